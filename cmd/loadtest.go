@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"github.com/Pixboost/transformimgs/v8/img"
+	"github.com/Pixboost/transformimgs/v8/loadtest"
+	"net/http"
+	"os"
+)
+
+// runLoadTest runs "loadtest" subcommand and returns exit code.
+func runLoadTest(args []string) int {
+	var (
+		target      string
+		manifest    string
+		requests    int
+		concurrency int
+		accept      string
+		compareAsIs bool
+	)
+	flags := flag.NewFlagSet("loadtest", flag.ExitOnError)
+	flags.StringVar(&target, "target", "http://localhost:8080", "Base URL of the running instance")
+	flags.StringVar(&manifest, "manifest", "", "File with request paths, one per line, e.g. /img/https://site.com/img.png/resize?size=300")
+	flags.IntVar(&requests, "requests", 0, "Total number of requests. Defaults to the number of lines in the manifest")
+	flags.IntVar(&concurrency, "concurrency", 1, "Number of requests in flight")
+	flags.StringVar(&accept, "accept", "image/avif,image/webp,*/*", "Accept header to send")
+	flags.BoolVar(&compareAsIs, "compareAsIs", false, "Load original images using /asis to report bytes saved")
+	_ = flags.Parse(args)
+
+	f, err := os.Open(manifest)
+	if err != nil {
+		img.Log.Errorf("Can't open manifest: %+v", err)
+		return 1
+	}
+	paths, err := loadtest.ReadManifest(f)
+	_ = f.Close()
+	if err != nil {
+		img.Log.Errorf("Can't read manifest: %+v", err)
+		return 1
+	}
+
+	report, err := loadtest.Run(context.Background(), &loadtest.Config{
+		Target:      target,
+		Manifest:    paths,
+		Requests:    requests,
+		Concurrency: concurrency,
+		Headers:     http.Header{"Accept": {accept}},
+		CompareAsIs: compareAsIs,
+	})
+	if err != nil {
+		img.Log.Errorf("Load test failed: %+v", err)
+		return 2
+	}
+
+	report.Print(os.Stdout)
+	return 0
+}
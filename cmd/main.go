@@ -1,52 +1,757 @@
 package main
 
 import (
+	"crypto/subtle"
 	"flag"
+	"fmt"
 	"github.com/Pixboost/transformimgs/v8/img"
 	"github.com/Pixboost/transformimgs/v8/img/loader"
 	"github.com/Pixboost/transformimgs/v8/img/processor"
 	"github.com/dooman87/kolibri/health"
+	"net"
 	"net/http"
+	"net/http/pprof"
 	"os"
 	"runtime"
+	"strings"
+	"time"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "loadtest" {
+		os.Exit(runLoadTest(os.Args[2:]))
+	}
+
 	var (
 		im              string
 		imIdent         string
 		cache           int
+		originCache     bool
+		originOptOut    bool
+		minCache        int
+		maxCache        int
 		procNum         int
 		disableSaveData bool
+		saveDataPolicy  string
+		parallelOpt     bool
+		fastDownscale   bool
+		gifLossy        float64
+		skipOptimised   bool
+		threadLimit     int
+		warmUpFormats   string
+		retryTransient  bool
+		reduceColors    bool
+		memoryBudget    int64
+		memoryWait      time.Duration
+		serverTiming    bool
+		processedBy     bool
+		instanceId      string
+		slowLog         time.Duration
+		slowLogSample   float64
+		inProcess       bool
+		cbThreshold     int
+		cbCoolDown      time.Duration
+		shadowRate      float64
+		shadowArgs      string
+		srgbProfile     string
+		cmykProfile     string
+		wideGamut       bool
+		maxFrames       int
+		maxOutFrames    int
+		maxAnimSize     int
+		maxDppx         float64
+		scaleByDppx     bool
+		variantCache    int64
+		disableSniffing bool
+		qualityConfig   string
+		targetSSIM      float64
+		networkHints    bool
+		slowDownlink    float64
+		maxBytes        int
+		maxWidth        int
+		maxHeight       int
+		rejectOversized bool
+		queueWeights    string
+		avifPolicies    string
+		digestHeaders   string
+		saveDataMax     int
+		hidden          string
+		noContent       bool
+		botMode         string
+		botMaxSize      int
+		botPatterns     string
+		botExclusions   string
+		fallbacks       string
+		normalizeUrls   bool
+		stripParams     string
+		forceHttps      bool
+		querySeparators string
+		sourceBase      string
+		defaultScheme   string
+		forwardedProtos string
+		maxDimension    int
+		debug           bool
+		stats           bool
+		metricsEnabled  bool
+		otlpUrl         string
+		otlpService     string
+		traceSample     float64
+		metrics         *img.Metrics
+		status          bool
+		adminAuth       string
+		maxMontage      int
+		maxSprite       int
+		maxLadder       int
+		cardTemplates   string
+		tileSize        int
+		dialects        string
+		exifGps         bool
+		tlsOpts         tlsOptions
+		listenOpts      listenOptions
+		protocolOpts    protocolOptions
+		disableRoutes   string
+		aliases         string
+		routePrefixes   string
+		problemDetails  bool
+		sourceLists     sourceListsOptions
+		allowNetworks   string
+		adminNetworks   string
+		adminAddr       string
+		trustedProxies  string
+		moderation      img.Moderation
+		moderationUrl   string
+		placeholder     string
+		sentryDsn       string
+		signingKeys     string
+		audit           img.Audit
+		auditLog        string
+		auditUrl        string
+		sentryEnv       string
+		reportSource    string
+		procName        string
+		loaderName      string
+		originLimits    loader.Limits
+		maxSourceSize   int64
+		dedupLoads      bool
+		originMirrors   string
+		sigV4           loader.SigV4
+		sigV4Hosts      string
 	)
 	flag.StringVar(&im, "imConvert", "", "Imagemagick convert command")
 	flag.StringVar(&imIdent, "imIdentify", "", "Imagemagick identify command")
 	flag.IntVar(&cache, "cache", 2592000,
 		"Number of seconds to cache image after transformation (0 to disable cache). Default value is 2592000 (30 days)")
+	flag.BoolVar(&originCache, "originCacheControl", false, "If set to true then max-age of responses is taken from Cache-Control or Expires headers of source images. -cache is used for sources without them.")
+	flag.BoolVar(&originOptOut, "originOptOut", false, "If set to true then X-Robots-Tag headers of source images are passed through and responses of private or no-store sources are not cached.")
+	flag.IntVar(&minCache, "minCache", 0, "Minimum max-age in seconds of responses with -originCacheControl. 0 disables the limit.")
+	flag.IntVar(&maxCache, "maxCache", 0, "Maximum max-age in seconds of responses with -originCacheControl. 0 disables the limit.")
 	flag.IntVar(&procNum, "proc", runtime.NumCPU(), "Number of images processors to run. Defaults to number of CPUs")
 	flag.BoolVar(&disableSaveData, "disableSaveData", false, "If set to true then will disable Save-Data client hint. Could be useful for CDNs that don't support Save-Data header in Vary.")
-	flag.Parse()
+	flag.StringVar(&saveDataPolicy, "saveDataPolicy", "default", "Policy for Save-Data client hint: default reduces images, hide serves empty images and off ignores Save-Data.")
+	flag.BoolVar(&parallelOpt, "parallelOptimise", false, "If set to true then optimise will encode image to all supported next generation formats in parallel and return the smallest.")
+	flag.BoolVar(&fastDownscale, "fastDownscale", false, "If set to true then large images will be scaled down to the intermediate size using a cheap algorithm before resize.")
+	flag.Float64Var(&gifLossy, "gifLossy", 0, "Lossiness of GIF output in percent, e.g. 5. Duplicate frames are removed, colors are reduced and similar pixels are merged. 0 disables lossy GIF optimisation.")
+	flag.IntVar(&threadLimit, "imThreadLimit", 0, "Maximum number of threads of each ImageMagick command. 0 means number of CPUs divided by number of processors (-proc flag).")
+	flag.StringVar(&warmUpFormats, "warmUpFormats", strings.Join(processor.WarmUpFormats, ","), "Comma separated list of output formats that are encoded on startup, so delegates are loaded and missing ones are reported before the first request. Empty list disables the warm-up.")
+	flag.BoolVar(&reduceColors, "reduceColorTypes", false, "If set to true then grayscale images and images with binary alpha channel, e.g. logos and icons, are encoded as palette or grayscale PNG and grayscale JPEG or WebP.")
+	flag.BoolVar(&retryTransient, "retryTransient", false, "If set to true then transformations that fail with transient ImageMagick errors, e.g. resource limit is hit, are retried once with the fallback format.")
+	flag.BoolVar(&skipOptimised, "skipOptimised", false, "Returns sources that are already optimised, e.g. tiny images or JPEG/WebP/AVIF with low quality, without encoding them on optimise.")
+	flag.Int64Var(&memoryBudget, "memoryBudget", 0, "Maximum estimated memory in MiB of decoded images that are transformed at the same time. 0 disables the limit.")
+	flag.DurationVar(&memoryWait, "memoryBudgetWait", 30*time.Second, "How long to wait for the memory budget to be available before responding with 503.")
+	flag.DurationVar(&slowLog, "slowLog", 0, "Duration of requests after which timings, source info and ImageMagick arguments are logged, e.g. 2s. 0 disables the threshold.")
+	flag.Float64Var(&slowLogSample, "slowLogSample", 0, "Percentage of requests that are logged with timings, source info and ImageMagick arguments regardless of their duration, e.g. 0.1. 0 disables sampling.")
+	flag.BoolVar(&processedBy, "processedBy", false, "If set to true then X-Processed-By header with the instance id, the queue and timings of the transformation will be added to responses.")
+	flag.StringVar(&instanceId, "instanceId", "", "Id of the instance in X-Processed-By header. Host name is used if empty.")
+	flag.BoolVar(&serverTiming, "serverTiming", false, "If set to true then Server-Timing header with queue wait and transformation time will be added to responses.")
+	flag.BoolVar(&inProcess, "inProcess", false, "If set to true then ImageMagick will run in-process using MagickWand API. Requires build with magickwand tag.")
+	flag.IntVar(&cbThreshold, "circuitBreakerThreshold", 0, "Number of consecutive processor failures after which original images are served as is for the cool-down period. 0 disables circuit breaker.")
+	flag.DurationVar(&cbCoolDown, "circuitBreakerCoolDown", 30*time.Second, "Cool-down period of the circuit breaker.")
+	flag.Float64Var(&shadowRate, "shadowSampleRate", 0, "Share of transformations (0 to 1) that will also be run in the background with -shadowConvertArgs to compare size, latency and SSIM. 0 disables shadow mode.")
+	flag.StringVar(&shadowArgs, "shadowConvertArgs", "", "Space separated additional ImageMagick convert arguments for the shadow processor.")
+	flag.StringVar(&srgbProfile, "srgbProfile", "", "Path to sRGB ICC profile. If set, then images with embedded ICC profiles (e.g. CMYK) will be converted to sRGB using profiles.")
+	flag.StringVar(&cmykProfile, "cmykProfile", "", "Path to CMYK ICC profile for CMYK images without embedded profile. Used with -srgbProfile.")
+	flag.BoolVar(&wideGamut, "preserveWideGamut", false, "If set to true then wide-gamut ICC profiles, e.g. Display P3, will be kept in the output instead of converting to sRGB.")
+	flag.IntVar(&maxFrames, "maxAnimationFrames", 0, "Maximum number of frames in animated images. Bigger animations will be rejected with 413. 0 disables the limit.")
+	flag.IntVar(&maxOutFrames, "maxOutputFrames", 0, "Maximum number of frames of output animations. Longer animations are sampled evenly keeping their duration. 0 disables the limit.")
+	flag.IntVar(&maxAnimSize, "maxAnimationSize", 0, "Maximum frame size of animated images in pixels (width * height). Bigger animations will be rejected with 413. 0 disables the limit.")
+	flag.Float64Var(&maxDppx, "maxDppx", 4, "Maximum value of dppx query param. Bigger values are clamped. 0 disables the limit.")
+	flag.BoolVar(&scaleByDppx, "scaleByDppx", false, "If set to true then size param is in CSS pixels and will be multiplied by dppx param.")
+	flag.Int64Var(&variantCache, "dppxVariantCache", 0, "Size in MiB of the cache of high density results of resize and fit, which are downscaled to serve lower density variants instead of decoding sources. Requires -scaleByDppx. 0 disables the cache.")
+	flag.BoolVar(&disableSniffing, "disableMimeSniffing", false, "If set to true then Content-Type of the source will be trusted instead of detecting MIME type from the content.")
+	flag.StringVar(&qualityConfig, "qualityConfig", "", "Path to JSON file with quality of output images for each format. Built-in quality ladder is used if not set.")
+	flag.Float64Var(&targetSSIM, "targetSSIM", 0, "If set then quality of lossy images will be searched for each image to get the smallest result with SSIM not less than the target, e.g. 0.98. 0 disables the search.")
+	flag.BoolVar(&networkHints, "networkHints", false, "If set to true then ECT and Downlink client hints will be used to serve lower quality images on slow networks. CDN must support ECT and Downlink in Vary header.")
+	flag.Float64Var(&slowDownlink, "slowDownlink", 1.5, "Bandwidth in Mbps from Downlink client hint below which network is considered slow. 0 disables the check.")
+	flag.StringVar(&digestHeaders, "digestHeaders", "", "Comma separated list of headers with SHA-256 digest of the response body: X-Content-Digest (hex) and/or Digest (RFC 3230). Digest is not added if empty.")
+	flag.StringVar(&avifPolicies, "avif", "", "Comma separated list of AVIF policies of operations, e.g. optimise=10,fit=off,*=5. The value is the minimum percentage by which AVIF must be smaller than the next best format or off to disable AVIF. * applies to other operations. AVIF is served whenever selected if empty.")
+	flag.StringVar(&queueWeights, "queueWeights", "", "Comma separated list of weights of operations for weighted fair scheduling, e.g. asis=4,optimise=2,resize=2. Classes are asis, other and names of operations. Empty disables the scheduling.")
+	flag.IntVar(&maxWidth, "maxWidth", 0, "Maximum width in pixels of resize, fit and upscale operations. Bigger sizes are scaled down preserving the aspect ratio. 0 disables the limit.")
+	flag.IntVar(&maxHeight, "maxHeight", 0, "Maximum height in pixels of resize, fit and upscale operations. Bigger sizes are scaled down preserving the aspect ratio. 0 disables the limit.")
+	flag.BoolVar(&rejectOversized, "rejectOversized", false, "If set to true then sizes bigger than maxWidth or maxHeight are rejected with 400 status instead of scaling them down.")
+	flag.IntVar(&maxBytes, "maxBytes", 0, "Default limit of the response size in bytes, see max-bytes query param. 0 disables the limit.")
+	flag.StringVar(&hidden, "placeholder", "", "Path to the image that is served instead of images hidden by Save-Data. Empty 1x1 GIF is served if empty.")
+	flag.BoolVar(&noContent, "placeholderNoContent", false, "If set to true then hidden images are responded with 204 status without body instead of the placeholder.")
+	flag.IntVar(&saveDataMax, "saveDataMaxSize", 0, "Maximum width and height in pixels of images when Save-Data is on. 0 disables the limit.")
+	flag.StringVar(&botMode, "botMode", "off", "How images are served to crawlers and link preview bots identified by User-Agent: off serves them as usual, reduce serves low quality images and original serves source images without transformation.")
+	flag.IntVar(&botMaxSize, "botMaxSize", 0, "Maximum width and height in pixels of images served to bots with -botMode=reduce. 0 disables the limit.")
+	flag.StringVar(&botPatterns, "botPatterns", strings.Join(img.DefaultBotPatterns, ","), "Comma separated list of case-insensitive parts of User-Agent of bots.")
+	flag.StringVar(&fallbacks, "formatFallbacks", "", "Output formats of clients identified by User-Agent when Accept header is not enough: default uses built-in fallbacks for old Android and Safari, otherwise path to JSON file with fallbacks. User-Agent is added to Vary header. Empty disables fallbacks.")
+	flag.StringVar(&botExclusions, "botExclusions", strings.Join(img.DefaultBotExclusions, ","), "Comma separated list of case-insensitive parts of User-Agent of bots that are served as usual, e.g. image search crawlers.")
+	flag.BoolVar(&normalizeUrls, "normalizeUrls", false, "If set to true then source URLs are canonicalized before loading: scheme and host are lowercased, default ports and fragments are removed, the path is re-encoded, tracking params are removed and query params are sorted.")
+	flag.StringVar(&stripParams, "stripParams", strings.Join(img.DefaultStripParams, ","), "Comma separated list of query params that are removed from source URLs with -normalizeUrls. Names ending with * are prefixes.")
+	flag.BoolVar(&forceHttps, "forceHttps", false, "If set to true then http source URLs are loaded using https. Requires -normalizeUrls.")
+	flag.StringVar(&sourceBase, "sourceBase", "", "Base URL of source images, e.g. https://origin.site.com/images. Source URLs without scheme, e.g. /img/products/1.jpg/resize, are loaded from the base URL.")
+	flag.StringVar(&defaultScheme, "defaultScheme", "", "Scheme of protocol relative source URLs, e.g. //site.com/img.png, when X-Forwarded-Proto header is absent or not allowed. Empty leaves such URLs as is.")
+	flag.StringVar(&forwardedProtos, "forwardedProtos", strings.Join(img.DefaultForwardedProtos, ","), "Comma separated list of allowed values of X-Forwarded-Proto header that are used as the scheme of protocol relative source URLs. The header is only honored from -trustedProxies.")
+	flag.StringVar(&querySeparators, "querySeparators", "off", "How requests with un-encoded ? in the source URL, e.g. /img/https://site.com/img.png?v=3/resize, are handled: off responds with 404, reject responds with 400 and rewrite reconstructs the source URL from the request URI.")
+	flag.IntVar(&maxDimension, "maxDimension", 10000, "Maximum width and height in pixels that could be requested in size param. 0 disables the limit.")
+	flag.BoolVar(&debug, "debug", false, "If set to true then debug query param will add headers with output format, quality and ImageMagick arguments to responses. Should not be enabled publicly.")
+	flag.BoolVar(&metricsEnabled, "metrics", false, "If set to true then latency of transformations and processor commands, queue wait, sizes, output formats and errors are exposed on /metrics as Prometheus histograms and counters.")
+	flag.StringVar(&otlpUrl, "otlpTracesUrl", "", "URL of traces endpoint of OpenTelemetry collector, e.g. http://localhost:4318/v1/traces. Requests are traced with spans of loading, queue wait, ImageMagick commands and writing of the response. Tracing is disabled if empty.")
+	flag.StringVar(&otlpService, "otlpServiceName", "transformimgs", "Name of the service in traces.")
+	flag.Float64Var(&traceSample, "traceSample", 100, "Percentage of requests without traceparent header that are traced. Requests with traceparent are traced if the parent is sampled.")
+	flag.BoolVar(&stats, "stats", false, "If set to true then sizes of source and transformed images will be tracked and exposed on /stats as JSON and on /metrics in Prometheus format.")
+	flag.BoolVar(&status, "status", false, "If set to true then HTML status page with uptime, queue, recent errors and top source hosts will be served on /status. Requires -adminBasicAuth or -adminAddr.")
+	flag.IntVar(&maxMontage, "maxMontageImages", 36, "Maximum number of source images in the montage. 0 disables the limit.")
+	flag.IntVar(&maxSprite, "maxSpriteImages", 100, "Maximum number of source images in the sprite sheet. 0 disables the limit.")
+	flag.IntVar(&maxLadder, "maxLadderWidths", 10, "Maximum number of widths in the ladder. 0 disables the limit.")
+	flag.StringVar(&cardTemplates, "cardTemplates", "", "Path to YAML file with templates of social cards available on /card/{template}.")
+	flag.IntVar(&tileSize, "tileSize", 512, "Size of Deep Zoom and IIIF tiles in pixels.")
+	flag.StringVar(&dialects, "dialects", "", "Comma separated list of URL dialects of other image services to enable, e.g. cloudinary.")
+	flag.StringVar(&disableRoutes, "disableRoutes", "", "Comma separated list of routes to disable, e.g. asis,fit.")
+	flag.StringVar(&aliases, "aliases", "", "Comma separated list of presets of operations served on /img/{url}/{alias}, e.g. thumb=fit?size=200x200,hero=resize?size=1200.")
+	flag.StringVar(&routePrefixes, "routePrefixes", "", "Comma separated list of path prefixes under which routes are also served, e.g. /v2.")
+	flag.BoolVar(&problemDetails, "problemDetails", false, "If set to true then all errors are returned as RFC 7807 problem details JSON with machine-readable codes. Otherwise, only requests that accept application/json get them.")
+	flag.StringVar(&sourceLists.allowFile, "sourceAllowlist", "", "Path to file with patterns of allowed source URLs, one per line, e.g. https://*.site.com/*. All sources are allowed if not set.")
+	flag.StringVar(&sourceLists.blockFile, "sourceBlocklist", "", "Path to file with patterns of blocked source URLs, one per line. Patterns with re: prefix are regular expressions.")
+	flag.DurationVar(&sourceLists.reload, "sourceListsReload", 10*time.Second, "How often to check source allowlist and blocklist files for changes. 0 disables reloading.")
+	flag.StringVar(&allowNetworks, "allowNetworks", "", "Comma separated list of networks in CIDR notation, e.g. 10.0.0.0/8, that have access to all endpoints. Everyone has access if not set.")
+	flag.StringVar(&adminNetworks, "adminAllowNetworks", "", "Comma separated list of networks in CIDR notation that have access to /stats, /metrics, /status and /debug/pprof. Everyone has access if not set.")
+	flag.StringVar(&adminAddr, "adminAddr", "", "Address of the admin listener for /health, /stats, /metrics, /status and /debug/pprof, e.g. :8081. Operational endpoints are served on the image port if not set.")
+	flag.StringVar(&adminAuth, "adminBasicAuth", "", "Credentials in user:password format that are required to access /stats, /metrics, /status and /debug/pprof using HTTP basic authentication.")
+	flag.StringVar(&trustedProxies, "trustedProxies", "", "Comma separated list of networks in CIDR notation of proxies whose X-Forwarded-For header is used to get IP address of the client. X-Forwarded-Proto and X-Forwarded-Host headers are only honored from these proxies and ignored by default.")
+	flag.StringVar(&moderationUrl, "moderationUrl", "", "URL of the moderation API. Images are sent in the body of POST request and API must respond with JSON {\"flagged\": true|false}.")
+	flag.BoolVar(&moderation.Results, "moderationResults", false, "If set to true then transformed images will be moderated instead of source images.")
+	flag.BoolVar(&moderation.Async, "moderationAsync", false, "If set to true then images will be moderated in the background and served with no-store Cache-Control until the verdict.")
+	flag.BoolVar(&moderation.FailClosed, "moderationFailClosed", false, "If set to true then 503 will be returned when moderation API fails. Images are served by default.")
+	flag.StringVar(&placeholder, "moderationPlaceholder", "", "Path to the image that replaces flagged images. Flagged images are rejected with 451 if not set.")
+	flag.StringVar(&auditLog, "auditLog", "", "Path to the append-only audit log of served images in JSON lines format. Records include IP address of the client, source, params and size of the response.")
+	flag.StringVar(&auditUrl, "auditUrl", "", "URL of the audit log collector. Each record is sent as JSON in the body of POST request.")
+	flag.StringVar(&audit.UserHeader, "auditUserHeader", "", "Name of the request header with the id of the user that is recorded in the audit log, e.g. X-Forwarded-User.")
+	flag.BoolVar(&audit.FailClosed, "auditFailClosed", false, "If set to true then 503 will be returned when the audit record could not be written. Images are served by default.")
+	flag.StringVar(&signingKeys, "signingKeys", "", "Comma separated list of secret keys of signed URLs. Requests without valid sig query param are rejected with 403. The first key signs URLs, others are accepted during rotation. URLs are not signed if empty.")
+	flag.StringVar(&sentryDsn, "sentryDsn", "", "Sentry DSN to report failed transformations with server errors, e.g. https://key@o1.ingest.sentry.io/123. Disabled if not set.")
+	flag.StringVar(&sentryEnv, "sentryEnvironment", "", "Name of the environment in Sentry reports, e.g. production.")
+	flag.StringVar(&reportSource, "errorReportSource", "full", "How URLs of source images are reported: full, hash (SHA-256 of the URL) or redact (only the host).")
+	flag.BoolVar(&exifGps, "exifGps", false, "If set to true then GPS location will be returned on /img/{imgUrl}/exif. Location is redacted by default.")
+	flag.StringVar(&tlsOpts.addr, "tlsAddr", ":8443", "Address of HTTPS listener, e.g. :443. HTTPS is enabled when tlsCert and tlsKey or autocertDomains are set.")
+	flag.StringVar(&tlsOpts.certFile, "tlsCert", "", "Path to PEM encoded TLS certificate for HTTPS.")
+	flag.StringVar(&tlsOpts.keyFile, "tlsKey", "", "Path to PEM encoded TLS private key for HTTPS.")
+	flag.StringVar(&tlsOpts.domains, "autocertDomains", "", "Comma separated list of domains to get Let's Encrypt certificates for. Port 80 must be forwarded to HTTP listener for ACME challenges.")
+	flag.StringVar(&tlsOpts.cacheDir, "autocertCache", "autocert", "Directory to store Let's Encrypt certificates.")
+	flag.StringVar(&tlsOpts.email, "autocertEmail", "", "Contact email for Let's Encrypt account, e.g. to receive notifications about expiring certificates.")
+	flag.StringVar(&listenOpts.unixSocket, "unixSocket", "", "Path of unix domain socket to listen for HTTP requests on instead of port 8080, e.g. /run/transformimgs/http.sock.")
+	flag.BoolVar(&listenOpts.systemd, "systemdSocket", false, "If set to true then sockets passed by systemd socket activation will be used: the first one for HTTP and the second one for HTTPS.")
+	flag.BoolVar(&protocolOpts.h2c, "h2c", false, "If set to true then HTTP listener will accept HTTP/2 without TLS, e.g. from proxies that support it.")
+	flag.BoolVar(&protocolOpts.http3, "http3", false, "If set to true then HTTP/3 over QUIC will be served on UDP port of HTTPS listener. Requires HTTPS.")
+	flag.IntVar(&listenOpts.writeBufferSize, "writeBufferSize", 0, "Size of send buffer of TCP connections in bytes, e.g. 1048576 for large images on high latency networks. 0 uses the operating system default.")
+	flag.StringVar(&procName, "processor", "imagemagick", "Name of the registered image processor.")
+	flag.StringVar(&loaderName, "loader", "http", "Name of the registered loader of source images.")
+	flag.IntVar(&originLimits.MaxPerHost, "originConnsPerHost", 0, "Maximum number of concurrent requests to one origin host. Other requests wait in the queue. 0 disables the limit.")
+	flag.BoolVar(&dedupLoads, "dedupLoads", false, "If set to true then concurrent requests of the same source image share one download from the origin.")
+	flag.Int64Var(&maxSourceSize, "maxSourceSize", 0, "Maximum size of source images in bytes. Loading of bigger images is aborted with 413 status. 0 disables the limit.")
+	flag.IntVar(&originLimits.MaxTotal, "originConns", 0, "Maximum number of concurrent requests to all origins. Other requests wait in the queue. 0 disables the limit.")
+	flag.StringVar(&sigV4.Region, "originSigV4Region", "", "AWS region of private origins, e.g. us-east-1. Requests to origins are signed with AWS Signature Version 4 using credentials from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN environment variables. Requests are not signed if empty.")
+	flag.StringVar(&sigV4.Service, "originSigV4Service", "s3", "AWS service of private origins, e.g. s3 or execute-api.")
+	flag.StringVar(&sigV4Hosts, "originSigV4Hosts", "", "Comma separated list of hosts of private origins that are signed with -originSigV4Region. Required if -originSigV4Region is set, requests to other hosts are not signed.")
+	flag.StringVar(&originMirrors, "originMirrors", "", "Comma separated list of mirrors of origin hosts, e.g. site.com=mirror1.site.com|mirror2.site.com. Images are loaded from mirrors in turn when the origin fails with a server error or timeout.")
+
+	// Flags of ImageMagick are ignored by other processors
+	img.RegisterProcessor("imagemagick", func() (img.Processor, error) {
+		var (
+			p   *processor.ImageMagick
+			err error
+		)
+		if inProcess {
+			p, err = newImageMagickWand()
+		} else {
+			p, err = processor.NewImageMagick(im, imIdent)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(qualityConfig) > 0 {
+			p.QualityLadder, err = loadQualityLadder(qualityConfig)
+			if err != nil {
+				return nil, fmt.Errorf("can't load quality config: %w", err)
+			}
+		}
+		p.ParallelOptimise = parallelOpt
+		p.FastDownscale = fastDownscale
+		p.GifLossy = gifLossy
+		p.SkipOptimised = skipOptimised
+		p.RetryTransient = retryTransient
+		p.ReduceColorTypes = reduceColors
+		p.Metrics = metrics
+		p.ThreadLimit = threadLimit
+		if threadLimit == 0 {
+			p.ThreadLimit = processor.DefaultThreadLimit(procNum)
+		}
+		p.TargetSSIM = targetSSIM
+		p.SRGBProfile = srgbProfile
+		p.CMYKProfile = cmykProfile
+		p.PreserveWideGamut = wideGamut
+		p.MaxAnimationFrames = maxFrames
+		p.MaxAnimationSize = maxAnimSize
+		if len(warmUpFormats) > 0 {
+			if err = p.WarmUp(strings.Split(warmUpFormats, ",")); err != nil {
+				return nil, err
+			}
+		}
 
-	p, err := processor.NewImageMagick(im, imIdent)
+		if shadowRate > 0 {
+			secondary := *p
+			secondary.AdditionalArgs = append(append([]string{}, p.AdditionalArgs...), strings.Fields(shadowArgs)...)
+			return &img.Shadow{
+				Primary:    p,
+				Secondary:  &secondary,
+				SampleRate: shadowRate,
+				Compare:    p.CompareSSIM,
+			}, nil
+		}
+		return p, nil
+	})
+	img.RegisterLoader("http", func() (img.Loader, error) {
+		mirrors, err := loader.ParseMirrors(originMirrors)
+		if err != nil {
+			return nil, fmt.Errorf("can't parse origin mirrors: %w", err)
+		}
+		httpLoader := &loader.Http{Limits: &originLimits, MaxSize: maxSourceSize, Mirrors: mirrors}
+		accessKey, secretKey := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+		if len(sigV4.Region) > 0 {
+			var hosts []string
+			for _, host := range strings.Split(sigV4Hosts, ",") {
+				if host = strings.TrimSpace(host); len(host) > 0 {
+					hosts = append(hosts, host)
+				}
+			}
+			if len(hosts) == 0 {
+				return nil, fmt.Errorf("-originSigV4Region requires -originSigV4Hosts")
+			}
+			if len(accessKey) == 0 || len(secretKey) == 0 {
+				return nil, fmt.Errorf("-originSigV4Region requires AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+			}
+			signer, err := loader.NewSigV4Signer(accessKey, secretKey, os.Getenv("AWS_SESSION_TOKEN"), sigV4.Region, sigV4.Service, hosts)
+			if err != nil {
+				return nil, fmt.Errorf("can't create SigV4 signer: %w", err)
+			}
+			httpLoader.Signer = signer
+		} else if len(sigV4Hosts) > 0 {
+			return nil, fmt.Errorf("-originSigV4Hosts requires -originSigV4Region")
+		}
+		if dedupLoads {
+			return &loader.Dedup{Loader: httpLoader}, nil
+		}
+		return httpLoader, nil
+	})
 
+	flag.Parse()
+
+	if metricsEnabled {
+		metrics = img.NewMetrics()
+	}
+	imgProc, err := img.NewProcessor(procName)
 	if err != nil {
-		img.Log.Errorf("Can't create image magic processor: %+v", err)
+		img.Log.Errorf("Can't create image processor: %+v", err)
 		os.Exit(1)
 	}
+	imgLoader, err := img.NewLoader(loaderName)
+	if err != nil {
+		img.Log.Errorf("Can't create loader: %+v", err)
+		os.Exit(1)
+	}
+
+	if tileSize <= 0 {
+		img.Log.Errorf("tileSize must be positive, but got [%d]", tileSize)
+		os.Exit(1)
+	}
+	if cbThreshold > 0 {
+		imgProc = img.NewCircuitBreaker(imgProc, cbThreshold, cbCoolDown)
+	}
+	weights, err := img.ParseQueueWeights(queueWeights)
+	if err != nil {
+		img.Log.Errorf("Can't parse queue weights: %+v", err)
+		os.Exit(2)
+	}
+	avif, err := img.ParseAvifPolicies(avifPolicies)
+	if err != nil {
+		img.Log.Errorf("Can't parse AVIF policies: %+v", err)
+		os.Exit(2)
+	}
+
+	var digests []string
+	for _, name := range strings.Split(digestHeaders, ",") {
+		name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+		if len(name) == 0 {
+			continue
+		}
+		if name != img.ContentDigestHeader && name != img.DigestHeader {
+			img.Log.Errorf("Unknown digest header [%s], headers are [%s, %s]", name, img.ContentDigestHeader, img.DigestHeader)
+			os.Exit(2)
+		}
+		digests = append(digests, name)
+	}
 
-	img.CacheTTL = cache
-	img.SaveDataEnabled = !disableSaveData
-	srv, err := img.NewService(&loader.Http{}, p, procNum)
+	srv, err := img.NewServiceWithConfig(imgLoader, imgProc, procNum, &img.ServiceConfig{
+		CacheTTL:           cache,
+		OriginCacheControl: originCache,
+		OriginOptOut:       originOptOut,
+		MinCacheTTL:        minCache,
+		MaxCacheTTL:        maxCache,
+		MaxDppx:            maxDppx,
+		NetworkHints:       networkHints,
+		SlowDownlink:       slowDownlink,
+		MaxWidth:           maxWidth,
+		MaxHeight:          maxHeight,
+		RejectOversized:    rejectOversized,
+		MaxDimension:       maxDimension,
+		MaxMontageImages:   maxMontage,
+		MaxSpriteImages:    maxSprite,
+		MaxLadderWidths:    maxLadder,
+		TileSize:           tileSize,
+		MaxBytes:           maxBytes,
+		MaxFrames:          maxOutFrames,
+		QueueWeights:       weights,
+		AvifPolicies:       avif,
+		DigestHeaders:      digests,
+		SourceBase:         sourceBase,
+		DefaultScheme:      defaultScheme,
+		ForwardedProtos:    splitList(forwardedProtos),
+		ProblemDetails:     problemDetails,
+	})
 	if err != nil {
 		img.Log.Errorf("Can't create image service: %+v", err)
 		os.Exit(2)
 	}
+	if disableSaveData {
+		saveDataPolicy = "off"
+	}
+	switch saveDataPolicy {
+	case "default":
+		srv.SaveData = &img.DefaultSaveDataPolicy{MaxSize: saveDataMax, LowResScale: img.DefaultLowResScale}
+	case "hide":
+		srv.SaveData = img.HideSaveDataPolicy{}
+	case "off":
+		srv.SaveData = img.OffSaveDataPolicy{}
+	default:
+		img.Log.Errorf("Unknown Save-Data policy [%s]", saveDataPolicy)
+		os.Exit(2)
+	}
+	if len(hidden) > 0 || noContent {
+		srv.Placeholder = &img.Placeholder{NoContent: noContent}
+		if len(hidden) > 0 {
+			data, err := os.ReadFile(hidden)
+			if err != nil {
+				img.Log.Errorf("Can't read placeholder: %+v", err)
+				os.Exit(2)
+			}
+			srv.Placeholder.Image = &img.Image{Id: hidden, Data: data, MimeType: http.DetectContentType(data)}
+		}
+	}
+	bots, err := img.ParseBotMode(botMode)
+	if err != nil {
+		img.Log.Errorf("Invalid -botMode: %s", err)
+		os.Exit(2)
+	}
+	if bots != img.BotOff {
+		srv.Bots = &img.BotPolicy{
+			Mode:       bots,
+			Patterns:   splitList(botPatterns),
+			Exclusions: splitList(botExclusions),
+			MaxSize:    botMaxSize,
+		}
+	}
+	srv.QuerySeparators, err = img.ParseQuerySeparators(querySeparators)
+	if err != nil {
+		img.Log.Errorf("Invalid -querySeparators: %s", err)
+		os.Exit(2)
+	}
+	if normalizeUrls {
+		srv.NormalizeUrl = (&img.UrlNormalizer{
+			StripParams: splitList(stripParams),
+			ForceHttps:  forceHttps,
+		}).Normalize
+	} else if forceHttps {
+		img.Log.Errorf("-forceHttps requires -normalizeUrls")
+		os.Exit(2)
+	}
+	srv.ServerTiming = serverTiming
+	if processedBy {
+		if len(instanceId) == 0 {
+			instanceId, err = os.Hostname()
+			if err != nil {
+				img.Log.Errorf("Can't get host name for -processedBy, set -instanceId: %+v", err)
+				os.Exit(2)
+			}
+		}
+		srv.ProcessedBy = instanceId
+	}
+	if keys := img.ParseSigningKeys(signingKeys); len(keys) > 0 {
+		srv.Signer = &img.UrlSigner{Keys: keys}
+	}
+	if slowLog > 0 || slowLogSample > 0 {
+		srv.SlowLog = &img.SlowLog{Threshold: slowLog, SamplePercent: slowLogSample}
+	}
+	srv.ScaleByDppx = scaleByDppx
+	if variantCache > 0 {
+		if !scaleByDppx {
+			img.Log.Errorf("-dppxVariantCache requires -scaleByDppx")
+			os.Exit(2)
+		}
+		srv.Variants = img.NewVariantCache(variantCache * 1024 * 1024)
+	}
+	srv.SniffMimeType = !disableSniffing
+	srv.Debug = debug
+	srv.ExifGPS = exifGps
+	for _, name := range strings.Split(dialects, ",") {
+		name = strings.TrimSpace(name)
+		if len(name) == 0 {
+			continue
+		}
+		dialect, ok := img.KnownDialects[name]
+		if !ok {
+			img.Log.Errorf("Unknown URL dialect [%s]", name)
+			os.Exit(2)
+		}
+		if srv.Dialects == nil {
+			srv.Dialects = make(map[string]img.Dialect)
+		}
+		srv.Dialects[name] = dialect
+	}
+	routeNames := srv.RouteNames()
+	srv.Aliases, err = img.ParseAliases(aliases)
+	if err != nil {
+		img.Log.Errorf("Can't parse aliases: %+v", err)
+		os.Exit(2)
+	}
+	for name := range srv.Aliases {
+		for _, n := range routeNames {
+			if n == name {
+				img.Log.Errorf("Alias [%s] clashes with the route", name)
+				os.Exit(2)
+			}
+		}
+	}
+	srv.RoutePrefixes = splitList(routePrefixes)
+	routeNames = srv.RouteNames()
+	for _, name := range strings.Split(disableRoutes, ",") {
+		name = strings.TrimSpace(name)
+		if len(name) == 0 {
+			continue
+		}
+		known := false
+		for _, n := range routeNames {
+			known = known || n == name
+		}
+		if !known {
+			img.Log.Errorf("Unknown route [%s], routes are [%s]", name, strings.Join(routeNames, ", "))
+			os.Exit(2)
+		}
+		if srv.DisabledRoutes == nil {
+			srv.DisabledRoutes = make(map[string]bool)
+		}
+		srv.DisabledRoutes[name] = true
+	}
+	for name, alias := range srv.Aliases {
+		if srv.DisabledRoutes[alias.Op] {
+			img.Log.Errorf("Alias [%s] is of the disabled route [%s]", name, alias.Op)
+			os.Exit(2)
+		}
+	}
+	if len(sourceLists.allowFile) > 0 || len(sourceLists.blockFile) > 0 {
+		policy, err := newSourcePolicy(&sourceLists)
+		if err != nil {
+			img.Log.Errorf("Can't load source lists: %+v", err)
+			os.Exit(2)
+		}
+		srv.Use(&img.Hooks{PreLoad: policy.Check})
+	}
+	if len(moderationUrl) > 0 {
+		moderation.Moderator = &img.HttpModerator{Url: moderationUrl, Client: &http.Client{Timeout: 10 * time.Second}}
+		if len(placeholder) > 0 {
+			data, err := os.ReadFile(placeholder)
+			if err != nil {
+				img.Log.Errorf("Can't read moderation placeholder: %+v", err)
+				os.Exit(2)
+			}
+			moderation.Placeholder = &img.Image{Id: placeholder, Data: data, MimeType: http.DetectContentType(data)}
+		}
+		srv.Use(moderation.Hooks())
+	}
+	if len(sentryDsn) > 0 {
+		reporter, err := img.NewSentryReporter(sentryDsn)
+		if err != nil {
+			img.Log.Errorf("Can't create Sentry reporter: %+v", err)
+			os.Exit(2)
+		}
+		reporter.Environment = sentryEnv
+		srv.ErrorReporter = reporter
+	}
+	switch reportSource {
+	case "full":
+	case "hash":
+		srv.ReportSource = img.HashSource
+	case "redact":
+		srv.ReportSource = img.RedactSource
+	default:
+		img.Log.Errorf("Unknown error report source [%s]", reportSource)
+		os.Exit(2)
+	}
+	switch fallbacks {
+	case "":
+	case "default":
+		srv.FormatFallbacks = img.DefaultFormatFallbacks
+	default:
+		srv.FormatFallbacks, err = loadFormatFallbacks(fallbacks)
+		if err != nil {
+			img.Log.Errorf("Can't load format fallbacks: %+v", err)
+			os.Exit(2)
+		}
+	}
+	if len(cardTemplates) > 0 {
+		srv.CardTemplates, err = loadCardTemplates(cardTemplates)
+		if err != nil {
+			img.Log.Errorf("Can't load card templates: %+v", err)
+			os.Exit(2)
+		}
+	}
+	if memoryBudget > 0 {
+		srv.MemoryBudget, err = img.NewMemoryBudget(memoryBudget*1024*1024, memoryWait)
+		if err != nil {
+			img.Log.Errorf("Can't create memory budget: %+v", err)
+			os.Exit(2)
+		}
+	}
+
+	if stats {
+		srv.Savings = img.NewSavings()
+	}
+	srv.Metrics = metrics
+	if len(otlpUrl) > 0 {
+		srv.Tracing = &img.Tracing{
+			Exporter:      img.NewOtlpExporter(otlpUrl, otlpService),
+			SamplePercent: traceSample,
+		}
+	}
+	if status {
+		// The page lists source URLs and error messages, so it's never served publicly
+		if len(adminAuth) == 0 && len(adminAddr) == 0 {
+			img.Log.Errorf("-status requires -adminBasicAuth or -adminAddr")
+			os.Exit(2)
+		}
+		srv.Status = img.NewStatus()
+	}
+
+	proxies, err := img.ParseNetworks(trustedProxies)
+	if err != nil {
+		img.Log.Errorf("Can't parse trusted proxies: %+v", err)
+		os.Exit(2)
+	}
+	srv.Config.TrustedProxies = proxies
+	if len(auditLog) > 0 && len(auditUrl) > 0 {
+		img.Log.Errorf("auditLog and auditUrl could not be used together")
+		os.Exit(2)
+	}
+	if len(auditLog) > 0 {
+		sink, err := img.NewFileAuditSink(auditLog)
+		if err != nil {
+			img.Log.Errorf("Can't open audit log: %+v", err)
+			os.Exit(2)
+		}
+		audit.Sink = sink
+	}
+	if len(auditUrl) > 0 {
+		audit.Sink = &img.HttpAuditSink{Url: auditUrl, Client: &http.Client{Timeout: 10 * time.Second}}
+	}
+	if audit.Sink != nil {
+		audit.TrustedProxies = proxies
+		// Registered after other hooks, so only served images are recorded
+		srv.Use(audit.Hooks())
+	}
+	apiACL, err := newNetworkACL(allowNetworks, proxies)
+	if err != nil {
+		img.Log.Errorf("Can't parse allowed networks: %+v", err)
+		os.Exit(2)
+	}
+	adminACL, err := newNetworkACL(adminNetworks, proxies)
+	if err != nil {
+		img.Log.Errorf("Can't parse allowed admin networks: %+v", err)
+		os.Exit(2)
+	}
 
 	router := srv.GetRouter()
+	if apiACL != nil {
+		router.Use(apiACL.Handler)
+	}
 	router.HandleFunc("/health", health.Health)
+	// Operational endpoints are served on the admin listener if it's set,
+	// so the image port could be exposed publicly
+	adminRouter := http.NewServeMux()
+	handleAdmin := func(path string, handler http.Handler) {
+		if len(adminAuth) > 0 {
+			handler = basicAuth(adminAuth, handler)
+		}
+		if adminACL != nil {
+			handler = adminACL.Handler(handler)
+		}
+		if len(adminAddr) > 0 {
+			adminRouter.Handle(path, handler)
+		} else {
+			router.Handle(path, handler)
+		}
+	}
+	if srv.Savings != nil {
+		handleAdmin("/stats", http.HandlerFunc(srv.Savings.ServeStats))
+	}
+	if srv.Savings != nil || srv.Metrics != nil {
+		handleAdmin("/metrics", http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			if srv.Savings != nil {
+				srv.Savings.ServeMetrics(resp, req)
+			}
+			if srv.Metrics != nil {
+				srv.Metrics.ServeMetrics(resp, req)
+			}
+			if loaderName == "http" {
+				originLimits.ServeMetrics(resp, req)
+			}
+		}))
+	}
+	if srv.Status != nil {
+		handleAdmin("/status", http.HandlerFunc(srv.ServeStatus))
+	}
+	if len(adminAddr) > 0 {
+		adminRouter.HandleFunc("/health", health.Health)
+		handleAdmin("/debug/pprof/", http.HandlerFunc(pprof.Index))
+		handleAdmin("/debug/pprof/cmdline", http.HandlerFunc(pprof.Cmdline))
+		handleAdmin("/debug/pprof/profile", http.HandlerFunc(pprof.Profile))
+		handleAdmin("/debug/pprof/symbol", http.HandlerFunc(pprof.Symbol))
+		handleAdmin("/debug/pprof/trace", http.HandlerFunc(pprof.Trace))
+	}
 
-	img.Log.Printf("Running the application on port 8080...\n")
-	err = http.ListenAndServe(":8080", router)
+	servers, h3, err := newServers(":8080", router, &tlsOpts, &protocolOpts)
+	if err != nil {
+		img.Log.Errorf("Can't configure HTTPS: %+v", err)
+		os.Exit(2)
+	}
+	if len(adminAddr) > 0 {
+		servers = append(servers, &http.Server{Addr: adminAddr, Handler: adminRouter})
+	}
+	listeners, err := newListeners(servers, &listenOpts)
+	if err != nil {
+		img.Log.Errorf("Can't listen: %+v", err)
+		os.Exit(2)
+	}
+	err = serve(servers, listeners, h3)
 
 	if err != nil {
 		img.Log.Errorf("Error while stopping application: %+v", err)
@@ -54,3 +759,75 @@ func main() {
 	}
 	os.Exit(0)
 }
+
+// newNetworkACL returns ACL with allowed networks or nil if networks are not set.
+func newNetworkACL(networks string, proxies []*net.IPNet) (*img.NetworkACL, error) {
+	allowed, err := img.ParseNetworks(networks)
+	if err != nil || len(allowed) == 0 {
+		return nil, err
+	}
+	return &img.NetworkACL{Allowed: allowed, TrustedProxies: proxies}, nil
+}
+
+// splitList returns non-empty trimmed items of the comma separated list.
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// basicAuth returns the handler that requires HTTP basic authentication with credentials
+// in user:password format and passes authenticated requests to the next handler.
+func basicAuth(credentials string, next http.Handler) http.Handler {
+	user, password, _ := strings.Cut(credentials, ":")
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		reqUser, reqPassword, ok := req.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(reqUser), []byte(user)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(reqPassword), []byte(password)) != 1 {
+			resp.Header().Set("WWW-Authenticate", `Basic realm="transformimgs"`)
+			http.Error(resp, "unauthorised", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(resp, req)
+	})
+}
+
+func loadQualityLadder(path string) (processor.QualityLadder, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	return processor.LoadQualityLadder(f)
+}
+
+func loadCardTemplates(path string) (img.CardTemplates, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	return img.LoadCardTemplates(f)
+}
+
+func loadFormatFallbacks(path string) ([]*img.FormatFallback, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	return img.LoadFormatFallbacks(f)
+}
@@ -0,0 +1,12 @@
+//go:build !magickwand
+
+package main
+
+import (
+	"fmt"
+	"github.com/Pixboost/transformimgs/v8/img/processor"
+)
+
+func newImageMagickWand() (*processor.ImageMagick, error) {
+	return nil, fmt.Errorf("in-process ImageMagick is not available, application must be built with magickwand tag")
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/Pixboost/transformimgs/v8/img"
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// tlsOptions are options of HTTPS listener. HTTPS is disabled when neither certificate
+// files nor autocert domains are set.
+type tlsOptions struct {
+	addr     string
+	certFile string
+	keyFile  string
+	// domains are host names to get Let's Encrypt certificates for.
+	domains  string
+	cacheDir string
+	email    string
+}
+
+// protocolOptions are options of HTTP versions.
+type protocolOptions struct {
+	// h2c is the flag to accept HTTP/2 without TLS on HTTP listener, e.g. from proxies.
+	h2c bool
+	// http3 is the flag to serve HTTP/3 over QUIC on UDP port of HTTPS listener.
+	http3 bool
+}
+
+// newServers returns HTTP server and HTTPS server if it's enabled by TLS options.
+// HTTPS server supports HTTP/2 and advertises HTTP/3 server if it's enabled.
+// When autocert is used, HTTP server also responds to ACME HTTP-01 challenges.
+func newServers(addr string, handler http.Handler, opts *tlsOptions, protocols *protocolOptions) ([]*http.Server, *http3.Server, error) {
+	h2 := &http2.Server{}
+	httpServer := &http.Server{Addr: addr, Handler: handler}
+	if protocols.h2c {
+		httpServer.Handler = h2c.NewHandler(handler, h2)
+	}
+
+	var domains []string
+	for _, d := range strings.Split(opts.domains, ",") {
+		if d = strings.TrimSpace(d); len(d) > 0 {
+			domains = append(domains, d)
+		}
+	}
+
+	var tlsConfig *tls.Config
+	switch {
+	case len(domains) > 0 && (len(opts.certFile) > 0 || len(opts.keyFile) > 0):
+		return nil, nil, errors.New("autocert domains and certificate files could not be used together")
+	case len(domains) > 0:
+		if len(opts.cacheDir) == 0 {
+			return nil, nil, errors.New("autocert cache directory is required")
+		}
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(domains...),
+			Cache:      autocert.DirCache(opts.cacheDir),
+			Email:      opts.email,
+		}
+		httpServer.Handler = manager.HTTPHandler(httpServer.Handler)
+		tlsConfig = manager.TLSConfig()
+	case len(opts.certFile) > 0 || len(opts.keyFile) > 0:
+		if len(opts.certFile) == 0 || len(opts.keyFile) == 0 {
+			return nil, nil, errors.New("both certificate and key files are required")
+		}
+		cert, err := tls.LoadX509KeyPair(opts.certFile, opts.keyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	default:
+		if protocols.http3 {
+			return nil, nil, errors.New("HTTP/3 requires HTTPS")
+		}
+		return []*http.Server{httpServer}, nil, nil
+	}
+
+	tlsConfig.MinVersion = tls.VersionTLS12
+	httpsServer := &http.Server{Addr: opts.addr, Handler: handler, TLSConfig: tlsConfig}
+	if err := http2.ConfigureServer(httpsServer, h2); err != nil {
+		return nil, nil, err
+	}
+
+	var h3 *http3.Server
+	if protocols.http3 {
+		h3 = &http3.Server{Addr: opts.addr, Handler: handler, TLSConfig: tlsConfig}
+		httpsServer.Handler = http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			// Alt-Svc header is only available after HTTP/3 server started listening
+			_ = h3.SetQUICHeaders(resp.Header())
+			handler.ServeHTTP(resp, req)
+		})
+	}
+
+	return []*http.Server{httpServer, httpsServer}, h3, nil
+}
+
+// listenOptions are options of listeners for servers.
+type listenOptions struct {
+	// unixSocket is the path of unix domain socket for HTTP server instead of TCP address.
+	unixSocket string
+	// systemd is the flag to use sockets passed by systemd socket activation.
+	systemd bool
+	// writeBufferSize is the size of the send buffer of TCP connections in bytes.
+	// Operating system default is used if zero.
+	writeBufferSize int
+}
+
+// newListeners returns listeners for servers. Sockets passed by systemd are used for
+// servers in the same order, e.g. the first one for HTTP and the second one for HTTPS.
+// Other servers listen on the unix socket (HTTP only) or on their TCP addresses.
+func newListeners(servers []*http.Server, opts *listenOptions) ([]net.Listener, error) {
+	var inherited []net.Listener
+	if opts.systemd {
+		var err error
+		inherited, err = systemdListeners()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	listeners := make([]net.Listener, len(servers))
+	for i, s := range servers {
+		var err error
+		switch {
+		case i < len(inherited):
+			listeners[i] = inherited[i]
+		case i == 0 && len(opts.unixSocket) > 0:
+			listeners[i], err = listenUnix(opts.unixSocket)
+		default:
+			listeners[i], err = net.Listen("tcp", s.Addr)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if opts.writeBufferSize > 0 {
+			listeners[i] = &writeBufferListener{Listener: listeners[i], size: opts.writeBufferSize}
+		}
+	}
+	for i := len(servers); i < len(inherited); i++ {
+		img.Log.Printf("Ignoring extra socket %s passed by systemd\n", inherited[i].Addr())
+		_ = inherited[i].Close()
+	}
+
+	return listeners, nil
+}
+
+// systemdListeners returns sockets passed by systemd socket activation. Sockets start
+// from file descriptor 3 and their number is in LISTEN_FDS environment variable.
+func systemdListeners() ([]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, errors.New("no sockets passed by systemd, LISTEN_PID is not set to the process id")
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil, errors.New("no sockets passed by systemd, LISTEN_FDS is not set")
+	}
+	// Variables are only for this process and must not be passed to ImageMagick commands
+	_ = os.Unsetenv("LISTEN_PID")
+	_ = os.Unsetenv("LISTEN_FDS")
+	_ = os.Unsetenv("LISTEN_FDNAMES")
+
+	listeners := make([]net.Listener, 0, count)
+	for fd := 3; fd < 3+count; fd++ {
+		f := os.NewFile(uintptr(fd), fmt.Sprintf("systemd-socket-%d", fd))
+		// FileListener duplicates the descriptor, so the original one is closed
+		l, err := net.FileListener(f)
+		_ = f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("socket [%d] passed by systemd is not a listener: %w", fd, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// listenUnix listens on unix domain socket removing the stale socket file left after the previous run.
+// The socket is writable by all users, so access should be limited by permissions of the directory.
+func listenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Stat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("[%s] exists and is not a socket", path)
+		}
+		if err = os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(path, 0666); err != nil {
+		_ = l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// writeBufferListener sets the send buffer size of accepted TCP connections, so
+// large images are sent with fewer round trips on high latency mobile networks.
+type writeBufferListener struct {
+	net.Listener
+	size int
+}
+
+func (l *writeBufferListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		if err = tcpConn.SetWriteBuffer(l.size); err != nil {
+			img.Log.Printf("Could not set write buffer size of the connection: %s\n", err)
+		}
+	}
+	return conn, nil
+}
+
+// serve runs servers on listeners and HTTP/3 server if it's not nil. Returns the first error.
+// Servers with TLSConfig serve HTTPS.
+func serve(servers []*http.Server, listeners []net.Listener, h3 *http3.Server) error {
+	errs := make(chan error, len(servers)+1)
+	if h3 != nil {
+		go func() {
+			img.Log.Printf("Running HTTP/3 on %s/udp...\n", h3.Addr)
+			errs <- h3.ListenAndServe()
+		}()
+	}
+	for i, s := range servers {
+		go func(s *http.Server, l net.Listener) {
+			if s.TLSConfig != nil {
+				img.Log.Printf("Running HTTPS on %s...\n", l.Addr())
+				// Certificates are in TLSConfig
+				errs <- s.ServeTLS(l, "", "")
+				return
+			}
+			img.Log.Printf("Running the application on %s...\n", l.Addr())
+			errs <- s.Serve(l)
+		}(s, listeners[i])
+	}
+	return <-errs
+}
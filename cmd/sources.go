@@ -0,0 +1,88 @@
+package main
+
+import (
+	"github.com/Pixboost/transformimgs/v8/img"
+	"os"
+	"time"
+)
+
+// sourceListsOptions are files with patterns of allowed and blocked source URLs.
+type sourceListsOptions struct {
+	allowFile string
+	blockFile string
+	// reload is the interval to check files for changes. Zero disables reloading.
+	reload time.Duration
+}
+
+// newSourcePolicy returns the policy with patterns from files. If reload interval is set,
+// then files are checked for changes in the background. Patterns are kept if the changed
+// file is invalid.
+func newSourcePolicy(opts *sourceListsOptions) (*img.SourcePolicy, error) {
+	policy := &img.SourcePolicy{}
+	if err := loadSourceLists(policy, opts); err != nil {
+		return nil, err
+	}
+
+	if opts.reload > 0 {
+		go func() {
+			modified := sourceListsModTime(opts)
+			for range time.Tick(opts.reload) {
+				m := sourceListsModTime(opts)
+				if m.Equal(modified) {
+					continue
+				}
+				modified = m
+				if err := loadSourceLists(policy, opts); err != nil {
+					img.Log.Errorf("Can't reload source lists, keeping previous patterns: %+v", err)
+					continue
+				}
+				img.Log.Printf("Source lists reloaded\n")
+			}
+		}()
+	}
+
+	return policy, nil
+}
+
+func loadSourceLists(policy *img.SourcePolicy, opts *sourceListsOptions) error {
+	var allow, block img.SourcePatterns
+	var err error
+	if len(opts.allowFile) > 0 {
+		if allow, err = loadSourcePatterns(opts.allowFile); err != nil {
+			return err
+		}
+	}
+	if len(opts.blockFile) > 0 {
+		if block, err = loadSourcePatterns(opts.blockFile); err != nil {
+			return err
+		}
+	}
+	policy.Set(allow, block)
+	return nil
+}
+
+func loadSourcePatterns(path string) (img.SourcePatterns, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	return img.ParseSourcePatterns(f)
+}
+
+// sourceListsModTime returns the latest modification time of files.
+func sourceListsModTime(opts *sourceListsOptions) time.Time {
+	var latest time.Time
+	for _, path := range []string{opts.allowFile, opts.blockFile} {
+		if len(path) == 0 {
+			continue
+		}
+		if fi, err := os.Stat(path); err == nil && fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest
+}
@@ -0,0 +1,9 @@
+//go:build magickwand
+
+package main
+
+import "github.com/Pixboost/transformimgs/v8/img/processor"
+
+func newImageMagickWand() (*processor.ImageMagick, error) {
+	return processor.NewImageMagickWand()
+}
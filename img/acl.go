@@ -0,0 +1,112 @@
+package img
+
+import (
+	"fmt"
+	"github.com/dooman87/glogi"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// NetworkACL limits access to the service by IP addresses of clients.
+type NetworkACL struct {
+	// Allowed are networks of clients that have access. Nobody has access if empty.
+	Allowed []*net.IPNet
+	// TrustedProxies are networks of proxies, e.g. load balancers, that add IP address of the
+	// client to X-Forwarded-For header. The header is ignored for other clients, so it can't be spoofed.
+	TrustedProxies []*net.IPNet
+	// Log is the logger. Package Log is used if nil.
+	Log glogi.Logger
+}
+
+// ParseNetworks parses comma separated list of networks in CIDR notation, e.g. "10.0.0.0/8, fd00::/8".
+// Single IP addresses are also accepted.
+func ParseNetworks(list string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, cidr := range strings.Split(list, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if len(cidr) == 0 {
+			continue
+		}
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address [%s]", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// ClientIP returns IP address of the client. X-Forwarded-For header is read from right to left
+// while addresses are trusted proxies. Clients connected over unix socket are considered local
+// with 127.0.0.1 address. Returns nil if address is invalid.
+func (a *NetworkACL) ClientIP(req *http.Request) net.IP {
+	ip := remoteIP(req)
+	if ip == nil {
+		return nil
+	}
+
+	var forwarded []string
+	for _, header := range req.Header.Values("X-Forwarded-For") {
+		forwarded = append(forwarded, strings.Split(header, ",")...)
+	}
+	for i := len(forwarded) - 1; i >= 0 && containsIP(a.TrustedProxies, ip); i-- {
+		if ip = net.ParseIP(strings.TrimSpace(forwarded[i])); ip == nil {
+			return nil
+		}
+	}
+	return ip
+}
+
+// Allow returns true if the client has access.
+func (a *NetworkACL) Allow(req *http.Request) bool {
+	ip := a.ClientIP(req)
+	return ip != nil && containsIP(a.Allowed, ip)
+}
+
+// Handler returns the handler that responds with 403 to clients without access and
+// passes other requests to the next handler.
+func (a *NetworkACL) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if !a.Allow(req) {
+			logOrDefault(a.Log).Printf("[%s]: Access denied for [%s]\n", req.URL.String(), a.ClientIP(req))
+			http.Error(resp, "access denied", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(resp, req)
+	})
+}
+
+// remoteIP returns IP address of the peer that sent the request, which could be a proxy.
+// Peers connected over unix socket have 127.0.0.1 address. Returns nil if address is invalid.
+func remoteIP(req *http.Request) net.IP {
+	if len(req.RemoteAddr) == 0 || req.RemoteAddr == "@" {
+		return net.IPv4(127, 0, 0, 1)
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,191 @@
+package img_test
+
+import (
+	"github.com/Pixboost/transformimgs/v8/img"
+	"github.com/dooman87/kolibri/test"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseNetworks(t *testing.T) {
+	networks, err := img.ParseNetworks("10.0.0.0/8, 192.168.1.1,fd00::/8, ::1")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := []string{"10.0.0.0/8", "192.168.1.1/32", "fd00::/8", "::1/128"}
+	if len(networks) != len(expected) {
+		t.Fatalf("expected %d networks, but got %v", len(expected), networks)
+	}
+	for i, network := range networks {
+		if network.String() != expected[i] {
+			t.Errorf("expected network %s, but got %s", expected[i], network)
+		}
+	}
+
+	for _, invalid := range []string{"10.0.0.0/33", "10.0.0", "localhost"} {
+		if _, err = img.ParseNetworks(invalid); err == nil {
+			t.Errorf("expected error for [%s]", invalid)
+		}
+	}
+}
+
+func TestNetworkACL_ClientIP(t *testing.T) {
+	proxies, _ := img.ParseNetworks("10.0.0.0/8")
+	acl := &img.NetworkACL{TrustedProxies: proxies}
+
+	testCases := []struct {
+		remoteAddr string
+		forwarded  []string
+		expected   string
+	}{
+		{"1.1.1.1:1234", nil, "1.1.1.1"},
+		{"1.1.1.1:1234", []string{"2.2.2.2"}, "1.1.1.1"},
+		{"10.0.0.1:1234", []string{"2.2.2.2"}, "2.2.2.2"},
+		{"10.0.0.1:1234", []string{"3.3.3.3, 2.2.2.2, 10.0.0.2"}, "2.2.2.2"},
+		{"10.0.0.1:1234", []string{"3.3.3.3", "10.0.0.2"}, "3.3.3.3"},
+		{"10.0.0.1:1234", []string{"10.0.0.2"}, "10.0.0.2"},
+		{"10.0.0.1:1234", []string{"invalid"}, "<nil>"},
+		{"[::1]:1234", nil, "::1"},
+		{"@", nil, "127.0.0.1"},
+	}
+
+	for _, tc := range testCases {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tc.remoteAddr
+		for _, f := range tc.forwarded {
+			req.Header.Add("X-Forwarded-For", f)
+		}
+		if ip := acl.ClientIP(req); ip.String() != tc.expected {
+			t.Errorf("%s %v: expected %s, but got %s", tc.remoteAddr, tc.forwarded, tc.expected, ip)
+		}
+	}
+}
+
+func TestNetworkACL_Handler(t *testing.T) {
+	allowed, _ := img.ParseNetworks("192.168.0.0/16")
+	proxies, _ := img.ParseNetworks("10.0.0.1")
+	acl := &img.NetworkACL{Allowed: allowed, TrustedProxies: proxies}
+	test.Service = acl.Handler(createService(t).GetRouter()).ServeHTTP
+	test.T = t
+
+	request := func(remoteAddr string, forwarded string) *http.Request {
+		req := httptest.NewRequest("GET", "http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise", nil)
+		req.RemoteAddr = remoteAddr
+		if len(forwarded) > 0 {
+			req.Header.Set("X-Forwarded-For", forwarded)
+		}
+		return req
+	}
+
+	testCases := []test.TestCase{
+		{
+			Request:     request("192.168.1.10:1234", ""),
+			Description: "Allowed client",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal(ImgPngOut, w.Body.String(), "Resulted image"),
+				)
+			},
+		},
+		{
+			Request:      request("1.1.1.1:1234", ""),
+			Description:  "Client is not allowed",
+			ExpectedCode: http.StatusForbidden,
+		},
+		{
+			Request:      request("1.1.1.1:1234", "192.168.1.10"),
+			Description:  "Spoofed X-Forwarded-For",
+			ExpectedCode: http.StatusForbidden,
+		},
+		{
+			Request:     request("10.0.0.1:1234", "192.168.1.10"),
+			Description: "Allowed client behind trusted proxy",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal(ImgPngOut, w.Body.String(), "Resulted image"),
+				)
+			},
+		},
+	}
+
+	test.RunRequests(testCases)
+}
+
+func TestService_TrustedProxies(t *testing.T) {
+	proxies, _ := img.ParseNetworks("10.0.0.0/8")
+	s, err := img.NewServiceWithConfig(&urlLoader{}, &resizerMock{}, 1, &img.ServiceConfig{TrustedProxies: proxies})
+	if err != nil {
+		t.Fatalf("could not create service: %s", err)
+	}
+	test.Service = s.GetRouter().ServeHTTP
+	test.T = t
+
+	request := func(remoteAddr string) *http.Request {
+		req := httptest.NewRequest("GET", "http://localhost/img/%2F%2Fsite.com/img.png/asis", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-Forwarded-Proto", "https")
+		return req
+	}
+
+	test.RunRequests([]test.TestCase{
+		{
+			Request:     request("10.0.0.1:1234"),
+			Description: "Trusted proxy",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t, test.Equal("https://site.com/img.png", w.Body.String(), "Source URL"))
+			},
+		},
+		{
+			Request:     request("192.168.1.1:1234"),
+			Description: "Untrusted client",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t, test.Equal("//site.com/img.png", w.Body.String(), "Source URL"))
+			},
+		},
+	})
+
+	s, err = img.NewServiceWithConfig(&loaderMock{}, &resizerMock{}, 1, &img.ServiceConfig{TrustedProxies: proxies})
+	if err != nil {
+		t.Fatalf("could not create service: %s", err)
+	}
+	test.Service = s.GetRouter().ServeHTTP
+
+	infoRequest := func(remoteAddr string) *http.Request {
+		req := httptest.NewRequest("GET", "http://localhost/iiif/http%3A%2F%2Fsite.com%2Fimg.png/info.json", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-Forwarded-Proto", "https")
+		req.Header.Set("X-Forwarded-Host", "images.site.com")
+		return req
+	}
+	expectId := func(expected string) func(w *httptest.ResponseRecorder, t *testing.T) {
+		return func(w *httptest.ResponseRecorder, t *testing.T) {
+			if !strings.Contains(w.Body.String(), `"id":"`+expected+`"`) {
+				t.Errorf("expected id [%s], but got %s", expected, w.Body.String())
+			}
+		}
+	}
+
+	test.RunRequests([]test.TestCase{
+		{
+			Request:     infoRequest("10.0.0.1:1234"),
+			Description: "Forwarded host of trusted proxy",
+			Handler:     expectId("https://images.site.com/iiif/http%3A%2F%2Fsite.com%2Fimg.png"),
+		},
+		{
+			Request:     infoRequest("192.168.1.1:1234"),
+			Description: "Forwarded host of untrusted client",
+			Handler:     expectId("http://localhost/iiif/http%3A%2F%2Fsite.com%2Fimg.png"),
+		},
+	})
+
+	s.Config.TrustedProxies = nil
+	test.RunRequests([]test.TestCase{
+		{
+			Request:     infoRequest("10.0.0.1:1234"),
+			Description: "No trusted proxies",
+			Handler:     expectId("http://localhost/iiif/http%3A%2F%2Fsite.com%2Fimg.png"),
+		},
+	})
+}
@@ -0,0 +1,96 @@
+package img
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Alias is the preset of the operation served on its own route, e.g. /img/{imgUrl}/thumb for
+// fit with size=200x200, so URL schemes could change presets without breaking published URLs.
+type Alias struct {
+	// Op is the name of the operation: "optimise", "resize", "fit", "upscale" or "avatar".
+	Op string
+	// Query are query params of the preset, e.g. size. They override params of the request.
+	Query url.Values
+}
+
+var aliasNameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// ParseAliases parses comma separated list of aliases in the format name=op?params,
+// e.g. "thumb=fit?size=200x200,hero=resize?size=1200". Names of built-in routes, e.g. "resize",
+// are rejected.
+func ParseAliases(list string) (map[string]*Alias, error) {
+	builtin := make(map[string]bool)
+	for _, route := range (&Service{}).builtinRoutes("") {
+		builtin[route.Name] = true
+	}
+
+	aliases := make(map[string]*Alias)
+	for _, a := range strings.Split(list, ",") {
+		a = strings.TrimSpace(a)
+		if len(a) == 0 {
+			continue
+		}
+		name, preset, ok := strings.Cut(a, "=")
+		if !ok {
+			return nil, fmt.Errorf("alias [%s] must be in format name=op?params", a)
+		}
+		name = strings.TrimSpace(name)
+		if !aliasNameRegexp.MatchString(name) {
+			return nil, fmt.Errorf("invalid alias name [%s]", name)
+		}
+		if builtin[name] {
+			return nil, fmt.Errorf("alias [%s] clashes with the route", name)
+		}
+		op, params, _ := strings.Cut(strings.TrimSpace(preset), "?")
+		if _, ok := operationHandlers[op]; !ok {
+			return nil, fmt.Errorf("unknown operation [%s] of alias [%s]", op, name)
+		}
+		query, err := url.ParseQuery(params)
+		if err != nil {
+			return nil, fmt.Errorf("invalid params of alias [%s]: %w", name, err)
+		}
+		aliases[name] = &Alias{Op: op, Query: query}
+	}
+	return aliases, nil
+}
+
+// operationHandlers are handlers of operations that could be aliased or used by dialects.
+var operationHandlers = map[string]func(r *Service) http.HandlerFunc{
+	"optimise": func(r *Service) http.HandlerFunc { return r.OptimiseUrl },
+	"resize":   func(r *Service) http.HandlerFunc { return r.ResizeUrl },
+	"fit":      func(r *Service) http.HandlerFunc { return r.FitToSizeUrl },
+	"upscale":  func(r *Service) http.HandlerFunc { return r.UpscaleUrl },
+	"avatar":   func(r *Service) http.HandlerFunc { return r.AvatarUrl },
+}
+
+// serveOperation serves the request with the handler of the operation. Operations disabled by
+// Service.DisabledRoutes are not found, so they can't be reached through aliases or dialects.
+func (r *Service) serveOperation(op string, resp http.ResponseWriter, req *http.Request) {
+	handler, ok := operationHandlers[op]
+	if !ok {
+		http.Error(resp, fmt.Sprintf("unknown operation [%s]", op), http.StatusInternalServerError)
+		return
+	}
+	if r.DisabledRoutes[op] {
+		http.NotFound(resp, req)
+		return
+	}
+	handler(r)(resp, req)
+}
+
+// aliasHandler serves the request with the handler of the operation of the alias and its params.
+func (r *Service) aliasHandler(alias *Alias) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		query := req.URL.Query()
+		for name, values := range alias.Query {
+			query[name] = values
+		}
+		nativeReq := req.Clone(req.Context())
+		nativeReq.URL.RawQuery = query.Encode()
+		r.serveOperation(alias.Op, resp, nativeReq)
+	}
+}
@@ -0,0 +1,133 @@
+package img_test
+
+import (
+	"github.com/Pixboost/transformimgs/v8/img"
+	"github.com/dooman87/kolibri/test"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestParseAliases(t *testing.T) {
+	aliases, err := img.ParseAliases(" thumb=fit?size=200x200, hero=resize?size=1200&dppx=1,small=optimise,")
+	expected := map[string]*img.Alias{
+		"thumb": {Op: "fit", Query: url.Values{"size": {"200x200"}}},
+		"hero":  {Op: "resize", Query: url.Values{"size": {"1200"}, "dppx": {"1"}}},
+		"small": {Op: "optimise", Query: url.Values{}},
+	}
+	if err != nil || !reflect.DeepEqual(aliases, expected) {
+		t.Errorf("expected aliases %+v, but got %+v, %v", expected, aliases, err)
+	}
+
+	for _, invalid := range []string{"thumb", "Thumb=fit", "thumb=rotate?deg=90", "thumb=fit?size=%zz", "resize=fit?size=200x200", "asis=optimise"} {
+		if _, err := img.ParseAliases(invalid); err == nil {
+			t.Errorf("expected error for [%s]", invalid)
+		}
+	}
+}
+
+func TestService_Aliases(t *testing.T) {
+	s := createService(t)
+	s.Aliases = map[string]*img.Alias{"thumb": {Op: "fit", Query: url.Values{"size": {"300x200"}}}}
+	s.RoutePrefixes = []string{"/v2/", "", "v3"}
+	s.Dialects = map[string]img.Dialect{"cloudinary": img.KnownDialects["cloudinary"]}
+	if names := s.RouteNames(); len(names) != 18 {
+		t.Errorf("expected names of 18 routes, but got %v", names)
+	}
+
+	expectImage := func(w *httptest.ResponseRecorder, t *testing.T) {
+		test.Error(t,
+			test.Equal(ImgPngOut, w.Body.String(), "Resulted image"),
+		)
+	}
+	for _, handler := range []http.Handler{s.GetRouter(), s.Handler()} {
+		test.Service = handler.ServeHTTP
+		test.T = t
+
+		test.RunRequests([]test.TestCase{
+			{
+				Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/thumb",
+				Description: "Alias",
+				Handler:     expectImage,
+			},
+			{
+				Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/thumb?size=100",
+				Description: "Params of the alias override params of the request",
+				Handler:     expectImage,
+			},
+			{
+				Url:         "http://localhost/v2/img/http%3A%2F%2Fsite.com/img.png/thumb",
+				Description: "Prefixed alias",
+				Handler:     expectImage,
+			},
+			{
+				Url:         "http://localhost/v3/img/http%3A%2F%2Fsite.com/img.png/resize?size=300",
+				Description: "Prefixed route",
+				Handler:     expectImage,
+			},
+			{
+				Url:         "http://localhost/v2/cloudinary/image/fetch/w_300/http://site.com/img.png",
+				Description: "Prefixed dialect",
+				Handler:     expectImage,
+			},
+			{
+				Url:          "http://localhost/v4/img/http%3A%2F%2Fsite.com/img.png/resize?size=300",
+				Description:  "Unknown prefix",
+				ExpectedCode: http.StatusNotFound,
+			},
+		})
+	}
+
+	s.DisabledRoutes = map[string]bool{"thumb": true}
+	test.Service = s.Handler().ServeHTTP
+	test.RunRequests([]test.TestCase{
+		{
+			Url:          "http://localhost/v2/img/http%3A%2F%2Fsite.com/img.png/thumb",
+			Description:  "Disabled alias",
+			ExpectedCode: http.StatusNotFound,
+		},
+	})
+
+	s.DisabledRoutes = map[string]bool{"fit": true}
+	for _, route := range s.Routes() {
+		if route.Name == "thumb" {
+			t.Errorf("expected alias of the disabled operation to be disabled")
+		}
+	}
+	test.Service = s.Handler().ServeHTTP
+	test.RunRequests([]test.TestCase{
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/thumb",
+			Description:  "Alias of the disabled operation",
+			ExpectedCode: http.StatusNotFound,
+		},
+	})
+}
+
+func TestService_AliasesClash(t *testing.T) {
+	s := createService(t)
+	s.Aliases = map[string]*img.Alias{
+		"resize":     {Op: "fit", Query: url.Values{"size": {"300x200"}}},
+		"cloudinary": {Op: "fit", Query: url.Values{"size": {"300x200"}}},
+	}
+	s.Dialects = map[string]img.Dialect{"cloudinary": img.KnownDialects["cloudinary"]}
+	if names := s.RouteNames(); len(names) != 17 {
+		t.Errorf("expected names of 17 routes without aliases, but got %v", names)
+	}
+	test.Service = s.Handler().ServeHTTP
+	test.T = t
+
+	test.RunRequests([]test.TestCase{
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/resize?size=300",
+			Description: "Route is not replaced by the alias",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal(ImgPngOut, w.Body.String(), "Resulted image"),
+				)
+			},
+		},
+	})
+}
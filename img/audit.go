@@ -0,0 +1,153 @@
+package img
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/dooman87/glogi"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// AuditRecord is the record about the served image in the audit log.
+type AuditRecord struct {
+	Time time.Time `json:"time"`
+	// Client is IP address of the client.
+	Client string `json:"client"`
+	// User is the value of Audit.UserHeader, e.g. the id of the authenticated user. Empty if not set.
+	User string `json:"user,omitempty"`
+	// Source is the URL of the source image.
+	Source string `json:"source"`
+	// Path is the path of the request, which includes the operation.
+	Path string `json:"path"`
+	// Params are query params of the request.
+	Params url.Values `json:"params,omitempty"`
+	// MimeType is the MIME type of the response.
+	MimeType string `json:"mimeType"`
+	// Bytes is the size of the response body.
+	Bytes int `json:"bytes"`
+}
+
+// AuditSink writes records to the append-only audit log. It must be safe for concurrent use.
+type AuditSink interface {
+	Write(record *AuditRecord) error
+}
+
+// Audit records who requested which source with which params and the size of the response,
+// e.g. for compliance when third-party content is served. Only served images are recorded.
+// Audit is installed using hooks, e.g. service.Use(audit.Hooks()).
+type Audit struct {
+	Sink AuditSink
+	// UserHeader is the name of the request header that identifies the user, e.g. set by
+	// authenticating proxy. Optional.
+	UserHeader string
+	// TrustedProxies are networks of proxies whose X-Forwarded-For header is used to get IP address
+	// of the client, see NetworkACL.
+	TrustedProxies []*net.IPNet
+	// FailClosed is the flag to respond with 503 when the record could not be written.
+	// Images are served by default.
+	FailClosed bool
+	// Log is the logger. Package Log is used if nil.
+	Log glogi.Logger
+}
+
+// Hooks returns hooks that write records after transformations.
+func (a *Audit) Hooks() *Hooks {
+	return &Hooks{
+		PostTransform: func(req *http.Request, _ http.ResponseWriter, config *TransformationConfig, result *Image) error {
+			return a.record(req, config, result)
+		},
+	}
+}
+
+func (a *Audit) record(req *http.Request, config *TransformationConfig, result *Image) error {
+	record := &AuditRecord{
+		Time:     time.Now().UTC(),
+		Source:   config.Src.Id,
+		Path:     req.URL.Path,
+		Params:   req.URL.Query(),
+		MimeType: result.MimeType,
+		Bytes:    len(result.Data),
+	}
+	if len(record.MimeType) == 0 {
+		record.MimeType = config.Src.MimeType
+	}
+	if ip := (&NetworkACL{TrustedProxies: a.TrustedProxies}).ClientIP(req); ip != nil {
+		record.Client = ip.String()
+	}
+	if len(a.UserHeader) > 0 {
+		record.User = req.Header.Get(a.UserHeader)
+	}
+
+	if err := a.Sink.Write(record); err != nil {
+		logOrDefault(a.Log).Errorf("[%s] Could not write audit record: %s", record.Source, err)
+		if a.FailClosed {
+			return NewHttpError(http.StatusServiceUnavailable, "request could not be audited")
+		}
+	}
+	return nil
+}
+
+// FileAuditSink writes records as JSON lines to the file that is opened in append-only mode.
+type FileAuditSink struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewFileAuditSink opens the file for appending records. The file is created if it doesn't exist.
+func NewFileAuditSink(path string) (*FileAuditSink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+	return &FileAuditSink{file: f}, nil
+}
+
+func (s *FileAuditSink) Write(record *AuditRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// One write per record, so lines are not interleaved with other writers of the file
+	_, err = s.file.Write(append(line, '\n'))
+	return err
+}
+
+// Close closes the file.
+func (s *FileAuditSink) Close() error {
+	return s.file.Close()
+}
+
+// HttpAuditSink sends each record as JSON in the body of POST request to the URL,
+// e.g. to the log collector. Any 2xx response means the record is stored.
+type HttpAuditSink struct {
+	Url    string
+	Client *http.Client
+}
+
+func (s *HttpAuditSink) Write(record *AuditRecord) error {
+	body, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Post(s.Url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("audit sink responded with %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package img_test
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/Pixboost/transformimgs/v8/img"
+	"github.com/dooman87/kolibri/test"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type auditSinkMock struct {
+	mu      sync.Mutex
+	records []*img.AuditRecord
+	err     error
+}
+
+func (s *auditSinkMock) Write(record *img.AuditRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records = append(s.records, record)
+	return s.err
+}
+
+func TestAudit(t *testing.T) {
+	sink := &auditSinkMock{}
+	s := createService(t)
+	s.Use((&img.Audit{Sink: sink, UserHeader: "X-User"}).Hooks())
+	test.Service = s.GetRouter().ServeHTTP
+	test.T = t
+
+	testCases := []test.TestCase{
+		{
+			Request: &http.Request{
+				Method:     "GET",
+				URL:        parseUrl("http://localhost/img/http%3A%2F%2Fsite.com/img.png/resize?size=300", t),
+				Header:     map[string][]string{"X-User": {"user-1"}},
+				RemoteAddr: "10.0.0.1:1234",
+			},
+			Description: "Served image is recorded",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal(ImgPngOut, w.Body.String(), "Resulted image"),
+				)
+			},
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/resize?size=400",
+			Description:  "Failed transformation is not recorded",
+			ExpectedCode: http.StatusInternalServerError,
+		},
+	}
+
+	test.RunRequests(testCases)
+
+	if len(sink.records) != 1 {
+		t.Fatalf("expected 1 record, but got %d", len(sink.records))
+	}
+	record := sink.records[0]
+	test.Error(t,
+		test.Equal("10.0.0.1", record.Client, "client"),
+		test.Equal("user-1", record.User, "user"),
+		test.Equal("http://site.com/img.png", record.Source, "source"),
+		test.Equal("300", record.Params.Get("size"), "size param"),
+		test.Equal("image/png", record.MimeType, "MIME type"),
+		test.Equal(len(ImgPngOut), record.Bytes, "bytes"),
+	)
+}
+
+func TestAudit_FailClosed(t *testing.T) {
+	s := createService(t)
+	s.Use((&img.Audit{Sink: &auditSinkMock{err: errors.New("disk is full")}, FailClosed: true}).Hooks())
+	test.Service = s.GetRouter().ServeHTTP
+	test.T = t
+
+	test.RunRequests([]test.TestCase{
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise",
+			Description:  "Record is not written",
+			ExpectedCode: http.StatusServiceUnavailable,
+		},
+	})
+}
+
+func TestFileAuditSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	if err := os.WriteFile(path, []byte("{}\n"), 0640); err != nil {
+		t.Fatalf("could not write file: %s", err)
+	}
+
+	sink, err := img.NewFileAuditSink(path)
+	if err != nil {
+		t.Fatalf("could not open sink: %s", err)
+	}
+	for _, source := range []string{"http://site.com/a.png", "http://site.com/b.png"} {
+		if err = sink.Write(&img.AuditRecord{Source: source, Bytes: 10}); err != nil {
+			t.Errorf("could not write record: %s", err)
+		}
+	}
+	_ = sink.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("could not read file: %s", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected existing line and 2 records, but got %v", lines)
+	}
+	var record img.AuditRecord
+	if err = json.Unmarshal([]byte(lines[2]), &record); err != nil {
+		t.Fatalf("could not parse record: %s", err)
+	}
+	test.Error(t,
+		test.Equal("http://site.com/b.png", record.Source, "source"),
+		test.Equal(10, record.Bytes, "bytes"),
+	)
+}
+
+func TestHttpAuditSink(t *testing.T) {
+	var record img.AuditRecord
+	status := http.StatusNoContent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&record); err != nil {
+			t.Errorf("could not decode record: %s", err)
+		}
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	sink := &img.HttpAuditSink{Url: server.URL}
+	if err := sink.Write(&img.AuditRecord{Source: "http://site.com/a.png"}); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	test.Error(t, test.Equal("http://site.com/a.png", record.Source, "source"))
+
+	status = http.StatusInternalServerError
+	if err := sink.Write(&img.AuditRecord{Source: "http://site.com/a.png"}); err == nil {
+		t.Errorf("expected error when collector fails")
+	}
+}
@@ -0,0 +1,71 @@
+package img
+
+import (
+	"fmt"
+	"image"
+	"net/http"
+	"strconv"
+)
+
+// FaceDetector detects faces on source images of avatars.
+type FaceDetector interface {
+	// DetectFace returns the bounding box of the most prominent face in pixels of the source after
+	// applying EXIF orientation or an empty rectangle if there are no faces on the image.
+	DetectFace(src *Image) (image.Rectangle, error)
+}
+
+// AvatarConfig is the configuration of avatars passed in TransformationConfig.Config.
+type AvatarConfig struct {
+	// Size is the width and the height of the avatar in pixels.
+	Size int
+	// Face is the bounding box of the face found by Service.FaceDetector. The center square of the
+	// image is used if it's empty.
+	Face image.Rectangle
+	// Detected is true if Face is detected by Service.FaceDetector. Processors detect faces
+	// themselves otherwise.
+	Detected bool
+}
+
+// Avatarer is implemented by processors that could make avatars: the square around the most
+// prominent face of the image resized to the size from AvatarConfig passed in input.Config
+// with the circular mask.
+type Avatarer interface {
+	Avatar(input *TransformationConfig) (*Image, error)
+}
+
+// AvatarUrl makes the avatar of the size from size query param, e.g. /img/{url}/avatar?size=128,
+// so avatar pipelines need one call instead of detecting, cropping, masking and optimising separately.
+// Faces are detected by Service.FaceDetector or the processor if it's nil. Responds with 501 if the
+// processor is not an Avatarer.
+func (r *Service) AvatarUrl(resp http.ResponseWriter, req *http.Request) {
+	avatarer, ok := r.Processor.(Avatarer)
+	if !ok {
+		http.Error(resp, "processor doesn't support avatars", http.StatusNotImplemented)
+		return
+	}
+
+	sizeParam, _ := getQueryParam(req.URL, "size")
+	if len(sizeParam) == 0 {
+		http.Error(resp, "size param is required", http.StatusBadRequest)
+		return
+	}
+	size, err := strconv.Atoi(sizeParam)
+	maxDimension := r.config().MaxDimension
+	if err != nil || size <= 0 || (maxDimension > 0 && size > maxDimension) {
+		http.Error(resp, fmt.Sprintf("size param must be a number between 1 and %d", maxDimension), http.StatusBadRequest)
+		return
+	}
+
+	r.transformUrl(resp, req, "avatar", func(input *TransformationConfig) (*Image, error) {
+		if r.FaceDetector != nil {
+			face, err := r.FaceDetector.DetectFace(input.Src)
+			if err != nil {
+				return nil, fmt.Errorf("could not detect face: %w", err)
+			}
+			avatarConfig := *input.Config.(*AvatarConfig)
+			avatarConfig.Face, avatarConfig.Detected = face, true
+			input.Config = &avatarConfig
+		}
+		return avatarer.Avatar(input)
+	}, &AvatarConfig{Size: size})
+}
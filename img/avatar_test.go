@@ -0,0 +1,98 @@
+package img_test
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Pixboost/transformimgs/v8/img"
+	"github.com/dooman87/kolibri/test"
+	"image"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// avatarProcessor returns the size and the face of the avatar as its data.
+type avatarProcessor struct {
+	resizerMock
+}
+
+func (p *avatarProcessor) Avatar(config *img.TransformationConfig) (*img.Image, error) {
+	avatarConfig := config.Config.(*img.AvatarConfig)
+	return &img.Image{
+		Data:     []byte(fmt.Sprintf("%d %v %t", avatarConfig.Size, avatarConfig.Face, avatarConfig.Detected)),
+		MimeType: "image/png",
+	}, nil
+}
+
+type faceDetectorMock struct {
+	err error
+}
+
+func (d *faceDetectorMock) DetectFace(src *img.Image) (image.Rectangle, error) {
+	return image.Rect(10, 20, 30, 40), d.err
+}
+
+func TestService_Avatar(t *testing.T) {
+	s, err := img.NewService(&loaderMock{}, &avatarProcessor{}, 1)
+	if err != nil {
+		t.Fatalf("could not create service: %s", err)
+	}
+	test.Service = s.GetRouter().ServeHTTP
+	test.T = t
+
+	expectBody := func(expected string) func(w *httptest.ResponseRecorder, t *testing.T) {
+		return func(w *httptest.ResponseRecorder, t *testing.T) {
+			test.Error(t, test.Equal(expected, w.Body.String(), "Avatar"))
+		}
+	}
+
+	test.RunRequests([]test.TestCase{
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/avatar?size=128",
+			Description: "Face is detected by the processor",
+			Handler:     expectBody("128 (0,0)-(0,0) false"),
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/avatar",
+			Description:  "Missing size",
+			ExpectedCode: http.StatusBadRequest,
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/avatar?size=128x128",
+			Description:  "Invalid size",
+			ExpectedCode: http.StatusBadRequest,
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/avatar?size=100000",
+			Description:  "Too big size",
+			ExpectedCode: http.StatusBadRequest,
+		},
+	})
+
+	s.FaceDetector = &faceDetectorMock{}
+	test.RunRequests([]test.TestCase{
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/avatar?size=64",
+			Description: "Face is detected by the detector",
+			Handler:     expectBody("64 (10,20)-(30,40) true"),
+		},
+	})
+
+	s.FaceDetector = &faceDetectorMock{err: errors.New("detector is down")}
+	test.RunRequests([]test.TestCase{
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/avatar?size=64",
+			Description:  "Detector error",
+			ExpectedCode: http.StatusInternalServerError,
+		},
+	})
+
+	test.Service = createService(t).GetRouter().ServeHTTP
+	test.RunRequests([]test.TestCase{
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/avatar?size=64",
+			ExpectedCode: http.StatusNotImplemented,
+			Description:  "Processor doesn't support avatars",
+		},
+	})
+}
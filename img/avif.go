@@ -0,0 +1,78 @@
+package img
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// AvifAllOps is the key of ServiceConfig.AvifPolicies that is used for operations without their own policy.
+const AvifAllOps = "*"
+
+const avifMimeType = "image/avif"
+
+// AvifPolicy defines when AVIF is served to clients that support it.
+type AvifPolicy struct {
+	// Disabled is the flag to never serve AVIF, e.g. for operations where encoding time matters more than size.
+	Disabled bool
+	// MinSavings is the minimum percentage by which AVIF must be smaller than the next best format,
+	// e.g. WebP or JPEG, otherwise the other format is served. Images are encoded twice when AVIF
+	// is selected, see TransformationConfig.AvifMinSavings. Zero serves AVIF whenever it's selected.
+	MinSavings float64
+}
+
+// ParseAvifPolicies parses comma separated list of policies of operations, e.g. "optimise=10,fit=off,*=5",
+// where the value is MinSavings or "off" to disable AVIF. AvifAllOps applies to other operations.
+func ParseAvifPolicies(list string) (map[string]*AvifPolicy, error) {
+	policies := make(map[string]*AvifPolicy)
+	for _, p := range strings.Split(list, ",") {
+		p = strings.TrimSpace(p)
+		if len(p) == 0 {
+			continue
+		}
+		op, value, ok := strings.Cut(p, "=")
+		if !ok {
+			return nil, fmt.Errorf("AVIF policy [%s] must be in format op=savings or op=off", p)
+		}
+		op, value = strings.TrimSpace(op), strings.TrimSpace(value)
+		if value == "off" {
+			policies[op] = &AvifPolicy{Disabled: true}
+			continue
+		}
+		savings, err := strconv.ParseFloat(value, 64)
+		if err != nil || savings < 0 || savings >= 100 {
+			return nil, fmt.Errorf("AVIF savings of [%s] must be a number between 0 and 100 or off", op)
+		}
+		policies[op] = &AvifPolicy{MinSavings: savings}
+	}
+	return policies, nil
+}
+
+// avifPolicy returns the AVIF policy of the operation or nil if AVIF is served as usual.
+func (r *Service) avifPolicy(op string) *AvifPolicy {
+	policies := r.config().AvifPolicies
+	if policy, ok := policies[op]; ok {
+		return policy
+	}
+	return policies[AvifAllOps]
+}
+
+// applyAvifPolicy removes AVIF from supported formats if it's disabled for the operation and
+// returns the minimum savings of AVIF.
+func (r *Service) applyAvifPolicy(op string, supportedFormats []string) ([]string, float64) {
+	policy := r.avifPolicy(op)
+	if policy == nil {
+		return supportedFormats, 0
+	}
+	if !policy.Disabled {
+		return supportedFormats, policy.MinSavings
+	}
+
+	formats := make([]string, 0, len(supportedFormats))
+	for _, f := range supportedFormats {
+		if f != avifMimeType {
+			formats = append(formats, f)
+		}
+	}
+	return formats, 0
+}
@@ -0,0 +1,78 @@
+package img_test
+
+import (
+	"fmt"
+	"github.com/Pixboost/transformimgs/v8/img"
+	"github.com/dooman87/kolibri/test"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// avifProcessor returns minimum savings of AVIF as data of optimised images.
+type avifProcessor struct {
+	resizerMock
+}
+
+func (p *avifProcessor) Optimise(config *img.TransformationConfig) (*img.Image, error) {
+	return &img.Image{Data: []byte(fmt.Sprintf("%g", config.AvifMinSavings)), MimeType: "image/avif"}, nil
+}
+
+func TestParseAvifPolicies(t *testing.T) {
+	policies, err := img.ParseAvifPolicies("optimise=10, fit=off,*=2.5")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	test.Error(t,
+		test.Equal(3, len(policies), "Number of policies"),
+		test.Equal(10.0, policies["optimise"].MinSavings, "Savings of optimise"),
+		test.Equal(true, policies["fit"].Disabled, "fit is disabled"),
+		test.Equal(2.5, policies[img.AvifAllOps].MinSavings, "Savings of other operations"),
+	)
+
+	for _, invalid := range []string{"optimise", "optimise=abc", "optimise=-1", "optimise=100"} {
+		if _, err := img.ParseAvifPolicies(invalid); err == nil {
+			t.Errorf("expected error for [%s]", invalid)
+		}
+	}
+}
+
+func TestService_AvifPolicies(t *testing.T) {
+	s, err := img.NewServiceWithConfig(&loaderMock{}, &avifProcessor{}, 1, &img.ServiceConfig{
+		AvifPolicies: map[string]*img.AvifPolicy{
+			"resize":       {Disabled: true},
+			img.AvifAllOps: {MinSavings: 15},
+		},
+	})
+	if err != nil {
+		t.Fatalf("could not create service: %s", err)
+	}
+	test.Service = s.GetRouter().ServeHTTP
+	test.T = t
+
+	request := func(url string) *http.Request {
+		req := httptest.NewRequest("GET", url, nil)
+		req.Header.Set("Accept", "image/png, image/webp, image/avif")
+		return req
+	}
+
+	test.RunRequests([]test.TestCase{
+		{
+			Request:     request("http://localhost/img/http%3A%2F%2Fsite.com/img.png/resize?size=300"),
+			Description: "AVIF is disabled for resize",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t, test.Equal("image/webp", w.Header().Get("Content-Type"), "Content-Type header"))
+			},
+		},
+		{
+			Request:     request("http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise"),
+			Description: "Minimum savings of other operations",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal("image/avif", w.Header().Get("Content-Type"), "Content-Type header"),
+					test.Equal("15", w.Body.String(), "Minimum savings"),
+				)
+			},
+		},
+	})
+}
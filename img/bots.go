@@ -0,0 +1,99 @@
+package img
+
+import (
+	"fmt"
+	"strings"
+)
+
+// BotMode defines how images are served to crawlers and link preview bots.
+type BotMode int
+
+const (
+	// BotOff serves images to bots as usual.
+	BotOff BotMode = iota
+	// BotReduce serves images to bots with LOW quality limited by MaxSize of BotPolicy.
+	BotReduce
+	// BotOriginal serves source images to bots without transformation, so no encoding is done.
+	BotOriginal
+)
+
+// DefaultBotPatterns are parts of User-Agent of crawlers and link preview bots.
+var DefaultBotPatterns = []string{
+	"bot",
+	"crawler",
+	"spider",
+	"slurp",
+	"facebookexternalhit",
+	"embedly",
+	"whatsapp",
+	"preview",
+}
+
+// DefaultBotExclusions are parts of User-Agent of bots that are served as usual, e.g. image search
+// crawlers that rank images by their quality.
+var DefaultBotExclusions = []string{
+	"Googlebot-Image",
+}
+
+// BotPolicy classifies requests by User-Agent header and serves smaller images or originals to bots,
+// so encoding is not spent on non-human traffic. User-Agent is added to Vary response header when
+// the policy is enabled, so CDN must support it or normalise User-Agent before caching.
+type BotPolicy struct {
+	Mode BotMode
+	// Patterns are parts of User-Agent of bots. Matching is case-insensitive.
+	Patterns []string
+	// Exclusions are parts of User-Agent of bots that are served as usual even if they match Patterns.
+	// Matching is case-insensitive.
+	Exclusions []string
+	// MaxSize limits width and height of images in pixels when Mode is BotReduce. Zero means no limit.
+	MaxSize int
+}
+
+// NewBotPolicy creates the policy with DefaultBotPatterns and DefaultBotExclusions.
+func NewBotPolicy(mode BotMode) *BotPolicy {
+	return &BotPolicy{
+		Mode:       mode,
+		Patterns:   DefaultBotPatterns,
+		Exclusions: DefaultBotExclusions,
+	}
+}
+
+// ParseBotMode parses the name of the mode: "off", "reduce" or "original".
+func ParseBotMode(mode string) (BotMode, error) {
+	switch mode {
+	case "off", "":
+		return BotOff, nil
+	case "reduce":
+		return BotReduce, nil
+	case "original":
+		return BotOriginal, nil
+	}
+	return BotOff, fmt.Errorf("bot mode [%s] must be one of 'off', 'reduce', 'original'", mode)
+}
+
+// IsBot returns true if User-Agent matches one of Patterns and none of Exclusions.
+func (p *BotPolicy) IsBot(userAgent string) bool {
+	if len(userAgent) == 0 {
+		return false
+	}
+	userAgent = strings.ToLower(userAgent)
+	for _, e := range p.Exclusions {
+		if strings.Contains(userAgent, strings.ToLower(e)) {
+			return false
+		}
+	}
+	for _, b := range p.Patterns {
+		if strings.Contains(userAgent, strings.ToLower(b)) {
+			return true
+		}
+	}
+	return false
+}
+
+// botMode returns the mode for the request or BotOff if the client is not a bot.
+func (r *Service) botMode(userAgent string) BotMode {
+	if r.Bots == nil || r.Bots.Mode == BotOff || !r.Bots.IsBot(userAgent) {
+		return BotOff
+	}
+	return r.Bots.Mode
+}
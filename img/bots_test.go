@@ -0,0 +1,112 @@
+package img_test
+
+import (
+	"github.com/Pixboost/transformimgs/v8/img"
+	"github.com/dooman87/kolibri/test"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBotPolicy_IsBot(t *testing.T) {
+	policy := img.NewBotPolicy(img.BotReduce)
+	testCases := []struct {
+		userAgent string
+		expected  bool
+	}{
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0 Safari/537.36", false},
+		{"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)", true},
+		{"Googlebot-Image/1.0", false},
+		{"facebookexternalhit/1.1 (+http://www.facebook.com/externalhit_uatext.php)", true},
+		{"Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)", true},
+		{"WhatsApp/2.23.20.0", true},
+		{"", false},
+	}
+
+	for _, tc := range testCases {
+		if isBot := policy.IsBot(tc.userAgent); isBot != tc.expected {
+			t.Errorf("expected %t for [%s], but got %t", tc.expected, tc.userAgent, isBot)
+		}
+	}
+}
+
+func TestParseBotMode(t *testing.T) {
+	for name, expected := range map[string]img.BotMode{"off": img.BotOff, "reduce": img.BotReduce, "original": img.BotOriginal} {
+		mode, err := img.ParseBotMode(name)
+		if err != nil || mode != expected {
+			t.Errorf("expected %d for [%s], but got %d, %v", expected, name, mode, err)
+		}
+	}
+	if _, err := img.ParseBotMode("hide"); err == nil {
+		t.Errorf("expected error for unknown mode")
+	}
+}
+
+func TestService_Bots(t *testing.T) {
+	s := createService(t)
+	test.T = t
+
+	request := func(userAgent string) *http.Request {
+		return &http.Request{
+			Method: "GET",
+			URL:    parseUrl("http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise", t),
+			Header: http.Header{"User-Agent": {userAgent}},
+		}
+	}
+	expectImage := func(expected string) func(w *httptest.ResponseRecorder, t *testing.T) {
+		return func(w *httptest.ResponseRecorder, t *testing.T) {
+			test.Error(t,
+				test.Equal(expected, w.Body.String(), "Resulted image"),
+				test.Equal("Accept, User-Agent, Save-Data", w.Header().Get("Vary"), "Vary header"),
+			)
+		}
+	}
+
+	s.Bots = img.NewBotPolicy(img.BotReduce)
+	test.Service = s.GetRouter().ServeHTTP
+	test.RunRequests([]test.TestCase{
+		{
+			Description: "Crawler",
+			Request:     request("Mozilla/5.0 (compatible; bingbot/2.0; +http://www.bing.com/bingbot.htm)"),
+			Handler:     expectImage(ImgLowQualityOut),
+		},
+		{
+			Description: "Image crawler",
+			Request:     request("Googlebot-Image/1.0"),
+			Handler:     expectImage(ImgPngOut),
+		},
+		{
+			Description: "Browser",
+			Request:     request("Mozilla/5.0 (X11; Linux x86_64; rv:120.0) Gecko/20100101 Firefox/120.0"),
+			Handler:     expectImage(ImgPngOut),
+		},
+	})
+
+	s.Bots = img.NewBotPolicy(img.BotOriginal)
+	test.RunRequests([]test.TestCase{
+		{
+			Description: "Original for link preview bot",
+			Request:     request("facebookexternalhit/1.1"),
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal(ImgSrc, w.Body.String(), "Resulted image"),
+					test.Equal("image/png", w.Header().Get("Content-Type"), "Content-Type header"),
+				)
+			},
+		},
+	})
+
+	s.Bots = &img.BotPolicy{Mode: img.BotOff, Patterns: img.DefaultBotPatterns}
+	test.RunRequests([]test.TestCase{
+		{
+			Description: "Disabled",
+			Request:     request("facebookexternalhit/1.1"),
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal(ImgPngOut, w.Body.String(), "Resulted image"),
+					test.Equal("Accept, Save-Data", w.Header().Get("Vary"), "Vary header"),
+				)
+			},
+		},
+	})
+}
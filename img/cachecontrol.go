@@ -0,0 +1,113 @@
+package img
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// originMaxAge returns max-age in seconds from Cache-Control or Expires headers of the source.
+// s-maxage is preferred, because responses of the service are cached by CDN. Returns false if
+// the source doesn't have caching headers.
+func originMaxAge(src *Image, now time.Time) (int, bool) {
+	if src == nil {
+		return 0, false
+	}
+
+	maxAge, sharedMaxAge := -1, -1
+	for _, directive := range strings.Split(src.CacheControl, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		switch strings.ToLower(name) {
+		case "no-store", "no-cache", "private":
+			return 0, true
+		case "max-age":
+			maxAge = parseSeconds(value)
+		case "s-maxage":
+			sharedMaxAge = parseSeconds(value)
+		}
+	}
+	if sharedMaxAge >= 0 {
+		return sharedMaxAge, true
+	}
+	if maxAge >= 0 {
+		return maxAge, true
+	}
+
+	if len(src.Expires) > 0 {
+		expires, err := http.ParseTime(src.Expires)
+		if err != nil {
+			// Invalid dates mean the source is already expired
+			return 0, true
+		}
+		return max(0, int(expires.Sub(now).Seconds())), true
+	}
+	return 0, false
+}
+
+// originNoCache returns Cache-Control of responses of sources that forbid caching or require
+// revalidation: "private, no-store" for private and no-store sources and "no-cache" for no-cache ones.
+func originNoCache(src *Image) (string, bool) {
+	if src == nil {
+		return "", false
+	}
+	noCache := false
+	for _, directive := range strings.Split(src.CacheControl, ",") {
+		name, _, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		switch strings.ToLower(name) {
+		case "no-store", "private":
+			return "private, no-store", true
+		case "no-cache":
+			noCache = true
+		}
+	}
+	if noCache {
+		return "no-cache", true
+	}
+	return "", false
+}
+
+// parseSeconds returns non-negative number of seconds or -1 if the value is invalid.
+func parseSeconds(value string) int {
+	seconds, err := strconv.Atoi(strings.Trim(strings.TrimSpace(value), `"`))
+	if err != nil || seconds < 0 {
+		return -1
+	}
+	return seconds
+}
+
+// originCacheControl returns Cache-Control of the response of the command if the source forbids
+// caching or requires revalidation, see ServiceConfig.OriginCacheControl. MinCacheTTL doesn't apply,
+// so per-asset policies of the origin are preserved.
+func (r *Service) originCacheControl(op *Command) (string, bool) {
+	if !r.config().OriginCacheControl {
+		return "", false
+	}
+	if cacheControl, ok := originNoCache(op.Config.Src); ok {
+		return cacheControl, true
+	}
+	return originNoCache(op.Result)
+}
+
+// cacheTTL returns max-age of the response of the command, see ServiceConfig.OriginCacheControl.
+// The source is the result of commands that return it as is.
+func (r *Service) cacheTTL(op *Command) int {
+	config := r.config()
+	if !config.OriginCacheControl {
+		return config.CacheTTL
+	}
+
+	ttl, ok := originMaxAge(op.Config.Src, time.Now())
+	if !ok {
+		if ttl, ok = originMaxAge(op.Result, time.Now()); !ok {
+			return config.CacheTTL
+		}
+	}
+	if config.MinCacheTTL > 0 && ttl < config.MinCacheTTL {
+		ttl = config.MinCacheTTL
+	}
+	if config.MaxCacheTTL > 0 && ttl > config.MaxCacheTTL {
+		ttl = config.MaxCacheTTL
+	}
+	return ttl
+}
@@ -0,0 +1,168 @@
+package img_test
+
+import (
+	"context"
+	"github.com/Pixboost/transformimgs/v8/img"
+	"github.com/dooman87/kolibri/test"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// cacheLoader returns the source with caching headers from query params of the URL.
+type cacheLoader struct{}
+
+func (l *cacheLoader) Load(url string, _ context.Context) (*img.Image, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &img.Image{
+		Id:           url,
+		Data:         []byte(ImgSrc),
+		MimeType:     "image/png",
+		CacheControl: req.URL.Query().Get("cc"),
+		Expires:      req.URL.Query().Get("expires"),
+	}, nil
+}
+
+func TestService_OriginCacheControl(t *testing.T) {
+	s, err := img.NewServiceWithConfig(&cacheLoader{}, &resizerMock{}, 1, &img.ServiceConfig{
+		CacheTTL:           86400,
+		OriginCacheControl: true,
+		MinCacheTTL:        60,
+		MaxCacheTTL:        3600,
+	})
+	if err != nil {
+		t.Fatalf("could not create service: %s", err)
+	}
+	test.Service = s.GetRouter().ServeHTTP
+	test.T = t
+
+	expectCacheControl := func(expected string) func(w *httptest.ResponseRecorder, t *testing.T) {
+		return func(w *httptest.ResponseRecorder, t *testing.T) {
+			test.Error(t,
+				test.Equal(expected, w.Header().Get("Cache-Control"), "Cache-Control header"),
+			)
+		}
+	}
+	expires := time.Now().Add(20 * time.Minute).UTC().Format(http.TimeFormat)
+
+	test.RunRequests([]test.TestCase{
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com%2Fimg.png%3Fcc%3Dmax-age%253D600/optimise",
+			Description: "max-age of the origin",
+			Handler:     expectCacheControl("public, max-age=600"),
+		},
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com%2Fimg.png%3Fcc%3Dmax-age%253D600%252C%2520s-maxage%253D900/resize?size=300",
+			Description: "s-maxage of the origin",
+			Handler:     expectCacheControl("public, max-age=900"),
+		},
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com%2Fimg.png%3Fcc%3Dmax-age%253D31536000/asis",
+			Description: "Clamped to maximum",
+			Handler:     expectCacheControl("public, max-age=3600"),
+		},
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com%2Fimg.png%3Fcc%3Dmax-age%253D10/optimise",
+			Description: "Clamped to minimum",
+			Handler:     expectCacheControl("public, max-age=60"),
+		},
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com%2Fimg.png%3Fcc%3Dno-store/optimise",
+			Description: "No-store origin",
+			Handler:     expectCacheControl("private, no-store"),
+		},
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com%2Fimg.png%3Fcc%3Dprivate%252C%2520max-age%253D600/asis",
+			Description: "Private origin",
+			Handler:     expectCacheControl("private, no-store"),
+		},
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com%2Fimg.png%3Fcc%3Dno-cache/optimise",
+			Description: "No-cache origin",
+			Handler:     expectCacheControl("no-cache"),
+		},
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com%2Fimg.png%3Fexpires%3D" + expires + "/optimise",
+			Description: "Expires of the origin",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				cacheControl := w.Header().Get("Cache-Control")
+				if cacheControl != "public, max-age=1200" && cacheControl != "public, max-age=1199" {
+					t.Errorf("expected max-age of 20 minutes, but got [%s]", cacheControl)
+				}
+			},
+		},
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com%2Fimg.png/optimise",
+			Description: "Origin without caching headers",
+			Handler:     expectCacheControl("public, max-age=86400"),
+		},
+	})
+}
+
+// robotsLoader returns the source with X-Robots-Tag and Cache-Control headers from query params of the URL.
+type robotsLoader struct {
+	cacheLoader
+}
+
+func (l *robotsLoader) Load(url string, ctx context.Context) (*img.Image, error) {
+	image, err := l.cacheLoader.Load(url, ctx)
+	if err != nil {
+		return nil, err
+	}
+	req, _ := http.NewRequest("GET", url, nil)
+	image.RobotsTag = req.URL.Query().Get("robots")
+	return image, nil
+}
+
+func TestService_OriginOptOut(t *testing.T) {
+	s, err := img.NewServiceWithConfig(&robotsLoader{}, &resizerMock{}, 1, &img.ServiceConfig{
+		CacheTTL:     86400,
+		OriginOptOut: true,
+	})
+	if err != nil {
+		t.Fatalf("could not create service: %s", err)
+	}
+	test.Service = s.GetRouter().ServeHTTP
+	test.T = t
+
+	expectHeaders := func(cacheControl string, robotsTag string) func(w *httptest.ResponseRecorder, t *testing.T) {
+		return func(w *httptest.ResponseRecorder, t *testing.T) {
+			test.Error(t,
+				test.Equal(cacheControl, w.Header().Get("Cache-Control"), "Cache-Control header"),
+				test.Equal(robotsTag, w.Header().Get("X-Robots-Tag"), "X-Robots-Tag header"),
+			)
+		}
+	}
+
+	test.RunRequests([]test.TestCase{
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com%2Fimg.png%3Frobots%3Dnoimageindex/optimise",
+			Description: "X-Robots-Tag of the origin",
+			Handler:     expectHeaders("public, max-age=86400", "noimageindex"),
+		},
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com%2Fimg.png%3Fcc%3Dprivate%252C%2520max-age%253D60/optimise",
+			Description: "Private source",
+			Handler:     expectHeaders("private, no-store", ""),
+		},
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com%2Fimg.png%3Fcc%3Dno-store/optimise",
+			Description: "No-store source",
+			Handler:     expectHeaders("private, no-store", ""),
+		},
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com%2Fimg.png%3Fcc%3Dmax-age%253D60/optimise",
+			Description: "Public source",
+			Handler:     expectHeaders("public, max-age=86400", ""),
+		},
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com%2Fimg.png%3Fcc%3Dprivate%26robots%3Dnoimageindex/asis",
+			Description: "Private source as is",
+			Handler:     expectHeaders("private, no-store", "noimageindex"),
+		},
+	})
+}
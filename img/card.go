@@ -0,0 +1,314 @@
+package img
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// DefaultCardWidth and DefaultCardHeight is the size of Open Graph images
+	// recommended by social networks.
+	DefaultCardWidth  = 1200
+	DefaultCardHeight = 630
+)
+
+// MaxCardTextLength is the maximum number of characters in title and author of the card.
+var MaxCardTextLength = 200
+
+var cardGravities = map[string]bool{
+	"northwest": true, "north": true, "northeast": true,
+	"west": true, "center": true, "east": true,
+	"southwest": true, "south": true, "southeast": true,
+}
+
+// CardBox is the area of the card in pixels. Content is placed inside the area using gravity,
+// e.g. "west" or "center", which is "northwest" by default.
+type CardBox struct {
+	X       int    `json:"x"`
+	Y       int    `json:"y"`
+	Width   int    `json:"width"`
+	Height  int    `json:"height"`
+	Gravity string `json:"gravity"`
+}
+
+// CardText is the area of the card with text.
+type CardText struct {
+	CardBox
+	// Font is the name of the font or the path to the font file. ImageMagick default font is used if empty.
+	Font string `json:"font"`
+	// Size is the font size in points. If zero then text is scaled to fill the area.
+	Size float64 `json:"size"`
+	// Color of the text, "black" by default.
+	Color string `json:"color"`
+}
+
+// CardImage is the area of the card with an image. Image is resized to fit the area.
+type CardImage struct {
+	CardBox
+	// Src is the URL of the image used when it's not set in the request.
+	Src string `json:"src"`
+}
+
+// CardTemplate is the layout of the social card.
+type CardTemplate struct {
+	// Width and Height is the size of the card, 1200x630 by default.
+	Width  int `json:"width"`
+	Height int `json:"height"`
+	// Background is the color of the card when background image is not set, "white" by default.
+	// Background images are resized to cover the card.
+	Background string `json:"background"`
+	// Title, Author and Logo are optional areas of the card.
+	Title  *CardText  `json:"title"`
+	Author *CardText  `json:"author"`
+	Logo   *CardImage `json:"logo"`
+}
+
+// CardTemplates are card templates by name.
+type CardTemplates map[string]*CardTemplate
+
+// CardConfig is the configuration of the card passed to CardRenderer
+// in TransformationConfig.Config.
+type CardConfig struct {
+	Template *CardTemplate
+	// Background and Logo are nil if not set.
+	Background *Image
+	Logo       *Image
+	// Title and Author are empty if not set.
+	Title  string
+	Author string
+}
+
+// CardRenderer is implemented by processors that could render social cards.
+type CardRenderer interface {
+	// Card renders the card from CardConfig passed in input.Config.
+	Card(input *TransformationConfig) (*Image, error)
+}
+
+// renderCard renders the card using the processor or returns 501 error if processor is not a CardRenderer.
+func renderCard(p Processor, config *TransformationConfig) (*Image, error) {
+	renderer, ok := p.(CardRenderer)
+	if !ok {
+		return nil, NewHttpError(http.StatusNotImplemented, "processor doesn't support cards")
+	}
+	return renderer.Card(config)
+}
+
+// LoadCardTemplates reads card templates in YAML format, e.g.
+//
+//	article:
+//	  background: "#1e293b"
+//	  title:
+//	    x: 80
+//	    y: 200
+//	    width: 1040
+//	    height: 240
+//	    size: 64
+//	    color: white
+//	    gravity: west
+//	  logo:
+//	    src: https://site.com/logo.png
+//	    x: 80
+//	    y: 60
+//	    width: 200
+//	    height: 80
+//
+// Only block mappings and scalars are supported.
+func LoadCardTemplates(r io.Reader) (CardTemplates, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := parseYaml(data)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse card templates: %w", err)
+	}
+
+	// Converting to JSON to map values to the structs with type checks
+	jsonData, err := json.Marshal(parsed)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse card templates: %w", err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(jsonData))
+	decoder.DisallowUnknownFields()
+	var templates CardTemplates
+	err = decoder.Decode(&templates)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse card templates: %w", err)
+	}
+
+	for name, t := range templates {
+		if t == nil {
+			return nil, fmt.Errorf("card template [%s] is empty", name)
+		}
+		if err := t.init(); err != nil {
+			return nil, fmt.Errorf("card template [%s]: %w", name, err)
+		}
+	}
+
+	return templates, nil
+}
+
+// init sets default values and validates the template.
+func (t *CardTemplate) init() error {
+	if t.Width == 0 {
+		t.Width = DefaultCardWidth
+	}
+	if t.Height == 0 {
+		t.Height = DefaultCardHeight
+	}
+	if len(t.Background) == 0 {
+		t.Background = "white"
+	}
+	if t.Width < 0 || t.Height < 0 {
+		return errors.New("width and height must be positive")
+	}
+
+	if t.Title != nil {
+		if err := t.Title.init(t, "title"); err != nil {
+			return err
+		}
+	}
+	if t.Author != nil {
+		if err := t.Author.init(t, "author"); err != nil {
+			return err
+		}
+	}
+	if t.Logo != nil {
+		if err := t.Logo.init(t, "logo"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *CardBox) init(t *CardTemplate, name string) error {
+	if len(b.Gravity) == 0 {
+		b.Gravity = "northwest"
+	}
+	if !cardGravities[b.Gravity] {
+		return fmt.Errorf("%s has unknown gravity [%s]", name, b.Gravity)
+	}
+	if b.Width <= 0 || b.Height <= 0 {
+		return fmt.Errorf("%s must have positive width and height", name)
+	}
+	if b.X < 0 || b.Y < 0 || b.X+b.Width > t.Width || b.Y+b.Height > t.Height {
+		return fmt.Errorf("%s must be inside the card", name)
+	}
+	return nil
+}
+
+func (c *CardText) init(t *CardTemplate, name string) error {
+	if len(c.Color) == 0 {
+		c.Color = "black"
+	}
+	if c.Size < 0 {
+		return fmt.Errorf("%s must have non negative size", name)
+	}
+	return c.CardBox.init(t, name)
+}
+
+// CardUrl renders the social card using the template from the path. Text is set by
+// title and author params, background and logo images by bg and logo params.
+func (r *Service) CardUrl(resp http.ResponseWriter, req *http.Request) {
+	if _, ok := r.Processor.(CardRenderer); !ok {
+		http.Error(resp, "processor doesn't support cards", http.StatusNotImplemented)
+		return
+	}
+
+	name := PathVars(req)["template"]
+	template, ok := r.CardTemplates[name]
+	if !ok {
+		http.Error(resp, fmt.Sprintf("card template [%s] not found", name), http.StatusNotFound)
+		return
+	}
+	// Templates are loaded before services are configured, so the limit is checked here
+	if maxDimension := r.config().MaxDimension; maxDimension > 0 && (template.Width > maxDimension || template.Height > maxDimension) {
+		r.sendError(resp, NewHttpError(http.StatusInternalServerError, fmt.Sprintf("width and height of card template [%s] must not be more than %d", name, maxDimension)))
+		return
+	}
+
+	config := &CardConfig{Template: template}
+	for _, text := range []struct {
+		param string
+		value *string
+	}{{"title", &config.Title}, {"author", &config.Author}} {
+		value, _ := getQueryParam(req.URL, text.param)
+		if utf8.RuneCountInString(value) > MaxCardTextLength {
+			http.Error(resp, fmt.Sprintf("%s param must not be longer than %d characters", text.param, MaxCardTextLength), http.StatusBadRequest)
+			return
+		}
+		*text.value = strings.Map(func(r rune) rune {
+			if unicode.IsControl(r) {
+				return ' '
+			}
+			return r
+		}, value)
+	}
+
+	var sources []string
+	bg, _ := getQueryParam(req.URL, "bg")
+	if len(bg) > 0 {
+		sources = append(sources, bg)
+	}
+	logo, _ := getQueryParam(req.URL, "logo")
+	if template.Logo == nil {
+		logo = ""
+	} else if len(logo) == 0 {
+		logo = template.Logo.Src
+	}
+	if len(logo) > 0 {
+		sources = append(sources, logo)
+	}
+
+	mergeHeader(resp.Header(), "Vary", r.formatsVary())
+
+	r.log().Printf("[%s]: Rendering card [%s]\n", req.URL.String(), name)
+
+	images, err := r.loadAll(req, sources)
+	if err != nil {
+		r.sendError(resp, err)
+		return
+	}
+	defer func() {
+		for _, image := range images {
+			image.Release()
+		}
+	}()
+	if len(bg) > 0 {
+		config.Background = images[0]
+	}
+	if len(logo) > 0 {
+		config.Logo = images[len(images)-1]
+	}
+
+	release, err := r.acquireAll(req, images)
+	if err != nil {
+		r.sendError(resp, err)
+		return
+	}
+	defer release()
+
+	r.execOp(&Command{
+		Transformation: func(input *TransformationConfig) (*Image, error) {
+			return renderCard(r.Processor, input)
+		},
+		Config: &TransformationConfig{
+			Src: &Image{
+				Id:      fmt.Sprintf("card %s", name),
+				NoStore: anyNoStore(images),
+			},
+			SupportedFormats: r.supportedFormats(req),
+			Quality:          DEFAULT,
+			Config:           config,
+		},
+		Req:  req,
+		Resp: resp,
+	})
+}
@@ -0,0 +1,86 @@
+package img_test
+
+import (
+	"github.com/Pixboost/transformimgs/v8/img"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadCardTemplates(t *testing.T) {
+	templates, err := img.LoadCardTemplates(strings.NewReader(`
+# Default layout for blog posts
+article:
+  background: "#1e293b"   # dark blue
+  title:
+    x: 80
+    y: 200
+    width: 1040
+    height: 240
+    size: 64.5
+    color: white
+    font: 'Open Sans'
+    gravity: west
+
+  logo:
+    src: https://site.com/logo.png
+    x: 80
+    y: 60
+    width: 200
+    height: 80
+square:
+  width: 600
+  height: 600
+`))
+	if err != nil {
+		t.Fatalf("could not load templates: %s", err)
+	}
+
+	expected := img.CardTemplates{
+		"article": {
+			Width:      img.DefaultCardWidth,
+			Height:     img.DefaultCardHeight,
+			Background: "#1e293b",
+			Title: &img.CardText{
+				CardBox: img.CardBox{X: 80, Y: 200, Width: 1040, Height: 240, Gravity: "west"},
+				Font:    "Open Sans",
+				Size:    64.5,
+				Color:   "white",
+			},
+			Logo: &img.CardImage{
+				CardBox: img.CardBox{X: 80, Y: 60, Width: 200, Height: 80, Gravity: "northwest"},
+				Src:     "https://site.com/logo.png",
+			},
+		},
+		"square": {
+			Width:      600,
+			Height:     600,
+			Background: "white",
+		},
+	}
+	if !reflect.DeepEqual(templates, expected) {
+		t.Errorf("expected templates %+v, but got %+v", expected, templates)
+	}
+}
+
+func TestLoadCardTemplates_Invalid(t *testing.T) {
+	for _, tc := range []struct {
+		description string
+		yaml        string
+	}{
+		{"Unknown field", "article:\n  colour: red\n"},
+		{"Wrong type", "article:\n  width: wide\n"},
+		{"Unexpected indentation", "article:\n  width: 100\n    height: 100\n"},
+		{"Duplicate key", "article:\n  width: 100\n  width: 200\n"},
+		{"Sequences", "article:\n  - title\n"},
+		{"Empty template", "article:\n"},
+		{"Unknown gravity", "article:\n  title:\n    width: 10\n    height: 10\n    gravity: middle\n"},
+		{"Area outside of the card", "article:\n  title:\n    x: 1100\n    width: 200\n    height: 10\n"},
+		{"Empty area", "article:\n  logo:\n    src: https://site.com/logo.png\n"},
+	} {
+		_, err := img.LoadCardTemplates(strings.NewReader(tc.yaml))
+		if err == nil {
+			t.Errorf("%s: expected error", tc.description)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package img
+
+import (
+	"errors"
+	"github.com/dooman87/glogi"
+	"sync"
+	"time"
+)
+
+// CircuitState is the state of the circuit breaker.
+type CircuitState int
+
+const (
+	// CircuitClosed means that transformations go to the processor.
+	CircuitClosed CircuitState = iota
+	// CircuitOpen means that transformations are short-circuited to the fallback.
+	CircuitOpen
+	// CircuitHalfOpen means that cool-down has passed and the next transformation
+	// will go to the processor to check if it's healthy again.
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// CircuitBreakerStats holds the state and counters of the circuit breaker.
+type CircuitBreakerStats struct {
+	State CircuitState
+	// Failures is the number of consecutive failures.
+	Failures int
+	// Opened is the number of times circuit has been opened.
+	Opened uint64
+	// ShortCircuited is the number of transformations that were served by the fallback.
+	ShortCircuited uint64
+}
+
+// CircuitBreaker is the Processor that protects against repeated failures
+// of the underlying processor, e.g. broken delegate or timeouts. When number of consecutive
+// failures reaches Threshold the circuit opens and all transformations go
+// to the Fallback processor for the CoolDown period. If Fallback is nil then
+// the source image is returned as is.
+type CircuitBreaker struct {
+	Processor Processor
+	// Fallback is the processor to use when circuit is open.
+	// If nil then source image is returned as is.
+	Fallback Processor
+	// Threshold is the number of consecutive failures that opens the circuit.
+	Threshold int
+	// CoolDown is the period when circuit stays open.
+	CoolDown time.Duration
+	// SlowCall is the duration after which successful transformation is
+	// counted as a failure. Zero disables the check.
+	SlowCall time.Duration
+	// IsFailure returns true if error should be counted as a processor failure.
+	// By default, all errors except HttpError with 4xx codes are failures.
+	IsFailure func(err error) bool
+	// Log is the logger. Package Log is used if nil.
+	Log glogi.Logger
+
+	mux      sync.Mutex
+	stats    CircuitBreakerStats
+	openedAt time.Time
+	trial    bool
+}
+
+// NewCircuitBreaker creates a circuit breaker around the processor.
+func NewCircuitBreaker(p Processor, threshold int, coolDown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		Processor: p,
+		Threshold: threshold,
+		CoolDown:  coolDown,
+	}
+}
+
+func (c *CircuitBreaker) Resize(config *TransformationConfig) (*Image, error) {
+	return c.exec(config, c.Processor.Resize, func(p Processor) Cmd { return p.Resize })
+}
+
+func (c *CircuitBreaker) FitToSize(config *TransformationConfig) (*Image, error) {
+	return c.exec(config, c.Processor.FitToSize, func(p Processor) Cmd { return p.FitToSize })
+}
+
+func (c *CircuitBreaker) Optimise(config *TransformationConfig) (*Image, error) {
+	return c.exec(config, c.Processor.Optimise, func(p Processor) Cmd { return p.Optimise })
+}
+
+// Upscale delegates to the processor if it's an Upscaler.
+func (c *CircuitBreaker) Upscale(config *TransformationConfig) (*Image, error) {
+	return c.exec(config, func(config *TransformationConfig) (*Image, error) {
+		return upscale(c.Processor, config)
+	}, func(p Processor) Cmd {
+		return func(config *TransformationConfig) (*Image, error) {
+			return upscale(p, config)
+		}
+	})
+}
+
+// Transcode delegates to the processor if it's a Transcoder.
+func (c *CircuitBreaker) Transcode(config *TransformationConfig) (*Image, error) {
+	return c.exec(config, func(config *TransformationConfig) (*Image, error) {
+		return transcode(c.Processor, config)
+	}, func(p Processor) Cmd {
+		return func(config *TransformationConfig) (*Image, error) {
+			return transcode(p, config)
+		}
+	})
+}
+
+// Plan delegates to the processor if it's a Planner. Plans are cheap,
+// so they don't affect the state of the circuit.
+func (c *CircuitBreaker) Plan(op string, config *TransformationConfig) (*Debug, error) {
+	return plan(c.Processor, op, config)
+}
+
+// Montage delegates to the processor if it's a Montager. Montages don't affect
+// the state of the circuit, because the source can't be served as a fallback.
+func (c *CircuitBreaker) Montage(config *TransformationConfig) (*Image, error) {
+	return montage(c.Processor, config)
+}
+
+// LoadImageInfo delegates to the processor if it could identify images, e.g. it's a Spriter or Tiler.
+func (c *CircuitBreaker) LoadImageInfo(src *Image) (*Info, error) {
+	return loadImageInfo(c.Processor, src)
+}
+
+// Sprite delegates to the processor if it's a Spriter.
+func (c *CircuitBreaker) Sprite(config *TransformationConfig) (*Image, error) {
+	spriter, err := asSpriter(c.Processor)
+	if err != nil {
+		return nil, err
+	}
+	return spriter.Sprite(config)
+}
+
+// Ladder delegates to the processor if it's a Ladderer.
+func (c *CircuitBreaker) Ladder(config *TransformationConfig) ([]*Image, error) {
+	ladderer, err := asLadderer(c.Processor)
+	if err != nil {
+		return nil, err
+	}
+	return ladderer.Ladder(config)
+}
+
+// Card delegates to the processor if it's a CardRenderer.
+func (c *CircuitBreaker) Card(config *TransformationConfig) (*Image, error) {
+	return renderCard(c.Processor, config)
+}
+
+// Tile delegates to the processor if it's a Tiler.
+func (c *CircuitBreaker) Tile(config *TransformationConfig) (*Image, error) {
+	return tile(c.Processor, config)
+}
+
+// LoadExif delegates to the processor if it's a MetadataReader.
+func (c *CircuitBreaker) LoadExif(src *Image) (map[string]string, error) {
+	return loadExif(c.Processor, src)
+}
+
+// Stats returns current state and counters.
+func (c *CircuitBreaker) Stats() CircuitBreakerStats {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.updateState()
+	return c.stats
+}
+
+func (c *CircuitBreaker) exec(config *TransformationConfig, cmd Cmd, fallback func(p Processor) Cmd) (*Image, error) {
+	if !c.allow() {
+		if c.Fallback != nil {
+			return fallback(c.Fallback)(config)
+		}
+		// The source is not cached, so the transformed image is served once the circuit closes
+		return &Image{
+			Id:       config.Src.Id,
+			Data:     config.Src.Data,
+			MimeType: config.Src.MimeType,
+			NoStore:  true,
+		}, nil
+	}
+
+	start := time.Now()
+	result, err := cmd(config)
+	c.record(err, time.Since(start))
+
+	return result, err
+}
+
+// allow returns true if transformation should go to the processor.
+func (c *CircuitBreaker) allow() bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	c.updateState()
+	switch c.stats.State {
+	case CircuitOpen:
+		c.stats.ShortCircuited++
+		return false
+	case CircuitHalfOpen:
+		if c.trial {
+			c.stats.ShortCircuited++
+			return false
+		}
+		c.trial = true
+	}
+
+	return true
+}
+
+func (c *CircuitBreaker) record(err error, duration time.Duration) {
+	failed := err != nil && c.isFailure(err)
+	if err == nil && c.SlowCall > 0 && duration > c.SlowCall {
+		failed = true
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.stats.State == CircuitHalfOpen {
+		c.trial = false
+	}
+
+	if !failed {
+		if c.stats.State != CircuitClosed {
+			logOrDefault(c.Log).Printf("Circuit breaker is closed\n")
+		}
+		c.stats.Failures = 0
+		c.stats.State = CircuitClosed
+		return
+	}
+
+	c.stats.Failures++
+	if c.stats.State == CircuitHalfOpen || (c.stats.State == CircuitClosed && c.stats.Failures >= c.Threshold) {
+		logOrDefault(c.Log).Printf("Circuit breaker is open for %s after %d consecutive failures, last error: %v\n", c.CoolDown, c.stats.Failures, err)
+		c.stats.State = CircuitOpen
+		c.stats.Opened++
+		c.openedAt = time.Now()
+	}
+}
+
+// updateState moves circuit to half-open state when cool-down has passed.
+// Must be called with the lock held.
+func (c *CircuitBreaker) updateState() {
+	if c.stats.State == CircuitOpen && time.Since(c.openedAt) >= c.CoolDown {
+		c.stats.State = CircuitHalfOpen
+		c.trial = false
+	}
+}
+
+func (c *CircuitBreaker) isFailure(err error) bool {
+	if c.IsFailure != nil {
+		return c.IsFailure(err)
+	}
+
+	var httpErr *HttpError
+	if errors.As(err, &httpErr) {
+		return httpErr.Code() >= 500
+	}
+	return true
+}
@@ -0,0 +1,160 @@
+package img_test
+
+import (
+	"errors"
+	"github.com/Pixboost/transformimgs/v8/img"
+	"github.com/dooman87/kolibri/test"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type failingProcMock struct {
+	err    error
+	calls  int
+	config *img.TransformationConfig
+}
+
+func (p *failingProcMock) transform(config *img.TransformationConfig) (*img.Image, error) {
+	p.calls++
+	p.config = config
+	if p.err != nil {
+		return nil, p.err
+	}
+	return &img.Image{Data: []byte("processed"), MimeType: "image/webp"}, nil
+}
+
+func (p *failingProcMock) Resize(config *img.TransformationConfig) (*img.Image, error) {
+	return p.transform(config)
+}
+
+func (p *failingProcMock) FitToSize(config *img.TransformationConfig) (*img.Image, error) {
+	return p.transform(config)
+}
+
+func (p *failingProcMock) Optimise(config *img.TransformationConfig) (*img.Image, error) {
+	return p.transform(config)
+}
+
+func circuitConfig() *img.TransformationConfig {
+	return &img.TransformationConfig{
+		Src: &img.Image{Id: "src", Data: []byte("source"), MimeType: "image/png"},
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	proc := &failingProcMock{err: errors.New("delegate failed")}
+	c := img.NewCircuitBreaker(proc, 2, 50*time.Millisecond)
+
+	_, err1 := c.Resize(circuitConfig())
+	_, err2 := c.FitToSize(circuitConfig())
+	result, err3 := c.Optimise(circuitConfig())
+	stats := c.Stats()
+
+	test.Error(t,
+		test.NotNil(err1, "first failure"),
+		test.NotNil(err2, "second failure"),
+		test.Nil(err3, "short circuited"),
+		test.Equal("source", string(result.Data), "source image returned as is"),
+		test.Equal("image/png", result.MimeType, "source mime type"),
+		test.Equal(true, result.NoStore, "source is not cached"),
+		test.Equal(2, proc.calls, "processor calls"),
+		test.Equal(img.CircuitOpen, stats.State, "state"),
+		test.Equal(uint64(1), stats.Opened, "opened"),
+		test.Equal(uint64(1), stats.ShortCircuited, "short circuited"),
+	)
+
+	time.Sleep(60 * time.Millisecond)
+	test.Error(t,
+		test.Equal(img.CircuitHalfOpen, c.Stats().State, "state after cool-down"),
+	)
+
+	proc.err = nil
+	result, err := c.Optimise(circuitConfig())
+	test.Error(t,
+		test.Nil(err, "trial call"),
+		test.Equal("processed", string(result.Data), "processed image"),
+		test.Equal(img.CircuitClosed, c.Stats().State, "state after successful trial"),
+		test.Equal(0, c.Stats().Failures, "failures reset"),
+	)
+}
+
+func TestCircuitBreaker_HalfOpenFailure(t *testing.T) {
+	proc := &failingProcMock{err: errors.New("delegate failed")}
+	c := img.NewCircuitBreaker(proc, 1, 10*time.Millisecond)
+
+	_, _ = c.Optimise(circuitConfig())
+	time.Sleep(20 * time.Millisecond)
+	_, err := c.Optimise(circuitConfig())
+
+	test.Error(t,
+		test.NotNil(err, "trial call failed"),
+		test.Equal(img.CircuitOpen, c.Stats().State, "state"),
+		test.Equal(uint64(2), c.Stats().Opened, "opened"),
+	)
+}
+
+func TestCircuitBreaker_Fallback(t *testing.T) {
+	proc := &failingProcMock{err: errors.New("delegate failed")}
+	fallback := &failingProcMock{}
+	c := img.NewCircuitBreaker(proc, 1, time.Minute)
+	c.Fallback = fallback
+
+	_, _ = c.Optimise(circuitConfig())
+	result, err := c.Optimise(circuitConfig())
+
+	test.Error(t,
+		test.Nil(err, "error"),
+		test.Equal("processed", string(result.Data), "fallback result"),
+		test.Equal(1, fallback.calls, "fallback calls"),
+	)
+}
+
+func TestCircuitBreaker_ClientErrors(t *testing.T) {
+	proc := &failingProcMock{err: img.NewHttpError(http.StatusBadRequest, "bad image")}
+	c := img.NewCircuitBreaker(proc, 1, time.Minute)
+
+	_, _ = c.Optimise(circuitConfig())
+	_, _ = c.Optimise(circuitConfig())
+
+	test.Error(t,
+		test.Equal(img.CircuitClosed, c.Stats().State, "state"),
+		test.Equal(2, proc.calls, "processor calls"),
+	)
+}
+
+func TestService_CircuitOpen(t *testing.T) {
+	s, err := img.NewService(&loaderMock{}, img.NewCircuitBreaker(&failingProcMock{err: errors.New("delegate failed")}, 1, time.Minute), 1)
+	if err != nil {
+		t.Fatalf("could not create service: %s", err)
+	}
+	test.Service = s.GetRouter().ServeHTTP
+	test.T = t
+
+	test.RunRequests([]test.TestCase{
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise",
+			Description:  "Failure opens the circuit",
+			ExpectedCode: http.StatusInternalServerError,
+		},
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise",
+			Description: "Source is not cached",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal(ImgSrc, w.Body.String(), "source image"),
+					test.Equal("no-store", w.Header().Get("Cache-Control"), "Cache-Control header"),
+				)
+			},
+		},
+	})
+}
+
+func TestCircuitState_String(t *testing.T) {
+	test.Error(t,
+		test.Equal("closed", img.CircuitClosed.String(), "closed"),
+		test.Equal("open", img.CircuitOpen.String(), "open"),
+		test.Equal("half-open", img.CircuitHalfOpen.String(), "half-open"),
+	)
+}
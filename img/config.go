@@ -0,0 +1,149 @@
+package img
+
+import (
+	"github.com/dooman87/glogi"
+	"net"
+	"net/http"
+)
+
+// ServiceConfig is the configuration of the service, so services with different
+// configuration could run in one process.
+type ServiceConfig struct {
+	// CacheTTL is the number of seconds that will be written to max-age HTTP header.
+	CacheTTL int
+	// OriginCacheControl is the flag to use max-age from Cache-Control or Expires headers of the source
+	// instead of CacheTTL, so caching policies of the origin survive transformations. CacheTTL is used
+	// if the origin doesn't have them. Responses of private and no-store sources get "private, no-store"
+	// and responses of no-cache sources get "no-cache" Cache-Control regardless of MinCacheTTL.
+	OriginCacheControl bool
+	// OriginOptOut is the flag to honor opt-out headers of the source for compliance-sensitive proxies.
+	// X-Robots-Tag, e.g. noimageindex, is passed through to responses, and responses of private or
+	// no-store sources get "private, no-store" Cache-Control and are not cached as variants.
+	OriginOptOut bool
+	// MinCacheTTL and MaxCacheTTL clamp max-age of the origin. Zero disables the limit.
+	MinCacheTTL int
+	MaxCacheTTL int
+	// MaxDppx is the maximum value of dppx query param. Bigger values are clamped to MaxDppx.
+	// Zero disables the limit.
+	MaxDppx float64
+	// NetworkHints is the flag to enable ECT and Downlink client hints.
+	// If enabled, then images are served with LOW quality on slow networks, see SlowDownlink.
+	// ECT and Downlink are added to Vary response header, so CDN must support them.
+	NetworkHints bool
+	// SlowDownlink is the bandwidth in Mbps reported by Downlink client hint
+	// below which network is considered slow. Zero disables the check.
+	SlowDownlink float64
+	// MaxWidth and MaxHeight limit the size of resize, fit and upscale operations in pixels after
+	// scaling by dppx, so clients can't request huge upscales that take minutes of CPU. Bigger sizes are
+	// scaled down preserving the aspect ratio. Zero disables the limit.
+	MaxWidth  int
+	MaxHeight int
+	// RejectOversized is the flag to respond with 400 to sizes bigger than MaxWidth or MaxHeight instead
+	// of scaling them down. Sizes from Width client hint are always scaled down.
+	RejectOversized bool
+	// MaxDimension is the maximum width and height in pixels that could be requested in size param,
+	// and of avatars, montages, sprite sheets, cards and IIIF images. Zero disables the limit.
+	MaxDimension int
+	// MaxMontageImages is the maximum number of source images in the montage. Zero disables the limit.
+	MaxMontageImages int
+	// MaxSpriteImages is the maximum number of source images in the sprite sheet. Zero disables the limit.
+	MaxSpriteImages int
+	// MaxLadderWidths is the maximum number of widths in the ladder. Zero disables the limit.
+	MaxLadderWidths int
+	// TileSize is the size of tiles in pixels for Deep Zoom and IIIF clients. DefaultTileSize is used if zero.
+	TileSize int
+	// AvifPolicies define when AVIF is served for each operation, e.g. "resize". AvifAllOps applies
+	// to operations without their own policy. AVIF is served whenever the processor selects it if nil.
+	AvifPolicies map[string]*AvifPolicy
+	// MaxBytes is the default limit of the response size in bytes, see max-bytes query param.
+	// Quality and then the size of images are lowered to fit the limit. Zero disables the limit.
+	MaxBytes int
+	// MaxFrames is the default limit of the number of frames of animated images, see max-frames
+	// query param. Longer animations are sampled evenly. Zero disables the limit.
+	MaxFrames int
+	// QueueWeights enables weighted fair scheduling of transformations between classes of commands
+	// (ClassAsIs, ClassOther or the name of the operation, e.g. "optimise"), so lightweight requests
+	// are not starved behind heavy encodes. Classes that are not in the map have DefaultQueueWeight.
+	// Commands are distributed between queues of processors in turns if not set.
+	QueueWeights map[string]int
+	// DigestHeaders are names of headers with SHA-256 digest of the response body that are added to
+	// responses: ContentDigestHeader and/or DigestHeader. Digest is not added if empty.
+	DigestHeaders []string
+	// SourceBase is the base URL of sources, e.g. https://origin.site.com/images. Source URLs
+	// without scheme, e.g. /img/products/1.jpg/resize, are loaded from SourceBase, so templates
+	// are simpler and the origin is hidden from clients. Paths are loaded as is if empty.
+	SourceBase string
+	// DefaultScheme is the scheme of protocol relative source URLs, e.g. //site.com/img.png, when
+	// X-Forwarded-Proto header is absent or not allowed. URLs are loaded as is if empty.
+	DefaultScheme string
+	// ForwardedProtos are values of X-Forwarded-Proto header that are used as the scheme of protocol
+	// relative source URLs. DefaultForwardedProtos are used if nil.
+	ForwardedProtos []string
+	// TrustedProxies are networks of proxies whose X-Forwarded-Proto and X-Forwarded-Host headers are
+	// honored. Headers of other peers are ignored, so they can't be spoofed. No peer is trusted if nil.
+	TrustedProxies []*net.IPNet
+	// ProblemDetails is the flag to respond to all errors with RFC 7807 problem details JSON with
+	// machine-readable codes, see Problem. Otherwise, only requests with Accept header that includes
+	// application/json or application/problem+json get them and other errors are plain text.
+	ProblemDetails bool
+	// Log is the logger of the service. Package Log is used if nil.
+	Log glogi.Logger
+}
+
+// DefaultForwardedProtos are allowed values of X-Forwarded-Proto header.
+var DefaultForwardedProtos = []string{"http", "https"}
+
+// DefaultServiceConfig returns the configuration with values of deprecated package variables.
+func DefaultServiceConfig() *ServiceConfig {
+	return &ServiceConfig{
+		CacheTTL:         CacheTTL,
+		MaxDppx:          MaxDppx,
+		NetworkHints:     NetworkHintsEnabled,
+		SlowDownlink:     SlowDownlink,
+		MaxDimension:     MaxDimension,
+		MaxMontageImages: MaxMontageImages,
+		MaxSpriteImages:  MaxSpriteImages,
+		MaxLadderWidths:  DefaultMaxLadderWidths,
+		TileSize:         TileSize,
+		Log:              Log,
+	}
+}
+
+// config returns the configuration of the service. NewService sets DefaultServiceConfig, so
+// only services that are not created by constructors use package variables.
+func (r *Service) config() *ServiceConfig {
+	if r.Config != nil {
+		return r.Config
+	}
+	return DefaultServiceConfig()
+}
+
+// tileSize returns the size of tiles, see ServiceConfig.TileSize.
+func (r *Service) tileSize() int {
+	if tileSize := r.config().TileSize; tileSize > 0 {
+		return tileSize
+	}
+	return DefaultTileSize
+}
+
+// trustForwarded returns true if X-Forwarded-* headers of the request are set by a trusted proxy,
+// see ServiceConfig.TrustedProxies.
+func (r *Service) trustForwarded(req *http.Request) bool {
+	ip := remoteIP(req)
+	return ip != nil && containsIP(r.config().TrustedProxies, ip)
+}
+
+func (r *Service) log() glogi.Logger {
+	if r.Config != nil {
+		return logOrDefault(r.Config.Log)
+	}
+	return Log
+}
+
+// logOrDefault returns the logger or package Log if it's nil.
+func logOrDefault(log glogi.Logger) glogi.Logger {
+	if log != nil {
+		return log
+	}
+	return Log
+}
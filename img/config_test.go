@@ -0,0 +1,126 @@
+package img_test
+
+import (
+	"fmt"
+	"github.com/Pixboost/transformimgs/v8/img"
+	"github.com/dooman87/kolibri/test"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type loggerMock struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *loggerMock) Printf(format string, v ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+func (l *loggerMock) Print(v ...interface{}) {
+	l.Printf("%s", fmt.Sprint(v...))
+}
+
+func (l *loggerMock) Errorf(format string, v ...interface{}) {
+	l.Printf(format, v...)
+}
+
+func (l *loggerMock) Error(v ...interface{}) {
+	l.Print(v...)
+}
+
+func TestNewServiceWithConfig(t *testing.T) {
+	logger := &loggerMock{}
+	configured, err := img.NewServiceWithConfig(&loaderMock{}, &resizerMock{}, 1, &img.ServiceConfig{
+		CacheTTL:     60,
+		MaxDppx:      1,
+		MaxDimension: 200,
+		Log:          logger,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// Second service in the same process is configured by package variables
+	global := createService(t)
+
+	for _, s := range []*img.Service{configured, global} {
+		s := s
+		maxDimensionCode := http.StatusOK
+		if s == configured {
+			maxDimensionCode = http.StatusBadRequest
+		}
+		test.Service = s.GetRouter().ServeHTTP
+		test.T = t
+
+		test.RunRequests([]test.TestCase{
+			{
+				Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise?dppx=3",
+				Description: "Cache-Control and dppx",
+				Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+					if s == configured {
+						test.Error(t,
+							test.Equal("public, max-age=60", w.Header().Get("Cache-Control"), "Cache-Control header"),
+							test.Equal(ImgPngOut, w.Body.String(), "dppx is clamped"),
+						)
+					} else {
+						test.Error(t,
+							test.Equal("public, max-age=86400", w.Header().Get("Cache-Control"), "Cache-Control header"),
+							test.Equal(ImgLowerQualityOut, w.Body.String(), "High density image"),
+						)
+					}
+				},
+			},
+			{
+				Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/resize?size=300",
+				Description:  "Max dimension",
+				ExpectedCode: maxDimensionCode,
+			},
+		})
+	}
+
+	logs := strings.Join(logger.lines, "\n")
+	for _, expected := range []string{"Transforming image http://site.com/img.png", "Starting transformation for [http://site.com/img.png]"} {
+		if !strings.Contains(logs, expected) {
+			t.Errorf("expected [%s] in logs of the configured service, but got %v", expected, logger.lines)
+		}
+	}
+	if global.Config == nil || global.Config.CacheTTL != img.CacheTTL {
+		t.Errorf("expected configuration of package variables, but got %+v", global.Config)
+	}
+
+	// Errors of the request are logged by the service that served it
+	other := &loggerMock{}
+	otherService, _ := img.NewServiceWithConfig(&loaderMock{}, &resizerMock{}, 1, &img.ServiceConfig{Log: other})
+	logger.lines = nil
+	test.Service = otherService.GetRouter().ServeHTTP
+	test.RunRequests([]test.TestCase{
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise",
+			Description: "Other service",
+		},
+	})
+	if len(logger.lines) != 0 || len(other.lines) == 0 {
+		t.Errorf("expected logs of the other service only, but got %v and %v", logger.lines, other.lines)
+	}
+
+	if _, err = img.NewServiceWithConfig(&loaderMock{}, &resizerMock{}, 0, &img.ServiceConfig{}); err == nil {
+		t.Errorf("expected error for procNum 0")
+	}
+}
+
+func TestNewService_SaveDataEnabled(t *testing.T) {
+	img.SaveDataEnabled = false
+	defer func() {
+		img.SaveDataEnabled = true
+	}()
+	s := createService(t)
+
+	if _, ok := s.SaveData.(img.OffSaveDataPolicy); !ok {
+		t.Errorf("expected OffSaveDataPolicy, but got %T", s.SaveData)
+	}
+}
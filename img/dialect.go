@@ -0,0 +1,198 @@
+package img
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// DialectRequest is the request of the native API translated from the URL of other image service.
+type DialectRequest struct {
+	// ImgUrl is the URL of the source image.
+	ImgUrl string
+	// Op is the name of the operation: "optimise", "resize" or "fit".
+	Op string
+	// Query are query params of the native API, e.g. size, dppx and trim-border.
+	Query url.Values
+}
+
+// Dialect translates URLs of other image services, so clients could keep their URL generation libraries.
+type Dialect interface {
+	// Parse translates the path of the URL without the dialect prefix into the request of the native API.
+	// Returned errors are sent with 400 status.
+	Parse(path string) (*DialectRequest, error)
+}
+
+// KnownDialects are built-in dialects by name.
+var KnownDialects = map[string]Dialect{
+	"cloudinary": &CloudinaryDialect{},
+}
+
+// dialectHandler translates the request with the dialect and serves it with the native handler.
+func (r *Service) dialectHandler(prefix string, dialect Dialect) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		dialectReq, err := dialect.Parse(strings.TrimPrefix(req.URL.Path, prefix))
+		if err != nil {
+			http.Error(resp, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Query of the request is the query of the source URL, e.g. ?v=1 of
+		// /image/fetch/w_300/https://site.com/img.png?v=1
+		imgUrl := dialectReq.ImgUrl
+		if sourceQuery := withoutSignature(req.URL.RawQuery); len(sourceQuery) > 0 {
+			imgUrl += "?" + sourceQuery
+		}
+
+		nativeReq := req.Clone(req.Context())
+		nativeReq.URL.RawQuery = dialectReq.Query.Encode()
+		nativeReq = WithPathVars(nativeReq, map[string]string{"imgUrl": imgUrl})
+		r.serveOperation(dialectReq.Op, resp, nativeReq)
+	}
+}
+
+var cloudinaryParamRegexp = regexp.MustCompile(`^[a-z]{1,3}_[^,]+$`)
+
+// CloudinaryDialect translates Cloudinary fetch URLs, e.g.
+// /demo/image/fetch/w_300,h_200,c_fill/https://site.com/img.png. The cloud name and
+// the resource type are optional. Supported transformations:
+//   - w_N and h_N set the size in pixels
+//   - c_fill crops the image to the size, c_fit resizes it to fit into the size preserving aspect ratio
+//   - c_scale, which is the default, resizes the image by one dimension preserving aspect ratio
+//   - dpr_N sets dppx
+//   - e_trim trims the border
+//
+// Gravity g_auto and g_center, quality q_* and format f_auto are ignored, because
+// the service chooses them automatically. Other transformations are rejected, including
+// c_scale by both dimensions, which distorts the image, and c_limit and c_lfill, which never enlarge it.
+type CloudinaryDialect struct{}
+
+// Parse translates the path of Cloudinary fetch URL.
+func (d *CloudinaryDialect) Parse(path string) (*DialectRequest, error) {
+	path = strings.TrimPrefix(path, "/")
+	if idx := strings.Index(path, "image/fetch/"); idx >= 0 {
+		path = path[idx+len("image/fetch/"):]
+	}
+
+	var (
+		width, height int
+		crop          string
+		query         = url.Values{}
+	)
+	for {
+		segment := path
+		if idx := strings.Index(path, "/"); idx >= 0 {
+			segment = path[:idx]
+		}
+		if !isCloudinaryTransformation(segment) {
+			break
+		}
+		path = strings.TrimPrefix(path[len(segment):], "/")
+
+		// Version segment, e.g. v1570979139
+		if segment[0] == 'v' && !strings.Contains(segment, "_") {
+			continue
+		}
+		for _, param := range strings.Split(segment, ",") {
+			name, value, _ := strings.Cut(param, "_")
+			var err error
+			switch name {
+			case "w":
+				width, err = parseCloudinaryDimension(param, value)
+			case "h":
+				height, err = parseCloudinaryDimension(param, value)
+			case "c":
+				if value != "fill" && value != "scale" && value != "fit" {
+					err = fmt.Errorf("crop mode [%s] is not supported", value)
+				}
+				crop = value
+			case "dpr":
+				if value != "auto" {
+					dppx, parseErr := strconv.ParseFloat(value, 64)
+					if parseErr != nil || dppx <= 0 {
+						err = fmt.Errorf("invalid dpr [%s]", value)
+					}
+					query.Set("dppx", value)
+				}
+			case "e":
+				if value != "trim" {
+					err = fmt.Errorf("effect [%s] is not supported", value)
+				}
+				query.Set("trim-border", "true")
+			case "g":
+				if value != "auto" && value != "center" {
+					err = fmt.Errorf("gravity [%s] is not supported", value)
+				}
+			case "q":
+			case "f":
+				if value != "auto" {
+					err = fmt.Errorf("format [%s] is not supported, format is chosen by Accept header", value)
+				}
+			default:
+				err = fmt.Errorf("transformation [%s] is not supported", param)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if len(path) == 0 {
+		return nil, errors.New("source URL is required")
+	}
+	result := &DialectRequest{
+		ImgUrl: path,
+		Query:  query,
+	}
+
+	switch {
+	case width == 0 && height == 0:
+		result.Op = "optimise"
+	case crop == "fill" && width > 0 && height > 0:
+		result.Op = "fit"
+		query.Set("size", fmt.Sprintf("%dx%d", width, height))
+	case crop == "fit" && width > 0 && height > 0:
+		result.Op = "resize"
+		query.Set("size", fmt.Sprintf("%dx%d", width, height))
+	case width > 0 && height > 0:
+		return nil, errors.New("scaling by both dimensions is not supported, use c_fit or c_fill")
+	case width > 0:
+		result.Op = "resize"
+		query.Set("size", strconv.Itoa(width))
+	default:
+		result.Op = "resize"
+		query.Set("size", fmt.Sprintf("x%d", height))
+	}
+
+	return result, nil
+}
+
+// isCloudinaryTransformation returns true if the segment is the list of transformations or the version.
+func isCloudinaryTransformation(segment string) bool {
+	if len(segment) == 0 {
+		return false
+	}
+	if segment[0] == 'v' {
+		if _, err := strconv.ParseUint(segment[1:], 10, 64); err == nil {
+			return true
+		}
+	}
+	for _, param := range strings.Split(segment, ",") {
+		if !cloudinaryParamRegexp.MatchString(param) {
+			return false
+		}
+	}
+	return true
+}
+
+func parseCloudinaryDimension(param string, value string) (int, error) {
+	v, err := strconv.Atoi(value)
+	if err != nil || v <= 0 {
+		return 0, fmt.Errorf("[%s] must be a positive number of pixels", param)
+	}
+	return v, nil
+}
@@ -0,0 +1,78 @@
+package img_test
+
+import (
+	"github.com/Pixboost/transformimgs/v8/img"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestCloudinaryDialect_Parse(t *testing.T) {
+	dialect := &img.CloudinaryDialect{}
+
+	for _, tt := range []struct {
+		description string
+		path        string
+		expected    *img.DialectRequest
+	}{
+		{
+			description: "Optimise",
+			path:        "/demo/image/fetch/https://site.com/img.png",
+			expected:    &img.DialectRequest{ImgUrl: "https://site.com/img.png", Op: "optimise", Query: url.Values{}},
+		},
+		{
+			description: "Fill",
+			path:        "/demo/image/fetch/w_300,h_200,c_fill,g_auto/q_auto,f_auto/https://site.com/img.png",
+			expected:    &img.DialectRequest{ImgUrl: "https://site.com/img.png", Op: "fit", Query: url.Values{"size": {"300x200"}}},
+		},
+		{
+			description: "Scale by width with dpr",
+			path:        "/w_300,dpr_2.0/v1570979139/https://site.com/img.png",
+			expected:    &img.DialectRequest{ImgUrl: "https://site.com/img.png", Op: "resize", Query: url.Values{"size": {"300"}, "dppx": {"2.0"}}},
+		},
+		{
+			description: "Fit by height with trim",
+			path:        "/image/fetch/h_200,c_fit,e_trim/https://site.com/img.png",
+			expected:    &img.DialectRequest{ImgUrl: "https://site.com/img.png", Op: "resize", Query: url.Values{"size": {"x200"}, "trim-border": {"true"}}},
+		},
+		{
+			description: "Fit into both dimensions",
+			path:        "/image/fetch/w_300,h_200,c_fit/https://site.com/img.png",
+			expected:    &img.DialectRequest{ImgUrl: "https://site.com/img.png", Op: "resize", Query: url.Values{"size": {"300x200"}}},
+		},
+		{
+			description: "Scale by height",
+			path:        "/image/fetch/h_200,c_scale/https://site.com/img.png",
+			expected:    &img.DialectRequest{ImgUrl: "https://site.com/img.png", Op: "resize", Query: url.Values{"size": {"x200"}}},
+		},
+	} {
+		req, err := dialect.Parse(tt.path)
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", tt.description, err)
+			continue
+		}
+		if !reflect.DeepEqual(req, tt.expected) {
+			t.Errorf("%s: expected %+v, but got %+v", tt.description, tt.expected, req)
+		}
+	}
+
+	for _, tt := range []struct {
+		description string
+		path        string
+	}{
+		{"No source", "/image/fetch/w_300/"},
+		{"Relative width", "/image/fetch/w_0.5/https://site.com/img.png"},
+		{"Unsupported crop", "/image/fetch/w_300,h_300,c_thumb/https://site.com/img.png"},
+		{"Limit", "/image/fetch/w_300,c_limit/https://site.com/img.png"},
+		{"Limit fill", "/image/fetch/w_300,h_200,c_lfill/https://site.com/img.png"},
+		{"Scale to both dimensions", "/image/fetch/w_300,h_200/https://site.com/img.png"},
+		{"Explicit scale to both dimensions", "/image/fetch/w_300,h_200,c_scale/https://site.com/img.png"},
+		{"Unsupported format", "/image/fetch/f_png/https://site.com/img.png"},
+		{"Unsupported transformation", "/image/fetch/r_max/https://site.com/img.png"},
+	} {
+		_, err := dialect.Parse(tt.path)
+		if err == nil {
+			t.Errorf("%s: expected error", tt.description)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package img
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+)
+
+// Headers with SHA-256 digest of the response body, see ServiceConfig.DigestHeaders.
+const (
+	// ContentDigestHeader is the hex encoded digest, e.g. to dedupe stored objects.
+	ContentDigestHeader = "X-Content-Digest"
+	// DigestHeader is the digest in RFC 3230 format, e.g. "SHA-256=base64", that is verified by clients and caches.
+	DigestHeader = "Digest"
+)
+
+// addDigest adds headers with SHA-256 digest of the data.
+func addDigest(resp http.ResponseWriter, data []byte, headers []string) {
+	if len(headers) == 0 {
+		return
+	}
+	hash := sha256.Sum256(data)
+	for _, h := range headers {
+		switch h {
+		case ContentDigestHeader:
+			resp.Header().Set(ContentDigestHeader, hex.EncodeToString(hash[:]))
+		case DigestHeader:
+			resp.Header().Set(DigestHeader, "SHA-256="+base64.StdEncoding.EncodeToString(hash[:]))
+		}
+	}
+}
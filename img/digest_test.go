@@ -0,0 +1,53 @@
+package img_test
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"github.com/Pixboost/transformimgs/v8/img"
+	"github.com/dooman87/kolibri/test"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestService_DigestHeaders(t *testing.T) {
+	s, err := img.NewServiceWithConfig(&loaderMock{}, &resizerMock{}, 1, &img.ServiceConfig{
+		DigestHeaders: []string{img.ContentDigestHeader, img.DigestHeader},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	test.Service = s.GetRouter().ServeHTTP
+	test.T = t
+
+	hash := sha256.Sum256([]byte(ImgPngOut))
+	testCases := []test.TestCase{
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise",
+			Description: "Digest of the transformed image",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal(ImgPngOut, w.Body.String(), "Resulted image"),
+					test.Equal(hex.EncodeToString(hash[:]), w.Header().Get("X-Content-Digest"), "X-Content-Digest header"),
+					test.Equal("SHA-256="+base64.StdEncoding.EncodeToString(hash[:]), w.Header().Get("Digest"), "Digest header"),
+				)
+			},
+		},
+	}
+
+	test.RunRequests(testCases)
+
+	test.Service = createService(t).GetRouter().ServeHTTP
+	test.RunRequests([]test.TestCase{
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise",
+			Description: "Digest is disabled",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal("", w.Header().Get("X-Content-Digest"), "X-Content-Digest header"),
+					test.Equal("", w.Header().Get("Digest"), "Digest header"),
+				)
+			},
+		},
+	})
+}
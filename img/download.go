@@ -0,0 +1,96 @@
+package img
+
+import (
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// MaxFilenameLength is the maximum length of filename query param in bytes.
+const MaxFilenameLength = 255
+
+// extensions are file extensions of output formats.
+var extensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+	"image/avif": ".avif",
+	"image/jxl":  ".jxl",
+	"image/heic": ".heic",
+	"image/tiff": ".tiff",
+	"image/bmp":  ".bmp",
+}
+
+// Download is the Content-Disposition of the response set by download and filename query params,
+// so "download image" buttons deliver the optimised image with a meaningful name.
+type Download struct {
+	// Attachment is the flag to ask the browser to save the image instead of displaying it.
+	Attachment bool
+	// Filename is the name of the file. The name of the source is used if empty.
+	Filename string
+}
+
+// getDownload returns Content-Disposition of the response from download and filename query params
+// or nil if both are not set. Filename is reduced to its base name, so it can't point to other directories.
+func getDownload(req *http.Request) (*Download, error) {
+	downloadParam, _ := getQueryParam(req.URL, "download")
+	filename, _ := getQueryParam(req.URL, "filename")
+	if len(downloadParam) == 0 && len(filename) == 0 {
+		return nil, nil
+	}
+
+	download := &Download{}
+	if len(downloadParam) > 0 {
+		attachment, err := strconv.ParseBool(downloadParam)
+		if err != nil {
+			return nil, NewHttpError(http.StatusBadRequest, "download query param must be true or false")
+		}
+		download.Attachment = attachment
+	}
+	if len(filename) > 0 {
+		filename = strings.Map(func(r rune) rune {
+			if unicode.IsControl(r) {
+				return -1
+			}
+			return r
+		}, filename)
+		filename = path.Base(strings.ReplaceAll(filename, "\\", "/"))
+		if filename == "." || filename == "/" || filename == ".." || len(filename) > MaxFilenameLength {
+			return nil, NewHttpError(http.StatusBadRequest, "filename query param must be a valid file name")
+		}
+		download.Filename = filename
+	}
+	return download, nil
+}
+
+// header returns the value of Content-Disposition header. The extension of the filename is replaced
+// with the extension of the output format, because the format depends on Accept header.
+func (d *Download) header(mimeType string, imgUrl string) string {
+	filename := d.Filename
+	if len(filename) == 0 {
+		filename = sourceFilename(imgUrl)
+	}
+	if ext, ok := extensions[mimeType]; ok {
+		filename = strings.TrimSuffix(filename, path.Ext(filename)) + ext
+	}
+
+	disposition := "inline"
+	if d.Attachment {
+		disposition = "attachment"
+	}
+	return mime.FormatMediaType(disposition, map[string]string{"filename": filename})
+}
+
+// sourceFilename returns the last segment of the path of the source URL or "image".
+func sourceFilename(imgUrl string) string {
+	u, err := url.Parse(imgUrl)
+	if err != nil || len(u.Path) == 0 || strings.HasSuffix(u.Path, "/") {
+		return "image"
+	}
+	return path.Base(u.Path)
+}
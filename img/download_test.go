@@ -0,0 +1,59 @@
+package img_test
+
+import (
+	"github.com/dooman87/kolibri/test"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestService_Download(t *testing.T) {
+	test.Service = createService(t).GetRouter().ServeHTTP
+	test.T = t
+
+	expectDisposition := func(expected string) func(w *httptest.ResponseRecorder, t *testing.T) {
+		return func(w *httptest.ResponseRecorder, t *testing.T) {
+			test.Error(t,
+				test.Equal(expected, w.Header().Get("Content-Disposition"), "Content-Disposition header"),
+			)
+		}
+	}
+
+	test.RunRequests([]test.TestCase{
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise?download=true&filename=hero.webp",
+			Description: "Extension of the output format",
+			Handler:     expectDisposition("attachment; filename=hero.png"),
+		},
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/resize?size=300&filename=..%2F..%2Fhero",
+			Description: "Inline with base name",
+			Handler:     expectDisposition("inline; filename=hero.png"),
+		},
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise?download=true&filename=h%C3%A9ro.png",
+			Description: "Non-ASCII name",
+			Handler:     expectDisposition("attachment; filename*=utf-8''h%C3%A9ro.png"),
+		},
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/asis?download=1",
+			Description: "Name of the source",
+			Handler:     expectDisposition("attachment; filename=img.png"),
+		},
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise",
+			Description: "No download",
+			Handler:     expectDisposition(""),
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise?download=maybe",
+			Description:  "Invalid download",
+			ExpectedCode: http.StatusBadRequest,
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise?filename=..",
+			Description:  "Invalid filename",
+			ExpectedCode: http.StatusBadRequest,
+		},
+	})
+}
@@ -0,0 +1,216 @@
+package img
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// MetadataReader is implemented by processors that could read metadata of images.
+type MetadataReader interface {
+	// LoadExif returns EXIF tags of the image by name, e.g. Make, FNumber or GPSLatitude.
+	// Values are in the format of ImageMagick, e.g. rationals are "28/10".
+	LoadExif(src *Image) (map[string]string, error)
+}
+
+// loadExif reads EXIF tags using the processor or returns 501 error if processor is not a MetadataReader.
+func loadExif(p Processor, src *Image) (map[string]string, error) {
+	reader, ok := p.(MetadataReader)
+	if !ok {
+		return nil, NewHttpError(http.StatusNotImplemented, "processor doesn't support metadata")
+	}
+	return reader.LoadExif(src)
+}
+
+// Exif is EXIF metadata of the image.
+type Exif struct {
+	Camera   *ExifCamera   `json:"camera,omitempty"`
+	Exposure *ExifExposure `json:"exposure,omitempty"`
+	GPS      *ExifGPS      `json:"gps,omitempty"`
+	// GPSRedacted is true when the image has GPS location, but it's not returned.
+	GPSRedacted bool `json:"gpsRedacted,omitempty"`
+}
+
+// ExifCamera is the information about the camera.
+type ExifCamera struct {
+	Make     string `json:"make,omitempty"`
+	Model    string `json:"model,omitempty"`
+	Lens     string `json:"lens,omitempty"`
+	Software string `json:"software,omitempty"`
+}
+
+// ExifExposure is the information about the exposure.
+type ExifExposure struct {
+	// ExposureTime is in seconds, e.g. "1/125".
+	ExposureTime string  `json:"exposureTime,omitempty"`
+	FNumber      float64 `json:"fNumber,omitempty"`
+	ISO          int     `json:"iso,omitempty"`
+	// FocalLength is in millimeters.
+	FocalLength float64 `json:"focalLength,omitempty"`
+	// DateTime is the time when the photo was taken in the format "2006:01:02 15:04:05".
+	DateTime string `json:"dateTime,omitempty"`
+}
+
+// ExifGPS is the location where the photo was taken in decimal degrees.
+type ExifGPS struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	// Altitude is in meters above the sea level. Nil if unknown.
+	Altitude *float64 `json:"altitude,omitempty"`
+}
+
+// NewExif returns metadata from EXIF tags. GPS location is returned only if gps is true.
+func NewExif(tags map[string]string, gps bool) *Exif {
+	exif := &Exif{}
+
+	camera := &ExifCamera{
+		Make:     tags["Make"],
+		Model:    tags["Model"],
+		Lens:     tags["LensModel"],
+		Software: tags["Software"],
+	}
+	if *camera != (ExifCamera{}) {
+		exif.Camera = camera
+	}
+
+	exposure := &ExifExposure{
+		ExposureTime: simplifyExifRational(tags["ExposureTime"]),
+		FNumber:      roundExif(parseExifRational(tags["FNumber"])),
+		FocalLength:  roundExif(parseExifRational(tags["FocalLength"])),
+		DateTime:     tags["DateTimeOriginal"],
+	}
+	// ISOSpeedRatings is the name of the tag before EXIF 2.3
+	iso := tags["PhotographicSensitivity"]
+	if len(iso) == 0 {
+		iso = tags["ISOSpeedRatings"]
+	}
+	exposure.ISO, _ = strconv.Atoi(strings.TrimSpace(strings.Split(iso, ",")[0]))
+	if len(exposure.DateTime) == 0 {
+		exposure.DateTime = tags["DateTime"]
+	}
+	if *exposure != (ExifExposure{}) {
+		exif.Exposure = exposure
+	}
+
+	latitude, okLat := parseExifCoordinate(tags["GPSLatitude"], tags["GPSLatitudeRef"])
+	longitude, okLon := parseExifCoordinate(tags["GPSLongitude"], tags["GPSLongitudeRef"])
+	if okLat && okLon {
+		if !gps {
+			exif.GPSRedacted = true
+			return exif
+		}
+		exif.GPS = &ExifGPS{Latitude: latitude, Longitude: longitude}
+		if len(tags["GPSAltitude"]) > 0 {
+			altitude := parseExifRational(tags["GPSAltitude"])
+			if tags["GPSAltitudeRef"] == "1" {
+				altitude = -altitude
+			}
+			altitude = roundExif(altitude)
+			exif.GPS.Altitude = &altitude
+		}
+	}
+
+	return exif
+}
+
+// parseExifRational parses rational, e.g. "28/10", or decimal value. Returns 0 if value is invalid.
+func parseExifRational(value string) float64 {
+	value = strings.TrimSpace(value)
+	if num, den, ok := strings.Cut(value, "/"); ok {
+		n, errN := strconv.ParseFloat(num, 64)
+		d, errD := strconv.ParseFloat(den, 64)
+		if errN != nil || errD != nil || d == 0 {
+			return 0
+		}
+		return n / d
+	}
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0
+	}
+	return v
+}
+
+// simplifyExifRational returns exposure time as "1/N" for short exposures and in seconds otherwise.
+func simplifyExifRational(value string) string {
+	v := parseExifRational(value)
+	if v <= 0 {
+		return ""
+	}
+	if v < 1 {
+		return "1/" + strconv.FormatFloat(math.Round(1/v), 'f', -1, 64)
+	}
+	return strconv.FormatFloat(roundExif(v), 'f', -1, 64)
+}
+
+// parseExifCoordinate converts degrees, minutes and seconds, e.g. "51/1, 30/1, 1234/100", into decimal degrees.
+// Coordinate is negative for S and W references.
+func parseExifCoordinate(value string, ref string) (float64, bool) {
+	parts := strings.Split(value, ",")
+	if len(value) == 0 || len(parts) != 3 {
+		return 0, false
+	}
+	coordinate := parseExifRational(parts[0]) + parseExifRational(parts[1])/60 + parseExifRational(parts[2])/3600
+	if ref == "S" || ref == "W" {
+		coordinate = -coordinate
+	}
+	return math.Round(coordinate*1e6) / 1e6, true
+}
+
+func roundExif(v float64) float64 {
+	return math.Round(v*100) / 100
+}
+
+// ExifUrl returns EXIF metadata of the image as JSON. GPS location is redacted unless ExifGPS is set.
+func (r *Service) ExifUrl(resp http.ResponseWriter, req *http.Request) {
+	if _, ok := r.Processor.(MetadataReader); !ok {
+		http.Error(resp, "processor doesn't support metadata", http.StatusNotImplemented)
+		return
+	}
+
+	imgUrl := r.getImgUrl(req)
+	if len(imgUrl) == 0 {
+		http.Error(resp, "url param is required", http.StatusBadRequest)
+		return
+	}
+
+	r.log().Printf("[%s]: Reading metadata of image %s\n", req.URL.String(), imgUrl)
+
+	images, err := r.loadAll(req, []string{imgUrl})
+	if err != nil {
+		r.sendError(resp, err)
+		return
+	}
+	release, err := r.acquireAll(req, images)
+	if err != nil {
+		images[0].Release()
+		r.sendError(resp, err)
+		return
+	}
+	defer release()
+
+	r.execOp(&Command{
+		Transformation: func(input *TransformationConfig) (*Image, error) {
+			tags, err := loadExif(r.Processor, input.Src)
+			if err != nil {
+				return nil, err
+			}
+
+			buf := GetBuffer()
+			err = json.NewEncoder(buf).Encode(NewExif(tags, r.ExifGPS))
+			if err != nil {
+				PutBuffer(buf)
+				return nil, err
+			}
+			return NewPooledImage("", buf, "application/json"), nil
+		},
+		Config: &TransformationConfig{
+			Src:     images[0],
+			Quality: DEFAULT,
+		},
+		Req:  req,
+		Resp: resp,
+	})
+}
@@ -0,0 +1,85 @@
+package img_test
+
+import (
+	"github.com/Pixboost/transformimgs/v8/img"
+	"reflect"
+	"testing"
+)
+
+func TestNewExif(t *testing.T) {
+	altitude := -12.5
+	tags := map[string]string{
+		"Make":             "Canon",
+		"Model":            "Canon EOS 5D",
+		"LensModel":        "EF24-105mm f/4L IS USM",
+		"Software":         "Adobe Lightroom",
+		"ExposureTime":     "10/2500",
+		"FNumber":          "28/10",
+		"ISOSpeedRatings":  "400",
+		"FocalLength":      "105/1",
+		"DateTimeOriginal": "2020:06:01 12:30:00",
+		"DateTime":         "2020:06:02 09:00:00",
+		"GPSLatitude":      "33/1, 51/1, 3240/100",
+		"GPSLatitudeRef":   "S",
+		"GPSLongitude":     "151/1, 12/1, 3600/100",
+		"GPSLongitudeRef":  "E",
+		"GPSAltitude":      "25/2",
+		"GPSAltitudeRef":   "1",
+	}
+
+	for _, tt := range []struct {
+		description string
+		tags        map[string]string
+		gps         bool
+		expected    *img.Exif
+	}{
+		{
+			description: "All tags",
+			tags:        tags,
+			gps:         true,
+			expected: &img.Exif{
+				Camera: &img.ExifCamera{Make: "Canon", Model: "Canon EOS 5D", Lens: "EF24-105mm f/4L IS USM", Software: "Adobe Lightroom"},
+				Exposure: &img.ExifExposure{
+					ExposureTime: "1/250", FNumber: 2.8, ISO: 400, FocalLength: 105, DateTime: "2020:06:01 12:30:00",
+				},
+				GPS: &img.ExifGPS{Latitude: -33.859, Longitude: 151.21, Altitude: &altitude},
+			},
+		},
+		{
+			description: "GPS is redacted",
+			tags:        tags,
+			expected: &img.Exif{
+				Camera: &img.ExifCamera{Make: "Canon", Model: "Canon EOS 5D", Lens: "EF24-105mm f/4L IS USM", Software: "Adobe Lightroom"},
+				Exposure: &img.ExifExposure{
+					ExposureTime: "1/250", FNumber: 2.8, ISO: 400, FocalLength: 105, DateTime: "2020:06:01 12:30:00",
+				},
+				GPSRedacted: true,
+			},
+		},
+		{
+			description: "Long exposure and modified date",
+			tags:        map[string]string{"ExposureTime": "25/10", "PhotographicSensitivity": "100, 100", "DateTime": "2020:06:02 09:00:00"},
+			expected: &img.Exif{
+				Exposure: &img.ExifExposure{ExposureTime: "2.5", ISO: 100, DateTime: "2020:06:02 09:00:00"},
+			},
+		},
+		{
+			description: "Invalid values are ignored",
+			tags:        map[string]string{"FNumber": "28/0", "GPSLatitude": "33/1", "GPSLatitudeRef": "S", "GPSLongitude": "1/1, 0/1, 0/1"},
+			gps:         true,
+			expected:    &img.Exif{},
+		},
+		{
+			description: "No tags",
+			tags:        map[string]string{},
+			expected:    &img.Exif{},
+		},
+	} {
+		t.Run(tt.description, func(t *testing.T) {
+			exif := img.NewExif(tt.tags, tt.gps)
+			if !reflect.DeepEqual(exif, tt.expected) {
+				t.Errorf("expected %+v, but got %+v", tt.expected, exif)
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package img
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// FormatFallback changes supported formats of clients with matching User-Agent when Accept header
+// is not enough to select the output format, e.g. old Android browsers support WebP, but send "Accept: */*".
+type FormatFallback struct {
+	// UserAgent matches User-Agent header of clients.
+	UserAgent *regexp.Regexp
+	// Add are MIME types that clients support even if they are not in Accept header.
+	Add []string
+	// Remove are MIME types that clients don't support even if they are in Accept header.
+	Remove []string
+}
+
+// DefaultFormatFallbacks are fallbacks for known clients:
+//   - Android 4.3 and 4.4 browsers and WebViews support WebP, but don't send it in Accept header;
+//   - Safari 14 on macOS before Big Sur sends image/webp in Accept header, but can't decode WebP.
+//     Safari 14 on Big Sur reports the same version of macOS, so it gets fallback formats too.
+var DefaultFormatFallbacks = []*FormatFallback{
+	{
+		UserAgent: regexp.MustCompile(`Android 4\.[34][^;]*;.*Version/4\.0`),
+		Add:       []string{"image/webp"},
+	},
+	{
+		UserAgent: regexp.MustCompile(`Mac OS X 10_(1[0-5]|[0-9])\D.*Version/14\.[0-9.]+ Safari/`),
+		Remove:    []string{"image/webp"},
+	},
+}
+
+type formatFallbackJson struct {
+	UserAgent string   `json:"userAgent"`
+	Add       []string `json:"add"`
+	Remove    []string `json:"remove"`
+}
+
+// UnmarshalJSON parses the fallback in format {"userAgent": "regexp", "add": [...], "remove": [...]}.
+func (f *FormatFallback) UnmarshalJSON(data []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	var parsed formatFallbackJson
+	if err := decoder.Decode(&parsed); err != nil {
+		return err
+	}
+	if len(parsed.UserAgent) == 0 {
+		return fmt.Errorf("userAgent of the format fallback is required")
+	}
+	userAgent, err := regexp.Compile(parsed.UserAgent)
+	if err != nil {
+		return fmt.Errorf("invalid userAgent of the format fallback: %w", err)
+	}
+	f.UserAgent, f.Add, f.Remove = userAgent, parsed.Add, parsed.Remove
+	return nil
+}
+
+// LoadFormatFallbacks reads JSON array of fallbacks, e.g.
+//
+//	[{"userAgent": "Android 4\\.[34]", "add": ["image/webp"]}]
+func LoadFormatFallbacks(r io.Reader) ([]*FormatFallback, error) {
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	var fallbacks []*FormatFallback
+	if err := decoder.Decode(&fallbacks); err != nil {
+		return nil, fmt.Errorf("could not parse format fallbacks: %w", err)
+	}
+	return fallbacks, nil
+}
+
+// supportedFormats returns media types from Accept header changed by FormatFallbacks
+// that match User-Agent of the request.
+func (r *Service) supportedFormats(req *http.Request) []string {
+	formats := getSupportedFormats(req)
+	if len(r.FormatFallbacks) == 0 {
+		return formats
+	}
+
+	userAgent := req.Header.Get("User-Agent")
+	for _, f := range r.FormatFallbacks {
+		if !f.UserAgent.MatchString(userAgent) {
+			continue
+		}
+		for _, add := range f.Add {
+			if !containsFormat(formats, add) {
+				formats = append(formats, strings.ToLower(add))
+			}
+		}
+		for _, remove := range f.Remove {
+			kept := formats[:0]
+			for _, format := range formats {
+				if !strings.EqualFold(format, remove) {
+					kept = append(kept, format)
+				}
+			}
+			formats = kept
+		}
+	}
+	return formats
+}
+
+// formatsVary returns request headers that are used to get supported formats.
+func (r *Service) formatsVary() []string {
+	if len(r.FormatFallbacks) > 0 {
+		return []string{"Accept", "User-Agent"}
+	}
+	return []string{"Accept"}
+}
+
+func containsFormat(formats []string, format string) bool {
+	for _, f := range formats {
+		if strings.EqualFold(f, format) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,82 @@
+package img_test
+
+import (
+	"github.com/Pixboost/transformimgs/v8/img"
+	"github.com/dooman87/kolibri/test"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const (
+	oldAndroidUA   = "Mozilla/5.0 (Linux; U; Android 4.4.2; en-us; SM-T230 Build/KOT49H) AppleWebKit/534.30 (KHTML, like Gecko) Version/4.0 Safari/534.30"
+	oldSafariUA    = "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_14_6) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/14.0.3 Safari/605.1.15"
+	modernChromeUA = "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36"
+)
+
+func TestService_FormatFallbacks(t *testing.T) {
+	s := createService(t)
+	s.FormatFallbacks = img.DefaultFormatFallbacks
+	test.Service = s.GetRouter().ServeHTTP
+	test.T = t
+
+	request := func(accept string, userAgent string) *http.Request {
+		return &http.Request{
+			Method: "GET",
+			URL:    parseUrl("http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise", t),
+			Header: http.Header{"Accept": {accept}, "User-Agent": {userAgent}},
+		}
+	}
+	expectImage := func(expected string) func(w *httptest.ResponseRecorder, t *testing.T) {
+		return func(w *httptest.ResponseRecorder, t *testing.T) {
+			test.Error(t,
+				test.Equal(expected, w.Body.String(), "Resulted image"),
+				test.Equal("Accept, User-Agent, Save-Data", w.Header().Get("Vary"), "Vary header"),
+			)
+		}
+	}
+
+	test.RunRequests([]test.TestCase{
+		{
+			Description: "Old Android browser",
+			Request:     request("*/*", oldAndroidUA),
+			Handler:     expectImage(ImgWebpOut),
+		},
+		{
+			Description: "Safari 14 on old macOS",
+			Request:     request("image/webp,image/png,*/*", oldSafariUA),
+			Handler:     expectImage(ImgPngOut),
+		},
+		{
+			Description: "Modern browser",
+			Request:     request("image/webp,image/png,*/*", modernChromeUA),
+			Handler:     expectImage(ImgWebpOut),
+		},
+		{
+			Description: "Unknown client",
+			Request:     request("*/*", "curl/8.0"),
+			Handler:     expectImage(ImgPngOut),
+		},
+	})
+}
+
+func TestLoadFormatFallbacks(t *testing.T) {
+	fallbacks, err := img.LoadFormatFallbacks(strings.NewReader(`[{"userAgent": "Android 4\\.[34]", "add": ["image/webp"]}]`))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(fallbacks) != 1 || !fallbacks[0].UserAgent.MatchString(oldAndroidUA) || len(fallbacks[0].Add) != 1 {
+		t.Errorf("unexpected fallbacks: %+v", fallbacks)
+	}
+
+	for _, invalid := range []string{
+		`[{"add": ["image/webp"]}]`,
+		`[{"userAgent": "(", "add": ["image/webp"]}]`,
+		`[{"userAgent": "Android", "unknown": true}]`,
+	} {
+		if _, err = img.LoadFormatFallbacks(strings.NewReader(invalid)); err == nil {
+			t.Errorf("expected error for %s", invalid)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package img
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Hooks are functions that are called while the service handles requests, e.g. to authorise
+// requests, audit transformations or add custom headers. All functions are optional.
+// Request is rejected when a hook returns an error. HttpError is sent with its code
+// and other errors with 500.
+type Hooks struct {
+	// PreLoad is called before loading each source image by its URL.
+	PreLoad func(req *http.Request, imgUrl string) error
+	// PostLoad is called after each source image is loaded.
+	PostLoad func(req *http.Request, src *Image) error
+	// PreTransform is called before adding the transformation to the queue. Config could be
+	// changed by the hook, e.g. to lower the quality.
+	PreTransform func(req *http.Request, config *TransformationConfig) error
+	// PostTransform is called after the successful transformation before writing the result to the response,
+	// so the hook could add response headers. Data of the result must not be used after the hook returns.
+	PostTransform func(req *http.Request, resp http.ResponseWriter, config *TransformationConfig, result *Image) error
+	// Headers is called after default headers of the successful response are set and before the body is written,
+	// so the hook could override or remove any of them, e.g. Cache-Control or X-Image-Width.
+	Headers func(req *http.Request, header http.Header)
+}
+
+// Use registers hooks. Hooks are called in the order of registration and the chain stops
+// on the first error. Hooks must be registered before the service starts handling requests.
+func (r *Service) Use(hooks *Hooks) {
+	r.hooks = append(r.hooks, hooks)
+}
+
+func (r *Service) preLoad(req *http.Request, imgUrl string) error {
+	for _, h := range r.hooks {
+		if h.PreLoad == nil {
+			continue
+		}
+		if err := h.PreLoad(req, imgUrl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Service) postLoad(req *http.Request, src *Image) error {
+	for _, h := range r.hooks {
+		if h.PostLoad == nil {
+			continue
+		}
+		if err := h.PostLoad(req, src); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Service) preTransform(op *Command) error {
+	for _, h := range r.hooks {
+		if h.PreTransform == nil {
+			continue
+		}
+		if err := h.PreTransform(op.Req, op.Config); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Service) postTransform(op *Command) error {
+	for _, h := range r.hooks {
+		if h.PostTransform == nil {
+			continue
+		}
+		if err := h.PostTransform(op.Req, op.Resp, op.Config, op.Result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Service) headers(op *Command) {
+	for _, h := range r.hooks {
+		if h.Headers != nil {
+			h.Headers(op.Req, op.Resp.Header())
+		}
+	}
+}
+
+// load loads the source image running load hooks. The URL is normalized by NormalizeUrl
+// before hooks. Rejects sources that are not images if SniffMimeType is set.
+func (r *Service) load(req *http.Request, imgUrl string) (src *Image, err error) {
+	if imgUrl, err = r.normalizeUrl(imgUrl); err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if err != nil {
+			r.log().Printf("[%s] Could not load image [%s]: %s\n", imgUrl, ErrorCategory(err), err)
+			if r.Status != nil {
+				r.Status.addError(imgUrl, "load", err)
+			}
+			if r.Metrics != nil {
+				r.Metrics.observeLoadError(err)
+			}
+		}
+	}()
+
+	if r.Status != nil {
+		r.Status.addSource(imgUrl)
+	}
+
+	if err = r.preLoad(req, imgUrl); err != nil {
+		return nil, err
+	}
+
+	ctx := req.Context()
+	if span := SpanFromContext(ctx).Child("load"); span != nil {
+		span.Kind = SpanKindClient
+		source := imgUrl
+		if r.ReportSource != nil {
+			source = r.ReportSource(source)
+		}
+		span.SetAttribute("url.full", source)
+		defer func() {
+			span.SetError(err)
+			span.End()
+		}()
+		ctx = ContextWithSpan(ctx, span)
+	}
+	src, err = r.Loader.Load(imgUrl, ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.SniffMimeType {
+		if err = sniffMimeType(src, r.log()); err != nil {
+			src.Release()
+			return nil, err
+		}
+	}
+
+	if err = r.postLoad(req, src); err != nil {
+		src.Release()
+		return nil, err
+	}
+
+	return src, nil
+}
+
+// mergeHeader sets the header with comma separated list of values that includes values that were
+// already set, e.g. by middlewares. Duplicates are removed ignoring case.
+func mergeHeader(header http.Header, name string, values []string) {
+	var merged []string
+	seen := make(map[string]bool)
+	for _, value := range append(header.Values(name), values...) {
+		for _, v := range strings.Split(value, ",") {
+			v = strings.TrimSpace(v)
+			if len(v) == 0 || seen[strings.ToLower(v)] {
+				continue
+			}
+			seen[strings.ToLower(v)] = true
+			merged = append(merged, v)
+		}
+	}
+	if len(merged) > 0 {
+		header.Set(name, strings.Join(merged, ", "))
+	}
+}
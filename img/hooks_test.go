@@ -0,0 +1,182 @@
+package img_test
+
+import (
+	"errors"
+	"github.com/Pixboost/transformimgs/v8/img"
+	"github.com/dooman87/kolibri/test"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestService_Use(t *testing.T) {
+	var (
+		calls   []string
+		callsMu sync.Mutex
+	)
+	record := func(call string) {
+		callsMu.Lock()
+		calls = append(calls, call)
+		callsMu.Unlock()
+	}
+
+	s := createService(t)
+	s.Use(&img.Hooks{
+		PreLoad: func(req *http.Request, imgUrl string) error {
+			if req.Header.Get("Authorization") != "secret" {
+				return img.NewHttpError(http.StatusForbidden, "not authorised")
+			}
+			record("pre-load " + imgUrl)
+			return nil
+		},
+		PostLoad: func(req *http.Request, src *img.Image) error {
+			record("post-load " + string(src.Data))
+			return nil
+		},
+		PreTransform: func(req *http.Request, config *img.TransformationConfig) error {
+			if req.URL.Query().Get("deny") == "transform" {
+				return errors.New("denied")
+			}
+			record("pre-transform")
+			return nil
+		},
+		PostTransform: func(req *http.Request, resp http.ResponseWriter, config *img.TransformationConfig, result *img.Image) error {
+			record("post-transform " + string(result.Data))
+			resp.Header().Set("X-Audit", "1")
+			return nil
+		},
+	})
+	s.Use(&img.Hooks{
+		PreTransform: func(req *http.Request, config *img.TransformationConfig) error {
+			if req.URL.Query().Get("boost") == "1" {
+				config.Enhance = true
+			}
+			return nil
+		},
+		PostTransform: func(req *http.Request, resp http.ResponseWriter, config *img.TransformationConfig, result *img.Image) error {
+			if req.URL.Query().Get("deny") == "result" {
+				return img.NewHttpError(http.StatusUnavailableForLegalReasons, "blocked")
+			}
+			return nil
+		},
+	})
+	test.Service = s.GetRouter().ServeHTTP
+	test.T = t
+
+	auth := map[string][]string{"Authorization": {"secret"}}
+	testCases := []test.TestCase{
+		{
+			Request: &http.Request{
+				Method: "GET",
+				URL:    parseUrl("http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise", t),
+				Header: auth,
+			},
+			Description: "All hooks are called",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal(ImgPngOut, w.Body.String(), "Resulted image"),
+					test.Equal("1", w.Header().Get("X-Audit"), "X-Audit header"),
+					test.Equal("pre-load http://site.com/img.png,post-load 321,pre-transform,post-transform 123",
+						strings.Join(calls, ","), "Calls of hooks"),
+				)
+			},
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise",
+			Description:  "Rejected before loading",
+			ExpectedCode: http.StatusForbidden,
+		},
+		{
+			Request: &http.Request{
+				Method: "GET",
+				URL:    parseUrl("http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise?deny=transform", t),
+				Header: auth,
+			},
+			Description:  "Rejected before transformation",
+			ExpectedCode: http.StatusInternalServerError,
+		},
+		{
+			Request: &http.Request{
+				Method: "GET",
+				URL:    parseUrl("http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise?boost=1", t),
+				Header: auth,
+			},
+			Description: "Config is changed by the hook",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal(ImgEnhanced, w.Body.String(), "Resulted image"),
+				)
+			},
+		},
+		{
+			Request: &http.Request{
+				Method: "GET",
+				URL:    parseUrl("http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise?deny=result", t),
+				Header: auth,
+			},
+			Description:  "Rejected after transformation",
+			ExpectedCode: http.StatusUnavailableForLegalReasons,
+		},
+		{
+			Request: &http.Request{
+				Method: "GET",
+				URL:    parseUrl("http://localhost/montage?size=100x50&src=http%3A%2F%2Fsite.com%2Fimg.png", t),
+				Header: auth,
+			},
+			Description: "Hooks are called for each source",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal(ImgSrc, w.Body.String(), "Resulted image"),
+					test.Equal("1", w.Header().Get("X-Audit"), "X-Audit header"),
+				)
+			},
+		},
+	}
+
+	test.RunRequests(testCases)
+}
+
+func TestService_Headers(t *testing.T) {
+	s := createService(t)
+	s.Use(&img.Hooks{
+		Headers: func(req *http.Request, header http.Header) {
+			header.Set("Cache-Control", "private, max-age=60")
+			header.Del("X-Image-Width")
+			header.Del("X-Image-Height")
+		},
+	})
+	router := s.GetRouter()
+	// Middleware that sets its own headers before the service
+	test.Service = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Vary", "Origin, accept")
+		resp.Header().Set("Content-Type", "application/octet-stream")
+		router.ServeHTTP(resp, req)
+	}
+	test.T = t
+
+	test.RunRequests([]test.TestCase{
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/resize?size=300",
+			Description: "Overridden headers",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal("private, max-age=60", w.Header().Get("Cache-Control"), "Cache-Control header"),
+					test.Equal("", w.Header().Get("X-Image-Width"), "X-Image-Width header"),
+					test.Equal("Origin, accept, Save-Data", strings.Join(w.Header().Values("Vary"), "|"), "Vary header"),
+					test.Equal("image/png", strings.Join(w.Header().Values("Content-Type"), "|"), "Content-Type header"),
+				)
+			},
+		},
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/asis",
+			Description: "Single Content-Type of the source",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal("image/png", strings.Join(w.Header().Values("Content-Type"), "|"), "Content-Type header"),
+				)
+			},
+		},
+	})
+}
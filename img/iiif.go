@@ -0,0 +1,296 @@
+package img
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// IiifRequest is the request of IIIF Image API 3.0 with the region, size, rotation,
+// quality and format, e.g. full/max/0/default.jpg.
+type IiifRequest struct {
+	Region   string
+	Size     string
+	Rotation string
+	Quality  string
+	Format   string
+	// MaxDimension is the maximum width and height of the tile. Zero disables the limit.
+	MaxDimension int
+}
+
+type iiifTile struct {
+	Width        int   `json:"width"`
+	ScaleFactors []int `json:"scaleFactors"`
+}
+
+type iiifInfo struct {
+	Context        string     `json:"@context"`
+	Id             string     `json:"id"`
+	Type           string     `json:"type"`
+	Protocol       string     `json:"protocol"`
+	Profile        string     `json:"profile"`
+	Width          int        `json:"width"`
+	Height         int        `json:"height"`
+	MaxWidth       int        `json:"maxWidth,omitempty"`
+	MaxHeight      int        `json:"maxHeight,omitempty"`
+	Tiles          []iiifTile `json:"tiles"`
+	ExtraFormats   []string   `json:"extraFormats"`
+	ExtraQualities []string   `json:"extraQualities"`
+	ExtraFeatures  []string   `json:"extraFeatures"`
+}
+
+// Tile returns the configuration of the tile for the request to the image with the given size.
+// Returns 400 error if request is invalid and 501 error if the feature is not supported,
+// e.g. mirroring or rotation by arbitrary angle.
+func (r *IiifRequest) Tile(info *Info) (*TileConfig, error) {
+	config := &TileConfig{}
+	var err error
+
+	config.X, config.Y, config.Width, config.Height, err = parseIiifRegion(r.Region, info.Width, info.Height)
+	if err != nil {
+		return nil, err
+	}
+	config.TargetWidth, config.TargetHeight, err = parseIiifSize(r.Size, config.Width, config.Height, r.MaxDimension)
+	if err != nil {
+		return nil, err
+	}
+	if err = r.options(config); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// options sets rotation, quality and format of the tile that don't depend on the image.
+func (r *IiifRequest) options(config *TileConfig) error {
+	if strings.HasPrefix(r.Rotation, "!") {
+		return NewHttpError(http.StatusNotImplemented, "mirroring is not supported")
+	}
+	rotation, err := strconv.ParseFloat(r.Rotation, 64)
+	if err != nil || rotation < 0 || rotation > 360 {
+		return NewHttpError(http.StatusBadRequest, "rotation must be a number between 0 and 360")
+	}
+	if rotation != math.Trunc(rotation) || int(rotation)%90 != 0 {
+		return NewHttpError(http.StatusNotImplemented, "only rotation by 90 degrees is supported")
+	}
+	config.Rotation = int(rotation) % 360
+
+	switch r.Quality {
+	case "default", "color":
+	case "gray":
+		config.Gray = true
+	case "bitonal":
+		return NewHttpError(http.StatusNotImplemented, "bitonal quality is not supported")
+	default:
+		return NewHttpError(http.StatusBadRequest, "quality must be one of 'default', 'color', 'gray', 'bitonal'")
+	}
+
+	if !tileFormats[r.Format] {
+		return NewHttpError(http.StatusNotImplemented, "format must be one of 'jpg', 'png', 'webp'")
+	}
+	config.Format = r.Format
+
+	return nil
+}
+
+// parseIiifRegion returns the region of the image in pixels. Region is clipped to the image.
+func parseIiifRegion(region string, width int, height int) (int, int, int, int, error) {
+	switch region {
+	case "full":
+		return 0, 0, width, height, nil
+	case "square":
+		if width > height {
+			return (width - height) / 2, 0, height, height, nil
+		}
+		return 0, (height - width) / 2, width, width, nil
+	}
+
+	invalid := NewHttpError(http.StatusBadRequest, "region must be 'full', 'square', 'x,y,w,h' or 'pct:x,y,w,h'")
+	pct := strings.HasPrefix(region, "pct:")
+	parts := strings.Split(strings.TrimPrefix(region, "pct:"), ",")
+	if len(parts) != 4 {
+		return 0, 0, 0, 0, invalid
+	}
+	values := make([]float64, 4)
+	for i, part := range parts {
+		v, err := strconv.ParseFloat(part, 64)
+		if err != nil || v < 0 || v > math.MaxInt32 || (!pct && v != math.Trunc(v)) {
+			return 0, 0, 0, 0, invalid
+		}
+		values[i] = v
+	}
+	if pct {
+		values[0] = values[0] * float64(width) / 100
+		values[1] = values[1] * float64(height) / 100
+		values[2] = values[2] * float64(width) / 100
+		values[3] = values[3] * float64(height) / 100
+	}
+
+	x, y := int(math.Round(values[0])), int(math.Round(values[1]))
+	w, h := int(math.Round(values[2])), int(math.Round(values[3]))
+	if x >= width || y >= height || w <= 0 || h <= 0 {
+		return 0, 0, 0, 0, NewHttpError(http.StatusBadRequest, "region is outside of the image")
+	}
+	if x+w > width {
+		w = width - x
+	}
+	if y+h > height {
+		h = height - y
+	}
+	return x, y, w, h, nil
+}
+
+// parseIiifSize returns the size of the tile for the region of the given size. Sizes bigger
+// than maxDimension are rejected unless it's zero, and "max" is scaled down to it.
+func parseIiifSize(size string, width int, height int, maxDimension int) (int, int, error) {
+	upscale := strings.HasPrefix(size, "^")
+	size = strings.TrimPrefix(size, "^")
+
+	var w, h int
+	switch {
+	case size == "max":
+		w, h = width, height
+		if maxDimension > 0 && (w > maxDimension || h > maxDimension) {
+			w, h = fitIiifSize(w, h, maxDimension, maxDimension)
+		}
+		return w, h, nil
+	case strings.HasPrefix(size, "pct:"):
+		pct, err := strconv.ParseFloat(strings.TrimPrefix(size, "pct:"), 64)
+		if err != nil || pct <= 0 || pct > math.MaxInt32 {
+			return 0, 0, NewHttpError(http.StatusBadRequest, "size percent must be a positive number")
+		}
+		w, h = int(math.Round(float64(width)*pct/100)), int(math.Round(float64(height)*pct/100))
+	default:
+		confined := strings.HasPrefix(size, "!")
+		parts := strings.Split(strings.TrimPrefix(size, "!"), ",")
+		if len(parts) != 2 || (confined && (len(parts[0]) == 0 || len(parts[1]) == 0)) {
+			return 0, 0, NewHttpError(http.StatusBadRequest, "size must be 'max', 'w,', ',h', 'w,h', '!w,h' or 'pct:n'")
+		}
+		var err error
+		if len(parts[0]) > 0 {
+			if w, err = strconv.Atoi(parts[0]); err != nil || w <= 0 {
+				return 0, 0, NewHttpError(http.StatusBadRequest, "width must be a positive number")
+			}
+		}
+		if len(parts[1]) > 0 {
+			if h, err = strconv.Atoi(parts[1]); err != nil || h <= 0 {
+				return 0, 0, NewHttpError(http.StatusBadRequest, "height must be a positive number")
+			}
+		}
+		switch {
+		case confined:
+			if !upscale {
+				w, h = int(math.Min(float64(w), float64(width))), int(math.Min(float64(h), float64(height)))
+			}
+			w, h = fitIiifSize(width, height, w, h)
+		case w == 0 && h == 0:
+			return 0, 0, NewHttpError(http.StatusBadRequest, "width or height is required")
+		case w == 0:
+			w = int(math.Round(float64(width) * float64(h) / float64(height)))
+		case h == 0:
+			h = int(math.Round(float64(height) * float64(w) / float64(width)))
+		}
+	}
+
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	if !upscale && (w > width || h > height) {
+		return 0, 0, NewHttpError(http.StatusBadRequest, "size is bigger than the region, use ^ for upscaling")
+	}
+	if maxDimension > 0 && (w > maxDimension || h > maxDimension) {
+		return 0, 0, NewHttpError(http.StatusBadRequest, fmt.Sprintf("width and height must not be more than %d", maxDimension))
+	}
+	return w, h, nil
+}
+
+// fitIiifSize returns the biggest size with the same aspect ratio that fits into maxWidth x maxHeight.
+func fitIiifSize(width int, height int, maxWidth int, maxHeight int) (int, int) {
+	scale := math.Min(float64(maxWidth)/float64(width), float64(maxHeight)/float64(height))
+	return int(math.Max(1, math.Round(float64(width)*scale))), int(math.Max(1, math.Round(float64(height)*scale)))
+}
+
+// IiifInfoUrl returns IIIF Image API 3.0 information about the image in info.json.
+func (r *Service) IiifInfoUrl(resp http.ResponseWriter, req *http.Request) {
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.forwardedProto(req); len(proto) > 0 {
+		scheme = proto
+	}
+	id := fmt.Sprintf("%s://%s%s", scheme, r.forwardedHost(req), strings.TrimSuffix(req.URL.EscapedPath(), "/info.json"))
+	maxDimension, tileSize := r.config().MaxDimension, r.tileSize()
+
+	r.tileUrl(resp, req, func(tiler Tiler, input *TransformationConfig) (*Image, error) {
+		info := &iiifInfo{
+			Context:        "http://iiif.io/api/image/3/context.json",
+			Id:             id,
+			Type:           "ImageService3",
+			Protocol:       "http://iiif.io/api/image",
+			Profile:        "level1",
+			Width:          input.SrcInfo.Width,
+			Height:         input.SrcInfo.Height,
+			Tiles:          []iiifTile{{Width: tileSize, ScaleFactors: iiifScaleFactors(input.SrcInfo.Width, input.SrcInfo.Height, tileSize)}},
+			ExtraFormats:   []string{"png", "webp"},
+			ExtraQualities: []string{"color", "gray"},
+			ExtraFeatures:  []string{"regionByPct", "regionSquare", "sizeByConfinedWh", "sizeByPct", "sizeUpscaling", "rotationBy90s"},
+		}
+		if maxDimension > 0 {
+			info.MaxWidth, info.MaxHeight = maxDimension, maxDimension
+		}
+
+		buf := GetBuffer()
+		err := json.NewEncoder(buf).Encode(info)
+		if err != nil {
+			PutBuffer(buf)
+			return nil, err
+		}
+		return NewPooledImage("", buf, "application/ld+json;profile=\"http://iiif.io/api/image/3/context.json\""), nil
+	})
+}
+
+// iiifScaleFactors returns powers of two until the whole image fits into one tile.
+func iiifScaleFactors(width int, height int, tileSize int) []int {
+	factors := []int{1}
+	for f := 1; (width+f-1)/f > tileSize || (height+f-1)/f > tileSize; {
+		f *= 2
+		factors = append(factors, f)
+	}
+	return factors
+}
+
+// IiifUrl returns the image for IIIF Image API 3.0 request.
+func (r *Service) IiifUrl(resp http.ResponseWriter, req *http.Request) {
+	vars := PathVars(req)
+	iiifReq := &IiifRequest{
+		Region:   vars["region"],
+		Size:     vars["size"],
+		Rotation: vars["rotation"],
+		Quality:  vars["quality"],
+		Format:   vars["format"],
+
+		MaxDimension: r.config().MaxDimension,
+	}
+
+	// Options that don't depend on the image are checked before loading it
+	if err := iiifReq.options(&TileConfig{}); err != nil {
+		r.sendError(resp, err)
+		return
+	}
+
+	r.tileUrl(resp, req, func(tiler Tiler, input *TransformationConfig) (*Image, error) {
+		config, err := iiifReq.Tile(input.SrcInfo)
+		if err != nil {
+			return nil, err
+		}
+		input.Config = config
+		return tiler.Tile(input)
+	})
+}
@@ -0,0 +1,188 @@
+package img
+
+import (
+	"bytes"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DefaultMaxLadderWidths is the maximum number of widths in the ladder of DefaultServiceConfig.
+const DefaultMaxLadderWidths = 10
+
+// LadderConfig is the configuration of the ladder passed to Ladderer in TransformationConfig.Config.
+type LadderConfig struct {
+	// Widths are widths of images in pixels in ascending order.
+	Widths []int
+}
+
+// Ladderer is implemented by processors that could resize the image to multiple widths
+// decoding the source only once, which is much cheaper than separate resizes.
+type Ladderer interface {
+	// Ladder resizes the image to each width from LadderConfig passed in input.Config preserving
+	// aspect ratio. Returns images in the order of widths.
+	Ladder(input *TransformationConfig) ([]*Image, error)
+}
+
+// asLadderer returns the processor as Ladderer or 501 error if it doesn't support ladders.
+func asLadderer(p Processor) (Ladderer, error) {
+	ladderer, ok := p.(Ladderer)
+	if !ok {
+		return nil, NewHttpError(http.StatusNotImplemented, "processor doesn't support ladders")
+	}
+	return ladderer, nil
+}
+
+// ladder resizes the image to all widths using the processor and returns them as
+// multipart/mixed document.
+func ladder(p Processor, config *TransformationConfig) (*Image, error) {
+	ladderer, err := asLadderer(p)
+	if err != nil {
+		return nil, err
+	}
+	images, err := ladderer.Ladder(config)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, image := range images {
+			image.Release()
+		}
+	}()
+
+	return newLadderMultipart(images, config.Config.(*LadderConfig).Widths, config.Src.MimeType)
+}
+
+// newLadderMultipart returns multipart/mixed document with a part for each image. Parts have
+// Content-Type, X-Image-Width and X-Image-Height headers.
+func newLadderMultipart(images []*Image, widths []int, srcMimeType string) (*Image, error) {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for i, image := range images {
+		header := textproto.MIMEHeader{}
+		mimeType := image.MimeType
+		if len(mimeType) == 0 {
+			mimeType = srcMimeType
+		}
+		if len(mimeType) > 0 {
+			header.Set("Content-Type", mimeType)
+		}
+		width := image.Width
+		if width == 0 && i < len(widths) {
+			width = widths[i]
+		}
+		header.Set("X-Image-Width", strconv.Itoa(width))
+		if image.Height > 0 {
+			header.Set("X-Image-Height", strconv.Itoa(image.Height))
+		}
+		header.Set("Content-Length", strconv.Itoa(len(image.Data)))
+
+		part, err := writer.CreatePart(header)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = part.Write(image.Data); err != nil {
+			return nil, err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	return &Image{
+		Data:     body.Bytes(),
+		MimeType: "multipart/mixed; boundary=" + writer.Boundary(),
+	}, nil
+}
+
+// parseLadderWidths parses comma separated list of widths. Duplicates are removed and widths are sorted.
+func (r *Service) parseLadderWidths(list string) ([]int, error) {
+	config := r.config()
+	seen := make(map[int]bool)
+	var widths []int
+	for _, w := range strings.Split(list, ",") {
+		w = strings.TrimSpace(w)
+		if len(w) == 0 {
+			continue
+		}
+		width, err := strconv.Atoi(w)
+		if err != nil || width <= 0 {
+			return nil, fmt.Errorf("width [%s] must be a positive number", w)
+		}
+		if config.MaxDimension > 0 && width > config.MaxDimension {
+			return nil, fmt.Errorf("widths must not be more than %d", config.MaxDimension)
+		}
+		if !seen[width] {
+			seen[width] = true
+			widths = append(widths, width)
+		}
+	}
+	if len(widths) == 0 {
+		return nil, fmt.Errorf("widths param is required")
+	}
+	if config.MaxLadderWidths > 0 && len(widths) > config.MaxLadderWidths {
+		return nil, fmt.Errorf("ladder must not have more than %d widths", config.MaxLadderWidths)
+	}
+	sort.Ints(widths)
+	return widths, nil
+}
+
+// LadderUrl resizes the image to each width from widths query param, e.g. widths=320,640,960,
+// decoding the source only once. Images are returned as multipart/mixed document in the
+// ascending order of widths, so they could be pre-generated and stored by the caller.
+// Responds with 501 if the processor is not a Ladderer.
+func (r *Service) LadderUrl(resp http.ResponseWriter, req *http.Request) {
+	if _, ok := r.Processor.(Ladderer); !ok {
+		http.Error(resp, "processor doesn't support ladders", http.StatusNotImplemented)
+		return
+	}
+
+	imgUrl := r.getImgUrl(req)
+	if len(imgUrl) == 0 {
+		http.Error(resp, "url param is required", http.StatusBadRequest)
+		return
+	}
+	widthsParam, _ := getQueryParam(req.URL, "widths")
+	widths, err := r.parseLadderWidths(widthsParam)
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	mergeHeader(resp.Header(), "Vary", r.formatsVary())
+
+	r.log().Printf("[%s]: Creating ladder of %d widths of %s\n", req.URL.String(), len(widths), imgUrl)
+
+	srcImage, err := r.load(req, imgUrl)
+	if err != nil {
+		r.sendError(resp, err)
+		return
+	}
+
+	release, err := r.acquireAll(req, []*Image{srcImage})
+	if err != nil {
+		srcImage.Release()
+		r.sendError(resp, err)
+		return
+	}
+	defer release()
+
+	r.execOp(&Command{
+		Op: "ladder",
+		Transformation: func(input *TransformationConfig) (*Image, error) {
+			return ladder(r.Processor, input)
+		},
+		Config: &TransformationConfig{
+			Src:              srcImage,
+			SupportedFormats: r.supportedFormats(req),
+			Quality:          DEFAULT,
+			Config:           &LadderConfig{Widths: widths},
+		},
+		Req:  req,
+		Resp: resp,
+	})
+}
@@ -0,0 +1,135 @@
+package img_test
+
+import (
+	"github.com/Pixboost/transformimgs/v8/img"
+	"github.com/dooman87/kolibri/test"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// ladderProcessor returns the width and the source of each image as its data.
+type ladderProcessor struct {
+	variantsProcessor
+}
+
+func (p *ladderProcessor) Ladder(config *img.TransformationConfig) ([]*img.Image, error) {
+	var images []*img.Image
+	for _, w := range config.Config.(*img.LadderConfig).Widths {
+		images = append(images, &img.Image{
+			Data:     []byte(strconv.Itoa(w) + " from " + string(config.Src.Data)),
+			MimeType: "image/webp",
+			Width:    w,
+			Height:   w / 2,
+		})
+	}
+	return images, nil
+}
+
+func TestService_Ladder(t *testing.T) {
+	s, err := img.NewService(&loaderMock{}, &ladderProcessor{}, 1)
+	if err != nil {
+		t.Fatalf("could not create service: %s", err)
+	}
+	test.Service = s.GetRouter().ServeHTTP
+	test.T = t
+
+	test.RunRequests([]test.TestCase{
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/ladder?widths=640,320,640",
+			Description: "Success",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				mediaType, params, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+				if err != nil || mediaType != "multipart/mixed" {
+					t.Fatalf("expected multipart/mixed, but got [%s]: %v", w.Header().Get("Content-Type"), err)
+				}
+
+				var parts []string
+				reader := multipart.NewReader(w.Body, params["boundary"])
+				for {
+					part, err := reader.NextPart()
+					if err == io.EOF {
+						break
+					}
+					if err != nil {
+						t.Fatalf("could not read part: %s", err)
+					}
+					data, _ := io.ReadAll(part)
+					parts = append(parts, part.Header.Get("X-Image-Width")+"x"+part.Header.Get("X-Image-Height")+" "+
+						part.Header.Get("Content-Type")+" "+string(data))
+				}
+
+				expected := "320x160 image/webp 320 from " + ImgSrc + "|640x320 image/webp 640 from " + ImgSrc
+				test.Error(t,
+					test.Equal(expected, strings.Join(parts, "|"), "Parts"),
+					test.Equal("Accept", w.Header().Get("Vary"), "Vary header"),
+				)
+			},
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/ladder",
+			ExpectedCode: http.StatusBadRequest,
+			Description:  "Missing widths",
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/ladder?widths=320,abc",
+			ExpectedCode: http.StatusBadRequest,
+			Description:  "Invalid width",
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/ladder?widths=1,2,3,4,5,6,7,8,9,10,11",
+			ExpectedCode: http.StatusBadRequest,
+			Description:  "Too many widths",
+		},
+	})
+
+	configured, err := img.NewServiceWithConfig(&loaderMock{}, &ladderProcessor{}, 1, &img.ServiceConfig{MaxLadderWidths: 2})
+	if err != nil {
+		t.Fatalf("could not create service: %s", err)
+	}
+	test.Service = configured.GetRouter().ServeHTTP
+	test.RunRequests([]test.TestCase{
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/ladder?widths=320,640,960",
+			ExpectedCode: http.StatusBadRequest,
+			Description:  "Too many widths for the service",
+		},
+	})
+	test.Service = s.GetRouter().ServeHTTP
+
+	memory := img.EstimateMemory(&img.Image{Data: []byte(ImgSrc)})
+	s.MemoryBudget, _ = img.NewMemoryBudget(memory-1, 0)
+	test.RunRequests([]test.TestCase{
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/ladder?widths=320",
+			ExpectedCode: http.StatusRequestEntityTooLarge,
+			Description:  "Image is bigger than memory budget",
+		},
+	})
+	s.MemoryBudget, _ = img.NewMemoryBudget(memory, 0)
+	test.RunRequests([]test.TestCase{
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/ladder?widths=320",
+			Description: "Image fits into memory budget",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal(int64(0), s.MemoryBudget.Used(), "Memory released"),
+				)
+			},
+		},
+	})
+
+	test.Service = createService(t).GetRouter().ServeHTTP
+	test.RunRequests([]test.TestCase{
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/ladder?widths=320",
+			ExpectedCode: http.StatusNotImplemented,
+			Description:  "Processor doesn't support ladders",
+		},
+	})
+}
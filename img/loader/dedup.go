@@ -0,0 +1,118 @@
+package loader
+
+import (
+	"context"
+	"github.com/Pixboost/transformimgs/v8/img"
+	"sync"
+)
+
+// Dedup shares one download of the source between concurrent requests of the same URL, so
+// different transformations of the same source, e.g. srcset variants requested by the browser at once,
+// don't hit the origin several times. Service normalizes URLs before loading, see img.Service.NormalizeUrl,
+// so equivalent URLs share the download too.
+type Dedup struct {
+	Loader img.Loader
+
+	mu    sync.Mutex
+	calls map[string]*dedupCall
+}
+
+type dedupCall struct {
+	done chan struct{}
+	// followers is the number of requests waiting for the download.
+	followers int
+	completed bool
+	// canceled is true if the context of the request that downloaded the source is done.
+	canceled bool
+	copies   []*img.Image
+	err      error
+}
+
+// Load loads the image using Loader or waits for the download of the same URL that is in progress.
+// Each request gets its own copy of the image, so it could be released independently. Waiting
+// requests retry the download if the request that started it was canceled.
+func (d *Dedup) Load(url string, ctx context.Context) (*img.Image, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	d.mu.Lock()
+	if d.calls == nil {
+		d.calls = make(map[string]*dedupCall)
+	}
+	if c, ok := d.calls[url]; ok {
+		c.followers++
+		d.mu.Unlock()
+		return d.wait(url, ctx, c)
+	}
+	c := &dedupCall{done: make(chan struct{})}
+	d.calls[url] = c
+	d.mu.Unlock()
+
+	image, err := d.Loader.Load(url, ctx)
+
+	d.mu.Lock()
+	delete(d.calls, url)
+	c.completed = true
+	c.canceled = ctx.Err() != nil
+	c.err = err
+	if err == nil {
+		c.copies = make([]*img.Image, c.followers)
+		for i := range c.copies {
+			c.copies[i] = copyImage(image)
+		}
+	}
+	d.mu.Unlock()
+	close(c.done)
+
+	return image, err
+}
+
+// wait waits for the download and returns the copy of the image.
+func (d *Dedup) wait(url string, ctx context.Context, c *dedupCall) (*img.Image, error) {
+	select {
+	case <-c.done:
+	case <-ctx.Done():
+		d.mu.Lock()
+		if !c.completed {
+			c.followers--
+			d.mu.Unlock()
+			return nil, sourceError(ctx.Err())
+		}
+		d.mu.Unlock()
+		// Copy was made for the request, so it must be taken and released
+		<-c.done
+		if image := takeCopy(&d.mu, c); image != nil {
+			image.Release()
+		}
+		return nil, sourceError(ctx.Err())
+	}
+
+	if c.err != nil {
+		if c.canceled {
+			return d.Load(url, ctx)
+		}
+		return nil, c.err
+	}
+	return takeCopy(&d.mu, c), nil
+}
+
+func takeCopy(mu *sync.Mutex, c *dedupCall) *img.Image {
+	mu.Lock()
+	defer mu.Unlock()
+	if len(c.copies) == 0 {
+		return nil
+	}
+	image := c.copies[len(c.copies)-1]
+	c.copies = c.copies[:len(c.copies)-1]
+	return image
+}
+
+func copyImage(image *img.Image) *img.Image {
+	buf := img.GetBuffer()
+	buf.Write(image.Data)
+	copied := img.NewPooledImage(image.Id, buf, image.MimeType)
+	copied.Width, copied.Height, copied.Frames = image.Width, image.Height, image.Frames
+	copied.CacheControl, copied.Expires, copied.RobotsTag = image.CacheControl, image.Expires, image.RobotsTag
+	return copied
+}
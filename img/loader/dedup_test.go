@@ -0,0 +1,121 @@
+package loader_test
+
+import (
+	"context"
+	"github.com/Pixboost/transformimgs/v8/img"
+	"github.com/Pixboost/transformimgs/v8/img/loader"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blockingLoader counts loads and returns the URL as data after release is closed
+// or the context is done.
+type blockingLoader struct {
+	loads   int32
+	release chan struct{}
+}
+
+func (l *blockingLoader) Load(url string, ctx context.Context) (*img.Image, error) {
+	atomic.AddInt32(&l.loads, 1)
+	select {
+	case <-l.release:
+		return &img.Image{Id: url, Data: []byte(url), MimeType: "image/png"}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestDedup_Load(t *testing.T) {
+	source := &blockingLoader{release: make(chan struct{})}
+	dedup := &loader.Dedup{Loader: source}
+
+	var wg sync.WaitGroup
+	images := make([]*img.Image, 4)
+	errs := make([]error, 4)
+	for i := range images {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			images[i], errs[i] = dedup.Load("http://site.com/img.png", context.Background())
+		}(i)
+	}
+	// Waiting for all requests to join the download
+	time.Sleep(20 * time.Millisecond)
+	close(source.release)
+	wg.Wait()
+
+	if loads := atomic.LoadInt32(&source.loads); loads != 1 {
+		t.Errorf("expected 1 load, but got %d", loads)
+	}
+	for i, image := range images {
+		if errs[i] != nil || image == nil || string(image.Data) != "http://site.com/img.png" {
+			t.Fatalf("unexpected result of request %d: %+v, %v", i, image, errs[i])
+		}
+		for j := 0; j < i; j++ {
+			if &images[j].Data[0] == &image.Data[0] {
+				t.Errorf("expected requests %d and %d to have own copies", j, i)
+			}
+		}
+	}
+	for _, image := range images {
+		image.Release()
+	}
+
+	image, err := dedup.Load("http://site.com/img.png", context.Background())
+	if err != nil || string(image.Data) != "http://site.com/img.png" {
+		t.Errorf("unexpected result of the next request: %+v, %v", image, err)
+	}
+	if loads := atomic.LoadInt32(&source.loads); loads != 2 {
+		t.Errorf("expected completed download not to be shared, but got %d loads", loads)
+	}
+}
+
+func TestDedup_LoadCanceled(t *testing.T) {
+	source := &blockingLoader{release: make(chan struct{})}
+	dedup := &loader.Dedup{Loader: source}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	leaderErr := make(chan error)
+	go func() {
+		_, err := dedup.Load("http://site.com/img.png", ctx)
+		leaderErr <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	followerErr := make(chan error)
+	go func() {
+		image, err := dedup.Load("http://site.com/img.png", context.Background())
+		if err == nil && string(image.Data) != "http://site.com/img.png" {
+			t.Errorf("unexpected image: %+v", image)
+		}
+		followerErr <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	cancel()
+	if err := <-leaderErr; err == nil {
+		t.Errorf("expected error of the canceled request")
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(source.release)
+	if err := <-followerErr; err != nil {
+		t.Errorf("expected follower to retry the download, but got %v", err)
+	}
+	if loads := atomic.LoadInt32(&source.loads); loads != 2 {
+		t.Errorf("expected 2 loads, but got %d", loads)
+	}
+
+	timeout, cancelTimeout := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancelTimeout()
+	source.release = make(chan struct{})
+	go func() {
+		_, _ = dedup.Load("http://site.com/img2.png", context.Background())
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if _, err := dedup.Load("http://site.com/img2.png", timeout); err == nil {
+		t.Errorf("expected error when the context of the waiting request is done")
+	}
+	close(source.release)
+}
@@ -2,20 +2,51 @@ package loader
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/Pixboost/transformimgs/v8/img"
+	"github.com/dooman87/glogi"
 	"io"
-	"io/ioutil"
 	"net"
 	"net/http"
+	"strings"
 	"time"
 )
 
 type Http struct {
 	// Headers that will be sent with each request
 	Headers http.Header
+	// Limits of concurrent requests to origins. Requests are not limited if nil.
+	Limits *Limits
+	// MaxSize is the maximum size of source images in bytes. Loading is aborted as soon as
+	// Content-Length or read bytes exceed it. Zero means no limit.
+	MaxSize int64
+	// Mirrors are hosts of mirrors of origin hosts, see ParseMirrors. If loading from the origin
+	// fails with a server error or timeout, then the same path is loaded from mirrors in turn.
+	Mirrors map[string][]string
+	// Signer signs requests to origins, e.g. SigV4. Requests are not signed if nil.
+	Signer RequestSigner
+	// Timeout is the maximum duration of loading from the origin including reading of the body.
+	// DefaultTimeout is used if zero.
+	Timeout time.Duration
+	// Log is the logger of the loader. Package img.Log is used if nil.
+	Log glogi.Logger
 }
 
+func (r *Http) log() glogi.Logger {
+	if r.Log != nil {
+		return r.Log
+	}
+	return img.Log
+}
+
+// DefaultTimeout is the timeout of loading from origins if Http.Timeout is not set.
+var DefaultTimeout = 60 * time.Second
+
+// maxPreallocSize limits the buffer that is allocated upfront using Content-Length of the response,
+// which is set by the origin and can't be trusted.
+const maxPreallocSize = 16 << 20
+
 var dialer = &net.Dialer{
 	Timeout:   5 * time.Second,
 	KeepAlive: 30 * time.Second,
@@ -33,10 +64,53 @@ var client = &http.Client{
 	},
 }
 
-func (r *Http) Load(url string, _ context.Context) (*img.Image, error) {
-	req, err := http.NewRequest("GET", url, nil)
+// Load loads the image using HTTP GET request. Errors are returned as img.HttpError:
+//   - 400 if URL is invalid or scheme is not supported;
+//   - 404 if the source image is not found;
+//   - 413 if the source image is bigger than MaxSize;
+//   - 504 if the source server has timed out or the deadline of the context is exceeded;
+//   - 502 for all other errors of the source server.
+//
+// Loading is aborted when the context is done, e.g. the client has gone. Errors of the origin
+// are returned if the image couldn't be loaded from mirrors either.
+func (r *Http) Load(url string, ctx context.Context) (*img.Image, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	image, err := r.load(url, url, ctx)
+	if err == nil || !failover(err) {
+		return image, err
+	}
+	for _, mirrorUrl := range r.mirrorUrls(url) {
+		if ctx.Err() != nil {
+			break
+		}
+		r.log().Printf("[%s] Loading from mirror [%s] after error: %s\n", url, mirrorUrl, err)
+		mirrorImage, mirrorErr := r.load(mirrorUrl, url, ctx)
+		if mirrorErr == nil {
+			return mirrorImage, nil
+		}
+		r.log().Printf("[%s] Could not load from mirror [%s]: %s\n", url, mirrorUrl, mirrorErr)
+	}
+	return nil, err
+}
+
+// load loads the image from url. id is the id of the loaded image, so images from mirrors
+// have the id of the source URL.
+func (r *Http) load(url string, id string, ctx context.Context) (*img.Image, error) {
+	timeout := r.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
-		return nil, err
+		return nil, img.NewHttpError(http.StatusBadRequest, fmt.Sprintf("invalid source URL: %s", err))
+	}
+	if (req.URL.Scheme != "http" && req.URL.Scheme != "https") || len(req.URL.Host) == 0 {
+		return nil, img.NewHttpError(http.StatusBadRequest, fmt.Sprintf("unsupported source URL [%s]", url))
 	}
 	for k, v := range r.Headers {
 		for _, headerVal := range v {
@@ -44,29 +118,80 @@ func (r *Http) Load(url string, _ context.Context) (*img.Image, error) {
 		}
 	}
 
+	if traceParent := img.SpanFromContext(ctx).TraceParent(); len(traceParent) > 0 {
+		req.Header.Set(img.TraceParentHeader, traceParent)
+	}
+
+	if r.Limits != nil {
+		release, err := r.Limits.Acquire(ctx, req.URL.Host)
+		if err != nil {
+			return nil, sourceError(err)
+		}
+		// Slot is released after the body is read
+		defer release()
+	}
+
+	if r.Signer != nil {
+		if err := r.Signer.Sign(req); err != nil {
+			return nil, img.NewHttpError(http.StatusBadGateway, fmt.Sprintf("could not sign request to the source: %s", err))
+		}
+	}
+
 	resp, err := client.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, sourceError(err)
 	}
 	defer func(Body io.ReadCloser) {
 		_ = Body.Close()
 	}(resp.Body)
 
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone {
+		return nil, fmt.Errorf("%w: expected %d but got code %d.\n Error '%s'",
+			img.ErrOriginNotFound, http.StatusOK, resp.StatusCode, resp.Status)
+	}
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("Expected %d but got code %d.\n Error '%s'",
-			http.StatusOK, resp.StatusCode, resp.Status)
+		return nil, img.NewHttpError(http.StatusBadGateway, fmt.Sprintf("Expected %d but got code %d.\n Error '%s'",
+			http.StatusOK, resp.StatusCode, resp.Status))
 	}
 
 	contentType := resp.Header.Get("Content-Type")
 
-	result, err := ioutil.ReadAll(resp.Body)
+	var body io.Reader = resp.Body
+	if r.MaxSize > 0 {
+		if resp.ContentLength > r.MaxSize {
+			return nil, fmt.Errorf("%w, Content-Length [%d] is more than allowed [%d]", img.ErrTooLarge, resp.ContentLength, r.MaxSize)
+		}
+		// Reading one more byte to detect bodies without Content-Length that are too large
+		body = io.LimitReader(resp.Body, r.MaxSize+1)
+	}
+
+	buf := img.GetBuffer()
+	if resp.ContentLength > 0 {
+		buf.Grow(int(min(resp.ContentLength, maxPreallocSize)))
+	}
+	_, err = buf.ReadFrom(body)
 	if err != nil {
-		return nil, err
+		img.PutBuffer(buf)
+		return nil, sourceError(err)
+	}
+	if r.MaxSize > 0 && int64(buf.Len()) > r.MaxSize {
+		img.PutBuffer(buf)
+		return nil, fmt.Errorf("%w, source image is more than allowed [%d] bytes", img.ErrTooLarge, r.MaxSize)
+	}
+
+	image := img.NewPooledImage(id, buf, contentType)
+	image.CacheControl = resp.Header.Get("Cache-Control")
+	image.Expires = resp.Header.Get("Expires")
+	image.RobotsTag = strings.Join(resp.Header.Values(img.RobotsTagHeader), ", ")
+	return image, nil
+}
+
+// sourceError converts error of the request to the source server to img.HttpError.
+func sourceError(err error) error {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return img.NewHttpError(http.StatusGatewayTimeout, fmt.Sprintf("timeout loading source image: %s", err))
 	}
 
-	return &img.Image{
-		Id:       url,
-		Data:     result,
-		MimeType: contentType,
-	}, nil
+	return img.NewHttpError(http.StatusBadGateway, fmt.Sprintf("error loading source image: %s", err))
 }
@@ -2,16 +2,21 @@ package loader_test
 
 import (
 	"context"
+	"errors"
+	"github.com/Pixboost/transformimgs/v8/img"
 	"github.com/Pixboost/transformimgs/v8/img/loader"
 	"github.com/dooman87/kolibri/test"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 )
 
 func TestHttp_LoadImg(t *testing.T) {
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Add("Content-Type", "cool/stuff")
+		w.Header().Add("Cache-Control", "public, max-age=60")
+		w.Header().Add("Expires", "Thu, 01 Dec 2044 16:00:00 GMT")
 		w.Write([]byte("123"))
 	}))
 	defer server.Close()
@@ -24,6 +29,8 @@ func TestHttp_LoadImg(t *testing.T) {
 		test.Nil(err, "error"),
 		test.Equal("cool/stuff", image.MimeType, "content type"),
 		test.Equal("123", string(image.Data), "resulted image"),
+		test.Equal("public, max-age=60", image.CacheControl, "Cache-Control of the origin"),
+		test.Equal("Thu, 01 Dec 2044 16:00:00 GMT", image.Expires, "Expires of the origin"),
 	)
 }
 
@@ -69,6 +76,27 @@ func TestHttp_LoadImgErrorResponseStatus(t *testing.T) {
 
 	test.Error(t,
 		test.NotNil(err, "error"),
+		test.Equal(http.StatusNotFound, httpCode(err), "status code"),
+		test.Equal(true, errors.Is(err, img.ErrOriginNotFound), "origin not found"),
+	)
+}
+
+func TestHttp_LoadErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	httpLoader := &loader.Http{}
+
+	_, serverErr := httpLoader.Load(server.URL, context.Background())
+	_, schemeErr := httpLoader.Load("ftp://site.com/img.png", context.Background())
+	_, invalidErr := httpLoader.Load("http://site.com/%zz", context.Background())
+
+	test.Error(t,
+		test.Equal(http.StatusBadGateway, httpCode(serverErr), "server error"),
+		test.Equal(http.StatusBadRequest, httpCode(schemeErr), "unsupported scheme"),
+		test.Equal(http.StatusBadRequest, httpCode(invalidErr), "invalid url"),
 	)
 }
 
@@ -137,3 +165,118 @@ func FuzzHttp_LoadCustomHeaders(f *testing.F) {
 		}
 	})
 }
+
+func httpCode(err error) int {
+	var httpErr *img.HttpError
+	if errors.As(err, &httpErr) {
+		return httpErr.Code()
+	}
+	return 0
+}
+
+func TestHttp_LoadMaxSize(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/chunked" {
+			// Flushing before writing the body, so Content-Length is not set
+			w.(http.Flusher).Flush()
+		}
+		w.Write([]byte("12345"))
+	}))
+	defer server.Close()
+
+	httpLoader := &loader.Http{MaxSize: 4}
+	_, lengthErr := httpLoader.Load(server.URL+"/length", context.Background())
+	_, chunkedErr := httpLoader.Load(server.URL+"/chunked", context.Background())
+	image, err := (&loader.Http{MaxSize: 5}).Load(server.URL+"/chunked", context.Background())
+
+	test.Error(t,
+		test.Equal(true, errors.Is(lengthErr, img.ErrTooLarge), "Content-Length is too large"),
+		test.Equal(true, errors.Is(chunkedErr, img.ErrTooLarge), "body is too large"),
+		test.Equal(http.StatusRequestEntityTooLarge, httpCode(chunkedErr), "status code"),
+		test.Nil(err, "error"),
+		test.Equal("12345", string(image.Data), "resulted image"),
+	)
+}
+
+func TestHttp_LoadHugeContentLength(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "1099511627776")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("123"))
+	}))
+	defer server.Close()
+
+	_, err := (&loader.Http{}).Load(server.URL, context.Background())
+
+	test.Error(t,
+		test.Equal(http.StatusBadGateway, httpCode(err), "truncated body"),
+	)
+}
+
+func TestHttp_LoadSlowOrigin(t *testing.T) {
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-done:
+		}
+	}))
+	defer server.Close()
+	defer close(done)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, deadlineErr := (&loader.Http{}).Load(server.URL, ctx)
+	deadlineTime := time.Since(start)
+
+	start = time.Now()
+	_, timeoutErr := (&loader.Http{Timeout: 50 * time.Millisecond}).Load(server.URL, context.Background())
+	timeoutTime := time.Since(start)
+
+	canceledCtx, cancelNow := context.WithCancel(context.Background())
+	cancelNow()
+	_, canceledErr := (&loader.Http{}).Load(server.URL, canceledCtx)
+
+	test.Error(t,
+		test.Equal(http.StatusGatewayTimeout, httpCode(deadlineErr), "deadline of the context"),
+		test.Equal(true, deadlineTime < time.Second, "loading is aborted at the deadline"),
+		test.Equal(http.StatusGatewayTimeout, httpCode(timeoutErr), "timeout of the loader"),
+		test.Equal(true, timeoutTime < time.Second, "loading is aborted at the timeout"),
+		test.Equal(http.StatusBadGateway, httpCode(canceledErr), "canceled context"),
+	)
+}
+
+func TestHttp_LoadRobotsTag(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("X-Robots-Tag", "noimageindex")
+		w.Header().Add("X-Robots-Tag", "noarchive")
+		w.Write([]byte("123"))
+	}))
+	defer server.Close()
+
+	image, err := (&loader.Http{}).Load(server.URL, context.Background())
+
+	test.Error(t,
+		test.Nil(err, "error"),
+		test.Equal("noimageindex, noarchive", image.RobotsTag, "X-Robots-Tag of the origin"),
+	)
+}
+
+func TestHttp_LoadTraceParent(t *testing.T) {
+	var traceParent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceParent = r.Header.Get("traceparent")
+		w.Write([]byte("123"))
+	}))
+	defer server.Close()
+
+	span := &img.Span{}
+	span.TraceId[0], span.SpanId[0] = 1, 2
+	_, err := (&loader.Http{}).Load(server.URL, img.ContextWithSpan(context.Background(), span))
+
+	test.Error(t,
+		test.Nil(err, "error"),
+		test.Equal("00-01000000000000000000000000000000-0200000000000000-01", traceParent, "traceparent header"),
+	)
+}
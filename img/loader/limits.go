@@ -0,0 +1,155 @@
+package loader
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// Limits limits the number of concurrent requests to origins per host and in total, so
+// a burst of requests to one origin doesn't trip its WAF or exhaust sockets. Requests over
+// the limits wait in the queue until a slot is released or the context is done.
+type Limits struct {
+	// MaxPerHost is the maximum number of concurrent requests to one host. Zero means no limit.
+	MaxPerHost int
+	// MaxTotal is the maximum number of concurrent requests to all hosts. Zero means no limit.
+	MaxTotal int
+
+	once  sync.Once
+	total chan struct{}
+	mu    sync.Mutex
+	hosts map[string]*hostSlots
+}
+
+// LimitsStats is the number of active and waiting requests.
+type LimitsStats struct {
+	Host    string
+	Active  int
+	Waiting int
+}
+
+type hostSlots struct {
+	slots   chan struct{}
+	active  int
+	waiting int
+}
+
+// Acquire waits for a free slot for the request to the host. Returned function must be called
+// to release the slot after the response is read.
+func (l *Limits) Acquire(ctx context.Context, host string) (func(), error) {
+	l.once.Do(func() {
+		if l.MaxTotal > 0 {
+			l.total = make(chan struct{}, l.MaxTotal)
+		}
+	})
+
+	h := l.host(host)
+	if h.slots != nil {
+		select {
+		case h.slots <- struct{}{}:
+		case <-ctx.Done():
+			l.done(host, h, false)
+			return nil, ctx.Err()
+		}
+	}
+	if l.total != nil {
+		select {
+		case l.total <- struct{}{}:
+		case <-ctx.Done():
+			if h.slots != nil {
+				<-h.slots
+			}
+			l.done(host, h, false)
+			return nil, ctx.Err()
+		}
+	}
+	l.mu.Lock()
+	h.waiting--
+	h.active++
+	l.mu.Unlock()
+
+	return func() {
+		if l.total != nil {
+			<-l.total
+		}
+		if h.slots != nil {
+			<-h.slots
+		}
+		l.done(host, h, true)
+	}, nil
+}
+
+// host returns slots of the host and registers the waiting request.
+func (l *Limits) host(host string) *hostSlots {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.hosts == nil {
+		l.hosts = make(map[string]*hostSlots)
+	}
+	h, ok := l.hosts[host]
+	if !ok {
+		h = &hostSlots{}
+		if l.MaxPerHost > 0 {
+			h.slots = make(chan struct{}, l.MaxPerHost)
+		}
+		l.hosts[host] = h
+	}
+	h.waiting++
+	return h
+}
+
+// done unregisters the request and removes hosts without requests.
+func (l *Limits) done(host string, h *hostSlots, active bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if active {
+		h.active--
+	} else {
+		h.waiting--
+	}
+	if h.active == 0 && h.waiting == 0 {
+		delete(l.hosts, host)
+	}
+}
+
+// Stats returns the number of active and waiting requests for each host with requests sorted by host.
+func (l *Limits) Stats() []LimitsStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	result := make([]LimitsStats, 0, len(l.hosts))
+	for host, h := range l.hosts {
+		result = append(result, LimitsStats{Host: host, Active: h.active, Waiting: h.waiting})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Host < result[j].Host
+	})
+	return result
+}
+
+// ServeMetrics writes the number of active and waiting requests as gauges in Prometheus text format.
+func (l *Limits) ServeMetrics(resp http.ResponseWriter, _ *http.Request) {
+	stats := l.Stats()
+	metrics := []struct {
+		name  string
+		help  string
+		value func(s LimitsStats) int
+	}{
+		{"transformimgs_origin_requests_active", "Number of active requests to origins.", func(s LimitsStats) int { return s.Active }},
+		{"transformimgs_origin_requests_waiting", "Number of requests to origins waiting for a free slot.", func(s LimitsStats) int { return s.Waiting }},
+	}
+
+	resp.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	resp.Header().Set("Cache-Control", "no-store")
+	for _, m := range metrics {
+		_, _ = fmt.Fprintf(resp, "# HELP %s %s\n# TYPE %s gauge\n", m.name, m.help, m.name)
+		for _, st := range stats {
+			_, _ = fmt.Fprintf(resp, "%s{host=%q} %d\n", m.name, st.Host, m.value(st))
+		}
+	}
+	_, _ = fmt.Fprintf(resp, "# HELP transformimgs_origin_requests_limit Limits of concurrent requests to origins.\n"+
+		"# TYPE transformimgs_origin_requests_limit gauge\n"+
+		"transformimgs_origin_requests_limit{scope=\"host\"} %d\ntransformimgs_origin_requests_limit{scope=\"total\"} %d\n",
+		l.MaxPerHost, l.MaxTotal)
+}
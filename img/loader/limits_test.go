@@ -0,0 +1,111 @@
+package loader_test
+
+import (
+	"context"
+	"github.com/Pixboost/transformimgs/v8/img/loader"
+	"github.com/dooman87/kolibri/test"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLimits_Acquire(t *testing.T) {
+	limits := &loader.Limits{MaxPerHost: 1, MaxTotal: 2}
+
+	releaseA, err := limits.Acquire(context.Background(), "a.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err = limits.Acquire(ctx, "a.com"); err == nil {
+		t.Errorf("expected error when host limit is reached")
+	}
+
+	releaseB, err := limits.Acquire(context.Background(), "b.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := []loader.LimitsStats{{Host: "a.com", Active: 1}, {Host: "b.com", Active: 1}}
+	if stats := limits.Stats(); !reflect.DeepEqual(expected, stats) {
+		t.Errorf("expected stats %+v, but got %+v", expected, stats)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err = limits.Acquire(ctx, "c.com"); err == nil {
+		t.Errorf("expected error when total limit is reached")
+	}
+
+	releaseA()
+	releaseC, err := limits.Acquire(context.Background(), "c.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	releaseB()
+	releaseC()
+	test.Error(t,
+		test.Equal(0, len(limits.Stats()), "hosts without requests"),
+	)
+}
+
+func TestLimits_ServeMetrics(t *testing.T) {
+	limits := &loader.Limits{MaxPerHost: 2}
+	release, _ := limits.Acquire(context.Background(), "a.com")
+	defer release()
+
+	w := httptest.NewRecorder()
+	limits.ServeMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	body := w.Body.String()
+	for _, line := range []string{
+		`transformimgs_origin_requests_active{host="a.com"} 1`,
+		`transformimgs_origin_requests_waiting{host="a.com"} 0`,
+		`transformimgs_origin_requests_limit{scope="host"} 2`,
+		`transformimgs_origin_requests_limit{scope="total"} 0`,
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("expected [%s] in metrics, but got %s", line, body)
+		}
+	}
+}
+
+func TestHttp_LoadLimits(t *testing.T) {
+	var active, maxActive int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&active, 1)
+		for {
+			m := atomic.LoadInt32(&maxActive)
+			if n <= m || atomic.CompareAndSwapInt32(&maxActive, m, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt32(&active, -1)
+		w.Write([]byte("123"))
+	}))
+	defer server.Close()
+
+	httpLoader := &loader.Http{Limits: &loader.Limits{MaxPerHost: 2}}
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := httpLoader.Load(server.URL, context.Background()); err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if maxActive > 2 {
+		t.Errorf("expected at most 2 concurrent requests, but got %d", maxActive)
+	}
+}
@@ -0,0 +1,69 @@
+package loader
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Pixboost/transformimgs/v8/img"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ParseMirrors parses the comma separated list of mirrors of origin hosts,
+// e.g. "site.com=mirror1.site.com|mirror2.site.com,cdn.com=backup.cdn.com".
+// Mirrors of the host are tried in the order of the list.
+func ParseMirrors(list string) (map[string][]string, error) {
+	mirrors := make(map[string][]string)
+	for _, m := range strings.Split(list, ",") {
+		m = strings.TrimSpace(m)
+		if len(m) == 0 {
+			continue
+		}
+		host, hosts, ok := strings.Cut(m, "=")
+		host = strings.ToLower(strings.TrimSpace(host))
+		if !ok || len(host) == 0 {
+			return nil, fmt.Errorf("mirrors [%s] must be in format host=mirror1|mirror2", m)
+		}
+		for _, mirror := range strings.Split(hosts, "|") {
+			mirror = strings.TrimSpace(mirror)
+			if len(mirror) == 0 || strings.ContainsAny(mirror, "/?#@") {
+				return nil, fmt.Errorf("invalid mirror [%s] of host [%s]", mirror, host)
+			}
+			mirrors[host] = append(mirrors[host], mirror)
+		}
+	}
+	return mirrors, nil
+}
+
+// mirrorUrls returns URLs of the source on mirrors of its host, see Http.Mirrors.
+func (r *Http) mirrorUrls(source string) []string {
+	if len(r.Mirrors) == 0 {
+		return nil
+	}
+	u, err := url.Parse(source)
+	if err != nil {
+		return nil
+	}
+	mirrors := r.Mirrors[strings.ToLower(u.Host)]
+	urls := make([]string, 0, len(mirrors))
+	for _, mirror := range mirrors {
+		m := *u
+		m.Host = mirror
+		urls = append(urls, m.String())
+	}
+	return urls
+}
+
+// failover returns true if the source image should be loaded from mirrors after the error,
+// i.e. the origin is down or has timed out. Images that are not found, too large or have
+// invalid URLs won't be different on mirrors.
+func failover(err error) bool {
+	if errors.Is(err, img.ErrOriginNotFound) || errors.Is(err, img.ErrTooLarge) {
+		return false
+	}
+	var httpErr *img.HttpError
+	if errors.As(err, &httpErr) {
+		return httpErr.Code() >= http.StatusInternalServerError
+	}
+	return true
+}
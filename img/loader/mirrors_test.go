@@ -0,0 +1,84 @@
+package loader_test
+
+import (
+	"context"
+	"errors"
+	"github.com/Pixboost/transformimgs/v8/img"
+	"github.com/Pixboost/transformimgs/v8/img/loader"
+	"github.com/dooman87/kolibri/test"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestParseMirrors(t *testing.T) {
+	mirrors, err := loader.ParseMirrors(" site.com=m1.site.com|m2.site.com:8080, CDN.com=backup.com,")
+	_, formatErr := loader.ParseMirrors("site.com")
+	_, mirrorErr := loader.ParseMirrors("site.com=m1.site.com|")
+	_, pathErr := loader.ParseMirrors("site.com=m1.site.com/images")
+
+	test.Error(t,
+		test.Nil(err, "error"),
+		test.Equal(2, len(mirrors), "number of hosts"),
+		test.Equal("m1.site.com,m2.site.com:8080", strings.Join(mirrors["site.com"], ","), "mirrors of site.com"),
+		test.Equal("backup.com", strings.Join(mirrors["cdn.com"], ","), "mirrors of cdn.com"),
+		test.NotNil(formatErr, "error of invalid format"),
+		test.NotNil(mirrorErr, "error of empty mirror"),
+		test.NotNil(pathErr, "error of mirror with path"),
+	)
+}
+
+func TestHttp_LoadMirrors(t *testing.T) {
+	var primaryPaths, mirrorPaths []string
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		primaryPaths = append(primaryPaths, r.URL.Path)
+		switch r.URL.Path {
+		case "/missing.png":
+			w.WriteHeader(http.StatusNotFound)
+		case "/ok.png":
+			w.Write([]byte("primary"))
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer primary.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer down.Close()
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mirrorPaths = append(mirrorPaths, r.URL.RequestURI())
+		if r.URL.Path == "/broken.png" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("mirror"))
+	}))
+	defer mirror.Close()
+
+	primaryHost, _ := url.Parse(primary.URL)
+	downHost, _ := url.Parse(down.URL)
+	mirrorHost, _ := url.Parse(mirror.URL)
+	httpLoader := &loader.Http{
+		Mirrors: map[string][]string{primaryHost.Host: {downHost.Host, mirrorHost.Host}},
+	}
+
+	ok, okErr := httpLoader.Load(primary.URL+"/ok.png", context.Background())
+	failed, failedErr := httpLoader.Load(primary.URL+"/img.png?v=1", context.Background())
+	_, missingErr := httpLoader.Load(primary.URL+"/missing.png", context.Background())
+	_, brokenErr := httpLoader.Load(primary.URL+"/broken.png", context.Background())
+
+	test.Error(t,
+		test.Nil(okErr, "error of the primary"),
+		test.Equal("primary", string(ok.Data), "image of the primary"),
+		test.Nil(failedErr, "error of the mirror"),
+		test.Equal("mirror", string(failed.Data), "image of the mirror"),
+		test.Equal(primary.URL+"/img.png?v=1", failed.Id, "id of the image from the mirror"),
+		test.Equal(true, errors.Is(missingErr, img.ErrOriginNotFound), "not found on the primary"),
+		test.Equal(http.StatusBadGateway, httpCode(brokenErr), "error of the primary"),
+		test.Equal("/img.png?v=1,/broken.png", strings.Join(mirrorPaths, ","), "requests to the mirror"),
+		test.Equal(4, len(primaryPaths), "requests to the primary"),
+	)
+}
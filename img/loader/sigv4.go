@@ -0,0 +1,188 @@
+package loader
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RequestSigner signs requests to origins, so private origins don't need to be public, e.g. SigV4.
+// Other schemes, e.g. HMAC headers of the origin, could be implemented by embedders.
+type RequestSigner interface {
+	Sign(req *http.Request) error
+}
+
+// emptyPayloadHash is SHA-256 of the empty body of GET requests.
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// SigV4 signs requests to AWS endpoints, e.g. private S3 buckets or CloudFront origins
+// behind API Gateway, with AWS Signature Version 4.
+type SigV4 struct {
+	AccessKey string
+	SecretKey string
+	// SessionToken is the token of temporary credentials. Not sent if empty.
+	SessionToken string
+	// Region of the endpoint, e.g. us-east-1.
+	Region string
+	// Service is the name of the service of the endpoint, e.g. s3.
+	Service string
+	// Hosts are hosts of origins that are signed, so credentials are not leaked to other origins.
+	// Requests are not signed if empty.
+	Hosts []string
+}
+
+// NewSigV4Signer creates the signer of requests to the hosts. Source URLs are chosen by clients,
+// so hosts are required to not send credentials to any origin.
+func NewSigV4Signer(accessKey string, secretKey string, sessionToken string, region string, service string, hosts []string) (*SigV4, error) {
+	if len(accessKey) == 0 || len(secretKey) == 0 || len(region) == 0 || len(service) == 0 {
+		return nil, fmt.Errorf("access key, secret key, region and service of SigV4 are required")
+	}
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("hosts of SigV4 are required")
+	}
+	return &SigV4{
+		AccessKey:    accessKey,
+		SecretKey:    secretKey,
+		SessionToken: sessionToken,
+		Region:       region,
+		Service:      service,
+		Hosts:        hosts,
+	}, nil
+}
+
+// Sign adds Authorization and X-Amz-* headers to the request.
+func (s *SigV4) Sign(req *http.Request) error {
+	return s.SignAt(req, time.Now())
+}
+
+// SignAt signs the request as if it's sent at the given time. Requests to hosts other than Hosts
+// are not signed.
+func (s *SigV4) SignAt(req *http.Request, t time.Time) error {
+	if !containsHost(s.Hosts, req.URL.Host) {
+		return nil
+	}
+	if len(s.AccessKey) == 0 || len(s.SecretKey) == 0 || len(s.Region) == 0 || len(s.Service) == 0 {
+		return fmt.Errorf("access key, secret key, region and service of SigV4 are required")
+	}
+
+	amzDate := t.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	if len(s.SessionToken) > 0 {
+		req.Header.Set("X-Amz-Security-Token", s.SessionToken)
+	}
+	if s.Service == "s3" {
+		req.Header.Set("X-Amz-Content-Sha256", emptyPayloadHash)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if name == "x-amz-date" || name == "x-amz-security-token" || name == "x-amz-content-sha256" {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s.canonicalPath(req.URL.Path),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		emptyPayloadHash,
+	}, "\n")
+	scope := strings.Join([]string{date, s.Region, s.Service, "aws4_request"}, "/")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hex.EncodeToString(requestHash[:])}, "\n")
+
+	key := []byte("AWS4" + s.SecretKey)
+	for _, part := range []string{date, s.Region, s.Service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, scope, signedHeaders, signature))
+	return nil
+}
+
+// canonicalPath returns URI encoded path. Segments are encoded twice for services other than S3.
+func (s *SigV4) canonicalPath(path string) string {
+	if len(path) == 0 {
+		return "/"
+	}
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = awsEscape(segment)
+		if s.Service != "s3" {
+			segments[i] = awsEscape(segments[i])
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// canonicalQuery returns URI encoded query params sorted by name and value.
+func canonicalQuery(query map[string][]string) string {
+	params := make([][2]string, 0, len(query))
+	for name, values := range query {
+		for _, value := range values {
+			params = append(params, [2]string{awsEscape(name), awsEscape(value)})
+		}
+	}
+	sort.Slice(params, func(i, j int) bool {
+		if params[i][0] != params[j][0] {
+			return params[i][0] < params[j][0]
+		}
+		return params[i][1] < params[j][1]
+	})
+	encoded := make([]string, len(params))
+	for i, p := range params {
+		encoded[i] = p[0] + "=" + p[1]
+	}
+	return strings.Join(encoded, "&")
+}
+
+// awsEscape percent-encodes all characters except unreserved ones as required by SigV4.
+func awsEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '.' || c == '_' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func containsHost(hosts []string, host string) bool {
+	for _, h := range hosts {
+		if strings.EqualFold(h, host) {
+			return true
+		}
+	}
+	return false
+}
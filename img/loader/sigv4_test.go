@@ -0,0 +1,87 @@
+package loader_test
+
+import (
+	"context"
+	"github.com/Pixboost/transformimgs/v8/img/loader"
+	"github.com/dooman87/kolibri/test"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSigV4_SignAt(t *testing.T) {
+	// get-vanilla case of the AWS SigV4 test suite
+	signer := &loader.SigV4{
+		AccessKey: "AKIDEXAMPLE",
+		SecretKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+		Region:    "us-east-1",
+		Service:   "service",
+		Hosts:     []string{"example.amazonaws.com"},
+	}
+	req, _ := http.NewRequest("GET", "https://example.amazonaws.com/", nil)
+	err := signer.SignAt(req, time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+
+	other, _ := http.NewRequest("GET", "https://other.com/", nil)
+	hostErr := signer.SignAt(other, time.Now())
+	noHosts, _ := http.NewRequest("GET", "https://example.amazonaws.com/", nil)
+	noHostsErr := (&loader.SigV4{AccessKey: "AKIDEXAMPLE", SecretKey: "secret", Region: "us-east-1", Service: "s3"}).SignAt(noHosts, time.Now())
+
+	test.Error(t,
+		test.Nil(err, "error"),
+		test.Equal("AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, "+
+			"SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+			req.Header.Get("Authorization"), "Authorization header"),
+		test.Equal("20150830T123600Z", req.Header.Get("X-Amz-Date"), "X-Amz-Date header"),
+		test.Nil(hostErr, "error of other host"),
+		test.Equal("", other.Header.Get("Authorization"), "other host is not signed"),
+		test.Nil(noHostsErr, "error without hosts"),
+		test.Equal("", noHosts.Header.Get("Authorization"), "nothing is signed without hosts"),
+		test.Equal("", noHosts.Header.Get("X-Amz-Security-Token"), "no session token without hosts"),
+	)
+}
+
+func TestNewSigV4Signer(t *testing.T) {
+	signer, err := loader.NewSigV4Signer("AKIDEXAMPLE", "secret", "", "us-east-1", "s3", []string{"bucket.s3.amazonaws.com"})
+	_, noHostsErr := loader.NewSigV4Signer("AKIDEXAMPLE", "secret", "", "us-east-1", "s3", nil)
+	_, noKeysErr := loader.NewSigV4Signer("", "", "", "us-east-1", "s3", []string{"bucket.s3.amazonaws.com"})
+
+	test.Error(t,
+		test.Nil(err, "error"),
+		test.Equal("bucket.s3.amazonaws.com", signer.Hosts[0], "hosts"),
+		test.Equal(true, noHostsErr != nil, "error without hosts"),
+		test.Equal(true, noKeysErr != nil, "error without credentials"),
+	)
+}
+
+func TestHttp_LoadSigned(t *testing.T) {
+	var auth, contentHash, token string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth, contentHash, token = r.Header.Get("Authorization"), r.Header.Get("X-Amz-Content-Sha256"), r.Header.Get("X-Amz-Security-Token")
+		w.Write([]byte("123"))
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	httpLoader := &loader.Http{Signer: &loader.SigV4{
+		AccessKey:    "AKIDEXAMPLE",
+		SecretKey:    "secret",
+		SessionToken: "token",
+		Region:       "ap-southeast-2",
+		Service:      "s3",
+		Hosts:        []string{host},
+	}}
+	image, err := httpLoader.Load(server.URL+"/bucket/img%20name.png?v=1", context.Background())
+	_, invalidErr := (&loader.Http{Signer: &loader.SigV4{Hosts: []string{host}}}).Load(server.URL, context.Background())
+
+	test.Error(t,
+		test.Nil(err, "error"),
+		test.Equal("123", string(image.Data), "resulted image"),
+		test.Equal(true, strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/"), "Authorization header"),
+		test.Equal(true, strings.Contains(auth, "/ap-southeast-2/s3/aws4_request, SignedHeaders=host;x-amz-content-sha256;x-amz-date;x-amz-security-token, "), "signed headers"),
+		test.Equal("e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", contentHash, "X-Amz-Content-Sha256 header"),
+		test.Equal("token", token, "X-Amz-Security-Token header"),
+		test.Equal(http.StatusBadGateway, httpCode(invalidErr), "signer without credentials"),
+	)
+}
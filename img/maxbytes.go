@@ -0,0 +1,61 @@
+package img
+
+import (
+	"fmt"
+	"github.com/dooman87/glogi"
+	"net/http"
+	"strconv"
+)
+
+// MaxBytesScaleStep is the ratio by which the size of the image is reduced on each attempt
+// to fit the image into max-bytes after the quality is lowered to LOWER.
+var MaxBytesScaleStep = 0.75
+
+// MaxBytesMinScale is the smallest scale of the image when it's fitted into max-bytes.
+// ErrTooLarge is returned if the image doesn't fit at this scale.
+var MaxBytesMinScale = 0.1
+
+// getMaxBytes returns the limit of the response size from max-bytes query param or
+// the default limit of the service. Zero means no limit.
+func (r *Service) getMaxBytes(req *http.Request) (int, error) {
+	param, _ := getQueryParam(req.URL, "max-bytes")
+	if len(param) == 0 {
+		return r.config().MaxBytes, nil
+	}
+	maxBytes, err := strconv.Atoi(param)
+	if err != nil || maxBytes <= 0 {
+		return 0, NewHttpError(http.StatusBadRequest, "max-bytes query param must be a positive number")
+	}
+	return maxBytes, nil
+}
+
+// fitToBytes returns the transformation that repeats the given one lowering quality and
+// then the size of the image until the result is not bigger than maxBytes.
+func fitToBytes(transformation Cmd, maxBytes int, log glogi.Logger) Cmd {
+	return func(config *TransformationConfig) (*Image, error) {
+		result, err := transformation(config)
+		for err == nil && len(result.Data) > maxBytes {
+			if config.Quality < LOWER {
+				config.Quality++
+			} else {
+				scale := config.Scale
+				if scale <= 0 {
+					scale = 1
+				}
+				scale = scale * MaxBytesScaleStep
+				if scale < MaxBytesMinScale {
+					size := len(result.Data)
+					result.Release()
+					return nil, fmt.Errorf("%w, could not fit [%d] bytes into max-bytes [%d]", ErrTooLarge, size, maxBytes)
+				}
+				config.Scale = scale
+			}
+
+			log.Printf("[%s] Result of [%d] bytes is more than max-bytes [%d], trying quality [%d] and scale [%g]\n",
+				config.Src.Id, len(result.Data), maxBytes, config.Quality, config.Scale)
+			result.Release()
+			result, err = transformation(config)
+		}
+		return result, err
+	}
+}
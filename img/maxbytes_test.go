@@ -0,0 +1,88 @@
+package img_test
+
+import (
+	"github.com/Pixboost/transformimgs/v8/img"
+	"github.com/dooman87/kolibri/test"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestService_MaxBytes(t *testing.T) {
+	test.Service = createService(t).GetRouter().ServeHTTP
+	test.T = t
+
+	testCases := []test.TestCase{
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise?max-bytes=3",
+			Description: "Image fits",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal(ImgPngOut, w.Body.String(), "Resulted image"),
+				)
+			},
+		},
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise?max-bytes=2",
+			Description: "Quality is lowered",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal(ImgLowQualityOut, w.Body.String(), "Resulted image"),
+				)
+			},
+		},
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/resize?size=300&max-bytes=1&dppx=2",
+			Description: "High density image",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal(ImgLowerQualityOut, w.Body.String(), "Resulted image"),
+				)
+			},
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise?max-bytes=1",
+			Description:  "Image doesn't fit",
+			ExpectedCode: http.StatusRequestEntityTooLarge,
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise?max-bytes=0",
+			Description:  "Invalid max-bytes",
+			ExpectedCode: http.StatusBadRequest,
+		},
+	}
+
+	test.RunRequests(testCases)
+}
+
+func TestService_DefaultMaxBytes(t *testing.T) {
+	s, err := img.NewServiceWithConfig(&loaderMock{}, &resizerMock{}, 1, &img.ServiceConfig{MaxBytes: 2})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	test.Service = s.GetRouter().ServeHTTP
+	test.T = t
+
+	testCases := []test.TestCase{
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise",
+			Description: "Default limit",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal(ImgLowQualityOut, w.Body.String(), "Resulted image"),
+				)
+			},
+		},
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise?max-bytes=3",
+			Description: "Query param overrides the default limit",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal(ImgPngOut, w.Body.String(), "Resulted image"),
+				)
+			},
+		},
+	}
+
+	test.RunRequests(testCases)
+}
@@ -0,0 +1,56 @@
+package img
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// limitSize returns the size of resize, fit and upscale operations limited by ServiceConfig.MaxWidth
+// and ServiceConfig.MaxHeight. Bigger sizes are scaled down preserving the aspect ratio or rejected
+// with 400 if ServiceConfig.RejectOversized is set. Sizes from Width client hint are always scaled down,
+// because they are not controlled by the page.
+func (r *Service) limitSize(size string, clientHint bool) (string, error) {
+	config := r.config()
+	if config.MaxWidth <= 0 && config.MaxHeight <= 0 {
+		return size, nil
+	}
+
+	dimensions := strings.Split(size, "x")
+	limits := []int{config.MaxWidth, config.MaxHeight}
+	names := []string{"width", "height"}
+	ratio := 1.0
+	var exceeded string
+	for i, d := range dimensions {
+		if len(d) == 0 || i >= len(limits) || limits[i] <= 0 {
+			continue
+		}
+		pixels, err := strconv.Atoi(d)
+		if err != nil {
+			return "", NewHttpError(http.StatusBadRequest, fmt.Sprintf("invalid size [%s]", size))
+		}
+		if pixels > limits[i] {
+			ratio = math.Min(ratio, float64(limits[i])/float64(pixels))
+			if len(exceeded) == 0 {
+				exceeded = fmt.Sprintf("%s must not be more than %d", names[i], limits[i])
+			}
+		}
+	}
+	if ratio == 1 {
+		return size, nil
+	}
+	if config.RejectOversized && !clientHint {
+		return "", NewHttpError(http.StatusBadRequest, exceeded)
+	}
+
+	for i, d := range dimensions {
+		if len(d) == 0 {
+			continue
+		}
+		pixels, _ := strconv.Atoi(d)
+		dimensions[i] = strconv.Itoa(int(math.Max(1, math.Round(float64(pixels)*ratio))))
+	}
+	return strings.Join(dimensions, "x"), nil
+}
@@ -0,0 +1,61 @@
+package img_test
+
+import (
+	"github.com/Pixboost/transformimgs/v8/img"
+	"github.com/dooman87/kolibri/test"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestService_MaxSize(t *testing.T) {
+	s, err := img.NewServiceWithConfig(&loaderMock{}, &resizerMock{}, 1, &img.ServiceConfig{MaxWidth: 300, MaxHeight: 200})
+	if err != nil {
+		t.Fatalf("could not create service: %s", err)
+	}
+	test.Service = s.GetRouter().ServeHTTP
+	test.T = t
+
+	test.RunRequests([]test.TestCase{
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/resize?size=300",
+			Description: "Size within the limit",
+		},
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/resize?size=3000",
+			Description: "Width is clamped",
+		},
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/fit?size=600x400",
+			Description: "Both dimensions are scaled down preserving the aspect ratio",
+		},
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/fit?size=300x200",
+			Description: "Size equal to the limit",
+		},
+	})
+
+	s.Config.RejectOversized = true
+	widthHint := httptest.NewRequest("GET", "http://localhost/img/http%3A%2F%2Fsite.com/img.png/resize", nil)
+	widthHint.Header.Set("Width", "600")
+	test.RunRequests([]test.TestCase{
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/resize?size=3000",
+			Description:  "Width is rejected",
+			ExpectedCode: http.StatusBadRequest,
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/fit?size=300x201",
+			Description:  "Height is rejected",
+			ExpectedCode: http.StatusBadRequest,
+		},
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/resize?size=300",
+			Description: "Size within the limit is not rejected",
+		},
+		{
+			Request:     widthHint,
+			Description: "Width client hint is clamped",
+		},
+	})
+}
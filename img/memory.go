@@ -0,0 +1,247 @@
+package img
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// BytesPerPixel is the estimated number of bytes that processor
+// uses to keep one decoded pixel in memory. ImageMagick Q16 uses
+// 2 bytes per channel and up to 4 channels.
+var BytesPerPixel int64 = 8
+
+// UnknownFormatRatio is used to estimate decoded memory of images which dimensions
+// can't be read from the header. Estimated memory is the size of the image multiplied by the ratio.
+var UnknownFormatRatio int64 = 10
+
+// FormatRatios overrides UnknownFormatRatio for formats with high compression ratio
+// when dimensions can't be read from the header. The key is MIME type of the image.
+var FormatRatios = map[string]int64{
+	"image/avif": 200,
+	"image/heic": 200,
+	"image/jxl":  200,
+	"image/webp": 100,
+}
+
+// EstimateMemory returns estimated number of bytes required to keep decoded image in memory.
+// Dimensions are taken from the image if known, otherwise read from GIF, JPEG, PNG, WebP, AVIF
+// and HEIC headers. Otherwise, the size of the image is multiplied by the ratio of its format.
+func EstimateMemory(image *Image) int64 {
+	if image == nil {
+		return 0
+	}
+
+	width, height := image.Width, image.Height
+	if width <= 0 || height <= 0 {
+		width, height = decodeSize(image.Data)
+	}
+	if width <= 0 || height <= 0 {
+		mimeType := DetectMimeType(image.Data)
+		if len(mimeType) == 0 {
+			mimeType = image.MimeType
+		}
+		ratio, ok := FormatRatios[mimeType]
+		if !ok {
+			ratio = UnknownFormatRatio
+		}
+		return int64(len(image.Data)) * ratio
+	}
+
+	return int64(width) * int64(height) * BytesPerPixel
+}
+
+// decodeSize returns dimensions of the image from its header or zeros if they can't be read.
+func decodeSize(data []byte) (int, int) {
+	if imgConfig, _, err := decodeConfig(data); err == nil {
+		return imgConfig.Width, imgConfig.Height
+	}
+	switch DetectMimeType(data) {
+	case "image/webp":
+		return webpSize(data)
+	case "image/avif", "image/heic":
+		return heifSize(data)
+	}
+	return 0, 0
+}
+
+// webpSize reads canvas size from VP8X chunk or frame size from VP8 and VP8L chunks.
+func webpSize(data []byte) (int, int) {
+	if len(data) < 30 {
+		return 0, 0
+	}
+	switch string(data[12:16]) {
+	case "VP8X":
+		return 1 + int(uint24(data[24:27])), 1 + int(uint24(data[27:30]))
+	case "VP8 ":
+		if !bytes.Equal(data[23:26], []byte{0x9D, 0x01, 0x2A}) {
+			return 0, 0
+		}
+		return int(binary.LittleEndian.Uint16(data[26:28]) & 0x3FFF), int(binary.LittleEndian.Uint16(data[28:30]) & 0x3FFF)
+	case "VP8L":
+		if data[20] != 0x2F {
+			return 0, 0
+		}
+		bits := binary.LittleEndian.Uint32(data[21:25])
+		return 1 + int(bits&0x3FFF), 1 + int((bits>>14)&0x3FFF)
+	}
+	return 0, 0
+}
+
+func uint24(b []byte) uint32 {
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+}
+
+// heifSize returns the largest size from image spatial extents (ispe) properties
+// in meta/iprp/ipco boxes. Grid images have extents of tiles as well as of the whole image.
+func heifSize(data []byte) (int, int) {
+	meta := findBox(data, "meta")
+	// meta is a full box with version and flags
+	if len(meta) < 4 {
+		return 0, 0
+	}
+	ipco := findBox(findBox(meta[4:], "iprp"), "ipco")
+
+	var width, height int
+	for boxType, content, rest, ok := nextBox(ipco); ok; boxType, content, rest, ok = nextBox(rest) {
+		if boxType != "ispe" || len(content) < 12 {
+			continue
+		}
+		// ispe is a full box, version and flags are followed by width and height
+		w, h := int(binary.BigEndian.Uint32(content[4:8])), int(binary.BigEndian.Uint32(content[8:12]))
+		if int64(w)*int64(h) > int64(width)*int64(height) {
+			width, height = w, h
+		}
+	}
+	return width, height
+}
+
+// findBox returns the content of the first ISOBMFF box of the type or nil if there is no such box.
+func findBox(data []byte, boxType string) []byte {
+	for t, content, rest, ok := nextBox(data); ok; t, content, rest, ok = nextBox(rest) {
+		if t == boxType {
+			return content
+		}
+	}
+	return nil
+}
+
+// nextBox splits data into the type and the content of the first ISOBMFF box and the rest of the data.
+func nextBox(data []byte) (boxType string, content []byte, rest []byte, ok bool) {
+	if len(data) < 8 {
+		return "", nil, nil, false
+	}
+	size, header := uint64(binary.BigEndian.Uint32(data[:4])), uint64(8)
+	switch size {
+	case 0:
+		size = uint64(len(data))
+	case 1:
+		if len(data) < 16 {
+			return "", nil, nil, false
+		}
+		size, header = binary.BigEndian.Uint64(data[8:16]), 16
+	}
+	if size < header || size > uint64(len(data)) {
+		return "", nil, nil, false
+	}
+	return string(data[4:8]), data[header:size], data[size:], true
+}
+
+func decodeConfig(data []byte) (imgConfig image.Config, format string, err error) {
+	// Some decoders panic on malformed headers
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("could not decode image config: %v", r)
+		}
+	}()
+	return image.DecodeConfig(bytes.NewReader(data))
+}
+
+// MemoryBudget limits estimated memory of images that are transformed at the same time.
+// New jobs are waiting for the memory to be released by in-flight jobs up to MaxWait
+// and rejected with 503 after that.
+type MemoryBudget struct {
+	// MaxWait is the maximum time to wait for the memory to be available.
+	// Zero means that jobs are rejected straight away when budget is exhausted.
+	MaxWait time.Duration
+
+	limit   int64
+	used    int64
+	mux     sync.Mutex
+	changed chan struct{}
+}
+
+// NewMemoryBudget creates a new budget with the limit in bytes.
+func NewMemoryBudget(limit int64, maxWait time.Duration) (*MemoryBudget, error) {
+	if limit <= 0 {
+		return nil, fmt.Errorf("memory budget must be positive, but got [%d]", limit)
+	}
+
+	return &MemoryBudget{
+		MaxWait: maxWait,
+		limit:   limit,
+		changed: make(chan struct{}),
+	}, nil
+}
+
+// Acquire reserves n bytes from the budget, waiting for in-flight jobs if required.
+// Reserved memory must be returned using Release.
+func (b *MemoryBudget) Acquire(ctx context.Context, n int64) error {
+	if n > b.limit {
+		return fmt.Errorf("%w, estimated memory [%d] is more than budget [%d]", ErrTooLarge, n, b.limit)
+	}
+
+	var timeout <-chan time.Time
+	if b.MaxWait > 0 {
+		timer := time.NewTimer(b.MaxWait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for {
+		b.mux.Lock()
+		if b.used+n <= b.limit {
+			b.used += n
+			b.mux.Unlock()
+			return nil
+		}
+		changed := b.changed
+		b.mux.Unlock()
+
+		if timeout == nil {
+			return NewHttpError(http.StatusServiceUnavailable, "memory budget is exhausted, try again later")
+		}
+
+		select {
+		case <-changed:
+		case <-timeout:
+			return NewHttpError(http.StatusServiceUnavailable, "memory budget is exhausted, try again later")
+		case <-ctx.Done():
+			return NewHttpError(http.StatusServiceUnavailable, "request was canceled while waiting for memory budget")
+		}
+	}
+}
+
+// Release returns n bytes to the budget.
+func (b *MemoryBudget) Release(n int64) {
+	b.mux.Lock()
+	b.used -= n
+	close(b.changed)
+	b.changed = make(chan struct{})
+	b.mux.Unlock()
+}
+
+// Used returns the number of bytes currently reserved.
+func (b *MemoryBudget) Used() int64 {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.used
+}
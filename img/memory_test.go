@@ -0,0 +1,132 @@
+package img_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"github.com/Pixboost/transformimgs/v8/img"
+	"github.com/dooman87/kolibri/test"
+	"image"
+	"image/png"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestEstimateMemory(t *testing.T) {
+	var buf bytes.Buffer
+	err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 30, 20)))
+	if err != nil {
+		t.Fatalf("could not encode png: %s", err)
+	}
+
+	test.Error(t,
+		test.Equal(int64(30*20)*img.BytesPerPixel, img.EstimateMemory(&img.Image{Data: buf.Bytes()}), "png"),
+		test.Equal(int64(3)*img.UnknownFormatRatio, img.EstimateMemory(&img.Image{Data: []byte("abc")}), "unknown format"),
+		test.Equal(int64(40*50)*img.BytesPerPixel, img.EstimateMemory(&img.Image{Data: []byte("abc"), Width: 40, Height: 50}), "known dimensions"),
+		test.Equal(int64(3)*img.FormatRatios["image/avif"], img.EstimateMemory(&img.Image{Data: []byte("abc"), MimeType: "image/avif"}), "source MIME type"),
+		test.Equal(int64(0), img.EstimateMemory(nil), "nil image"),
+	)
+}
+
+func TestEstimateMemory_Headers(t *testing.T) {
+	riff := func(chunk string, payload ...byte) []byte {
+		data := append([]byte("RIFF\x00\x00\x00\x00WEBP"+chunk+"\x00\x00\x00\x00"), payload...)
+		return append(data, make([]byte, 16)...)
+	}
+	box := func(boxType string, content ...byte) []byte {
+		size := make([]byte, 4)
+		binary.BigEndian.PutUint32(size, uint32(8+len(content)))
+		return append(append(size, boxType...), content...)
+	}
+	ispe := func(width, height uint32) []byte {
+		content := make([]byte, 12)
+		binary.BigEndian.PutUint32(content[4:8], width)
+		binary.BigEndian.PutUint32(content[8:12], height)
+		return box("ispe", content...)
+	}
+	ftyp := box("ftyp", []byte("avif\x00\x00\x00\x00mif1")...)
+	avif := append(ftyp, box("meta", append([]byte{0, 0, 0, 0},
+		box("iprp", box("ipco", append(ispe(100, 50), ispe(300, 200)...)...)...)...)...)...)
+	noExtents := append(ftyp, box("mdat", 1, 2, 3)...)
+	jxl := []byte{0xFF, 0x0A, 1, 2, 3}
+
+	testCases := []struct {
+		description string
+		data        []byte
+		expected    int64
+	}{
+		{"webp VP8X", riff("VP8X", 0, 0, 0, 0, 99, 0, 0, 49, 0, 0), 100 * 50 * img.BytesPerPixel},
+		{"webp VP8", riff("VP8 ", 0, 0, 0, 0x9D, 0x01, 0x2A, 100, 0, 50, 0), 100 * 50 * img.BytesPerPixel},
+		{"webp VP8L", riff("VP8L", 0x2F, 0x63, 0x40, 0x0C, 0), 100 * 50 * img.BytesPerPixel},
+		{"avif largest extents", avif, 300 * 200 * img.BytesPerPixel},
+		{"avif without extents", noExtents, int64(len(noExtents)) * img.FormatRatios["image/avif"]},
+		{"jxl", jxl, int64(len(jxl)) * img.FormatRatios["image/jxl"]},
+	}
+
+	for _, tc := range testCases {
+		test.Error(t,
+			test.Equal(tc.expected, img.EstimateMemory(&img.Image{Data: tc.data}), tc.description),
+		)
+	}
+}
+
+func TestNewMemoryBudget(t *testing.T) {
+	_, err := img.NewMemoryBudget(0, 0)
+
+	if err == nil || err.Error() != "memory budget must be positive, but got [0]" {
+		t.Errorf("expected error but got %s", err)
+	}
+}
+
+func TestMemoryBudget_Acquire(t *testing.T) {
+	budget, _ := img.NewMemoryBudget(100, 0)
+
+	test.Error(t,
+		test.Nil(budget.Acquire(context.Background(), 60), "first job"),
+		test.Equal(http.StatusServiceUnavailable, httpCode(budget.Acquire(context.Background(), 60)), "second job"),
+		test.Equal(http.StatusRequestEntityTooLarge, httpCode(budget.Acquire(context.Background(), 101)), "too large job"),
+		test.Equal(int64(60), budget.Used(), "used memory"),
+	)
+
+	budget.Release(60)
+
+	test.Error(t,
+		test.Equal(int64(0), budget.Used(), "used memory after release"),
+	)
+}
+
+func TestMemoryBudget_AcquireWait(t *testing.T) {
+	budget, _ := img.NewMemoryBudget(100, time.Second)
+
+	_ = budget.Acquire(context.Background(), 60)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		budget.Release(60)
+	}()
+
+	test.Error(t,
+		test.Nil(budget.Acquire(context.Background(), 60), "waiting job"),
+	)
+
+	budget.MaxWait = 10 * time.Millisecond
+	test.Error(t,
+		test.Equal(http.StatusServiceUnavailable, httpCode(budget.Acquire(context.Background(), 60)), "timed out job"),
+	)
+
+	budget.MaxWait = time.Second
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	test.Error(t,
+		test.Equal(http.StatusServiceUnavailable, httpCode(budget.Acquire(ctx, 60)), "canceled job"),
+	)
+}
+
+func httpCode(err error) int {
+	var httpErr *img.HttpError
+	if errors.As(err, &httpErr) {
+		return httpErr.Code()
+	}
+	return 0
+}
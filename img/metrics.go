@@ -0,0 +1,187 @@
+package img
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DurationBuckets are upper bounds in seconds of histogram buckets of durations.
+var DurationBuckets = []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// SizeBuckets are upper bounds in bytes of histogram buckets of image sizes.
+var SizeBuckets = []float64{1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20}
+
+// Metrics collects latency, sizes and errors of transformations for alerting on degradation:
+// transformation time and queue wait per operation, sizes of sources and results, output formats,
+// errors of loading sources and durations of processor commands, e.g. ImageMagick convert.
+// Metrics are available in Prometheus text format using ServeMetrics.
+type Metrics struct {
+	mu       sync.Mutex
+	families map[string]*metricFamily
+}
+
+type metricFamily struct {
+	help    string
+	buckets []float64
+	series  map[string]*series
+}
+
+// series is the counter or the histogram with the set of labels.
+type series struct {
+	labels string
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+const (
+	metricTransformDuration = "transformimgs_transform_duration_seconds"
+	metricQueueWait         = "transformimgs_queue_wait_seconds"
+	metricSourceBytes       = "transformimgs_source_bytes"
+	metricOutputBytes       = "transformimgs_output_bytes"
+	metricTransformErrors   = "transformimgs_transform_errors_total"
+	metricLoadErrors        = "transformimgs_load_errors_total"
+	metricCommandDuration   = "transformimgs_command_duration_seconds"
+	metricCommandErrors     = "transformimgs_command_errors_total"
+)
+
+// NewMetrics creates metrics without observations.
+func NewMetrics() *Metrics {
+	m := &Metrics{families: make(map[string]*metricFamily)}
+	m.family(metricTransformDuration, "Duration of transformations by operation.", DurationBuckets)
+	m.family(metricQueueWait, "Time waiting for a free processor by operation.", DurationBuckets)
+	m.family(metricSourceBytes, "Size of source images by operation.", SizeBuckets)
+	m.family(metricOutputBytes, "Size of transformed images by operation and output format.", SizeBuckets)
+	m.family(metricTransformErrors, "Number of failed transformations by operation and error category.", nil)
+	m.family(metricLoadErrors, "Number of source images that could not be loaded by status code and error category.", nil)
+	m.family(metricCommandDuration, "Duration of processor commands, e.g. ImageMagick convert.", DurationBuckets)
+	m.family(metricCommandErrors, "Number of failed processor commands.", nil)
+	return m
+}
+
+func (m *Metrics) family(name string, help string, buckets []float64) {
+	m.families[name] = &metricFamily{help: help, buckets: buckets, series: make(map[string]*series)}
+}
+
+// observe adds the value to the series of the family with the labels in name=value pairs.
+func (m *Metrics) observe(name string, value float64, labels ...string) {
+	var b strings.Builder
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		fmt.Fprintf(&b, "%s=%q", labels[i], labels[i+1])
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f := m.families[name]
+	s, ok := f.series[b.String()]
+	if !ok {
+		s = &series{labels: b.String(), counts: make([]uint64, len(f.buckets))}
+		f.series[s.labels] = s
+	}
+	for i, bound := range f.buckets {
+		if value <= bound {
+			s.counts[i]++
+		}
+	}
+	s.sum += value
+	s.count++
+}
+
+// ObserveCommand records the duration and the error of the processor command, e.g. "convert".
+func (m *Metrics) ObserveCommand(command string, duration time.Duration, err error) {
+	m.observe(metricCommandDuration, duration.Seconds(), "command", command)
+	if err != nil {
+		m.observe(metricCommandErrors, 1, "command", command)
+	}
+}
+
+// observeOp records timings and sizes of the finished command. Commands without operation,
+// e.g. asis, are not recorded.
+func (m *Metrics) observeOp(op *Command) {
+	if len(op.Op) == 0 {
+		return
+	}
+	if op.Err != nil {
+		m.observe(metricTransformErrors, 1, "op", op.Op, "category", ErrorCategory(op.Err))
+		return
+	}
+	m.observe(metricTransformDuration, op.FinishedAt.Sub(op.StartedAt).Seconds(), "op", op.Op)
+	m.observe(metricQueueWait, op.StartedAt.Sub(op.QueuedAt).Seconds(), "op", op.Op)
+	m.observe(metricSourceBytes, float64(len(op.Config.Src.Data)), "op", op.Op)
+	if op.Result != nil {
+		m.observe(metricOutputBytes, float64(len(op.Result.Data)), "op", op.Op, "format", resultFormat(op))
+	}
+}
+
+// observeLoadError records the error of loading the source image.
+func (m *Metrics) observeLoadError(err error) {
+	code := http.StatusInternalServerError
+	var httpErr *HttpError
+	if errors.As(err, &httpErr) {
+		code = httpErr.Code()
+	}
+	m.observe(metricLoadErrors, 1, "code", strconv.Itoa(code), "category", ErrorCategory(err))
+}
+
+// ServeMetrics writes histograms and counters in Prometheus text format. Metrics are
+// formatted under the lock and written after it's released, so slow clients don't block
+// requests that record metrics.
+func (m *Metrics) ServeMetrics(resp http.ResponseWriter, _ *http.Request) {
+	out := m.format()
+
+	resp.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	resp.Header().Set("Cache-Control", "no-store")
+	_, _ = resp.Write(out.Bytes())
+}
+
+// format returns the snapshot of metrics in Prometheus text format.
+func (m *Metrics) format() *bytes.Buffer {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	out := &bytes.Buffer{}
+	names := make([]string, 0, len(m.families))
+	for name := range m.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		f := m.families[name]
+		keys := make([]string, 0, len(f.series))
+		for key := range f.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		if f.buckets == nil {
+			_, _ = fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s counter\n", name, f.help, name)
+			for _, key := range keys {
+				_, _ = fmt.Fprintf(out, "%s{%s} %d\n", name, key, f.series[key].count)
+			}
+			continue
+		}
+
+		_, _ = fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s histogram\n", name, f.help, name)
+		for _, key := range keys {
+			s := f.series[key]
+			for i, bound := range f.buckets {
+				_, _ = fmt.Fprintf(out, "%s_bucket{%s,le=\"%s\"} %d\n", name, key, strconv.FormatFloat(bound, 'f', -1, 64), s.counts[i])
+			}
+			_, _ = fmt.Fprintf(out, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, key, s.count)
+			_, _ = fmt.Fprintf(out, "%s_sum{%s} %s\n", name, key, strconv.FormatFloat(s.sum, 'g', -1, 64))
+			_, _ = fmt.Fprintf(out, "%s_count{%s} %d\n", name, key, s.count)
+		}
+	}
+	return out
+}
@@ -0,0 +1,77 @@
+package img_test
+
+import (
+	"errors"
+	"github.com/Pixboost/transformimgs/v8/img"
+	"github.com/dooman87/kolibri/test"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics_ObserveCommand(t *testing.T) {
+	m := img.NewMetrics()
+	m.ObserveCommand("convert", 30*time.Millisecond, nil)
+	m.ObserveCommand("convert", 2*time.Second, errors.New("failed"))
+
+	w := httptest.NewRecorder()
+	m.ServeMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+
+	test.Error(t,
+		test.Equal(true, strings.Contains(body, `# HELP transformimgs_command_duration_seconds Duration of processor commands, e.g. ImageMagick convert.
+# TYPE transformimgs_command_duration_seconds histogram
+transformimgs_command_duration_seconds_bucket{command="convert",le="0.01"} 0
+transformimgs_command_duration_seconds_bucket{command="convert",le="0.025"} 0
+transformimgs_command_duration_seconds_bucket{command="convert",le="0.05"} 1
+transformimgs_command_duration_seconds_bucket{command="convert",le="0.1"} 1
+transformimgs_command_duration_seconds_bucket{command="convert",le="0.25"} 1
+transformimgs_command_duration_seconds_bucket{command="convert",le="0.5"} 1
+transformimgs_command_duration_seconds_bucket{command="convert",le="1"} 1
+transformimgs_command_duration_seconds_bucket{command="convert",le="2.5"} 2
+transformimgs_command_duration_seconds_bucket{command="convert",le="5"} 2
+transformimgs_command_duration_seconds_bucket{command="convert",le="10"} 2
+transformimgs_command_duration_seconds_bucket{command="convert",le="30"} 2
+transformimgs_command_duration_seconds_bucket{command="convert",le="+Inf"} 2
+transformimgs_command_duration_seconds_sum{command="convert"} 2.03
+transformimgs_command_duration_seconds_count{command="convert"} 2
+`), "command duration"),
+		test.Equal(true, strings.Contains(body, `
+transformimgs_command_errors_total{command="convert"} 1
+`), "command errors"),
+		test.Equal("text/plain; version=0.0.4", w.Header().Get("Content-Type"), "Content-Type header"),
+	)
+}
+
+func TestService_Metrics(t *testing.T) {
+	s := createService(t)
+	s.Metrics = img.NewMetrics()
+	test.Service = s.GetRouter().ServeHTTP
+	test.T = t
+
+	test.RunRequests([]test.TestCase{
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/resize?size=300",
+			Description: "Successful transformation",
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/missing.png/optimise",
+			Description:  "Source could not be loaded",
+			ExpectedCode: http.StatusInternalServerError,
+		},
+	})
+
+	w := httptest.NewRecorder()
+	s.Metrics.ServeMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+
+	test.Error(t,
+		test.Equal(true, strings.Contains(body, `transformimgs_transform_duration_seconds_count{op="resize"} 1`), "transform duration"),
+		test.Equal(true, strings.Contains(body, `transformimgs_queue_wait_seconds_count{op="resize"} 1`), "queue wait"),
+		test.Equal(true, strings.Contains(body, `transformimgs_source_bytes_count{op="resize"} 1`), "source size"),
+		test.Equal(true, strings.Contains(body, `transformimgs_output_bytes_count{op="resize",format="image/png"} 1`), "output size and format"),
+		test.Equal(true, strings.Contains(body, `transformimgs_load_errors_total{code="500",category="other"} 1`), "load errors"),
+	)
+}
@@ -0,0 +1,114 @@
+package img
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/dooman87/glogi"
+)
+
+// sniffLen is the number of bytes that are used to detect MIME type of text formats.
+const sniffLen = 1024
+
+var (
+	jpegSig = []byte{0xFF, 0xD8, 0xFF}
+	pngSig  = []byte{0x89, 'P', 'N', 'G', 0x0D, 0x0A, 0x1A, 0x0A}
+	jxlSig  = []byte{0xFF, 0x0A}
+	// jxlBoxSig is the signature of JPEG XL in ISOBMFF container
+	jxlBoxSig = []byte{0x00, 0x00, 0x00, 0x0C, 'J', 'X', 'L', ' ', 0x0D, 0x0A, 0x87, 0x0A}
+	tiffLESig = []byte{'I', 'I', 0x2A, 0x00}
+	tiffBESig = []byte{'M', 'M', 0x00, 0x2A}
+	icoSig    = []byte{0x00, 0x00, 0x01, 0x00}
+)
+
+// DetectMimeType returns MIME type of the image using magic numbers
+// or an empty string if data is not an image in a known format.
+func DetectMimeType(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, jpegSig):
+		return "image/jpeg"
+	case bytes.HasPrefix(data, pngSig):
+		return "image/png"
+	case bytes.HasPrefix(data, []byte("GIF87a")), bytes.HasPrefix(data, []byte("GIF89a")):
+		return "image/gif"
+	case len(data) >= 12 && bytes.Equal(data[:4], []byte("RIFF")) && bytes.Equal(data[8:12], []byte("WEBP")):
+		return "image/webp"
+	case bytes.HasPrefix(data, jxlSig), bytes.HasPrefix(data, jxlBoxSig):
+		return "image/jxl"
+	case bytes.HasPrefix(data, tiffLESig), bytes.HasPrefix(data, tiffBESig):
+		return "image/tiff"
+	case len(data) >= 26 && bytes.HasPrefix(data, []byte("BM")):
+		return "image/bmp"
+	case bytes.HasPrefix(data, icoSig):
+		return "image/x-icon"
+	}
+
+	if mimeType := detectHeif(data); len(mimeType) > 0 {
+		return mimeType
+	}
+
+	return detectSvg(data)
+}
+
+// detectHeif returns MIME type of AVIF and HEIC images using brands from ftyp box.
+func detectHeif(data []byte) string {
+	if len(data) < 16 || !bytes.Equal(data[4:8], []byte("ftyp")) {
+		return ""
+	}
+	boxSize := int(binary.BigEndian.Uint32(data[:4]))
+	if boxSize < 16 || boxSize > len(data) {
+		return ""
+	}
+
+	heic := false
+	// Major brand is followed by minor version and the list of compatible brands
+	brands := append([][]byte{data[8:12]}, splitBrands(data[16:boxSize])...)
+	for _, brand := range brands {
+		switch string(brand) {
+		case "avif", "avis":
+			return "image/avif"
+		case "heic", "heix", "heim", "heis", "hevc", "hevx":
+			heic = true
+		}
+	}
+	if heic {
+		return "image/heic"
+	}
+
+	return ""
+}
+
+func splitBrands(data []byte) [][]byte {
+	var brands [][]byte
+	for i := 0; i+4 <= len(data); i += 4 {
+		brands = append(brands, data[i:i+4])
+	}
+	return brands
+}
+
+func detectSvg(data []byte) string {
+	if len(data) > sniffLen {
+		data = data[:sniffLen]
+	}
+	data = bytes.TrimSpace(data)
+	if bytes.HasPrefix(data, []byte("<svg")) ||
+		(bytes.HasPrefix(data, []byte("<?xml")) && bytes.Contains(data, []byte("<svg"))) {
+		return "image/svg+xml"
+	}
+
+	return ""
+}
+
+// sniffMimeType sets MIME type of the image detected from its content.
+// Returns error with 415 code if the image is not in a known format.
+func sniffMimeType(image *Image, log glogi.Logger) error {
+	mimeType := DetectMimeType(image.Data)
+	if len(mimeType) == 0 {
+		return ErrUnsupportedFormat
+	}
+	if mimeType != image.MimeType {
+		log.Printf("[%s] Detected MIME type [%s], source MIME type is [%s]\n", image.Id, mimeType, image.MimeType)
+		image.MimeType = mimeType
+	}
+
+	return nil
+}
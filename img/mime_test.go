@@ -0,0 +1,28 @@
+package img_test
+
+import (
+	"github.com/Pixboost/transformimgs/v8/img"
+	"github.com/dooman87/kolibri/test"
+	"testing"
+)
+
+func TestDetectMimeType(t *testing.T) {
+	avif := []byte{0x00, 0x00, 0x00, 0x1C, 'f', 't', 'y', 'p', 'm', 'i', 'f', '1', 0x00, 0x00, 0x00, 0x00,
+		'm', 'i', 'f', '1', 'a', 'v', 'i', 'f', 'm', 'i', 'a', 'f'}
+	heic := []byte{0x00, 0x00, 0x00, 0x18, 'f', 't', 'y', 'p', 'h', 'e', 'i', 'c', 0x00, 0x00, 0x00, 0x00,
+		'm', 'i', 'f', '1', 'h', 'e', 'i', 'c'}
+
+	test.Error(t,
+		test.Equal("image/jpeg", img.DetectMimeType([]byte{0xFF, 0xD8, 0xFF, 0xE0}), "jpeg"),
+		test.Equal("image/png", img.DetectMimeType([]byte("\x89PNG\r\n\x1a\n....")), "png"),
+		test.Equal("image/gif", img.DetectMimeType([]byte("GIF89a....")), "gif"),
+		test.Equal("image/webp", img.DetectMimeType([]byte("RIFF\x00\x00\x00\x00WEBPVP8 ")), "webp"),
+		test.Equal("image/jxl", img.DetectMimeType([]byte{0xFF, 0x0A, 0x00}), "jxl"),
+		test.Equal("image/avif", img.DetectMimeType(avif), "avif"),
+		test.Equal("image/heic", img.DetectMimeType(heic), "heic"),
+		test.Equal("image/svg+xml", img.DetectMimeType([]byte("<?xml version=\"1.0\"?>\n<svg xmlns=\"http://www.w3.org/2000/svg\"></svg>")), "svg"),
+		test.Equal("", img.DetectMimeType([]byte("<!DOCTYPE html><html><body>Not Found</body></html>")), "html"),
+		test.Equal("", img.DetectMimeType([]byte{}), "empty"),
+		test.Equal("", img.DetectMimeType([]byte{0x00, 0x00, 0x00, 0xFF, 'f', 't', 'y', 'p', 'a', 'v', 'i', 'f', 0, 0, 0, 0}), "truncated ftyp box"),
+	)
+}
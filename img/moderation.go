@@ -0,0 +1,197 @@
+package img
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/dooman87/glogi"
+	"net/http"
+	"sync"
+)
+
+// Moderator checks images, e.g. using moderation API or local NSFW model.
+type Moderator interface {
+	// Moderate returns true if the image is flagged and must not be served.
+	// Data of the image must not be used after the method returns.
+	Moderate(ctx context.Context, image *Image) (bool, error)
+}
+
+// MaxModerationVerdicts is the number of verdicts about not flagged images that are remembered
+// by Moderation. Verdicts about flagged images are always remembered.
+var MaxModerationVerdicts = 10000
+
+// Moderation blocks or replaces images that are flagged by the moderator. Verdicts are
+// remembered by URL of the source image or by URL of the request when results are moderated,
+// so each image is moderated once.
+// Moderation is installed using hooks, e.g. service.Use(moderation.Hooks()).
+type Moderation struct {
+	Moderator Moderator
+	// Results is the flag to moderate transformed images instead of source images.
+	Results bool
+	// Async is the flag to moderate images in the background. The image is served with no-store Cache-Control
+	// while it's moderated, so CDN doesn't keep it, and following requests are blocked if it's flagged.
+	// Used when moderation is too slow for the request.
+	Async bool
+	// FailClosed is the flag to respond with 503 when the moderator fails. Images are served by default.
+	FailClosed bool
+	// Placeholder is the image that replaces flagged images. Flagged images are rejected with 451 if nil.
+	// Placeholder replaces sources before transformation, so it's resized as requested
+	// unless Results is set.
+	Placeholder *Image
+	// Log is the logger. Package Log is used if nil.
+	Log glogi.Logger
+
+	mu       sync.Mutex
+	flagged  map[string]bool
+	verdicts map[string]bool
+	pending  map[string]bool
+}
+
+// Hooks returns hooks that moderate source images or results.
+func (m *Moderation) Hooks() *Hooks {
+	if m.Results {
+		return &Hooks{
+			PostTransform: func(req *http.Request, _ http.ResponseWriter, config *TransformationConfig, result *Image) error {
+				return m.moderate(req, req.URL.String(), result)
+			},
+		}
+	}
+	return &Hooks{
+		PostLoad: func(req *http.Request, src *Image) error {
+			return m.moderate(req, src.Id, src)
+		},
+	}
+}
+
+// moderate checks the image with the id and replaces its data with the placeholder if it's flagged.
+func (m *Moderation) moderate(req *http.Request, id string, image *Image) error {
+	flagged, known := m.verdict(id)
+	if !known {
+		if m.Async {
+			m.moderateAsync(id, image)
+			image.NoStore = true
+			return nil
+		}
+
+		var err error
+		flagged, err = m.Moderator.Moderate(req.Context(), image)
+		if err != nil {
+			logOrDefault(m.Log).Errorf("[%s] Moderation failed: %s", id, err)
+			if m.FailClosed {
+				return NewHttpError(http.StatusServiceUnavailable, "image could not be moderated")
+			}
+			return nil
+		}
+		m.setVerdict(id, flagged)
+	}
+
+	if !flagged {
+		return nil
+	}
+	logOrDefault(m.Log).Printf("[%s] Image is flagged by moderation\n", id)
+	if m.Placeholder == nil {
+		return NewHttpError(http.StatusUnavailableForLegalReasons, "image is blocked by moderation")
+	}
+	image.Data = m.Placeholder.Data
+	image.MimeType = m.Placeholder.MimeType
+	image.Width = m.Placeholder.Width
+	image.Height = m.Placeholder.Height
+	return nil
+}
+
+// moderateAsync moderates the copy of the image in the background unless it's already moderated.
+func (m *Moderation) moderateAsync(id string, image *Image) {
+	m.mu.Lock()
+	if m.pending == nil {
+		m.pending = make(map[string]bool)
+	}
+	if m.pending[id] {
+		m.mu.Unlock()
+		return
+	}
+	m.pending[id] = true
+	m.mu.Unlock()
+
+	// Data goes back to the pool after the request
+	buf := GetBuffer()
+	buf.Write(image.Data)
+	imageCopy := NewPooledImage(id, buf, image.MimeType)
+	go func() {
+		defer imageCopy.Release()
+		flagged, err := m.Moderator.Moderate(context.Background(), imageCopy)
+
+		m.mu.Lock()
+		delete(m.pending, id)
+		m.mu.Unlock()
+		if err != nil {
+			logOrDefault(m.Log).Errorf("[%s] Moderation failed: %s", id, err)
+			return
+		}
+		m.setVerdict(id, flagged)
+	}()
+}
+
+func (m *Moderation) verdict(id string) (bool, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.flagged[id] {
+		return true, true
+	}
+	_, known := m.verdicts[id]
+	return false, known
+}
+
+func (m *Moderation) setVerdict(id string, flagged bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if flagged {
+		if m.flagged == nil {
+			m.flagged = make(map[string]bool)
+		}
+		m.flagged[id] = true
+		return
+	}
+	if m.verdicts == nil || len(m.verdicts) >= MaxModerationVerdicts {
+		m.verdicts = make(map[string]bool)
+	}
+	m.verdicts[id] = false
+}
+
+// HttpModerator sends images to the moderation API. The image is sent in the body of POST request
+// with its MIME type in Content-Type header. API must respond with JSON {"flagged": true|false}.
+type HttpModerator struct {
+	Url    string
+	Client *http.Client
+}
+
+func (h *HttpModerator) Moderate(ctx context.Context, image *Image) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.Url, bytes.NewReader(image.Data))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", image.MimeType)
+
+	client := h.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("moderation API responded with %d", resp.StatusCode)
+	}
+
+	var verdict struct {
+		Flagged bool `json:"flagged"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&verdict); err != nil {
+		return false, fmt.Errorf("invalid response of moderation API: %w", err)
+	}
+	return verdict.Flagged, nil
+}
@@ -0,0 +1,221 @@
+package img_test
+
+import (
+	"context"
+	"errors"
+	"github.com/Pixboost/transformimgs/v8/img"
+	"github.com/dooman87/kolibri/test"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// moderatorMock flags img2.png
+type moderatorMock struct {
+	err   error
+	mu    sync.Mutex
+	calls int
+}
+
+func (m *moderatorMock) Moderate(_ context.Context, image *img.Image) (bool, error) {
+	m.mu.Lock()
+	m.calls++
+	m.mu.Unlock()
+	if m.err != nil {
+		return false, m.err
+	}
+	return string(image.Data) == NoContentTypeImgSrc || string(image.Data) == NoContentTypeImgOut, nil
+}
+
+func (m *moderatorMock) Calls() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.calls
+}
+
+func TestModeration_Sources(t *testing.T) {
+	moderator := &moderatorMock{}
+	s := createService(t)
+	s.Use((&img.Moderation{Moderator: moderator}).Hooks())
+	test.Service = s.GetRouter().ServeHTTP
+	test.T = t
+
+	testCases := []test.TestCase{
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise",
+			Description: "Image is not flagged",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal(ImgPngOut, w.Body.String(), "Resulted image"),
+				)
+			},
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img2.png/optimise",
+			Description:  "Flagged image",
+			ExpectedCode: http.StatusUnavailableForLegalReasons,
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img2.png/asis",
+			Description:  "Verdict is remembered",
+			ExpectedCode: http.StatusUnavailableForLegalReasons,
+		},
+	}
+	test.RunRequests(testCases)
+
+	if moderator.Calls() != 2 {
+		t.Errorf("expected 2 calls of moderator, but got %d", moderator.Calls())
+	}
+}
+
+func TestModeration_Placeholder(t *testing.T) {
+	s := createService(t)
+	s.Use((&img.Moderation{
+		Moderator:   &moderatorMock{},
+		Placeholder: &img.Image{Data: []byte(ImgSrc), MimeType: "image/png"},
+	}).Hooks())
+	test.Service = s.GetRouter().ServeHTTP
+	test.T = t
+
+	testCases := []test.TestCase{
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img2.png/resize?size=300",
+			Description: "Placeholder is transformed",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal(ImgPngOut, w.Body.String(), "Resulted image"),
+				)
+			},
+		},
+	}
+	test.RunRequests(testCases)
+}
+
+func TestModeration_Results(t *testing.T) {
+	s := createService(t)
+	s.Use((&img.Moderation{
+		Moderator:   &moderatorMock{},
+		Results:     true,
+		Placeholder: &img.Image{Data: []byte("placeholder"), MimeType: "image/gif"},
+	}).Hooks())
+	test.Service = s.GetRouter().ServeHTTP
+	test.T = t
+
+	testCases := []test.TestCase{
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img2.png/optimise",
+			Description: "Result is replaced",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal("placeholder", w.Body.String(), "Resulted image"),
+					test.Equal("image/gif", w.Header().Get("Content-Type"), "Content-Type header"),
+				)
+			},
+		},
+	}
+	test.RunRequests(testCases)
+}
+
+func TestModeration_Async(t *testing.T) {
+	moderator := &moderatorMock{}
+	s := createService(t)
+	s.Use((&img.Moderation{Moderator: moderator, Async: true}).Hooks())
+	test.Service = s.GetRouter().ServeHTTP
+	test.T = t
+
+	test.RunRequests([]test.TestCase{
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img2.png/optimise",
+			Description: "Image is served while moderated",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal("no-store", w.Header().Get("Cache-Control"), "Cache-Control header"),
+				)
+			},
+		},
+	})
+
+	for i := 0; i < 100 && moderator.Calls() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i := 0; i < 100; i++ {
+		w := httptest.NewRecorder()
+		test.Service(w, httptest.NewRequest("GET", "http://localhost/img/http%3A%2F%2Fsite.com/img2.png/optimise", nil))
+		if w.Code == http.StatusUnavailableForLegalReasons {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("expected flagged image to be blocked")
+}
+
+func TestModeration_AsyncCacheControl(t *testing.T) {
+	for _, results := range []bool{false, true} {
+		moderator := &moderatorMock{}
+		s := createService(t)
+		s.Use((&img.Moderation{Moderator: moderator, Async: true, Results: results}).Hooks())
+
+		w := httptest.NewRecorder()
+		s.GetRouter().ServeHTTP(w, httptest.NewRequest("GET", "http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise", nil))
+		if cacheControl := w.Header().Get("Cache-Control"); cacheControl != "no-store" {
+			t.Errorf("results %t: expected no-store before the verdict, but got [%s]", results, cacheControl)
+		}
+
+		cached := false
+		for i := 0; i < 100 && !cached; i++ {
+			w = httptest.NewRecorder()
+			s.GetRouter().ServeHTTP(w, httptest.NewRequest("GET", "http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise", nil))
+			cached = strings.HasPrefix(w.Header().Get("Cache-Control"), "public")
+			time.Sleep(10 * time.Millisecond)
+		}
+		if !cached {
+			t.Errorf("results %t: expected public Cache-Control after the verdict", results)
+		}
+	}
+}
+
+func TestModeration_FailClosed(t *testing.T) {
+	s := createService(t)
+	s.Use((&img.Moderation{Moderator: &moderatorMock{err: errors.New("moderation_error")}, FailClosed: true}).Hooks())
+	test.Service = s.GetRouter().ServeHTTP
+	test.T = t
+
+	testCases := []test.TestCase{
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/asis",
+			Description:  "Moderation failed",
+			ExpectedCode: http.StatusServiceUnavailable,
+		},
+	}
+	test.RunRequests(testCases)
+}
+
+func TestHttpModerator(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		switch string(body) {
+		case "bad":
+			_, _ = resp.Write([]byte(`{"flagged": true}`))
+		case "good":
+			_, _ = resp.Write([]byte(`{"flagged": false}`))
+		default:
+			http.Error(resp, "error", http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+	moderator := &img.HttpModerator{Url: server.URL}
+
+	for data, expected := range map[string]bool{"bad": true, "good": false} {
+		flagged, err := moderator.Moderate(context.Background(), &img.Image{Data: []byte(data), MimeType: "image/png"})
+		if err != nil || flagged != expected {
+			t.Errorf("%s: expected %t, but got %t, %v", data, expected, flagged, err)
+		}
+	}
+	if _, err := moderator.Moderate(context.Background(), &img.Image{Data: []byte("error")}); err == nil {
+		t.Errorf("expected error")
+	}
+}
@@ -0,0 +1,227 @@
+package img
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// MaxMontageImages is the maximum number of source images in the montage. Zero disables the limit.
+//
+// Deprecated: use ServiceConfig.MaxMontageImages.
+var MaxMontageImages = 36
+
+// MontageConfig is the configuration of the montage passed to Montager
+// in TransformationConfig.Config.
+type MontageConfig struct {
+	// Images are tiled from left to right and from top to bottom.
+	Images []*Image
+	// Columns is the number of columns in the grid.
+	Columns int
+	// Gap is the space between cells in pixels.
+	Gap int
+	// CellWidth and CellHeight are the size of the cell in pixels. Images are resized
+	// to cover the cell and cropped to the cell size.
+	CellWidth  int
+	CellHeight int
+}
+
+// Size returns width and height of the montage in pixels.
+func (c *MontageConfig) Size() (int, int) {
+	return c.gridSize(len(c.Images))
+}
+
+func (c *MontageConfig) gridSize(count int) (int, int) {
+	if c.Columns <= 0 || count == 0 {
+		return 0, 0
+	}
+	columns := c.Columns
+	if count < columns {
+		columns = count
+	}
+	rows := (count + c.Columns - 1) / c.Columns
+	return columns*(c.CellWidth+c.Gap) - c.Gap, rows*(c.CellHeight+c.Gap) - c.Gap
+}
+
+// Montager is implemented by processors that could tile multiple images into a grid.
+type Montager interface {
+	// Montage tiles images from MontageConfig passed in input.Config into a single image.
+	Montage(input *TransformationConfig) (*Image, error)
+}
+
+// montage tiles images using the processor or returns 501 error if processor is not a Montager.
+func montage(p Processor, config *TransformationConfig) (*Image, error) {
+	montager, ok := p.(Montager)
+	if !ok {
+		return nil, NewHttpError(http.StatusNotImplemented, "processor doesn't support montage")
+	}
+	return montager.Montage(config)
+}
+
+// MontageUrl tiles source images from src query params into a grid. Size of cells is
+// defined by size param in the format WxH, number of columns by cols param and
+// space between cells in pixels by gap param.
+func (r *Service) MontageUrl(resp http.ResponseWriter, req *http.Request) {
+	if _, ok := r.Processor.(Montager); !ok {
+		http.Error(resp, "processor doesn't support montage", http.StatusNotImplemented)
+		return
+	}
+
+	config, err := r.getMontageConfig(req)
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	mergeHeader(resp.Header(), "Vary", r.formatsVary())
+
+	sources := req.URL.Query()["src"]
+	r.log().Printf("[%s]: Creating montage of %d images\n", req.URL.String(), len(sources))
+
+	config.Images, err = r.loadAll(req, sources)
+	if err != nil {
+		r.sendError(resp, err)
+		return
+	}
+	defer func() {
+		for _, image := range config.Images {
+			image.Release()
+		}
+	}()
+
+	release, err := r.acquireAll(req, config.Images)
+	if err != nil {
+		r.sendError(resp, err)
+		return
+	}
+	defer release()
+
+	r.execOp(&Command{
+		Transformation: func(input *TransformationConfig) (*Image, error) {
+			return montage(r.Processor, input)
+		},
+		Config: &TransformationConfig{
+			Src: &Image{
+				Id:      fmt.Sprintf("montage of %d images", len(sources)),
+				NoStore: anyNoStore(config.Images),
+			},
+			SupportedFormats: r.supportedFormats(req),
+			Quality:          DEFAULT,
+			Config:           config,
+		},
+		Req:  req,
+		Resp: resp,
+	})
+}
+
+// getMontageConfig returns the configuration from the query params without loading images.
+func (r *Service) getMontageConfig(req *http.Request) (*MontageConfig, error) {
+	serviceConfig := r.config()
+	sources := req.URL.Query()["src"]
+	if len(sources) == 0 {
+		return nil, errors.New("src param is required")
+	}
+	if serviceConfig.MaxMontageImages > 0 && len(sources) > serviceConfig.MaxMontageImages {
+		return nil, fmt.Errorf("montage must not have more than %d images", serviceConfig.MaxMontageImages)
+	}
+
+	size, _ := getQueryParam(req.URL, "size")
+	if len(size) == 0 {
+		return nil, errors.New("size param is required")
+	}
+	if err := r.validateSize(size, true); err != nil {
+		return nil, err
+	}
+	dimensions := strings.Split(size, "x")
+	config := &MontageConfig{
+		Columns: int(math.Ceil(math.Sqrt(float64(len(sources))))),
+	}
+	config.CellWidth, _ = strconv.Atoi(dimensions[0])
+	config.CellHeight, _ = strconv.Atoi(dimensions[1])
+
+	if cols, _ := getQueryParam(req.URL, "cols"); len(cols) > 0 {
+		columns, err := strconv.Atoi(cols)
+		if err != nil || columns <= 0 {
+			return nil, errors.New("cols param must be a positive number")
+		}
+		config.Columns = columns
+	}
+	if gapParam, _ := getQueryParam(req.URL, "gap"); len(gapParam) > 0 {
+		gap, err := strconv.Atoi(gapParam)
+		if err != nil || gap < 0 {
+			return nil, errors.New("gap param must be a non negative number")
+		}
+		if serviceConfig.MaxDimension > 0 && gap > serviceConfig.MaxDimension {
+			return nil, fmt.Errorf("gap param must not be more than %d", serviceConfig.MaxDimension)
+		}
+		config.Gap = gap
+	}
+
+	width, height := config.gridSize(len(sources))
+	if serviceConfig.MaxDimension > 0 && (width > serviceConfig.MaxDimension || height > serviceConfig.MaxDimension) {
+		return nil, fmt.Errorf("width and height of montage must not be more than %d", serviceConfig.MaxDimension)
+	}
+
+	return config, nil
+}
+
+// acquireAll reserves memory for all images if MemoryBudget is set.
+// Returns the function that releases reserved memory.
+func (r *Service) acquireAll(req *http.Request, images []*Image) (func(), error) {
+	if r.MemoryBudget == nil {
+		return func() {}, nil
+	}
+
+	var memory int64
+	for _, image := range images {
+		memory += EstimateMemory(image)
+	}
+	err := r.MemoryBudget.Acquire(req.Context(), memory)
+	if err != nil {
+		r.log().Printf("[%s] Could not reserve [%d] bytes of memory: %s\n", req.URL.String(), memory, err)
+		return nil, err
+	}
+	return func() { r.MemoryBudget.Release(memory) }, nil
+}
+
+// anyNoStore returns true if any of images must not be cached, see Image.NoStore.
+func anyNoStore(images []*Image) bool {
+	for _, image := range images {
+		if image != nil && image.NoStore {
+			return true
+		}
+	}
+	return false
+}
+
+// loadAll loads all images in parallel. Loaded images are released if any of them fails.
+func (r *Service) loadAll(req *http.Request, sources []string) ([]*Image, error) {
+	var (
+		images = make([]*Image, len(sources))
+		errs   = make([]error, len(sources))
+		wg     sync.WaitGroup
+	)
+	for i, src := range sources {
+		wg.Add(1)
+		go func(i int, src string) {
+			defer wg.Done()
+			images[i], errs[i] = r.load(req, src)
+		}(i, src)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			for _, image := range images {
+				image.Release()
+			}
+			return nil, err
+		}
+	}
+
+	return images, nil
+}
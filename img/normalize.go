@@ -0,0 +1,127 @@
+package img
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// DefaultStripParams are query params of source URLs that are added by marketing and
+// analytics tools and don't change the image.
+var DefaultStripParams = []string{
+	"utm_*",
+	"fbclid",
+	"gclid",
+	"dclid",
+	"msclkid",
+	"mc_cid",
+	"mc_eid",
+	"_ga",
+}
+
+// UrlNormalizer canonicalizes source URLs, so equivalent URLs are loaded and cached as the
+// same source. Scheme and host are lowercased, default ports and fragments are removed,
+// the path is re-encoded and the remaining query params are sorted.
+// Normalize could be used as Service.NormalizeUrl.
+type UrlNormalizer struct {
+	// StripParams are names of query params that are removed. Names ending with "*" are
+	// prefixes, e.g. "utm_*". Matching is case-insensitive.
+	StripParams []string
+	// ForceHttps is the flag to load http sources using https.
+	ForceHttps bool
+}
+
+// NewUrlNormalizer creates the normalizer with DefaultStripParams.
+func NewUrlNormalizer() *UrlNormalizer {
+	return &UrlNormalizer{StripParams: DefaultStripParams}
+}
+
+// Normalize returns the canonical form of the source URL or 400 error if the URL could not be parsed.
+// URLs without scheme or host, e.g. of custom loaders, are returned as is.
+func (n *UrlNormalizer) Normalize(imgUrl string) (string, error) {
+	u, err := url.Parse(imgUrl)
+	if err != nil {
+		return "", NewHttpError(http.StatusBadRequest, fmt.Sprintf("invalid source URL: %s", err))
+	}
+	if len(u.Scheme) == 0 || len(u.Host) == 0 {
+		return imgUrl, nil
+	}
+
+	u.Scheme = strings.ToLower(u.Scheme)
+	if n.ForceHttps && u.Scheme == "http" {
+		u.Scheme = "https"
+	}
+	u.Host = strings.ToLower(u.Host)
+	if port := u.Port(); (port == "80" && u.Scheme == "http") || (port == "443" && u.Scheme == "https") {
+		u.Host = strings.TrimSuffix(u.Host, ":"+port)
+	}
+	u.Fragment, u.RawFragment = "", ""
+
+	// Encoded slashes must be kept, because they are not the same as path separators
+	if !strings.Contains(strings.ToLower(u.RawPath), "%2f") {
+		u.RawPath = ""
+	}
+
+	if len(u.RawQuery) > 0 {
+		query, err := url.ParseQuery(u.RawQuery)
+		if err != nil {
+			return "", NewHttpError(http.StatusBadRequest, fmt.Sprintf("invalid query of source URL: %s", err))
+		}
+		for name := range query {
+			if n.isStripped(name) {
+				query.Del(name)
+			}
+		}
+		u.RawQuery = query.Encode()
+	}
+	u.ForceQuery = false
+
+	return u.String(), nil
+}
+
+// isStripped returns true if the query param must be removed.
+func (n *UrlNormalizer) isStripped(name string) bool {
+	name = strings.ToLower(name)
+	for _, param := range n.StripParams {
+		param = strings.ToLower(param)
+		if prefix, ok := strings.CutSuffix(param, "*"); ok {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		} else if name == param {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveUrl returns the source URL prepended with the base URL if the source is a path, e.g.
+// products/1.jpg. Absolute and protocol relative URLs are returned as is. Paths with ".." segments
+// are rejected with 400, so sources outside of the base could not be loaded.
+func resolveUrl(base string, imgUrl string) (string, error) {
+	if len(base) == 0 || strings.HasPrefix(imgUrl, "//") {
+		return imgUrl, nil
+	}
+	if u, err := url.Parse(imgUrl); err != nil || u.IsAbs() {
+		return imgUrl, nil
+	}
+
+	path, _, _ := strings.Cut(imgUrl, "?")
+	for _, segment := range strings.Split(path, "/") {
+		if segment == ".." {
+			return "", NewHttpError(http.StatusBadRequest, "source path must not contain .. segments")
+		}
+	}
+	return strings.TrimSuffix(base, "/") + "/" + strings.TrimPrefix(imgUrl, "/"), nil
+}
+
+// normalizeUrl returns the source URL resolved against ServiceConfig.SourceBase and normalized
+// by Service.NormalizeUrl.
+func (r *Service) normalizeUrl(imgUrl string) (string, error) {
+	imgUrl, err := resolveUrl(r.config().SourceBase, imgUrl)
+	if err != nil || r.NormalizeUrl == nil {
+		return imgUrl, err
+	}
+	return r.NormalizeUrl(imgUrl)
+}
@@ -0,0 +1,178 @@
+package img_test
+
+import (
+	"github.com/Pixboost/transformimgs/v8/img"
+	"github.com/dooman87/kolibri/test"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestUrlNormalizer_Normalize(t *testing.T) {
+	normalizer := img.NewUrlNormalizer()
+	https := &img.UrlNormalizer{ForceHttps: true}
+
+	for _, tc := range []struct {
+		normalizer *img.UrlNormalizer
+		url        string
+		expected   string
+	}{
+		{normalizer, "http://site.com/img.png", "http://site.com/img.png"},
+		{normalizer, "HTTP://Site.COM:80/img.png#top", "http://site.com/img.png"},
+		{normalizer, "https://site.com:443/img.png", "https://site.com/img.png"},
+		{normalizer, "https://site.com:8443/img.png", "https://site.com:8443/img.png"},
+		{normalizer, "http://site.com/img.png?utm_source=mail&w=100&fbclid=abc&a=1", "http://site.com/img.png?a=1&w=100"},
+		{normalizer, "http://site.com/img.png?UTM_Campaign=sale", "http://site.com/img.png"},
+		{normalizer, "http://site.com/my%7Eimg%201.png", "http://site.com/my~img%201.png"},
+		{normalizer, "http://site.com/a%2fb/img.png", "http://site.com/a%2fb/img.png"},
+		{normalizer, "/relative/img.png", "/relative/img.png"},
+		{https, "http://site.com/img.png?utm_source=mail", "https://site.com/img.png?utm_source=mail"},
+	} {
+		normalized, err := tc.normalizer.Normalize(tc.url)
+		if err != nil {
+			t.Errorf("unexpected error for [%s]: %s", tc.url, err)
+			continue
+		}
+		test.Error(t, test.Equal(tc.expected, normalized, tc.url))
+	}
+
+	if _, err := normalizer.Normalize("http://site.com/img.png?a=%zz"); err == nil {
+		t.Errorf("expected error for invalid query")
+	}
+}
+
+func TestService_NormalizeUrl(t *testing.T) {
+	s := createService(t)
+	s.NormalizeUrl = img.NewUrlNormalizer().Normalize
+	test.Service = s.GetRouter().ServeHTTP
+	test.T = t
+
+	test.RunRequests([]test.TestCase{
+		{
+			Url:         "http://localhost/img/HTTP%3A%2F%2FSite.com%3A80%2Fimg.png%3Futm_source%3Dmail/optimise",
+			Description: "Equivalent URL",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal(ImgPngOut, w.Body.String(), "Resulted image"),
+				)
+			},
+		},
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com%2Fimg.png%23top/asis",
+			Description: "As is",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal(ImgSrc, w.Body.String(), "Resulted image"),
+				)
+			},
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com%2Fimg.png%3Fa%3D%25zz/optimise",
+			ExpectedCode: http.StatusBadRequest,
+			Description:  "Invalid URL",
+		},
+	})
+}
+
+func TestService_SourceBase(t *testing.T) {
+	s, err := img.NewServiceWithConfig(&urlLoader{}, &resizerMock{}, 1, &img.ServiceConfig{
+		SourceBase: "https://origin.site.com/images/",
+	})
+	if err != nil {
+		t.Fatalf("could not create service: %s", err)
+	}
+	test.Service = s.GetRouter().ServeHTTP
+	test.T = t
+
+	expectSource := func(expected string) func(w *httptest.ResponseRecorder, t *testing.T) {
+		return func(w *httptest.ResponseRecorder, t *testing.T) {
+			test.Error(t,
+				test.Equal(expected, w.Body.String(), "Source URL"),
+			)
+		}
+	}
+
+	test.RunRequests([]test.TestCase{
+		{
+			Url:         "http://localhost/img/products/1.jpg/asis",
+			Description: "Path",
+			Handler:     expectSource("https://origin.site.com/images/products/1.jpg"),
+		},
+		{
+			Url:         "http://localhost/img//products/1.jpg%3Fv%3D2/asis",
+			Description: "Path with leading slash and query",
+			Handler:     expectSource("https://origin.site.com/images/products/1.jpg?v=2"),
+		},
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/asis",
+			Description: "Absolute URL",
+			Handler:     expectSource("http://site.com/img.png"),
+		},
+		{
+			Url:          "http://localhost/img/products/../../secret.jpg/asis",
+			Description:  "Path outside of the base",
+			ExpectedCode: http.StatusBadRequest,
+		},
+	})
+}
+
+func TestService_ProtocolRelativeUrl(t *testing.T) {
+	// httptest requests are sent from 192.0.2.1
+	proxies, _ := img.ParseNetworks("192.0.2.0/24")
+	s, err := img.NewServiceWithConfig(&urlLoader{}, &resizerMock{}, 1, &img.ServiceConfig{
+		DefaultScheme:  "https",
+		TrustedProxies: proxies,
+	})
+	if err != nil {
+		t.Fatalf("could not create service: %s", err)
+	}
+	test.Service = s.GetRouter().ServeHTTP
+	test.T = t
+
+	request := func(proto string) *http.Request {
+		req := httptest.NewRequest("GET", "http://localhost/img/%2F%2Fsite.com/img.png/asis", nil)
+		if len(proto) > 0 {
+			req.Header.Set("X-Forwarded-Proto", proto)
+		}
+		return req
+	}
+	expectSource := func(expected string) func(w *httptest.ResponseRecorder, t *testing.T) {
+		return func(w *httptest.ResponseRecorder, t *testing.T) {
+			test.Error(t,
+				test.Equal(expected, w.Body.String(), "Source URL"),
+			)
+		}
+	}
+
+	test.RunRequests([]test.TestCase{
+		{
+			Request:     request(""),
+			Description: "Default scheme",
+			Handler:     expectSource("https://site.com/img.png"),
+		},
+		{
+			Request:     request("http"),
+			Description: "Forwarded protocol",
+			Handler:     expectSource("http://site.com/img.png"),
+		},
+		{
+			Request:     request("HTTP, https"),
+			Description: "Protocols of several proxies",
+			Handler:     expectSource("http://site.com/img.png"),
+		},
+		{
+			Request:     request("file"),
+			Description: "Protocol is not allowed",
+			Handler:     expectSource("https://site.com/img.png"),
+		},
+	})
+
+	s.Config.DefaultScheme = ""
+	test.RunRequests([]test.TestCase{
+		{
+			Request:     request("javascript"),
+			Description: "No default scheme",
+			Handler:     expectSource("//site.com/img.png"),
+		},
+	})
+}
@@ -0,0 +1,137 @@
+package img
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/dooman87/glogi"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// MaxPendingExports is the maximum number of batches of spans that are sent to the collector at the same time.
+var MaxPendingExports = 10
+
+// OtlpExporter sends spans to OpenTelemetry collector using OTLP/HTTP with JSON encoding,
+// e.g. to http://localhost:4318/v1/traces. Spans are sent in the background and dropped
+// if the collector is slow.
+type OtlpExporter struct {
+	Client *http.Client
+	// Url is the URL of traces endpoint of the collector.
+	Url string
+	// ServiceName is service.name attribute of the resource.
+	ServiceName string
+	// Log is the logger. Package Log is used if nil.
+	Log glogi.Logger
+
+	pending chan struct{}
+}
+
+// NewOtlpExporter creates the exporter that sends spans to the traces endpoint of the collector.
+func NewOtlpExporter(url string, serviceName string) *OtlpExporter {
+	return &OtlpExporter{
+		Client:      &http.Client{Timeout: 10 * time.Second},
+		Url:         url,
+		ServiceName: serviceName,
+		pending:     make(chan struct{}, MaxPendingExports),
+	}
+}
+
+func (e *OtlpExporter) Export(spans []*Span) {
+	if len(spans) == 0 {
+		return
+	}
+	select {
+	case e.pending <- struct{}{}:
+	default:
+		logOrDefault(e.Log).Errorf("Too many pending exports of spans, dropping [%d] spans", len(spans))
+		return
+	}
+
+	go func() {
+		defer func() { <-e.pending }()
+		if err := e.send(spans); err != nil {
+			logOrDefault(e.Log).Errorf("Could not export spans: %s", err)
+		}
+	}()
+}
+
+// send posts spans as OTLP ExportTraceServiceRequest.
+func (e *OtlpExporter) send(spans []*Span) error {
+	body, err := json.Marshal(e.request(spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", e.Url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := e.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("collector responded with %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// request returns OTLP JSON request with spans.
+func (e *OtlpExporter) request(spans []*Span) map[string]interface{} {
+	otlpSpans := make([]map[string]interface{}, 0, len(spans))
+	for _, s := range spans {
+		span := map[string]interface{}{
+			"traceId":           hex.EncodeToString(s.TraceId[:]),
+			"spanId":            hex.EncodeToString(s.SpanId[:]),
+			"name":              s.Name,
+			"kind":              s.Kind,
+			"startTimeUnixNano": strconv.FormatInt(s.StartTime.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.EndTime.UnixNano(), 10),
+			"attributes":        otlpAttributes(s.Attributes),
+		}
+		if s.ParentId != [8]byte{} {
+			span["parentSpanId"] = hex.EncodeToString(s.ParentId[:])
+		}
+		if len(s.Err) > 0 {
+			// STATUS_CODE_ERROR
+			span["status"] = map[string]interface{}{"code": 2, "message": s.Err}
+		}
+		otlpSpans = append(otlpSpans, span)
+	}
+
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": otlpAttributes(map[string]string{"service.name": e.ServiceName}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]interface{}{"name": "github.com/Pixboost/transformimgs"},
+						"spans": otlpSpans,
+					},
+				},
+			},
+		},
+	}
+}
+
+// otlpAttributes returns string attributes sorted by key.
+func otlpAttributes(attributes map[string]string) []interface{} {
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	result := make([]interface{}, len(keys))
+	for i, key := range keys {
+		result[i] = map[string]interface{}{"key": key, "value": map[string]interface{}{"stringValue": attributes[key]}}
+	}
+	return result
+}
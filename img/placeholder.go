@@ -0,0 +1,39 @@
+package img
+
+import (
+	"net/http"
+)
+
+var emptyGif = [...]byte{0x47, 0x49, 0x46, 0x38, 0x39, 0x61, 0x1, 0x0, 0x1, 0x0, 0x0, 0x0, 0x0, 0x21, 0xf9, 0x4, 0x1, 0xa, 0x0, 0x1, 0x0, 0x2c, 0x0, 0x0, 0x0, 0x0, 0x1, 0x0, 0x1, 0x0, 0x0, 0x2, 0x2, 0x4c, 0x1, 0x0, 0x3b}
+
+// Placeholder is the response that is served instead of hidden images, see SaveDataHide.
+type Placeholder struct {
+	// Image is served instead of hidden images. Empty 1x1 GIF is served if nil.
+	Image *Image
+	// NoContent is the flag to respond with 204 status without body instead of the image,
+	// e.g. for clients that hide broken images.
+	NoContent bool
+}
+
+// servePlaceholder writes the placeholder of Service.Placeholder to the response with
+// the same caching headers as images.
+func (r *Service) servePlaceholder(resp http.ResponseWriter) {
+	placeholder := r.Placeholder
+	if placeholder == nil {
+		placeholder = &Placeholder{}
+	}
+	cacheTTL := r.config().CacheTTL
+
+	if placeholder.NoContent {
+		resp.Header().Set("Cache-Control", cacheControl(cacheTTL))
+		resp.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	image := placeholder.Image
+	if image == nil {
+		image = &Image{Data: emptyGif[:], MimeType: "image/gif", Width: 1, Height: 1}
+	}
+	addHeaders(resp, image, cacheTTL)
+	_, _ = resp.Write(image.Data)
+}
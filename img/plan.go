@@ -0,0 +1,104 @@
+package img
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// TransformationPlan is the transformation that would be done by the processor,
+// see Service.PlanUrl.
+type TransformationPlan struct {
+	// Op is the name of the operation: "optimise", "resize" or "fit".
+	Op     string    `json:"op"`
+	Source PlanImage `json:"source"`
+	Target PlanImage `json:"target"`
+	// Args are the arguments of the ImageMagick command that would produce the output.
+	Args []string `json:"args,omitempty"`
+}
+
+// PlanImage describes the source or the output image of the plan.
+type PlanImage struct {
+	Format string `json:"format"`
+	// Width and Height are zero if not known, e.g. when border is trimmed.
+	Width   int `json:"width"`
+	Height  int `json:"height"`
+	Quality int `json:"quality,omitempty"`
+	// Size is the size of the image in bytes. It's estimated for the output image, see EstimateSize.
+	Size int64 `json:"size"`
+	// Frames is the number of frames, more than 1 for animated images. Omitted if not known.
+	Frames int `json:"frames,omitempty"`
+	// Animated is true for animated images.
+	Animated bool `json:"animated,omitempty"`
+}
+
+// EstimateSize returns the rough size in bytes of the output image assuming that
+// the size is proportional to the number of pixels. The estimation is not bigger than
+// the source, because the source is served when the output is bigger.
+func EstimateSize(srcSize int64, source *Info, target *Info) int64 {
+	if source.Width <= 0 || source.Height <= 0 || target.Width <= 0 || target.Height <= 0 {
+		return srcSize
+	}
+
+	ratio := float64(target.Width*target.Height) / float64(source.Width*source.Height)
+	if ratio >= 1 {
+		return srcSize
+	}
+	return int64(float64(srcSize) * ratio)
+}
+
+// newPlanImage returns the plan encoded to JSON as an image, so it could be
+// written to the response the same way as transformed images.
+func newPlanImage(op string, config *TransformationConfig, debug *Debug) (*Image, error) {
+	plan := &TransformationPlan{
+		Op:   op,
+		Args: debug.Args,
+	}
+	srcSize := int64(len(config.Src.Data))
+	source, target := debug.Source, debug.Target
+	if source == nil {
+		source = &Info{}
+	}
+	if target == nil {
+		target = &Info{}
+	}
+
+	plan.Source = PlanImage{
+		Format:  source.Format,
+		Width:   source.Width,
+		Height:  source.Height,
+		Quality: source.Quality,
+		Size:    srcSize,
+	}
+	plan.Target = PlanImage{
+		Format:  debug.MimeType,
+		Width:   target.Width,
+		Height:  target.Height,
+		Quality: debug.Quality,
+		Size:    EstimateSize(srcSize, source, target),
+	}
+	if len(plan.Target.Format) == 0 {
+		plan.Target.Format = source.Format
+	}
+	if config.TrimBorder {
+		plan.Target.Width, plan.Target.Height = 0, 0
+	}
+	plan.Source.Frames, plan.Source.Animated = source.Frames, source.Frames > 1
+	plan.Target.Frames = config.OutputFrames(source.Frames)
+	plan.Target.Animated = plan.Target.Frames > 1
+
+	buf := GetBuffer()
+	if err := json.NewEncoder(buf).Encode(plan); err != nil {
+		PutBuffer(buf)
+		return nil, err
+	}
+	return NewPooledImage("", buf, "application/json"), nil
+}
+
+// plan returns the plan of the processor or 501 error if processor is not a Planner.
+func plan(p Processor, op string, config *TransformationConfig) (*Debug, error) {
+	planner, ok := p.(Planner)
+	if !ok {
+		return nil, NewHttpError(http.StatusNotImplemented, "processor doesn't support plans")
+	}
+	return planner.Plan(op, config)
+}
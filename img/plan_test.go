@@ -0,0 +1,18 @@
+package img_test
+
+import (
+	"github.com/Pixboost/transformimgs/v8/img"
+	"github.com/dooman87/kolibri/test"
+	"testing"
+)
+
+func TestEstimateSize(t *testing.T) {
+	source := &img.Info{Width: 600, Height: 400}
+
+	test.Error(t,
+		test.Equal(int64(250), img.EstimateSize(1000, source, &img.Info{Width: 300, Height: 200}), "downscale"),
+		test.Equal(int64(1000), img.EstimateSize(1000, source, &img.Info{Width: 1200, Height: 800}), "upscale"),
+		test.Equal(int64(1000), img.EstimateSize(1000, source, &img.Info{}), "unknown target size"),
+		test.Equal(int64(1000), img.EstimateSize(1000, &img.Info{}, &img.Info{Width: 300, Height: 200}), "unknown source size"),
+	)
+}
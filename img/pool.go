@@ -0,0 +1,56 @@
+package img
+
+import (
+	"bytes"
+	"sync"
+)
+
+// MaxPooledBufferSize is the maximum capacity in bytes of a buffer
+// that will be returned to the pool. Bigger buffers are left for GC,
+// so a single huge image doesn't pin memory for the lifetime of the process.
+var MaxPooledBufferSize = 32 * 1024 * 1024
+
+var bufPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+// GetBuffer returns an empty buffer from the pool.
+// The buffer should be returned using PutBuffer or attached
+// to an image using NewPooledImage.
+func GetBuffer() *bytes.Buffer {
+	return bufPool.Get().(*bytes.Buffer)
+}
+
+// PutBuffer returns the buffer to the pool. The buffer must not be used after that.
+func PutBuffer(buf *bytes.Buffer) {
+	if buf == nil || buf.Cap() > MaxPooledBufferSize {
+		return
+	}
+	buf.Reset()
+	bufPool.Put(buf)
+}
+
+// NewPooledImage creates an image which data is backed by the buffer
+// from the pool. The buffer will be returned to the pool on Release.
+func NewPooledImage(id string, buf *bytes.Buffer, mimeType string) *Image {
+	return &Image{
+		Id:       id,
+		Data:     buf.Bytes(),
+		MimeType: mimeType,
+		buf:      buf,
+	}
+}
+
+// Release returns the buffer backing the image data to the pool.
+// It's a no-op for images that were not created with NewPooledImage.
+// Data of the image must not be used after release.
+func (i *Image) Release() {
+	if i == nil || i.buf == nil {
+		return
+	}
+	PutBuffer(i.buf)
+	i.buf = nil
+	i.Data = nil
+}
@@ -0,0 +1,46 @@
+package img_test
+
+import (
+	"github.com/Pixboost/transformimgs/v8/img"
+	"github.com/dooman87/kolibri/test"
+	"testing"
+)
+
+func TestNewPooledImage_Release(t *testing.T) {
+	buf := img.GetBuffer()
+	buf.WriteString("123")
+
+	image := img.NewPooledImage("id", buf, "image/png")
+
+	test.Error(t,
+		test.Equal("123", string(image.Data), "image data"),
+		test.Equal("image/png", image.MimeType, "mime type"),
+	)
+
+	image.Release()
+	image.Release()
+
+	test.Error(t,
+		test.Equal(0, len(image.Data), "image data after release"),
+	)
+}
+
+func TestImage_ReleaseNotPooled(t *testing.T) {
+	image := &img.Image{Data: []byte("123")}
+	image.Release()
+
+	var nilImage *img.Image
+	nilImage.Release()
+
+	test.Error(t,
+		test.Equal("123", string(image.Data), "image data"),
+	)
+}
+
+func TestPutBuffer_TooBig(t *testing.T) {
+	buf := img.GetBuffer()
+	buf.Grow(img.MaxPooledBufferSize + 1)
+
+	img.PutBuffer(buf)
+	img.PutBuffer(nil)
+}
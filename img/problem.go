@@ -0,0 +1,125 @@
+package img
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// ProblemMimeType is the MIME type of RFC 7807 problem details.
+const ProblemMimeType = "application/problem+json"
+
+// Problem is the body of error responses in RFC 7807 problem details format, see
+// ServiceConfig.ProblemDetails.
+type Problem struct {
+	// Type is always "about:blank", so Title is the status text.
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	// Detail is the message of the error.
+	Detail string `json:"detail,omitempty"`
+	// Instance is the path of the request.
+	Instance string `json:"instance,omitempty"`
+	// Code is the machine-readable code of the error: the category of the error, e.g. "origin_not_found"
+	// or "too_large", see ErrorCategory, or the status text in snake case, e.g. "bad_request".
+	Code string `json:"code"`
+}
+
+// problemWriter replaces plain text error responses with problem details.
+type problemWriter struct {
+	http.ResponseWriter
+	req     *http.Request
+	code    string
+	status  int
+	problem bool
+	detail  bytes.Buffer
+}
+
+func (w *problemWriter) WriteHeader(status int) {
+	if status >= http.StatusBadRequest && strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		w.problem, w.status = true, status
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *problemWriter) Write(b []byte) (int, error) {
+	if w.problem {
+		return w.detail.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// finish writes problem details of the error response.
+func (w *problemWriter) finish() {
+	if !w.problem {
+		return
+	}
+	code := w.code
+	if len(code) == 0 || code == "other" {
+		code = statusCode(w.status)
+	}
+	w.Header().Set("Content-Type", ProblemMimeType)
+	w.ResponseWriter.WriteHeader(w.status)
+	_ = json.NewEncoder(w.ResponseWriter).Encode(&Problem{
+		Type:     "about:blank",
+		Title:    http.StatusText(w.status),
+		Status:   w.status,
+		Detail:   strings.TrimSpace(w.detail.String()),
+		Instance: w.req.URL.Path,
+		Code:     code,
+	})
+}
+
+// statusCode returns the status text in snake case, e.g. "gateway_timeout".
+func statusCode(status int) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r
+		case r == ' ' || r == '-':
+			return '_'
+		}
+		return -1
+	}, strings.ToLower(http.StatusText(status)))
+}
+
+// wantsProblem returns true if errors of the request are responded with problem details: enabled
+// by ServiceConfig.ProblemDetails or Accept header with JSON.
+func (r *Service) wantsProblem(req *http.Request) bool {
+	if r.config().ProblemDetails {
+		return true
+	}
+	for _, accept := range req.Header.Values("Accept") {
+		for _, mime := range strings.Split(accept, ",") {
+			mime, _, _ = strings.Cut(mime, ";")
+			switch strings.ToLower(strings.TrimSpace(mime)) {
+			case "application/json", ProblemMimeType:
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// problemHandler returns the handler that responds with problem details instead of plain text
+// errors if the request wants them.
+func (r *Service) problemHandler(next http.HandlerFunc) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		if !r.wantsProblem(req) {
+			next(resp, req)
+			return
+		}
+		w := &problemWriter{ResponseWriter: resp, req: req}
+		next(w, req)
+		w.finish()
+	}
+}
+
+// setProblemCode sets the code of problem details to the category of the error, see Problem.Code.
+func setProblemCode(resp http.ResponseWriter, err error) {
+	if w, ok := resp.(*problemWriter); ok {
+		w.code = ErrorCategory(err)
+	}
+}
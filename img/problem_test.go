@@ -0,0 +1,121 @@
+package img_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Pixboost/transformimgs/v8/img"
+	"github.com/dooman87/kolibri/test"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestService_ProblemDetails(t *testing.T) {
+	s := createService(t)
+	test.Service = s.GetRouter().ServeHTTP
+	test.T = t
+
+	expectProblem := func(code string, status int) func(w *httptest.ResponseRecorder, t *testing.T) {
+		return func(w *httptest.ResponseRecorder, t *testing.T) {
+			var problem img.Problem
+			err := json.Unmarshal(w.Body.Bytes(), &problem)
+			test.Error(t,
+				test.Nil(err, "error of parsing problem details"),
+				test.Equal(img.ProblemMimeType, w.Header().Get("Content-Type"), "Content-Type header"),
+				test.Equal("about:blank", problem.Type, "type"),
+				test.Equal(http.StatusText(status), problem.Title, "title"),
+				test.Equal(status, problem.Status, "status"),
+				test.Equal(code, problem.Code, "code"),
+				test.Equal(true, len(problem.Detail) > 0, "detail"),
+			)
+		}
+	}
+	jsonRequest := func(url string, accept string) *http.Request {
+		req := httptest.NewRequest("GET", url, nil)
+		req.Header.Set("Accept", accept)
+		return req
+	}
+
+	test.RunRequests([]test.TestCase{
+		{
+			Request:      jsonRequest("http://localhost/img/http%3A%2F%2Fsite.com/img.png/resize", "application/json"),
+			Description:  "Missing param",
+			ExpectedCode: http.StatusBadRequest,
+			Handler:      expectProblem("bad_request", http.StatusBadRequest),
+		},
+		{
+			Request:      jsonRequest("http://localhost/img/http%3A%2F%2Fsite.com/missing.png/optimise", "application/problem+json;q=0.9, */*"),
+			Description:  "Error of the loader",
+			ExpectedCode: http.StatusInternalServerError,
+			Handler:      expectProblem("internal_server_error", http.StatusInternalServerError),
+		},
+		{
+			Request:      jsonRequest("http://localhost/img/http%3A%2F%2Fsite.com/img.png/rotate", "application/json"),
+			Description:  "Unknown route",
+			ExpectedCode: http.StatusNotFound,
+			Handler:      expectProblem("not_found", http.StatusNotFound),
+		},
+		{
+			Request:      jsonRequest("http://localhost/img/http%3A%2F%2Fsite.com/img.png/resize", "image/webp,*/*"),
+			Description:  "Plain text error",
+			ExpectedCode: http.StatusBadRequest,
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal(true, strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain"), "Content-Type header"),
+				)
+			},
+		},
+		{
+			Request:     jsonRequest("http://localhost/img/http%3A%2F%2Fsite.com/img.png/resize?size=300", "application/json"),
+			Description: "Successful response",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal(ImgPngOut, w.Body.String(), "Resulted image"),
+				)
+			},
+		},
+	})
+}
+
+// notFoundLoader returns ErrOriginNotFound for all sources.
+type notFoundLoader struct{}
+
+func (l *notFoundLoader) Load(url string, _ context.Context) (*img.Image, error) {
+	return nil, fmt.Errorf("%w: got 404", img.ErrOriginNotFound)
+}
+
+func TestService_ProblemDetailsConfig(t *testing.T) {
+	s, err := img.NewServiceWithConfig(&notFoundLoader{}, &resizerMock{}, 1, &img.ServiceConfig{ProblemDetails: true})
+	if err != nil {
+		t.Fatalf("could not create service: %s", err)
+	}
+	test.Service = s.Handler().ServeHTTP
+	test.T = t
+
+	test.RunRequests([]test.TestCase{
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/resize",
+			Description:  "Problem details without Accept header",
+			ExpectedCode: http.StatusBadRequest,
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal(img.ProblemMimeType, w.Header().Get("Content-Type"), "Content-Type header"),
+					test.Equal(true, strings.Contains(w.Body.String(), `"code":"bad_request"`), "code"),
+				)
+			},
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise",
+			Description:  "Code of the error category",
+			ExpectedCode: http.StatusNotFound,
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal(true, strings.Contains(w.Body.String(), `"code":"origin_not_found"`), "code"),
+					test.Equal(true, strings.Contains(w.Body.String(), `"instance":"/img/http://site.com/img.png/optimise"`), "instance"),
+				)
+			},
+		},
+	})
+}
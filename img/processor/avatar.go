@@ -0,0 +1,153 @@
+package processor
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/Pixboost/transformimgs/v8/img"
+	"github.com/Pixboost/transformimgs/v8/img/processor/internal"
+	"image"
+	"image/png"
+)
+
+// AvatarPadding is the size of avatars relative to the size of the face, so the avatar includes
+// hair and shoulders.
+var AvatarPadding = 2.0
+
+// faceDetectionSize is the size in pixels of the downscaled image that is used to detect faces.
+const faceDetectionSize = 64
+
+// Avatar crops the square around the most prominent face of the image, resizes it to the size from
+// img.AvatarConfig and applies the circular mask. Faces are detected using DetectFace unless they are
+// detected by img.Service.FaceDetector. The center square is used if there are no faces.
+// Outputs without alpha channel, e.g. JPEG, are encoded as PNG.
+func (p *ImageMagick) Avatar(config *img.TransformationConfig) (*img.Image, error) {
+	avatarConfig, ok := config.Config.(*img.AvatarConfig)
+	if !ok {
+		return nil, fmt.Errorf("could not get avatarConfig")
+	}
+	source, err := p.getSourceInfo(config)
+	if err != nil {
+		return nil, err
+	}
+
+	face := avatarConfig.Face
+	if !avatarConfig.Detected {
+		face, err = p.detectFace(config.Src, source)
+		if err != nil {
+			return nil, err
+		}
+	}
+	width, height := orientedSize(source)
+	crop := internal.AvatarCrop(width, height, face, AvatarPadding)
+
+	args, target, mimeType := p.getAvatarArgs(config, source, crop, avatarConfig.Size)
+	outputImageData, args, err := p.encode(config, source, args, mimeType)
+	if err != nil {
+		if retry := p.fallbackConfig(config, mimeType, err); retry != nil {
+			return p.Avatar(retry)
+		}
+		return nil, err
+	}
+	setDebug(config, source, target, args, mimeType)
+
+	result := img.NewPooledImage("", outputImageData, mimeType)
+	result.Width, result.Height, result.Frames = target.Width, target.Height, 1
+	return result, nil
+}
+
+// getAvatarArgs returns convert arguments, the target and MIME type of the output for avatar.
+func (p *ImageMagick) getAvatarArgs(config *img.TransformationConfig, source *img.Info, crop image.Rectangle, size int) ([]string, *img.Info, string) {
+	target := &img.Info{Width: size, Height: size}
+	outputFormatArg, mimeType := getOutputFormat(source, target, config.SupportedFormats)
+
+	var qualityOpts []string
+	switch {
+	case len(mimeType) > 0 || source.Format == "PNG":
+		qualityOpts = p.getQualityOptions(source, config, mimeType)
+	default:
+		// The mask needs alpha channel
+		outputFormatArg, mimeType = "png:-", "image/png"
+	}
+
+	colorProfileOpts, keepProfileOpts := p.getColorProfileOptions(source, config)
+	center := float64(size-1) / 2
+
+	args := make([]string, 0)
+	args = append(args, "-") //Input
+	if source.Frames > 1 {
+		// Avatars are static
+		args = append(args, "-delete", "1--1")
+	}
+	args = append(args, colorProfileOpts...)
+	args = append(args, beforeResizeConvertOpts...)
+	args = append(args, "-crop", fmt.Sprintf("%dx%d+%d+%d", crop.Dx(), crop.Dy(), crop.Min.X, crop.Min.Y), "+repage")
+	args = append(args, "-resize", fmt.Sprintf("%dx%d!", size, size))
+	args = append(args,
+		"(", "-size", fmt.Sprintf("%dx%d", size, size), "xc:black", "-fill", "white",
+		"-draw", fmt.Sprintf("circle %g,%g %g,0", center, center, center), ")",
+		"-alpha", "off", "-compose", "CopyOpacity", "-composite",
+	)
+	args = append(args, qualityOpts...)
+	args = append(args, p.AdditionalArgs...)
+	if p.GetAdditionalArgs != nil {
+		args = append(args, p.GetAdditionalArgs("avatar", config.Src.Data, source, target)...)
+	}
+	args = append(args, convertOpts...)
+	args = append(args, keepProfileOpts...)
+	args = append(args, getConvertFormatOptions(source, mimeType)...)
+	args = append(args, outputFormatArg) //Output
+
+	return args, target, mimeType
+}
+
+// DetectFace returns the bounding box of the largest skin colored region of the image, which is
+// usually the face on portraits and profile photos. It's a cheap heuristic that doesn't need a model,
+// so ImageMagick could be used as img.FaceDetector when more accurate detector is not available.
+func (p *ImageMagick) DetectFace(src *img.Image) (image.Rectangle, error) {
+	source, err := p.LoadImageInfo(src)
+	if err != nil {
+		return image.Rectangle{}, err
+	}
+	return p.detectFace(src, source)
+}
+
+func (p *ImageMagick) detectFace(src *img.Image, source *img.Info) (image.Rectangle, error) {
+	args := []string{"-"}
+	if source.Frames > 1 {
+		args = append(args, "-delete", "1--1")
+	}
+	args = append(args, beforeResizeConvertOpts...)
+	args = append(args, "-resize", fmt.Sprintf("%dx%d!", faceDetectionSize, faceDetectionSize), "-colorspace", "sRGB", "png:-")
+
+	out, err := p.execImagemagick(bytes.NewReader(src.Data), args, src.Id)
+	if err != nil {
+		return image.Rectangle{}, err
+	}
+	defer img.PutBuffer(out)
+	small, err := png.Decode(out)
+	if err != nil {
+		return image.Rectangle{}, fmt.Errorf("could not decode image for face detection: %w", err)
+	}
+
+	region := internal.SkinRegion(small)
+	if region.Empty() {
+		p.log().Printf("[%s] No faces are detected, using the center of the image\n", src.Id)
+		return region, nil
+	}
+	width, height := orientedSize(source)
+	bounds := small.Bounds()
+	scaleX, scaleY := float64(width)/float64(bounds.Dx()), float64(height)/float64(bounds.Dy())
+	return image.Rect(
+		int(float64(region.Min.X)*scaleX), int(float64(region.Min.Y)*scaleY),
+		int(float64(region.Max.X)*scaleX), int(float64(region.Max.Y)*scaleY),
+	), nil
+}
+
+// orientedSize returns the width and the height of the image after applying EXIF orientation.
+func orientedSize(source *img.Info) (int, int) {
+	switch source.Orientation {
+	case "LeftTop", "RightTop", "RightBottom", "LeftBottom":
+		return source.Height, source.Width
+	}
+	return source.Width, source.Height
+}
@@ -0,0 +1,55 @@
+package processor
+
+import (
+	"github.com/Pixboost/transformimgs/v8/img"
+)
+
+// withAvifSavings returns the AVIF result if it's at least img.TransformationConfig.AvifMinSavings
+// percent smaller than the image transformed to the next best format. Otherwise, the other image
+// is returned. Results in other formats are returned as is.
+func (p *ImageMagick) withAvifSavings(config *img.TransformationConfig, result *img.Image, transform func(*img.TransformationConfig) (*img.Image, error)) *img.Image {
+	if config.AvifMinSavings <= 0 || result.MimeType != AvifMime {
+		return result
+	}
+
+	other := withoutAvif(config)
+	otherResult, err := transform(other)
+	if err != nil {
+		p.log().Printf("[%s] WARNING: could not transform image to compare with AVIF: %s\n", config.Src.Id, err)
+		return result
+	}
+	if hasAvifSavings(len(result.Data), len(otherResult.Data), config.AvifMinSavings) {
+		otherResult.Release()
+		return result
+	}
+
+	p.log().Printf("[%s] AVIF size [%d] is not [%.1f%%] smaller than [%d], using the other format\n",
+		config.Src.Id, len(result.Data), config.AvifMinSavings, len(otherResult.Data))
+	result.Release()
+	if config.Debug != nil {
+		*config.Debug = *other.Debug
+	}
+	return otherResult
+}
+
+// withoutAvif returns the copy of the config without AVIF in supported formats. Decisions of
+// the processor are collected separately, so they are not mixed with decisions for AVIF.
+func withoutAvif(config *img.TransformationConfig) *img.TransformationConfig {
+	other := *config
+	other.AvifMinSavings = 0
+	other.SupportedFormats = make([]string, 0, len(config.SupportedFormats))
+	for _, f := range config.SupportedFormats {
+		if f != AvifMime {
+			other.SupportedFormats = append(other.SupportedFormats, f)
+		}
+	}
+	if config.Debug != nil {
+		other.Debug = &img.Debug{}
+	}
+	return &other
+}
+
+// hasAvifSavings returns true if AVIF of avifSize bytes is at least minSavings percent smaller than otherSize.
+func hasAvifSavings(avifSize int, otherSize int, minSavings float64) bool {
+	return float64(avifSize) <= float64(otherSize)*(1-minSavings/100)
+}
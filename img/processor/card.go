@@ -0,0 +1,127 @@
+package processor
+
+import (
+	"fmt"
+	"github.com/Pixboost/transformimgs/v8/img"
+	"net/http"
+	"strings"
+)
+
+// Card renders the social card: the background image is resized to cover the card,
+// then the logo and text are drawn in their areas of the template.
+//
+// Images are passed to "convert" command as extra files, so cards are not supported
+// when ImageMagick runs in-process.
+func (p *ImageMagick) Card(config *img.TransformationConfig) (*img.Image, error) {
+	cardConfig, ok := config.Config.(*img.CardConfig)
+	if !ok || cardConfig.Template == nil {
+		return nil, fmt.Errorf("could not get cardConfig")
+	}
+	if p.runner != nil {
+		return nil, img.NewHttpError(http.StatusNotImplemented, "cards are not supported by in-process ImageMagick")
+	}
+
+	template := cardConfig.Template
+	// Cards are usually photos with text, so they are encoded with lossy compression
+	source := &img.Info{
+		Format: "JPEG",
+		Opaque: true,
+		Width:  template.Width,
+		Height: template.Height,
+	}
+	target := &img.Info{
+		Opaque: true,
+		Width:  template.Width,
+		Height: template.Height,
+	}
+	outputFormatArg, mimeType := getOutputFormat(source, target, config.SupportedFormats)
+	if len(mimeType) == 0 {
+		outputFormatArg, mimeType = "jpg:-", "image/jpeg"
+	}
+
+	args, images := p.getCardArgs(cardConfig)
+	args = append(args, p.getQualityOptions(source, config, mimeType)...)
+	args = append(args, p.AdditionalArgs...)
+	args = append(args, convertOpts...)
+	args = append(args, getConvertFormatOptions(source, mimeType)...)
+	args = append(args, outputFormatArg) //Output
+
+	outputImageData, err := p.execImagemagickFiles(images, args, config.Src.Id)
+	if err != nil {
+		return nil, err
+	}
+	setDebug(config, source, target, args, mimeType)
+
+	result := img.NewPooledImage("", outputImageData, mimeType)
+	result.Width, result.Height = template.Width, template.Height
+	return result, nil
+}
+
+// getCardArgs returns convert arguments without output options and images that are
+// passed as extra files. Each element is rendered in parentheses to the size of its area
+// and composed at the position of the area.
+func (p *ImageMagick) getCardArgs(cardConfig *img.CardConfig) ([]string, [][]byte) {
+	var (
+		template = cardConfig.Template
+		cardSize = fmt.Sprintf("%dx%d", template.Width, template.Height)
+		images   [][]byte
+	)
+
+	args := []string{"-respect-parentheses"}
+	if cardConfig.Background != nil {
+		images = append(images, cardConfig.Background.Data)
+		args = append(args, "fd:3[0]")
+		args = append(args, beforeResizeConvertOpts...)
+		args = append(args, "-resize", cardSize+"^", "-gravity", "center", "-extent", cardSize)
+	} else {
+		args = append(args, "-size", cardSize, "xc:"+template.Background)
+	}
+
+	if template.Logo != nil && cardConfig.Logo != nil {
+		images = append(images, cardConfig.Logo.Data)
+		box := template.Logo.CardBox
+		boxSize := fmt.Sprintf("%dx%d", box.Width, box.Height)
+		// The first image is passed as the first extra file which is fd 3 in the child process
+		args = append(args, "(", fmt.Sprintf("fd:%d[0]", len(images)+2))
+		args = append(args, beforeResizeConvertOpts...)
+		args = append(args, "-resize", boxSize, "-background", "none", "-gravity", box.Gravity, "-extent", boxSize, ")")
+		args = append(args, getCardCompositeArgs(box)...)
+	}
+
+	for _, text := range []struct {
+		area  *img.CardText
+		value string
+	}{{template.Title, cardConfig.Title}, {template.Author, cardConfig.Author}} {
+		if text.area == nil || len(strings.TrimSpace(text.value)) == 0 {
+			continue
+		}
+		box := text.area.CardBox
+		args = append(args, "(", "-size", fmt.Sprintf("%dx%d", box.Width, box.Height), "-background", "none",
+			"-fill", text.area.Color, "-gravity", box.Gravity)
+		if len(text.area.Font) > 0 {
+			args = append(args, "-font", text.area.Font)
+		}
+		if text.area.Size > 0 {
+			args = append(args, "-pointsize", fmt.Sprintf("%g", text.area.Size))
+		}
+		args = append(args, "caption:"+escapeCaption(text.value), ")")
+		args = append(args, getCardCompositeArgs(box)...)
+	}
+
+	return args, images
+}
+
+func getCardCompositeArgs(box img.CardBox) []string {
+	return []string{"-gravity", "northwest", "-geometry", fmt.Sprintf("+%d+%d", box.X, box.Y), "-composite"}
+}
+
+// escapeCaption escapes text, so ImageMagick doesn't read it from a file
+// when it starts with @ and doesn't expand percent escapes.
+func escapeCaption(text string) string {
+	text = strings.ReplaceAll(text, "\\", "\\\\")
+	text = strings.ReplaceAll(text, "%", "%%")
+	if strings.HasPrefix(text, "@") {
+		text = "\\" + text
+	}
+	return text
+}
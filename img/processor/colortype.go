@@ -0,0 +1,70 @@
+package processor
+
+import (
+	"fmt"
+	"github.com/Pixboost/transformimgs/v8/img"
+	"strings"
+)
+
+// colorTypeFormat is the format of properties that are used to detect cheaper color types: the type
+// of the image, the number of unique colors and the difference between the variance of the binary alpha
+// channel with the same mean and the variance of the alpha channel. The difference is zero only if
+// all pixels are either fully transparent or fully opaque.
+const colorTypeFormat = "%[type] %k %[fx:mean.a*(1-mean.a)-standard_deviation.a^2]"
+
+// maxBinaryAlphaDeviation is the maximum difference of variances for the alpha channel that is
+// treated as binary. It allows rounding errors and a few semi-transparent pixels in big images.
+const maxBinaryAlphaDeviation = 1e-7
+
+// loadColorType sets Grayscale, BinaryAlpha and Colors of the info. Errors are logged, because
+// the image is encoded as usual without them.
+func (p *ImageMagick) loadColorType(src *img.Image, info *img.Info) {
+	out, err := p.execIdentify(src, colorTypeFormat)
+	if err != nil {
+		p.log().Printf("[%s] WARNING: could not detect color type: %s\n", src.Id, err)
+		return
+	}
+
+	var (
+		imageType string
+		deviation float64
+	)
+	_, err = fmt.Sscanf(strings.TrimSpace(out), "%s %d %g", &imageType, &info.Colors, &deviation)
+	if err != nil {
+		p.log().Printf("[%s] WARNING: could not parse color type [%s]: %s\n", src.Id, out, err)
+		return
+	}
+	info.Grayscale = imageType == "Bilevel" || strings.HasPrefix(imageType, "Grayscale")
+	info.BinaryAlpha = !info.Opaque && deviation < maxBinaryAlphaDeviation
+}
+
+// getColorTypeOptions returns options to encode grayscale images and images with binary alpha
+// channel using cheaper color types, see ImageMagick.ReduceColorTypes:
+//   - PNG with binary alpha and not more than 256 colors is encoded as palette PNG if it's not resized,
+//     because resizing adds semi-transparent pixels on edges;
+//   - grayscale PNG is encoded as grayscale PNG with or without alpha;
+//   - opaque grayscale JPEG and WebP are encoded with a single channel.
+//
+// Colors of the image could be changed by the transformation, so options are not returned in that case.
+func getColorTypeOptions(config *img.TransformationConfig, source *img.Info, target *img.Info, outputMimeType string) []string {
+	if (!source.Grayscale && !source.BinaryAlpha) || len(config.ReplaceColors) > 0 || config.Enhance {
+		return nil
+	}
+
+	sameSize := target.Width == source.Width && target.Height == source.Height
+	switch {
+	case len(outputMimeType) == 0 && source.Format == "PNG":
+		if source.BinaryAlpha && sameSize && source.Colors > 0 && source.Colors <= 256 {
+			return []string{"-define", "png:format=png8"}
+		}
+		if source.Grayscale && source.Opaque {
+			return []string{"-type", "Grayscale"}
+		}
+		if source.Grayscale {
+			return []string{"-type", "GrayscaleAlpha"}
+		}
+	case source.Grayscale && source.Opaque && (outputMimeType == WebpMime || (len(outputMimeType) == 0 && source.Format == "JPEG")):
+		return []string{"-type", "Grayscale"}
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package processor
+
+import (
+	"github.com/Pixboost/transformimgs/v8/img"
+	"strings"
+)
+
+// exifFormat outputs all EXIF tags of the image as "exif:Name=Value" lines.
+const exifFormat = "%[EXIF:*]"
+
+// LoadExif returns EXIF tags of the image. Tags of the first frame are returned for
+// animated images. Returns an empty map if the image doesn't have EXIF.
+func (p *ImageMagick) LoadExif(src *img.Image) (map[string]string, error) {
+	out, err := p.execIdentify(src, exifFormat)
+	if err != nil {
+		return nil, img.ErrUnsupportedFormat
+	}
+
+	return parseExifTags(out), nil
+}
+
+// parseExifTags parses the output of identify with exifFormat.
+func parseExifTags(out string) map[string]string {
+	tags := make(map[string]string)
+	for _, line := range strings.Split(out, "\n") {
+		name, value, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if !ok || !strings.HasPrefix(name, "exif:") {
+			continue
+		}
+		name = strings.TrimPrefix(name, "exif:")
+		// Identify outputs tags for each frame, keeping the first one
+		if _, exists := tags[name]; !exists {
+			tags[name] = strings.TrimSpace(value)
+		}
+	}
+	return tags
+}
@@ -5,23 +5,118 @@ import (
 	"fmt"
 	"github.com/Pixboost/transformimgs/v8/img"
 	"github.com/Pixboost/transformimgs/v8/img/processor/internal"
+	"github.com/dooman87/glogi"
 	"io"
+	"math"
+	"os"
 	"os/exec"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
+// magickRunner runs ImageMagick commands in-process instead of executing binaries.
+type magickRunner interface {
+	// convert runs "convert" command with the given arguments. Input and output
+	// images are referenced as "-" in arguments.
+	convert(in io.Reader, args []string) (*bytes.Buffer, error)
+	// identify returns image properties formatted using ImageMagick escapes.
+	identify(in []byte, format string) (string, error)
+}
+
 type ImageMagick struct {
 	convertCmd  string
 	identifyCmd string
+	// runner is used instead of executing convert and identify binaries if set.
+	runner magickRunner
 	// AdditionalArgs are static arguments that will be passed to ImageMagick "convert" command for all operations.
 	// Argument name and value should be in separate array elements.
 	AdditionalArgs []string
 	// GetAdditionalArgs could return additional arguments for ImageMagick "convert" command.
-	// "op" is the name of the operation: "optimise", "resize" or "fit".
+	// "op" is the name of the operation: "optimise", "resize", "fit", "upscale" or "transcode".
 	// Some fields in the target info might not be filled, so you need to check on them!
 	// Argument name and value should be in a separate array elements.
 	GetAdditionalArgs func(op string, image []byte, source *img.Info, target *img.Info) []string
+	// ParallelOptimise enables encoding to all formats supported by the client (WebP and AVIF)
+	// concurrently on optimise and returning the smallest result, rather than
+	// choosing the output format upfront.
+	// GetAdditionalArgs must be safe for concurrent use when this flag is set.
+	ParallelOptimise bool
+	// SRGBProfile is the path to sRGB ICC profile. If set, then images with embedded
+	// ICC profile (e.g. CMYK or wide-gamut) will be converted to sRGB using that profile
+	// instead of the naive color space conversion.
+	SRGBProfile string
+	// PreserveWideGamut is the flag to keep wide-gamut ICC profiles, e.g. Display P3,
+	// in the output instead of converting images to sRGB.
+	// Could also be enabled per transformation using img.TransformationConfig.WideGamut.
+	PreserveWideGamut bool
+	// CMYKProfile is the path to CMYK ICC profile that is used for CMYK images without
+	// embedded profile. Only used when SRGBProfile is set.
+	CMYKProfile string
+	// MaxAnimationFrames is the maximum number of frames in animated images.
+	// Transformations of images with more frames will fail with 413 error. Zero means no limit.
+	MaxAnimationFrames int
+	// MaxAnimationSize is the maximum size of frames in pixels (width * height) for animated images.
+	// Transformations of bigger animations will fail with 413 error. Zero means no limit.
+	MaxAnimationSize int
+	// FastDownscale enables two-pass resize for large images, where image
+	// is scaled down to the intermediate size using a cheap algorithm before
+	// the high-quality resize. It significantly reduces CPU time for thumbnails of big images.
+	FastDownscale bool
+	// TargetSSIM enables perceptual quality mode, where encoder quality of lossy images
+	// is searched for each image to get the smallest result with SSIM not less than the target, e.g. 0.98.
+	// It's expensive, because images are encoded several times. Zero disables the mode.
+	TargetSSIM float64
+	// QualitySearchSteps is the maximum number of encodes during the quality search.
+	// DefaultQualitySearchSteps is used when not set.
+	QualitySearchSteps int
+	// QualityLadder defines quality of output images for each output format.
+	// DefaultQualityLadder is used when not set.
+	QualityLadder QualityLadder
+	// MaxParallelEncodes is the maximum number of candidate encodes that could run
+	// at the same time for one image when ParallelOptimise is set.
+	// DefaultMaxParallelEncodes is used when not set.
+	MaxParallelEncodes int
+	// GifLossy enables lossy optimisation of GIF output, similar to gifsicle --lossy, for clients
+	// that don't support next generation formats. Duplicate frames are removed, colors are reduced
+	// to GifColors and pixels that differ from the previous frame by less than GifLossy percent
+	// are made transparent, so they are compressed better. Zero disables the optimisation.
+	GifLossy float64
+	// SuperResolution is the optional hook that enlarges the source image, e.g. using an external
+	// super-resolution model, before Upscale resizes it to the target size. It's called only when
+	// the target is bigger than the source. Data of the source must not be used after the hook returns.
+	SuperResolution func(src *img.Image, target *img.Info) (*img.Image, error)
+	// SkipOptimised enables returning the source from Optimise without encoding when it's already
+	// optimised, e.g. tiny images or sources in the output format with quality not higher than the
+	// output quality. It saves CPU and avoids generation loss. Sources with metadata are always encoded,
+	// so metadata is removed.
+	SkipOptimised bool
+	// ThreadLimit is the maximum number of threads of each ImageMagick command, so concurrent
+	// commands don't spawn a thread per CPU each and thrash the scheduler, see DefaultThreadLimit.
+	// Zero uses the default of ImageMagick. Ignored when ImageMagick runs in-process.
+	ThreadLimit int
+	// RetryTransient enables a single retry of the transformation with the fallback format
+	// (the format of the source) when encoding to a next generation format fails with
+	// one of TransientErrors, e.g. a resource limit is hit.
+	RetryTransient bool
+	// ReduceColorTypes enables detection of grayscale images and binary alpha channels of PNG and JPEG
+	// sources, so logos and icons are encoded using cheaper color types: palette or grayscale PNG and
+	// grayscale JPEG or WebP instead of full RGBA. Detection reads all pixels of the source, so it
+	// runs an additional identify command.
+	ReduceColorTypes bool
+	// Metrics records durations and errors of convert and identify commands. Disabled if nil.
+	Metrics *img.Metrics
+	// Log is the logger of the processor. Package img.Log is used if nil.
+	Log glogi.Logger
+}
+
+func (p *ImageMagick) log() glogi.Logger {
+	if p.Log != nil {
+		return p.Log
+	}
+	return img.Log
 }
 
 var beforeResizeConvertOpts = []string{
@@ -34,18 +129,42 @@ var convertOpts = []string{
 	"-define", "png:compression-filter=5",
 	"-define", "png:compression-level=9",
 	"-define", "png:compression-strategy=0",
-	"-define", "png:exclude-chunk=bKGD,cHRM,EXIF,gAMA,iCCP,iTXt,sRGB,tEXt,zCCP,zTXt,date",
+	"-define", "png:exclude-chunk=bKGD,cHRM,EXIF,gAMA,iCCP,iTXt,sRGB,tEXt,tIME,zCCP,zTXt,date",
 	"-define", "heic:speed=6",
 	"-interlace", "None",
 	"-colorspace", "sRGB",
 	"-sampling-factor", "4:2:0",
 	"+profile", "!icc,*",
+	// Removing timestamps, so the same input always produces the same output
+	"+set", "date:create",
+	"+set", "date:modify",
+	"+set", "date:timestamp",
 }
 
+// identifyFormat is the format of image properties that are used to build img.Info.
+// Properties are printed for each frame, so we are using new line to separate them.
+// Fields that could be empty or contain spaces are separated by "|".
+const identifyFormat = "%m %Q %[opaque] %w %h %[colorspace]|%[profiles]|%[icc:description]|%T|%[orientation]\\n"
+
 var cutToFitOpts = []string{
 	"-gravity", "center",
 }
 
+// EnhanceModulate is the argument of -modulate option (brightness,saturation,hue in percents)
+// applied after auto-level and auto-gamma when image is enhanced. Boosts saturation by 10% by default.
+var EnhanceModulate = "100,110,100"
+
+// GifColors is the number of colors in GIF output for each quality when ImageMagick.GifLossy is set.
+var GifColors = map[img.Quality]int{
+	img.DEFAULT: 256,
+	img.LOW:     128,
+	img.LOWER:   64,
+}
+
+// SkipOptimisedMaxSize is the size in bytes of images that are too small to be optimised
+// when ImageMagick.SkipOptimised is set.
+var SkipOptimisedMaxSize = 1024
+
 // Debug is a flag for logging.
 // When true, all IM commands will be printed to stdout.
 var Debug = true
@@ -62,6 +181,15 @@ const (
 
 	MaxJxlLossyTargetSize = 1000 * 1000
 
+	// DefaultMaxParallelEncodes is the default value of ImageMagick.MaxParallelEncodes
+	DefaultMaxParallelEncodes = 2
+
+	// MinSearchQuality and MaxSearchQuality are the bounds of the quality search when ImageMagick.TargetSSIM is set.
+	MinSearchQuality = 30
+	MaxSearchQuality = 95
+	// DefaultQualitySearchSteps is the default value of ImageMagick.QualitySearchSteps
+	DefaultQualitySearchSteps = 6
+
 	JxlMime  = "image/jxl"
 	WebpMime = "image/webp"
 	AvifMime = "image/avif"
@@ -102,54 +230,93 @@ func NewImageMagick(im string, idi string) (*ImageMagick, error) {
 	}, nil
 }
 
+// DefaultThreadLimit returns the number of threads of each ImageMagick command when the
+// number of concurrent commands is workers, so all commands together use each CPU once.
+func DefaultThreadLimit(workers int) int {
+	if workers <= 0 {
+		return runtime.NumCPU()
+	}
+	return max(1, runtime.NumCPU()/workers)
+}
+
+// command returns ImageMagick command with the thread limit.
+func (p *ImageMagick) command(name string, args ...string) *exec.Cmd {
+	cmd := exec.Command(name, args...)
+	if p.ThreadLimit > 0 {
+		cmd.Env = append(os.Environ(), "MAGICK_THREAD_LIMIT="+strconv.Itoa(p.ThreadLimit))
+	}
+	return cmd
+}
+
 // Resize resizes an image to the given size preserving aspect ratio. No cropping applies.
 //
 // Format of the size argument is WIDTHxHEIGHT with any of the dimension could be dropped, e.g. 300, x200, 300x200.
 func (p *ImageMagick) Resize(config *img.TransformationConfig) (*img.Image, error) {
-	srcData := config.Src.Data
-	source, err := p.LoadImageInfo(config.Src)
+	source, err := p.getSourceInfo(config)
+	if err != nil {
+		return nil, err
+	}
+
+	args, target, mimeType, err := p.getResizeArgs(config, source)
+	if err != nil {
+		return nil, err
+	}
+
+	outputImageData, args, err := p.encode(config, source, args, mimeType)
 	if err != nil {
+		if retry := p.fallbackConfig(config, mimeType, err); retry != nil {
+			return p.Resize(retry)
+		}
 		return nil, err
 	}
+	setDebug(config, source, target, args, mimeType)
+
+	return p.withAvifSavings(config, withSize(img.NewPooledImage("", outputImageData, mimeType), config, source, target), p.Resize), nil
+}
 
+// getResizeArgs returns convert arguments, the target and MIME type of the output for resize.
+func (p *ImageMagick) getResizeArgs(config *img.TransformationConfig, source *img.Info) ([]string, *img.Info, string, error) {
 	resizeConfig, ok := config.Config.(*img.ResizeConfig)
 	if !ok {
-		return nil, fmt.Errorf("could not get resizeConfig")
+		return nil, nil, "", fmt.Errorf("could not get resizeConfig")
 	}
 
 	targetSize := resizeConfig.Size
 	target := &img.Info{
 		Opaque: source.Opaque,
 	}
-	err = internal.CalculateTargetSizeForResize(source, target, targetSize)
+	err := internal.CalculateTargetSizeForResize(source, target, targetSize)
 	if err != nil {
-		img.Log.Errorf("could not calculate target size for [%s], targetSize: [%s]\n", config.Src.Id, targetSize)
+		p.log().Errorf("could not calculate target size for [%s], targetSize: [%s]\n", config.Src.Id, targetSize)
 	}
+	targetSize = limitTargetSize(config, target, targetSize)
 	outputFormatArg, mimeType := getOutputFormat(source, target, config.SupportedFormats)
 
+	beforeInputOpts, fastDownscaleOpts := p.getFastDownscaleOptions(source, target)
+
+	colorProfileOpts, keepProfileOpts := p.getColorProfileOptions(source, config)
+
 	args := make([]string, 0)
+	args = append(args, beforeInputOpts...)
 	args = append(args, "-") //Input
 	args = append(args, getBeforeTransformConvertFormatOptions(config, source, mimeType)...)
+	args = append(args, colorProfileOpts...)
 	args = append(args, beforeResizeConvertOpts...)
+	args = append(args, fastDownscaleOpts...)
 	args = append(args, "-resize", targetSize)
-	args = append(args, getQualityOptions(source, config, mimeType)...)
+	args = append(args, p.getQualityOptions(source, config, mimeType)...)
 	args = append(args, p.AdditionalArgs...)
 	if p.GetAdditionalArgs != nil {
-		args = append(args, p.GetAdditionalArgs("resize", srcData, source, target)...)
+		args = append(args, p.GetAdditionalArgs("resize", config.Src.Data, source, target)...)
 	}
 	args = append(args, convertOpts...)
-	args = append(args, getConvertFormatOptions(source)...)
+	args = append(args, keepProfileOpts...)
+	args = append(args, p.getGifLossyOptions(config, source, mimeType)...)
+	args = append(args, getColorTypeOptions(config, source, target, mimeType)...)
+	args = append(args, getConvertFormatOptions(source, mimeType)...)
 	args = append(args, outputFormatArg) //Output
 
-	outputImageData, err := p.execImagemagick(bytes.NewReader(srcData), args, config.Src.Id)
-	if err != nil {
-		return nil, err
-	}
-
-	return &img.Image{
-		Data:     outputImageData,
-		MimeType: mimeType,
-	}, nil
+	return args, target, mimeType, nil
 }
 
 // FitToSize resizes input image to exact size with cropping everything that out of the bound.
@@ -157,120 +324,502 @@ func (p *ImageMagick) Resize(config *img.TransformationConfig) (*img.Image, erro
 //
 // Format of the size argument is WIDTHxHEIGHT, e.g. 300x200. Both dimensions must be included.
 func (p *ImageMagick) FitToSize(config *img.TransformationConfig) (*img.Image, error) {
-	srcData := config.Src.Data
-	source, err := p.LoadImageInfo(config.Src)
+	source, err := p.getSourceInfo(config)
+	if err != nil {
+		return nil, err
+	}
+
+	args, target, mimeType, err := p.getFitArgs(config, source)
+	if err != nil {
+		return nil, err
+	}
+
+	outputImageData, args, err := p.encode(config, source, args, mimeType)
 	if err != nil {
+		if retry := p.fallbackConfig(config, mimeType, err); retry != nil {
+			return p.FitToSize(retry)
+		}
 		return nil, err
 	}
+	setDebug(config, source, target, args, mimeType)
 
+	// Extent always produces the image of the target size, even when it's trimmed
+	result := img.NewPooledImage("", outputImageData, mimeType)
+	result.Width, result.Height = target.Width, target.Height
+	result.Frames = outputFrames(config, source)
+	return p.withAvifSavings(config, result, p.FitToSize), nil
+}
+
+// getFitArgs returns convert arguments, the target and MIME type of the output for fit.
+func (p *ImageMagick) getFitArgs(config *img.TransformationConfig, source *img.Info) ([]string, *img.Info, string, error) {
 	resizeConfig, ok := config.Config.(*img.ResizeConfig)
 	if !ok {
-		return nil, fmt.Errorf("could not get resizeConfig")
+		return nil, nil, "", fmt.Errorf("could not get resizeConfig")
 	}
 
 	targetSize := resizeConfig.Size
 	target := &img.Info{
 		Opaque: source.Opaque,
 	}
-	err = internal.CalculateTargetSizeForFit(target, targetSize)
+	err := internal.CalculateTargetSizeForFit(target, targetSize)
 	if err != nil {
-		img.Log.Errorf("could not calculate target size for [%s], targetSize: [%s]\n", config.Src.Id, targetSize)
+		p.log().Errorf("could not calculate target size for [%s], targetSize: [%s]\n", config.Src.Id, targetSize)
 	}
+	targetSize = limitTargetSize(config, target, targetSize)
 	outputFormatArg, mimeType := getOutputFormat(source, target, config.SupportedFormats)
 
+	beforeInputOpts, fastDownscaleOpts := p.getFastDownscaleOptions(source, target)
+
+	colorProfileOpts, keepProfileOpts := p.getColorProfileOptions(source, config)
+
 	args := make([]string, 0)
+	args = append(args, beforeInputOpts...)
 	args = append(args, "-") //Input
 	args = append(args, getBeforeTransformConvertFormatOptions(config, source, mimeType)...)
+	args = append(args, colorProfileOpts...)
 	args = append(args, beforeResizeConvertOpts...)
+	args = append(args, fastDownscaleOpts...)
 	args = append(args, "-resize", targetSize+"^")
 
-	args = append(args, getQualityOptions(source, config, mimeType)...)
+	args = append(args, p.getQualityOptions(source, config, mimeType)...)
 	args = append(args, p.AdditionalArgs...)
 	if p.GetAdditionalArgs != nil {
-		args = append(args, p.GetAdditionalArgs("fit", srcData, source, target)...)
+		args = append(args, p.GetAdditionalArgs("fit", config.Src.Data, source, target)...)
 	}
 	args = append(args, convertOpts...)
+	args = append(args, keepProfileOpts...)
 	args = append(args, cutToFitOpts...)
 	args = append(args, "-extent", targetSize)
-	args = append(args, getConvertFormatOptions(source)...)
+	args = append(args, p.getGifLossyOptions(config, source, mimeType)...)
+	args = append(args, getColorTypeOptions(config, source, target, mimeType)...)
+	args = append(args, getConvertFormatOptions(source, mimeType)...)
 	args = append(args, outputFormatArg) //Output
 
-	outputImageData, err := p.execImagemagick(bytes.NewReader(srcData), args, config.Src.Id)
+	return args, target, mimeType, nil
+}
+
+func (p *ImageMagick) Optimise(config *img.TransformationConfig) (*img.Image, error) {
+	source, err := p.getSourceInfo(config)
 	if err != nil {
 		return nil, err
 	}
 
-	return &img.Image{
-		Data:     outputImageData,
-		MimeType: mimeType,
-	}, nil
+	target := getOptimiseTarget(config, source)
+
+	if p.SkipOptimised {
+		if _, mimeType := getOutputFormat(source, target, config.SupportedFormats); p.isOptimised(config, source, target, mimeType) {
+			p.log().Printf("[%s] Source is already optimised, skipping encode\n", config.Src.Id)
+			setDebug(config, source, target, nil, config.Src.MimeType)
+			if config.Debug != nil {
+				config.Debug.Original = true
+			}
+			return sourceAsIs(config, source), nil
+		}
+	}
+
+	if p.ParallelOptimise {
+		candidates := getCandidateFormats(source, target, config.SupportedFormats)
+		if len(candidates) > 1 {
+			result, err := p.optimiseCandidates(config, source, target, candidates)
+			if err != nil {
+				if retry := p.fallbackConfig(config, candidates[0].mimeType, err); retry != nil {
+					return p.Optimise(retry)
+				}
+			}
+			return result, err
+		}
+	}
+
+	outputFormatArg, mimeType := getOutputFormat(source, target, config.SupportedFormats)
+
+	result, args, err := p.encode(config, source, p.getOptimiseArgs(config, source, target, outputFormatArg, mimeType), mimeType)
+	if err != nil {
+		if retry := p.fallbackConfig(config, mimeType, err); retry != nil {
+			return p.Optimise(retry)
+		}
+		return nil, err
+	}
+	setDebug(config, source, target, args, mimeType)
+
+	return p.withAvifSavings(config, p.optimiseResult(config, source, target, result, mimeType), p.Optimise), nil
 }
 
-func (p *ImageMagick) Optimise(config *img.TransformationConfig) (*img.Image, error) {
-	srcData := config.Src.Data
-	source, err := p.LoadImageInfo(config.Src)
+// Plan returns the transformation that would be done for the operation without encoding the image.
+// "op" is the name of the operation: "optimise", "resize" or "fit".
+// When ParallelOptimise is set, the plan of optimise uses the preferred output format,
+// because the smallest one is only known after encoding. When TargetSSIM is set, the quality
+// is the default one, because the search requires encoding.
+func (p *ImageMagick) Plan(op string, config *img.TransformationConfig) (*img.Debug, error) {
+	source, err := p.getSourceInfo(config)
 	if err != nil {
 		return nil, err
 	}
 
+	var (
+		args     []string
+		target   *img.Info
+		mimeType string
+	)
+	switch op {
+	case "resize":
+		args, target, mimeType, err = p.getResizeArgs(config, source)
+	case "fit":
+		args, target, mimeType, err = p.getFitArgs(config, source)
+	case "optimise":
+		var outputFormatArg string
+		target = getOptimiseTarget(config, source)
+		outputFormatArg, mimeType = getOutputFormat(source, target, config.SupportedFormats)
+		args = p.getOptimiseArgs(config, source, target, outputFormatArg, mimeType)
+	default:
+		err = fmt.Errorf("unknown operation [%s]", op)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &img.Debug{}
+	setDebug(&img.TransformationConfig{Debug: plan}, source, target, args, mimeType)
+	return plan, nil
+}
+
+// getOptimiseTarget returns the target of optimise, which is the source limited by the config.
+func getOptimiseTarget(config *img.TransformationConfig, source *img.Info) *img.Info {
 	target := &img.Info{
 		Opaque: source.Opaque,
-		Width:  source.Width,
-		Height: source.Height,
 	}
-	outputFormatArg, mimeType := getOutputFormat(source, target, config.SupportedFormats)
+	target.Width, target.Height = config.LimitSize(source.Width, source.Height)
+	return target
+}
+
+// optimiseCandidates encodes the source image to all candidate formats in parallel and
+// returns the smallest result.
+func (p *ImageMagick) optimiseCandidates(config *img.TransformationConfig, source *img.Info, target *img.Info, candidates []outputFormat) (*img.Image, error) {
+	maxParallel := p.MaxParallelEncodes
+	if maxParallel <= 0 {
+		maxParallel = DefaultMaxParallelEncodes
+	}
+
+	var (
+		results = make([]*bytes.Buffer, len(candidates))
+		args    = make([][]string, len(candidates))
+		errs    = make([]error, len(candidates))
+		sem     = make(chan struct{}, maxParallel)
+		wg      sync.WaitGroup
+	)
+	for i, c := range candidates {
+		wg.Add(1)
+		go func(i int, c outputFormat) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			results[i], args[i], errs[i] = p.encode(config, source, p.getOptimiseArgs(config, source, target, c.arg, c.mimeType), c.mimeType)
+		}(i, c)
+	}
+	wg.Wait()
+
+	best := -1
+	for i, c := range candidates {
+		if errs[i] != nil {
+			p.log().Printf("[%s] WARNING: could not encode candidate [%s]: %s", config.Src.Id, c.mimeType, errs[i])
+			continue
+		}
+		p.log().Printf("[%s] Candidate [%s] size is [%d]", config.Src.Id, c.mimeType, results[i].Len())
+		if best == -1 || results[i].Len() < results[best].Len() {
+			best = i
+		}
+	}
+	if best == -1 {
+		return nil, errs[0]
+	}
+	if candidates[best].mimeType == AvifMime && config.AvifMinSavings > 0 {
+		other := -1
+		for i, c := range candidates {
+			if errs[i] == nil && c.mimeType != AvifMime && (other == -1 || results[i].Len() < results[other].Len()) {
+				other = i
+			}
+		}
+		if other != -1 && !hasAvifSavings(results[best].Len(), results[other].Len(), config.AvifMinSavings) {
+			p.log().Printf("[%s] AVIF size [%d] is not [%.1f%%] smaller than [%s], using it", config.Src.Id, results[best].Len(), config.AvifMinSavings, candidates[other].mimeType)
+			best = other
+		}
+	}
+
+	for i := range results {
+		if i != best {
+			img.PutBuffer(results[i])
+		}
+	}
+
+	setDebug(config, source, target, args[best], candidates[best].mimeType)
+
+	return p.optimiseResult(config, source, target, results[best], candidates[best].mimeType), nil
+}
+
+func (p *ImageMagick) getOptimiseArgs(config *img.TransformationConfig, source *img.Info, target *img.Info, outputFormatArg string, mimeType string) []string {
+	colorProfileOpts, keepProfileOpts := p.getColorProfileOptions(source, config)
 
 	args := make([]string, 0)
 	args = append(args, "-") //Input
 	args = append(args, getBeforeTransformConvertFormatOptions(config, source, mimeType)...)
+	args = append(args, colorProfileOpts...)
 	args = append(args, beforeResizeConvertOpts...)
-	args = append(args, getQualityOptions(source, config, mimeType)...)
+	if target.Width != source.Width || target.Height != source.Height {
+		args = append(args, "-resize", fmt.Sprintf("%dx%d", target.Width, target.Height))
+	}
+	args = append(args, p.getQualityOptions(source, config, mimeType)...)
 	args = append(args, p.AdditionalArgs...)
 	if p.GetAdditionalArgs != nil {
-		args = append(args, p.GetAdditionalArgs("optimise", srcData, source, target)...)
+		args = append(args, p.GetAdditionalArgs("optimise", config.Src.Data, source, target)...)
 	}
 	args = append(args, convertOpts...)
-	args = append(args, getConvertFormatOptions(source)...)
+	args = append(args, keepProfileOpts...)
+	args = append(args, p.getGifLossyOptions(config, source, mimeType)...)
+	args = append(args, getColorTypeOptions(config, source, target, mimeType)...)
+	args = append(args, getConvertFormatOptions(source, mimeType)...)
 	args = append(args, outputFormatArg) //Output
 
-	result, err := p.execImagemagick(bytes.NewReader(srcData), args, config.Src.Id)
+	return args
+}
+
+// limitTargetSize applies img.TransformationConfig.Scale and MaxSize to the target
+// and returns the new target size. Returns the original size if it's not changed.
+func limitTargetSize(config *img.TransformationConfig, target *img.Info, targetSize string) string {
+	if target.Width <= 0 || target.Height <= 0 {
+		return targetSize
+	}
+
+	width, height := config.LimitSize(target.Width, target.Height)
+	if width == target.Width && height == target.Height {
+		return targetSize
+	}
+	target.Width, target.Height = width, height
+
+	return fmt.Sprintf("%dx%d", width, height)
+}
+
+// optimiseResult returns the original image if optimised version is bigger
+// and colors of the image are not changed, including conversion to sRGB.
+func (p *ImageMagick) optimiseResult(config *img.TransformationConfig, source *img.Info, target *img.Info, result *bytes.Buffer, mimeType string) *img.Image {
+	srcData := config.Src.Data
+	colorProfileOpts, _ := p.getColorProfileOptions(source, config)
+	if result.Len() > len(srcData) && len(config.ReplaceColors) == 0 && !config.Enhance && config.OutputFrames(source.Frames) == source.Frames &&
+		len(colorProfileOpts) == 0 && source.ColorSpace != "CMYK" {
+		p.log().Printf("[%s] WARNING: Optimised size [%d] is more than original [%d], fallback to original", config.Src.Id, result.Len(), len(srcData))
+		img.PutBuffer(result)
+		if config.Debug != nil {
+			config.Debug.Original = true
+		}
+		return &img.Image{
+			Data:   srcData,
+			Width:  source.Width,
+			Height: source.Height,
+			Frames: source.Frames,
+		}
+	}
+
+	return withSize(img.NewPooledImage("", result, mimeType), config, source, target)
+}
+
+// isOptimised returns true if encoding the source to the output format would not make it smaller.
+func (p *ImageMagick) isOptimised(config *img.TransformationConfig, source *img.Info, target *img.Info, outputMimeType string) bool {
+	transformed := target.Width != source.Width || target.Height != source.Height || config.TrimBorder ||
+		len(config.ReplaceColors) > 0 || config.Enhance || config.OutputFrames(source.Frames) != source.Frames || config.Depth > 0
+	if transformed || len(source.Profiles) > 0 || source.ColorSpace == "CMYK" {
+		return false
+	}
+	if len(config.Src.Data) <= SkipOptimisedMaxSize {
+		return true
+	}
+
+	sameFormat := outputMimeType == "image/"+strings.ToLower(source.Format) || (len(outputMimeType) == 0 && source.Format == "JPEG")
+	if !sameFormat || source.Illustration || source.Frames > 1 {
+		return false
+	}
+	quality := p.getQualityOptions(source, config, outputMimeType)
+	if len(quality) == 0 {
+		// Quality of modern formats could be unknown, they are re-encoded only to lower quality
+		return source.Quality == 0 && config.Quality == img.DEFAULT && outputMimeType != ""
+	}
+	outputQuality, _ := strconv.Atoi(quality[1])
+	return source.Quality > 0 && source.Quality <= outputQuality
+}
+
+// withSize sets dimensions of the result image to the target size and the number of frames.
+// Dimensions are unknown when border is trimmed, so they are not set.
+func withSize(result *img.Image, config *img.TransformationConfig, source *img.Info, target *img.Info) *img.Image {
+	if !config.TrimBorder {
+		result.Width, result.Height = target.Width, target.Height
+	}
+	result.Frames = outputFrames(config, source)
+	return result
+}
+
+// outputFrames returns the number of frames of the output image, see img.TransformationConfig.OutputFrames.
+func outputFrames(config *img.TransformationConfig, source *img.Info) int {
+	return config.OutputFrames(source.Frames)
+}
+
+// encode runs convert command with the given arguments. If TargetSSIM is set, then
+// it searches for the lowest quality of lossy output that meets the target.
+// Returns the output and the arguments that produced it.
+func (p *ImageMagick) encode(config *img.TransformationConfig, source *img.Info, args []string, mimeType string) (*bytes.Buffer, []string, error) {
+	span := config.Span.Child("imagemagick.convert")
+	span.SetAttribute("image.mime_type", mimeType)
+	defer span.End()
+
+	lossy := mimeType == WebpMime || mimeType == AvifMime || mimeType == JxlMime || (len(mimeType) == 0 && source.Format == "JPEG")
+	if p.TargetSSIM <= 0 || !lossy || source.Illustration || source.Frames > 1 {
+		result, err := p.execImagemagick(bytes.NewReader(config.Src.Data), args, config.Src.Id)
+		return result, args, err
+	}
+
+	result, quality, err := p.searchQuality(config, args)
 	if err != nil {
-		return nil, err
+		p.log().Printf("[%s] WARNING: could not find quality for target SSIM, using default quality: %s\n", config.Src.Id, err)
+		result, err = p.execImagemagick(bytes.NewReader(config.Src.Data), args, config.Src.Id)
+		return result, args, err
 	}
 
-	if len(result) > len(srcData) {
-		img.Log.Printf("[%s] WARNING: Optimised size [%d] is more than original [%d], fallback to original", config.Src.Id, len(result), len(srcData))
-		result = srcData
-		mimeType = ""
+	return result, withQuality(args, quality), nil
+}
+
+// searchQuality uses binary search to find the lowest quality between MinSearchQuality
+// and MaxSearchQuality with SSIM not less than TargetSSIM. SSIM is calculated against
+// the same transformation encoded to lossless PNG. Returns the output and its quality.
+func (p *ImageMagick) searchQuality(config *img.TransformationConfig, args []string) (*bytes.Buffer, int, error) {
+	imgId := config.Src.Id
+	reference, err := p.execImagemagick(bytes.NewReader(config.Src.Data), withOutput(args, "png:-"), imgId)
+	if err != nil {
+		return nil, 0, err
 	}
+	defer img.PutBuffer(reference)
+	referenceImg := &img.Image{Id: imgId, Data: reference.Bytes()}
 
-	return &img.Image{
-		Data:     result,
-		MimeType: mimeType,
-	}, nil
+	steps := p.QualitySearchSteps
+	if steps <= 0 {
+		steps = DefaultQualitySearchSteps
+	}
+
+	var (
+		best        *bytes.Buffer
+		bestQuality int
+		low         = MinSearchQuality
+		high        = MaxSearchQuality
+	)
+	for i := 0; i < steps && low <= high; i++ {
+		quality := (low + high) / 2
+		candidate, err := p.execImagemagick(bytes.NewReader(config.Src.Data), withQuality(args, quality), imgId)
+		if err == nil {
+			var ssim float64
+			ssim, err = p.CompareSSIM(&img.Image{Id: imgId, Data: candidate.Bytes()}, referenceImg)
+			if err != nil {
+				img.PutBuffer(candidate)
+			} else if ssim >= p.TargetSSIM {
+				if best != nil {
+					img.PutBuffer(best)
+				}
+				best, bestQuality = candidate, quality
+				high = quality - 1
+			} else {
+				img.PutBuffer(candidate)
+				low = quality + 1
+			}
+		}
+		if err != nil {
+			if best != nil {
+				img.PutBuffer(best)
+			}
+			return nil, 0, err
+		}
+	}
+
+	if best == nil {
+		p.log().Printf("[%s] Target SSIM [%.4f] is not reached, using quality [%d]\n", imgId, p.TargetSSIM, MaxSearchQuality)
+		best, err = p.execImagemagick(bytes.NewReader(config.Src.Data), withQuality(args, MaxSearchQuality), imgId)
+		return best, MaxSearchQuality, err
+	}
+
+	p.log().Printf("[%s] Found quality [%d] for target SSIM [%.4f]\n", imgId, bestQuality, p.TargetSSIM)
+	return best, bestQuality, nil
 }
 
-func (p *ImageMagick) execImagemagick(in *bytes.Reader, args []string, imgId string) ([]byte, error) {
-	var out, cmderr bytes.Buffer
-	cmd := exec.Command(p.convertCmd)
+// withQuality returns a copy of convert arguments with the given quality.
+func withQuality(args []string, quality int) []string {
+	result := append([]string{}, args...)
+	for i := 0; i < len(result)-1; i++ {
+		if result[i] == "-quality" {
+			result[i+1] = strconv.Itoa(quality)
+			return result
+		}
+	}
+
+	output := result[len(result)-1]
+	return append(append(result[:len(result)-1], "-quality", strconv.Itoa(quality)), output)
+}
+
+// getQuality returns the value of -quality argument or zero if it's not set.
+func getQuality(args []string) int {
+	for i := 0; i < len(args)-1; i++ {
+		if args[i] == "-quality" {
+			quality, _ := strconv.Atoi(args[i+1])
+			return quality
+		}
+	}
+	return 0
+}
+
+// setDebug records the decisions made during the transformation if config.Debug is set.
+func setDebug(config *img.TransformationConfig, source *img.Info, target *img.Info, args []string, mimeType string) {
+	if config.Debug == nil {
+		return
+	}
+	config.Debug.Source = source
+	config.Debug.Target = target
+	config.Debug.MimeType = mimeType
+	config.Debug.Quality = getQuality(args)
+	config.Debug.Args = args
+}
+
+// withOutput returns a copy of convert arguments with the given output.
+func withOutput(args []string, output string) []string {
+	result := append([]string{}, args...)
+	result[len(result)-1] = output
+	return result
+}
+
+// execImagemagick runs convert command and returns the output in a buffer from img pool.
+func (p *ImageMagick) execImagemagick(in *bytes.Reader, args []string, imgId string) (out *bytes.Buffer, err error) {
+	if p.Metrics != nil {
+		defer p.observe("convert", time.Now(), &err)
+	}
+	if p.runner != nil {
+		if Debug {
+			p.log().Printf("[%s] Running in-process convert, args '%v'\n", imgId, args)
+		}
+		return p.runner.convert(in, args)
+	}
 
-	cmd.Args = append(cmd.Args, args...)
+	var cmderr bytes.Buffer
+	out = img.GetBuffer()
+	cmd := p.command(p.convertCmd, args...)
 
 	cmd.Stdin = in
-	cmd.Stdout = &out
+	cmd.Stdout = out
 	cmd.Stderr = &cmderr
 
 	if Debug {
-		img.Log.Printf("[%s] Running resize command, args '%v'\n", imgId, cmd.Args)
+		p.log().Printf("[%s] Running resize command, args '%v'\n", imgId, cmd.Args)
 	}
-	err := cmd.Run()
+	err = cmd.Run()
 	if err != nil {
-		img.Log.Printf("[%s] Error executing convert command: %s\n", imgId, err.Error())
-		img.Log.Printf("[%s] ERROR: %s\n", imgId, cmderr.String())
-		return nil, fmt.Errorf("Error executing convert command: %w\nStderr: [%s]", err, strings.TrimSpace(cmderr.String()))
+		img.PutBuffer(out)
+		p.log().Printf("[%s] Error executing convert command: %s\n", imgId, err.Error())
+		p.log().Printf("[%s] ERROR: %s\n", imgId, cmderr.String())
+		return nil, fmt.Errorf("%w: %w", img.ErrEncodeFailed, &img.CommandError{Command: "convert", Err: err, Stderr: strings.TrimSpace(cmderr.String())})
 	}
 
-	return out.Bytes(), nil
+	return out, nil
 }
 
 func (p *ImageMagick) execIllustration(in io.Reader) bool {
@@ -283,42 +832,113 @@ func (p *ImageMagick) execIllustration(in io.Reader) bool {
 
 	err := cmd.Run()
 	if err != nil {
-		img.Log.Printf("Error executing illustration command: %s\n", err.Error())
-		img.Log.Printf("ERROR: %s\n", cmderr.String())
+		p.log().Printf("Error executing illustration command: %s\n", err.Error())
+		p.log().Printf("ERROR: %s\n", cmderr.String())
 		return false
 	}
 
 	return string(out.Bytes()) == "true"
 }
 
-func (p *ImageMagick) LoadImageInfo(src *img.Image) (*img.Info, error) {
+// CompareSSIM returns structural similarity (SSIM) of two images using ImageMagick, where 1 means
+// that images are identical. Images must have the same dimensions.
+// It could be used as img.Shadow.Compare.
+func (p *ImageMagick) CompareSSIM(a *img.Image, b *img.Image) (float64, error) {
 	var out, cmderr bytes.Buffer
-	imgId := src.Id
-	in := bytes.NewReader(src.Data)
-	cmd := exec.Command(p.identifyCmd)
-	cmd.Args = append(cmd.Args, "-format", "%m %Q %[opaque] %w %h", "-")
 
-	cmd.Stdin = in
+	second, secondW, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer second.Close()
+	go func() {
+		_, _ = secondW.Write(b.Data)
+		_ = secondW.Close()
+	}()
+
+	// The second image is passed as the first extra file which is fd 3 in the child process
+	cmd := p.command(p.convertCmd, "-", "fd:3", "-metric", "SSIM", "-compare", "-format", "%[distortion]", "info:")
+	cmd.Stdin = bytes.NewReader(a.Data)
+	cmd.ExtraFiles = []*os.File{second}
 	cmd.Stdout = &out
 	cmd.Stderr = &cmderr
 
-	if Debug {
-		img.Log.Printf("[%s] Running identify command, args '%v'\n", imgId, cmd.Args)
+	err = cmd.Run()
+	if err != nil {
+		return 0, &img.CommandError{Command: "compare", Err: err, Stderr: strings.TrimSpace(cmderr.String())}
 	}
-	err := cmd.Run()
+
+	return strconv.ParseFloat(strings.TrimSpace(out.String()), 64)
+}
+
+// getSourceInfo returns information about the source image reusing
+// config.SrcInfo if it's already loaded.
+func (p *ImageMagick) getSourceInfo(config *img.TransformationConfig) (*img.Info, error) {
+	if config.SrcInfo == nil {
+		span := config.Span.Child("imagemagick.identify")
+		info, err := p.LoadImageInfo(config.Src)
+		span.SetError(err)
+		span.End()
+		if err != nil {
+			return nil, err
+		}
+		config.SrcInfo = info
+	}
+
+	return config.SrcInfo, p.checkAnimationLimits(config.SrcInfo)
+}
+
+// checkAnimationLimits returns an error if animated image exceeds MaxAnimationFrames or MaxAnimationSize.
+func (p *ImageMagick) checkAnimationLimits(info *img.Info) error {
+	if info.Frames <= 1 {
+		return nil
+	}
+	if p.MaxAnimationFrames > 0 && info.Frames > p.MaxAnimationFrames {
+		return fmt.Errorf("%w, animation has [%d] frames, which is more than allowed [%d]", img.ErrTooLarge, info.Frames, p.MaxAnimationFrames)
+	}
+	if p.MaxAnimationSize > 0 && info.Width*info.Height > p.MaxAnimationSize {
+		return fmt.Errorf("%w, animation size [%dx%d] is more than allowed [%d] pixels", img.ErrTooLarge, info.Width, info.Height, p.MaxAnimationSize)
+	}
+	return nil
+}
+
+// LoadImageInfo returns information about the image. Returns img.HttpError with
+// 415 code if the image could not be identified, e.g. it's an HTML page or truncated file.
+func (p *ImageMagick) LoadImageInfo(src *img.Image) (*img.Info, error) {
+	out, err := p.execIdentify(src, identifyFormat)
 	if err != nil {
-		img.Log.Printf("[%s] Error executing identify command: %s\n", err.Error(), imgId)
-		img.Log.Printf("[%s] ERROR: %s\n", cmderr.String(), imgId)
-		return nil, fmt.Errorf("Error executing identify command: %w\nStderr: [%s]", err, strings.TrimSpace(cmderr.String()))
+		return nil, img.ErrUnsupportedFormat
 	}
 
+	// Identify outputs properties for each frame on a separate line
+	frames := strings.Split(strings.TrimSpace(out), "\n")
+	firstFrame := frames[0]
 	imageInfo := &img.Info{
-		Size:         in.Size(),
+		Size:         int64(len(src.Data)),
 		Illustration: false,
+		Frames:       len(frames),
 	}
-	_, err = fmt.Sscanf(out.String(), "%s %d %t %d %d", &imageInfo.Format, &imageInfo.Quality, &imageInfo.Opaque, &imageInfo.Width, &imageInfo.Height)
+	_, err = fmt.Sscanf(firstFrame, "%s %d %t %d %d", &imageInfo.Format, &imageInfo.Quality, &imageInfo.Opaque, &imageInfo.Width, &imageInfo.Height)
 	if err != nil {
-		return nil, err
+		p.log().Printf("[%s] Could not parse identify output [%s]: %s\n", src.Id, firstFrame, err)
+		return nil, img.ErrUnsupportedFormat
+	}
+	parts := strings.Split(firstFrame, "|")
+	fields := strings.Fields(parts[0])
+	if len(fields) > 5 {
+		imageInfo.ColorSpace = fields[5]
+	}
+	if len(parts) > 1 && len(strings.TrimSpace(parts[1])) > 0 {
+		imageInfo.Profiles = strings.Split(strings.TrimSpace(parts[1]), ",")
+	}
+	if len(parts) > 2 {
+		imageInfo.ColorProfile = strings.TrimSpace(parts[2])
+	}
+	if len(parts) > 3 {
+		imageInfo.Delay, _ = strconv.Atoi(strings.TrimSpace(parts[3]))
+	}
+	if len(parts) > 4 {
+		imageInfo.Orientation = strings.TrimSpace(parts[4])
 	}
 
 	if imageInfo.Format == "PNG" {
@@ -329,10 +949,50 @@ func (p *ImageMagick) LoadImageInfo(src *img.Image) (*img.Info, error) {
 			return nil, err
 		}
 	}
+	if p.ReduceColorTypes && imageInfo.Frames == 1 && (imageInfo.Format == "PNG" || imageInfo.Format == "JPEG") {
+		p.loadColorType(src, imageInfo)
+	}
 
 	return imageInfo, nil
 }
 
+func (p *ImageMagick) execIdentify(src *img.Image, format string) (_ string, err error) {
+	if p.Metrics != nil {
+		defer p.observe("identify", time.Now(), &err)
+	}
+	imgId := src.Id
+	if p.runner != nil {
+		if Debug {
+			p.log().Printf("[%s] Running in-process identify\n", imgId)
+		}
+		return p.runner.identify(src.Data, format)
+	}
+
+	var out, cmderr bytes.Buffer
+	cmd := p.command(p.identifyCmd, "-format", format, "-")
+
+	cmd.Stdin = bytes.NewReader(src.Data)
+	cmd.Stdout = &out
+	cmd.Stderr = &cmderr
+
+	if Debug {
+		p.log().Printf("[%s] Running identify command, args '%v'\n", imgId, cmd.Args)
+	}
+	err = cmd.Run()
+	if err != nil {
+		p.log().Printf("[%s] Error executing identify command: %s\n", err.Error(), imgId)
+		p.log().Printf("[%s] ERROR: %s\n", cmderr.String(), imgId)
+		return "", &img.CommandError{Command: "identify", Err: err, Stderr: strings.TrimSpace(cmderr.String())}
+	}
+
+	return out.String(), nil
+}
+
+// observe records the duration of the command that started at the given time and its error in Metrics.
+func (p *ImageMagick) observe(command string, start time.Time, err *error) {
+	p.Metrics.ObserveCommand(command, time.Since(start), *err)
+}
+
 // isIllustration returns true if image is cartoon like, including
 // icons, logos, illustrations.
 //
@@ -387,8 +1047,86 @@ func getOutputFormat(src *img.Info, target *img.Info, supportedFormats []string)
 	return "-", ""
 }
 
-func getConvertFormatOptions(source *img.Info) []string {
+type outputFormat struct {
+	arg      string
+	mimeType string
+}
+
+// getCandidateFormats returns the list of next generation formats that
+// the image could be encoded to. It follows the same restrictions as getOutputFormat.
+func getCandidateFormats(src *img.Info, target *img.Info, supportedFormats []string) []outputFormat {
+	var candidates []outputFormat
+	targetSize := target.Width * target.Height
+	for _, f := range supportedFormats {
+		switch {
+		case f == AvifMime && src.Format != "GIF" && !src.Illustration && targetSize < MaxAVIFTargetSize && targetSize != 0:
+			candidates = append(candidates, outputFormat{"avif:-", AvifMime})
+		case f == WebpMime && src.Height < MaxWebpHeight && src.Width < MaxWebpWidth:
+			candidates = append(candidates, outputFormat{"webp:-", WebpMime})
+		}
+	}
+
+	return candidates
+}
+
+// getColorProfileOptions returns options to convert the image to sRGB color space using
+// embedded ICC profile. CMYK images without embedded profile are converted using CMYKProfile.
+// The profile is removed after conversion, because browsers assume sRGB for untagged images.
+//
+// Wide-gamut images keep their profile when it's requested by PreserveWideGamut or
+// config.WideGamut. In that case the second returned slice has options that must be added
+// after convertOpts, so the profile is not excluded from PNG output.
+func (p *ImageMagick) getColorProfileOptions(source *img.Info, config *img.TransformationConfig) ([]string, []string) {
+	if (p.PreserveWideGamut || config.WideGamut) && source.HasProfile("icc") && internal.IsWideGamutProfile(source.ColorProfile) {
+		return nil, []string{"-define", "png:exclude-chunk=bKGD,cHRM,EXIF,gAMA,iTXt,sRGB,tEXt,tIME,zCCP,zTXt,date"}
+	}
+
+	if len(p.SRGBProfile) == 0 {
+		return nil, nil
+	}
+
 	var opts []string
+	hasIcc := source.HasProfile("icc")
+	if !hasIcc && source.ColorSpace == "CMYK" && len(p.CMYKProfile) > 0 {
+		opts = append(opts, "-profile", p.CMYKProfile)
+	}
+	if hasIcc || len(opts) > 0 {
+		opts = append(opts, "-profile", p.SRGBProfile, "+profile", "icc")
+	}
+
+	return opts, nil
+}
+
+// getFastDownscaleOptions returns options for the cheap downscale of large images
+// to the intermediate size before the high-quality resize. JPEG images are scaled
+// while decoding, other formats are scaled using box filter after reading.
+//
+// The first returned slice must be added before the input image.
+func (p *ImageMagick) getFastDownscaleOptions(source *img.Info, target *img.Info) ([]string, []string) {
+	if !p.FastDownscale || source.Format == "GIF" {
+		return nil, nil
+	}
+
+	scale := internal.CalculateFastDownscale(source, target)
+	if scale == 0 {
+		return nil, nil
+	}
+
+	if source.Format == "JPEG" {
+		width := int(math.Ceil(float64(source.Width) * scale))
+		height := int(math.Ceil(float64(source.Height) * scale))
+		return []string{"-define", fmt.Sprintf("jpeg:size=%dx%d", width, height)}, nil
+	}
+
+	return nil, []string{"-scale", fmt.Sprintf("%.2f%%", math.Ceil(scale*10000)/100)}
+}
+
+func getConvertFormatOptions(source *img.Info, outputMimeType string) []string {
+	var opts []string
+	if source.Format == "GIF" && source.Frames > 1 && len(outputMimeType) == 0 {
+		// Converting coalesced frames back to the frame-delta GIF
+		opts = append(opts, "-layers", "Optimize")
+	}
 	if source.Illustration {
 		opts = append(opts, "-define", "webp:lossless=true", "-quality", "100", "-define", "jxl:effort=9")
 	} else {
@@ -401,66 +1139,99 @@ func getConvertFormatOptions(source *img.Info) []string {
 	return opts
 }
 
+// getGifLossyOptions returns options for lossy optimisation of GIF output when GifLossy is set.
+// They must be added before getConvertFormatOptions, so frames are optimised with the fuzz.
+func (p *ImageMagick) getGifLossyOptions(config *img.TransformationConfig, source *img.Info, outputMimeType string) []string {
+	if p.GifLossy <= 0 || source.Format != "GIF" || len(outputMimeType) > 0 {
+		return nil
+	}
+
+	var opts []string
+	if source.Frames > 1 {
+		opts = append(opts, "-layers", "RemoveDups")
+	}
+	colors, ok := GifColors[config.Quality]
+	if !ok {
+		colors = GifColors[img.DEFAULT]
+	}
+	if colors > 0 {
+		opts = append(opts, "-colors", strconv.Itoa(colors))
+	}
+	if source.Frames > 1 {
+		// Fuzz is used by "-layers Optimize" when comparing frames
+		opts = append(opts, "-fuzz", fmt.Sprintf("%g%%", p.GifLossy))
+	}
+
+	return opts
+}
+
+// getSampleFramesOptions returns options to keep every FrameStep frame of animations that
+// are longer than config.MaxFrames. Delay is multiplied by the step, so the duration is kept
+// for animations with the same delay between frames. Frames must be coalesced before.
+func getSampleFramesOptions(config *img.TransformationConfig, source *img.Info) []string {
+	step := config.FrameStep(source.Frames)
+	if config.Static || step <= 1 {
+		return nil
+	}
+
+	deleted := make([]string, 0, source.Frames)
+	for i := 0; i < source.Frames; i++ {
+		if i%step != 0 {
+			deleted = append(deleted, strconv.Itoa(i))
+		}
+	}
+	opts := []string{"-delete", strings.Join(deleted, ",")}
+	if source.Delay > 0 {
+		opts = append(opts, "-set", "delay", strconv.Itoa(source.Delay*step))
+	}
+	return opts
+}
+
 func getBeforeTransformConvertFormatOptions(config *img.TransformationConfig, source *img.Info, outputMimeType string) []string {
 	var opts []string
 
-	if outputMimeType == "image/webp" && source.Format == "GIF" {
+	if config.Static && source.Frames > 1 {
+		// Keeping only the first frame
+		opts = append(opts, "-delete", "1--1")
+	}
+	// Animated GIFs could have frames that only contain changes from the previous frame,
+	// so we need to restore full frames before any transformations.
+	sampleOpts := getSampleFramesOptions(config, source)
+	if (source.Format == "GIF" && (outputMimeType == WebpMime || source.Frames > 1)) || len(sampleOpts) > 0 {
 		opts = append(opts, "-coalesce")
 	}
+	opts = append(opts, sampleOpts...)
 	if config.TrimBorder {
 		opts = append(opts, "-trim")
 	}
+	if len(config.ReplaceColors) > 0 {
+		opts = append(opts, "-fuzz", fmt.Sprintf("%g%%", config.Fuzz))
+		for _, c := range config.ReplaceColors {
+			opts = append(opts, "-fill", "#"+c.To, "-opaque", "#"+c.From)
+		}
+	}
+	if config.Enhance {
+		opts = append(opts, "-auto-level", "-auto-gamma", "-modulate", EnhanceModulate)
+	}
+	if config.Depth > 0 {
+		opts = append(opts, "-depth", strconv.Itoa(config.Depth))
+	}
 
 	return opts
 }
 
-func getQualityOptions(source *img.Info, config *img.TransformationConfig, outputMimeType string) []string {
-	var quality int
-
-	img.Log.Printf("[%s] Getting quality for the image, source quality: %d, quality: %d, output type: %s", config.Src.Id, source.Quality, config.Quality, outputMimeType)
+func (p *ImageMagick) getQualityOptions(source *img.Info, config *img.TransformationConfig, outputMimeType string) []string {
+	p.log().Printf("[%s] Getting quality for the image, source quality: %d, quality: %d, output type: %s", config.Src.Id, source.Quality, config.Quality, outputMimeType)
 
-	if source.Illustration {
-		return []string{}
-	}
-
-	switch {
-	case outputMimeType == AvifMime:
-		switch {
-		case source.Quality > 85:
-			quality = 70
-		case source.Quality > 75:
-			quality = 60
-		default:
-			quality = 50
-		}
-	case outputMimeType == JxlMime:
-		switch {
-		case source.Quality > 85:
-			quality = 82
-		case source.Quality > 75:
-			quality = 72
-		default:
-			quality = 62
-		}
-	case source.Quality == 100:
-		quality = 82
-	case config.Quality != img.DEFAULT:
-		quality = source.Quality
+	ladder := p.QualityLadder
+	if ladder == nil {
+		ladder = DefaultQualityLadder
 	}
 
+	quality := ladder.Quality(source, config.Quality, outputMimeType)
 	if quality == 0 {
 		return []string{}
 	}
 
-	// If using lossy compression, then we can go lower
-	if quality != 100 {
-		switch config.Quality {
-		case img.LOW:
-			quality -= 10
-		case img.LOWER:
-			quality -= 20
-		}
-	}
-
 	return []string{"-quality", strconv.Itoa(quality)}
 }
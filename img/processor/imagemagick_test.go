@@ -2,14 +2,22 @@ package processor_test
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"github.com/Pixboost/transformimgs/v8/img"
 	"github.com/Pixboost/transformimgs/v8/img/processor"
+	"image"
+	"image/color"
+	"image/png"
 	"io/ioutil"
+	"math"
+	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"reflect"
+	"runtime"
 	"strconv"
 	"strings"
 	"testing"
@@ -135,12 +143,14 @@ func TestImageMagick_GetAdditionalArgs(t *testing.T) {
 		t.Errorf("Expected source image to be 201318 bytes, but got [%d]", len(aImage))
 	}
 	if !reflect.DeepEqual(aSource, &img.Info{
-		Format:  "PNG",
-		Quality: 100,
-		Opaque:  true,
-		Width:   400,
-		Height:  400,
-		Size:    201318,
+		Format:     "PNG",
+		Quality:    100,
+		Opaque:     true,
+		Width:      400,
+		Height:     400,
+		Size:       201318,
+		ColorSpace: "sRGB",
+		Frames:     1,
 	}) {
 		t.Errorf("Source image error: %+v", aSource)
 	}
@@ -381,6 +391,99 @@ func TestImageMagickProcessor_Optimise_Avif_Webp(t *testing.T) {
 	}
 }
 
+func TestImageMagickProcessor_Optimise_Parallel(t *testing.T) {
+	files := []string{"big-jpeg.jpg", "medium-jpeg.jpg", "opaque-png.png", "transparent-png.png", "animated.gif", "logo.png"}
+
+	for _, f := range files {
+		orig, err := ioutil.ReadFile(fmt.Sprintf("%s/%s", "./test_files/transformations", f))
+		if err != nil {
+			t.Errorf("Can't read file %s: %+v", f, err)
+			continue
+		}
+
+		optimise := func(parallel bool) *img.Image {
+			proc.ParallelOptimise = parallel
+			defer func() { proc.ParallelOptimise = false }()
+
+			result, err := proc.Optimise(&img.TransformationConfig{
+				Src: &img.Image{
+					Id:   f,
+					Data: orig,
+				},
+				SupportedFormats: []string{"image/avif", "image/webp"},
+			})
+			if err != nil {
+				t.Fatalf("Can't transform file %s: %+v", f, err)
+			}
+			return result
+		}
+
+		sequential := optimise(false)
+		parallel := optimise(true)
+
+		if len(parallel.Data) > len(sequential.Data) {
+			t.Errorf("%s: expected parallel result [%d] to be not bigger than sequential [%d]", f, len(parallel.Data), len(sequential.Data))
+		}
+		if parallel.MimeType != "" && parallel.MimeType != "image/avif" && parallel.MimeType != "image/webp" {
+			t.Errorf("%s: unexpected mime type [%s]", f, parallel.MimeType)
+		}
+	}
+}
+
+func TestImageMagick_AvifMinSavings(t *testing.T) {
+	f := fmt.Sprintf("%s/%s", "./test_files/transformations", "medium-jpeg.jpg")
+	orig, err := ioutil.ReadFile(f)
+	if err != nil {
+		t.Fatalf("Can't read file %s: %+v", f, err)
+	}
+
+	for _, parallel := range []bool{false, true} {
+		proc.ParallelOptimise = parallel
+		for _, tc := range []struct {
+			minSavings       float64
+			expectedMimeType string
+		}{
+			{0, processor.AvifMime},
+			{99, processor.WebpMime},
+		} {
+			debug := &img.Debug{}
+			result, err := proc.Optimise(&img.TransformationConfig{
+				Src: &img.Image{
+					Id:   f,
+					Data: orig,
+				},
+				SupportedFormats: []string{processor.AvifMime, processor.WebpMime},
+				AvifMinSavings:   tc.minSavings,
+				Debug:            debug,
+			})
+			if err != nil {
+				t.Fatalf("Can't transform file %s: %+v", f, err)
+			}
+			if result.MimeType != tc.expectedMimeType || debug.MimeType != tc.expectedMimeType {
+				t.Errorf("parallel=%t, min savings %g: expected %s, but got [%s], debug [%s]",
+					parallel, tc.minSavings, tc.expectedMimeType, result.MimeType, debug.MimeType)
+			}
+		}
+	}
+	proc.ParallelOptimise = false
+
+	result, err := proc.Resize(&img.TransformationConfig{
+		Src: &img.Image{
+			Id:   f,
+			Data: orig,
+		},
+		SupportedFormats: []string{processor.AvifMime, processor.WebpMime},
+		AvifMinSavings:   99,
+		Config:           &img.ResizeConfig{Size: "100"},
+	})
+	if err != nil {
+		t.Fatalf("Can't resize file %s: %+v", f, err)
+	}
+	if result.MimeType != processor.WebpMime {
+		t.Errorf("expected %s for resize, but got [%s]", processor.WebpMime, result.MimeType)
+	}
+}
+
 func TestImageMagickProcessor_Optimise_Jxl_Avif_Webp(t *testing.T) {
 	qualities := []img.Quality{img.DEFAULT, img.LOW, img.LOWER}
 
@@ -441,6 +544,40 @@ func TestImageMagickProcessor_Optimise_Jxl_Webp(t *testing.T) {
 	}
 }
 
+func TestImageMagickProcessor_Resize_FastDownscale(t *testing.T) {
+	proc.FastDownscale = true
+	defer func() { proc.FastDownscale = false }()
+
+	tests := []*testTransformation{
+		{"big-jpeg.jpg", "image/webp"},
+		{"opaque-png.png", "image/webp"},
+		{"transparent-png.png", "image/webp"},
+		{"animated.gif", "image/webp"},
+	}
+
+	testImages(t, func(orig []byte, imgId string) (*img.Image, error) {
+		return proc.Resize(&img.TransformationConfig{
+			Src: &img.Image{
+				Id:   imgId,
+				Data: orig,
+			},
+			SupportedFormats: []string{"image/webp"},
+			Config:           &img.ResizeConfig{Size: "50"},
+		})
+	}, tests)
+
+	testImages(t, func(orig []byte, imgId string) (*img.Image, error) {
+		return proc.FitToSize(&img.TransformationConfig{
+			Src: &img.Image{
+				Id:   imgId,
+				Data: orig,
+			},
+			SupportedFormats: []string{"image/webp"},
+			Config:           &img.ResizeConfig{Size: "50x50"},
+		})
+	}, tests)
+}
+
 func TestImageMagickProcessor_Resize_Avif(t *testing.T) {
 	testImages(t, func(orig []byte, imgId string) (*img.Image, error) {
 		return proc.Resize(&img.TransformationConfig{
@@ -707,9 +844,9 @@ func TestOptimise_ErrorIdentify(t *testing.T) {
 		t.Error("expected error but got none")
 	}
 
-	expectedError := "identify: no decode delegate for this image format"
-	if !strings.Contains(err.Error(), expectedError) {
-		t.Errorf("expected error to contain [%s], but got [%s]", expectedError, err.Error())
+	var httpErr *img.HttpError
+	if !errors.As(err, &httpErr) || httpErr.Code() != http.StatusUnsupportedMediaType {
+		t.Errorf("expected 415 error, but got [%v]", err)
 	}
 }
 
@@ -747,3 +884,1106 @@ func TestOptimise_ErrorConvert(t *testing.T) {
 		t.Errorf("expected error to contain [%s], but got [%s]", expectedError, err.Error())
 	}
 }
+
+func TestImageMagick_SrcInfoReused(t *testing.T) {
+	f := fmt.Sprintf("%s/%s", "./test_files/transformations", "medium-jpeg.jpg")
+
+	orig, err := ioutil.ReadFile(f)
+	if err != nil {
+		t.Errorf("Can't read file %s: %+v", f, err)
+	}
+
+	config := &img.TransformationConfig{
+		Src: &img.Image{
+			Id:   f,
+			Data: orig,
+		},
+	}
+	_, err = proc.Optimise(config)
+	if err != nil {
+		t.Errorf("Can't transform file: %+v", err)
+	}
+	if config.SrcInfo == nil || config.SrcInfo.Format != "JPEG" {
+		t.Errorf("expected source info to be loaded, but got %+v", config.SrcInfo)
+	}
+
+	// Identify must not run when info is provided, so the error comes from convert command
+	_, err = proc.Optimise(&img.TransformationConfig{
+		Src: &img.Image{
+			Data: []byte("This is not an image!"),
+		},
+		SrcInfo: config.SrcInfo,
+	})
+	if err == nil || !strings.Contains(err.Error(), "Error executing convert command") {
+		t.Errorf("expected convert error, but got [%v]", err)
+	}
+}
+
+func TestImageMagick_AnimationLimits(t *testing.T) {
+	f := fmt.Sprintf("%s/%s", "./test_files/transformations", "animated.gif")
+
+	orig, err := ioutil.ReadFile(f)
+	if err != nil {
+		t.Errorf("Can't read file %s: %+v", f, err)
+	}
+
+	info, err := proc.LoadImageInfo(&img.Image{Id: f, Data: orig})
+	if err != nil || info.Frames <= 1 {
+		t.Fatalf("expected animated image, but got %+v, %v", info, err)
+	}
+
+	proc.MaxAnimationFrames = info.Frames - 1
+	_, err = proc.Resize(&img.TransformationConfig{
+		Src: &img.Image{
+			Id:   f,
+			Data: orig,
+		},
+		Config: &img.ResizeConfig{Size: "50"},
+	})
+	proc.MaxAnimationFrames = 0
+
+	var httpErr *img.HttpError
+	if !errors.As(err, &httpErr) || httpErr.Code() != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected 413 error, but got [%v]", err)
+	}
+}
+
+func TestImageMagick_MaxFrames(t *testing.T) {
+	f := fmt.Sprintf("%s/%s", "./test_files/transformations", "animated.gif")
+	orig, err := ioutil.ReadFile(f)
+	if err != nil {
+		t.Fatalf("Can't read file %s: %+v", f, err)
+	}
+
+	info, err := proc.LoadImageInfo(&img.Image{Id: f, Data: orig})
+	if err != nil || info.Frames <= 2 {
+		t.Fatalf("expected animation with more than 2 frames, but got %+v, %v", info, err)
+	}
+
+	for _, formats := range [][]string{nil, {processor.WebpMime}} {
+		result, err := proc.Resize(&img.TransformationConfig{
+			Src:              &img.Image{Id: f, Data: orig},
+			SupportedFormats: formats,
+			Quality:          img.DEFAULT,
+			MaxFrames:        2,
+			Config:           &img.ResizeConfig{Size: "100"},
+		})
+		if err != nil {
+			t.Fatalf("could not resize image: %s", err)
+		}
+
+		resultInfo, err := proc.LoadImageInfo(result)
+		if err != nil {
+			t.Fatalf("could not identify result: %s", err)
+		}
+		if resultInfo.Frames != 2 || result.Frames != 2 {
+			t.Errorf("expected 2 frames for formats %v, but got [%d], reported [%d]", formats, resultInfo.Frames, result.Frames)
+		}
+		if info.Delay > 0 && resultInfo.Delay != info.Delay*((info.Frames+1)/2) {
+			t.Errorf("expected delay to be increased for formats %v, but got [%d], source [%d]", formats, resultInfo.Delay, info.Delay)
+		}
+	}
+}
+
+func TestImageMagick_TargetSSIM(t *testing.T) {
+	f := fmt.Sprintf("%s/%s", "./test_files/transformations", "medium-jpeg.jpg")
+
+	orig, err := ioutil.ReadFile(f)
+	if err != nil {
+		t.Errorf("Can't read file %s: %+v", f, err)
+	}
+
+	transform := func(targetSSIM float64, op func(*img.TransformationConfig) (*img.Image, error), config interface{}) *img.Image {
+		proc.TargetSSIM = targetSSIM
+		defer func() { proc.TargetSSIM = 0 }()
+
+		result, err := op(&img.TransformationConfig{
+			Src: &img.Image{
+				Id:   f,
+				Data: orig,
+			},
+			SupportedFormats: []string{processor.WebpMime},
+			Quality:          img.DEFAULT,
+			Config:           config,
+		})
+		if err != nil {
+			t.Fatalf("could not transform image: %s", err)
+		}
+		return result
+	}
+
+	low := transform(0.9, proc.Optimise, nil)
+	high := transform(0.995, proc.Optimise, nil)
+
+	if len(low.Data) >= len(high.Data) {
+		t.Errorf("expected image with lower target SSIM to be smaller, but got %d >= %d", len(low.Data), len(high.Data))
+	}
+
+	lowFit := transform(0.9, proc.FitToSize, &img.ResizeConfig{Size: "300x200"})
+	highFit := transform(0.995, proc.FitToSize, &img.ResizeConfig{Size: "300x200"})
+
+	if len(lowFit.Data) >= len(highFit.Data) {
+		t.Errorf("expected fitted image with lower target SSIM to be smaller, but got %d >= %d", len(lowFit.Data), len(highFit.Data))
+	}
+}
+
+func TestImageMagick_DeterministicOutput(t *testing.T) {
+	tests := []*testTransformation{
+		{"logo.png", ""},
+		{"medium-jpeg.jpg", "image/webp"},
+		{"medium-jpeg.jpg", "image/avif"},
+		{"animated.gif", ""},
+	}
+
+	for _, tt := range tests {
+		f := fmt.Sprintf("%s/%s", "./test_files/transformations", tt.file)
+		orig, err := ioutil.ReadFile(f)
+		if err != nil {
+			t.Errorf("Can't read file %s: %+v", f, err)
+		}
+
+		resize := func() []byte {
+			result, err := proc.Resize(&img.TransformationConfig{
+				Src: &img.Image{
+					Id:   f,
+					Data: orig,
+				},
+				SupportedFormats: []string{tt.expectedOutputMimeType},
+				Quality:          img.DEFAULT,
+				Config:           &img.ResizeConfig{Size: "100"},
+			})
+			if err != nil {
+				t.Fatalf("could not resize %s: %s", f, err)
+			}
+			return result.Data
+		}
+
+		if !bytes.Equal(resize(), resize()) {
+			t.Errorf("expected the same output for %s to %s", tt.file, tt.expectedOutputMimeType)
+		}
+	}
+}
+
+func TestImageMagick_Debug(t *testing.T) {
+	f := fmt.Sprintf("%s/%s", "./test_files/transformations", "medium-jpeg.jpg")
+
+	orig, err := ioutil.ReadFile(f)
+	if err != nil {
+		t.Errorf("Can't read file %s: %+v", f, err)
+	}
+
+	debug := &img.Debug{}
+	_, err = proc.Resize(&img.TransformationConfig{
+		Src: &img.Image{
+			Id:   f,
+			Data: orig,
+		},
+		SupportedFormats: []string{processor.WebpMime},
+		Quality:          img.DEFAULT,
+		Config:           &img.ResizeConfig{Size: "100"},
+		Debug:            debug,
+	})
+	if err != nil {
+		t.Fatalf("could not resize image: %s", err)
+	}
+
+	if debug.Source == nil || debug.Source.Format != "JPEG" {
+		t.Errorf("expected JPEG source, but got %+v", debug.Source)
+	}
+	if debug.Target == nil || debug.Target.Width != 100 {
+		t.Errorf("expected target width 100, but got %+v", debug.Target)
+	}
+	if debug.MimeType != processor.WebpMime {
+		t.Errorf("expected %s output, but got [%s]", processor.WebpMime, debug.MimeType)
+	}
+	if debug.Quality <= 0 {
+		t.Errorf("expected quality to be set, but got %d", debug.Quality)
+	}
+	if len(debug.Args) == 0 || debug.Args[len(debug.Args)-1] != "webp:-" {
+		t.Errorf("expected convert arguments with webp output, but got %v", debug.Args)
+	}
+}
+
+func TestImageMagick_Plan(t *testing.T) {
+	f := fmt.Sprintf("%s/%s", "./test_files/transformations", "medium-jpeg.jpg")
+
+	orig, err := ioutil.ReadFile(f)
+	if err != nil {
+		t.Errorf("Can't read file %s: %+v", f, err)
+	}
+
+	plan, err := proc.Plan("fit", &img.TransformationConfig{
+		Src: &img.Image{
+			Id:   f,
+			Data: orig,
+		},
+		SupportedFormats: []string{processor.AvifMime},
+		Quality:          img.DEFAULT,
+		Config:           &img.ResizeConfig{Size: "100x50"},
+	})
+	if err != nil {
+		t.Fatalf("could not plan image: %s", err)
+	}
+
+	if plan.Target.Width != 100 || plan.Target.Height != 50 {
+		t.Errorf("expected target 100x50, but got %dx%d", plan.Target.Width, plan.Target.Height)
+	}
+	if plan.MimeType != processor.AvifMime {
+		t.Errorf("expected %s output, but got [%s]", processor.AvifMime, plan.MimeType)
+	}
+	if len(plan.Args) == 0 || plan.Args[len(plan.Args)-1] != "avif:-" {
+		t.Errorf("expected convert arguments with avif output, but got %v", plan.Args)
+	}
+
+	_, err = proc.Plan("crop", &img.TransformationConfig{
+		Src: &img.Image{
+			Id:   f,
+			Data: orig,
+		},
+	})
+	if err == nil {
+		t.Errorf("expected error for unknown operation")
+	}
+}
+
+func TestImageMagick_ReplaceColors(t *testing.T) {
+	f := fmt.Sprintf("%s/%s", "./test_files/transformations", "logo.png")
+
+	orig, err := ioutil.ReadFile(f)
+	if err != nil {
+		t.Errorf("Can't read file %s: %+v", f, err)
+	}
+
+	plan, err := proc.Plan("optimise", &img.TransformationConfig{
+		Src: &img.Image{
+			Id:   f,
+			Data: orig,
+		},
+		ReplaceColors: []img.ColorReplacement{{From: "ff0000", To: "00ff00"}},
+		Fuzz:          10,
+	})
+	if err != nil {
+		t.Fatalf("could not plan image: %s", err)
+	}
+
+	args := strings.Join(plan.Args, " ")
+	if !strings.Contains(args, "-fuzz 10% -fill #00ff00 -opaque #ff0000") {
+		t.Errorf("expected color replacement in arguments, but got %v", plan.Args)
+	}
+}
+
+func TestImageMagick_Enhance(t *testing.T) {
+	f := fmt.Sprintf("%s/%s", "./test_files/transformations", "medium-jpeg.jpg")
+
+	orig, err := ioutil.ReadFile(f)
+	if err != nil {
+		t.Errorf("Can't read file %s: %+v", f, err)
+	}
+
+	plan, err := proc.Plan("resize", &img.TransformationConfig{
+		Src: &img.Image{
+			Id:   f,
+			Data: orig,
+		},
+		Enhance: true,
+		Config:  &img.ResizeConfig{Size: "300"},
+	})
+	if err != nil {
+		t.Fatalf("could not plan image: %s", err)
+	}
+
+	args := strings.Join(plan.Args, " ")
+	if !strings.Contains(args, "-auto-level -auto-gamma -modulate "+processor.EnhanceModulate) {
+		t.Errorf("expected enhance options in arguments, but got %v", plan.Args)
+	}
+}
+
+func TestImageMagick_Montage(t *testing.T) {
+	var images []*img.Image
+	for _, file := range []string{"medium-jpeg.jpg", "logo.png", "animated.gif"} {
+		f := fmt.Sprintf("%s/%s", "./test_files/transformations", file)
+		orig, err := ioutil.ReadFile(f)
+		if err != nil {
+			t.Fatalf("Can't read file %s: %+v", f, err)
+		}
+		images = append(images, &img.Image{Id: f, Data: orig})
+	}
+
+	result, err := proc.Montage(&img.TransformationConfig{
+		Src:              &img.Image{Id: "montage"},
+		SupportedFormats: []string{processor.WebpMime},
+		Quality:          img.DEFAULT,
+		Config: &img.MontageConfig{
+			Images:     images,
+			Columns:    2,
+			Gap:        10,
+			CellWidth:  100,
+			CellHeight: 50,
+		},
+	})
+	if err != nil {
+		t.Fatalf("could not create montage: %s", err)
+	}
+
+	info, err := proc.LoadImageInfo(result)
+	if err != nil {
+		t.Fatalf("could not identify montage: %s", err)
+	}
+	if info.Width != 210 || info.Height != 110 {
+		t.Errorf("expected montage 210x110, but got %dx%d", info.Width, info.Height)
+	}
+	if result.MimeType != processor.WebpMime {
+		t.Errorf("expected %s output, but got [%s]", processor.WebpMime, result.MimeType)
+	}
+}
+
+func TestImageMagick_Sprite(t *testing.T) {
+	var images []*img.Image
+	for _, file := range []string{"logo.png", "medium-jpeg.jpg"} {
+		f := fmt.Sprintf("%s/%s", "./test_files/transformations", file)
+		orig, err := ioutil.ReadFile(f)
+		if err != nil {
+			t.Fatalf("Can't read file %s: %+v", f, err)
+		}
+		images = append(images, &img.Image{Id: f, Data: orig})
+	}
+
+	result, err := proc.Sprite(&img.TransformationConfig{
+		Src:              &img.Image{Id: "sprite"},
+		SupportedFormats: []string{processor.WebpMime},
+		Quality:          img.DEFAULT,
+		Config: &img.SpriteConfig{
+			Images: images,
+			Cells: []img.SpriteCell{
+				{X: 0, Y: 0, Width: 50, Height: 50},
+				{X: 60, Y: 0, Width: 50, Height: 50},
+			},
+			Width:  110,
+			Height: 50,
+		},
+	})
+	if err != nil {
+		t.Fatalf("could not create sprite sheet: %s", err)
+	}
+
+	info, err := proc.LoadImageInfo(result)
+	if err != nil {
+		t.Fatalf("could not identify sprite sheet: %s", err)
+	}
+	if info.Width != 110 || info.Height != 50 {
+		t.Errorf("expected sprite sheet 110x50, but got %dx%d", info.Width, info.Height)
+	}
+	if result.MimeType != processor.WebpMime {
+		t.Errorf("expected %s output, but got [%s]", processor.WebpMime, result.MimeType)
+	}
+}
+
+func TestImageMagick_Ladder(t *testing.T) {
+	f := fmt.Sprintf("%s/%s", "./test_files/transformations", "medium-jpeg.jpg")
+	orig, err := ioutil.ReadFile(f)
+	if err != nil {
+		t.Fatalf("Can't read file %s: %+v", f, err)
+	}
+
+	widths := []int{50, 100, 200}
+	images, err := proc.Ladder(&img.TransformationConfig{
+		Src:              &img.Image{Id: f, Data: orig, MimeType: "image/jpeg"},
+		SupportedFormats: []string{processor.WebpMime},
+		Quality:          img.DEFAULT,
+		Config:           &img.LadderConfig{Widths: widths},
+	})
+	if err != nil {
+		t.Fatalf("could not create ladder: %s", err)
+	}
+	if len(images) != len(widths) {
+		t.Fatalf("expected %d images, but got %d", len(widths), len(images))
+	}
+
+	for i, image := range images {
+		info, err := proc.LoadImageInfo(image)
+		if err != nil {
+			t.Fatalf("could not identify image of width %d: %s", widths[i], err)
+		}
+		if info.Width != widths[i] || image.Width != widths[i] {
+			t.Errorf("expected width %d, but got %d", widths[i], info.Width)
+		}
+		if image.MimeType != processor.WebpMime {
+			t.Errorf("expected %s output, but got [%s]", processor.WebpMime, image.MimeType)
+		}
+	}
+}
+
+func TestImageMagick_Card(t *testing.T) {
+	f := fmt.Sprintf("%s/%s", "./test_files/transformations", "logo.png")
+	logo, err := ioutil.ReadFile(f)
+	if err != nil {
+		t.Fatalf("Can't read file %s: %+v", f, err)
+	}
+
+	result, err := proc.Card(&img.TransformationConfig{
+		Src:              &img.Image{Id: "card"},
+		SupportedFormats: []string{processor.WebpMime},
+		Quality:          img.DEFAULT,
+		Config: &img.CardConfig{
+			Template: &img.CardTemplate{
+				Width:      600,
+				Height:     315,
+				Background: "navy",
+				Title: &img.CardText{
+					CardBox: img.CardBox{X: 40, Y: 100, Width: 520, Height: 120, Gravity: "west"},
+					Color:   "white",
+				},
+				Logo: &img.CardImage{
+					CardBox: img.CardBox{X: 40, Y: 20, Width: 100, Height: 50, Gravity: "northwest"},
+				},
+			},
+			Logo:  &img.Image{Id: f, Data: logo},
+			Title: "@/etc/passwd 100%",
+		},
+	})
+	if err != nil {
+		t.Fatalf("could not render card: %s", err)
+	}
+
+	info, err := proc.LoadImageInfo(result)
+	if err != nil {
+		t.Fatalf("could not identify card: %s", err)
+	}
+	if info.Width != 600 || info.Height != 315 {
+		t.Errorf("expected card 600x315, but got %dx%d", info.Width, info.Height)
+	}
+	if result.MimeType != processor.WebpMime {
+		t.Errorf("expected %s output, but got [%s]", processor.WebpMime, result.MimeType)
+	}
+}
+
+func TestImageMagick_Tile(t *testing.T) {
+	f := fmt.Sprintf("%s/%s", "./test_files/transformations", "medium-jpeg.jpg")
+	orig, err := ioutil.ReadFile(f)
+	if err != nil {
+		t.Fatalf("Can't read file %s: %+v", f, err)
+	}
+
+	result, err := proc.Tile(&img.TransformationConfig{
+		Src:     &img.Image{Id: f, Data: orig},
+		Quality: img.DEFAULT,
+		Config: &img.TileConfig{
+			X:            10,
+			Y:            20,
+			Width:        200,
+			Height:       100,
+			TargetWidth:  100,
+			TargetHeight: 50,
+			Rotation:     90,
+			Gray:         true,
+			Format:       "webp",
+		},
+	})
+	if err != nil {
+		t.Fatalf("could not create tile: %s", err)
+	}
+
+	info, err := proc.LoadImageInfo(result)
+	if err != nil {
+		t.Fatalf("could not identify tile: %s", err)
+	}
+	if info.Width != 50 || info.Height != 100 {
+		t.Errorf("expected tile 50x100, but got %dx%d", info.Width, info.Height)
+	}
+	if result.MimeType != processor.WebpMime {
+		t.Errorf("expected %s output, but got [%s]", processor.WebpMime, result.MimeType)
+	}
+}
+
+func TestImageMagick_Upscale(t *testing.T) {
+	f := fmt.Sprintf("%s/%s", "./test_files/transformations", "small-transparent-png.png")
+	orig, err := ioutil.ReadFile(f)
+	if err != nil {
+		t.Fatalf("Can't read file %s: %+v", f, err)
+	}
+
+	config := &img.TransformationConfig{
+		Src:     &img.Image{Id: f, Data: orig},
+		Quality: img.DEFAULT,
+		Config:  &img.ResizeConfig{Size: "358"},
+		Debug:   &img.Debug{},
+	}
+	result, err := proc.Upscale(config)
+	if err != nil {
+		t.Fatalf("could not upscale image: %s", err)
+	}
+	if result.Width != 358 || result.Height != 84 {
+		t.Errorf("expected 358x84 image, but got %dx%d", result.Width, result.Height)
+	}
+	args := strings.Join(config.Debug.Args, " ")
+	if !strings.Contains(args, "-filter Lanczos -resize 358 -unsharp") {
+		t.Errorf("expected Lanczos filter and sharpening in arguments, but got %v", config.Debug.Args)
+	}
+}
+
+func TestImageMagick_Avatar(t *testing.T) {
+	f := fmt.Sprintf("%s/%s", "./test_files/transformations", "medium-jpeg.jpg")
+	orig, err := ioutil.ReadFile(f)
+	if err != nil {
+		t.Fatalf("Can't read file %s: %+v", f, err)
+	}
+
+	for _, tt := range []struct {
+		supportedFormats []string
+		expectedMimeType string
+	}{
+		{nil, "image/png"},
+		{[]string{processor.WebpMime}, processor.WebpMime},
+	} {
+		config := &img.TransformationConfig{
+			Src:              &img.Image{Id: f, Data: orig},
+			SupportedFormats: tt.supportedFormats,
+			Quality:          img.DEFAULT,
+			Config:           &img.AvatarConfig{Size: 64, Face: image.Rect(100, 50, 150, 100), Detected: true},
+			Debug:            &img.Debug{},
+		}
+		result, err := proc.Avatar(config)
+		if err != nil {
+			t.Fatalf("could not make avatar: %s", err)
+		}
+		if result.Width != 64 || result.Height != 64 || result.MimeType != tt.expectedMimeType {
+			t.Errorf("expected 64x64 %s image, but got %dx%d %s", tt.expectedMimeType, result.Width, result.Height, result.MimeType)
+		}
+		args := strings.Join(config.Debug.Args, " ")
+		if !strings.Contains(args, "-crop 100x100+75+25 +repage -resize 64x64!") {
+			t.Errorf("expected crop around the face in arguments, but got %v", config.Debug.Args)
+		}
+	}
+
+	// The corner is outside of the circular mask
+	result, err := proc.Avatar(&img.TransformationConfig{
+		Src:    &img.Image{Id: f, Data: orig},
+		Config: &img.AvatarConfig{Size: 64},
+	})
+	if err != nil {
+		t.Fatalf("could not make avatar: %s", err)
+	}
+	decoded, err := png.Decode(bytes.NewReader(result.Data))
+	if err != nil {
+		t.Fatalf("could not decode avatar: %s", err)
+	}
+	if _, _, _, a := decoded.At(0, 0).RGBA(); a != 0 {
+		t.Errorf("expected transparent corner, but got alpha %d", a)
+	}
+	if _, _, _, a := decoded.At(32, 32).RGBA(); a != 0xffff {
+		t.Errorf("expected opaque center, but got alpha %d", a)
+	}
+}
+
+func TestImageMagick_Upscale_SuperResolution(t *testing.T) {
+	f := fmt.Sprintf("%s/%s", "./test_files/transformations", "small-transparent-png.png")
+	orig, err := ioutil.ReadFile(f)
+	if err != nil {
+		t.Fatalf("Can't read file %s: %+v", f, err)
+	}
+	enlarged, err := ioutil.ReadFile(fmt.Sprintf("%s/%s", "./test_files/transformations", "logo.png"))
+	if err != nil {
+		t.Fatalf("Can't read file: %+v", err)
+	}
+
+	superResProc, err := processor.NewImageMagick(os.ExpandEnv("${IM_HOME}/convert"), os.ExpandEnv("${IM_HOME}/identify"))
+	if err != nil {
+		t.Fatalf("Error while creating image processor: %+v", err)
+	}
+	var calls int
+	superResProc.SuperResolution = func(src *img.Image, target *img.Info) (*img.Image, error) {
+		calls++
+		return &img.Image{Data: enlarged, MimeType: "image/png"}, nil
+	}
+
+	for _, size := range []string{"358", "100"} {
+		config := &img.TransformationConfig{
+			Src:     &img.Image{Id: f, Data: orig},
+			Quality: img.DEFAULT,
+			Config:  &img.ResizeConfig{Size: size},
+			Debug:   &img.Debug{},
+		}
+		_, err = superResProc.Upscale(config)
+		if err != nil {
+			t.Fatalf("could not upscale image: %s", err)
+		}
+		if size == "358" && (config.Debug.Source.Width != 406 || strings.Contains(strings.Join(config.Debug.Args, " "), "-unsharp")) {
+			t.Errorf("expected enlarged source without sharpening, but got %+v, %v", config.Debug.Source, config.Debug.Args)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("expected hook to be called only when the image is enlarged, but got %d calls", calls)
+	}
+}
+
+func TestImageMagick_Transcode(t *testing.T) {
+	f := fmt.Sprintf("%s/%s", "./test_files/transformations", "medium-jpeg.jpg")
+	orig, err := ioutil.ReadFile(f)
+	if err != nil {
+		t.Fatalf("Can't read file %s: %+v", f, err)
+	}
+
+	config := &img.TransformationConfig{
+		Src:              &img.Image{Id: f, Data: orig, MimeType: "image/jpeg"},
+		SupportedFormats: []string{processor.WebpMime},
+		Quality:          img.LOWER,
+		Debug:            &img.Debug{},
+	}
+	result, err := proc.Transcode(config)
+	if err != nil {
+		t.Fatalf("could not transcode image: %s", err)
+	}
+	if result.MimeType != processor.WebpMime || len(result.Data) >= len(orig) {
+		t.Errorf("expected smaller %s image, but got [%s] of %d bytes", processor.WebpMime, result.MimeType, len(result.Data))
+	}
+	if config.Debug.Quality != processor.TranscodeQuality {
+		t.Errorf("expected quality %d, but got %d", processor.TranscodeQuality, config.Debug.Quality)
+	}
+	if config.Debug.Target.Width != config.Debug.Source.Width || config.Debug.Target.Height != config.Debug.Source.Height {
+		t.Errorf("expected image not to be resized, but got %+v", config.Debug.Target)
+	}
+
+	result, err = proc.Transcode(&img.TransformationConfig{
+		Src: &img.Image{Id: f, Data: orig, MimeType: "image/jpeg"},
+	})
+	if err != nil {
+		t.Fatalf("could not transcode image: %s", err)
+	}
+	if result.MimeType != "image/jpeg" || !bytes.Equal(result.Data, orig) {
+		t.Errorf("expected source image, but got [%s]", result.MimeType)
+	}
+}
+
+func TestImageMagick_SkipOptimised(t *testing.T) {
+	f := fmt.Sprintf("%s/%s", "./test_files/transformations", "logo.png")
+	orig, err := ioutil.ReadFile(f)
+	if err != nil {
+		t.Fatalf("Can't read file %s: %+v", f, err)
+	}
+	info, err := proc.LoadImageInfo(&img.Image{Id: f, Data: orig})
+	if err != nil {
+		t.Fatalf("could not identify image: %s", err)
+	}
+	if len(info.Profiles) > 0 {
+		t.Skipf("expected image without metadata, but got %v", info.Profiles)
+	}
+
+	skipProc, err := processor.NewImageMagick(os.ExpandEnv("${IM_HOME}/convert"), os.ExpandEnv("${IM_HOME}/identify"))
+	if err != nil {
+		t.Fatalf("Error while creating image processor: %+v", err)
+	}
+	skipProc.SkipOptimised = true
+	maxSize := processor.SkipOptimisedMaxSize
+	processor.SkipOptimisedMaxSize = len(orig)
+	defer func() {
+		processor.SkipOptimisedMaxSize = maxSize
+	}()
+
+	config := &img.TransformationConfig{
+		Src:     &img.Image{Id: f, Data: orig, MimeType: "image/png"},
+		Quality: img.DEFAULT,
+		Debug:   &img.Debug{},
+	}
+	result, err := skipProc.Optimise(config)
+	if err != nil {
+		t.Fatalf("could not optimise image: %s", err)
+	}
+	if !bytes.Equal(result.Data, orig) || result.MimeType != "image/png" || !config.Debug.Original {
+		t.Errorf("expected tiny image to be returned as is, but got [%s] of %d bytes", result.MimeType, len(result.Data))
+	}
+
+	config = &img.TransformationConfig{
+		Src:     &img.Image{Id: f, Data: orig, MimeType: "image/png"},
+		Quality: img.DEFAULT,
+		Enhance: true,
+		Debug:   &img.Debug{},
+	}
+	_, err = skipProc.Optimise(config)
+	if err != nil {
+		t.Fatalf("could not optimise image: %s", err)
+	}
+	if len(config.Debug.Args) == 0 {
+		t.Errorf("expected enhanced image to be encoded")
+	}
+}
+
+func TestImageMagick_LoadExif(t *testing.T) {
+	f := fmt.Sprintf("%s/%s", "./test_files/transformations", "medium-jpeg.jpg")
+	orig, err := ioutil.ReadFile(f)
+	if err != nil {
+		t.Fatalf("Can't read file %s: %+v", f, err)
+	}
+
+	tags, err := proc.LoadExif(&img.Image{Id: f, Data: orig})
+	if err != nil {
+		t.Fatalf("could not load EXIF: %s", err)
+	}
+	for name := range tags {
+		if strings.HasPrefix(name, "exif:") {
+			t.Errorf("expected tag name without prefix, but got [%s]", name)
+		}
+	}
+
+	_, err = proc.LoadExif(&img.Image{Id: "html", Data: []byte("<html></html>")})
+	if err == nil {
+		t.Error("expected error for not an image")
+	}
+}
+
+func TestImageMagick_GifLossy(t *testing.T) {
+	f := fmt.Sprintf("%s/%s", "./test_files/transformations", "animated.gif")
+	orig, err := ioutil.ReadFile(f)
+	if err != nil {
+		t.Fatalf("Can't read file %s: %+v", f, err)
+	}
+
+	procLossy, err := processor.NewImageMagick(os.ExpandEnv("${IM_HOME}/convert"), os.ExpandEnv("${IM_HOME}/identify"))
+	if err != nil {
+		t.Fatalf("could not create processor: %s", err)
+	}
+	procLossy.GifLossy = 5
+
+	config := func(supportedFormats []string) *img.TransformationConfig {
+		return &img.TransformationConfig{
+			Src:              &img.Image{Id: f, Data: orig},
+			SupportedFormats: supportedFormats,
+			Quality:          img.LOW,
+		}
+	}
+
+	plan, err := procLossy.Plan("optimise", config(nil))
+	if err != nil {
+		t.Fatalf("could not plan image: %s", err)
+	}
+	args := strings.Join(plan.Args, " ")
+	if !strings.Contains(args, "-layers RemoveDups -colors 128 -fuzz 5% -layers Optimize") {
+		t.Errorf("expected lossy GIF options in arguments, but got %v", plan.Args)
+	}
+
+	plan, err = procLossy.Plan("optimise", config([]string{processor.WebpMime}))
+	if err != nil {
+		t.Fatalf("could not plan image: %s", err)
+	}
+	if strings.Contains(strings.Join(plan.Args, " "), "RemoveDups") {
+		t.Errorf("expected no lossy GIF options for WebP output, but got %v", plan.Args)
+	}
+
+	lossless, err := proc.Optimise(config(nil))
+	if err != nil {
+		t.Fatalf("could not optimise image: %s", err)
+	}
+	lossy, err := procLossy.Optimise(config(nil))
+	if err != nil {
+		t.Fatalf("could not optimise image: %s", err)
+	}
+	if len(lossy.Data) > len(lossless.Data) {
+		t.Errorf("expected lossy GIF [%d] to be not bigger than lossless [%d]", len(lossy.Data), len(lossless.Data))
+	}
+}
+
+func TestImageMagick_Static(t *testing.T) {
+	f := fmt.Sprintf("%s/%s", "./test_files/transformations", "animated.gif")
+	orig, err := ioutil.ReadFile(f)
+	if err != nil {
+		t.Fatalf("Can't read file %s: %+v", f, err)
+	}
+
+	for _, formats := range [][]string{nil, {processor.WebpMime}} {
+		result, err := proc.Resize(&img.TransformationConfig{
+			Src:              &img.Image{Id: f, Data: orig},
+			SupportedFormats: formats,
+			Quality:          img.DEFAULT,
+			Static:           true,
+			Config:           &img.ResizeConfig{Size: "100"},
+		})
+		if err != nil {
+			t.Fatalf("could not resize image: %s", err)
+		}
+
+		info, err := proc.LoadImageInfo(result)
+		if err != nil {
+			t.Fatalf("could not identify result: %s", err)
+		}
+		if info.Frames != 1 {
+			t.Errorf("expected still image for formats %v, but got [%d] frames", formats, info.Frames)
+		}
+		if result.Frames != 1 {
+			t.Errorf("expected 1 frame in the result for formats %v, but got [%d]", formats, result.Frames)
+		}
+	}
+}
+
+func TestDefaultThreadLimit(t *testing.T) {
+	cpus := runtime.NumCPU()
+	for workers, expected := range map[int]int{1: cpus, 2: max(1, cpus/2), cpus * 2: 1, 0: cpus} {
+		if limit := processor.DefaultThreadLimit(workers); limit != expected {
+			t.Errorf("expected %d threads for %d workers, but got %d", expected, workers, limit)
+		}
+	}
+}
+
+func TestImageMagick_WarmUp(t *testing.T) {
+	if err := proc.WarmUp([]string{"png", "webp"}); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	err := proc.WarmUp([]string{"png", "nosuchformat"})
+	if err == nil || !strings.Contains(err.Error(), "nosuchformat") {
+		t.Errorf("expected error for unknown format, but got %v", err)
+	}
+}
+
+func TestIsTransientError(t *testing.T) {
+	tests := []struct {
+		err       error
+		transient bool
+	}{
+		{nil, false},
+		{fmt.Errorf("%w: Error executing convert command: exit status 1\nStderr: [convert: cache resources exhausted `-' @ error/cache.c/OpenPixelCache/4095.]", img.ErrEncodeFailed), true},
+		{fmt.Errorf("%w: Error executing convert command: exit status 1\nStderr: [convert: unable to open image `/tmp/magick-123abc': No such file or directory]", img.ErrEncodeFailed), true},
+		{fmt.Errorf("%w: Error executing convert command: exit status 1\nStderr: [convert: unrecognized option `-i_dont_know']", img.ErrEncodeFailed), false},
+		{fmt.Errorf("%w: cache resources exhausted", img.ErrTooLarge), false},
+	}
+
+	for _, tt := range tests {
+		if transient := processor.IsTransientError(tt.err); transient != tt.transient {
+			t.Errorf("expected transient to be %t for [%v], but got %t", tt.transient, tt.err, transient)
+		}
+	}
+}
+
+func TestImageMagick_Depth(t *testing.T) {
+	src := image.NewNRGBA64(image.Rect(0, 0, 64, 64))
+	for x := 0; x < 64; x++ {
+		for y := 0; y < 64; y++ {
+			src.SetNRGBA64(x, y, color.NRGBA64{R: uint16(x * 1024), G: uint16(y * 1024), B: 0x8000, A: 0xffff})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, src); err != nil {
+		t.Fatalf("could not encode png: %s", err)
+	}
+
+	result, err := proc.Optimise(&img.TransformationConfig{
+		Src: &img.Image{
+			Id:   "png48",
+			Data: buf.Bytes(),
+		},
+		Depth: 8,
+	})
+	if err != nil {
+		t.Fatalf("could not optimise image: %s", err)
+	}
+
+	// Bit depth is the first byte after the width and height in IHDR chunk
+	if len(result.Data) < 25 || result.Data[24] != 8 {
+		t.Errorf("expected 8-bit PNG, but got %v", result.Data[:25])
+	}
+}
+
+func TestImageMagick_ReduceColorTypes(t *testing.T) {
+	proc.ReduceColorTypes = true
+	defer func() { proc.ReduceColorTypes = false }()
+
+	encode := func(pixel func(x, y int) color.NRGBA) []byte {
+		src := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+		for x := 0; x < 64; x++ {
+			for y := 0; y < 64; y++ {
+				src.SetNRGBA(x, y, pixel(x, y))
+			}
+		}
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, src); err != nil {
+			t.Fatalf("could not encode png: %s", err)
+		}
+		return buf.Bytes()
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		// colorType is the PNG color type: 0 - grayscale, 3 - palette, 4 - grayscale with alpha
+		colorType byte
+	}{
+		{
+			name: "Icon with binary alpha",
+			data: encode(func(x, y int) color.NRGBA {
+				if x < 16 {
+					return color.NRGBA{}
+				}
+				return color.NRGBA{R: uint8(x / 16 * 60), G: 0x20, B: uint8(y / 16 * 60), A: 0xff}
+			}),
+			colorType: 3,
+		},
+		{
+			name: "Grayscale",
+			data: encode(func(x, y int) color.NRGBA {
+				v := uint8(x * 4)
+				return color.NRGBA{R: v, G: v, B: v, A: 0xff}
+			}),
+			colorType: 0,
+		},
+		{
+			name: "Grayscale with alpha",
+			data: encode(func(x, y int) color.NRGBA {
+				v := uint8(x * 4)
+				return color.NRGBA{R: v, G: v, B: v, A: uint8(y * 4)}
+			}),
+			colorType: 4,
+		},
+	}
+
+	for _, tt := range tests {
+		result, err := proc.Optimise(&img.TransformationConfig{
+			Src: &img.Image{
+				Id:   tt.name,
+				Data: tt.data,
+			},
+		})
+		if err != nil {
+			t.Fatalf("%s: could not optimise image: %s", tt.name, err)
+		}
+
+		// Color type is the second byte after the width and height in IHDR chunk
+		if len(result.Data) < 26 || result.Data[25] != tt.colorType {
+			t.Errorf("%s: expected PNG color type %d, but got %v", tt.name, tt.colorType, result.Data[:26])
+		}
+	}
+}
+
+func TestImageMagick_ColorProfile(t *testing.T) {
+	dir := t.TempDir()
+	srgbProfile := filepath.Join(dir, "srgb.icc")
+	p3Profile := filepath.Join(dir, "p3.icc")
+	if err := os.WriteFile(srgbProfile, iccProfile("sRGB test"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p3Profile, iccProfile("Display P3 test"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := processor.NewImageMagick(os.ExpandEnv("${IM_HOME}/convert"), os.ExpandEnv("${IM_HOME}/identify"))
+	if err != nil {
+		t.Fatalf("could not create processor: %s", err)
+	}
+	p.SRGBProfile = srgbProfile
+	p.PreserveWideGamut = true
+	// Makes the output bigger than the source to check that it's not replaced by the original.
+	p.AdditionalArgs = []string{"-quality", "100"}
+
+	source := func(format string, args ...string) []byte {
+		cmdArgs := append([]string{"-size", "64x64", "xc:gray", "+noise", "Random", "-quality", "50"}, args...)
+		out, err := exec.Command(os.ExpandEnv("${IM_HOME}/convert"), append(cmdArgs, format+":-")...).Output()
+		if err != nil {
+			t.Fatalf("could not create %s source: %s", format, err)
+		}
+		return out
+	}
+
+	tests := []struct {
+		name             string
+		data             []byte
+		supportedFormats []string
+		expectedMimeType string
+		// expectedProfile is the expected description of the output ICC profile, empty if it's stripped.
+		expectedProfile string
+	}{
+		{"sRGB JPEG", source("jpg", "-profile", srgbProfile), nil, "image/jpeg", ""},
+		{"sRGB JPEG to WebP", source("jpg", "-profile", srgbProfile), []string{"image/webp"}, "image/webp", ""},
+		{"sRGB PNG", source("png", "-profile", srgbProfile), nil, "image/png", ""},
+		{"CMYK JPEG", source("jpg", "-colorspace", "CMYK"), nil, "image/jpeg", ""},
+		{"Display P3 JPEG", source("jpg", "-profile", p3Profile), nil, "image/jpeg", "Display P3 test"},
+		{"Display P3 JPEG to WebP", source("jpg", "-profile", p3Profile), []string{"image/webp"}, "image/webp", "Display P3 test"},
+		{"Display P3 PNG", source("png", "-profile", p3Profile), nil, "image/png", "Display P3 test"},
+	}
+
+	for _, tt := range tests {
+		result, err := p.Optimise(&img.TransformationConfig{
+			Src: &img.Image{
+				Id:   tt.name,
+				Data: tt.data,
+			},
+			SupportedFormats: tt.supportedFormats,
+		})
+		if err != nil {
+			t.Fatalf("%s: could not optimise image: %s", tt.name, err)
+		}
+		if bytes.Equal(result.Data, tt.data) {
+			t.Errorf("%s: expected converted image, but got original", tt.name)
+			continue
+		}
+		if result.MimeType != tt.expectedMimeType {
+			t.Errorf("%s: expected mime type %s, but got %s", tt.name, tt.expectedMimeType, result.MimeType)
+		}
+
+		info, err := p.LoadImageInfo(result)
+		if err != nil {
+			t.Fatalf("%s: could not load output image info: %s", tt.name, err)
+		}
+		if info.ColorSpace != "sRGB" {
+			t.Errorf("%s: expected sRGB color space, but got %s", tt.name, info.ColorSpace)
+		}
+		if len(tt.expectedProfile) == 0 && info.HasProfile("icc") {
+			t.Errorf("%s: expected ICC profile to be stripped, but got %s", tt.name, info.ColorProfile)
+		}
+		if len(tt.expectedProfile) > 0 && (!info.HasProfile("icc") || info.ColorProfile != tt.expectedProfile) {
+			t.Errorf("%s: expected ICC profile %s, but got %v %s", tt.name, tt.expectedProfile, info.Profiles, info.ColorProfile)
+		}
+	}
+}
+
+// iccProfile returns a minimal ICC v2 RGB display profile with sRGB primaries
+// and the given description.
+func iccProfile(description string) []byte {
+	s15 := func(v float64) uint32 { return uint32(int32(math.Round(v * 65536))) }
+	xyz := func(x, y, z float64) []byte {
+		b := []byte("XYZ \x00\x00\x00\x00")
+		for _, v := range []float64{x, y, z} {
+			b = binary.BigEndian.AppendUint32(b, s15(v))
+		}
+		return b
+	}
+	desc := []byte("desc\x00\x00\x00\x00")
+	desc = binary.BigEndian.AppendUint32(desc, uint32(len(description)+1))
+	desc = append(desc, description...)
+	desc = append(desc, make([]byte, 1+4+4+2+1+67)...)
+	curv := []byte("curv\x00\x00\x00\x00\x00\x00\x00\x01\x02\x33")
+
+	tags := []struct {
+		sig  string
+		data []byte
+	}{
+		{"desc", desc},
+		{"cprt", []byte("text\x00\x00\x00\x00No copyright\x00")},
+		{"wtpt", xyz(0.9642, 1, 0.8249)},
+		{"rXYZ", xyz(0.4361, 0.2225, 0.0139)},
+		{"gXYZ", xyz(0.3851, 0.7169, 0.0971)},
+		{"bXYZ", xyz(0.1431, 0.0606, 0.7141)},
+		{"rTRC", curv},
+		{"gTRC", curv},
+		{"bTRC", curv},
+	}
+
+	offset := 128 + 4 + 12*len(tags)
+	table := binary.BigEndian.AppendUint32(nil, uint32(len(tags)))
+	var data []byte
+	for _, tag := range tags {
+		for len(data)%4 != 0 {
+			data = append(data, 0)
+		}
+		table = append(table, tag.sig...)
+		table = binary.BigEndian.AppendUint32(table, uint32(offset+len(data)))
+		table = binary.BigEndian.AppendUint32(table, uint32(len(tag.data)))
+		data = append(data, tag.data...)
+	}
+
+	header := make([]byte, 128)
+	binary.BigEndian.PutUint32(header[0:], uint32(128+len(table)+len(data)))
+	binary.BigEndian.PutUint32(header[8:], 0x02100000)
+	copy(header[12:], "mntr")
+	copy(header[16:], "RGB ")
+	copy(header[20:], "XYZ ")
+	copy(header[36:], "acsp")
+	copy(header[68:], xyz(0.9642, 1, 0.8249)[8:])
+
+	return append(append(header, table...), data...)
+}
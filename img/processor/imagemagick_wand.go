@@ -0,0 +1,236 @@
+//go:build magickwand
+
+package processor
+
+/*
+#cgo pkg-config: MagickWand
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <MagickWand/MagickWand.h>
+
+static char *exception_message(ExceptionInfo *exception) {
+	if (exception->reason == NULL) {
+		return strdup("unknown error");
+	}
+	if (exception->description == NULL) {
+		return strdup(exception->reason);
+	}
+	size_t len = strlen(exception->reason) + strlen(exception->description) + 4;
+	char *msg = malloc(len);
+	snprintf(msg, len, "%s (%s)", exception->reason, exception->description);
+	return msg;
+}
+
+// im_convert runs convert command in-process. Returns NULL on success or error message.
+static char *im_convert(int argc, char **argv) {
+	char *err = NULL;
+	ImageInfo *image_info = AcquireImageInfo();
+	ExceptionInfo *exception = AcquireExceptionInfo();
+
+	MagickBooleanType status = MagickCommandGenesis(image_info, ConvertImageCommand, argc, argv, (char **) NULL, exception);
+	if (status == MagickFalse || exception->severity >= ErrorException) {
+		err = exception_message(exception);
+	}
+
+	DestroyImageInfo(image_info);
+	DestroyExceptionInfo(exception);
+	return err;
+}
+
+// im_identify returns image properties of each frame using format escapes. Sets err on failure.
+static char *im_identify(const void *blob, size_t length, const char *format, char **err) {
+	char *result = NULL;
+	ImageInfo *image_info = AcquireImageInfo();
+	ExceptionInfo *exception = AcquireExceptionInfo();
+
+	Image *image = BlobToImage(image_info, blob, length, exception);
+	if (image == NULL) {
+		*err = exception_message(exception);
+	} else {
+		result = AcquireString("");
+		for (Image *next = image; next != NULL; next = GetNextImageInList(next)) {
+			char *props = InterpretImageProperties(image_info, next, format, exception);
+			if (props == NULL) {
+				*err = exception_message(exception);
+				break;
+			}
+			ConcatenateString(&result, props);
+			DestroyString(props);
+		}
+		if (*err != NULL) {
+			result = DestroyString(result);
+		} else {
+			char *copy = strdup(result);
+			DestroyString(result);
+			result = copy;
+		}
+		DestroyImageList(image);
+	}
+
+	DestroyImageInfo(image_info);
+	DestroyExceptionInfo(exception);
+	return result;
+}
+*/
+import "C"
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/Pixboost/transformimgs/v8/img"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+var wandGenesis sync.Once
+
+// wandRunner runs ImageMagick commands in-process using MagickWand API.
+// Input and output images are passed through pipes using "fd:" ImageMagick
+// file names, so arguments are the same as for the convert binary.
+type wandRunner struct{}
+
+// NewImageMagickWand creates a new ImageMagick processor that runs ImageMagick in-process
+// using MagickWand C API instead of executing convert and identify binaries for each request.
+// This eliminates fork/exec overhead and command line size limits.
+//
+// It's only available when built with "magickwand" tag and MagickWand development
+// libraries installed:
+//
+//	go build -tags magickwand
+func NewImageMagickWand() (*ImageMagick, error) {
+	_, err := exec.LookPath("illustration")
+	if err != nil {
+		return nil, err
+	}
+
+	wandGenesis.Do(func() {
+		C.MagickWandGenesis()
+	})
+
+	return &ImageMagick{
+		runner:         &wandRunner{},
+		AdditionalArgs: []string{},
+	}, nil
+}
+
+func (r *wandRunner) convert(in io.Reader, args []string) (*bytes.Buffer, error) {
+	inR, inW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer inR.Close()
+	outR, outW, err := os.Pipe()
+	if err != nil {
+		_ = inW.Close()
+		return nil, err
+	}
+	defer outR.Close()
+
+	// ImageMagick closes files when finished, so giving it copies of descriptors
+	inFd, err := syscall.Dup(int(inR.Fd()))
+	if err != nil {
+		_ = inW.Close()
+		_ = outW.Close()
+		return nil, err
+	}
+	outFd, err := syscall.Dup(int(outW.Fd()))
+	if err != nil {
+		_ = syscall.Close(inFd)
+		_ = inW.Close()
+		_ = outW.Close()
+		return nil, err
+	}
+
+	wandArgs := make([]string, 0, len(args)+1)
+	wandArgs = append(wandArgs, "convert")
+	inputReplaced := false
+	for i, a := range args {
+		switch {
+		case i == len(args)-1:
+			wandArgs = append(wandArgs, strings.TrimSuffix(a, "-")+fmt.Sprintf("fd:%d", outFd))
+		case a == "-" && !inputReplaced:
+			wandArgs = append(wandArgs, fmt.Sprintf("fd:%d", inFd))
+			inputReplaced = true
+		default:
+			wandArgs = append(wandArgs, a)
+		}
+	}
+
+	go func() {
+		_, _ = io.Copy(inW, in)
+		_ = inW.Close()
+	}()
+
+	out := img.GetBuffer()
+	readDone := make(chan error, 1)
+	go func() {
+		_, err := out.ReadFrom(outR)
+		readDone <- err
+	}()
+
+	cArgs := make([]*C.char, len(wandArgs))
+	for i, a := range wandArgs {
+		cArgs[i] = C.CString(a)
+	}
+	defer func() {
+		for _, a := range cArgs {
+			C.free(unsafe.Pointer(a))
+		}
+	}()
+
+	cErr := C.im_convert(C.int(len(cArgs)), (**C.char)(unsafe.Pointer(&cArgs[0])))
+	closeIfSame(inFd, inR)
+	closeIfSame(outFd, outW)
+	_ = outW.Close()
+	readErr := <-readDone
+
+	if cErr != nil {
+		msg := C.GoString(cErr)
+		C.free(unsafe.Pointer(cErr))
+		img.PutBuffer(out)
+		return nil, fmt.Errorf("%w: Error executing convert command: %s", img.ErrEncodeFailed, msg)
+	}
+	if readErr != nil {
+		img.PutBuffer(out)
+		return nil, readErr
+	}
+
+	return out, nil
+}
+
+func (r *wandRunner) identify(in []byte, format string) (string, error) {
+	if len(in) == 0 {
+		return "", fmt.Errorf("Error executing identify command: empty image")
+	}
+
+	cFormat := C.CString(format)
+	defer C.free(unsafe.Pointer(cFormat))
+	var cErr *C.char
+	result := C.im_identify(unsafe.Pointer(&in[0]), C.size_t(len(in)), cFormat, &cErr)
+	if cErr != nil {
+		msg := C.GoString(cErr)
+		C.free(unsafe.Pointer(cErr))
+		return "", fmt.Errorf("Error executing identify command: %s", msg)
+	}
+	defer C.free(unsafe.Pointer(result))
+
+	return C.GoString(result), nil
+}
+
+// closeIfSame closes the descriptor if it still refers to the same pipe as f.
+// ImageMagick closes files that it opened, but it might not open them at all on errors.
+func closeIfSame(fd int, f *os.File) {
+	var fdStat, fStat syscall.Stat_t
+	if syscall.Fstat(fd, &fdStat) != nil || syscall.Fstat(int(f.Fd()), &fStat) != nil {
+		return
+	}
+	if fdStat.Dev == fStat.Dev && fdStat.Ino == fStat.Ino {
+		_ = syscall.Close(fd)
+	}
+}
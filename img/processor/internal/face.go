@@ -0,0 +1,87 @@
+package internal
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// MinSkinRegion is the minimum part of the image covered by the skin region that is treated as a face.
+const MinSkinRegion = 0.01
+
+// SkinRegion returns the bounding box of the largest connected region of skin colored pixels
+// or an empty rectangle if the region is smaller than MinSkinRegion of the image. Pixels are
+// classified using thresholds of Cb and Cr chroma components that don't depend on the lighting.
+func SkinRegion(m image.Image) image.Rectangle {
+	bounds := m.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	skin := make([]bool, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			r, g, b, a := m.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			if a < 0x8000 {
+				continue
+			}
+			_, cb, cr := color.RGBToYCbCr(uint8(r>>8), uint8(g>>8), uint8(b>>8))
+			skin[y*width+x] = cb >= 77 && cb <= 127 && cr >= 133 && cr <= 173
+		}
+	}
+
+	var (
+		largest     image.Rectangle
+		largestSize int
+		visited     = make([]bool, len(skin))
+		queue       []int
+	)
+	for start := range skin {
+		if !skin[start] || visited[start] {
+			continue
+		}
+		region := image.Rect(start%width, start/width, start%width+1, start/width+1)
+		size := 0
+		visited[start] = true
+		queue = append(queue[:0], start)
+		for len(queue) > 0 {
+			i := queue[len(queue)-1]
+			queue = queue[:len(queue)-1]
+			size++
+			x, y := i%width, i/width
+			region = region.Union(image.Rect(x, y, x+1, y+1))
+			for _, n := range [][2]int{{x - 1, y}, {x + 1, y}, {x, y - 1}, {x, y + 1}} {
+				if n[0] < 0 || n[0] >= width || n[1] < 0 || n[1] >= height {
+					continue
+				}
+				j := n[1]*width + n[0]
+				if skin[j] && !visited[j] {
+					visited[j] = true
+					queue = append(queue, j)
+				}
+			}
+		}
+		if size > largestSize {
+			largest, largestSize = region, size
+		}
+	}
+
+	if float64(largestSize) < MinSkinRegion*float64(width*height) {
+		return image.Rectangle{}
+	}
+	return largest
+}
+
+// AvatarCrop returns the square region of the image with the given size that contains the face
+// in the center with the padding around it, e.g. 2 for the region twice as big as the face.
+// The region is moved inside the image if the face is close to the border. The center square
+// is returned if the face is empty.
+func AvatarCrop(width int, height int, face image.Rectangle, padding float64) image.Rectangle {
+	side := min(width, height)
+	centerX, centerY := width/2, height/2
+	if !face.Empty() {
+		side = min(side, max(1, int(math.Round(float64(max(face.Dx(), face.Dy()))*padding))))
+		centerX, centerY = (face.Min.X+face.Max.X)/2, (face.Min.Y+face.Max.Y)/2
+	}
+
+	x := min(max(0, centerX-side/2), width-side)
+	y := min(max(0, centerY-side/2), height-side)
+	return image.Rect(x, y, x+side, y+side)
+}
@@ -0,0 +1,56 @@
+package internal
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestSkinRegion(t *testing.T) {
+	background := color.RGBA{R: 40, G: 90, B: 200, A: 255}
+	skin := color.RGBA{R: 224, G: 172, B: 138, A: 255}
+
+	m := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for x := 0; x < 64; x++ {
+		for y := 0; y < 64; y++ {
+			m.Set(x, y, background)
+		}
+	}
+	// Small region is ignored in favour of the largest one
+	m.Set(2, 2, skin)
+	for x := 20; x < 40; x++ {
+		for y := 10; y < 36; y++ {
+			m.Set(x, y, skin)
+		}
+	}
+
+	if region := SkinRegion(m); region != image.Rect(20, 10, 40, 36) {
+		t.Errorf("expected region (20,10)-(40,36), but got %v", region)
+	}
+
+	noFace := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	noFace.Set(5, 5, skin)
+	if region := SkinRegion(noFace); !region.Empty() {
+		t.Errorf("expected empty region, but got %v", region)
+	}
+}
+
+func TestAvatarCrop(t *testing.T) {
+	tests := []struct {
+		width, height int
+		face          image.Rectangle
+		expected      image.Rectangle
+	}{
+		{400, 300, image.Rectangle{}, image.Rect(50, 0, 350, 300)},
+		{400, 300, image.Rect(150, 100, 200, 150), image.Rect(125, 75, 225, 175)},
+		{400, 300, image.Rect(0, 0, 50, 50), image.Rect(0, 0, 100, 100)},
+		{400, 300, image.Rect(350, 250, 400, 300), image.Rect(300, 200, 400, 300)},
+		{400, 300, image.Rect(0, 0, 400, 300), image.Rect(50, 0, 350, 300)},
+	}
+
+	for _, tt := range tests {
+		if crop := AvatarCrop(tt.width, tt.height, tt.face, 2); crop != tt.expected {
+			t.Errorf("%dx%d with face %v: expected %v, but got %v", tt.width, tt.height, tt.face, tt.expected, crop)
+		}
+	}
+}
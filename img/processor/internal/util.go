@@ -5,6 +5,7 @@ import (
 	"github.com/Pixboost/transformimgs/v8/img"
 	"regexp"
 	"strconv"
+	"strings"
 )
 
 var (
@@ -67,3 +68,47 @@ func CalculateTargetSizeForResize(source *img.Info, target *img.Info, targetSize
 
 	return nil
 }
+
+// FastDownscaleMinRatio is the minimum ratio between source and target
+// sizes when the fast downscale is worth doing.
+const FastDownscaleMinRatio = 4
+
+// CalculateFastDownscale returns the scale of the intermediate image for the fast
+// downscale before the high-quality resize. The intermediate image keeps at least 2x of
+// the target size in both dimensions regardless of the image orientation.
+//
+// Returns 0 if the fast downscale is not required.
+func CalculateFastDownscale(source *img.Info, target *img.Info) float64 {
+	if source.Width <= 0 || source.Height <= 0 || target.Width <= 0 || target.Height <= 0 {
+		return 0
+	}
+
+	sourceMin := source.Width
+	if source.Height < sourceMin {
+		sourceMin = source.Height
+	}
+	targetMax := target.Width
+	if target.Height > targetMax {
+		targetMax = target.Height
+	}
+
+	if sourceMin < targetMax*FastDownscaleMinRatio {
+		return 0
+	}
+
+	return 2 * float64(targetMax) / float64(sourceMin)
+}
+
+var wideGamutProfiles = []string{"p3", "adobe rgb", "prophoto", "2020"}
+
+// IsWideGamutProfile returns true if ICC profile description belongs
+// to the wide-gamut color space, e.g. Display P3, Adobe RGB, ProPhoto or Rec. 2020.
+func IsWideGamutProfile(description string) bool {
+	description = strings.ToLower(description)
+	for _, p := range wideGamutProfiles {
+		if strings.Contains(description, p) {
+			return true
+		}
+	}
+	return false
+}
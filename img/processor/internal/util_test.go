@@ -135,3 +135,43 @@ func FuzzCalculateTargetSizeForResize(f *testing.F) {
 		}, target, targetSize)
 	})
 }
+
+func TestCalculateFastDownscale(t *testing.T) {
+	tests := []struct {
+		source        *img.Info
+		target        *img.Info
+		expectedScale float64
+	}{
+		{&img.Info{Width: 6000, Height: 4000}, &img.Info{Width: 300, Height: 200}, 0.15},
+		{&img.Info{Width: 4000, Height: 6000}, &img.Info{Width: 300, Height: 450}, 0.225},
+		{&img.Info{Width: 1000, Height: 1000}, &img.Info{Width: 300, Height: 300}, 0},
+		{&img.Info{Width: 1200, Height: 1200}, &img.Info{Width: 300, Height: 300}, 0.5},
+		{&img.Info{Width: 6000, Height: 4000}, &img.Info{Width: 0, Height: 0}, 0},
+		{&img.Info{Width: 0, Height: 0}, &img.Info{Width: 300, Height: 200}, 0},
+	}
+
+	for idx, tt := range tests {
+		scale := CalculateFastDownscale(tt.source, tt.target)
+		if scale != tt.expectedScale {
+			t.Errorf("Test %d failed: Expected [%f] scale, but got [%f]", idx, tt.expectedScale, scale)
+		}
+	}
+}
+
+func TestIsWideGamutProfile(t *testing.T) {
+	tests := map[string]bool{
+		"Display P3":                true,
+		"Adobe RGB (1998)":          true,
+		"ProPhoto RGB":              true,
+		"ITU-R BT.2020":             true,
+		"sRGB IEC61966-2.1":         false,
+		"U.S. Web Coated (SWOP) v2": false,
+		"":                          false,
+	}
+
+	for description, expected := range tests {
+		if IsWideGamutProfile(description) != expected {
+			t.Errorf("Expected [%t] for [%s]", expected, description)
+		}
+	}
+}
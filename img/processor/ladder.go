@@ -0,0 +1,102 @@
+package processor
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/Pixboost/transformimgs/v8/img"
+	"github.com/Pixboost/transformimgs/v8/img/processor/internal"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Ladder resizes the image to each width of img.LadderConfig preserving aspect ratio. The source
+// is decoded once and each width is written from a clone of the decoded image, so all images have
+// the same output format and quality that are selected for the biggest width.
+//
+// Images are written to temporary files, so ladders are not supported when ImageMagick runs in-process.
+func (p *ImageMagick) Ladder(config *img.TransformationConfig) ([]*img.Image, error) {
+	ladderConfig, ok := config.Config.(*img.LadderConfig)
+	if !ok {
+		return nil, fmt.Errorf("could not get ladderConfig")
+	}
+	if len(ladderConfig.Widths) == 0 {
+		return nil, fmt.Errorf("ladder must have at least one width")
+	}
+	if p.runner != nil {
+		return nil, img.NewHttpError(http.StatusNotImplemented, "ladders are not supported by in-process ImageMagick")
+	}
+
+	source, err := p.getSourceInfo(config)
+	if err != nil {
+		return nil, err
+	}
+	if source.Frames > 1 {
+		return nil, img.NewHttpError(http.StatusUnsupportedMediaType, "ladders of animated images are not supported")
+	}
+
+	targets := make([]*img.Info, len(ladderConfig.Widths))
+	for i, width := range ladderConfig.Widths {
+		targets[i] = &img.Info{Opaque: source.Opaque}
+		if err = internal.CalculateTargetSizeForResize(source, targets[i], strconv.Itoa(width)); err != nil {
+			p.log().Errorf("could not calculate target size for [%s], width: [%d]\n", config.Src.Id, width)
+		}
+	}
+	largest := targets[len(targets)-1]
+	outputFormatArg, mimeType := getOutputFormat(source, largest, config.SupportedFormats)
+	format := strings.TrimSuffix(outputFormatArg, "-")
+	if len(format) == 0 {
+		format = strings.ToLower(source.Format) + ":"
+		mimeType = config.Src.MimeType
+	}
+
+	dir, err := os.MkdirTemp("", "transformimgs-ladder-")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	colorProfileOpts, keepProfileOpts := p.getColorProfileOptions(source, config)
+
+	args := []string{"-"} //Input
+	args = append(args, getBeforeTransformConvertFormatOptions(config, source, mimeType)...)
+	args = append(args, colorProfileOpts...)
+	args = append(args, beforeResizeConvertOpts...)
+	args = append(args, p.getQualityOptions(source, config, mimeType)...)
+	args = append(args, p.AdditionalArgs...)
+	args = append(args, convertOpts...)
+	args = append(args, keepProfileOpts...)
+	args = append(args, getConvertFormatOptions(source, mimeType)...)
+	paths := make([]string, len(ladderConfig.Widths))
+	for i, width := range ladderConfig.Widths {
+		paths[i] = filepath.Join(dir, strconv.Itoa(i))
+		args = append(args, "(", "+clone", "-resize", strconv.Itoa(width), "-write", format+paths[i], "+delete", ")")
+	}
+	args = append(args, "null:") //Output
+
+	out, err := p.execImagemagick(bytes.NewReader(config.Src.Data), args, config.Src.Id)
+	if err != nil {
+		return nil, err
+	}
+	img.PutBuffer(out)
+	setDebug(config, source, largest, args, mimeType)
+
+	images := make([]*img.Image, 0, len(paths))
+	for i, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read image of width [%d]: %w", ladderConfig.Widths[i], err)
+		}
+		images = append(images, &img.Image{
+			Data:     data,
+			MimeType: mimeType,
+			Width:    targets[i].Width,
+			Height:   targets[i].Height,
+		})
+	}
+	return images, nil
+}
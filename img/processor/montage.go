@@ -0,0 +1,140 @@
+package processor
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/Pixboost/transformimgs/v8/img"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// MontageBackground is the color of gaps and empty cells of the montage.
+var MontageBackground = "white"
+
+// Montage tiles images into a grid. Each image is resized to cover the cell and
+// cropped to the cell size. Only the first frame of animated images is used.
+//
+// Images are passed to "convert" command as extra files, so montage is not supported
+// when ImageMagick runs in-process.
+func (p *ImageMagick) Montage(config *img.TransformationConfig) (*img.Image, error) {
+	montageConfig, ok := config.Config.(*img.MontageConfig)
+	if !ok {
+		return nil, fmt.Errorf("could not get montageConfig")
+	}
+	if montageConfig.Columns <= 0 || len(montageConfig.Images) == 0 {
+		return nil, fmt.Errorf("montage must have images and positive number of columns")
+	}
+	if p.runner != nil {
+		return nil, img.NewHttpError(http.StatusNotImplemented, "montage is not supported by in-process ImageMagick")
+	}
+
+	width, height := montageConfig.Size()
+	// Montage is treated as an opaque photo, so it's encoded with lossy compression
+	source := &img.Info{
+		Format: "JPEG",
+		Opaque: true,
+		Width:  width,
+		Height: height,
+	}
+	target := &img.Info{
+		Opaque: true,
+		Width:  width,
+		Height: height,
+	}
+	outputFormatArg, mimeType := getOutputFormat(source, target, config.SupportedFormats)
+	if len(mimeType) == 0 {
+		outputFormatArg, mimeType = "jpg:-", "image/jpeg"
+	}
+
+	args := p.getMontageArgs(config, montageConfig, source, mimeType)
+	args = append(args, outputFormatArg) //Output
+
+	data := make([][]byte, len(montageConfig.Images))
+	for i, image := range montageConfig.Images {
+		data[i] = image.Data
+	}
+	outputImageData, err := p.execImagemagickFiles(data, args, config.Src.Id)
+	if err != nil {
+		return nil, err
+	}
+	setDebug(config, source, target, args, mimeType)
+
+	result := img.NewPooledImage("", outputImageData, mimeType)
+	result.Width, result.Height = width, height
+	return result, nil
+}
+
+// getMontageArgs returns convert arguments without the output. Each row is built in parentheses:
+// cells are extended by the gap to the right and bottom and appended horizontally. Then rows are
+// appended vertically and the trailing gap is cropped.
+func (p *ImageMagick) getMontageArgs(config *img.TransformationConfig, montageConfig *img.MontageConfig, source *img.Info, mimeType string) []string {
+	cellSize := fmt.Sprintf("%dx%d", montageConfig.CellWidth, montageConfig.CellHeight)
+	width, height := montageConfig.Size()
+
+	args := []string{"-background", MontageBackground}
+	for i := range montageConfig.Images {
+		if i%montageConfig.Columns == 0 {
+			args = append(args, "(")
+		}
+		// The first image is passed as the first extra file which is fd 3 in the child process
+		args = append(args, fmt.Sprintf("fd:%d[0]", i+3))
+		if (i+1)%montageConfig.Columns == 0 || i == len(montageConfig.Images)-1 {
+			args = append(args, beforeResizeConvertOpts...)
+			args = append(args,
+				"-resize", cellSize+"^",
+				"-gravity", "center", "-extent", cellSize,
+				"-gravity", "northwest", "-extent", fmt.Sprintf("%dx%d", montageConfig.CellWidth+montageConfig.Gap, montageConfig.CellHeight+montageConfig.Gap),
+				"+append", ")")
+		}
+	}
+	args = append(args, "-gravity", "northwest", "-append", "-crop", fmt.Sprintf("%dx%d+0+0", width, height), "+repage")
+	args = append(args, p.getQualityOptions(source, config, mimeType)...)
+	args = append(args, p.AdditionalArgs...)
+	args = append(args, convertOpts...)
+	args = append(args, getConvertFormatOptions(source, mimeType)...)
+
+	return args
+}
+
+// execImagemagickFiles runs convert command with the given images passed as extra files
+// and returns the output in a buffer from img pool.
+func (p *ImageMagick) execImagemagickFiles(images [][]byte, args []string, imgId string) (*bytes.Buffer, error) {
+	files := make([]*os.File, 0, len(images))
+	defer func() {
+		for _, f := range files {
+			_ = f.Close()
+		}
+	}()
+	for _, data := range images {
+		r, w, err := os.Pipe()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, r)
+		go func(data []byte) {
+			_, _ = w.Write(data)
+			_ = w.Close()
+		}(data)
+	}
+
+	var cmderr bytes.Buffer
+	out := img.GetBuffer()
+	cmd := p.command(p.convertCmd, args...)
+	cmd.ExtraFiles = files
+	cmd.Stdout = out
+	cmd.Stderr = &cmderr
+
+	if Debug {
+		p.log().Printf("[%s] Running convert command with [%d] files, args '%v'\n", imgId, len(images), cmd.Args)
+	}
+	err := cmd.Run()
+	if err != nil {
+		img.PutBuffer(out)
+		p.log().Printf("[%s] Error executing convert command: %s\n", imgId, err.Error())
+		p.log().Printf("[%s] ERROR: %s\n", imgId, cmderr.String())
+		return nil, fmt.Errorf("%w: %w", img.ErrEncodeFailed, &img.CommandError{Command: "convert", Err: err, Stderr: strings.TrimSpace(cmderr.String())})
+	}
+
+	return out, nil
+}
@@ -0,0 +1,128 @@
+package processor
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Pixboost/transformimgs/v8/img"
+	"io"
+)
+
+// DefaultQualityFormat is the key of QualityLadder that is used for
+// output formats without their own entry.
+const DefaultQualityFormat = "default"
+
+// QualityTier maps quality of the source image to quality of the output image.
+type QualityTier struct {
+	// MinSourceQuality is the minimum quality of the source image the tier is applied to.
+	MinSourceQuality int `json:"minSourceQuality"`
+	// Quality is the quality of the output image. Zero means quality of the source image.
+	Quality int `json:"quality"`
+}
+
+// FormatQuality defines quality of the output images in one format.
+type FormatQuality struct {
+	// Tiers are checked in order and the first one matching the source quality is used.
+	// If none is matched then quality of the source image is used.
+	Tiers []QualityTier `json:"tiers"`
+	// Low is added to the quality when reduced quality is requested (img.LOW), e.g. Save-Data is on.
+	Low int `json:"low"`
+	// Lower is added to the quality for high density screens (img.LOWER),
+	// see img.HighDensityDppx.
+	Lower int `json:"lower"`
+}
+
+// QualityLadder defines quality of the output images for each output
+// MIME type, e.g. image/avif. Formats without entry use DefaultQualityFormat.
+// Quality of illustrations is not set, so lossless compression could be used.
+type QualityLadder map[string]*FormatQuality
+
+// DefaultQualityLadder is used when ImageMagick.QualityLadder is not set.
+var DefaultQualityLadder = QualityLadder{
+	AvifMime: {
+		Tiers: []QualityTier{{MinSourceQuality: 86, Quality: 70}, {MinSourceQuality: 76, Quality: 60}, {Quality: 50}},
+		Low:   -10,
+		Lower: -20,
+	},
+	JxlMime: {
+		Tiers: []QualityTier{{MinSourceQuality: 86, Quality: 82}, {MinSourceQuality: 76, Quality: 72}, {Quality: 62}},
+		Low:   -10,
+		Lower: -20,
+	},
+	DefaultQualityFormat: {
+		Tiers: []QualityTier{{MinSourceQuality: 100, Quality: 82}},
+		Low:   -10,
+		Lower: -20,
+	},
+}
+
+// LoadQualityLadder reads quality ladder in JSON format, e.g.
+//
+//	{
+//	  "image/avif": {"tiers": [{"minSourceQuality": 86, "quality": 70}, {"quality": 50}], "low": -10, "lower": -20},
+//	  "default": {"tiers": [{"minSourceQuality": 100, "quality": 82}], "low": -10, "lower": -20}
+//	}
+func LoadQualityLadder(r io.Reader) (QualityLadder, error) {
+	var ladder QualityLadder
+	err := json.NewDecoder(r).Decode(&ladder)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse quality ladder: %w", err)
+	}
+
+	for format, q := range ladder {
+		if q == nil {
+			return nil, fmt.Errorf("quality of [%s] is empty", format)
+		}
+		for _, t := range q.Tiers {
+			if t.Quality < 0 || t.Quality > 100 {
+				return nil, fmt.Errorf("quality of [%s] must be between 0 and 100, but got [%d]", format, t.Quality)
+			}
+		}
+	}
+
+	return ladder, nil
+}
+
+// Quality returns quality of the output image in the given format.
+// Returns 0 if quality should not be set, so ImageMagick keeps the quality of the source.
+func (l QualityLadder) Quality(source *img.Info, quality img.Quality, outputMimeType string) int {
+	if source.Illustration {
+		return 0
+	}
+
+	formatQuality, ok := l[outputMimeType]
+	if !ok {
+		formatQuality, ok = l[DefaultQualityFormat]
+	}
+	if !ok {
+		return 0
+	}
+
+	result := 0
+	for _, t := range formatQuality.Tiers {
+		if source.Quality >= t.MinSourceQuality {
+			result = t.Quality
+			break
+		}
+	}
+	if result == 0 && quality != img.DEFAULT {
+		result = source.Quality
+	}
+	if result == 0 {
+		return 0
+	}
+
+	// If using lossy compression, then we can go lower
+	if result != 100 {
+		switch quality {
+		case img.LOW:
+			result += formatQuality.Low
+		case img.LOWER:
+			result += formatQuality.Lower
+		}
+	}
+	if result < 1 {
+		result = 1
+	}
+
+	return result
+}
@@ -0,0 +1,52 @@
+package processor_test
+
+import (
+	"github.com/Pixboost/transformimgs/v8/img"
+	"github.com/Pixboost/transformimgs/v8/img/processor"
+	"github.com/dooman87/kolibri/test"
+	"strings"
+	"testing"
+)
+
+func TestDefaultQualityLadder(t *testing.T) {
+	l := processor.DefaultQualityLadder
+	jpeg := &img.Info{Quality: 90}
+	lowJpeg := &img.Info{Quality: 70}
+	png := &img.Info{Quality: 100}
+
+	test.Error(t,
+		test.Equal(70, l.Quality(jpeg, img.DEFAULT, processor.AvifMime), "avif"),
+		test.Equal(40, l.Quality(lowJpeg, img.LOW, processor.AvifMime), "avif low"),
+		test.Equal(62, l.Quality(jpeg, img.LOWER, processor.JxlMime), "jxl lower"),
+		test.Equal(0, l.Quality(jpeg, img.DEFAULT, processor.WebpMime), "webp keeps source quality"),
+		test.Equal(80, l.Quality(jpeg, img.LOW, processor.WebpMime), "webp low"),
+		test.Equal(82, l.Quality(png, img.DEFAULT, ""), "png"),
+		test.Equal(0, l.Quality(&img.Info{Quality: 100, Illustration: true}, img.LOW, processor.AvifMime), "illustration"),
+	)
+}
+
+func TestLoadQualityLadder(t *testing.T) {
+	l, err := processor.LoadQualityLadder(strings.NewReader(`{
+		"image/webp": {"tiers": [{"minSourceQuality": 80, "quality": 75}, {"quality": 65}], "low": -15},
+		"default": {"tiers": [{"quality": 80}]}
+	}`))
+
+	test.Error(t,
+		test.Nil(err, "error"),
+		test.Equal(75, l.Quality(&img.Info{Quality: 90}, img.DEFAULT, processor.WebpMime), "webp"),
+		test.Equal(50, l.Quality(&img.Info{Quality: 70}, img.LOW, processor.WebpMime), "webp low"),
+		test.Equal(80, l.Quality(&img.Info{Quality: 90}, img.LOWER, processor.AvifMime), "default"),
+	)
+}
+
+func TestLoadQualityLadder_Errors(t *testing.T) {
+	_, errJson := processor.LoadQualityLadder(strings.NewReader(`{"image/webp": [`))
+	_, errQuality := processor.LoadQualityLadder(strings.NewReader(`{"image/webp": {"tiers": [{"quality": 120}]}}`))
+	_, errEmpty := processor.LoadQualityLadder(strings.NewReader(`{"image/webp": null}`))
+
+	test.Error(t,
+		test.NotNil(errJson, "invalid json"),
+		test.Equal("quality of [image/webp] must be between 0 and 100, but got [120]", errQuality.Error(), "invalid quality"),
+		test.Equal("quality of [image/webp] is empty", errEmpty.Error(), "empty format"),
+	)
+}
@@ -0,0 +1,49 @@
+package processor
+
+import (
+	"errors"
+	"github.com/Pixboost/transformimgs/v8/img"
+	"strings"
+)
+
+// TransientErrors are parts of ImageMagick error messages that are known to be transient,
+// e.g. resource limits that are hit when many large images are transformed at the same time
+// or races on temporary files. Matching is case-insensitive.
+var TransientErrors = []string{
+	"cache resources exhausted",
+	"resource limit",
+	"unable to extend cache",
+	"memory allocation failed",
+	"unable to create temporary file",
+	"/magick-",
+}
+
+// IsTransientError returns true if the error is the encoding error with one of TransientErrors
+// in the message, so the transformation could succeed on retry.
+func IsTransientError(err error) bool {
+	if err == nil || !errors.Is(err, img.ErrEncodeFailed) {
+		return false
+	}
+	msg := strings.ToLower(err.Error())
+	for _, e := range TransientErrors {
+		if strings.Contains(msg, strings.ToLower(e)) {
+			return true
+		}
+	}
+	return false
+}
+
+// fallbackConfig returns the copy of the config for the retry of the transformation with the fallback
+// format if the encoding to a next generation format failed with a transient error and RetryTransient
+// is set. Returns nil if the transformation shouldn't be retried. The fallback format is never retried,
+// so the transformation runs at most twice.
+func (p *ImageMagick) fallbackConfig(config *img.TransformationConfig, mimeType string, err error) *img.TransformationConfig {
+	if !p.RetryTransient || len(mimeType) == 0 || !IsTransientError(err) {
+		return nil
+	}
+	p.log().Printf("[%s] WARNING: transient error while encoding to [%s], retrying with the fallback format: %s\n", config.Src.Id, mimeType, err)
+
+	retry := *config
+	retry.SupportedFormats = nil
+	return &retry
+}
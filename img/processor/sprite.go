@@ -0,0 +1,64 @@
+package processor
+
+import (
+	"fmt"
+	"github.com/Pixboost/transformimgs/v8/img"
+	"net/http"
+)
+
+// Sprite draws images at positions of their cells on the transparent canvas.
+// Images are not resized and only the first frame of animated images is used.
+//
+// Images are passed to "convert" command as extra files, so sprites are not supported
+// when ImageMagick runs in-process.
+func (p *ImageMagick) Sprite(config *img.TransformationConfig) (*img.Image, error) {
+	spriteConfig, ok := config.Config.(*img.SpriteConfig)
+	if !ok {
+		return nil, fmt.Errorf("could not get spriteConfig")
+	}
+	if len(spriteConfig.Images) == 0 || len(spriteConfig.Images) != len(spriteConfig.Cells) {
+		return nil, fmt.Errorf("sprite sheet must have a cell for each image")
+	}
+	if p.runner != nil {
+		return nil, img.NewHttpError(http.StatusNotImplemented, "sprites are not supported by in-process ImageMagick")
+	}
+
+	// Sprites are usually icons and logos, so they are encoded losslessly
+	source := &img.Info{
+		Format:       "PNG",
+		Illustration: true,
+		Width:        spriteConfig.Width,
+		Height:       spriteConfig.Height,
+	}
+	target := &img.Info{
+		Width:  spriteConfig.Width,
+		Height: spriteConfig.Height,
+	}
+	outputFormatArg, mimeType := getOutputFormat(source, target, config.SupportedFormats)
+	if len(mimeType) == 0 {
+		outputFormatArg, mimeType = "png:-", "image/png"
+	}
+
+	args := []string{"-size", fmt.Sprintf("%dx%d", spriteConfig.Width, spriteConfig.Height), "xc:none"}
+	data := make([][]byte, len(spriteConfig.Images))
+	for i, image := range spriteConfig.Images {
+		data[i] = image.Data
+		cell := spriteConfig.Cells[i]
+		// The first image is passed as the first extra file which is fd 3 in the child process
+		args = append(args, fmt.Sprintf("fd:%d[0]", i+3), "-geometry", fmt.Sprintf("+%d+%d", cell.X, cell.Y), "-composite")
+	}
+	args = append(args, p.AdditionalArgs...)
+	args = append(args, convertOpts...)
+	args = append(args, getConvertFormatOptions(source, mimeType)...)
+	args = append(args, outputFormatArg) //Output
+
+	outputImageData, err := p.execImagemagickFiles(data, args, config.Src.Id)
+	if err != nil {
+		return nil, err
+	}
+	setDebug(config, source, target, args, mimeType)
+
+	result := img.NewPooledImage("", outputImageData, mimeType)
+	result.Width, result.Height = spriteConfig.Width, spriteConfig.Height
+	return result, nil
+}
@@ -0,0 +1,85 @@
+package processor
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/Pixboost/transformimgs/v8/img"
+)
+
+// tileOutputs are output arguments and MIME types of tile formats.
+var tileOutputs = map[string][2]string{
+	"jpg":  {"jpg:-", "image/jpeg"},
+	"png":  {"png:-", "image/png"},
+	"webp": {"webp:-", WebpMime},
+}
+
+// Tile cuts the region of the source image and resizes it to the target size ignoring
+// the aspect ratio. Only the first frame of animated images is used.
+func (p *ImageMagick) Tile(config *img.TransformationConfig) (*img.Image, error) {
+	tileConfig, ok := config.Config.(*img.TileConfig)
+	if !ok {
+		return nil, fmt.Errorf("could not get tileConfig")
+	}
+	output, ok := tileOutputs[tileConfig.Format]
+	if !ok {
+		return nil, fmt.Errorf("unsupported tile format [%s]", tileConfig.Format)
+	}
+	outputFormatArg, mimeType := output[0], output[1]
+
+	source, err := p.getSourceInfo(config)
+	if err != nil {
+		return nil, err
+	}
+	target := &img.Info{
+		Opaque: source.Opaque,
+		Width:  tileConfig.TargetWidth,
+		Height: tileConfig.TargetHeight,
+	}
+	if tileConfig.Rotation == 90 || tileConfig.Rotation == 270 {
+		target.Width, target.Height = target.Height, target.Width
+	}
+
+	args := p.getTileArgs(config, tileConfig, source, mimeType)
+	args = append(args, outputFormatArg) //Output
+
+	outputImageData, err := p.execImagemagick(bytes.NewReader(config.Src.Data), args, config.Src.Id)
+	if err != nil {
+		return nil, err
+	}
+	setDebug(config, source, target, args, mimeType)
+
+	result := img.NewPooledImage("", outputImageData, mimeType)
+	result.Width, result.Height = target.Width, target.Height
+	return result, nil
+}
+
+// getTileArgs returns convert arguments without the output.
+func (p *ImageMagick) getTileArgs(config *img.TransformationConfig, tileConfig *img.TileConfig, source *img.Info, mimeType string) []string {
+	colorProfileOpts, keepProfileOpts := p.getColorProfileOptions(source, config)
+
+	args := []string{"-"} //Input
+	if source.Frames > 1 {
+		args = append(args, "-delete", "1--1")
+	}
+	args = append(args, colorProfileOpts...)
+	args = append(args, beforeResizeConvertOpts...)
+	args = append(args,
+		"-crop", fmt.Sprintf("%dx%d+%d+%d", tileConfig.Width, tileConfig.Height, tileConfig.X, tileConfig.Y), "+repage",
+		"-resize", fmt.Sprintf("%dx%d!", tileConfig.TargetWidth, tileConfig.TargetHeight))
+	if tileConfig.Rotation != 0 {
+		args = append(args, "-rotate", fmt.Sprintf("%d", tileConfig.Rotation))
+	}
+	if tileConfig.Gray {
+		args = append(args, "-colorspace", "Gray")
+	}
+	if mimeType == "image/jpeg" && !source.Opaque {
+		args = append(args, "-background", "white", "-alpha", "remove")
+	}
+	args = append(args, p.getQualityOptions(source, config, mimeType)...)
+	args = append(args, p.AdditionalArgs...)
+	args = append(args, convertOpts...)
+	args = append(args, keepProfileOpts...)
+	args = append(args, getConvertFormatOptions(source, mimeType)...)
+
+	return args
+}
@@ -0,0 +1,83 @@
+package processor
+
+import (
+	"bytes"
+	"github.com/Pixboost/transformimgs/v8/img"
+	"strconv"
+	"strings"
+)
+
+// TranscodeQuality is the quality of photos converted by Transcode. It's high enough, so
+// the result is visually equivalent to the source. Illustrations are converted losslessly.
+var TranscodeQuality = 90
+
+// Transcode converts an image to the best format supported by the client without resizing.
+// Quality of the config is ignored, so the result is visually equivalent to the source.
+// The source is returned if it's already in that format or the converted image is bigger.
+func (p *ImageMagick) Transcode(config *img.TransformationConfig) (*img.Image, error) {
+	source, err := p.getSourceInfo(config)
+	if err != nil {
+		return nil, err
+	}
+
+	target := &img.Info{
+		Opaque: source.Opaque,
+		Width:  source.Width,
+		Height: source.Height,
+	}
+	outputFormatArg, mimeType := getOutputFormat(source, target, config.SupportedFormats)
+	if len(mimeType) == 0 || mimeType == "image/"+strings.ToLower(source.Format) {
+		return sourceAsIs(config, source), nil
+	}
+
+	colorProfileOpts, keepProfileOpts := p.getColorProfileOptions(source, config)
+
+	args := make([]string, 0)
+	args = append(args, "-") //Input
+	args = append(args, getBeforeTransformConvertFormatOptions(config, source, mimeType)...)
+	args = append(args, colorProfileOpts...)
+	args = append(args, beforeResizeConvertOpts...)
+	if !source.Illustration {
+		args = append(args, "-quality", strconv.Itoa(TranscodeQuality))
+	}
+	args = append(args, p.AdditionalArgs...)
+	if p.GetAdditionalArgs != nil {
+		args = append(args, p.GetAdditionalArgs("transcode", config.Src.Data, source, target)...)
+	}
+	args = append(args, convertOpts...)
+	args = append(args, keepProfileOpts...)
+	args = append(args, getConvertFormatOptions(source, mimeType)...)
+	args = append(args, outputFormatArg) //Output
+
+	outputImageData, err := p.execImagemagick(bytes.NewReader(config.Src.Data), args, config.Src.Id)
+	if err != nil {
+		if retry := p.fallbackConfig(config, mimeType, err); retry != nil {
+			return p.Transcode(retry)
+		}
+		return nil, err
+	}
+	setDebug(config, source, target, args, mimeType)
+
+	if outputImageData.Len() >= len(config.Src.Data) {
+		img.PutBuffer(outputImageData)
+		return sourceAsIs(config, source), nil
+	}
+
+	result := img.NewPooledImage("", outputImageData, mimeType)
+	result.Width, result.Height = target.Width, target.Height
+	result.Frames = outputFrames(config, source)
+	return result, nil
+}
+
+// sourceAsIs returns the source image as the result. Data belongs to the source, so the
+// result must not be released separately.
+func sourceAsIs(config *img.TransformationConfig, source *img.Info) *img.Image {
+	return &img.Image{
+		Id:       config.Src.Id,
+		Data:     config.Src.Data,
+		MimeType: config.Src.MimeType,
+		Width:    source.Width,
+		Height:   source.Height,
+		Frames:   source.Frames,
+	}
+}
@@ -0,0 +1,117 @@
+package processor
+
+import (
+	"fmt"
+	"github.com/Pixboost/transformimgs/v8/img"
+	"github.com/Pixboost/transformimgs/v8/img/processor/internal"
+)
+
+// upscaleFilterOpts select Lanczos filter that keeps more details than the default
+// filter when images are enlarged.
+var upscaleFilterOpts = []string{"-filter", "Lanczos"}
+
+// upscaleSharpenOpts restore edges that are softened by interpolation.
+var upscaleSharpenOpts = []string{"-unsharp", "0x0.75+0.75+0.008"}
+
+// Upscale enlarges an image to the given size preserving aspect ratio using Lanczos filter and
+// sharpening. If SuperResolution is set, then the source is enlarged by the hook first.
+//
+// Format of the size argument is the same as for Resize.
+func (p *ImageMagick) Upscale(config *img.TransformationConfig) (*img.Image, error) {
+	source, err := p.getSourceInfo(config)
+	if err != nil {
+		return nil, err
+	}
+
+	sharpen := true
+	if p.SuperResolution != nil {
+		resizeConfig, ok := config.Config.(*img.ResizeConfig)
+		if !ok {
+			return nil, fmt.Errorf("could not get resizeConfig")
+		}
+		target := &img.Info{}
+		if err = internal.CalculateTargetSizeForResize(source, target, resizeConfig.Size); err == nil &&
+			target.Width > source.Width && target.Height > source.Height {
+			enlarged, err := p.SuperResolution(config.Src, target)
+			if err != nil {
+				return nil, err
+			}
+			defer enlarged.Release()
+			if len(enlarged.Id) == 0 {
+				enlarged.Id = config.Src.Id
+			}
+
+			enlargedConfig := *config
+			enlargedConfig.Src = enlarged
+			enlargedConfig.SrcInfo = nil
+			config = &enlargedConfig
+			source, err = p.getSourceInfo(config)
+			if err != nil {
+				return nil, err
+			}
+			// The model restores details, so sharpening would only add halos
+			sharpen = false
+		}
+	}
+
+	args, target, mimeType, err := p.getUpscaleArgs(config, source, sharpen)
+	if err != nil {
+		return nil, err
+	}
+
+	outputImageData, args, err := p.encode(config, source, args, mimeType)
+	if err != nil {
+		if retry := p.fallbackConfig(config, mimeType, err); retry != nil {
+			return p.Upscale(retry)
+		}
+		return nil, err
+	}
+	setDebug(config, source, target, args, mimeType)
+
+	return withSize(img.NewPooledImage("", outputImageData, mimeType), config, source, target), nil
+}
+
+// getUpscaleArgs returns convert arguments, the target and MIME type of the output for upscale.
+func (p *ImageMagick) getUpscaleArgs(config *img.TransformationConfig, source *img.Info, sharpen bool) ([]string, *img.Info, string, error) {
+	resizeConfig, ok := config.Config.(*img.ResizeConfig)
+	if !ok {
+		return nil, nil, "", fmt.Errorf("could not get resizeConfig")
+	}
+
+	targetSize := resizeConfig.Size
+	target := &img.Info{
+		Opaque: source.Opaque,
+	}
+	err := internal.CalculateTargetSizeForResize(source, target, targetSize)
+	if err != nil {
+		p.log().Errorf("could not calculate target size for [%s], targetSize: [%s]\n", config.Src.Id, targetSize)
+	}
+	targetSize = limitTargetSize(config, target, targetSize)
+	outputFormatArg, mimeType := getOutputFormat(source, target, config.SupportedFormats)
+
+	colorProfileOpts, keepProfileOpts := p.getColorProfileOptions(source, config)
+
+	args := make([]string, 0)
+	args = append(args, "-") //Input
+	args = append(args, getBeforeTransformConvertFormatOptions(config, source, mimeType)...)
+	args = append(args, colorProfileOpts...)
+	args = append(args, beforeResizeConvertOpts...)
+	args = append(args, upscaleFilterOpts...)
+	args = append(args, "-resize", targetSize)
+	if sharpen {
+		args = append(args, upscaleSharpenOpts...)
+	}
+	args = append(args, p.getQualityOptions(source, config, mimeType)...)
+	args = append(args, p.AdditionalArgs...)
+	if p.GetAdditionalArgs != nil {
+		args = append(args, p.GetAdditionalArgs("upscale", config.Src.Data, source, target)...)
+	}
+	args = append(args, convertOpts...)
+	args = append(args, keepProfileOpts...)
+	args = append(args, p.getGifLossyOptions(config, source, mimeType)...)
+	args = append(args, getColorTypeOptions(config, source, target, mimeType)...)
+	args = append(args, getConvertFormatOptions(source, mimeType)...)
+	args = append(args, outputFormatArg) //Output
+
+	return args, target, mimeType, nil
+}
@@ -0,0 +1,27 @@
+package processor
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/Pixboost/transformimgs/v8/img"
+)
+
+// WarmUpFormats are all output formats of the processor that are encoded by WarmUp.
+var WarmUpFormats = []string{"png", "jpeg", "gif", "webp", "avif", "jxl"}
+
+// WarmUp encodes a tiny image to each format, so delegates are loaded before the first request.
+// Returns an error for the first format that could not be encoded, e.g. when AVIF delegate is missing.
+func (p *ImageMagick) WarmUp(formats []string) error {
+	for _, format := range formats {
+		out, err := p.execImagemagick(bytes.NewReader(nil), []string{"-size", "8x8", "xc:white", format + ":-"}, "warm-up")
+		if err != nil {
+			return fmt.Errorf("could not encode %s image, check that ImageMagick supports the format: %w", format, err)
+		}
+		empty := out.Len() == 0
+		img.PutBuffer(out)
+		if empty {
+			return fmt.Errorf("could not encode %s image, the output is empty", format)
+		}
+	}
+	return nil
+}
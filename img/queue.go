@@ -1,5 +1,7 @@
 package img
 
+import "time"
+
 type Queue struct {
 	ops chan *Command
 }
@@ -15,17 +17,25 @@ func NewQueue() *Queue {
 
 func (q *Queue) start() {
 	for op := range q.ops {
-		if op.Result == nil {
-			Log.Printf("Starting transformation for [%s]", op.Config.Src.Id)
-			op.Result, op.Err = op.Transformation(op.Config)
-			Log.Printf("Finished transformation for [%s]", op.Config.Src.Id)
-		}
-		op.FinishedCond.L.Lock()
-		op.Finished = true
-		op.FinishedCond.L.Unlock()
-
-		op.FinishedCond.Signal()
+		runCommand(op)
+	}
+}
+
+// runCommand runs the transformation of the command and signals that it's finished.
+func runCommand(op *Command) {
+	op.StartedAt = time.Now()
+	if op.Result == nil {
+		log := logOrDefault(op.log)
+		log.Printf("Starting transformation for [%s]", op.Config.Src.Id)
+		op.Result, op.Err = op.Transformation(op.Config)
+		log.Printf("Finished transformation for [%s]", op.Config.Src.Id)
 	}
+	op.FinishedAt = time.Now()
+	op.FinishedCond.L.Lock()
+	op.Finished = true
+	op.FinishedCond.L.Unlock()
+
+	op.FinishedCond.Signal()
 }
 
 func (q *Queue) AddAndWait(op *Command, callback OpCallback) {
@@ -0,0 +1,96 @@
+package img
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ProcessorFactory creates the processor. Factories are called after command line flags
+// are parsed, so plugins could define their own flags when registering.
+type ProcessorFactory func() (Processor, error)
+
+// LoaderFactory creates the loader. Factories are called after command line flags
+// are parsed, so plugins could define their own flags when registering.
+type LoaderFactory func() (Loader, error)
+
+var (
+	registryMu sync.RWMutex
+	processors = make(map[string]ProcessorFactory)
+	loaders    = make(map[string]LoaderFactory)
+)
+
+// RegisterProcessor makes the processor available by the name, e.g. "vips". It's usually called
+// from init function of the plugin package. Panics if the name is already registered or factory is nil.
+func RegisterProcessor(name string, factory ProcessorFactory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if factory == nil {
+		panic("img: processor factory is nil")
+	}
+	if _, exists := processors[name]; exists {
+		panic(fmt.Sprintf("img: processor [%s] is already registered", name))
+	}
+	processors[name] = factory
+}
+
+// RegisterLoader makes the loader available by the name, e.g. "s3". It's usually called
+// from init function of the plugin package. Panics if the name is already registered or factory is nil.
+func RegisterLoader(name string, factory LoaderFactory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if factory == nil {
+		panic("img: loader factory is nil")
+	}
+	if _, exists := loaders[name]; exists {
+		panic(fmt.Sprintf("img: loader [%s] is already registered", name))
+	}
+	loaders[name] = factory
+}
+
+// NewProcessor creates the processor registered with the name.
+func NewProcessor(name string) (Processor, error) {
+	registryMu.RLock()
+	factory, ok := processors[name]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown processor [%s], registered processors are [%s]", name, strings.Join(Processors(), ", "))
+	}
+	return factory()
+}
+
+// NewLoader creates the loader registered with the name.
+func NewLoader(name string) (Loader, error) {
+	registryMu.RLock()
+	factory, ok := loaders[name]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown loader [%s], registered loaders are [%s]", name, strings.Join(Loaders(), ", "))
+	}
+	return factory()
+}
+
+// Processors returns sorted names of registered processors.
+func Processors() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	names := make([]string, 0, len(processors))
+	for name := range processors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Loaders returns sorted names of registered loaders.
+func Loaders() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	names := make([]string, 0, len(loaders))
+	for name := range loaders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
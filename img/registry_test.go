@@ -0,0 +1,66 @@
+package img_test
+
+import (
+	"github.com/Pixboost/transformimgs/v8/img"
+	"strings"
+	"testing"
+)
+
+func TestRegisterProcessor(t *testing.T) {
+	proc := &resizerMock{}
+	img.RegisterProcessor("test-processor", func() (img.Processor, error) {
+		return proc, nil
+	})
+
+	p, err := img.NewProcessor("test-processor")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if p != proc {
+		t.Errorf("expected processor from the factory")
+	}
+
+	_, err = img.NewProcessor("unknown")
+	if err == nil || !strings.Contains(err.Error(), "test-processor") {
+		t.Errorf("expected error with registered processors, but got %v", err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected panic on duplicate registration")
+		}
+	}()
+	img.RegisterProcessor("test-processor", func() (img.Processor, error) {
+		return proc, nil
+	})
+}
+
+func TestRegisterLoader(t *testing.T) {
+	l := &loaderMock{}
+	img.RegisterLoader("test-loader", func() (img.Loader, error) {
+		return l, nil
+	})
+
+	loader, err := img.NewLoader("test-loader")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if loader != l {
+		t.Errorf("expected loader from the factory")
+	}
+	if names := img.Loaders(); len(names) != 1 || names[0] != "test-loader" {
+		t.Errorf("expected [test-loader], but got %v", names)
+	}
+
+	_, err = img.NewLoader("unknown")
+	if err == nil {
+		t.Errorf("expected error")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected panic on nil factory")
+		}
+	}()
+	img.RegisterLoader("nil-loader", nil)
+}
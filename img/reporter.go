@@ -0,0 +1,197 @@
+package img
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dooman87/glogi"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ErrorReport describes the failed transformation.
+type ErrorReport struct {
+	// Op is the name of the operation, e.g. "optimise". Empty for operations that are not named, e.g. montage.
+	Op string
+	// Source is the URL of the source image after ReportSource is applied.
+	Source string
+	// Params are query params of the request.
+	Params url.Values
+	// Category is the category of the error, see ErrorCategory.
+	Category string
+	// Err is the error of the transformation.
+	Err error
+	// Stderr is the standard error output of the processor command if the error is CommandError.
+	Stderr string
+	Time   time.Time
+}
+
+// ErrorReporter sends failed transformations to the error tracking service, e.g. Sentry.
+// Only server errors (5xx) are reported. Report is called while the request is handled,
+// so it must not block.
+type ErrorReporter interface {
+	Report(report *ErrorReport)
+}
+
+// HashSource returns SHA-256 hash of the source URL, so failures of the same source could be
+// grouped without revealing the URL.
+func HashSource(imgUrl string) string {
+	hash := sha256.Sum256([]byte(imgUrl))
+	return hex.EncodeToString(hash[:])
+}
+
+// RedactSource returns the host of the source URL without path and query, which could contain
+// user identifiers or signatures.
+func RedactSource(imgUrl string) string {
+	u, err := url.Parse(imgUrl)
+	if err != nil || len(u.Host) == 0 {
+		return "[redacted]"
+	}
+	return u.Scheme + "://" + u.Host + "/[redacted]"
+}
+
+// reportError reports the failed command if it's a server error and ErrorReporter is set.
+func (r *Service) reportError(op *Command) {
+	if r.ErrorReporter == nil {
+		return
+	}
+	var httpErr *HttpError
+	if errors.As(op.Err, &httpErr) && httpErr.Code() < http.StatusInternalServerError {
+		return
+	}
+
+	report := &ErrorReport{
+		Op:       op.Op,
+		Source:   op.Config.Src.Id,
+		Category: ErrorCategory(op.Err),
+		Err:      op.Err,
+		Time:     time.Now(),
+	}
+	if r.ReportSource != nil {
+		report.Source = r.ReportSource(report.Source)
+	}
+	if op.Req != nil {
+		report.Params = op.Req.URL.Query()
+	}
+	var cmdErr *CommandError
+	if errors.As(op.Err, &cmdErr) {
+		report.Stderr = cmdErr.Stderr
+	}
+	r.ErrorReporter.Report(report)
+}
+
+// SentryReporter sends error reports to Sentry in the background using its HTTP API.
+// Reports are dropped when MaxPendingReports are being sent, so the service is not slowed down
+// when Sentry is unavailable.
+type SentryReporter struct {
+	// Environment is the name of the environment, e.g. "production". Optional.
+	Environment string
+	Client      *http.Client
+	// Log is the logger. Package Log is used if nil.
+	Log glogi.Logger
+
+	storeUrl string
+	auth     string
+	pending  chan struct{}
+}
+
+// MaxPendingReports is the maximum number of reports that are sent to Sentry at the same time.
+var MaxPendingReports = 10
+
+// NewSentryReporter creates the reporter for the Sentry DSN, e.g. https://key@o1.ingest.sentry.io/123.
+func NewSentryReporter(dsn string) (*SentryReporter, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Sentry DSN: %w", err)
+	}
+	path := strings.TrimSuffix(u.Path, "/")
+	idx := strings.LastIndex(path, "/")
+	if u.User == nil || len(u.User.Username()) == 0 || len(u.Host) == 0 || idx < 0 || idx == len(path)-1 {
+		return nil, errors.New("invalid Sentry DSN, must be in format https://key@host/project")
+	}
+
+	return &SentryReporter{
+		Client:   &http.Client{Timeout: 10 * time.Second},
+		storeUrl: fmt.Sprintf("%s://%s%s/api/%s/store/", u.Scheme, u.Host, path[:idx], path[idx+1:]),
+		auth:     fmt.Sprintf("Sentry sentry_version=7, sentry_client=transformimgs/8, sentry_key=%s", u.User.Username()),
+		pending:  make(chan struct{}, MaxPendingReports),
+	}, nil
+}
+
+func (s *SentryReporter) Report(report *ErrorReport) {
+	select {
+	case s.pending <- struct{}{}:
+	default:
+		logOrDefault(s.Log).Errorf("Too many pending error reports, dropping report of [%s]", report.Source)
+		return
+	}
+
+	go func() {
+		defer func() { <-s.pending }()
+		if err := s.send(report); err != nil {
+			logOrDefault(s.Log).Errorf("Could not send error report to Sentry: %s", err)
+		}
+	}()
+}
+
+// send posts the report as Sentry event.
+func (s *SentryReporter) send(report *ErrorReport) error {
+	body, err := json.Marshal(s.event(report))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.storeUrl, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sentry-Auth", s.auth)
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Sentry responded with %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// event returns Sentry event of the report.
+func (s *SentryReporter) event(report *ErrorReport) map[string]interface{} {
+	id := make([]byte, 16)
+	_, _ = rand.Read(id)
+
+	params := make(map[string]string, len(report.Params))
+	for k := range report.Params {
+		params[k] = report.Params.Get(k)
+	}
+
+	event := map[string]interface{}{
+		"event_id":  hex.EncodeToString(id),
+		"timestamp": report.Time.UTC().Format(time.RFC3339),
+		"platform":  "go",
+		"level":     "error",
+		"logger":    "transformimgs",
+		"exception": map[string]interface{}{
+			"values": []map[string]string{{"type": report.Category, "value": report.Err.Error()}},
+		},
+		"tags": map[string]string{"op": report.Op, "category": report.Category},
+		"extra": map[string]interface{}{
+			"source": report.Source,
+			"params": params,
+			"stderr": report.Stderr,
+		},
+	}
+	if len(s.Environment) > 0 {
+		event["environment"] = s.Environment
+	}
+	return event
+}
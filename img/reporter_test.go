@@ -0,0 +1,159 @@
+package img_test
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/Pixboost/transformimgs/v8/img"
+	"github.com/dooman87/kolibri/test"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type reporterMock struct {
+	mu      sync.Mutex
+	reports []*img.ErrorReport
+}
+
+func (r *reporterMock) Report(report *img.ErrorReport) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reports = append(r.reports, report)
+}
+
+func TestService_ErrorReporter(t *testing.T) {
+	s := createService(t)
+	reporter := &reporterMock{}
+	s.ErrorReporter = reporter
+	s.ReportSource = img.RedactSource
+	test.Service = s.GetRouter().ServeHTTP
+	test.T = t
+
+	testCases := []test.TestCase{
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/resize?size=400",
+			Description:  "Server error is reported",
+			ExpectedCode: http.StatusInternalServerError,
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/corrupted.png/optimise",
+			Description:  "Client error is not reported",
+			ExpectedCode: http.StatusUnsupportedMediaType,
+		},
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise",
+			Description: "Success is not reported",
+		},
+	}
+
+	test.RunRequests(testCases)
+
+	if len(reporter.reports) != 1 {
+		t.Fatalf("expected 1 report, but got %d", len(reporter.reports))
+	}
+	report := reporter.reports[0]
+	test.Error(t,
+		test.Equal("resize", report.Op, "op"),
+		test.Equal("http://site.com/[redacted]", report.Source, "source"),
+		test.Equal("400", report.Params.Get("size"), "size param"),
+		test.Equal("other", report.Category, "category"),
+		test.Equal("resize_error", report.Err.Error(), "error"),
+	)
+}
+
+func TestService_ErrorReporter_Stderr(t *testing.T) {
+	s := createService(t)
+	reporter := &reporterMock{}
+	s.ErrorReporter = reporter
+	s.Processor = &stderrProcessor{resizerMock: &resizerMock{}}
+	test.Service = s.GetRouter().ServeHTTP
+	test.T = t
+
+	test.RunRequests([]test.TestCase{
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise",
+			Description:  "Stderr of the command",
+			ExpectedCode: http.StatusInternalServerError,
+		},
+	})
+
+	if len(reporter.reports) != 1 {
+		t.Fatalf("expected 1 report, but got %d", len(reporter.reports))
+	}
+	test.Error(t,
+		test.Equal("convert: no encode delegate", reporter.reports[0].Stderr, "stderr"),
+		test.Equal("encode_failed", reporter.reports[0].Category, "category"),
+	)
+}
+
+type stderrProcessor struct {
+	*resizerMock
+}
+
+func (p *stderrProcessor) Optimise(*img.TransformationConfig) (*img.Image, error) {
+	return nil, errors.Join(img.ErrEncodeFailed, &img.CommandError{Command: "convert", Err: errors.New("exit status 1"), Stderr: "convert: no encode delegate"})
+}
+
+func TestHashSource(t *testing.T) {
+	a, b := img.HashSource("http://site.com/a.png"), img.HashSource("http://site.com/b.png")
+	test.Error(t,
+		test.Equal(64, len(a), "length of hash"),
+		test.Equal(a, img.HashSource("http://site.com/a.png"), "same URL"),
+	)
+	if a == b {
+		t.Errorf("expected different hashes of different URLs")
+	}
+}
+
+func TestNewSentryReporter(t *testing.T) {
+	for _, dsn := range []string{"https://o1.ingest.sentry.io/123", "https://key@o1.ingest.sentry.io/", "://"} {
+		if _, err := img.NewSentryReporter(dsn); err == nil {
+			t.Errorf("expected error for DSN [%s]", dsn)
+		}
+	}
+}
+
+func TestSentryReporter_Report(t *testing.T) {
+	events := make(chan map[string]interface{}, 1)
+	var auth, path string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth, path = r.Header.Get("X-Sentry-Auth"), r.URL.Path
+		var event map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Errorf("could not decode event: %s", err)
+		}
+		events <- event
+	}))
+	defer server.Close()
+
+	reporter, err := img.NewSentryReporter("http://key@" + server.Listener.Addr().String() + "/sentry/42")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	reporter.Environment = "test"
+	reporter.Report(&img.ErrorReport{
+		Op:       "optimise",
+		Source:   "http://site.com/img.png",
+		Category: "encode_failed",
+		Err:      errors.New("image could not be encoded"),
+		Stderr:   "convert: no encode delegate",
+		Time:     time.Now(),
+	})
+
+	var event map[string]interface{}
+	select {
+	case event = <-events:
+	case <-time.After(5 * time.Second):
+		t.Fatal("event was not sent")
+	}
+	extra, _ := event["extra"].(map[string]interface{})
+	test.Error(t,
+		test.Equal("/sentry/api/42/store/", path, "path"),
+		test.Equal("Sentry sentry_version=7, sentry_client=transformimgs/8, sentry_key=key", auth, "auth"),
+		test.Equal("test", event["environment"], "environment"),
+		test.Equal("http://site.com/img.png", extra["source"], "source"),
+		test.Equal("convert: no encode delegate", extra["stderr"], "stderr"),
+	)
+}
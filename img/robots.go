@@ -0,0 +1,46 @@
+package img
+
+import (
+	"strings"
+)
+
+// RobotsTagHeader is the header of opt-out directives for crawlers, e.g. "noimageindex".
+const RobotsTagHeader = "X-Robots-Tag"
+
+// privateSource returns true if Cache-Control of the source forbids shared caches to store it.
+func privateSource(src *Image) bool {
+	if src == nil {
+		return false
+	}
+	for _, directive := range strings.Split(src.CacheControl, ",") {
+		name, _, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		switch strings.ToLower(name) {
+		case "no-store", "private":
+			return true
+		}
+	}
+	return false
+}
+
+// addOptOut passes opt-out headers of the source through to the response of the command, see
+// ServiceConfig.OriginOptOut: X-Robots-Tag as is and private or no-store Cache-Control as
+// "private, no-store", so shared caches don't store the transformed image either.
+// Headers are taken from the result if the source doesn't have them, e.g. for /asis.
+func (r *Service) addOptOut(op *Command) {
+	if !r.config().OriginOptOut || op.Config == nil {
+		return
+	}
+	src := op.Config.Src
+	if src == nil || (len(src.CacheControl) == 0 && len(src.RobotsTag) == 0) {
+		src = op.Result
+	}
+	if src == nil {
+		return
+	}
+	if len(src.RobotsTag) > 0 {
+		op.Resp.Header().Set(RobotsTagHeader, src.RobotsTag)
+	}
+	if privateSource(src) {
+		op.Resp.Header().Set("Cache-Control", "private, no-store")
+	}
+}
@@ -0,0 +1,257 @@
+package img
+
+import (
+	"context"
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Route is the HTTP route of the service. Routes could be registered on any router
+// or served without a router using Service.Handler.
+type Route struct {
+	// Name is the name of the route, e.g. "resize" or "dzi-tile".
+	Name string
+	// Pattern is the path pattern in gorilla/mux syntax, e.g. /img/{imgUrl:.*}/resize,
+	// where {name} matches one path segment and {name:regexp} matches the regular expression.
+	Pattern string
+	// Handler of the route. It reads path variables using PathVars, so routers other than
+	// gorilla/mux must pass them using WithPathVars.
+	Handler http.HandlerFunc
+}
+
+type pathVarsKey struct{}
+
+// WithPathVars returns the shallow copy of the request with path variables of the route,
+// e.g. imgUrl. Embedders that register route handlers on their own paths must set variables
+// of the original pattern.
+func WithPathVars(req *http.Request, vars map[string]string) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), pathVarsKey{}, vars))
+}
+
+// PathVars returns path variables of the request set by WithPathVars.
+func PathVars(req *http.Request) map[string]string {
+	vars, _ := req.Context().Value(pathVarsKey{}).(map[string]string)
+	return vars
+}
+
+// Routes returns enabled routes of the service in the order they must be matched.
+// Handlers verify signatures of requests if Service.Signer is set, respond with problem
+// details to clients that want them, see ServiceConfig.ProblemDetails, and trace requests
+// if Service.Tracing is set.
+func (r *Service) Routes() []Route {
+	var enabled []Route
+	for _, route := range r.allRoutes() {
+		if r.DisabledRoutes[route.Name] {
+			continue
+		}
+		if alias, ok := r.Aliases[route.Name]; ok && r.DisabledRoutes[alias.Op] {
+			continue
+		}
+		if r.Signer != nil {
+			route.Handler = r.Signer.Handler(route.Handler)
+		}
+		route.Handler = r.problemHandler(route.Handler)
+		if r.Tracing != nil {
+			route.Handler = r.traceHandler(route, route.Handler)
+		}
+		enabled = append(enabled, route)
+	}
+	return enabled
+}
+
+// RouteNames returns names of all routes including disabled ones.
+func (r *Service) RouteNames() []string {
+	routes := r.prefixedRoutes("")
+	names := make([]string, len(routes))
+	for i, route := range routes {
+		names[i] = route.Name
+	}
+	return names
+}
+
+// allRoutes returns routes of the service and their copies under RoutePrefixes.
+func (r *Service) allRoutes() []Route {
+	routes := r.prefixedRoutes("")
+	for _, prefix := range r.RoutePrefixes {
+		if prefix = strings.Trim(prefix, "/"); len(prefix) > 0 {
+			routes = append(routes, r.prefixedRoutes("/"+prefix)...)
+		}
+	}
+	return routes
+}
+
+// prefixedRoutes returns routes with patterns under the path prefix, e.g. /v2. Aliases that clash
+// with names of other routes are skipped.
+func (r *Service) prefixedRoutes(prefix string) []Route {
+	routes := r.builtinRoutes(prefix)
+	builtin := make(map[string]bool, len(routes))
+	for _, route := range routes {
+		builtin[route.Name] = true
+	}
+
+	aliases := make([]string, 0, len(r.Aliases))
+	for name := range r.Aliases {
+		if !builtin[name] && r.Dialects[name] == nil {
+			aliases = append(aliases, name)
+		}
+	}
+	sort.Strings(aliases)
+	for _, name := range aliases {
+		routes = append(routes, Route{name, prefix + "/img/{imgUrl:.*}/" + name, r.aliasHandler(r.Aliases[name])})
+	}
+
+	names := make([]string, 0, len(r.Dialects))
+	for name := range r.Dialects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		dialectPrefix := prefix + "/" + name
+		routes = append(routes, Route{name, dialectPrefix + "/{path:.*}", r.dialectHandler(dialectPrefix, r.Dialects[name])})
+	}
+
+	return routes
+}
+
+// builtinRoutes returns routes of operations and endpoints of the service under the path prefix.
+func (r *Service) builtinRoutes(prefix string) []Route {
+	return []Route{
+		{"resize", prefix + "/img/{imgUrl:.*}/resize", r.ResizeUrl},
+		{"fit", prefix + "/img/{imgUrl:.*}/fit", r.FitToSizeUrl},
+		{"asis", prefix + "/img/{imgUrl:.*}/asis", r.AsIs},
+		{"optimise", prefix + "/img/{imgUrl:.*}/optimise", r.OptimiseUrl},
+		{"upscale", prefix + "/img/{imgUrl:.*}/upscale", r.UpscaleUrl},
+		{"avatar", prefix + "/img/{imgUrl:.*}/avatar", r.AvatarUrl},
+		{"ladder", prefix + "/img/{imgUrl:.*}/ladder", r.LadderUrl},
+		{"plan", prefix + "/img/{imgUrl:.*}/plan", r.PlanUrl},
+		{"exif", prefix + "/img/{imgUrl:.*}/exif", r.ExifUrl},
+		{"montage", prefix + "/montage", r.MontageUrl},
+		{"sprite", prefix + "/sprite", r.SpriteUrl},
+		{"card", prefix + "/card/{template}", r.CardUrl},
+		{"dzi", prefix + "/dzi/{imgUrl:.*}.dzi", r.DziUrl},
+		{"dzi-tile", prefix + "/dzi/{imgUrl:.*}_files/{level:[0-9]+}/{col:[0-9]+}_{row:[0-9]+}.{format:[a-z]+}", r.DziTileUrl},
+		{"iiif-info", prefix + "/iiif/{imgUrl:.*}/info.json", r.IiifInfoUrl},
+		{"iiif", prefix + "/iiif/{imgUrl:.*}/{region}/{size}/{rotation}/{quality:[a-z]+}.{format:[a-z]+}", r.IiifUrl},
+	}
+}
+
+// GetRouter returns gorilla/mux router with routes of the service.
+func (r *Service) GetRouter() *mux.Router {
+	router := mux.NewRouter().SkipClean(true)
+	for _, route := range r.Routes() {
+		handler := route.Handler
+		router.HandleFunc(route.Pattern, func(resp http.ResponseWriter, req *http.Request) {
+			handler(resp, WithPathVars(req, mux.Vars(req)))
+		})
+	}
+	router.NotFoundHandler = r.problemHandler(r.querySeparatorsHandler(router).ServeHTTP)
+
+	return router
+}
+
+// Handler returns the handler that serves routes of the service using only standard library,
+// so it could be mounted on http.ServeMux or any other router, e.g. mux.Handle("/", s.Handler()).
+// Responds with 404 if no route matches the path unless the request is rewritten, see QuerySeparators.
+func (r *Service) Handler() http.Handler {
+	routes := r.Routes()
+	h := &routesHandler{routes: make([]compiledRoute, len(routes))}
+	for i, route := range routes {
+		re, names, err := compilePattern(route.Pattern)
+		if err != nil {
+			// Patterns of the service are constant, so it's a programming error
+			panic(fmt.Sprintf("invalid pattern of route [%s]: %s", route.Name, err))
+		}
+		h.routes[i] = compiledRoute{re: re, names: names, handler: route.Handler}
+	}
+	h.notFound = r.problemHandler(r.querySeparatorsHandler(h).ServeHTTP)
+
+	return h
+}
+
+type compiledRoute struct {
+	re      *regexp.Regexp
+	names   []string
+	handler http.HandlerFunc
+}
+
+type routesHandler struct {
+	routes   []compiledRoute
+	notFound http.Handler
+}
+
+func (h *routesHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	for _, route := range h.routes {
+		matches := route.re.FindStringSubmatch(req.URL.Path)
+		if matches == nil {
+			continue
+		}
+		vars := make(map[string]string, len(route.names))
+		for i, name := range route.names {
+			vars[name] = matches[i+1]
+		}
+		route.handler(resp, WithPathVars(req, vars))
+		return
+	}
+
+	h.notFound.ServeHTTP(resp, req)
+}
+
+// compilePattern converts the path pattern into the regular expression that matches the whole path.
+// Returns names of variables in the order of their groups.
+func compilePattern(pattern string) (*regexp.Regexp, []string, error) {
+	var (
+		expr  strings.Builder
+		names []string
+	)
+	expr.WriteString("^")
+	for len(pattern) > 0 {
+		start := strings.Index(pattern, "{")
+		if start < 0 {
+			expr.WriteString(regexp.QuoteMeta(pattern))
+			break
+		}
+		expr.WriteString(regexp.QuoteMeta(pattern[:start]))
+
+		// Variable could contain braces in the regular expression, e.g. {id:[0-9]{2}}
+		end, depth := -1, 0
+		for i := start; i < len(pattern) && end < 0; i++ {
+			switch pattern[i] {
+			case '{':
+				depth++
+			case '}':
+				depth--
+				if depth == 0 {
+					end = i
+				}
+			}
+		}
+		if end < 0 {
+			return nil, nil, fmt.Errorf("unbalanced braces in [%s]", pattern)
+		}
+
+		name, varExpr, ok := strings.Cut(pattern[start+1:end], ":")
+		if !ok {
+			varExpr = "[^/]+"
+		}
+		if len(name) == 0 {
+			return nil, nil, fmt.Errorf("variable without name in [%s]", pattern)
+		}
+		expr.WriteString("(" + varExpr + ")")
+		names = append(names, name)
+		pattern = pattern[end+1:]
+	}
+	expr.WriteString("$")
+
+	re, err := regexp.Compile(expr.String())
+	if err != nil {
+		return nil, nil, err
+	}
+	if re.NumSubexp() != len(names) {
+		return nil, nil, fmt.Errorf("regular expressions of variables must not have capturing groups")
+	}
+	return re, names, nil
+}
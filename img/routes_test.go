@@ -0,0 +1,130 @@
+package img_test
+
+import (
+	"github.com/Pixboost/transformimgs/v8/img"
+	"github.com/dooman87/kolibri/test"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestService_Handler(t *testing.T) {
+	s := createService(t)
+	s.Dialects = map[string]img.Dialect{"cloudinary": img.KnownDialects["cloudinary"]}
+	test.Service = s.Handler().ServeHTTP
+	test.T = t
+
+	testCases := []test.TestCase{
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise",
+			Description: "Image URL with slashes",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal(ImgPngOut, w.Body.String(), "Resulted image"),
+				)
+			},
+		},
+		{
+			Url:         "http://localhost/dzi/http%3A%2F%2Fsite.com%2Fimg.png_files/4/0_0.png",
+			Description: "Route with several variables",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal("0,0,10,20 5x10 png", w.Body.String(), "Tile"),
+				)
+			},
+		},
+		{
+			Url:         "http://localhost/cloudinary/image/fetch/w_300/http://site.com/img.png",
+			Description: "Dialect",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal(ImgPngOut, w.Body.String(), "Resulted image"),
+				)
+			},
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/rotate",
+			Description:  "Unknown route",
+			ExpectedCode: http.StatusNotFound,
+		},
+		{
+			Url:          "http://localhost/dzi/http%3A%2F%2Fsite.com%2Fimg.png_files/4/0_0.PNG",
+			Description:  "Variable doesn't match the regular expression",
+			ExpectedCode: http.StatusNotFound,
+		},
+	}
+
+	test.RunRequests(testCases)
+}
+
+func TestService_Routes(t *testing.T) {
+	var resize img.Route
+	for _, route := range createService(t).Routes() {
+		if route.Name == "resize" {
+			resize = route
+		}
+	}
+	if resize.Handler == nil {
+		t.Fatal("expected resize route")
+	}
+
+	// Route on the custom path scheme
+	router := http.NewServeMux()
+	router.HandleFunc("/thumbnail", func(resp http.ResponseWriter, req *http.Request) {
+		resize.Handler(resp, img.WithPathVars(req, map[string]string{"imgUrl": req.URL.Query().Get("src")}))
+	})
+	test.Service = router.ServeHTTP
+	test.T = t
+
+	test.RunRequests([]test.TestCase{
+		{
+			Url:         "http://localhost/thumbnail?src=http%3A%2F%2Fsite.com%2Fimg.png&size=300",
+			Description: "Handler with path variables",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal(ImgPngOut, w.Body.String(), "Resulted image"),
+				)
+			},
+		},
+	})
+}
+
+func TestService_DisabledRoutes(t *testing.T) {
+	s := createService(t)
+	s.DisabledRoutes = map[string]bool{"asis": true, "fit": true}
+	for _, route := range s.Routes() {
+		if route.Name == "asis" || route.Name == "fit" {
+			t.Errorf("expected route [%s] to be disabled", route.Name)
+		}
+	}
+	if names := s.RouteNames(); len(names) != 16 {
+		t.Errorf("expected names of all 16 routes, but got %v", names)
+	}
+
+	for _, handler := range []http.Handler{s.GetRouter(), s.Handler()} {
+		test.Service = handler.ServeHTTP
+		test.T = t
+
+		test.RunRequests([]test.TestCase{
+			{
+				Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/asis",
+				Description:  "Disabled route",
+				ExpectedCode: http.StatusNotFound,
+			},
+			{
+				Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/fit?size=300x200",
+				Description:  "Disabled route with params",
+				ExpectedCode: http.StatusNotFound,
+			},
+			{
+				Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise",
+				Description: "Enabled route",
+				Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+					test.Error(t,
+						test.Equal(ImgPngOut, w.Body.String(), "Resulted image"),
+					)
+				},
+			},
+		})
+	}
+}
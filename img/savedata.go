@@ -0,0 +1,125 @@
+package img
+
+import (
+	"net/http"
+)
+
+// SaveDataMode defines how images are served to users that prefer reduced data usage.
+type SaveDataMode int
+
+const (
+	// SaveDataOff serves images as usual.
+	SaveDataOff SaveDataMode = iota
+	// SaveDataReduce serves images with LOW quality limited by MaxSize and Scale of SaveData.
+	SaveDataReduce
+	// SaveDataHide serves empty 1x1 GIF instead of images.
+	SaveDataHide
+)
+
+// SaveData is the decision of SaveDataPolicy for the request.
+type SaveData struct {
+	Mode SaveDataMode
+	// MaxSize limits width and height of images in pixels. Zero means no limit.
+	MaxSize int
+	// Scale of images, e.g. 0.5. Zero means images are not scaled.
+	Scale float64
+}
+
+// SaveDataPolicy decides how to serve images to users that prefer reduced data usage, e.g.
+// based on Save-Data client hint.
+type SaveDataPolicy interface {
+	// SaveData returns the decision for the request and request headers that were used to decide.
+	// Headers are added to Vary response header, so CDN must support them. Returns HttpError if
+	// the request is invalid.
+	SaveData(req *http.Request) (*SaveData, []string, error)
+}
+
+// SaveDataPolicyFunc is an adapter to use functions as SaveDataPolicy.
+type SaveDataPolicyFunc func(req *http.Request) (*SaveData, []string, error)
+
+func (f SaveDataPolicyFunc) SaveData(req *http.Request) (*SaveData, []string, error) {
+	return f(req)
+}
+
+// DefaultLowResScale is the default scale of images when save-data=low-res query param is passed.
+const DefaultLowResScale = 0.5
+
+// SaveDataEnabled is the flag to enable/disable Save-Data client hint.
+//
+// Deprecated: set Service.SaveData to OffSaveDataPolicy to disable it.
+var SaveDataEnabled = true
+
+// SaveDataMaxSize limits width and height in pixels of images that are served
+// with Save-Data header. Zero means no limit.
+//
+// Deprecated: use DefaultSaveDataPolicy.MaxSize.
+var SaveDataMaxSize = 0
+
+// SaveDataLowResScale is the scale of images when save-data=low-res query param is passed.
+//
+// Deprecated: use DefaultSaveDataPolicy.LowResScale.
+var SaveDataLowResScale = DefaultLowResScale
+
+// defaultSaveDataPolicy returns the policy that NewService sets using values of deprecated package variables.
+func defaultSaveDataPolicy() SaveDataPolicy {
+	if !SaveDataEnabled {
+		return OffSaveDataPolicy{}
+	}
+	return &DefaultSaveDataPolicy{MaxSize: SaveDataMaxSize, LowResScale: SaveDataLowResScale}
+}
+
+// DefaultSaveDataPolicy reduces images when Save-Data header is "on". Behaviour could be
+// changed by save-data query param:
+//   - off - ignores Save-Data header;
+//   - hide - serves empty image instead;
+//   - low-res - scales images down by LowResScale.
+type DefaultSaveDataPolicy struct {
+	// MaxSize limits width and height of images in pixels. Zero means no limit.
+	MaxSize int
+	// LowResScale is the scale of images when save-data=low-res query param is passed.
+	LowResScale float64
+}
+
+func (p *DefaultSaveDataPolicy) SaveData(req *http.Request) (*SaveData, []string, error) {
+	param, _ := getQueryParam(req.URL, "save-data")
+	if len(param) > 0 && param != "off" && param != "hide" && param != "low-res" {
+		return nil, nil, NewHttpError(http.StatusBadRequest, "save-data query param must be one of 'off', 'hide', 'low-res'")
+	}
+	if param == "off" {
+		return &SaveData{}, nil, nil
+	}
+
+	vary := []string{"Save-Data"}
+	if req.Header.Get("Save-Data") != "on" {
+		return &SaveData{}, vary, nil
+	}
+	switch param {
+	case "hide":
+		return &SaveData{Mode: SaveDataHide}, vary, nil
+	case "low-res":
+		return &SaveData{Mode: SaveDataReduce, MaxSize: p.MaxSize, Scale: p.LowResScale}, vary, nil
+	}
+	return &SaveData{Mode: SaveDataReduce, MaxSize: p.MaxSize}, vary, nil
+}
+
+// OffSaveDataPolicy ignores Save-Data header. Could be useful for CDNs that don't support
+// Save-Data header in Vary.
+type OffSaveDataPolicy struct{}
+
+func (OffSaveDataPolicy) SaveData(*http.Request) (*SaveData, []string, error) {
+	return &SaveData{}, nil, nil
+}
+
+// HideSaveDataPolicy serves empty images when Save-Data header is "on", e.g. for decorative images.
+// Images are served as usual with save-data=off query param.
+type HideSaveDataPolicy struct{}
+
+func (HideSaveDataPolicy) SaveData(req *http.Request) (*SaveData, []string, error) {
+	if param, _ := getQueryParam(req.URL, "save-data"); param == "off" {
+		return &SaveData{}, nil, nil
+	}
+	if req.Header.Get("Save-Data") == "on" {
+		return &SaveData{Mode: SaveDataHide}, []string{"Save-Data"}, nil
+	}
+	return &SaveData{}, []string{"Save-Data"}, nil
+}
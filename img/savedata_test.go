@@ -0,0 +1,163 @@
+package img_test
+
+import (
+	"github.com/Pixboost/transformimgs/v8/img"
+	"github.com/dooman87/kolibri/test"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestSaveDataPolicies(t *testing.T) {
+	defaultPolicy := &img.DefaultSaveDataPolicy{MaxSize: 100, LowResScale: 0.5}
+	testCases := []struct {
+		name     string
+		policy   img.SaveDataPolicy
+		query    string
+		header   string
+		expected *img.SaveData
+		vary     []string
+	}{
+		{"default without header", defaultPolicy, "", "", &img.SaveData{}, []string{"Save-Data"}},
+		{"default", defaultPolicy, "", "on", &img.SaveData{Mode: img.SaveDataReduce, MaxSize: 100}, []string{"Save-Data"}},
+		{"default low-res", defaultPolicy, "save-data=low-res", "on", &img.SaveData{Mode: img.SaveDataReduce, MaxSize: 100, Scale: 0.5}, []string{"Save-Data"}},
+		{"default hide", defaultPolicy, "save-data=hide", "on", &img.SaveData{Mode: img.SaveDataHide}, []string{"Save-Data"}},
+		{"default off", defaultPolicy, "save-data=off", "on", &img.SaveData{}, nil},
+		{"off", img.OffSaveDataPolicy{}, "save-data=hide", "on", &img.SaveData{}, nil},
+		{"hide", img.HideSaveDataPolicy{}, "", "on", &img.SaveData{Mode: img.SaveDataHide}, []string{"Save-Data"}},
+		{"hide without header", img.HideSaveDataPolicy{}, "", "", &img.SaveData{}, []string{"Save-Data"}},
+		{"hide off", img.HideSaveDataPolicy{}, "save-data=off", "on", &img.SaveData{}, nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://localhost/img/site.com/img.png/optimise?"+tc.query, nil)
+			if len(tc.header) > 0 {
+				req.Header.Set("Save-Data", tc.header)
+			}
+			saveData, vary, err := tc.policy.SaveData(req)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !reflect.DeepEqual(saveData, tc.expected) {
+				t.Errorf("expected %+v, but got %+v", tc.expected, saveData)
+			}
+			if !reflect.DeepEqual(vary, tc.vary) {
+				t.Errorf("expected vary %v, but got %v", tc.vary, vary)
+			}
+		})
+	}
+
+	req := httptest.NewRequest("GET", "http://localhost/img/site.com/img.png/optimise?save-data=invalid", nil)
+	if _, _, err := defaultPolicy.SaveData(req); err == nil {
+		t.Errorf("expected error for invalid param")
+	}
+}
+
+func TestService_CustomSaveDataPolicy(t *testing.T) {
+	s := createService(t)
+	s.SaveData = img.SaveDataPolicyFunc(func(req *http.Request) (*img.SaveData, []string, error) {
+		if req.Header.Get("X-Data-Saver") == "1" {
+			return &img.SaveData{Mode: img.SaveDataReduce}, []string{"X-Data-Saver"}, nil
+		}
+		return &img.SaveData{}, []string{"X-Data-Saver"}, nil
+	})
+	test.Service = s.GetRouter().ServeHTTP
+	test.T = t
+
+	testCases := []test.TestCase{
+		{
+			Request: &http.Request{
+				Method: "GET",
+				URL:    parseUrl("http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise", t),
+				Header: map[string][]string{
+					"X-Data-Saver": {"1"},
+				},
+			},
+			Description: "Custom header",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal(ImgLowQualityOut, w.Body.String(), "Resulted image"),
+					test.Equal("Accept, X-Data-Saver", w.Header().Get("Vary"), "Vary response header"),
+				)
+			},
+		},
+		{
+			Request: &http.Request{
+				Method: "GET",
+				URL:    parseUrl("http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise", t),
+				Header: map[string][]string{
+					"Save-Data": {"on"},
+				},
+			},
+			Description: "Save-Data is ignored",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal(ImgPngOut, w.Body.String(), "Resulted image"),
+				)
+			},
+		},
+	}
+
+	test.RunRequests(testCases)
+}
+
+func TestService_Placeholder(t *testing.T) {
+	s := createService(t)
+	s.SaveData = img.HideSaveDataPolicy{}
+	test.Service = s.GetRouter().ServeHTTP
+	test.T = t
+
+	hidden := func() *http.Request {
+		req := httptest.NewRequest("GET", "http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise", nil)
+		req.Header.Set("Save-Data", "on")
+		return req
+	}
+
+	test.RunRequests([]test.TestCase{
+		{
+			Request:     hidden(),
+			Description: "Empty GIF",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal("image/gif", w.Header().Get("Content-Type"), "Content-Type header"),
+					test.Equal("37", w.Header().Get("Content-Length"), "Content-Length header"),
+					test.Equal("public, max-age=86400", w.Header().Get("Cache-Control"), "Cache-Control header"),
+					test.Equal("1", w.Header().Get("X-Image-Width"), "X-Image-Width header"),
+					test.Equal("Accept, Save-Data", w.Header().Get("Vary"), "Vary header"),
+				)
+			},
+		},
+	})
+
+	s.Placeholder = &img.Placeholder{Image: &img.Image{Data: []byte("blank"), MimeType: "image/webp"}}
+	test.RunRequests([]test.TestCase{
+		{
+			Request:     hidden(),
+			Description: "Custom placeholder",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal("image/webp", w.Header().Get("Content-Type"), "Content-Type header"),
+					test.Equal("5", w.Header().Get("Content-Length"), "Content-Length header"),
+					test.Equal("blank", w.Body.String(), "Body"),
+				)
+			},
+		},
+	})
+
+	s.Placeholder = &img.Placeholder{NoContent: true}
+	test.RunRequests([]test.TestCase{
+		{
+			Request:      hidden(),
+			Description:  "No content",
+			ExpectedCode: http.StatusNoContent,
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal("public, max-age=86400", w.Header().Get("Cache-Control"), "Cache-Control header"),
+					test.Equal(0, w.Body.Len(), "Body"),
+				)
+			},
+		},
+	})
+}
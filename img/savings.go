@@ -0,0 +1,133 @@
+package img
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// SavingsStats holds cumulative sizes of source and transformed images
+// for one operation and output format.
+type SavingsStats struct {
+	// Op is the name of the operation: "optimise", "resize", "fit", "upscale" or "transcode".
+	Op string `json:"op"`
+	// Format is the MIME type of transformed images.
+	Format string `json:"format"`
+	// Count is the number of transformed images.
+	Count       uint64 `json:"count"`
+	InputBytes  int64  `json:"inputBytes"`
+	OutputBytes int64  `json:"outputBytes"`
+}
+
+type savingsKey struct {
+	op     string
+	format string
+}
+
+// Savings tracks cumulative sizes of source and transformed images per operation and
+// output format since Savings was created. Statistics are available as JSON using ServeStats
+// and in Prometheus text format using ServeMetrics.
+type Savings struct {
+	// Since is the time when the tracking started.
+	Since time.Time
+
+	mux   sync.Mutex
+	stats map[savingsKey]*SavingsStats
+}
+
+// NewSavings creates an empty statistics.
+func NewSavings() *Savings {
+	return &Savings{
+		Since: time.Now(),
+		stats: make(map[savingsKey]*SavingsStats),
+	}
+}
+
+// Add counts one transformed image.
+func (s *Savings) Add(op string, format string, inputBytes int, outputBytes int) {
+	if len(format) == 0 {
+		format = "unknown"
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	key := savingsKey{op: op, format: format}
+	stats, ok := s.stats[key]
+	if !ok {
+		stats = &SavingsStats{Op: op, Format: format}
+		s.stats[key] = stats
+	}
+	stats.Count++
+	stats.InputBytes += int64(inputBytes)
+	stats.OutputBytes += int64(outputBytes)
+}
+
+// Stats returns statistics sorted by operation and format.
+func (s *Savings) Stats() []SavingsStats {
+	s.mux.Lock()
+	result := make([]SavingsStats, 0, len(s.stats))
+	for _, stats := range s.stats {
+		result = append(result, *stats)
+	}
+	s.mux.Unlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Op != result[j].Op {
+			return result[i].Op < result[j].Op
+		}
+		return result[i].Format < result[j].Format
+	})
+	return result
+}
+
+type savingsResponse struct {
+	Since       time.Time      `json:"since"`
+	InputBytes  int64          `json:"inputBytes"`
+	OutputBytes int64          `json:"outputBytes"`
+	SavedBytes  int64          `json:"savedBytes"`
+	Stats       []SavingsStats `json:"stats"`
+}
+
+// ServeStats writes statistics as JSON with totals for all operations and formats.
+func (s *Savings) ServeStats(resp http.ResponseWriter, _ *http.Request) {
+	result := savingsResponse{
+		Since: s.Since,
+		Stats: s.Stats(),
+	}
+	for _, stats := range result.Stats {
+		result.InputBytes += stats.InputBytes
+		result.OutputBytes += stats.OutputBytes
+	}
+	result.SavedBytes = result.InputBytes - result.OutputBytes
+
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(resp).Encode(result)
+}
+
+// ServeMetrics writes statistics as counters in Prometheus text format.
+func (s *Savings) ServeMetrics(resp http.ResponseWriter, _ *http.Request) {
+	stats := s.Stats()
+	metrics := []struct {
+		name  string
+		help  string
+		value func(s SavingsStats) int64
+	}{
+		{"transformimgs_transformations_total", "Number of transformed images.", func(s SavingsStats) int64 { return int64(s.Count) }},
+		{"transformimgs_input_bytes_total", "Size of source images in bytes.", func(s SavingsStats) int64 { return s.InputBytes }},
+		{"transformimgs_output_bytes_total", "Size of transformed images in bytes.", func(s SavingsStats) int64 { return s.OutputBytes }},
+	}
+
+	resp.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	resp.Header().Set("Cache-Control", "no-store")
+	for _, m := range metrics {
+		_, _ = fmt.Fprintf(resp, "# HELP %s %s\n# TYPE %s counter\n", m.name, m.help, m.name)
+		for _, st := range stats {
+			_, _ = fmt.Fprintf(resp, "%s{op=%q,format=%q} %d\n", m.name, st.Op, st.Format, m.value(st))
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package img_test
+
+import (
+	"github.com/Pixboost/transformimgs/v8/img"
+	"github.com/dooman87/kolibri/test"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestSavings_Stats(t *testing.T) {
+	s := img.NewSavings()
+	s.Add("resize", "image/webp", 1000, 100)
+	s.Add("resize", "image/webp", 500, 50)
+	s.Add("optimise", "", 300, 300)
+
+	expected := []img.SavingsStats{
+		{Op: "optimise", Format: "unknown", Count: 1, InputBytes: 300, OutputBytes: 300},
+		{Op: "resize", Format: "image/webp", Count: 2, InputBytes: 1500, OutputBytes: 150},
+	}
+	if stats := s.Stats(); !reflect.DeepEqual(stats, expected) {
+		t.Errorf("expected stats %+v, but got %+v", expected, stats)
+	}
+}
+
+func TestSavings_ServeMetrics(t *testing.T) {
+	s := img.NewSavings()
+	s.Add("fit", "image/avif", 1000, 100)
+
+	w := httptest.NewRecorder()
+	s.ServeMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	test.Error(t,
+		test.Equal(`# HELP transformimgs_transformations_total Number of transformed images.
+# TYPE transformimgs_transformations_total counter
+transformimgs_transformations_total{op="fit",format="image/avif"} 1
+# HELP transformimgs_input_bytes_total Size of source images in bytes.
+# TYPE transformimgs_input_bytes_total counter
+transformimgs_input_bytes_total{op="fit",format="image/avif"} 1000
+# HELP transformimgs_output_bytes_total Size of transformed images in bytes.
+# TYPE transformimgs_output_bytes_total counter
+transformimgs_output_bytes_total{op="fit",format="image/avif"} 100
+`, w.Body.String(), "metrics"),
+		test.Equal("text/plain; version=0.0.4", w.Header().Get("Content-Type"), "Content-Type header"),
+	)
+}
@@ -0,0 +1,161 @@
+package img
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Classes of commands that are used by Scheduler. Other commands are classified by the
+// name of the operation, e.g. "optimise" or "resize".
+const (
+	// ClassAsIs is the class of commands without transformation, e.g. /asis requests.
+	ClassAsIs = "asis"
+	// ClassOther is the class of transformations without the name of the operation, e.g. montage.
+	ClassOther = "other"
+)
+
+// DefaultQueueWeight is the weight of classes of commands that are not in Scheduler weights.
+const DefaultQueueWeight = 1
+
+// Scheduler runs commands on the fixed number of workers using weighted fair scheduling
+// between classes of commands, so lightweight requests, e.g. /asis, are not starved behind
+// heavy encodes. When commands of several classes are waiting, each class gets the share of
+// workers proportional to its weight. Commands of the same class run in the order they were added.
+type Scheduler struct {
+	weights map[string]int
+	workers int
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending map[string][]*Command
+	// current is the current weight of classes in the smooth weighted round-robin
+	current map[string]int
+}
+
+// NewScheduler creates the scheduler with the number of workers and weights of classes of commands.
+func NewScheduler(workers int, weights map[string]int) *Scheduler {
+	s := &Scheduler{
+		weights: weights,
+		workers: workers,
+		pending: make(map[string][]*Command),
+		current: make(map[string]int),
+	}
+	s.cond = sync.NewCond(&s.mu)
+	for i := 0; i < workers; i++ {
+		go s.start(i)
+	}
+	return s
+}
+
+// ParseQueueWeights parses comma separated list of weights of classes, e.g. "asis=4,optimise=2".
+func ParseQueueWeights(list string) (map[string]int, error) {
+	weights := make(map[string]int)
+	for _, w := range strings.Split(list, ",") {
+		w = strings.TrimSpace(w)
+		if len(w) == 0 {
+			continue
+		}
+		class, value, ok := strings.Cut(w, "=")
+		if !ok {
+			return nil, fmt.Errorf("weight [%s] must be in format class=weight", w)
+		}
+		weight, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || weight <= 0 {
+			return nil, fmt.Errorf("weight of class [%s] must be a positive number", class)
+		}
+		weights[strings.TrimSpace(class)] = weight
+	}
+	return weights, nil
+}
+
+// Pending returns the number of commands waiting for a worker.
+func (s *Scheduler) Pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pending := 0
+	for _, ops := range s.pending {
+		pending += len(ops)
+	}
+	return pending
+}
+
+// commandClass returns the class of the command for the scheduler.
+func commandClass(op *Command) string {
+	switch {
+	case len(op.class) > 0:
+		return op.class
+	case op.Result != nil:
+		return ClassAsIs
+	case len(op.Op) > 0:
+		return op.Op
+	}
+	return ClassOther
+}
+
+// AddAndWait adds the command to the scheduler, waits for it to finish and calls the callback.
+func (s *Scheduler) AddAndWait(op *Command, callback OpCallback) {
+	class := commandClass(op)
+	s.mu.Lock()
+	s.pending[class] = append(s.pending[class], op)
+	s.mu.Unlock()
+	s.cond.Signal()
+
+	op.FinishedCond.L.Lock()
+	for !op.Finished {
+		op.FinishedCond.Wait()
+	}
+	op.FinishedCond.L.Unlock()
+
+	callback()
+}
+
+func (s *Scheduler) start(worker int) {
+	for {
+		op := s.next()
+		op.Worker = worker
+		runCommand(op)
+	}
+}
+
+// next waits for a pending command and returns the one from the class selected using
+// smooth weighted round-robin among classes with pending commands.
+func (s *Scheduler) next() *Command {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.pending) == 0 {
+		s.cond.Wait()
+	}
+
+	var (
+		selected string
+		total    int
+	)
+	for class := range s.pending {
+		weight := s.weight(class)
+		total += weight
+		s.current[class] += weight
+		if len(selected) == 0 || s.current[class] > s.current[selected] ||
+			(s.current[class] == s.current[selected] && class < selected) {
+			selected = class
+		}
+	}
+	s.current[selected] -= total
+
+	op := s.pending[selected][0]
+	s.pending[selected] = s.pending[selected][1:]
+	if len(s.pending[selected]) == 0 {
+		// Classes without pending commands don't accumulate weight
+		delete(s.pending, selected)
+		delete(s.current, selected)
+	}
+	return op
+}
+
+func (s *Scheduler) weight(class string) int {
+	if w, ok := s.weights[class]; ok && w > 0 {
+		return w
+	}
+	return DefaultQueueWeight
+}
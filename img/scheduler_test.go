@@ -0,0 +1,123 @@
+package img_test
+
+import (
+	"github.com/Pixboost/transformimgs/v8/img"
+	"github.com/dooman87/kolibri/test"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseQueueWeights(t *testing.T) {
+	weights, err := img.ParseQueueWeights("asis=4, optimise=2,,")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !reflect.DeepEqual(map[string]int{"asis": 4, "optimise": 2}, weights) {
+		t.Errorf("unexpected weights: %v", weights)
+	}
+
+	for _, list := range []string{"asis", "asis=0", "asis=abc"} {
+		if _, err := img.ParseQueueWeights(list); err == nil {
+			t.Errorf("expected error for [%s]", list)
+		}
+	}
+}
+
+func TestScheduler_Weights(t *testing.T) {
+	s := img.NewScheduler(1, map[string]int{"resize": 3})
+
+	var (
+		mu      sync.Mutex
+		order   []string
+		started = make(chan struct{})
+		release = make(chan struct{})
+		wg      sync.WaitGroup
+	)
+	add := func(op string, block bool) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.AddAndWait(&img.Command{
+				Op: op,
+				Transformation: func(input *img.TransformationConfig) (*img.Image, error) {
+					if block {
+						close(started)
+						<-release
+						return &img.Image{}, nil
+					}
+					mu.Lock()
+					order = append(order, op[:1])
+					mu.Unlock()
+					return &img.Image{}, nil
+				},
+				Config:       &img.TransformationConfig{Src: &img.Image{Id: op}},
+				FinishedCond: sync.NewCond(&sync.Mutex{}),
+			}, func() {})
+		}()
+	}
+	waitPending := func(n int) {
+		for i := 0; i < 100 && s.Pending() != n; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if s.Pending() != n {
+			t.Fatalf("expected [%d] pending commands, but got [%d]", n, s.Pending())
+		}
+	}
+
+	// Blocks the worker until all commands are added
+	add("optimise", true)
+	<-started
+	for i := 0; i < 4; i++ {
+		add("optimise", false)
+		waitPending(i + 1)
+	}
+	for i := 0; i < 4; i++ {
+		add("resize", false)
+	}
+	waitPending(8)
+	close(release)
+	wg.Wait()
+
+	if strings.Join(order, "") != "rorrrooo" {
+		t.Errorf("expected commands to run in order [rorrrooo], but got [%s]", strings.Join(order, ""))
+	}
+}
+
+func TestService_QueueWeights(t *testing.T) {
+	s, err := img.NewServiceWithConfig(&loaderMock{}, &resizerMock{}, 2, &img.ServiceConfig{QueueWeights: map[string]int{"asis": 4}})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if s.Scheduler == nil || s.Q != nil {
+		t.Fatalf("expected scheduler to be used instead of queues")
+	}
+	test.Service = s.GetRouter().ServeHTTP
+	test.T = t
+
+	testCases := []test.TestCase{
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise",
+			Description: "Transformation",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal(ImgPngOut, w.Body.String(), "Resulted image"),
+				)
+			},
+		},
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/asis",
+			Description: "As is",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal("321", w.Body.String(), "Resulted image"),
+				)
+			},
+		},
+	}
+
+	test.RunRequests(testCases)
+}
@@ -0,0 +1,87 @@
+package img
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// QuerySeparators defines how requests with un-encoded query separators in the source URL are handled,
+// e.g. /img/https://site.com/img.png?v=3/resize?size=300. The query of the source URL swallows
+// the operation, so such requests don't match any route.
+type QuerySeparators int
+
+const (
+	// QuerySeparatorsOff responds with 404 as for any other unknown path.
+	QuerySeparatorsOff QuerySeparators = iota
+	// QuerySeparatorsReject responds with 400 explaining that the source URL must be encoded.
+	QuerySeparatorsReject
+	// QuerySeparatorsRewrite reconstructs the source URL from the raw request URI, so
+	// the request above is served as /img/https://site.com/img.png%3Fv=3/resize?size=300.
+	QuerySeparatorsRewrite
+)
+
+// ParseQuerySeparators parses the mode: "off", "reject" or "rewrite".
+func ParseQuerySeparators(mode string) (QuerySeparators, error) {
+	switch strings.ToLower(mode) {
+	case "off":
+		return QuerySeparatorsOff, nil
+	case "reject":
+		return QuerySeparatorsReject, nil
+	case "rewrite":
+		return QuerySeparatorsRewrite, nil
+	}
+	return QuerySeparatorsOff, fmt.Errorf("unknown query separators mode [%s], must be off, reject or rewrite", mode)
+}
+
+type rewrittenKey struct{}
+
+// encodeQuerySeparators returns the copy of the request with the query of the source URL moved
+// into the path or nil if the query doesn't contain the path of the operation. The path of the operation
+// starts from the last slash before the first "?" of the query, so the query of the operation could contain slashes.
+func encodeQuerySeparators(req *http.Request) *http.Request {
+	query := req.URL.RawQuery
+	head, _, _ := strings.Cut(query, "?")
+	i := strings.LastIndex(head, "/")
+	if i < 0 {
+		return nil
+	}
+
+	// Query is already percent-encoded, so it must be kept as is in the decoded path
+	uri := req.URL.EscapedPath() + "%3F" + strings.ReplaceAll(query[:i], "%", "%25") + query[i:]
+	parsed, err := url.ParseRequestURI(uri)
+	if err != nil {
+		return nil
+	}
+
+	rewritten := req.Clone(context.WithValue(req.Context(), rewrittenKey{}, true))
+	rewritten.URL.Path, rewritten.URL.RawPath, rewritten.URL.RawQuery = parsed.Path, parsed.RawPath, parsed.RawQuery
+	rewritten.RequestURI = rewritten.URL.RequestURI()
+	return rewritten
+}
+
+// querySeparatorsHandler returns the handler of requests that don't match any route. Requests with
+// un-encoded query separators in the source URL are rejected or served by next with the rewritten URL
+// depending on Service.QuerySeparators. Other requests are responded with 404.
+func (r *Service) querySeparatorsHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if r.QuerySeparators == QuerySeparatorsOff || req.Context().Value(rewrittenKey{}) != nil {
+			http.NotFound(resp, req)
+			return
+		}
+		rewritten := encodeQuerySeparators(req)
+		if rewritten == nil {
+			http.NotFound(resp, req)
+			return
+		}
+		if r.QuerySeparators == QuerySeparatorsReject {
+			http.Error(resp, "imgUrl must be URL encoded, e.g. ? as %3F and & as %26", http.StatusBadRequest)
+			return
+		}
+
+		r.log().Printf("[%s]: Rewriting un-encoded query separators of the source URL to [%s]\n", req.URL.String(), rewritten.URL.String())
+		next.ServeHTTP(resp, rewritten)
+	})
+}
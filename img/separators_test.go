@@ -0,0 +1,92 @@
+package img_test
+
+import (
+	"context"
+	"github.com/Pixboost/transformimgs/v8/img"
+	"github.com/dooman87/kolibri/test"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// urlLoader returns the URL of the source as its data.
+type urlLoader struct{}
+
+func (l *urlLoader) Load(url string, _ context.Context) (*img.Image, error) {
+	return &img.Image{Id: url, Data: []byte(url), MimeType: "image/png"}, nil
+}
+
+func TestService_QuerySeparators(t *testing.T) {
+	s, err := img.NewService(&urlLoader{}, &resizerMock{}, 1)
+	if err != nil {
+		t.Fatalf("could not create service: %s", err)
+	}
+	test.T = t
+
+	expectSource := func(expected string) func(w *httptest.ResponseRecorder, t *testing.T) {
+		return func(w *httptest.ResponseRecorder, t *testing.T) {
+			test.Error(t,
+				test.Equal(expected, w.Body.String(), "Source URL"),
+			)
+		}
+	}
+
+	for _, handler := range []func() http.Handler{
+		func() http.Handler { return s.GetRouter() },
+		func() http.Handler { return s.Handler() },
+	} {
+		s.QuerySeparators = img.QuerySeparatorsRewrite
+		test.Service = handler().ServeHTTP
+		test.RunRequests([]test.TestCase{
+			{
+				Url:         "http://localhost/img/http://site.com/img.php?id=3&v=2/asis",
+				Description: "Query of the source",
+				Handler:     expectSource("http://site.com/img.php?id=3&v=2"),
+			},
+			{
+				Url:         "http://localhost/img/http://site.com/img.php?q=a%20b/c/asis?dppx=2&bg=a/b",
+				Description: "Query of the source and the operation",
+				Handler:     expectSource("http://site.com/img.php?q=a%20b/c"),
+			},
+			{
+				Url:         "http://localhost/img/http%3A%2F%2Fsite.com%2Fimg.php%3Fid%3D3/asis",
+				Description: "Encoded source",
+				Handler:     expectSource("http://site.com/img.php?id=3"),
+			},
+			{
+				Url:          "http://localhost/img/http://site.com/img.php?id=3/rotate?a=b/c",
+				Description:  "Unknown route",
+				ExpectedCode: http.StatusNotFound,
+			},
+			{
+				Url:          "http://localhost/unknown?a=b",
+				Description:  "Unknown path",
+				ExpectedCode: http.StatusNotFound,
+			},
+		})
+
+		s.QuerySeparators = img.QuerySeparatorsReject
+		test.Service = handler().ServeHTTP
+		test.RunRequests([]test.TestCase{
+			{
+				Url:          "http://localhost/img/http://site.com/img.php?id=3/asis",
+				Description:  "Rejected",
+				ExpectedCode: http.StatusBadRequest,
+			},
+		})
+
+		s.QuerySeparators = img.QuerySeparatorsOff
+		test.Service = handler().ServeHTTP
+		test.RunRequests([]test.TestCase{
+			{
+				Url:          "http://localhost/img/http://site.com/img.php?id=3/asis",
+				Description:  "Not found",
+				ExpectedCode: http.StatusNotFound,
+			},
+		})
+	}
+
+	if _, err = img.ParseQuerySeparators("strict"); err == nil {
+		t.Errorf("expected error for unknown mode")
+	}
+}
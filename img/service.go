@@ -5,25 +5,49 @@ import (
 	"errors"
 	"fmt"
 	"github.com/dooman87/glogi"
-	"github.com/gorilla/mux"
+	"math"
 	"net/http"
 	"net/url"
 	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 // CacheTTL is the number of seconds  that will be written to max-age HTTP header
+//
+// Deprecated: use ServiceConfig.CacheTTL.
 var CacheTTL int
 
-// SaveDataEnabled is the flag to enable/disable Save-Data client hint.
-// Sometime CDN doesn't support Save-Data in Vary response header in which
-// case you would need to set this to false
-var SaveDataEnabled = true
+// NetworkHintsEnabled is the flag to enable ECT and Downlink client hints.
+// If enabled, then images are served with LOW quality on slow networks, see SlowDownlink.
+// ECT and Downlink are added to Vary response header, so CDN must support them.
+//
+// Deprecated: use ServiceConfig.NetworkHints.
+var NetworkHintsEnabled = false
+
+// SlowDownlink is the bandwidth in Mbps reported by Downlink client hint
+// below which network is considered slow. Zero disables the check.
+// Networks with effective connection type (ECT) slow-2g, 2g and 3g are always considered slow.
+//
+// Deprecated: use ServiceConfig.SlowDownlink.
+var SlowDownlink = 1.5
+
+// MaxDimension is the maximum width and height in pixels that could be requested
+// in size param. Zero disables the limit.
+//
+// Deprecated: use ServiceConfig.MaxDimension.
+var MaxDimension = 10000
+
+// MaxDppx is the maximum value of dppx query param. Bigger values are clamped to MaxDppx.
+// Zero disables the limit.
+//
+// Deprecated: use ServiceConfig.MaxDppx.
+var MaxDppx = 4.0
 
 // Log is the logger that could be overridden. Should implement interface glogi.Logger.
-// By default is using glogi.SimpleLogger.
+// By default is using glogi.SimpleLogger. Services log with ServiceConfig.Log if it's set.
 var Log glogi.Logger = glogi.NewSimpleLogger()
 
 // Loader is responsible for loading an original image for transformation
@@ -45,27 +69,153 @@ const (
 	LOWER
 )
 
+// HighDensityDppx is the minimum device pixel ratio of high density screens.
+// Compression artifacts are less visible on such screens, so images are served
+// with LOWER quality.
+const HighDensityDppx = 2.0
+
 type ResizeConfig struct {
 	// Size is a size of output images in the format WxH.
+	// Size is in device pixels, so clients should multiply size
+	// in CSS pixels by dppx, see DevicePixels. If Service.ScaleByDppx is set then
+	// service does it using ScaledSize.
 	Size string
 }
 
+// ScaledSize returns Size in device pixels assuming that Size is in CSS pixels.
+// Each dimension is calculated using DevicePixels.
+func (c *ResizeConfig) ScaledSize(dppx float64) (string, error) {
+	dimensions := strings.Split(c.Size, "x")
+	for i, d := range dimensions {
+		if len(d) == 0 {
+			continue
+		}
+		cssPixels, err := strconv.Atoi(d)
+		if err != nil {
+			return "", fmt.Errorf("invalid size [%s]: %w", c.Size, err)
+		}
+		dimensions[i] = strconv.Itoa(DevicePixels(cssPixels, dppx))
+	}
+
+	return strings.Join(dimensions, "x"), nil
+}
+
+// DevicePixels returns the number of device pixels for the given size in CSS pixels:
+// round(cssPixels * dppx). If dppx is not positive then it's treated as 1.
+func DevicePixels(cssPixels int, dppx float64) int {
+	if dppx <= 0 {
+		return cssPixels
+	}
+	return int(math.Round(float64(cssPixels) * dppx))
+}
+
 // TransformationConfig is a configuration passed to Processor
 // that used during transformations.
 type TransformationConfig struct {
 	// Src is the source image to transform.
 	// This field is required for transformations.
 	Src *Image
+	// SrcInfo is the information about the source image. If nil then processor
+	// will load it and store here, so subsequent transformations
+	// of the same source don't need to identify it again.
+	SrcInfo *Info
 	// SupportedFormats is the list of output formats supported by client.
 	// Processor will use one of those formats for result image. If list
 	// is empty the format of the source image will be used.
 	SupportedFormats []string
 	// Quality defines quality of output image
 	Quality Quality
+	// MaxSize limits width and height of the output image in pixels. Zero means no limit.
+	MaxSize int
+	// Scale is the ratio of the output image size to the requested size, e.g. 0.5
+	// for the half resolution. Zero means that image is not scaled.
+	Scale float64
+	// Dppx is the number of device pixels per CSS pixel of the client, the same as window.devicePixelRatio.
+	// Zero if unknown. Service sets Quality to LOWER for high density screens (see HighDensityDppx),
+	// processors could use it for other density-aware optimisations.
+	Dppx float64
 	// TrimBorder is a flag whether we need to remove border or not
 	TrimBorder bool
+	// WideGamut is a flag to preserve wide-gamut color profiles, e.g. Display P3,
+	// instead of converting the image to sRGB
+	WideGamut bool
+	// ReplaceColors are colors that are replaced in the source image before the transformation.
+	ReplaceColors []ColorReplacement
+	// Fuzz is the distance in percents between colors that are treated as the same
+	// when colors are replaced.
+	Fuzz float64
+	// Enhance is a flag to automatically adjust levels, gamma and saturation of
+	// the image, e.g. for under-exposed user generated content.
+	Enhance bool
+	// Static is a flag to return the first frame of animated images as a still image,
+	// e.g. for lightweight previews that load the animation on interaction.
+	Static bool
+	// Depth is the bit depth of channels of the output image, e.g. 8 to convert 16-bit sources.
+	// Zero keeps the depth of the source.
+	Depth int
+	// MaxFrames limits the number of frames of animated images. Longer animations are sampled
+	// evenly and the delay between frames is increased, so the duration is kept. Zero means no limit.
+	MaxFrames int
+	// AvifMinSavings is the minimum percentage by which AVIF must be smaller than the next best
+	// format to be served. Processors encode the image to the other format to compare. Zero serves
+	// AVIF whenever it's selected.
+	AvifMinSavings float64
 	// Config is the configuration for the specific transformation
 	Config interface{}
+	// Debug collects decisions made by the processor if not nil, see Service.Debug.
+	Debug *Debug
+	// Span is the span of the transformation if the request is traced, see Service.Tracing.
+	// Processors could add child spans, e.g. for external commands.
+	Span *Span
+}
+
+// FrameStep returns the step between frames of the animation with the given number of frames
+// that are kept to fit MaxFrames, e.g. 2 when every second frame is kept.
+func (c *TransformationConfig) FrameStep(frames int) int {
+	if c.MaxFrames <= 0 || frames <= c.MaxFrames {
+		return 1
+	}
+	return (frames + c.MaxFrames - 1) / c.MaxFrames
+}
+
+// OutputFrames returns the number of frames of the output image for the source with the
+// given number of frames after Static and MaxFrames are applied.
+func (c *TransformationConfig) OutputFrames(frames int) int {
+	if c.Static && frames > 1 {
+		return 1
+	}
+	step := c.FrameStep(frames)
+	return (frames + step - 1) / step
+}
+
+// ColorReplacement replaces one color with another. Colors are hex RGB values
+// without #, e.g. "ff0000".
+type ColorReplacement struct {
+	From string
+	To   string
+}
+
+// LimitSize returns the size of the output image for the given target size
+// after applying Scale and MaxSize. Aspect ratio is preserved.
+func (c *TransformationConfig) LimitSize(width int, height int) (int, int) {
+	ratio := 1.0
+	if c.Scale > 0 {
+		ratio = c.Scale
+	}
+	if maxDimension := math.Max(float64(width), float64(height)) * ratio; c.MaxSize > 0 && maxDimension > float64(c.MaxSize) {
+		ratio = ratio * float64(c.MaxSize) / maxDimension
+	}
+	if ratio == 1.0 {
+		return width, height
+	}
+
+	scale := func(d int) int {
+		if d <= 0 {
+			return d
+		}
+		return int(math.Max(1, math.Round(float64(d)*ratio)))
+	}
+	return scale(width), scale(height)
 }
 
 // Processor is the interface for transforming/optimising images.
@@ -92,78 +242,198 @@ type Processor interface {
 	Optimise(input *TransformationConfig) (*Image, error)
 }
 
+// Planner is implemented by processors that could describe the transformation without running it.
+type Planner interface {
+	// Plan returns decisions that processor would make for the transformation.
+	// "op" is the name of the operation: "optimise", "resize" or "fit".
+	Plan(op string, input *TransformationConfig) (*Debug, error)
+}
+
 type Service struct {
-	Loader      Loader
-	Processor   Processor
-	Q           []*Queue
-	currProc    int
-	currProcMux sync.Mutex
+	Loader    Loader
+	Processor Processor
+	// Q are queues of processors. Nil when Scheduler is used.
+	Q []*Queue
+	// Scheduler runs commands when ServiceConfig.QueueWeights is set, see NewScheduler.
+	Scheduler *Scheduler
+	// Config is the configuration of the service. Deprecated package variables are used if nil.
+	Config *ServiceConfig
+	// MemoryBudget limits estimated memory of images that are transformed at the same time.
+	// Disabled if nil.
+	MemoryBudget *MemoryBudget
+	// Savings tracks sizes of source and transformed images. Disabled if nil.
+	Savings *Savings
+	// Metrics collects latency, sizes and errors of transformations. Disabled if nil.
+	Metrics *Metrics
+	// Tracing traces requests with OpenTelemetry compatible spans. Disabled if nil.
+	Tracing *Tracing
+	// Status tracks transformations in progress, recent errors and top source hosts for the
+	// status page, see ServeStatus. Disabled if nil.
+	Status *Status
+	// CardTemplates are templates of social cards available on /card/{template}.
+	CardTemplates CardTemplates
+	// Dialects translate URLs of other image services. Key is the path prefix without slashes,
+	// e.g. URLs of "cloudinary" dialect start with /cloudinary/.
+	Dialects map[string]Dialect
+	// Aliases are presets of operations served on their own routes by name, e.g. "thumb" is
+	// served on /img/{imgUrl}/thumb. Aliases with names of other routes and aliases of operations
+	// disabled by DisabledRoutes are not registered.
+	Aliases map[string]*Alias
+	// RoutePrefixes are path prefixes, e.g. "/v2", under which routes are served in addition to
+	// unprefixed routes, so versioned URL schemes could be introduced without breaking published URLs.
+	RoutePrefixes []string
+	// DisabledRoutes are names of routes that are not registered, e.g. "asis" or "fit", to reduce
+	// the attack surface. Disabled operations are not served through aliases and dialects either.
+	// See Service.Routes for names of routes.
+	DisabledRoutes map[string]bool
+	// SaveData is the policy for users that prefer reduced data usage. NewService sets
+	// DefaultSaveDataPolicy, or OffSaveDataPolicy if SaveDataEnabled is false. Save-Data is ignored if nil.
+	SaveData SaveDataPolicy
+	// Placeholder is served instead of images hidden by SaveData policy. Empty 1x1 GIF is
+	// served if nil.
+	Placeholder *Placeholder
+	// FormatFallbacks change supported formats of clients by User-Agent when Accept header is
+	// not enough to select the output format, see DefaultFormatFallbacks. User-Agent is added to
+	// Vary response header if set. Disabled if empty.
+	FormatFallbacks []*FormatFallback
+	// Variants caches high density results of resize and fit to derive lower density variants
+	// from them when ScaleByDppx is set. Disabled if nil.
+	Variants *VariantCache
+	// Bots is the policy for crawlers and link preview bots. Bots are served as usual if nil.
+	Bots *BotPolicy
+	// Signer requires signed URLs, see UrlSigner. Requests to routes of the service with missing or
+	// invalid signature are responded with 403. URLs are not signed if nil.
+	Signer *UrlSigner
+	// QuerySeparators defines how requests with un-encoded "?" in the source URL are handled,
+	// e.g. /img/https://site.com/img.png?v=3/resize. Such requests are responded with 404 by default.
+	QuerySeparators QuerySeparators
+	// ExifGPS is the flag to return GPS location on /img/{imgUrl}/exif. Location is redacted by default,
+	// because it could reveal where the photo was taken.
+	ExifGPS bool
+	// ProcessedBy is the id of the instance, e.g. the host name, that is added to X-Processed-By header
+	// with the queue and timings of the transformation, so the variance between instances of the fleet behind
+	// a load balancer could be debugged. The header is not added if empty.
+	ProcessedBy string
+	// ServerTiming is the flag to add Server-Timing header with queue wait and
+	// transformation time to the responses.
+	ServerTiming bool
+	// SniffMimeType is the flag to detect MIME type of source images from their content
+	// instead of trusting Content-Type of the source. Sources that are not images are rejected with 415.
+	SniffMimeType bool
+	// ScaleByDppx is the flag to treat size param as CSS pixels and
+	// multiply it by dppx param to get the size of the output image.
+	ScaleByDppx bool
+	// Debug is the flag to enable debug query param that adds X-Debug-* headers
+	// with decisions made during the transformation, e.g. output format, quality and
+	// ImageMagick arguments. It exposes internals, so shouldn't be enabled publicly.
+	Debug bool
+	// FaceDetector detects faces on sources of avatars, e.g. using an external model. Faces are
+	// detected by the processor if nil, see Avatarer.
+	FaceDetector FaceDetector
+	// SlowLog logs details of slow and sampled requests, e.g. ImageMagick arguments. Disabled if nil.
+	SlowLog *SlowLog
+	// ErrorReporter reports failed transformations with server errors, e.g. to Sentry. Disabled if nil.
+	ErrorReporter ErrorReporter
+	// NormalizeUrl canonicalizes URLs of source images before they are loaded, so equivalent
+	// URLs hit the same cached source, e.g. UrlNormalizer.Normalize. URLs are loaded as is if nil.
+	NormalizeUrl func(imgUrl string) (string, error)
+	// ReportSource transforms URLs of source images before they are reported, e.g. HashSource
+	// or RedactSource. URLs are reported as is if nil.
+	ReportSource func(imgUrl string) string
+	hooks        []*Hooks
+	currProc     int
+	currProcMux  sync.Mutex
 }
 
 type Cmd func(input *TransformationConfig) (*Image, error)
 
 type Command struct {
+	// Op is the name of the operation: "optimise", "resize", "fit", "upscale", "avatar" or "transcode".
+	// Empty for requests that are not counted in Service.Savings.
+	Op             string
 	Transformation Cmd
 	Config         *TransformationConfig
+	Req            *http.Request
 	Resp           http.ResponseWriter
 	Result         *Image
-	FinishedCond   *sync.Cond
-	Finished       bool
-	Err            error
+	// Download sets Content-Disposition header of the response. The header is not set if nil.
+	Download     *Download
+	FinishedCond *sync.Cond
+	Finished     bool
+	Err          error
+	// ReceivedAt is the time when the request was received. QueuedAt is used if zero.
+	ReceivedAt time.Time
+	// QueuedAt is the time when command was added to the queue
+	QueuedAt time.Time
+	// StartedAt is the time when queue started to execute the command
+	StartedAt time.Time
+	// FinishedAt is the time when command execution finished
+	FinishedAt time.Time
+	// Worker is the index of the queue or the scheduler worker that executed the command.
+	Worker int
+	// class is the class of the command before it's executed, see commandClass.
+	class string
+	// hideDebug is true if Config.Debug is collected only for Service.SlowLog, so X-Debug-* headers are not added.
+	hideDebug bool
+	// log is the logger of the service that executes the command.
+	log glogi.Logger
 }
 
-var emptyGif = [...]byte{0x47, 0x49, 0x46, 0x38, 0x39, 0x61, 0x1, 0x0, 0x1, 0x0, 0x0, 0x0, 0x0, 0x21, 0xf9, 0x4, 0x1, 0xa, 0x0, 0x1, 0x0, 0x2c, 0x0, 0x0, 0x0, 0x0, 0x1, 0x0, 0x1, 0x0, 0x0, 0x2, 0x2, 0x4c, 0x1, 0x0, 0x3b}
-
+// NewService creates the service that is configured by package variables, see NewServiceWithConfig.
 func NewService(r Loader, p Processor, procNum int) (*Service, error) {
+	return NewServiceWithConfig(r, p, procNum, nil)
+}
+
+// NewServiceWithConfig creates the service with the configuration. Values of deprecated package
+// variables are used if config is nil, see DefaultServiceConfig.
+func NewServiceWithConfig(r Loader, p Processor, procNum int, config *ServiceConfig) (*Service, error) {
 	if procNum <= 0 {
 		return nil, fmt.Errorf("procNum must be positive, but got [%d]", procNum)
 	}
-
-	Log.Printf("Creating new service with [%d] number of processors\n", procNum)
+	if config == nil {
+		config = DefaultServiceConfig()
+	}
 
 	srv := &Service{
 		Loader:    r,
 		Processor: p,
-		Q:         make([]*Queue, procNum),
+		Config:    config,
+		SaveData:  defaultSaveDataPolicy(),
 	}
+	srv.log().Printf("Creating new service with [%d] number of processors\n", procNum)
 
-	for i := 0; i < procNum; i++ {
-		srv.Q[i] = NewQueue()
+	if len(config.QueueWeights) > 0 {
+		srv.Scheduler = NewScheduler(procNum, config.QueueWeights)
+	} else {
+		srv.Q = make([]*Queue, procNum)
+		for i := 0; i < procNum; i++ {
+			srv.Q[i] = NewQueue()
+		}
 	}
 	srv.currProc = 0
 
 	return srv, nil
 }
 
-func (r *Service) GetRouter() *mux.Router {
-	router := mux.NewRouter().SkipClean(true)
-	router.HandleFunc("/img/{imgUrl:.*}/resize", r.ResizeUrl)
-	router.HandleFunc("/img/{imgUrl:.*}/fit", r.FitToSizeUrl)
-	router.HandleFunc("/img/{imgUrl:.*}/asis", r.AsIs)
-	router.HandleFunc("/img/{imgUrl:.*}/optimise", r.OptimiseUrl)
-
-	return router
-}
-
 func (r *Service) OptimiseUrl(resp http.ResponseWriter, req *http.Request) {
-	r.transformUrl(resp, req, r.Processor.Optimise, nil)
+	r.transformUrl(resp, req, "optimise", r.Processor.Optimise, nil)
 }
 
 func (r *Service) ResizeUrl(resp http.ResponseWriter, req *http.Request) {
 	size, _ := getQueryParam(req.URL, "size")
+	if len(size) == 0 {
+		size, _ = getClientHint(req.Header, "Width")
+	}
 	if len(size) == 0 {
 		http.Error(resp, "size param is required", http.StatusBadRequest)
 		return
 	}
-	if match, err := regexp.MatchString(`^\d*[x]?\d*$`, size); !match || err != nil {
-		if err != nil {
-			Log.Printf("Error while matching size: %s\n", err.Error())
-		}
-		http.Error(resp, "size param should be in format WxH", http.StatusBadRequest)
+	if err := r.validateSize(size, false); err != nil {
+		http.Error(resp, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	r.transformUrl(resp, req, r.Processor.Resize, &ResizeConfig{Size: size})
+	r.transformUrl(resp, req, "resize", r.Processor.Resize, &ResizeConfig{Size: size})
 }
 
 func (r *Service) FitToSizeUrl(resp http.ResponseWriter, req *http.Request) {
@@ -172,35 +442,136 @@ func (r *Service) FitToSizeUrl(resp http.ResponseWriter, req *http.Request) {
 		http.Error(resp, "size param is required", http.StatusBadRequest)
 		return
 	}
-	if match, err := regexp.MatchString(`^\d*[x]\d*$`, size); !match || err != nil {
-		if err != nil {
-			Log.Printf("Error while matching size: %s\n", err.Error())
+	if err := r.validateSize(size, true); err != nil {
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	r.transformUrl(resp, req, "fit", r.Processor.FitToSize, &ResizeConfig{Size: size})
+}
+
+// PlanUrl returns the transformation that would be done as JSON without encoding the image.
+// The operation is defined by op query param, which is "resize" when size param is set
+// and "optimise" otherwise.
+func (r *Service) PlanUrl(resp http.ResponseWriter, req *http.Request) {
+	planner, ok := r.Processor.(Planner)
+	if !ok {
+		http.Error(resp, "processor doesn't support plans", http.StatusNotImplemented)
+		return
+	}
+
+	size, _ := getQueryParam(req.URL, "size")
+	op, _ := getQueryParam(req.URL, "op")
+	if len(op) == 0 {
+		op = "optimise"
+		if len(size) > 0 {
+			op = "resize"
 		}
-		http.Error(resp, "size param should be in format WxH", http.StatusBadRequest)
+	}
+
+	var config interface{}
+	switch op {
+	case "optimise":
+	case "resize", "fit":
+		if len(size) == 0 {
+			http.Error(resp, "size param is required", http.StatusBadRequest)
+			return
+		}
+		if err := r.validateSize(size, op == "fit"); err != nil {
+			http.Error(resp, err.Error(), http.StatusBadRequest)
+			return
+		}
+		config = &ResizeConfig{Size: size}
+	default:
+		http.Error(resp, "op query param must be one of 'optimise', 'resize', 'fit'", http.StatusBadRequest)
 		return
 	}
 
-	r.transformUrl(resp, req, r.Processor.FitToSize, &ResizeConfig{Size: size})
+	r.transformUrl(resp, req, "", func(input *TransformationConfig) (*Image, error) {
+		plan, err := planner.Plan(op, input)
+		if err != nil {
+			return nil, err
+		}
+		return newPlanImage(op, input, plan)
+	}, config)
+}
+
+var sizeRegexp = regexp.MustCompile(`^(\d*)(x?)(\d*)$`)
+
+// validateSize returns an error if size is not in the format WxH, any dimension is
+// zero or bigger than ServiceConfig.MaxDimension. If both is true then width and height are required.
+func (r *Service) validateSize(size string, both bool) error {
+	maxDimension := r.config().MaxDimension
+	parsedSize := sizeRegexp.FindStringSubmatch(size)
+	if parsedSize == nil {
+		return errors.New("size param should be in format WxH")
+	}
+	width, height := parsedSize[1], parsedSize[3]
+	if both && (len(width) == 0 || len(height) == 0 || len(parsedSize[2]) == 0) {
+		return errors.New("size param should be in format WxH with both width and height")
+	}
+	if len(width) == 0 && len(height) == 0 {
+		return errors.New("size param should have width or height")
+	}
+
+	for _, d := range []string{width, height} {
+		if len(d) == 0 {
+			continue
+		}
+		dimension, err := strconv.Atoi(d)
+		switch {
+		case err != nil:
+			return errors.New("width and height in size param are too big")
+		case dimension == 0:
+			return errors.New("width and height in size param must be positive")
+		case maxDimension > 0 && dimension > maxDimension:
+			return fmt.Errorf("width and height in size param must not be more than %d", maxDimension)
+		}
+	}
+
+	return nil
 }
 
+// AsIs returns the source image. With format=auto query param the image is converted to the
+// format supported by the client without other changes, see Transcoder.
 func (r *Service) AsIs(resp http.ResponseWriter, req *http.Request) {
-	imgUrl := getImgUrl(req)
+	imgUrl := r.getImgUrl(req)
 	if len(imgUrl) == 0 {
 		http.Error(resp, "url param is required", http.StatusBadRequest)
 		return
 	}
 
-	Log.Printf("Requested image %s as is\n", imgUrl)
+	format, _ := getQueryParam(req.URL, "format")
+	if len(format) > 0 && format != "auto" {
+		http.Error(resp, "format query param must be 'auto'", http.StatusBadRequest)
+		return
+	}
+	if format == "auto" {
+		transcoder, ok := r.Processor.(Transcoder)
+		if !ok {
+			http.Error(resp, "processor doesn't support transcode", http.StatusNotImplemented)
+			return
+		}
+		r.transformUrl(resp, req, "transcode", transcoder.Transcode, nil)
+		return
+	}
 
-	result, err := r.Loader.Load(imgUrl, req.Context())
+	r.log().Printf("Requested image %s as is\n", imgUrl)
 
+	r.serveAsIs(resp, req, imgUrl)
+}
+
+// serveAsIs serves the source image without transformation.
+func (r *Service) serveAsIs(resp http.ResponseWriter, req *http.Request, imgUrl string) {
+	download, err := getDownload(req)
 	if err != nil {
-		sendError(resp, err)
+		r.sendError(resp, err)
 		return
 	}
-
-	if len(result.MimeType) > 0 {
-		resp.Header().Add("Content-Type", result.MimeType)
+	result, err := r.load(req, imgUrl)
+	if err != nil {
+		r.sendError(resp, err)
+		return
 	}
 
 	r.execOp(&Command{
@@ -209,22 +580,97 @@ func (r *Service) AsIs(resp http.ResponseWriter, req *http.Request) {
 				Id: imgUrl,
 			},
 		},
-		Result: result,
-		Resp:   resp,
+		Result:   result,
+		Download: download,
+		Req:      req,
+		Resp:     resp,
 	})
 }
 
 func (r *Service) execOp(op *Command) {
+	if err := r.preTransform(op); err != nil {
+		op.Config.Src.Release()
+		op.Result.Release()
+		r.sendError(op.Resp, err)
+		return
+	}
+
 	op.FinishedCond = sync.NewCond(&sync.Mutex{})
+	op.log = r.log()
 
-	queue := r.getQueue()
-	queue.AddAndWait(op, func() {
-		Log.Printf("Image [%s] transformed successfully, writing to the response", op.Config.Src.Id)
-		writeResult(op)
+	var addAndWait func(op *Command, callback OpCallback)
+	if r.Scheduler != nil {
+		addAndWait = r.Scheduler.AddAndWait
+	} else {
+		var queue *Queue
+		queue, op.Worker = r.getQueue()
+		addAndWait = queue.AddAndWait
+	}
+	op.class = commandClass(op)
+	if r.Status != nil {
+		r.Status.start(op)
+	}
+	var requestSpan *Span
+	if op.Req != nil {
+		requestSpan = SpanFromContext(op.Req.Context())
+	}
+	if requestSpan != nil {
+		// Started when the worker picks up the command
+		op.Config.Span = requestSpan.newSpan("transform", SpanKindInternal)
+		op.Config.Span.SetAttribute("transformimgs.op", op.Op)
+	}
+	op.QueuedAt = time.Now()
+	addAndWait(op, func() {
+		if requestSpan != nil {
+			requestSpan.record("queue", op.QueuedAt, op.StartedAt)
+			op.Config.Span.StartTime = op.StartedAt
+			op.Config.Span.SetError(op.Err)
+			op.Config.Span.endAt(op.FinishedAt)
+		}
+		if op.Err == nil {
+			r.log().Printf("Image [%s] transformed successfully, writing to the response", op.Config.Src.Id)
+			op.Err = r.postTransform(op)
+		} else {
+			r.log().Errorf("[%s] Transformation failed [%s]: %s", op.Config.Src.Id, ErrorCategory(op.Err), op.Err)
+			r.reportError(op)
+		}
+		if r.ServerTiming {
+			addServerTiming(op)
+		}
+		if len(r.ProcessedBy) > 0 {
+			r.addProcessedBy(op)
+		}
+		writeSpan := requestSpan.Child("write")
+		r.writeResult(op)
+		writeSpan.End()
+		r.logSlow(op)
+		if r.Savings != nil && len(op.Op) > 0 && op.Err == nil {
+			r.Savings.Add(op.Op, resultFormat(op), len(op.Config.Src.Data), len(op.Result.Data))
+		}
+		if r.Metrics != nil {
+			r.Metrics.observeOp(op)
+		}
+		if r.Status != nil {
+			r.Status.finish(op)
+		}
+
+		// Buffers are going back to the pool, so data must not be used after this point
+		op.Config.Src.Release()
+		op.Result.Release()
 	})
 }
 
-func (r *Service) getQueue() *Queue {
+// resultFormat returns MIME type of the result. Processors could return the source
+// without MIME type when it's smaller than the transformed image.
+func resultFormat(op *Command) string {
+	if len(op.Result.MimeType) > 0 {
+		return op.Result.MimeType
+	}
+	return op.Config.Src.MimeType
+}
+
+// getQueue returns the next queue and its index.
+func (r *Service) getQueue() (*Queue, int) {
 	// Get the next execution channel
 	r.currProcMux.Lock()
 	r.currProc++
@@ -234,16 +680,67 @@ func (r *Service) getQueue() *Queue {
 	procIdx := r.currProc
 	r.currProcMux.Unlock()
 
-	return r.Q[procIdx]
+	return r.Q[procIdx], procIdx
 }
 
-// Adds Content-Length and Cache-Control headers
-func addHeaders(resp http.ResponseWriter, image *Image) {
+// Adds Content-Length, Cache-Control and image size headers
+func addHeaders(resp http.ResponseWriter, image *Image, cacheTTL int) {
 	if len(image.MimeType) != 0 {
-		resp.Header().Add("Content-Type", image.MimeType)
+		resp.Header().Set("Content-Type", image.MimeType)
+	}
+	resp.Header().Set("Content-Length", strconv.Itoa(len(image.Data)))
+	resp.Header().Set("Cache-Control", cacheControl(cacheTTL))
+	if image.Width > 0 && image.Height > 0 {
+		resp.Header().Set("X-Image-Width", strconv.Itoa(image.Width))
+		resp.Header().Set("X-Image-Height", strconv.Itoa(image.Height))
+	}
+	if image.Frames > 0 {
+		resp.Header().Set("X-Frames", strconv.Itoa(image.Frames))
+		resp.Header().Set("X-Animated", strconv.FormatBool(image.Frames > 1))
+	}
+}
+
+// cacheControl returns the value of Cache-Control header of responses.
+func cacheControl(cacheTTL int) string {
+	return fmt.Sprintf("public, max-age=%d", cacheTTL)
+}
+
+// Adds Server-Timing header with queue wait and transformation duration in milliseconds
+func addServerTiming(op *Command) {
+	queue := op.StartedAt.Sub(op.QueuedAt)
+	transform := op.FinishedAt.Sub(op.StartedAt)
+	op.Resp.Header().Set("Server-Timing", fmt.Sprintf("queue;dur=%.1f, transform;dur=%.1f",
+		float64(queue.Microseconds())/1000, float64(transform.Microseconds())/1000))
+}
+
+// addProcessedBy adds X-Processed-By header with the id of the instance, the class of the command,
+// the index of the worker and durations of queue wait and transformation in milliseconds.
+func (r *Service) addProcessedBy(op *Command) {
+	queue := op.StartedAt.Sub(op.QueuedAt)
+	transform := op.FinishedAt.Sub(op.StartedAt)
+	op.Resp.Header().Set("X-Processed-By", fmt.Sprintf("%s; class=%s; worker=%d; queue=%.1f; transform=%.1f",
+		r.ProcessedBy, op.class, op.Worker, float64(queue.Microseconds())/1000, float64(transform.Microseconds())/1000))
+}
+
+// Adds X-Debug-* headers with decisions made during the transformation
+func addDebug(resp http.ResponseWriter, config *TransformationConfig) {
+	debug := config.Debug
+	format := debug.MimeType
+	if debug.Source != nil {
+		resp.Header().Set("X-Debug-Source", fmt.Sprintf("%s %dx%d quality=%d size=%d",
+			debug.Source.Format, debug.Source.Width, debug.Source.Height, debug.Source.Quality, len(config.Src.Data)))
+		if len(format) == 0 {
+			format = debug.Source.Format
+		}
+	}
+	if debug.Target != nil {
+		resp.Header().Set("X-Debug-Target", fmt.Sprintf("%s %dx%d quality=%d",
+			format, debug.Target.Width, debug.Target.Height, debug.Quality))
 	}
-	resp.Header().Add("Content-Length", strconv.Itoa(len(image.Data)))
-	resp.Header().Add("Cache-Control", fmt.Sprintf("public, max-age=%d", CacheTTL))
+	if len(debug.Args) > 0 {
+		resp.Header().Set("X-Debug-Args", strings.Join(debug.Args, " "))
+	}
+	resp.Header().Set("X-Debug-Original", strconv.FormatBool(debug.Original))
 }
 
 func getQueryParam(url *url.URL, name string) (string, bool) {
@@ -253,141 +750,529 @@ func getQueryParam(url *url.URL, name string) (string, bool) {
 	return "", url.Query().Has(name)
 }
 
-func getImgUrl(req *http.Request) string {
-	imgUrl := mux.Vars(req)["imgUrl"]
+var hexColorRegexp = regexp.MustCompile(`^([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+
+// parseColorReplacements parses comma separated list of replacements in
+// the format from:to, e.g. ff0000:00ff00,fff:000.
+func parseColorReplacements(param string) ([]ColorReplacement, error) {
+	var result []ColorReplacement
+	for _, replacement := range strings.Split(param, ",") {
+		colors := strings.Split(replacement, ":")
+		if len(colors) != 2 || !hexColorRegexp.MatchString(colors[0]) || !hexColorRegexp.MatchString(colors[1]) {
+			return nil, errors.New("replace-color param should be in format RRGGBB:RRGGBB")
+		}
+		result = append(result, ColorReplacement{From: colors[0], To: colors[1]})
+	}
+	return result, nil
+}
+
+// getBoolQueryParam returns true if the param is present without value, e.g. ?trim-border,
+// otherwise parses the value of the param.
+func getBoolQueryParam(url *url.URL, name string) (bool, error) {
+	value, exist := getQueryParam(url, name)
+	if !exist {
+		return false, nil
+	}
+	if len(value) == 0 {
+		return true, nil
+	}
+	return strconv.ParseBool(value)
+}
+
+// getClientHint returns the value of the client hint and the name of the header
+// it was sent in, e.g. Sec-CH-DPR or legacy DPR. Returns empty strings if hint is not sent.
+func getClientHint(header http.Header, name string) (string, string) {
+	for _, h := range []string{"Sec-CH-" + name, name} {
+		if value := header.Get(h); len(value) > 0 {
+			return strings.TrimSpace(value), h
+		}
+	}
+	return "", ""
+}
+
+// getImgUrl returns the source URL from the path. Protocol relative URLs get the scheme from
+// X-Forwarded-Proto header or ServiceConfig.DefaultScheme.
+func (r *Service) getImgUrl(req *http.Request) string {
+	imgUrl := PathVars(req)["imgUrl"]
 	if len(imgUrl) == 0 {
 		return ""
 	}
 
-	if strings.HasPrefix(imgUrl, "//") && len(req.Header["X-Forwarded-Proto"]) == 1 {
-		imgUrl = fmt.Sprintf("%s:%s", req.Header["X-Forwarded-Proto"][0], imgUrl)
+	if strings.HasPrefix(imgUrl, "//") {
+		scheme := r.forwardedProto(req)
+		if len(scheme) == 0 {
+			scheme = r.config().DefaultScheme
+		}
+		if len(scheme) > 0 {
+			imgUrl = fmt.Sprintf("%s:%s", scheme, imgUrl)
+		}
 	}
 
 	return imgUrl
 }
 
+// forwardedProto returns the protocol from X-Forwarded-Proto header if it's set by a trusted proxy and
+// it's in ServiceConfig.ForwardedProtos or empty string otherwise. Only the first value is used
+// if proxies appended their protocols.
+func (r *Service) forwardedProto(req *http.Request) string {
+	if len(req.Header["X-Forwarded-Proto"]) != 1 || !r.trustForwarded(req) {
+		return ""
+	}
+	proto, _, _ := strings.Cut(req.Header["X-Forwarded-Proto"][0], ",")
+	proto = strings.ToLower(strings.TrimSpace(proto))
+
+	allowed := r.config().ForwardedProtos
+	if allowed == nil {
+		allowed = DefaultForwardedProtos
+	}
+	for _, p := range allowed {
+		if strings.EqualFold(p, proto) {
+			return proto
+		}
+	}
+	r.log().Printf("[%s]: Ignoring X-Forwarded-Proto [%s] that is not allowed\n", req.URL.String(), proto)
+	return ""
+}
+
+// forwardedHost returns the host from X-Forwarded-Host header if it's set by a proxy from
+// ServiceConfig.TrustedProxies or the host of the request otherwise.
+func (r *Service) forwardedHost(req *http.Request) string {
+	host := strings.TrimSpace(req.Header.Get("X-Forwarded-Host"))
+	if len(host) == 0 || !r.trustForwarded(req) {
+		return req.Host
+	}
+	host, _, _ = strings.Cut(host, ",")
+	return strings.TrimSpace(host)
+}
+
+// getSupportedFormats returns media types from all Accept header lines, because some proxies
+// split the header. Types are lowercased without parameters and deduplicated. Types with q=0
+// are not acceptable, so they are skipped.
 func getSupportedFormats(req *http.Request) []string {
-	acceptHeader := req.Header["Accept"]
-	if len(acceptHeader) > 0 {
-		accepts := strings.Split(acceptHeader[0], ",")
-		trimmedAccepts := make([]string, len(accepts))
-		for i, a := range accepts {
-			trimmedAccepts[i] = strings.TrimSpace(a)
+	formats := []string{}
+	seen := make(map[string]bool)
+	for _, line := range req.Header.Values("Accept") {
+		for _, accept := range strings.Split(line, ",") {
+			mediaType, params, _ := strings.Cut(accept, ";")
+			mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+			if len(mediaType) == 0 || seen[mediaType] || isNotAcceptable(params) {
+				continue
+			}
+			seen[mediaType] = true
+			formats = append(formats, mediaType)
 		}
-		return trimmedAccepts
 	}
 
-	return []string{}
+	return formats
+}
+
+// isNotAcceptable returns true if media type parameters have zero quality, e.g. "q=0".
+func isNotAcceptable(params string) bool {
+	for _, param := range strings.Split(params, ";") {
+		name, value, found := strings.Cut(param, "=")
+		if !found || !strings.EqualFold(strings.TrimSpace(name), "q") {
+			continue
+		}
+		q, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		return err == nil && q == 0
+	}
+	return false
 }
 
-func writeResult(op *Command) {
+// writeResult writes the result or the error of the command to the response. Headers hooks
+// are called after default headers are set.
+func (r *Service) writeResult(op *Command) {
+	config := r.config()
 	if op.Err != nil {
-		http.Error(op.Resp, fmt.Sprintf("Error transforming image: '%s'", op.Err.Error()), http.StatusInternalServerError)
+		// The error is logged with details by execOp
+		setProblemCode(op.Resp, op.Err)
+		msg, code := errorResponse(op.Err)
+		http.Error(op.Resp, msg, code)
 		return
 	}
 
-	addHeaders(op.Resp, op.Result)
+	addHeaders(op.Resp, op.Result, r.cacheTTL(op))
+	if cacheControl, ok := r.originCacheControl(op); ok {
+		op.Resp.Header().Set("Cache-Control", cacheControl)
+	}
+	r.addOptOut(op)
+	if op.Result.NoStore || (op.Config.Src != nil && op.Config.Src.NoStore) {
+		op.Resp.Header().Set("Cache-Control", "no-store")
+	}
+	if op.Download != nil {
+		op.Resp.Header().Set("Content-Disposition", op.Download.header(resultFormat(op), op.Config.Src.Id))
+	}
+	addDigest(op.Resp, op.Result.Data, config.DigestHeaders)
+	if op.Config.Debug != nil && !op.hideDebug {
+		addDebug(op.Resp, op.Config)
+	}
+	r.headers(op)
 	_, _ = op.Resp.Write(op.Result.Data)
 }
 
-func (r *Service) transformUrl(resp http.ResponseWriter, req *http.Request, transformation Cmd, config interface{}) {
-	imgUrl := getImgUrl(req)
+func (r *Service) transformUrl(resp http.ResponseWriter, req *http.Request, opName string, transformation Cmd, config interface{}) {
+	receivedAt := time.Now()
+	imgUrl := r.getImgUrl(req)
 	if len(imgUrl) == 0 {
 		http.Error(resp, "url param is required", http.StatusBadRequest)
 		return
 	}
+	// Normalized before variants are looked up, so equivalent URLs share them
+	imgUrl, err := r.normalizeUrl(imgUrl)
+	if err != nil {
+		r.sendError(resp, err)
+		return
+	}
+
+	serviceConfig := r.config()
+
+	// Vary header includes only request headers that could change the response
+	vary := r.formatsVary()
 
 	var dppx float64 = 0
 	dppxParam, _ := getQueryParam(req.URL, "dppx")
 	if len(dppxParam) != 0 {
 		var err error
 		dppx, err = strconv.ParseFloat(dppxParam, 32)
-		if err != nil {
-			http.Error(resp, "dppx query param must be a number", http.StatusBadRequest)
+		if err != nil || dppx < 0 || math.IsNaN(dppx) || math.IsInf(dppx, 0) {
+			http.Error(resp, "dppx query param must be a positive number", http.StatusBadRequest)
 			return
 		}
+	} else if dprHint, dprHeader := getClientHint(req.Header, "DPR"); len(dprHeader) > 0 {
+		vary = append(vary, dprHeader)
+		// Invalid client hints are ignored
+		dppx, _ = strconv.ParseFloat(dprHint, 32)
+		if dppx < 0 || math.IsNaN(dppx) || math.IsInf(dppx, 0) {
+			dppx = 0
+		}
+	}
+	if serviceConfig.MaxDppx > 0 && dppx > serviceConfig.MaxDppx {
+		dppx = serviceConfig.MaxDppx
 	}
 
-	var saveDataParam = ""
-	if SaveDataEnabled {
-		saveDataParam, _ = getQueryParam(req.URL, "save-data")
-		if len(saveDataParam) > 0 && saveDataParam != "off" && saveDataParam != "hide" {
-			http.Error(resp, "save-data query param must be one of 'off', 'hide'", http.StatusBadRequest)
-			return
+	widthHint := false
+	if _, ok := config.(*ResizeConfig); ok {
+		if size, _ := getQueryParam(req.URL, "size"); len(size) == 0 {
+			_, widthHeader := getClientHint(req.Header, "Width")
+			vary = append(vary, widthHeader)
+			widthHint = true
 		}
 	}
 
-	var trimBorder = false
-	trimBorderParamValue, trimBorderParamExist := getQueryParam(req.URL, "trim-border")
-	if trimBorderParamExist {
-		if len(trimBorderParamValue) == 0 {
-			trimBorder = true
-		} else {
-			var err error
-			trimBorder, err = strconv.ParseBool(trimBorderParamValue)
-			if err != nil {
-				http.Error(resp, "can't parse trim-border param", http.StatusBadRequest)
-			}
+	// Width client hint is already in device pixels
+	if resizeConfig, ok := config.(*ResizeConfig); ok && r.ScaleByDppx && dppx > 0 && !widthHint {
+		size, err := resizeConfig.ScaledSize(dppx)
+		if err == nil {
+			err = r.validateSize(size, false)
 		}
+		if err != nil {
+			http.Error(resp, err.Error(), http.StatusBadRequest)
+			return
+		}
+		config = &ResizeConfig{Size: size}
+	}
+	if resizeConfig, ok := config.(*ResizeConfig); ok {
+		size, err := r.limitSize(resizeConfig.Size, widthHint)
+		if err != nil {
+			r.sendError(resp, err)
+			return
+		}
+		config = &ResizeConfig{Size: size}
 	}
 
-	saveDataHeader := req.Header.Get("Save-Data")
+	saveData, saveDataVary, err := r.saveData(req)
+	if err != nil {
+		r.sendError(resp, err)
+		return
+	}
 
-	Log.Printf("[%s]: Transforming image %s using config %+v\n", req.URL.String(), imgUrl, config)
+	var botMode BotMode
+	if r.Bots != nil && r.Bots.Mode != BotOff {
+		if len(r.FormatFallbacks) == 0 {
+			vary = append(vary, "User-Agent")
+		}
+		botMode = r.botMode(req.Header.Get("User-Agent"))
+	}
+	if botMode == BotReduce && saveData.Mode == SaveDataOff {
+		saveData = &SaveData{Mode: SaveDataReduce, MaxSize: r.Bots.MaxSize}
+	}
+
+	trimBorder, err := getBoolQueryParam(req.URL, "trim-border")
+	if err != nil {
+		http.Error(resp, "can't parse trim-border param", http.StatusBadRequest)
+		return
+	}
 
-	if SaveDataEnabled {
-		resp.Header().Add("Vary", "Accept, Save-Data")
+	wideGamut, err := getBoolQueryParam(req.URL, "wide-gamut")
+	if err != nil {
+		http.Error(resp, "can't parse wide-gamut param", http.StatusBadRequest)
+		return
+	}
 
-		if saveDataHeader == "on" && saveDataParam == "hide" {
-			_, _ = resp.Write(emptyGif[:])
+	var replaceColors []ColorReplacement
+	if replaceColorParam, _ := getQueryParam(req.URL, "replace-color"); len(replaceColorParam) > 0 {
+		replaceColors, err = parseColorReplacements(replaceColorParam)
+		if err != nil {
+			http.Error(resp, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	var fuzz float64
+	if fuzzParam, _ := getQueryParam(req.URL, "fuzz"); len(fuzzParam) > 0 {
+		fuzz, err = strconv.ParseFloat(fuzzParam, 64)
+		if err != nil || fuzz < 0 || fuzz > 100 {
+			http.Error(resp, "fuzz query param must be a number between 0 and 100", http.StatusBadRequest)
 			return
 		}
-	} else {
-		resp.Header().Add("Vary", "Accept")
 	}
 
-	supportedFormats := getSupportedFormats(req)
+	enhance, _ := getQueryParam(req.URL, "enhance")
+	if len(enhance) > 0 && enhance != "auto" {
+		http.Error(resp, "enhance query param must be 'auto'", http.StatusBadRequest)
+		return
+	}
 
-	srcImage, err := r.Loader.Load(imgUrl, req.Context())
+	animation, _ := getQueryParam(req.URL, "animation")
+	if len(animation) > 0 && animation != "on" && animation != "off" {
+		http.Error(resp, "animation query param must be one of 'on', 'off'", http.StatusBadRequest)
+		return
+	}
+
+	maxFrames, err := r.getMaxFrames(req)
+	if err != nil {
+		r.sendError(resp, err)
+		return
+	}
+	download, err := getDownload(req)
 	if err != nil {
-		sendError(resp, err)
+		r.sendError(resp, err)
 		return
 	}
 
-	Log.Printf("Source image [%s] loaded successfully, adding to the queue\n", imgUrl)
+	depth := 0
+	if param, _ := getQueryParam(req.URL, "depth"); len(param) > 0 {
+		if param != "8" {
+			http.Error(resp, "depth query param must be 8", http.StatusBadRequest)
+			return
+		}
+		depth = 8
+	}
+
+	maxBytes, err := r.getMaxBytes(req)
+	if err != nil {
+		r.sendError(resp, err)
+		return
+	}
+	// Plans are JSON documents, so they are not limited
+	if maxBytes > 0 && len(opName) > 0 {
+		transformation = fitToBytes(transformation, maxBytes, r.log())
+	}
+
+	var debug *Debug
+	if r.Debug {
+		enabled, err := getBoolQueryParam(req.URL, "debug")
+		if err != nil {
+			http.Error(resp, "can't parse debug param", http.StatusBadRequest)
+			return
+		}
+		if enabled {
+			debug = &Debug{}
+		}
+	}
+	// Decisions of the processor are cheap to collect, so they are logged if the request turns out slow
+	hideDebug := false
+	if r.SlowLog != nil && debug == nil {
+		debug, hideDebug = &Debug{}, true
+	}
+
+	r.log().Printf("[%s]: Transforming image %s using config %+v\n", req.URL.String(), imgUrl, config)
+
+	vary = append(vary, saveDataVary...)
+	if serviceConfig.NetworkHints {
+		vary = append(vary, "ECT", "Downlink")
+		mergeHeader(resp.Header(), "Accept-CH", []string{"ECT", "Downlink"})
+	}
+	mergeHeader(resp.Header(), "Vary", vary)
+
+	if saveData.Mode == SaveDataHide {
+		r.servePlaceholder(resp)
+		return
+	}
+
+	// Plans are served to bots as usual
+	if botMode == BotOriginal && len(opName) > 0 {
+		r.log().Printf("[%s]: Serving source image to bot\n", imgUrl)
+		r.serveAsIs(resp, req, imgUrl)
+		return
+	}
+
+	supportedFormats, avifMinSavings := r.applyAvifPolicy(opName, r.supportedFormats(req))
+
+	// Variants depend only on query params and dppx, so other reduced images are not cached
+	var variant string
+	if r.Variants != nil && r.ScaleByDppx && !widthHint && (opName == "resize" || opName == "fit") &&
+		saveData.Mode == SaveDataOff && botMode == BotOff {
+		variant = variantKey(req, opName, imgUrl)
+	}
+
+	var srcImage *Image
+	if len(variant) > 0 && dppx < HighDensityDppx {
+		srcImage, err = r.loadVariant(req, imgUrl, variant)
+		if err != nil {
+			r.sendError(resp, err)
+			return
+		}
+		if srcImage != nil {
+			r.log().Printf("[%s]: Deriving image from the high density variant\n", imgUrl)
+			// Already applied to the variant
+			trimBorder, enhance, replaceColors, fuzz = false, "", nil, 0
+		}
+	}
+	if srcImage == nil {
+		srcImage, err = r.load(req, imgUrl)
+		if err != nil {
+			r.sendError(resp, err)
+			return
+		}
+	}
+	// Sources that opted out of caching are not cached as variants either
+	if len(variant) > 0 && dppx >= HighDensityDppx && !(serviceConfig.OriginOptOut && privateSource(srcImage)) {
+		transformation = r.Variants.storeVariant(variant, transformation)
+	}
+
+	if r.MemoryBudget != nil {
+		memory := EstimateMemory(srcImage)
+		err = r.MemoryBudget.Acquire(req.Context(), memory)
+		if err != nil {
+			srcImage.Release()
+			r.log().Printf("[%s] Could not reserve [%d] bytes of memory: %s\n", imgUrl, memory, err)
+			r.sendError(resp, err)
+			return
+		}
+		defer r.MemoryBudget.Release(memory)
+	}
+
+	r.log().Printf("Source image [%s] loaded successfully, adding to the queue\n", imgUrl)
 
 	r.execOp(&Command{
+		Op:             opName,
 		Transformation: transformation,
 		Config: &TransformationConfig{
 			Src:              srcImage,
 			SupportedFormats: supportedFormats,
-			Quality:          getQuality(saveDataHeader, saveDataParam, dppx),
+			Quality:          getQuality(saveData.Mode, dppx, isSlowNetwork(req.Header, serviceConfig)),
+			Dppx:             dppx,
+			MaxSize:          saveData.MaxSize,
+			Scale:            saveData.Scale,
 			TrimBorder:       trimBorder,
+			WideGamut:        wideGamut,
+			ReplaceColors:    replaceColors,
+			Fuzz:             fuzz,
+			Enhance:          enhance == "auto",
+			Static:           animation == "off",
+			Depth:            depth,
+			MaxFrames:        maxFrames,
+			AvifMinSavings:   avifMinSavings,
 			Config:           config,
+			Debug:            debug,
 		},
-		Resp: resp,
+		Download:   download,
+		Req:        req,
+		Resp:       resp,
+		ReceivedAt: receivedAt,
+		hideDebug:  hideDebug,
 	})
 }
 
-func getQuality(saveDataHeader string, saveDataParam string, dppx float64) Quality {
-	if dppx >= 2.0 {
+func getQuality(saveData SaveDataMode, dppx float64, slowNetwork bool) Quality {
+	if dppx >= HighDensityDppx {
 		return LOWER
 	}
 
-	if SaveDataEnabled && saveDataHeader == "on" && saveDataParam != "off" {
+	if saveData == SaveDataReduce {
+		return LOW
+	}
+
+	if slowNetwork {
 		return LOW
 	}
 
 	return DEFAULT
 }
 
-func sendError(resp http.ResponseWriter, err error) {
+// saveData returns the decision of SaveData policy for the request.
+func (r *Service) saveData(req *http.Request) (*SaveData, []string, error) {
+	if r.SaveData == nil {
+		return &SaveData{}, nil, nil
+	}
+	saveData, vary, err := r.SaveData.SaveData(req)
 	if err != nil {
-		var httpErr *HttpError
-		if errors.As(err, &httpErr) {
-			http.Error(resp, httpErr.Error(), httpErr.Code())
-		} else {
-			http.Error(resp, fmt.Sprintf("Error reading image: '%s'", err.Error()), http.StatusInternalServerError)
+		return nil, nil, err
+	}
+	if saveData.Mode != SaveDataReduce {
+		// Limits are only applied to reduced images
+		return &SaveData{Mode: saveData.Mode}, vary, nil
+	}
+	return saveData, vary, nil
+}
+
+// getMaxFrames returns the limit of frames of animations from max-frames query param or
+// the default one from the config. The param could only lower the default limit.
+func (r *Service) getMaxFrames(req *http.Request) (int, error) {
+	maxFrames := r.config().MaxFrames
+	param, _ := getQueryParam(req.URL, "max-frames")
+	if len(param) == 0 {
+		return maxFrames, nil
+	}
+	frames, err := strconv.Atoi(param)
+	if err != nil || frames <= 0 {
+		return 0, NewHttpError(http.StatusBadRequest, "max-frames query param must be a positive number")
+	}
+	if maxFrames > 0 && frames > maxFrames {
+		return maxFrames, nil
+	}
+	return frames, nil
+}
+
+// isSlowNetwork returns true if ECT or Downlink client hints report slow network.
+func isSlowNetwork(header http.Header, config *ServiceConfig) bool {
+	if !config.NetworkHints {
+		return false
+	}
+
+	switch strings.ToLower(header.Get("ECT")) {
+	case "slow-2g", "2g", "3g":
+		return true
+	}
+
+	if downlinkHeader := header.Get("Downlink"); config.SlowDownlink > 0 && len(downlinkHeader) > 0 {
+		downlink, err := strconv.ParseFloat(downlinkHeader, 64)
+		if err == nil && downlink >= 0 && downlink < config.SlowDownlink {
+			return true
 		}
 	}
+
+	return false
+}
+
+func (r *Service) sendError(resp http.ResponseWriter, err error) {
+	if err != nil {
+		setProblemCode(resp, err)
+		msg, code := errorResponse(err)
+		if msg != err.Error() {
+			r.log().Errorf("Error processing request: %s", err)
+		}
+		http.Error(resp, msg, code)
+	}
+}
+
+// errorResponse returns the message and the status code of the error response. Messages of
+// HttpError are sent as is, but details of wrapped errors, e.g. stderr of CommandError, are
+// replaced with the message of the category, e.g. ErrEncodeFailed, so they are not leaked to clients.
+func errorResponse(err error) (string, int) {
+	var httpErr *HttpError
+	if errors.As(err, &httpErr) {
+		return httpErr.Error(), httpErr.Code()
+	}
+	return http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError
 }
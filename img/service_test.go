@@ -10,7 +10,11 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
 	"testing"
+	"time"
 )
 
 const (
@@ -24,6 +28,14 @@ const (
 	ImgLowQualityOut   = "12"
 	ImgLowerQualityOut = "1"
 	ImgBorderTrimmed   = "777"
+	ImgWideGamut       = "888"
+	ImgEnhanced        = "999"
+	ImgStatic          = "666"
+	ImgCorrupted       = "000"
+	ImgPngSignature    = "\x89PNG\r\n\x1a\n"
+	ImgLowRes          = "55"
+	ImgUpscaled        = "444"
+	Img8Bit            = "88"
 
 	EmptyGifBase64Out = "R0lGODlhAQABAAAAACH5BAEKAAEALAAAAAABAAEAAAICTAEAOw=="
 )
@@ -33,10 +45,13 @@ type resizerMock struct {
 }
 
 func (r *resizerMock) Resize(config *img.TransformationConfig) (*img.Image, error) {
+	if string(config.Src.Data) == ImgCorrupted {
+		return nil, img.NewHttpError(http.StatusUnsupportedMediaType, "source image is not supported or corrupted")
+	}
 	if !r.fuzzTests {
 		data := config.Src.Data
 		size := config.Config.(*img.ResizeConfig).Size
-		if (string(data) != ImgSrc && string(data) != NoContentTypeImgSrc) || size != "300x200" {
+		if (string(data) != ImgSrc && string(data) != NoContentTypeImgSrc) || (size != "300x200" && size != "300") {
 			return nil, errors.New("resize_error")
 		}
 	}
@@ -45,6 +60,9 @@ func (r *resizerMock) Resize(config *img.TransformationConfig) (*img.Image, erro
 }
 
 func (r *resizerMock) FitToSize(config *img.TransformationConfig) (*img.Image, error) {
+	if string(config.Src.Data) == ImgCorrupted {
+		return nil, img.NewHttpError(http.StatusUnsupportedMediaType, "source image is not supported or corrupted")
+	}
 	data := config.Src.Data
 	size := config.Config.(*img.ResizeConfig).Size
 	if (string(data) != ImgSrc && string(data) != NoContentTypeImgSrc) || size != "300x200" {
@@ -55,6 +73,9 @@ func (r *resizerMock) FitToSize(config *img.TransformationConfig) (*img.Image, e
 }
 
 func (r *resizerMock) Optimise(config *img.TransformationConfig) (*img.Image, error) {
+	if string(config.Src.Data) == ImgCorrupted {
+		return nil, img.NewHttpError(http.StatusUnsupportedMediaType, "source image is not supported or corrupted")
+	}
 	data := config.Src.Data
 
 	if string(data) != ImgSrc && string(data) != NoContentTypeImgSrc {
@@ -64,6 +85,103 @@ func (r *resizerMock) Optimise(config *img.TransformationConfig) (*img.Image, er
 	return r.resultImage(config), nil
 }
 
+func (r *resizerMock) Plan(op string, config *img.TransformationConfig) (*img.Debug, error) {
+	if string(config.Src.Data) == ImgCorrupted {
+		return nil, img.NewHttpError(http.StatusUnsupportedMediaType, "source image is not supported or corrupted")
+	}
+	target := &img.Info{Width: 600, Height: 400}
+	if config.Config != nil {
+		target = &img.Info{Width: 300, Height: 200}
+	}
+	source := &img.Info{Format: "PNG", Width: 600, Height: 400}
+	if config.Static || config.MaxFrames > 0 {
+		source.Frames = 10
+	}
+	return &img.Debug{
+		Source:   source,
+		Target:   target,
+		MimeType: "image/webp",
+		Quality:  80,
+		Args:     []string{"-", op, "webp:-"},
+	}, nil
+}
+
+func (r *resizerMock) Montage(config *img.TransformationConfig) (*img.Image, error) {
+	montageConfig := config.Config.(*img.MontageConfig)
+	data := ""
+	for _, image := range montageConfig.Images {
+		data += string(image.Data)
+	}
+	width, height := montageConfig.Size()
+	return &img.Image{
+		Data:     []byte(data),
+		MimeType: "image/jpeg",
+		Width:    width,
+		Height:   height,
+	}, nil
+}
+
+func (r *resizerMock) Card(config *img.TransformationConfig) (*img.Image, error) {
+	cardConfig := config.Config.(*img.CardConfig)
+	data := cardConfig.Title + "|" + cardConfig.Author
+	for _, image := range []*img.Image{cardConfig.Background, cardConfig.Logo} {
+		data += "|"
+		if image != nil {
+			data += string(image.Data)
+		}
+	}
+	return &img.Image{
+		Data:     []byte(data),
+		MimeType: "image/jpeg",
+		Width:    cardConfig.Template.Width,
+		Height:   cardConfig.Template.Height,
+	}, nil
+}
+
+func (r *resizerMock) Tile(config *img.TransformationConfig) (*img.Image, error) {
+	tileConfig := config.Config.(*img.TileConfig)
+	return &img.Image{
+		Data: []byte(fmt.Sprintf("%d,%d,%d,%d %dx%d %s", tileConfig.X, tileConfig.Y, tileConfig.Width, tileConfig.Height,
+			tileConfig.TargetWidth, tileConfig.TargetHeight, tileConfig.Format)),
+		MimeType: "image/jpeg",
+		Width:    tileConfig.TargetWidth,
+		Height:   tileConfig.TargetHeight,
+	}, nil
+}
+
+func (r *resizerMock) LoadImageInfo(src *img.Image) (*img.Info, error) {
+	if string(src.Data) == NoContentTypeImgSrc {
+		return &img.Info{Width: 30, Height: 10}, nil
+	}
+	return &img.Info{Width: 10, Height: 20}, nil
+}
+
+func (r *resizerMock) LoadExif(src *img.Image) (map[string]string, error) {
+	if string(src.Data) == NoContentTypeImgSrc {
+		return map[string]string{}, nil
+	}
+	return map[string]string{
+		"Make":            "Canon",
+		"Model":           "Canon EOS 5D",
+		"ExposureTime":    "1/125",
+		"FNumber":         "28/10",
+		"GPSLatitude":     "51/1, 30/1, 0/1",
+		"GPSLatitudeRef":  "N",
+		"GPSLongitude":    "0/1, 7/1, 30/1",
+		"GPSLongitudeRef": "W",
+	}, nil
+}
+
+func (r *resizerMock) Sprite(config *img.TransformationConfig) (*img.Image, error) {
+	spriteConfig := config.Config.(*img.SpriteConfig)
+	return &img.Image{
+		Data:     []byte(ImgPngOut),
+		MimeType: "image/png",
+		Width:    spriteConfig.Width,
+		Height:   spriteConfig.Height,
+	}, nil
+}
+
 func (r *resizerMock) supports(supportedFormats []string, format string) bool {
 	supports := false
 	for _, f := range supportedFormats {
@@ -75,26 +193,96 @@ func (r *resizerMock) supports(supportedFormats []string, format string) bool {
 	return supports
 }
 
+func (r *resizerMock) Upscale(config *img.TransformationConfig) (*img.Image, error) {
+	if string(config.Src.Data) != ImgSrc || config.Config.(*img.ResizeConfig).Size != "1200" {
+		return nil, errors.New("upscale_error")
+	}
+	return &img.Image{
+		Data:     []byte(ImgUpscaled),
+		MimeType: "image/png",
+	}, nil
+}
+
+func (r *resizerMock) Transcode(config *img.TransformationConfig) (*img.Image, error) {
+	if r.supports(config.SupportedFormats, "image/webp") {
+		return &img.Image{
+			Data:     []byte(ImgWebpOut),
+			MimeType: "image/webp",
+		}, nil
+	}
+	return &img.Image{
+		Data:     config.Src.Data,
+		MimeType: config.Src.MimeType,
+	}, nil
+}
+
 func (r *resizerMock) resultImage(config *img.TransformationConfig) *img.Image {
+	if config.Debug != nil {
+		config.Debug.Source = &img.Info{Format: "PNG", Width: 600, Height: 400}
+		config.Debug.Target = &img.Info{Width: 300, Height: 200}
+		config.Debug.Quality = 80
+		config.Debug.Args = []string{"-", "-resize", "300", "-quality", "80", "png:-"}
+	}
+
 	if config.TrimBorder {
 		return &img.Image{
 			Data: []byte(ImgBorderTrimmed),
 		}
 	}
 
+	if config.WideGamut {
+		return &img.Image{
+			Data: []byte(ImgWideGamut),
+		}
+	}
+
+	if config.Enhance {
+		return &img.Image{
+			Data: []byte(ImgEnhanced),
+		}
+	}
+
+	if config.Static {
+		return &img.Image{
+			Data: []byte(ImgStatic),
+		}
+	}
+
+	if config.Depth == 8 {
+		return &img.Image{
+			Data: []byte(Img8Bit),
+		}
+	}
+
+	if len(config.ReplaceColors) > 0 {
+		var colors []string
+		for _, c := range config.ReplaceColors {
+			colors = append(colors, c.From+":"+c.To)
+		}
+		return &img.Image{
+			Data: []byte(fmt.Sprintf("%s fuzz=%g", strings.Join(colors, ","), config.Fuzz)),
+		}
+	}
+
 	if string(config.Src.Data) == NoContentTypeImgSrc {
 		return &img.Image{
 			Data: []byte(NoContentTypeImgOut),
 		}
 	}
 
+	if config.Quality == img.LOW && config.Scale == img.DefaultLowResScale {
+		return &img.Image{
+			Data: []byte(ImgLowRes),
+		}
+	}
+
 	if config.Quality == img.LOW {
 		return &img.Image{
 			Data: []byte(ImgLowQualityOut),
 		}
 	}
 
-	if config.Quality == img.LOWER {
+	if config.Quality == img.LOWER && config.Dppx >= img.HighDensityDppx {
 		return &img.Image{
 			Data: []byte(ImgLowerQualityOut),
 		}
@@ -117,6 +305,9 @@ func (r *resizerMock) resultImage(config *img.TransformationConfig) *img.Image {
 	return &img.Image{
 		Data:     []byte(ImgPngOut),
 		MimeType: "image/png",
+		Width:    300,
+		Height:   200,
+		Frames:   1,
 	}
 }
 
@@ -137,6 +328,27 @@ func (l *loaderMock) Load(url string, _ context.Context) (*img.Image, error) {
 			Id:       url,
 		}, nil
 	}
+	if url == "http://site.com/corrupted.png" {
+		return &img.Image{
+			Data:     []byte(ImgCorrupted),
+			MimeType: "image/png",
+			Id:       url,
+		}, nil
+	}
+	if url == "http://site.com/real.png" {
+		return &img.Image{
+			Data:     []byte(ImgPngSignature),
+			MimeType: "text/html",
+			Id:       url,
+		}, nil
+	}
+	if url == "http://site.com/error_page.png" {
+		return &img.Image{
+			Data:     []byte("<html><body>Not Found</body></html>"),
+			MimeType: "image/png",
+			Id:       url,
+		}, nil
+	}
 	if url == "http://site.com/custom_error.png" {
 		return nil, img.NewHttpError(http.StatusTeapot, "Uh oh :(")
 	}
@@ -225,6 +437,38 @@ func TestService_Transforms(t *testing.T) {
 						)
 					},
 				},
+				{
+					Description: "AVIF Support in separate Accept header line",
+					Request: &http.Request{
+						Method: "GET",
+						URL:    parseUrl(fmt.Sprintf("http://localhost/img/http%%3A%%2F%%2Fsite.com/img.png%s", tt.urlSuffix), t),
+						Header: map[string][]string{
+							"Accept": {"image/png, image/webp", "Image/AVIF;q=0.9, image/webp"},
+						},
+					},
+					Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+						test.Error(t,
+							test.Equal(ImgAvifOut, w.Body.String(), "Resulted image"),
+							test.Equal("image/avif", w.Header().Get("Content-Type"), "Content-Type header"),
+						)
+					},
+				},
+				{
+					Description: "AVIF is not acceptable",
+					Request: &http.Request{
+						Method: "GET",
+						URL:    parseUrl(fmt.Sprintf("http://localhost/img/http%%3A%%2F%%2Fsite.com/img.png%s", tt.urlSuffix), t),
+						Header: map[string][]string{
+							"Accept": {"image/webp, image/avif; q=0"},
+						},
+					},
+					Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+						test.Error(t,
+							test.Equal(ImgWebpOut, w.Body.String(), "Resulted image"),
+							test.Equal("image/webp", w.Header().Get("Content-Type"), "Content-Type header"),
+						)
+					},
+				},
 				{
 					Description: "Save-Data: on",
 					Request: &http.Request{
@@ -273,6 +517,21 @@ func TestService_Transforms(t *testing.T) {
 						)
 					},
 				},
+				{
+					Description: "?save-data=low-res",
+					Request: &http.Request{
+						Method: "GET",
+						URL:    parseUrl(fmt.Sprintf("http://localhost/img/http%%3A%%2F%%2Fsite.com/img.png%s&save-data=low-res", tt.urlSuffix), t),
+						Header: map[string][]string{
+							"Save-Data": {"on"},
+						},
+					},
+					Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+						test.Error(t,
+							test.Equal(ImgLowRes, w.Body.String(), "Resulted image"),
+						)
+					},
+				},
 				{
 					Description: "Invalid save-data param",
 					Request: &http.Request{
@@ -318,6 +577,14 @@ func TestService_Transforms(t *testing.T) {
 					},
 					ExpectedCode: http.StatusBadRequest,
 				},
+				{
+					Description: "Negative dppx",
+					Request: &http.Request{
+						Method: "GET",
+						URL:    parseUrl(fmt.Sprintf("http://localhost/img/http%%3A%%2F%%2Fsite.com/img.png%s&dppx=-1", tt.urlSuffix), t),
+					},
+					ExpectedCode: http.StatusBadRequest,
+				},
 				{
 					Description: "MIME Sniffing",
 					Request: &http.Request{
@@ -338,6 +605,7 @@ func TestService_Transforms(t *testing.T) {
 						Header: map[string][]string{
 							"X-Forwarded-Proto": {"http"},
 						},
+						RemoteAddr: "127.0.0.1:1234",
 					},
 					Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
 						test.Error(t,
@@ -372,6 +640,23 @@ func TestService_Transforms(t *testing.T) {
 						)
 					},
 				},
+				{
+					Description: "Wide Gamut",
+					Request: &http.Request{
+						Method: "GET",
+						URL:    parseUrl(fmt.Sprintf("http://localhost/img/http%%3A%%2F%%2Fsite.com/img.png%s&wide-gamut=true", tt.urlSuffix), t),
+					},
+					Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+						test.Error(t,
+							test.Equal(ImgWideGamut, w.Body.String(), "Resulted image"),
+						)
+					},
+				},
+				{
+					Url:          fmt.Sprintf("http://localhost/img/http%%3A%%2F%%2Fsite.com/corrupted.png%s", tt.urlSuffix),
+					ExpectedCode: http.StatusUnsupportedMediaType,
+					Description:  "Unsupported source image",
+				},
 				{
 					Url:          fmt.Sprintf("http://localhost/img/http%%3A%%2F%%2Flocalhost/img/NO_SUCH_IMAGE%s", tt.urlSuffix),
 					ExpectedCode: http.StatusInternalServerError,
@@ -390,8 +675,6 @@ func TestService_Transforms(t *testing.T) {
 }
 
 func TestService_Transforms_SaveDataDisabled(t *testing.T) {
-	img.SaveDataEnabled = false
-
 	tests := []*transformTest{
 		{
 			name:      "Resize",
@@ -409,7 +692,9 @@ func TestService_Transforms_SaveDataDisabled(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			test.Service = createService(t).GetRouter().ServeHTTP
+			s := createService(t)
+			s.SaveData = img.OffSaveDataPolicy{}
+			test.Service = s.GetRouter().ServeHTTP
 			test.T = t
 
 			testCases := []test.TestCase{
@@ -469,8 +754,6 @@ func TestService_Transforms_SaveDataDisabled(t *testing.T) {
 			test.RunRequests(testCases)
 		})
 	}
-
-	img.SaveDataEnabled = true
 }
 
 func TestService_ResizeUrl(t *testing.T) {
@@ -508,6 +791,31 @@ func TestService_ResizeUrl(t *testing.T) {
 			ExpectedCode: http.StatusBadRequest,
 			Description:  "Resize error",
 		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/resize?size=x",
+			ExpectedCode: http.StatusBadRequest,
+			Description:  "No dimensions",
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/resize?size=0x0",
+			ExpectedCode: http.StatusBadRequest,
+			Description:  "Zero dimensions",
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/resize?size=300x0",
+			ExpectedCode: http.StatusBadRequest,
+			Description:  "Zero height",
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/resize?size=10001",
+			ExpectedCode: http.StatusBadRequest,
+			Description:  "Width is more than max dimension",
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/resize?size=x99999999999999999999",
+			ExpectedCode: http.StatusBadRequest,
+			Description:  "Height overflow",
+		},
 	}
 
 	test.RunRequests(testCases)
@@ -538,6 +846,26 @@ func TestService_FitToSizeUrl(t *testing.T) {
 			ExpectedCode: http.StatusBadRequest,
 			Description:  "2 - Size param should be in format WxH",
 		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/fit?size=300x",
+			ExpectedCode: http.StatusBadRequest,
+			Description:  "Height is required",
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/fit?size=x",
+			ExpectedCode: http.StatusBadRequest,
+			Description:  "No dimensions",
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/fit?size=0x200",
+			ExpectedCode: http.StatusBadRequest,
+			Description:  "Zero width",
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/fit?size=300x20000",
+			ExpectedCode: http.StatusBadRequest,
+			Description:  "Height is more than max dimension",
+		},
 	}
 
 	test.RunRequests(testCases)
@@ -553,104 +881,1336 @@ func TestService_TrimBorder(t *testing.T) {
 			ExpectedCode: http.StatusBadRequest,
 			Description:  "trim-border param value is invalid",
 		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/fit?size=50x50&wide-gamut=abc",
+			ExpectedCode: http.StatusBadRequest,
+			Description:  "wide-gamut param value is invalid",
+		},
 	}
 
 	test.RunRequests(testCases)
 }
 
-func TestService_AsIs(t *testing.T) {
+func TestService_ReplaceColor(t *testing.T) {
 	test.Service = createService(t).GetRouter().ServeHTTP
 	test.T = t
 
 	testCases := []test.TestCase{
 		{
-			Description: "Success",
-			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/asis",
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise?replace-color=ff0000:00FF00,fff:000&fuzz=10.5",
+			Description: "Colors are replaced",
 			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
 				test.Error(t,
-					test.Equal("public, max-age=86400", w.Header().Get("Cache-Control"), "Cache-Control header"),
-					test.Equal("3", w.Header().Get("Content-Length"), "Content-Length header"),
-					test.Equal("image/png", w.Header().Get("Content-Type"), "Content-Type header"),
-					test.Equal("", w.Header().Get("Vary"), "No Vary header"),
+					test.Equal("ff0000:00FF00,fff:000 fuzz=10.5", w.Body.String(), "Resulted image"),
 				)
 			},
 		},
 		{
-			Request: &http.Request{
-				Method: "GET",
-				URL:    parseUrl("http://localhost/img/%2F%2Fsite.com/img.png/asis", t),
-				Header: map[string][]string{
-					"X-Forwarded-Proto": {"http"},
-				},
-			},
-			Description: "Using protocol from X-Forwarded-Proto header to load source image",
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/resize?size=300&replace-color=ff0000:00ff00",
+			Description: "Fuzz is zero by default",
 			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
 				test.Error(t,
-					test.Equal("public, max-age=86400", w.Header().Get("Cache-Control"), "Cache-Control header"),
-					test.Equal("3", w.Header().Get("Content-Length"), "Content-Length header"),
+					test.Equal("ff0000:00ff00 fuzz=0", w.Body.String(), "Resulted image"),
 				)
 			},
 		},
 		{
-			Url:          "http://localhost/img/NO_SUCH_IMAGE/asis",
-			ExpectedCode: http.StatusInternalServerError,
-			Description:  "Read error",
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise?replace-color=red:00ff00",
+			ExpectedCode: http.StatusBadRequest,
+			Description:  "Color is not hex",
 		},
 		{
-			Url:          "http://localhost/img//asis",
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise?replace-color=ff0000",
 			ExpectedCode: http.StatusBadRequest,
-			Description:  "Source image URL is required",
+			Description:  "Target color is missing",
 		},
 		{
-			Url:          fmt.Sprintf("http://localhost/img/http%%3A%%2F%%2Fsite.com/custom_error.png/asis"),
-			ExpectedCode: http.StatusTeapot,
-			Description:  "Uh oh :(",
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise?replace-color=ff0000:00ff00&fuzz=101",
+			ExpectedCode: http.StatusBadRequest,
+			Description:  "Fuzz is more than 100",
 		},
 	}
 
 	test.RunRequests(testCases)
 }
 
-func FuzzService_ResizeUrl(f *testing.F) {
-	f.Add("300x200", "image/png, image/webp, image/avif", 3.0, true, "")
-	f.Add("300", "image/png, image/webp", 4.2, false, "off")
-	f.Add("x200", "image/png", 4.2, false, "hide")
-
-	img.CacheTTL = 86400
-	srv, _ := img.NewService(&loaderMock{}, &resizerMock{fuzzTests: true}, 1)
-	s := srv.GetRouter().ServeHTTP
-
-	f.Fuzz(func(t *testing.T, size string, acceptFormats string, dppx float64, saveDataHeaderEnabled bool, saveDataParam string) {
-		test.T = t
-		headers := make(map[string][]string, 0)
-		if saveDataHeaderEnabled {
-			headers["Save-Data"] = []string{"On"}
-		}
-		headers["Accept"] = []string{acceptFormats}
+func TestService_Enhance(t *testing.T) {
+	test.Service = createService(t).GetRouter().ServeHTTP
+	test.T = t
 
-		urlStr := fmt.Sprintf("http://localhost/img/http%%3A%%2F%%2Fsite.com/img.png/resize?size=%s&dppx=%f&save-data=%s", size, dppx, saveDataParam)
-		u, _ := url.Parse(urlStr)
+	testCases := []test.TestCase{
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/resize?size=300&enhance=auto",
+			Description: "Image is enhanced",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal(ImgEnhanced, w.Body.String(), "Resulted image"),
+				)
+			},
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise?enhance=max",
+			ExpectedCode: http.StatusBadRequest,
+			Description:  "Unknown enhance value",
+		},
+	}
 
-		if u != nil {
-			req := &http.Request{
-				Method: "GET",
-				URL:    u,
-				Header: headers,
-			}
+	test.RunRequests(testCases)
+}
 
-			resp := httptest.NewRecorder()
-			s(resp, req)
+func TestService_Animation(t *testing.T) {
+	test.Service = createService(t).GetRouter().ServeHTTP
+	test.T = t
 
-			statusCode := resp.Result().StatusCode
-			switch {
-			case statusCode >= http.StatusInternalServerError:
-				t.Errorf("should not respond with 5xx errors, url: [%s] [%v]", urlStr, saveDataHeaderEnabled)
-			case statusCode == http.StatusOK:
-				contentType := resp.Header().Get("content-type")
-				if contentType != "image/png" && contentType != "image/webp" && contentType != "image/avif" && contentType != "text/plain; charset=utf-8" {
-					t.Errorf("unexpected Content-Type [%s] for URL [%s]", contentType, urlStr)
-				}
-			case statusCode == http.StatusBadRequest:
+	testCases := []test.TestCase{
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/resize?size=300&animation=off",
+			Description: "First frame of the animation",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal(ImgStatic, w.Body.String(), "Resulted image"),
+				)
+			},
+		},
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise?animation=on",
+			Description: "Animation is kept",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal(ImgPngOut, w.Body.String(), "Resulted image"),
+				)
+			},
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise?animation=false",
+			ExpectedCode: http.StatusBadRequest,
+			Description:  "Unknown animation value",
+		},
+	}
+
+	test.RunRequests(testCases)
+}
+
+func TestService_Depth(t *testing.T) {
+	test.Service = createService(t).GetRouter().ServeHTTP
+	test.T = t
+
+	testCases := []test.TestCase{
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/resize?size=300&depth=8",
+			Description: "8-bit output",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal(Img8Bit, w.Body.String(), "Resulted image"),
+				)
+			},
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise?depth=16",
+			ExpectedCode: http.StatusBadRequest,
+			Description:  "Unsupported depth",
+		},
+	}
+
+	test.RunRequests(testCases)
+}
+
+func TestService_AsIs(t *testing.T) {
+	test.Service = createService(t).GetRouter().ServeHTTP
+	test.T = t
+
+	testCases := []test.TestCase{
+		{
+			Description: "Success",
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/asis",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal("public, max-age=86400", w.Header().Get("Cache-Control"), "Cache-Control header"),
+					test.Equal("3", w.Header().Get("Content-Length"), "Content-Length header"),
+					test.Equal("image/png", w.Header().Get("Content-Type"), "Content-Type header"),
+					test.Equal("", w.Header().Get("Vary"), "No Vary header"),
+				)
+			},
+		},
+		{
+			Request: &http.Request{
+				Method: "GET",
+				URL:    parseUrl("http://localhost/img/%2F%2Fsite.com/img.png/asis", t),
+				Header: map[string][]string{
+					"X-Forwarded-Proto": {"http"},
+				},
+				RemoteAddr: "127.0.0.1:1234",
+			},
+			Description: "Using protocol from X-Forwarded-Proto header to load source image",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal("public, max-age=86400", w.Header().Get("Cache-Control"), "Cache-Control header"),
+					test.Equal("3", w.Header().Get("Content-Length"), "Content-Length header"),
+				)
+			},
+		},
+		{
+			Url:          "http://localhost/img/NO_SUCH_IMAGE/asis",
+			ExpectedCode: http.StatusInternalServerError,
+			Description:  "Read error",
+		},
+		{
+			Url:          "http://localhost/img//asis",
+			ExpectedCode: http.StatusBadRequest,
+			Description:  "Source image URL is required",
+		},
+		{
+			Url:          fmt.Sprintf("http://localhost/img/http%%3A%%2F%%2Fsite.com/custom_error.png/asis"),
+			ExpectedCode: http.StatusTeapot,
+			Description:  "Uh oh :(",
+		},
+	}
+
+	test.RunRequests(testCases)
+}
+
+func TestService_AsIs_FormatAuto(t *testing.T) {
+	test.Service = createService(t).GetRouter().ServeHTTP
+	test.T = t
+
+	testCases := []test.TestCase{
+		{
+			Request: &http.Request{
+				Method: "GET",
+				URL:    parseUrl("http://localhost/img/http%3A%2F%2Fsite.com/img.png/asis?format=auto", t),
+				Header: map[string][]string{
+					"Accept": {"image/webp"},
+				},
+			},
+			Description: "Converted to WebP",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal(ImgWebpOut, w.Body.String(), "Resulted image"),
+					test.Equal("image/webp", w.Header().Get("Content-Type"), "Content-Type header"),
+					test.Equal("Accept, Save-Data", w.Header().Get("Vary"), "Vary header"),
+				)
+			},
+		},
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/asis?format=auto",
+			Description: "Modern formats are not supported",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal(ImgSrc, w.Body.String(), "Resulted image"),
+					test.Equal("image/png", w.Header().Get("Content-Type"), "Content-Type header"),
+				)
+			},
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/asis?format=webp",
+			ExpectedCode: http.StatusBadRequest,
+			Description:  "Invalid format",
+		},
+	}
+
+	test.RunRequests(testCases)
+
+	s, err := img.NewService(&loaderMock{}, &processorOnly{&resizerMock{}}, 1)
+	if err != nil {
+		t.Fatalf("Error while creating service: %+v", err)
+	}
+	test.Service = s.GetRouter().ServeHTTP
+	test.RunRequests([]test.TestCase{
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/asis?format=auto",
+			ExpectedCode: http.StatusNotImplemented,
+			Description:  "Processor is not a transcoder",
+		},
+	})
+}
+
+func TestService_MemoryBudget(t *testing.T) {
+	srv := createService(t)
+	srv.MemoryBudget, _ = img.NewMemoryBudget(int64(len(ImgSrc))*img.UnknownFormatRatio-1, 0)
+	test.Service = srv.GetRouter().ServeHTTP
+	test.T = t
+
+	testCases := []test.TestCase{
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise",
+			ExpectedCode: http.StatusRequestEntityTooLarge,
+			Description:  "Image is bigger than memory budget",
+		},
+	}
+
+	test.RunRequests(testCases)
+
+	srv.MemoryBudget, _ = img.NewMemoryBudget(int64(len(ImgSrc))*img.UnknownFormatRatio, 0)
+
+	testCases = []test.TestCase{
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise",
+			Description: "Image fits into memory budget",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal(ImgPngOut, w.Body.String(), "Resulted image"),
+					test.Equal(int64(0), srv.MemoryBudget.Used(), "Memory released"),
+				)
+			},
+		},
+	}
+
+	test.RunRequests(testCases)
+}
+
+func TestService_ServerTiming(t *testing.T) {
+	srv := createService(t)
+	srv.ServerTiming = true
+	test.Service = srv.GetRouter().ServeHTTP
+	test.T = t
+
+	testCases := []test.TestCase{
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise",
+			Description: "Server-Timing header",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				if !regexp.MustCompile(`^queue;dur=[\d.]+, transform;dur=[\d.]+$`).MatchString(w.Header().Get("Server-Timing")) {
+					t.Errorf("unexpected Server-Timing header [%s]", w.Header().Get("Server-Timing"))
+				}
+			},
+		},
+	}
+
+	test.RunRequests(testCases)
+}
+
+func TestService_ProcessedBy(t *testing.T) {
+	srv := createService(t)
+	test.Service = srv.GetRouter().ServeHTTP
+	test.T = t
+
+	test.RunRequests([]test.TestCase{
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise",
+			Description: "Disabled by default",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t, test.Equal("", w.Header().Get("X-Processed-By"), "X-Processed-By header"))
+			},
+		},
+	})
+
+	srv.ProcessedBy = "web-1"
+	test.RunRequests([]test.TestCase{
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise",
+			Description: "X-Processed-By header",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				if !regexp.MustCompile(`^web-1; class=optimise; worker=\d+; queue=[\d.]+; transform=[\d.]+$`).MatchString(w.Header().Get("X-Processed-By")) {
+					t.Errorf("unexpected X-Processed-By header [%s]", w.Header().Get("X-Processed-By"))
+				}
+			},
+		},
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/asis",
+			Description: "Commands without transformation",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				if !strings.HasPrefix(w.Header().Get("X-Processed-By"), "web-1; class=asis; worker=") {
+					t.Errorf("unexpected X-Processed-By header [%s]", w.Header().Get("X-Processed-By"))
+				}
+			},
+		},
+	})
+}
+
+func TestService_ImageSize(t *testing.T) {
+	test.Service = createService(t).GetRouter().ServeHTTP
+	test.T = t
+
+	testCases := []test.TestCase{
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/resize?size=300",
+			Description: "Image size headers",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal("300", w.Header().Get("X-Image-Width"), "X-Image-Width header"),
+					test.Equal("200", w.Header().Get("X-Image-Height"), "X-Image-Height header"),
+					test.Equal("1", w.Header().Get("X-Frames"), "X-Frames header"),
+					test.Equal("false", w.Header().Get("X-Animated"), "X-Animated header"),
+				)
+			},
+		},
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/fit?size=300x200&trim-border=true",
+			Description: "No image size headers when size is unknown",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal("", w.Header().Get("X-Image-Width"), "X-Image-Width header"),
+					test.Equal("", w.Header().Get("X-Image-Height"), "X-Image-Height header"),
+				)
+			},
+		},
+	}
+
+	test.RunRequests(testCases)
+}
+
+func TestService_Debug(t *testing.T) {
+	srv := createService(t)
+	srv.Debug = true
+	test.Service = srv.GetRouter().ServeHTTP
+	test.T = t
+
+	testCases := []test.TestCase{
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/resize?size=300&debug",
+			Description: "Debug headers",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal("PNG 600x400 quality=0 size=3", w.Header().Get("X-Debug-Source"), "X-Debug-Source header"),
+					test.Equal("PNG 300x200 quality=80", w.Header().Get("X-Debug-Target"), "X-Debug-Target header"),
+					test.Equal("- -resize 300 -quality 80 png:-", w.Header().Get("X-Debug-Args"), "X-Debug-Args header"),
+					test.Equal("false", w.Header().Get("X-Debug-Original"), "X-Debug-Original header"),
+				)
+			},
+		},
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/resize?size=300",
+			Description: "No debug headers without debug param",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal("", w.Header().Get("X-Debug-Args"), "X-Debug-Args header"),
+				)
+			},
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/resize?size=300&debug=abc",
+			Description:  "debug param value is invalid",
+			ExpectedCode: http.StatusBadRequest,
+		},
+	}
+
+	test.RunRequests(testCases)
+
+	srv.Debug = false
+	test.RunRequests([]test.TestCase{
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/resize?size=300&debug",
+			Description: "Debug param is ignored when debug is disabled",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal("", w.Header().Get("X-Debug-Args"), "X-Debug-Args header"),
+				)
+			},
+		},
+	})
+}
+
+func TestService_PlanUrl(t *testing.T) {
+	test.Service = createService(t).GetRouter().ServeHTTP
+	test.T = t
+
+	testCases := []test.TestCase{
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/plan?size=300",
+			Description: "Resize plan",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal("application/json", w.Header().Get("Content-Type"), "Content-Type header"),
+					test.Equal(`{"op":"resize","source":{"format":"PNG","width":600,"height":400,"size":3},"target":{"format":"image/webp","width":300,"height":200,"quality":80,"size":0},"args":["-","resize","webp:-"]}`+"\n",
+						w.Body.String(), "Plan"),
+				)
+			},
+		},
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/plan",
+			Description: "Optimise plan",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal(`{"op":"optimise","source":{"format":"PNG","width":600,"height":400,"size":3},"target":{"format":"image/webp","width":600,"height":400,"quality":80,"size":3},"args":["-","optimise","webp:-"]}`+"\n",
+						w.Body.String(), "Plan"),
+				)
+			},
+		},
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/plan?animation=off",
+			Description: "Plan of animated image",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal(`{"op":"optimise","source":{"format":"PNG","width":600,"height":400,"size":3,"frames":10,"animated":true},"target":{"format":"image/webp","width":600,"height":400,"quality":80,"size":3,"frames":1},"args":["-","optimise","webp:-"]}`+"\n",
+						w.Body.String(), "Plan"),
+				)
+			},
+		},
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/plan?max-frames=4",
+			Description: "Plan of sampled animation",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal(`{"op":"optimise","source":{"format":"PNG","width":600,"height":400,"size":3,"frames":10,"animated":true},"target":{"format":"image/webp","width":600,"height":400,"quality":80,"size":3,"frames":4,"animated":true},"args":["-","optimise","webp:-"]}`+"\n",
+						w.Body.String(), "Plan"),
+				)
+			},
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/plan?max-frames=0",
+			Description:  "Invalid max-frames",
+			ExpectedCode: http.StatusBadRequest,
+		},
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/plan?op=fit&size=300x200",
+			Description: "Fit plan",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				if !strings.HasPrefix(w.Body.String(), `{"op":"fit",`) {
+					t.Errorf("expected fit plan, but got %s", w.Body.String())
+				}
+			},
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/plan?op=fit&size=300",
+			Description:  "Fit plan without height",
+			ExpectedCode: http.StatusBadRequest,
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/plan?op=resize",
+			Description:  "Resize plan without size",
+			ExpectedCode: http.StatusBadRequest,
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/plan?op=crop",
+			Description:  "Unknown operation",
+			ExpectedCode: http.StatusBadRequest,
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/corrupted.png/plan",
+			Description:  "Corrupted source",
+			ExpectedCode: http.StatusUnsupportedMediaType,
+		},
+	}
+
+	test.RunRequests(testCases)
+}
+
+func TestService_MaxFrames(t *testing.T) {
+	s, err := img.NewServiceWithConfig(&loaderMock{}, &resizerMock{}, 1, &img.ServiceConfig{MaxFrames: 2})
+	if err != nil {
+		t.Fatalf("could not create service: %s", err)
+	}
+	test.Service = s.GetRouter().ServeHTTP
+	test.T = t
+
+	expectFrames := func(expected string) func(w *httptest.ResponseRecorder, t *testing.T) {
+		return func(w *httptest.ResponseRecorder, t *testing.T) {
+			if !strings.Contains(w.Body.String(), expected) {
+				t.Errorf("expected target with %s, but got %s", expected, w.Body.String())
+			}
+		}
+	}
+
+	test.RunRequests([]test.TestCase{
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/plan",
+			Description: "Default limit",
+			Handler:     expectFrames(`"size":3,"frames":2,"animated":true}`),
+		},
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/plan?max-frames=5",
+			Description: "Param could not raise the limit",
+			Handler:     expectFrames(`"size":3,"frames":2,"animated":true}`),
+		},
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/plan?max-frames=1",
+			Description: "Param lowers the limit",
+			Handler:     expectFrames(`"size":3,"frames":1}`),
+		},
+	})
+}
+
+func TestService_PlanUrl_NotSupported(t *testing.T) {
+	s, err := img.NewService(&loaderMock{}, img.NewCircuitBreaker(&processorOnly{&resizerMock{}}, 1, time.Second), 1)
+	if err != nil {
+		t.Fatalf("Error while creating service: %+v", err)
+	}
+	test.Service = s.GetRouter().ServeHTTP
+	test.T = t
+
+	test.RunRequests([]test.TestCase{
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/plan",
+			Description:  "Processor is not a planner",
+			ExpectedCode: http.StatusNotImplemented,
+		},
+	})
+}
+
+// processorOnly hides methods of the processor that are not in img.Processor
+type processorOnly struct {
+	img.Processor
+}
+
+func TestService_Savings(t *testing.T) {
+	srv := createService(t)
+	srv.Savings = img.NewSavings()
+	test.Service = srv.GetRouter().ServeHTTP
+	test.T = t
+
+	test.RunRequests([]test.TestCase{
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/resize?size=300",
+			Description: "Resize is counted",
+		},
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/plan",
+			Description: "Plan is not counted",
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/corrupted.png/optimise",
+			Description:  "Errors are not counted",
+			ExpectedCode: http.StatusUnsupportedMediaType,
+		},
+	})
+
+	expected := []img.SavingsStats{
+		{Op: "resize", Format: "image/png", Count: 1, InputBytes: int64(len(ImgSrc)), OutputBytes: int64(len(ImgPngOut))},
+	}
+	if stats := srv.Savings.Stats(); !reflect.DeepEqual(stats, expected) {
+		t.Errorf("expected stats %+v, but got %+v", expected, stats)
+	}
+}
+
+func TestService_MontageUrl(t *testing.T) {
+	test.Service = createService(t).GetRouter().ServeHTTP
+	test.T = t
+
+	src := "src=http%3A%2F%2Fsite.com%2Fimg.png&src=http%3A%2F%2Fsite.com%2Fimg2.png&src=http%3A%2F%2Fsite.com%2Fimg.png"
+	testCases := []test.TestCase{
+		{
+			Url:         "http://localhost/montage?size=100x50&" + src,
+			Description: "Default columns",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal(ImgSrc+NoContentTypeImgSrc+ImgSrc, w.Body.String(), "Resulted image"),
+					test.Equal("image/jpeg", w.Header().Get("Content-Type"), "Content-Type header"),
+					test.Equal("Accept", w.Header().Get("Vary"), "Vary header"),
+					test.Equal("200", w.Header().Get("X-Image-Width"), "X-Image-Width header"),
+					test.Equal("100", w.Header().Get("X-Image-Height"), "X-Image-Height header"),
+				)
+			},
+		},
+		{
+			Url:         "http://localhost/montage?size=100x50&cols=3&gap=10&" + src,
+			Description: "Columns and gap",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal("320", w.Header().Get("X-Image-Width"), "X-Image-Width header"),
+					test.Equal("50", w.Header().Get("X-Image-Height"), "X-Image-Height header"),
+				)
+			},
+		},
+		{
+			Url:          "http://localhost/montage?size=100x50",
+			Description:  "No sources",
+			ExpectedCode: http.StatusBadRequest,
+		},
+		{
+			Url:          "http://localhost/montage?size=100&" + src,
+			Description:  "Cell size without height",
+			ExpectedCode: http.StatusBadRequest,
+		},
+		{
+			Url:          "http://localhost/montage?size=100x50&cols=0&" + src,
+			Description:  "Invalid columns",
+			ExpectedCode: http.StatusBadRequest,
+		},
+		{
+			Url:          "http://localhost/montage?size=100x50&gap=-1&" + src,
+			Description:  "Invalid gap",
+			ExpectedCode: http.StatusBadRequest,
+		},
+		{
+			Url:          "http://localhost/montage?size=5000x50&cols=3&" + src,
+			Description:  "Montage is too big",
+			ExpectedCode: http.StatusBadRequest,
+		},
+		{
+			Url:          "http://localhost/montage?size=100x50&src=http%3A%2F%2Fsite.com%2Fimg.png&src=http%3A%2F%2Fsite.com%2Fcustom_error.png",
+			Description:  "Source could not be loaded",
+			ExpectedCode: http.StatusTeapot,
+		},
+	}
+
+	test.RunRequests(testCases)
+}
+
+func TestService_CardUrl(t *testing.T) {
+	s := createService(t)
+	s.CardTemplates = img.CardTemplates{
+		"article": {
+			Width:  1200,
+			Height: 630,
+			Title:  &img.CardText{CardBox: img.CardBox{Width: 1000, Height: 200}},
+			Logo:   &img.CardImage{CardBox: img.CardBox{Width: 100, Height: 100}, Src: "http://site.com/img2.png"},
+		},
+	}
+	test.Service = s.GetRouter().ServeHTTP
+	test.T = t
+
+	testCases := []test.TestCase{
+		{
+			Url:         "http://localhost/card/article?title=Hello%0AWorld&author=John&bg=http%3A%2F%2Fsite.com%2Fimg.png",
+			Description: "Card with background and default logo",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal("Hello World|John|"+ImgSrc+"|"+NoContentTypeImgSrc, w.Body.String(), "Resulted image"),
+					test.Equal("image/jpeg", w.Header().Get("Content-Type"), "Content-Type header"),
+					test.Equal("1200", w.Header().Get("X-Image-Width"), "X-Image-Width header"),
+					test.Equal("630", w.Header().Get("X-Image-Height"), "X-Image-Height header"),
+				)
+			},
+		},
+		{
+			Url:         "http://localhost/card/article?title=Hello&logo=http%3A%2F%2Fsite.com%2Fimg.png",
+			Description: "Card with logo from request",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal("Hello|||"+ImgSrc, w.Body.String(), "Resulted image"),
+				)
+			},
+		},
+		{
+			Url:          "http://localhost/card/unknown?title=Hello",
+			Description:  "Unknown template",
+			ExpectedCode: http.StatusNotFound,
+		},
+		{
+			Url:          "http://localhost/card/article?title=" + strings.Repeat("a", img.MaxCardTextLength+1),
+			Description:  "Title is too long",
+			ExpectedCode: http.StatusBadRequest,
+		},
+	}
+
+	test.RunRequests(testCases)
+}
+
+func TestService_Dialects(t *testing.T) {
+	s := createService(t)
+	s.Dialects = map[string]img.Dialect{"cloudinary": img.KnownDialects["cloudinary"]}
+	test.Service = s.GetRouter().ServeHTTP
+	test.T = t
+
+	testCases := []test.TestCase{
+		{
+			Request: &http.Request{
+				Method: "GET",
+				URL:    parseUrl("http://localhost/cloudinary/demo/image/fetch/w_300,h_200,c_fill/http://site.com/img.png", t),
+				Header: map[string][]string{
+					"Accept": {"image/png"},
+				},
+			},
+			Description: "Fill is translated to fit",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal(ImgPngOut, w.Body.String(), "Resulted image"),
+					test.Equal("image/png", w.Header().Get("Content-Type"), "Content-Type header"),
+				)
+			},
+		},
+		{
+			Url:          "http://localhost/cloudinary/demo/image/fetch/w_300,a_90/http://site.com/img.png",
+			Description:  "Unsupported transformation",
+			ExpectedCode: http.StatusBadRequest,
+		},
+		{
+			Url:          "http://localhost/imgproxy/insecure/rs:fill:300:200/plain/http://site.com/img.png",
+			Description:  "Dialect is not enabled",
+			ExpectedCode: http.StatusNotFound,
+		},
+	}
+
+	test.RunRequests(testCases)
+
+	s.DisabledRoutes = map[string]bool{"fit": true}
+	test.Service = s.GetRouter().ServeHTTP
+	test.RunRequests([]test.TestCase{
+		{
+			Url:          "http://localhost/cloudinary/demo/image/fetch/w_300,h_200,c_fill/http://site.com/img.png",
+			Description:  "Disabled operation",
+			ExpectedCode: http.StatusNotFound,
+		},
+		{
+			Url:         "http://localhost/cloudinary/demo/image/fetch/w_300/http://site.com/img.png",
+			Description: "Enabled operation",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal(ImgPngOut, w.Body.String(), "Resulted image"),
+				)
+			},
+		},
+	})
+}
+
+// queryLoader records URLs of loaded images and loads them without the query.
+type queryLoader struct {
+	loaderMock
+	urls []string
+}
+
+func (l *queryLoader) Load(url string, ctx context.Context) (*img.Image, error) {
+	l.urls = append(l.urls, url)
+	path, _, _ := strings.Cut(url, "?")
+	return l.loaderMock.Load(path, ctx)
+}
+
+func TestService_DialectSourceQuery(t *testing.T) {
+	loader := &queryLoader{}
+	s, err := img.NewService(loader, &resizerMock{}, 1)
+	if err != nil {
+		t.Fatalf("could not create service: %s", err)
+	}
+	s.Dialects = map[string]img.Dialect{"cloudinary": img.KnownDialects["cloudinary"]}
+	s.Signer = &img.UrlSigner{Keys: [][]byte{[]byte("secret")}}
+	test.Service = s.GetRouter().ServeHTTP
+	test.T = t
+
+	test.RunRequests([]test.TestCase{
+		{
+			Url:         "http://localhost" + s.Signer.SignUrl("/cloudinary/demo/image/fetch/w_300/http://site.com/img.png?v=1&b=2"),
+			Description: "Query of the source",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal(ImgPngOut, w.Body.String(), "Resulted image"),
+					test.Equal("http://site.com/img.png?v=1&b=2", strings.Join(loader.urls, ","), "Source URL"),
+				)
+			},
+		},
+	})
+}
+
+func TestService_ExifUrl(t *testing.T) {
+	s := createService(t)
+	test.Service = s.GetRouter().ServeHTTP
+	test.T = t
+
+	testCases := []test.TestCase{
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com%2Fimg.png/exif",
+			Description: "GPS is redacted",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal("application/json", w.Header().Get("Content-Type"), "Content-Type header"),
+					test.Equal(`{"camera":{"make":"Canon","model":"Canon EOS 5D"},"exposure":{"exposureTime":"1/125","fNumber":2.8},"gpsRedacted":true}`+"\n",
+						w.Body.String(), "EXIF"),
+				)
+			},
+		},
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com%2Fimg2.png/exif",
+			Description: "Image without EXIF",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal("{}\n", w.Body.String(), "EXIF"),
+				)
+			},
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com%2Fcustom_error.png/exif",
+			Description:  "Loader error",
+			ExpectedCode: http.StatusTeapot,
+		},
+	}
+
+	test.RunRequests(testCases)
+
+	s.ExifGPS = true
+	test.Service = s.GetRouter().ServeHTTP
+	test.RunRequests([]test.TestCase{
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com%2Fimg.png/exif",
+			Description: "GPS is returned",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal(`{"camera":{"make":"Canon","model":"Canon EOS 5D"},"exposure":{"exposureTime":"1/125","fNumber":2.8},"gps":{"latitude":51.5,"longitude":-0.125}}`+"\n",
+						w.Body.String(), "EXIF"),
+				)
+			},
+		},
+	})
+}
+
+func TestService_Tiles(t *testing.T) {
+	test.Service = createService(t).GetRouter().ServeHTTP
+	test.T = t
+
+	testCases := []test.TestCase{
+		{
+			Url:         "http://localhost/dzi/http%3A%2F%2Fsite.com%2Fimg.png.dzi",
+			Description: "Deep Zoom descriptor",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal("application/xml", w.Header().Get("Content-Type"), "Content-Type header"),
+					test.Equal(`<?xml version="1.0" encoding="UTF-8"?>
+<Image xmlns="http://schemas.microsoft.com/deepzoom/2008" Format="jpg" Overlap="1" TileSize="512">
+  <Size Width="10" Height="20"/>
+</Image>
+`, w.Body.String(), "Descriptor"),
+				)
+			},
+		},
+		{
+			Url:          "http://localhost/dzi/http%3A%2F%2Fsite.com%2Fimg.png.dzi?format=gif",
+			Description:  "Unsupported Deep Zoom format",
+			ExpectedCode: http.StatusBadRequest,
+		},
+		{
+			Url:         "http://localhost/dzi/http%3A%2F%2Fsite.com%2Fimg.png_files/4/0_0.png",
+			Description: "Deep Zoom tile",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal("0,0,10,20 5x10 png", w.Body.String(), "Tile"),
+				)
+			},
+		},
+		{
+			Url:          "http://localhost/dzi/http%3A%2F%2Fsite.com%2Fimg.png_files/4/1_0.png",
+			Description:  "Deep Zoom tile outside of the image",
+			ExpectedCode: http.StatusNotFound,
+		},
+		{
+			Request: &http.Request{
+				Method: "GET",
+				Host:   "localhost",
+				URL:    parseUrl("http://localhost/iiif/http%3A%2F%2Fsite.com%2Fimg.png/info.json", t),
+				Header: map[string][]string{
+					"X-Forwarded-Proto": {"https"},
+				},
+				RemoteAddr: "127.0.0.1:1234",
+			},
+			Description: "IIIF info.json",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal(`{"@context":"http://iiif.io/api/image/3/context.json","id":"https://localhost/iiif/http%3A%2F%2Fsite.com%2Fimg.png",`+
+						`"type":"ImageService3","protocol":"http://iiif.io/api/image","profile":"level1","width":10,"height":20,`+
+						`"maxWidth":10000,"maxHeight":10000,"tiles":[{"width":512,"scaleFactors":[1]}],"extraFormats":["png","webp"],`+
+						`"extraQualities":["color","gray"],"extraFeatures":["regionByPct","regionSquare","sizeByConfinedWh","sizeByPct","sizeUpscaling","rotationBy90s"]}`+"\n",
+						w.Body.String(), "info.json"),
+				)
+			},
+		},
+		{
+			Url:         "http://localhost/iiif/http%3A%2F%2Fsite.com%2Fimg.png/0,10,10,10/5,/0/default.webp",
+			Description: "IIIF image",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal("0,10,10,10 5x5 webp", w.Body.String(), "Tile"),
+					test.Equal("5", w.Header().Get("X-Image-Width"), "X-Image-Width header"),
+				)
+			},
+		},
+		{
+			Url:          "http://localhost/iiif/http%3A%2F%2Fsite.com%2Fimg.png/full/max/45/default.jpg",
+			Description:  "IIIF rotation is not supported",
+			ExpectedCode: http.StatusNotImplemented,
+		},
+		{
+			Url:          "http://localhost/iiif/http%3A%2F%2Fsite.com%2Fimg.png/20,0,10,10/max/0/default.jpg",
+			Description:  "IIIF region is outside of the image",
+			ExpectedCode: http.StatusBadRequest,
+		},
+	}
+
+	test.RunRequests(testCases)
+}
+
+func TestService_TilesMemoryBudget(t *testing.T) {
+	srv := createService(t)
+	memory := img.EstimateMemory(&img.Image{Data: []byte(ImgSrc)})
+	srv.MemoryBudget, _ = img.NewMemoryBudget(memory-1, 0)
+	test.Service = srv.GetRouter().ServeHTTP
+	test.T = t
+
+	tiles := []string{
+		"http://localhost/dzi/http%3A%2F%2Fsite.com%2Fimg.png_files/4/0_0.png",
+		"http://localhost/iiif/http%3A%2F%2Fsite.com%2Fimg.png/0,10,10,10/5,/0/default.webp",
+	}
+	var testCases []test.TestCase
+	for _, url := range tiles {
+		testCases = append(testCases, test.TestCase{
+			Url:          url,
+			ExpectedCode: http.StatusRequestEntityTooLarge,
+			Description:  "Image is bigger than memory budget",
+		})
+	}
+	test.RunRequests(testCases)
+
+	srv.MemoryBudget, _ = img.NewMemoryBudget(memory, 0)
+	_ = srv.MemoryBudget.Acquire(context.Background(), 1)
+	testCases = nil
+	for _, url := range tiles {
+		testCases = append(testCases, test.TestCase{
+			Url:          url,
+			ExpectedCode: http.StatusServiceUnavailable,
+			Description:  "Memory budget is exhausted",
+		})
+	}
+	test.RunRequests(testCases)
+
+	srv.MemoryBudget.Release(1)
+	testCases = nil
+	for _, url := range tiles {
+		testCases = append(testCases, test.TestCase{
+			Url:         url,
+			Description: "Image fits into memory budget",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal(int64(0), srv.MemoryBudget.Used(), "Memory released"),
+				)
+			},
+		})
+	}
+	test.RunRequests(testCases)
+}
+
+func TestService_CompositionMemoryBudget(t *testing.T) {
+	srv := createService(t)
+	srv.CardTemplates = img.CardTemplates{
+		"article": {
+			Width:  1200,
+			Height: 630,
+			Logo:   &img.CardImage{CardBox: img.CardBox{Width: 100, Height: 100}, Src: "http://site.com/img2.png"},
+		},
+	}
+	// Both compositions use img.png and img2.png
+	memory := img.EstimateMemory(&img.Image{Data: []byte(ImgSrc)}) + img.EstimateMemory(&img.Image{Data: []byte(NoContentTypeImgSrc)})
+	srv.MemoryBudget, _ = img.NewMemoryBudget(memory-1, 0)
+	test.Service = srv.GetRouter().ServeHTTP
+	test.T = t
+
+	urls := []string{
+		"http://localhost/card/article?bg=http%3A%2F%2Fsite.com%2Fimg.png",
+		"http://localhost/sprite?src=http%3A%2F%2Fsite.com%2Fimg.png&src=http%3A%2F%2Fsite.com%2Fimg2.png",
+	}
+	var testCases []test.TestCase
+	for _, url := range urls {
+		testCases = append(testCases, test.TestCase{
+			Url:          url,
+			ExpectedCode: http.StatusRequestEntityTooLarge,
+			Description:  "Images are bigger than memory budget",
+		})
+	}
+	test.RunRequests(testCases)
+
+	srv.MemoryBudget, _ = img.NewMemoryBudget(memory, 0)
+	testCases = nil
+	for _, url := range urls {
+		testCases = append(testCases, test.TestCase{
+			Url:         url,
+			Description: "Images fit into memory budget",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal(int64(0), srv.MemoryBudget.Used(), "Memory released"),
+				)
+			},
+		})
+	}
+	test.RunRequests(testCases)
+}
+
+func TestService_SpriteUrl(t *testing.T) {
+	test.Service = createService(t).GetRouter().ServeHTTP
+	test.T = t
+
+	src := "src=http%3A%2F%2Fsite.com%2Fimg.png&src=http%3A%2F%2Fsite.com%2Fimg2.png"
+	testCases := []test.TestCase{
+		{
+			Url:         "http://localhost/sprite?" + src,
+			Description: "Sprite sheet",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal(ImgPngOut, w.Body.String(), "Resulted image"),
+					test.Equal("30", w.Header().Get("X-Image-Width"), "X-Image-Width header"),
+					test.Equal("30", w.Header().Get("X-Image-Height"), "X-Image-Height header"),
+				)
+			},
+		},
+		{
+			Url:         "http://localhost/sprite?map=json&gap=2&" + src,
+			Description: "JSON map",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal("application/json", w.Header().Get("Content-Type"), "Content-Type header"),
+					test.Equal(`{"width":30,"height":32,"cells":[{"src":"http://site.com/img.png","x":0,"y":0,"width":10,"height":20},{"src":"http://site.com/img2.png","x":0,"y":22,"width":30,"height":10}]}`+"\n",
+						w.Body.String(), "Map"),
+				)
+			},
+		},
+		{
+			Url:         "http://localhost/sprite?map=css&" + src,
+			Description: "CSS map",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal("text/css", w.Header().Get("Content-Type"), "Content-Type header"),
+					test.Equal(`.sprite {
+  background-image: url("/sprite?src=http%3A%2F%2Fsite.com%2Fimg.png&src=http%3A%2F%2Fsite.com%2Fimg2.png");
+  background-repeat: no-repeat;
+}
+.sprite-0 {
+  background-position: 0 0;
+  width: 10px;
+  height: 20px;
+}
+.sprite-1 {
+  background-position: 0 -20px;
+  width: 30px;
+  height: 10px;
+}
+`, w.Body.String(), "Map"),
+				)
+			},
+		},
+		{
+			Url:          "http://localhost/sprite",
+			Description:  "No sources",
+			ExpectedCode: http.StatusBadRequest,
+		},
+		{
+			Url:          "http://localhost/sprite?map=xml&" + src,
+			Description:  "Invalid map format",
+			ExpectedCode: http.StatusBadRequest,
+		},
+		{
+			Url:          "http://localhost/sprite?gap=abc&" + src,
+			Description:  "Invalid gap",
+			ExpectedCode: http.StatusBadRequest,
+		},
+	}
+
+	test.RunRequests(testCases)
+}
+
+func TestService_SniffMimeType(t *testing.T) {
+	srv := createService(t)
+	srv.SniffMimeType = true
+	test.Service = srv.GetRouter().ServeHTTP
+	test.T = t
+
+	testCases := []test.TestCase{
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/real.png/asis",
+			Description: "Detected MIME type",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal("image/png", w.Header().Get("Content-Type"), "Content-Type header"),
+				)
+			},
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/error_page.png/asis",
+			Description:  "Not an image as is",
+			ExpectedCode: http.StatusUnsupportedMediaType,
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/error_page.png/optimise",
+			Description:  "Not an image",
+			ExpectedCode: http.StatusUnsupportedMediaType,
+		},
+	}
+
+	test.RunRequests(testCases)
+}
+
+func TestService_NetworkHints(t *testing.T) {
+	img.NetworkHintsEnabled = true
+	defer func() { img.NetworkHintsEnabled = false }()
+
+	test.Service = createService(t).GetRouter().ServeHTTP
+	test.T = t
+
+	request := func(header string, value string) *http.Request {
+		h := http.Header{}
+		h.Set(header, value)
+		return &http.Request{
+			Method: "GET",
+			URL:    parseUrl("http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise", t),
+			Header: h,
+		}
+	}
+	expectImage := func(expected string) func(w *httptest.ResponseRecorder, t *testing.T) {
+		return func(w *httptest.ResponseRecorder, t *testing.T) {
+			test.Error(t,
+				test.Equal(expected, w.Body.String(), "Resulted image"),
+				test.Equal("Accept, Save-Data, ECT, Downlink", w.Header().Get("Vary"), "Vary header"),
+				test.Equal("ECT, Downlink", w.Header().Get("Accept-CH"), "Accept-CH header"),
+			)
+		}
+	}
+
+	testCases := []test.TestCase{
+		{
+			Description: "ECT: 3g",
+			Request:     request("ECT", "3g"),
+			Handler:     expectImage(ImgLowQualityOut),
+		},
+		{
+			Description: "ECT: 4g",
+			Request:     request("ECT", "4g"),
+			Handler:     expectImage(ImgPngOut),
+		},
+		{
+			Description: "Slow downlink",
+			Request:     request("Downlink", "0.4"),
+			Handler:     expectImage(ImgLowQualityOut),
+		},
+		{
+			Description: "Fast downlink",
+			Request:     request("Downlink", "10"),
+			Handler:     expectImage(ImgPngOut),
+		},
+		{
+			Description: "Invalid downlink",
+			Request:     request("Downlink", "fast"),
+			Handler:     expectImage(ImgPngOut),
+		},
+	}
+
+	test.RunRequests(testCases)
+}
+
+func TestService_Vary(t *testing.T) {
+	test.Service = createService(t).GetRouter().ServeHTTP
+	test.T = t
+
+	request := func(url string, header string, value string) *http.Request {
+		h := http.Header{}
+		if len(header) > 0 {
+			h.Set(header, value)
+		}
+		return &http.Request{
+			Method: "GET",
+			URL:    parseUrl(url, t),
+			Header: h,
+		}
+	}
+	expect := func(vary string, image string) func(w *httptest.ResponseRecorder, t *testing.T) {
+		return func(w *httptest.ResponseRecorder, t *testing.T) {
+			test.Error(t,
+				test.Equal(vary, w.Header().Get("Vary"), "Vary header"),
+				test.Equal(image, w.Body.String(), "Resulted image"),
+			)
+		}
+	}
+
+	testCases := []test.TestCase{
+		{
+			Description: "save-data=off",
+			Request:     request("http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise?save-data=off", "", ""),
+			Handler:     expect("Accept", ImgPngOut),
+		},
+		{
+			Description: "DPR client hint",
+			Request:     request("http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise", "Sec-CH-DPR", "3"),
+			Handler:     expect("Accept, Sec-CH-DPR, Save-Data", ImgLowerQualityOut),
+		},
+		{
+			Description: "Legacy DPR client hint",
+			Request:     request("http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise", "DPR", "2"),
+			Handler:     expect("Accept, DPR, Save-Data", ImgLowerQualityOut),
+		},
+		{
+			Description: "Invalid DPR client hint",
+			Request:     request("http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise", "DPR", "abc"),
+			Handler:     expect("Accept, DPR, Save-Data", ImgPngOut),
+		},
+		{
+			Description: "dppx param takes precedence over DPR client hint",
+			Request:     request("http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise?dppx=1", "DPR", "3"),
+			Handler:     expect("Accept, Save-Data", ImgPngOut),
+		},
+		{
+			Description: "Width client hint",
+			Request:     request("http://localhost/img/http%3A%2F%2Fsite.com/img.png/resize", "Sec-CH-Width", "300"),
+			Handler:     expect("Accept, Sec-CH-Width, Save-Data", ImgPngOut),
+		},
+		{
+			Description: "size param takes precedence over Width client hint",
+			Request:     request("http://localhost/img/http%3A%2F%2Fsite.com/img.png/resize?size=300", "Width", "500"),
+			Handler:     expect("Accept, Save-Data", ImgPngOut),
+		},
+	}
+
+	test.RunRequests(testCases)
+}
+
+func TestService_ScaleByDppx(t *testing.T) {
+	srv := createService(t)
+	srv.ScaleByDppx = true
+	test.Service = srv.GetRouter().ServeHTTP
+	test.T = t
+
+	testCases := []test.TestCase{
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/resize?size=300x200",
+			Description:  "No dppx",
+			ExpectedCode: http.StatusOK,
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/resize?size=150x100&dppx=2",
+			Description:  "Size in CSS pixels",
+			ExpectedCode: http.StatusOK,
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/fit?size=75x50&dppx=100",
+			Description:  "dppx is clamped",
+			ExpectedCode: http.StatusOK,
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/resize?size=300x200&dppx=NaN",
+			Description:  "NaN dppx",
+			ExpectedCode: http.StatusBadRequest,
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/resize?size=300x200&dppx=Inf",
+			Description:  "Infinite dppx",
+			ExpectedCode: http.StatusBadRequest,
+		},
+	}
+
+	test.RunRequests(testCases)
+}
+
+func FuzzService_ResizeUrl(f *testing.F) {
+	f.Add("300x200", "image/png, image/webp, image/avif", 3.0, true, "")
+	f.Add("300", "image/png, image/webp", 4.2, false, "off")
+	f.Add("x200", "image/png", 4.2, false, "hide")
+
+	img.CacheTTL = 86400
+	srv, _ := img.NewService(&loaderMock{}, &resizerMock{fuzzTests: true}, 1)
+	s := srv.GetRouter().ServeHTTP
+
+	f.Fuzz(func(t *testing.T, size string, acceptFormats string, dppx float64, saveDataHeaderEnabled bool, saveDataParam string) {
+		test.T = t
+		headers := make(map[string][]string, 0)
+		if saveDataHeaderEnabled {
+			headers["Save-Data"] = []string{"On"}
+		}
+		headers["Accept"] = []string{acceptFormats}
+
+		urlStr := fmt.Sprintf("http://localhost/img/http%%3A%%2F%%2Fsite.com/img.png/resize?size=%s&dppx=%f&save-data=%s", size, dppx, saveDataParam)
+		u, _ := url.Parse(urlStr)
+
+		if u != nil {
+			req := &http.Request{
+				Method: "GET",
+				URL:    u,
+				Header: headers,
+			}
+
+			resp := httptest.NewRecorder()
+			s(resp, req)
+
+			statusCode := resp.Result().StatusCode
+			switch {
+			case statusCode >= http.StatusInternalServerError:
+				t.Errorf("should not respond with 5xx errors, url: [%s] [%v]", urlStr, saveDataHeaderEnabled)
+			case statusCode == http.StatusOK:
+				contentType := resp.Header().Get("content-type")
+				if contentType != "image/png" && contentType != "image/webp" && contentType != "image/avif" && contentType != "text/plain; charset=utf-8" {
+					t.Errorf("unexpected Content-Type [%s] for URL [%s]", contentType, urlStr)
+				}
+			case statusCode == http.StatusBadRequest:
 				t.Logf("Bad request for url: [%s]", urlStr)
 			default:
 				t.Errorf("unexpected response status [%d]", statusCode)
@@ -666,6 +2226,7 @@ func createService(t *testing.T) *img.Service {
 		t.Fatalf("Error while creating service: %+v", err)
 		return nil
 	}
+	s.Config.TrustedProxies, _ = img.ParseNetworks("127.0.0.1/32")
 	return s
 }
 
@@ -677,3 +2238,33 @@ func parseUrl(strUrl string, t *testing.T) *url.URL {
 	}
 	return u
 }
+
+func TestService_ErrorDetailsAreNotSent(t *testing.T) {
+	s := createService(t)
+	s.Processor = &stderrProcessor{resizerMock: &resizerMock{}}
+	test.Service = s.GetRouter().ServeHTTP
+	test.T = t
+
+	test.RunRequests([]test.TestCase{
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise",
+			Description:  "Stderr of the command",
+			ExpectedCode: http.StatusInternalServerError,
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal("image could not be encoded\n", w.Body.String(), "message of the category"),
+				)
+			},
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/resize?size=400",
+			Description:  "Error of the processor",
+			ExpectedCode: http.StatusInternalServerError,
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal("Internal Server Error\n", w.Body.String(), "status text"),
+				)
+			},
+		},
+	})
+}
@@ -0,0 +1,250 @@
+package img
+
+import (
+	"github.com/dooman87/glogi"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ShadowResult is the result of running the secondary processor for one transformation.
+type ShadowResult struct {
+	// Op is the name of the operation: "optimise", "resize" or "fit".
+	Op                string
+	Id                string
+	PrimarySize       int
+	SecondarySize     int
+	PrimaryDuration   time.Duration
+	SecondaryDuration time.Duration
+	// Similarity of secondary result to the primary one as returned by Shadow.Compare.
+	// Zero if images were not compared.
+	Similarity float64
+	Err        error
+}
+
+// ShadowStats holds aggregated results of the shadow processor.
+type ShadowStats struct {
+	// Samples is the number of transformations that were run by secondary processor.
+	Samples uint64
+	// Skipped is the number of sampled transformations that were skipped
+	// because too many secondary transformations were in flight.
+	Skipped uint64
+	Errors  uint64
+	// Bytes and durations are only counted for samples without errors.
+	PrimaryBytes      int64
+	SecondaryBytes    int64
+	PrimaryDuration   time.Duration
+	SecondaryDuration time.Duration
+	// Compared is the number of samples with calculated similarity.
+	Compared      uint64
+	SimilaritySum float64
+}
+
+// Shadow is the Processor that always serves results of the Primary processor and
+// runs the Secondary processor in the background on a sample of transformations.
+// Differences in size, latency and similarity are reported without
+// affecting responses. This allows to safely roll out a new processor or new
+// encoder options.
+type Shadow struct {
+	Primary   Processor
+	Secondary Processor
+	// SampleRate is the share of transformations that will also be run by
+	// the secondary processor, from 0 to 1.
+	SampleRate float64
+	// MaxInFlight is the maximum number of secondary transformations running
+	// in the background. Samples are skipped when the limit is reached. Defaults to 1.
+	MaxInFlight int
+	// Compare returns similarity of the secondary result to the primary one, e.g. SSIM.
+	// Optional.
+	Compare func(primary *Image, secondary *Image) (float64, error)
+	// Report is called for each sample. Logs the result by default.
+	Report func(r *ShadowResult)
+	// Log is the logger. Package Log is used if nil.
+	Log glogi.Logger
+
+	initOnce sync.Once
+	inFlight chan struct{}
+	mux      sync.Mutex
+	stats    ShadowStats
+	wg       sync.WaitGroup
+}
+
+func (s *Shadow) Resize(config *TransformationConfig) (*Image, error) {
+	return s.exec("resize", config, s.Primary.Resize, s.Secondary.Resize)
+}
+
+func (s *Shadow) FitToSize(config *TransformationConfig) (*Image, error) {
+	return s.exec("fit", config, s.Primary.FitToSize, s.Secondary.FitToSize)
+}
+
+func (s *Shadow) Optimise(config *TransformationConfig) (*Image, error) {
+	return s.exec("optimise", config, s.Primary.Optimise, s.Secondary.Optimise)
+}
+
+// Upscale delegates to the primary processor if it's an Upscaler.
+func (s *Shadow) Upscale(config *TransformationConfig) (*Image, error) {
+	return upscale(s.Primary, config)
+}
+
+// Transcode delegates to the primary processor if it's a Transcoder.
+func (s *Shadow) Transcode(config *TransformationConfig) (*Image, error) {
+	return transcode(s.Primary, config)
+}
+
+// Plan delegates to the primary processor if it's a Planner.
+func (s *Shadow) Plan(op string, config *TransformationConfig) (*Debug, error) {
+	return plan(s.Primary, op, config)
+}
+
+// Montage delegates to the primary processor if it's a Montager.
+func (s *Shadow) Montage(config *TransformationConfig) (*Image, error) {
+	return montage(s.Primary, config)
+}
+
+// LoadImageInfo delegates to the primary processor if it could identify images, e.g. it's a Spriter or Tiler.
+func (s *Shadow) LoadImageInfo(src *Image) (*Info, error) {
+	return loadImageInfo(s.Primary, src)
+}
+
+// Sprite delegates to the primary processor if it's a Spriter.
+func (s *Shadow) Sprite(config *TransformationConfig) (*Image, error) {
+	spriter, err := asSpriter(s.Primary)
+	if err != nil {
+		return nil, err
+	}
+	return spriter.Sprite(config)
+}
+
+// Ladder delegates to the primary processor if it's a Ladderer.
+func (s *Shadow) Ladder(config *TransformationConfig) ([]*Image, error) {
+	ladderer, err := asLadderer(s.Primary)
+	if err != nil {
+		return nil, err
+	}
+	return ladderer.Ladder(config)
+}
+
+// Card delegates to the primary processor if it's a CardRenderer.
+func (s *Shadow) Card(config *TransformationConfig) (*Image, error) {
+	return renderCard(s.Primary, config)
+}
+
+// Tile delegates to the primary processor if it's a Tiler.
+func (s *Shadow) Tile(config *TransformationConfig) (*Image, error) {
+	return tile(s.Primary, config)
+}
+
+// LoadExif delegates to the primary processor if it's a MetadataReader.
+func (s *Shadow) LoadExif(src *Image) (map[string]string, error) {
+	return loadExif(s.Primary, src)
+}
+
+// Stats returns aggregated results.
+func (s *Shadow) Stats() ShadowStats {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.stats
+}
+
+// Wait waits for all background transformations to finish.
+func (s *Shadow) Wait() {
+	s.wg.Wait()
+}
+
+func (s *Shadow) exec(op string, config *TransformationConfig, primary Cmd, secondary Cmd) (*Image, error) {
+	start := time.Now()
+	result, err := primary(config)
+	primaryDuration := time.Since(start)
+
+	if err != nil || s.SampleRate <= 0 || rand.Float64() >= s.SampleRate {
+		return result, err
+	}
+
+	s.initOnce.Do(func() {
+		maxInFlight := s.MaxInFlight
+		if maxInFlight <= 0 {
+			maxInFlight = 1
+		}
+		s.inFlight = make(chan struct{}, maxInFlight)
+	})
+
+	select {
+	case s.inFlight <- struct{}{}:
+	default:
+		s.mux.Lock()
+		s.stats.Skipped++
+		s.mux.Unlock()
+		return result, err
+	}
+
+	// Source and result buffers are released once the response is written,
+	// so the background transformation needs its own copies. Debug and span
+	// belong to the request and must not be touched after it's finished.
+	shadowConfig := *config
+	shadowConfig.Debug = nil
+	shadowConfig.Span = nil
+	shadowConfig.Src = &Image{
+		Id:       config.Src.Id,
+		Data:     append([]byte(nil), config.Src.Data...),
+		MimeType: config.Src.MimeType,
+	}
+	primaryResult := &Image{
+		Id:       result.Id,
+		Data:     append([]byte(nil), result.Data...),
+		MimeType: result.MimeType,
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer func() { <-s.inFlight }()
+		s.runSecondary(op, &shadowConfig, secondary, primaryResult, primaryDuration)
+	}()
+
+	return result, err
+}
+
+func (s *Shadow) runSecondary(op string, config *TransformationConfig, secondary Cmd, primaryResult *Image, primaryDuration time.Duration) {
+	r := &ShadowResult{
+		Op:              op,
+		Id:              config.Src.Id,
+		PrimarySize:     len(primaryResult.Data),
+		PrimaryDuration: primaryDuration,
+	}
+
+	start := time.Now()
+	secondaryResult, err := secondary(config)
+	r.SecondaryDuration = time.Since(start)
+	r.Err = err
+
+	if err == nil {
+		r.SecondarySize = len(secondaryResult.Data)
+		if s.Compare != nil {
+			r.Similarity, r.Err = s.Compare(primaryResult, secondaryResult)
+		}
+		secondaryResult.Release()
+	}
+
+	s.mux.Lock()
+	s.stats.Samples++
+	if r.Err != nil {
+		s.stats.Errors++
+	} else {
+		s.stats.PrimaryBytes += int64(r.PrimarySize)
+		s.stats.PrimaryDuration += r.PrimaryDuration
+		s.stats.SecondaryBytes += int64(r.SecondarySize)
+		s.stats.SecondaryDuration += r.SecondaryDuration
+		if s.Compare != nil {
+			s.stats.Compared++
+			s.stats.SimilaritySum += r.Similarity
+		}
+	}
+	s.mux.Unlock()
+
+	if s.Report != nil {
+		s.Report(r)
+	} else {
+		logOrDefault(s.Log).Printf("[%s] Shadow %s: size %d -> %d, time %s -> %s, similarity %.4f, error: %v\n",
+			r.Id, r.Op, r.PrimarySize, r.SecondarySize, r.PrimaryDuration, r.SecondaryDuration, r.Similarity, r.Err)
+	}
+}
@@ -0,0 +1,106 @@
+package img_test
+
+import (
+	"errors"
+	"github.com/Pixboost/transformimgs/v8/img"
+	"github.com/dooman87/kolibri/test"
+	"testing"
+)
+
+func TestShadow(t *testing.T) {
+	primary := &failingProcMock{}
+	secondary := &failingProcMock{}
+	var reports []*img.ShadowResult
+	shadow := &img.Shadow{
+		Primary:    primary,
+		Secondary:  secondary,
+		SampleRate: 1,
+		Compare: func(primary *img.Image, secondary *img.Image) (float64, error) {
+			return 0.5, nil
+		},
+		Report: func(r *img.ShadowResult) {
+			reports = append(reports, r)
+		},
+	}
+
+	config := circuitConfig()
+	result, err := shadow.Resize(config)
+	shadow.Wait()
+	_, _ = shadow.FitToSize(config)
+	shadow.Wait()
+	stats := shadow.Stats()
+
+	test.Error(t,
+		test.Nil(err, "error"),
+		test.Equal("processed", string(result.Data), "primary result"),
+		test.Equal(2, primary.calls, "primary calls"),
+		test.Equal(2, secondary.calls, "secondary calls"),
+		test.Equal(uint64(2), stats.Samples, "samples"),
+		test.Equal(int64(18), stats.SecondaryBytes, "secondary bytes"),
+		test.Equal(uint64(2), stats.Compared, "compared"),
+		test.Equal(1.0, stats.SimilaritySum, "similarity sum"),
+		test.Equal(2, len(reports), "reports"),
+		test.Equal("resize", reports[0].Op, "op"),
+		test.Equal("src", reports[0].Id, "id"),
+	)
+}
+
+func TestShadow_RequestState(t *testing.T) {
+	primary := &failingProcMock{}
+	secondary := &failingProcMock{}
+	shadow := &img.Shadow{
+		Primary:    primary,
+		Secondary:  secondary,
+		SampleRate: 1,
+	}
+
+	config := circuitConfig()
+	config.Debug = &img.Debug{}
+	config.Span = &img.Span{Name: "request"}
+	_, err := shadow.Optimise(config)
+	shadow.Wait()
+
+	test.Error(t,
+		test.Nil(err, "error"),
+		test.Equal(true, primary.config.Span == config.Span, "primary span"),
+		test.Equal(true, secondary.config.Debug == nil, "secondary debug"),
+		test.Equal(true, secondary.config.Span == nil, "secondary span"),
+	)
+}
+
+func TestShadow_SecondaryError(t *testing.T) {
+	primary := &failingProcMock{}
+	secondary := &failingProcMock{err: errors.New("secondary failed")}
+	shadow := &img.Shadow{
+		Primary:    primary,
+		Secondary:  secondary,
+		SampleRate: 1,
+	}
+
+	result, err := shadow.Optimise(circuitConfig())
+	shadow.Wait()
+
+	test.Error(t,
+		test.Nil(err, "error"),
+		test.Equal("processed", string(result.Data), "primary result"),
+		test.Equal(uint64(1), shadow.Stats().Errors, "errors"),
+		test.Equal(int64(0), shadow.Stats().PrimaryBytes, "primary bytes"),
+	)
+}
+
+func TestShadow_NotSampled(t *testing.T) {
+	primary := &failingProcMock{}
+	secondary := &failingProcMock{}
+	shadow := &img.Shadow{
+		Primary:   primary,
+		Secondary: secondary,
+	}
+
+	_, _ = shadow.Optimise(circuitConfig())
+	shadow.Wait()
+
+	test.Error(t,
+		test.Equal(1, primary.calls, "primary calls"),
+		test.Equal(0, secondary.calls, "secondary calls"),
+	)
+}
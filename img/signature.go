@@ -0,0 +1,102 @@
+package img
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strings"
+)
+
+// SignatureParam is the query param with the signature of the URL.
+const SignatureParam = "sig"
+
+// UrlSigner signs URLs of the service, so only URLs generated by the owner of the key are served
+// and the public deployment can't be used as a free resize proxy by third parties. The signature
+// is HMAC-SHA256 of the escaped path, which contains the source URL and the operation, and the
+// query params without SignatureParam in their order, e.g. "/img/https://site.com/img.png/resize?size=300".
+// It's encoded using URL-safe base64 without padding.
+type UrlSigner struct {
+	// Keys are secret keys of signatures. URLs are signed using the first key and signatures
+	// of all keys are valid, so keys could be rotated without breaking URLs in the wild.
+	Keys [][]byte
+}
+
+// ParseSigningKeys parses comma separated list of keys.
+func ParseSigningKeys(list string) [][]byte {
+	var keys [][]byte
+	for _, key := range strings.Split(list, ",") {
+		key = strings.TrimSpace(key)
+		if len(key) > 0 {
+			keys = append(keys, []byte(key))
+		}
+	}
+	return keys
+}
+
+// Sign returns the signature of the escaped path and the raw query of the URL.
+// SignatureParam is ignored if the query already has it.
+func (s *UrlSigner) Sign(path string, rawQuery string) string {
+	return s.sign(s.Keys[0], path, rawQuery)
+}
+
+// SignUrl returns the URL with the signature appended to the query params, e.g.
+// /img/https://site.com/img.png/resize?size=300&sig=... The URL must be escaped.
+func (s *UrlSigner) SignUrl(url string) string {
+	path, rawQuery, _ := strings.Cut(url, "?")
+	sig := s.Sign(path, rawQuery)
+	if query := withoutSignature(rawQuery); len(query) > 0 {
+		return path + "?" + query + "&" + SignatureParam + "=" + sig
+	}
+	return path + "?" + SignatureParam + "=" + sig
+}
+
+// Verify returns true if the request has the valid signature of one of the keys.
+func (s *UrlSigner) Verify(req *http.Request) bool {
+	sig, ok := getQueryParam(req.URL, SignatureParam)
+	if !ok || len(sig) == 0 {
+		return false
+	}
+	for _, key := range s.Keys {
+		if hmac.Equal([]byte(sig), []byte(s.sign(key, req.URL.EscapedPath(), req.URL.RawQuery))) {
+			return true
+		}
+	}
+	return false
+}
+
+// Handler returns the handler that responds with 403 to requests with missing or invalid
+// signature and passes other requests to the next handler.
+func (s *UrlSigner) Handler(next http.HandlerFunc) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		if !s.Verify(req) {
+			http.Error(resp, "missing or invalid signature", http.StatusForbidden)
+			return
+		}
+		next(resp, req)
+	}
+}
+
+func (s *UrlSigner) sign(key []byte, path string, rawQuery string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(path))
+	if query := withoutSignature(rawQuery); len(query) > 0 {
+		mac.Write([]byte("?" + query))
+	}
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// withoutSignature returns the raw query without SignatureParam keeping the order of other params.
+func withoutSignature(rawQuery string) string {
+	if len(rawQuery) == 0 {
+		return ""
+	}
+	params := strings.Split(rawQuery, "&")
+	kept := params[:0]
+	for _, p := range params {
+		if name, _, _ := strings.Cut(p, "="); name != SignatureParam {
+			kept = append(kept, p)
+		}
+	}
+	return strings.Join(kept, "&")
+}
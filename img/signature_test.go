@@ -0,0 +1,65 @@
+package img_test
+
+import (
+	"github.com/Pixboost/transformimgs/v8/img"
+	"github.com/dooman87/kolibri/test"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestUrlSigner_SignUrl(t *testing.T) {
+	signer := &img.UrlSigner{Keys: [][]byte{[]byte("secret")}}
+
+	signed := signer.SignUrl("/img/http://site.com/img.png/resize?size=300")
+	resigned := signer.SignUrl(signed)
+
+	test.Error(t,
+		test.Equal("/img/http://site.com/img.png/resize?size=300&sig="+signer.Sign("/img/http://site.com/img.png/resize", "size=300"), signed, "signed URL"),
+		test.Equal(signed, resigned, "URL signed twice"),
+		test.Equal(false, signer.Sign("/img/http://site.com/img.png/resize", "size=300") == signer.Sign("/img/http://site.com/img.png/resize", "size=301"), "params are signed"),
+		test.Equal(false, signer.Sign("/img/http://site.com/img.png/resize", "size=300") == signer.Sign("/img/http://site.com/img.png/fit", "size=300"), "operation is signed"),
+	)
+}
+
+func TestService_Signer(t *testing.T) {
+	s := createService(t)
+	s.Signer = &img.UrlSigner{Keys: [][]byte{[]byte("new"), []byte("old")}}
+	old := &img.UrlSigner{Keys: [][]byte{[]byte("old")}}
+	other := &img.UrlSigner{Keys: [][]byte{[]byte("other")}}
+	test.Service = s.Handler().ServeHTTP
+	test.T = t
+
+	testCases := []test.TestCase{
+		{
+			Url:         "http://localhost" + s.Signer.SignUrl("/img/http%3A%2F%2Fsite.com/img.png/resize?size=300"),
+			Description: "Signed URL",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal(ImgPngOut, w.Body.String(), "Resulted image"),
+				)
+			},
+		},
+		{
+			Url:         "http://localhost" + old.SignUrl("/img/http%3A%2F%2Fsite.com/img.png/resize?size=300"),
+			Description: "URL signed with the old key",
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/resize?size=300",
+			Description:  "Missing signature",
+			ExpectedCode: http.StatusForbidden,
+		},
+		{
+			Url:          "http://localhost" + other.SignUrl("/img/http%3A%2F%2Fsite.com/img.png/resize?size=300"),
+			Description:  "Signature of other key",
+			ExpectedCode: http.StatusForbidden,
+		},
+		{
+			Url:          "http://localhost" + s.Signer.SignUrl("/img/http%3A%2F%2Fsite.com/img.png/resize?size=300") + "&dppx=2",
+			Description:  "Param is added to the signed URL",
+			ExpectedCode: http.StatusForbidden,
+		},
+	}
+
+	test.RunRequests(testCases)
+}
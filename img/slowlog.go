@@ -0,0 +1,71 @@
+package img
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// SlowLog logs details of slow requests and a sample of other requests: timings of loading, waiting
+// in the queue, transformation and writing, the source and the target of the transformation and
+// ImageMagick arguments. It helps to diagnose tail latency without verbose logging of all requests.
+type SlowLog struct {
+	// Threshold is the duration of the request after which it's logged. Zero disables the threshold.
+	Threshold time.Duration
+	// SamplePercent is the percentage of requests that are logged regardless of their duration,
+	// e.g. 0.1. Zero disables sampling.
+	SamplePercent float64
+}
+
+// reason returns why the request with the given duration is logged or empty string if it's not logged.
+func (s *SlowLog) reason(duration time.Duration) string {
+	if s.Threshold > 0 && duration >= s.Threshold {
+		return "Slow"
+	}
+	if s.SamplePercent > 0 && rand.Float64()*100 < s.SamplePercent {
+		return "Sampled"
+	}
+	return ""
+}
+
+// logSlow logs details of the finished command if it's slow or sampled, see Service.SlowLog.
+func (r *Service) logSlow(op *Command) {
+	if r.SlowLog == nil {
+		return
+	}
+	received := op.ReceivedAt
+	if received.IsZero() {
+		received = op.QueuedAt
+	}
+	now := time.Now()
+	reason := r.SlowLog.reason(now.Sub(received))
+	if len(reason) == 0 {
+		return
+	}
+
+	var details strings.Builder
+	fmt.Fprintf(&details, "load=%s queue=%s transform=%s write=%s source=[%s %d bytes]",
+		op.QueuedAt.Sub(received), op.StartedAt.Sub(op.QueuedAt), op.FinishedAt.Sub(op.StartedAt),
+		now.Sub(op.FinishedAt), op.Config.Src.MimeType, len(op.Config.Src.Data))
+	if debug := op.Config.Debug; debug != nil {
+		if debug.Source != nil {
+			fmt.Fprintf(&details, " identify=[%s %dx%d quality=%d frames=%d]",
+				debug.Source.Format, debug.Source.Width, debug.Source.Height, debug.Source.Quality, debug.Source.Frames)
+		}
+		if debug.Target != nil {
+			fmt.Fprintf(&details, " target=[%s %dx%d quality=%d]",
+				debug.MimeType, debug.Target.Width, debug.Target.Height, debug.Quality)
+		}
+		if len(debug.Args) > 0 {
+			fmt.Fprintf(&details, " args=[%s]", strings.Join(debug.Args, " "))
+		}
+	}
+	if op.Err != nil {
+		fmt.Fprintf(&details, " error=[%s]", op.Err)
+	} else if op.Result != nil {
+		fmt.Fprintf(&details, " result=[%s %d bytes]", resultFormat(op), len(op.Result.Data))
+	}
+
+	r.log().Printf("[%s]: %s request took %s: %s\n", op.Req.URL.String(), reason, now.Sub(received), details.String())
+}
@@ -0,0 +1,71 @@
+package img_test
+
+import (
+	"github.com/Pixboost/transformimgs/v8/img"
+	"github.com/dooman87/kolibri/test"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestService_SlowLog(t *testing.T) {
+	logger := &loggerMock{}
+	s, err := img.NewServiceWithConfig(&loaderMock{}, &resizerMock{}, 1, &img.ServiceConfig{Log: logger})
+	if err != nil {
+		t.Fatalf("could not create service: %s", err)
+	}
+	test.Service = s.GetRouter().ServeHTTP
+	test.T = t
+
+	slowLogs := func() []string {
+		logger.mu.Lock()
+		defer logger.mu.Unlock()
+		var lines []string
+		for _, l := range logger.lines {
+			if strings.Contains(l, "request took") {
+				lines = append(lines, l)
+			}
+		}
+		logger.lines = nil
+		return lines
+	}
+
+	for _, tc := range []struct {
+		description string
+		slowLog     *img.SlowLog
+		expected    string
+	}{
+		{"Disabled", nil, ""},
+		{"Fast request", &img.SlowLog{Threshold: time.Hour}, ""},
+		{"Slow request", &img.SlowLog{Threshold: time.Nanosecond}, "Slow request took"},
+		{"Sampled request", &img.SlowLog{Threshold: time.Hour, SamplePercent: 100}, "Sampled request took"},
+	} {
+		s.SlowLog = tc.slowLog
+		test.RunRequests([]test.TestCase{
+			{
+				Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/resize?size=300",
+				Description: tc.description,
+				Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+					if len(w.Header().Get("X-Debug-Args")) > 0 {
+						t.Errorf("expected no debug headers, but got %s", w.Header().Get("X-Debug-Args"))
+					}
+				},
+			},
+		})
+
+		lines := slowLogs()
+		if len(tc.expected) == 0 {
+			if len(lines) > 0 {
+				t.Errorf("%s: expected no slow logs, but got %v", tc.description, lines)
+			}
+			continue
+		}
+		if len(lines) != 1 || !strings.Contains(lines[0], tc.expected) ||
+			!strings.Contains(lines[0], "queue=") ||
+			!strings.Contains(lines[0], "identify=[PNG 600x400") ||
+			!strings.Contains(lines[0], "args=[- -resize 300 -quality 80 png:-]") {
+			t.Errorf("%s: expected details of the request, but got %v", tc.description, lines)
+		}
+	}
+}
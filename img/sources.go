@@ -0,0 +1,105 @@
+package img
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/dooman87/glogi"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// SourcePatterns are patterns of source URLs. Patterns are globs, e.g. https://*.site.com/*,
+// or regular expressions with "re:" prefix, e.g. re:^https://cdn[0-9]+\.site\.com/.
+// In the scheme and the host of globs "*" doesn't match "/", "?", "#" and "@", so it can't
+// go past the host. In the path, and in globs without "://", it matches any characters.
+type SourcePatterns []*regexp.Regexp
+
+// ParseSourcePatterns reads patterns, one per line. Empty lines and lines starting with # are ignored.
+func ParseSourcePatterns(r io.Reader) (SourcePatterns, error) {
+	patterns := SourcePatterns{}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		pattern := strings.TrimSpace(scanner.Text())
+		if len(pattern) == 0 || strings.HasPrefix(pattern, "#") {
+			continue
+		}
+
+		var expr string
+		if re, ok := strings.CutPrefix(pattern, "re:"); ok {
+			expr = re
+		} else {
+			expr = globExpr(pattern)
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		patterns = append(patterns, re)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return patterns, nil
+}
+
+// globExpr converts the glob to the regular expression that matches the whole URL.
+func globExpr(pattern string) string {
+	host, path := "", pattern
+	if i := strings.Index(pattern, "://"); i >= 0 {
+		end := len(pattern)
+		if j := strings.Index(pattern[i+3:], "/"); j >= 0 {
+			end = i + 3 + j
+		}
+		host, path = pattern[:end], pattern[end:]
+	}
+	return "^" + globRegexp(host, "[^/?#@]*") + globRegexp(path, ".*") + "$"
+}
+
+func globRegexp(glob string, star string) string {
+	return strings.ReplaceAll(regexp.QuoteMeta(glob), `\*`, star)
+}
+
+// Match returns true if the URL matches any of patterns.
+func (p SourcePatterns) Match(url string) bool {
+	for _, re := range p {
+		if re.MatchString(url) {
+			return true
+		}
+	}
+	return false
+}
+
+// SourcePolicy limits source URLs that could be loaded. Patterns could be replaced while
+// the service is running, e.g. to quickly cut off abusive sources.
+type SourcePolicy struct {
+	// Log is the logger. Package Log is used if nil.
+	Log glogi.Logger
+
+	mu    sync.RWMutex
+	allow SourcePatterns
+	block SourcePatterns
+}
+
+// Set replaces patterns of the policy. URLs must match allow patterns unless they are nil
+// and must not match block patterns.
+func (p *SourcePolicy) Set(allow SourcePatterns, block SourcePatterns) {
+	p.mu.Lock()
+	p.allow = allow
+	p.block = block
+	p.mu.Unlock()
+}
+
+// Check returns 403 error if the source URL is not allowed. It could be used as
+// Hooks.PreLoad, e.g. service.Use(&img.Hooks{PreLoad: policy.Check}).
+func (p *SourcePolicy) Check(_ *http.Request, imgUrl string) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if (p.allow != nil && !p.allow.Match(imgUrl)) || p.block.Match(imgUrl) {
+		logOrDefault(p.Log).Printf("[%s] Source is not allowed\n", imgUrl)
+		return NewHttpError(http.StatusForbidden, "source URL is not allowed")
+	}
+	return nil
+}
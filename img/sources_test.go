@@ -0,0 +1,87 @@
+package img_test
+
+import (
+	"github.com/Pixboost/transformimgs/v8/img"
+	"github.com/dooman87/kolibri/test"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseSourcePatterns(t *testing.T) {
+	patterns, err := img.ParseSourcePatterns(strings.NewReader(`
+# Comment
+https://*.site.com/*
+re:^http://cdn[0-9]+\.site\.com/
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for url, expected := range map[string]bool{
+		"https://www.site.com/img.png":      true,
+		"https://www.site.com/a/b/img.png":  true,
+		"https://site.com/img.png":          false,
+		"https://www.site.com.evil/img.png": false,
+		"https://evil.com/.site.com/x.png":  false,
+		"https://evil.com/?.site.com/":      false,
+		"https://evil.com#.site.com/":       false,
+		"http://cdn1.site.com/img.png":      true,
+		"http://cdn.site.com/img.png":       false,
+	} {
+		if patterns.Match(url) != expected {
+			t.Errorf("expected match of [%s] to be %t", url, expected)
+		}
+	}
+
+	_, err = img.ParseSourcePatterns(strings.NewReader("https://site.com/*\nre:[a-"))
+	if err == nil || !strings.HasPrefix(err.Error(), "line 2") {
+		t.Errorf("expected error on line 2, but got %v", err)
+	}
+}
+
+func TestSourcePolicy_Check(t *testing.T) {
+	allow, _ := img.ParseSourcePatterns(strings.NewReader("http://site.com/*"))
+	block, _ := img.ParseSourcePatterns(strings.NewReader("*/img2.png"))
+	policy := &img.SourcePolicy{}
+	policy.Set(allow, block)
+
+	s := createService(t)
+	s.Use(&img.Hooks{PreLoad: policy.Check})
+	test.Service = s.GetRouter().ServeHTTP
+	test.T = t
+
+	testCases := []test.TestCase{
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise",
+			Description: "Allowed source",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal(ImgPngOut, w.Body.String(), "Resulted image"),
+				)
+			},
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img2.png/optimise",
+			Description:  "Blocked source",
+			ExpectedCode: http.StatusForbidden,
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fother.com/img.png/asis",
+			Description:  "Source is not in allowlist",
+			ExpectedCode: http.StatusForbidden,
+		},
+	}
+	test.RunRequests(testCases)
+
+	policy.Set(nil, block)
+	test.RunRequests([]test.TestCase{
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fother.com/img.png/asis",
+			Description: "Allowlist is removed",
+			// Source is passed to the loader, which doesn't know it
+			ExpectedCode: http.StatusInternalServerError,
+		},
+	})
+}
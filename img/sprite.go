@@ -0,0 +1,280 @@
+package img
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// MaxSpriteImages is the maximum number of source images in the sprite sheet. Zero disables the limit.
+//
+// Deprecated: use ServiceConfig.MaxSpriteImages.
+var MaxSpriteImages = 100
+
+// SpriteCell is the position of the image in the sprite sheet.
+type SpriteCell struct {
+	// Src is the source of the image.
+	Src    string `json:"src"`
+	X      int    `json:"x"`
+	Y      int    `json:"y"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+// SpriteConfig is the configuration of the sprite sheet passed to Spriter
+// in TransformationConfig.Config.
+type SpriteConfig struct {
+	// Images are the source images, Cells are their positions.
+	Images []*Image
+	Cells  []SpriteCell
+	// Width and Height are the size of the sprite sheet in pixels.
+	Width  int
+	Height int
+}
+
+// SpriteMap is the coordinate map of the sprite sheet.
+type SpriteMap struct {
+	Width  int          `json:"width"`
+	Height int          `json:"height"`
+	Cells  []SpriteCell `json:"cells"`
+}
+
+// Spriter is implemented by processors that could pack multiple images into a sprite sheet.
+type Spriter interface {
+	// LoadImageInfo returns information about the image, e.g. dimensions.
+	LoadImageInfo(src *Image) (*Info, error)
+	// Sprite draws images from SpriteConfig passed in input.Config at positions of their cells
+	// on the transparent background.
+	Sprite(input *TransformationConfig) (*Image, error)
+}
+
+// PackSprites places images of the given sizes on shelves. Images are sorted by height and
+// placed from left to right until the row is wider than the square of the same area.
+// Gap is the space between images in pixels. Returns positions of images in the order of sizes
+// and the size of the sprite sheet.
+func PackSprites(sizes []SpriteCell, gap int) ([]SpriteCell, int, int) {
+	var (
+		area     float64
+		maxWidth int
+	)
+	for _, s := range sizes {
+		area += float64((s.Width + gap) * (s.Height + gap))
+		if s.Width > maxWidth {
+			maxWidth = s.Width
+		}
+	}
+	rowWidth := int(math.Ceil(math.Sqrt(area)))
+	if rowWidth < maxWidth {
+		rowWidth = maxWidth
+	}
+
+	order := make([]int, len(sizes))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return sizes[order[i]].Height > sizes[order[j]].Height
+	})
+
+	var (
+		cells                   = make([]SpriteCell, len(sizes))
+		x, y, shelfHeight       int
+		sheetWidth, sheetHeight int
+	)
+	for _, i := range order {
+		cell := sizes[i]
+		if x > 0 && x+cell.Width > rowWidth {
+			x = 0
+			y += shelfHeight + gap
+			shelfHeight = 0
+		}
+		cell.X, cell.Y = x, y
+		cells[i] = cell
+
+		x += cell.Width + gap
+		if cell.Height > shelfHeight {
+			shelfHeight = cell.Height
+		}
+		if cell.X+cell.Width > sheetWidth {
+			sheetWidth = cell.X + cell.Width
+		}
+		if cell.Y+cell.Height > sheetHeight {
+			sheetHeight = cell.Y + cell.Height
+		}
+	}
+
+	return cells, sheetWidth, sheetHeight
+}
+
+// SpriteUrl packs source images from src query params into a sprite sheet. Space between
+// images in pixels could be set by gap param. When map param is "json" or "css" the coordinate
+// map is returned instead of the image.
+func (r *Service) SpriteUrl(resp http.ResponseWriter, req *http.Request) {
+	spriter, ok := r.Processor.(Spriter)
+	if !ok {
+		http.Error(resp, "processor doesn't support sprites", http.StatusNotImplemented)
+		return
+	}
+
+	serviceConfig := r.config()
+	sources := req.URL.Query()["src"]
+	if len(sources) == 0 {
+		http.Error(resp, "src param is required", http.StatusBadRequest)
+		return
+	}
+	if serviceConfig.MaxSpriteImages > 0 && len(sources) > serviceConfig.MaxSpriteImages {
+		http.Error(resp, fmt.Sprintf("sprite sheet must not have more than %d images", serviceConfig.MaxSpriteImages), http.StatusBadRequest)
+		return
+	}
+	gap := 0
+	if gapParam, _ := getQueryParam(req.URL, "gap"); len(gapParam) > 0 {
+		var err error
+		gap, err = strconv.Atoi(gapParam)
+		if err != nil || gap < 0 || (serviceConfig.MaxDimension > 0 && gap > serviceConfig.MaxDimension) {
+			http.Error(resp, "gap param must be a non negative number", http.StatusBadRequest)
+			return
+		}
+	}
+	mapFormat, _ := getQueryParam(req.URL, "map")
+	if len(mapFormat) > 0 && mapFormat != "json" && mapFormat != "css" {
+		http.Error(resp, "map query param must be one of 'json', 'css'", http.StatusBadRequest)
+		return
+	}
+
+	mergeHeader(resp.Header(), "Vary", r.formatsVary())
+
+	r.log().Printf("[%s]: Creating sprite sheet of %d images\n", req.URL.String(), len(sources))
+
+	images, err := r.loadAll(req, sources)
+	if err != nil {
+		r.sendError(resp, err)
+		return
+	}
+	defer func() {
+		for _, image := range images {
+			image.Release()
+		}
+	}()
+
+	release, err := r.acquireAll(req, images)
+	if err != nil {
+		r.sendError(resp, err)
+		return
+	}
+	defer release()
+
+	// URL of the sprite sheet for CSS is the same request without map param
+	sheetUrl := *req.URL
+	query := sheetUrl.Query()
+	query.Del("map")
+	sheetUrl.RawQuery = query.Encode()
+
+	r.execOp(&Command{
+		Transformation: func(input *TransformationConfig) (*Image, error) {
+			config, err := packSprites(spriter, images, sources, gap, serviceConfig.MaxDimension)
+			if err != nil {
+				return nil, err
+			}
+			switch mapFormat {
+			case "json":
+				return newSpriteJson(config)
+			case "css":
+				return newSpriteCss(config, sheetUrl.RequestURI()), nil
+			}
+			input.Config = config
+			return spriter.Sprite(input)
+		},
+		Config: &TransformationConfig{
+			Src: &Image{
+				Id:      fmt.Sprintf("sprite of %d images", len(sources)),
+				NoStore: anyNoStore(images),
+			},
+			SupportedFormats: r.supportedFormats(req),
+			Quality:          DEFAULT,
+		},
+		Req:  req,
+		Resp: resp,
+	})
+}
+
+// packSprites identifies the images and returns the configuration of the sprite sheet.
+// Sheets bigger than maxDimension are rejected unless it's zero.
+func packSprites(spriter Spriter, images []*Image, sources []string, gap int, maxDimension int) (*SpriteConfig, error) {
+	sizes := make([]SpriteCell, len(images))
+	for i, image := range images {
+		info, err := spriter.LoadImageInfo(image)
+		if err != nil {
+			return nil, err
+		}
+		sizes[i] = SpriteCell{Src: sources[i], Width: info.Width, Height: info.Height}
+	}
+
+	config := &SpriteConfig{Images: images}
+	config.Cells, config.Width, config.Height = PackSprites(sizes, gap)
+	if maxDimension > 0 && (config.Width > maxDimension || config.Height > maxDimension) {
+		return nil, NewHttpError(http.StatusBadRequest, fmt.Sprintf("width and height of sprite sheet must not be more than %d", maxDimension))
+	}
+	if config.Width == 0 || config.Height == 0 {
+		return nil, errors.New("sprite sheet is empty")
+	}
+
+	return config, nil
+}
+
+func newSpriteJson(config *SpriteConfig) (*Image, error) {
+	buf := GetBuffer()
+	err := json.NewEncoder(buf).Encode(&SpriteMap{
+		Width:  config.Width,
+		Height: config.Height,
+		Cells:  config.Cells,
+	})
+	if err != nil {
+		PutBuffer(buf)
+		return nil, err
+	}
+	return NewPooledImage("", buf, "application/json"), nil
+}
+
+// newSpriteCss returns CSS with .sprite class for the sprite sheet and .sprite-N class
+// for each image, where N is the index of the image in src params.
+func newSpriteCss(config *SpriteConfig, sheetUrl string) *Image {
+	buf := GetBuffer()
+	_, _ = fmt.Fprintf(buf, ".sprite {\n  background-image: url(%q);\n  background-repeat: no-repeat;\n}\n", sheetUrl)
+	for i, cell := range config.Cells {
+		_, _ = fmt.Fprintf(buf, ".sprite-%d {\n  background-position: %s %s;\n  width: %dpx;\n  height: %dpx;\n}\n",
+			i, cssOffset(cell.X), cssOffset(cell.Y), cell.Width, cell.Height)
+	}
+	return NewPooledImage("", buf, "text/css")
+}
+
+func cssOffset(v int) string {
+	if v == 0 {
+		return "0"
+	}
+	return fmt.Sprintf("-%dpx", v)
+}
+
+// loadImageInfo identifies the image using the processor or returns 501 error
+// if processor doesn't have LoadImageInfo method.
+func loadImageInfo(p Processor, src *Image) (*Info, error) {
+	identifier, ok := p.(interface {
+		LoadImageInfo(src *Image) (*Info, error)
+	})
+	if !ok {
+		return nil, NewHttpError(http.StatusNotImplemented, "processor doesn't support image info")
+	}
+	return identifier.LoadImageInfo(src)
+}
+
+// asSpriter returns the processor as Spriter or 501 error if it doesn't support sprites.
+func asSpriter(p Processor) (Spriter, error) {
+	spriter, ok := p.(Spriter)
+	if !ok {
+		return nil, NewHttpError(http.StatusNotImplemented, "processor doesn't support sprites")
+	}
+	return spriter, nil
+}
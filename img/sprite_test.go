@@ -0,0 +1,31 @@
+package img_test
+
+import (
+	"github.com/Pixboost/transformimgs/v8/img"
+	"reflect"
+	"testing"
+)
+
+func TestPackSprites(t *testing.T) {
+	sizes := []img.SpriteCell{
+		{Src: "a", Width: 10, Height: 10},
+		{Src: "b", Width: 20, Height: 30},
+		{Src: "c", Width: 30, Height: 20},
+		{Src: "d", Width: 10, Height: 10},
+	}
+
+	cells, width, height := img.PackSprites(sizes, 2)
+
+	expected := []img.SpriteCell{
+		{Src: "a", X: 32, Y: 32, Width: 10, Height: 10},
+		{Src: "b", X: 0, Y: 0, Width: 20, Height: 30},
+		{Src: "c", X: 0, Y: 32, Width: 30, Height: 20},
+		{Src: "d", X: 0, Y: 54, Width: 10, Height: 10},
+	}
+	if !reflect.DeepEqual(cells, expected) {
+		t.Errorf("expected cells %+v, but got %+v", expected, cells)
+	}
+	if width != 42 || height != 64 {
+		t.Errorf("expected sprite sheet 42x64, but got %dx%d", width, height)
+	}
+}
@@ -0,0 +1,276 @@
+package img
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MaxStatusErrors is the number of recent errors shown on the status page.
+var MaxStatusErrors = 20
+
+// MaxStatusHosts is the number of source hosts tracked for the status page.
+// Requests to other hosts are counted as "[other]".
+var MaxStatusHosts = 1000
+
+// TopStatusHosts is the number of source hosts with most requests shown on the status page.
+var TopStatusHosts = 10
+
+// StatusError is the recent error shown on the status page.
+type StatusError struct {
+	Time   time.Time
+	Source string
+	// Op is the name of the operation or "load" for errors of loading source images.
+	Op       string
+	Category string
+	Message  string
+}
+
+// StatusHost is the number of requests to the source host.
+type StatusHost struct {
+	Host     string
+	Requests uint64
+}
+
+// Status tracks the state of the service for operators without a metrics stack: transformations
+// in progress, recent errors and top source hosts. Service tracks the state if Service.Status is set
+// and the page is served by Service.ServeStatus.
+type Status struct {
+	// Since is the time when the tracking started.
+	Since time.Time
+
+	mux        sync.Mutex
+	inProgress map[string]int
+	served     uint64
+	failed     uint64
+	errors     []StatusError
+	hosts      map[string]uint64
+}
+
+// NewStatus creates an empty status.
+func NewStatus() *Status {
+	return &Status{
+		Since:      time.Now(),
+		inProgress: make(map[string]int),
+		hosts:      make(map[string]uint64),
+	}
+}
+
+// addSource counts the request to the host of the source image.
+func (s *Status) addSource(imgUrl string) {
+	host := "[unknown]"
+	if u, err := url.Parse(imgUrl); err == nil && len(u.Host) > 0 {
+		host = u.Host
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if _, ok := s.hosts[host]; !ok && len(s.hosts) >= MaxStatusHosts {
+		host = "[other]"
+	}
+	s.hosts[host]++
+}
+
+// start counts the command that is added to the queue.
+func (s *Status) start(op *Command) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.inProgress[commandClass(op)]++
+}
+
+// finish counts the finished command and records its error.
+func (s *Status) finish(op *Command) {
+	s.mux.Lock()
+	class := commandClass(op)
+	s.inProgress[class]--
+	if s.inProgress[class] == 0 {
+		delete(s.inProgress, class)
+	}
+	if op.Err == nil {
+		s.served++
+	}
+	s.mux.Unlock()
+
+	if op.Err != nil {
+		name := op.Op
+		if len(name) == 0 {
+			name = class
+		}
+		s.addError(op.Config.Src.Id, name, op.Err)
+	}
+}
+
+// addError records the error and counts the failed request.
+func (s *Status) addError(source string, op string, err error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.failed++
+	s.errors = append(s.errors, StatusError{
+		Time:     time.Now(),
+		Source:   source,
+		Op:       op,
+		Category: ErrorCategory(err),
+		Message:  err.Error(),
+	})
+	if len(s.errors) > MaxStatusErrors {
+		s.errors = s.errors[len(s.errors)-MaxStatusErrors:]
+	}
+}
+
+// statusPage is the data of the status page template.
+type statusPage struct {
+	Since       time.Time
+	Uptime      time.Duration
+	Goroutines  int
+	Processors  int
+	Served      uint64
+	Failed      uint64
+	Pending     int
+	Scheduler   bool
+	InProgress  map[string]int
+	MemoryUsed  int64
+	Memory      bool
+	Circuit     *CircuitBreakerStats
+	Variants    *VariantCacheStats
+	Savings     []SavingsStats
+	Hosts       []StatusHost
+	Errors      []StatusError
+	GeneratedAt time.Time
+}
+
+var statusTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>TransformImgs status</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.6em; text-align: left; }
+</style>
+</head>
+<body>
+<h1>TransformImgs status</h1>
+<table>
+<tr><th>Started</th><td>{{.Since.Format "2006-01-02 15:04:05 MST"}}</td></tr>
+<tr><th>Uptime</th><td>{{.Uptime}}</td></tr>
+<tr><th>Goroutines</th><td>{{.Goroutines}}</td></tr>
+<tr><th>Processors</th><td>{{.Processors}}</td></tr>
+<tr><th>Served</th><td>{{.Served}}</td></tr>
+<tr><th>Failed</th><td>{{.Failed}}</td></tr>
+{{if .Memory}}<tr><th>Memory budget used</th><td>{{.MemoryUsed}} bytes</td></tr>{{end}}
+{{with .Variants}}<tr><th>Variant cache</th><td>{{.Entries}} variants, {{.Bytes}} bytes, {{.Hits}} hits, {{.Misses}} misses</td></tr>{{end}}
+{{with .Circuit}}<tr><th>Circuit breaker</th><td>{{.State}}, {{.Failures}} consecutive failures, opened {{.Opened}} times, {{.ShortCircuited}} short-circuited</td></tr>{{end}}
+</table>
+
+<h2>Queue</h2>
+<table>
+{{if .Scheduler}}<tr><th>Waiting for a processor</th><td>{{.Pending}}</td></tr>{{end}}
+<tr><th>Class</th><th>Queued or running</th></tr>
+{{range $class, $n := .InProgress}}<tr><td>{{$class}}</td><td>{{$n}}</td></tr>
+{{else}}<tr><td colspan="2">Idle</td></tr>
+{{end}}
+</table>
+
+{{if .Savings}}
+<h2>Transformations</h2>
+<table>
+<tr><th>Operation</th><th>Format</th><th>Count</th><th>Input bytes</th><th>Output bytes</th></tr>
+{{range .Savings}}<tr><td>{{.Op}}</td><td>{{.Format}}</td><td>{{.Count}}</td><td>{{.InputBytes}}</td><td>{{.OutputBytes}}</td></tr>
+{{end}}
+</table>
+{{end}}
+
+<h2>Top source hosts</h2>
+<table>
+<tr><th>Host</th><th>Requests</th></tr>
+{{range .Hosts}}<tr><td>{{.Host}}</td><td>{{.Requests}}</td></tr>
+{{else}}<tr><td colspan="2">No requests</td></tr>
+{{end}}
+</table>
+
+<h2>Recent errors</h2>
+<table>
+<tr><th>Time</th><th>Operation</th><th>Category</th><th>Source</th><th>Error</th></tr>
+{{range .Errors}}<tr><td>{{.Time.Format "2006-01-02 15:04:05"}}</td><td>{{.Op}}</td><td>{{.Category}}</td><td>{{.Source}}</td><td>{{.Message}}</td></tr>
+{{else}}<tr><td colspan="5">No errors</td></tr>
+{{end}}
+</table>
+<p>Generated at {{.GeneratedAt.Format "2006-01-02 15:04:05 MST"}}</p>
+</body>
+</html>
+`))
+
+// ServeStatus writes the HTML status page with uptime, queue, recent errors and top source hosts.
+// Responds with 404 if Status is not set. The page exposes URLs of source images and internals,
+// so it should be protected, e.g. served on the admin listener.
+func (r *Service) ServeStatus(resp http.ResponseWriter, req *http.Request) {
+	if r.Status == nil {
+		http.NotFound(resp, req)
+		return
+	}
+	s := r.Status
+
+	page := statusPage{
+		Since:       s.Since,
+		Uptime:      time.Since(s.Since).Round(time.Second),
+		Goroutines:  runtime.NumGoroutine(),
+		Processors:  len(r.Q),
+		GeneratedAt: time.Now(),
+	}
+	if r.Scheduler != nil {
+		page.Scheduler = true
+		page.Pending = r.Scheduler.Pending()
+		page.Processors = r.Scheduler.workers
+	}
+	if r.MemoryBudget != nil {
+		page.Memory = true
+		page.MemoryUsed = r.MemoryBudget.Used()
+	}
+	if r.Variants != nil {
+		stats := r.Variants.Stats()
+		page.Variants = &stats
+	}
+	if cb, ok := r.Processor.(*CircuitBreaker); ok {
+		stats := cb.Stats()
+		page.Circuit = &stats
+	}
+	if r.Savings != nil {
+		page.Savings = r.Savings.Stats()
+	}
+
+	s.mux.Lock()
+	page.Served, page.Failed = s.served, s.failed
+	page.InProgress = make(map[string]int, len(s.inProgress))
+	for class, n := range s.inProgress {
+		page.InProgress[class] = n
+	}
+	for host, n := range s.hosts {
+		page.Hosts = append(page.Hosts, StatusHost{Host: host, Requests: n})
+	}
+	// Newest errors first
+	for i := len(s.errors) - 1; i >= 0; i-- {
+		page.Errors = append(page.Errors, s.errors[i])
+	}
+	s.mux.Unlock()
+
+	sort.Slice(page.Hosts, func(i, j int) bool {
+		if page.Hosts[i].Requests != page.Hosts[j].Requests {
+			return page.Hosts[i].Requests > page.Hosts[j].Requests
+		}
+		return page.Hosts[i].Host < page.Hosts[j].Host
+	})
+	if len(page.Hosts) > TopStatusHosts {
+		page.Hosts = page.Hosts[:TopStatusHosts]
+	}
+
+	resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+	resp.Header().Set("Cache-Control", "no-store")
+	if err := statusTemplate.Execute(resp, page); err != nil {
+		r.log().Errorf("Could not render status page: %s", err)
+	}
+}
@@ -0,0 +1,74 @@
+package img_test
+
+import (
+	"github.com/Pixboost/transformimgs/v8/img"
+	"github.com/dooman87/kolibri/test"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestService_ServeStatus(t *testing.T) {
+	s := createService(t)
+	s.Status = img.NewStatus()
+	router := s.GetRouter()
+	router.HandleFunc("/status", s.ServeStatus)
+	test.Service = router.ServeHTTP
+	test.T = t
+
+	testCases := []test.TestCase{
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise",
+			Description: "Served image",
+		},
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/asis",
+			Description: "Served as is",
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/resize?size=400",
+			Description:  "Transformation error",
+			ExpectedCode: http.StatusInternalServerError,
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fother.com/img.png/optimise",
+			Description:  "Load error",
+			ExpectedCode: http.StatusInternalServerError,
+		},
+		{
+			Url:         "http://localhost/status",
+			Description: "Status page",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				body := w.Body.String()
+				test.Error(t,
+					test.Equal("text/html; charset=utf-8", w.Header().Get("Content-Type"), "Content-Type"),
+					test.Equal("no-store", w.Header().Get("Cache-Control"), "Cache-Control"),
+				)
+				for _, expected := range []string{
+					"<tr><th>Served</th><td>2</td></tr>",
+					"<tr><th>Failed</th><td>2</td></tr>",
+					"<tr><td>site.com</td><td>3</td></tr>",
+					"<tr><td>other.com</td><td>1</td></tr>",
+					"resize_error",
+					"<td>load</td><td>other</td><td>http://other.com/img.png</td><td>read_error</td>",
+					"<td colspan=\"2\">Idle</td>",
+				} {
+					if !strings.Contains(body, expected) {
+						t.Errorf("expected status page to contain [%s], but got %s", expected, body)
+					}
+				}
+			},
+		},
+	}
+
+	test.RunRequests(testCases)
+}
+
+func TestService_ServeStatus_Disabled(t *testing.T) {
+	s := createService(t)
+	w := httptest.NewRecorder()
+	s.ServeStatus(w, httptest.NewRequest(http.MethodGet, "http://localhost/status", nil))
+
+	test.Error(t, test.Equal(http.StatusNotFound, w.Code, "status code"))
+}
@@ -0,0 +1,229 @@
+package img
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// DefaultTileSize is the size of tiles in pixels for Deep Zoom and IIIF clients.
+const DefaultTileSize = 512
+
+// TileSize is the size of tiles in pixels for Deep Zoom and IIIF clients.
+//
+// Deprecated: use ServiceConfig.TileSize.
+var TileSize = DefaultTileSize
+
+// TileOverlap is the number of pixels that Deep Zoom tiles overlap with neighbours.
+var TileOverlap = 1
+
+// tileFormats are output formats of tiles.
+var tileFormats = map[string]bool{
+	"jpg":  true,
+	"png":  true,
+	"webp": true,
+}
+
+// TileConfig is the configuration of the tile passed to Tiler in TransformationConfig.Config.
+type TileConfig struct {
+	// X, Y, Width and Height is the region of the source image in pixels.
+	X      int
+	Y      int
+	Width  int
+	Height int
+	// TargetWidth and TargetHeight is the size of the tile before rotation.
+	TargetWidth  int
+	TargetHeight int
+	// Rotation is the clockwise rotation in degrees: 0, 90, 180 or 270.
+	Rotation int
+	// Gray is the flag to convert the tile to grayscale.
+	Gray bool
+	// Format is the output format: "jpg", "png" or "webp".
+	Format string
+}
+
+// Tiler is implemented by processors that could cut tiles from the source image.
+type Tiler interface {
+	// LoadImageInfo returns information about the image, e.g. dimensions.
+	LoadImageInfo(src *Image) (*Info, error)
+	// Tile cuts the region from TileConfig passed in input.Config and resizes it to the target size.
+	Tile(input *TransformationConfig) (*Image, error)
+}
+
+// tile cuts the tile using the processor or returns 501 error if processor is not a Tiler.
+func tile(p Processor, config *TransformationConfig) (*Image, error) {
+	tiler, ok := p.(Tiler)
+	if !ok {
+		return nil, NewHttpError(http.StatusNotImplemented, "processor doesn't support tiles")
+	}
+	return tiler.Tile(config)
+}
+
+// DziLevel returns the number of the highest Deep Zoom level of the image,
+// where the image has original size. Each lower level is half of the previous.
+func DziLevel(width int, height int) int {
+	maxSide := width
+	if height > maxSide {
+		maxSide = height
+	}
+	if maxSide <= 1 {
+		return 0
+	}
+	return int(math.Ceil(math.Log2(float64(maxSide))))
+}
+
+// DziTile returns the configuration of the tile in the given column and row of the Deep Zoom level
+// with tiles of tileSize pixels.
+func DziTile(info *Info, tileSize int, level int, col int, row int, format string) (*TileConfig, error) {
+	maxLevel := DziLevel(info.Width, info.Height)
+	if level < 0 || level > maxLevel || col < 0 || row < 0 {
+		return nil, NewHttpError(http.StatusNotFound, "tile not found")
+	}
+
+	scale := 1 << (maxLevel - level)
+	levelWidth := (info.Width + scale - 1) / scale
+	levelHeight := (info.Height + scale - 1) / scale
+	x, width, okX := dziTileRange(col, levelWidth, tileSize)
+	y, height, okY := dziTileRange(row, levelHeight, tileSize)
+	if !okX || !okY {
+		return nil, NewHttpError(http.StatusNotFound, "tile not found")
+	}
+
+	config := &TileConfig{
+		X:            x * scale,
+		Y:            y * scale,
+		Width:        width * scale,
+		Height:       height * scale,
+		TargetWidth:  width,
+		TargetHeight: height,
+		Format:       format,
+	}
+	// Region of the last tile could be outside of the image because level size is rounded up
+	if config.X+config.Width > info.Width {
+		config.Width = info.Width - config.X
+	}
+	if config.Y+config.Height > info.Height {
+		config.Height = info.Height - config.Y
+	}
+	return config, nil
+}
+
+// dziTileRange returns the start and the length of the tile with the given index
+// including overlap. Returns false if the tile is outside of the level.
+func dziTileRange(index int, levelSize int, tileSize int) (int, int, bool) {
+	start := index * tileSize
+	if start >= levelSize {
+		return 0, 0, false
+	}
+	end := start + tileSize + TileOverlap
+	if index > 0 {
+		start -= TileOverlap
+	}
+	if end > levelSize {
+		end = levelSize
+	}
+	return start, end - start, true
+}
+
+// DziUrl returns Deep Zoom descriptor of the image in XML. Format of tiles could be set by format param,
+// "jpg" by default.
+func (r *Service) DziUrl(resp http.ResponseWriter, req *http.Request) {
+	format, _ := getQueryParam(req.URL, "format")
+	if len(format) == 0 {
+		format = "jpg"
+	}
+	if !tileFormats[format] {
+		http.Error(resp, "format query param must be one of 'jpg', 'png', 'webp'", http.StatusBadRequest)
+		return
+	}
+
+	tileSize := r.tileSize()
+	r.tileUrl(resp, req, func(tiler Tiler, input *TransformationConfig) (*Image, error) {
+		buf := GetBuffer()
+		_, _ = fmt.Fprintf(buf, "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n"+
+			"<Image xmlns=\"http://schemas.microsoft.com/deepzoom/2008\" Format=\"%s\" Overlap=\"%d\" TileSize=\"%d\">\n"+
+			"  <Size Width=\"%d\" Height=\"%d\"/>\n"+
+			"</Image>\n", format, TileOverlap, tileSize, input.SrcInfo.Width, input.SrcInfo.Height)
+		return NewPooledImage("", buf, "application/xml"), nil
+	})
+}
+
+// DziTileUrl returns the Deep Zoom tile of the image.
+func (r *Service) DziTileUrl(resp http.ResponseWriter, req *http.Request) {
+	vars := PathVars(req)
+	level, errLevel := strconv.Atoi(vars["level"])
+	col, errCol := strconv.Atoi(vars["col"])
+	row, errRow := strconv.Atoi(vars["row"])
+	if errLevel != nil || errCol != nil || errRow != nil {
+		http.Error(resp, "level, column and row must be numbers", http.StatusBadRequest)
+		return
+	}
+	format := vars["format"]
+	if !tileFormats[format] {
+		http.Error(resp, "format must be one of 'jpg', 'png', 'webp'", http.StatusBadRequest)
+		return
+	}
+	tileSize := r.tileSize()
+
+	r.tileUrl(resp, req, func(tiler Tiler, input *TransformationConfig) (*Image, error) {
+		config, err := DziTile(input.SrcInfo, tileSize, level, col, row, format)
+		if err != nil {
+			return nil, err
+		}
+		input.Config = config
+		return tiler.Tile(input)
+	})
+}
+
+// tileUrl loads the source image from the path and runs the transformation in the queue
+// after the source is identified. Information about the source is in input.SrcInfo.
+func (r *Service) tileUrl(resp http.ResponseWriter, req *http.Request, transformation func(tiler Tiler, input *TransformationConfig) (*Image, error)) {
+	tiler, ok := r.Processor.(Tiler)
+	if !ok {
+		http.Error(resp, "processor doesn't support tiles", http.StatusNotImplemented)
+		return
+	}
+
+	imgUrl := r.getImgUrl(req)
+	if len(imgUrl) == 0 {
+		http.Error(resp, "url param is required", http.StatusBadRequest)
+		return
+	}
+
+	r.log().Printf("[%s]: Getting tiles of image %s\n", req.URL.String(), imgUrl)
+
+	images, err := r.loadAll(req, []string{imgUrl})
+	if err != nil {
+		r.sendError(resp, err)
+		return
+	}
+	release, err := r.acquireAll(req, images)
+	if err != nil {
+		images[0].Release()
+		r.sendError(resp, err)
+		return
+	}
+	defer release()
+
+	r.execOp(&Command{
+		Transformation: func(input *TransformationConfig) (*Image, error) {
+			info, err := tiler.LoadImageInfo(input.Src)
+			if err != nil {
+				return nil, err
+			}
+			if info.Width <= 0 || info.Height <= 0 {
+				return nil, errors.New("could not get size of the image")
+			}
+			input.SrcInfo = info
+			return transformation(tiler, input)
+		},
+		Config: &TransformationConfig{
+			Src:     images[0],
+			Quality: DEFAULT,
+		},
+		Req:  req,
+		Resp: resp,
+	})
+}
@@ -0,0 +1,158 @@
+package img_test
+
+import (
+	"errors"
+	"github.com/Pixboost/transformimgs/v8/img"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestDziLevel(t *testing.T) {
+	for _, tt := range []struct {
+		width, height, level int
+	}{
+		{1, 1, 0},
+		{2, 1, 1},
+		{1000, 500, 10},
+		{1024, 1024, 10},
+		{1025, 10, 11},
+	} {
+		if level := img.DziLevel(tt.width, tt.height); level != tt.level {
+			t.Errorf("expected level %d for %dx%d, but got %d", tt.level, tt.width, tt.height, level)
+		}
+	}
+}
+
+func TestDziTile(t *testing.T) {
+	info := &img.Info{Width: 1000, Height: 600}
+
+	for _, tt := range []struct {
+		description     string
+		level, col, row int
+		expected        *img.TileConfig
+	}{
+		{
+			description: "First tile of the highest level",
+			level:       10, col: 0, row: 0,
+			expected: &img.TileConfig{X: 0, Y: 0, Width: 513, Height: 513, TargetWidth: 513, TargetHeight: 513, Format: "jpg"},
+		},
+		{
+			description: "Last tile of the highest level",
+			level:       10, col: 1, row: 1,
+			expected: &img.TileConfig{X: 511, Y: 511, Width: 489, Height: 89, TargetWidth: 489, TargetHeight: 89, Format: "jpg"},
+		},
+		{
+			description: "The whole image in one tile",
+			level:       9, col: 0, row: 0,
+			expected: &img.TileConfig{X: 0, Y: 0, Width: 1000, Height: 600, TargetWidth: 500, TargetHeight: 300, Format: "jpg"},
+		},
+		{
+			description: "Level size is rounded up",
+			level:       0, col: 0, row: 0,
+			expected: &img.TileConfig{X: 0, Y: 0, Width: 1000, Height: 600, TargetWidth: 1, TargetHeight: 1, Format: "jpg"},
+		},
+	} {
+		config, err := img.DziTile(info, img.DefaultTileSize, tt.level, tt.col, tt.row, "jpg")
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", tt.description, err)
+			continue
+		}
+		if !reflect.DeepEqual(config, tt.expected) {
+			t.Errorf("%s: expected %+v, but got %+v", tt.description, tt.expected, config)
+		}
+	}
+
+	for _, tt := range []struct {
+		description     string
+		level, col, row int
+	}{
+		{"Level is too high", 11, 0, 0},
+		{"Column is outside of the level", 10, 2, 0},
+		{"Row is outside of the level", 9, 0, 1},
+	} {
+		_, err := img.DziTile(info, img.DefaultTileSize, tt.level, tt.col, tt.row, "jpg")
+		var httpErr *img.HttpError
+		if !errors.As(err, &httpErr) || httpErr.Code() != http.StatusNotFound {
+			t.Errorf("%s: expected 404 error, but got %v", tt.description, err)
+		}
+	}
+}
+
+func TestIiifRequest_Tile(t *testing.T) {
+	info := &img.Info{Width: 1000, Height: 600}
+
+	for _, tt := range []struct {
+		description string
+		req         img.IiifRequest
+		expected    *img.TileConfig
+	}{
+		{
+			description: "Full image",
+			req:         img.IiifRequest{Region: "full", Size: "max", Rotation: "0", Quality: "default", Format: "jpg"},
+			expected:    &img.TileConfig{Width: 1000, Height: 600, TargetWidth: 1000, TargetHeight: 600, Format: "jpg"},
+		},
+		{
+			description: "Square region by width",
+			req:         img.IiifRequest{Region: "square", Size: "300,", Rotation: "90", Quality: "gray", Format: "png"},
+			expected:    &img.TileConfig{X: 200, Width: 600, Height: 600, TargetWidth: 300, TargetHeight: 300, Rotation: 90, Gray: true, Format: "png"},
+		},
+		{
+			description: "Region in pixels is clipped",
+			req:         img.IiifRequest{Region: "512,512,512,512", Size: ",44", Rotation: "360", Quality: "color", Format: "webp"},
+			expected:    &img.TileConfig{X: 512, Y: 512, Width: 488, Height: 88, TargetWidth: 244, TargetHeight: 44, Format: "webp"},
+		},
+		{
+			description: "Region in percents with confined size",
+			req:         img.IiifRequest{Region: "pct:10,10,50,50", Size: "!100,100", Rotation: "0", Quality: "default", Format: "jpg"},
+			expected:    &img.TileConfig{X: 100, Y: 60, Width: 500, Height: 300, TargetWidth: 100, TargetHeight: 60, Format: "jpg"},
+		},
+		{
+			description: "Size in percents",
+			req:         img.IiifRequest{Region: "full", Size: "pct:25", Rotation: "0", Quality: "default", Format: "jpg"},
+			expected:    &img.TileConfig{Width: 1000, Height: 600, TargetWidth: 250, TargetHeight: 150, Format: "jpg"},
+		},
+		{
+			description: "Upscaling",
+			req:         img.IiifRequest{Region: "0,0,100,100", Size: "^200,200", Rotation: "0", Quality: "default", Format: "jpg"},
+			expected:    &img.TileConfig{Width: 100, Height: 100, TargetWidth: 200, TargetHeight: 200, Format: "jpg"},
+		},
+		{
+			description: "Max size is limited",
+			req:         img.IiifRequest{Region: "full", Size: "max", Rotation: "0", Quality: "default", Format: "jpg", MaxDimension: 500},
+			expected:    &img.TileConfig{Width: 1000, Height: 600, TargetWidth: 500, TargetHeight: 300, Format: "jpg"},
+		},
+	} {
+		config, err := tt.req.Tile(info)
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", tt.description, err)
+			continue
+		}
+		if !reflect.DeepEqual(config, tt.expected) {
+			t.Errorf("%s: expected %+v, but got %+v", tt.description, tt.expected, config)
+		}
+	}
+
+	for _, tt := range []struct {
+		description string
+		req         img.IiifRequest
+		code        int
+	}{
+		{"Invalid region", img.IiifRequest{Region: "1,2,3", Size: "max", Rotation: "0", Quality: "default", Format: "jpg"}, http.StatusBadRequest},
+		{"Region outside of the image", img.IiifRequest{Region: "1000,0,10,10", Size: "max", Rotation: "0", Quality: "default", Format: "jpg"}, http.StatusBadRequest},
+		{"Upscaling without ^", img.IiifRequest{Region: "0,0,100,100", Size: "200,", Rotation: "0", Quality: "default", Format: "jpg"}, http.StatusBadRequest},
+		{"Invalid size", img.IiifRequest{Region: "full", Size: ",", Rotation: "0", Quality: "default", Format: "jpg"}, http.StatusBadRequest},
+		{"Size is more than limit", img.IiifRequest{Region: "full", Size: "600,", Rotation: "0", Quality: "default", Format: "jpg", MaxDimension: 500}, http.StatusBadRequest},
+		{"Invalid rotation", img.IiifRequest{Region: "full", Size: "max", Rotation: "abc", Quality: "default", Format: "jpg"}, http.StatusBadRequest},
+		{"Arbitrary rotation", img.IiifRequest{Region: "full", Size: "max", Rotation: "45", Quality: "default", Format: "jpg"}, http.StatusNotImplemented},
+		{"Mirroring", img.IiifRequest{Region: "full", Size: "max", Rotation: "!0", Quality: "default", Format: "jpg"}, http.StatusNotImplemented},
+		{"Bitonal", img.IiifRequest{Region: "full", Size: "max", Rotation: "0", Quality: "bitonal", Format: "jpg"}, http.StatusNotImplemented},
+		{"Unsupported format", img.IiifRequest{Region: "full", Size: "max", Rotation: "0", Quality: "default", Format: "tif"}, http.StatusNotImplemented},
+	} {
+		_, err := tt.req.Tile(info)
+		var httpErr *img.HttpError
+		if !errors.As(err, &httpErr) || httpErr.Code() != tt.code {
+			t.Errorf("%s: expected %d error, but got %v", tt.description, tt.code, err)
+		}
+	}
+}
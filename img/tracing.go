@@ -0,0 +1,239 @@
+package img
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	mathrand "math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceParentHeader is the header of W3C trace context that is read from requests and
+// propagated to origins.
+const TraceParentHeader = "traceparent"
+
+// Kinds of spans as defined by OpenTelemetry.
+const (
+	SpanKindInternal = 1
+	SpanKindServer   = 2
+	SpanKindClient   = 3
+)
+
+// Span is the timed operation of the traced request, e.g. loading of the source or ImageMagick
+// command. Methods of nil spans do nothing, so untraced requests don't need checks.
+type Span struct {
+	TraceId  [16]byte
+	SpanId   [8]byte
+	ParentId [8]byte
+	Name     string
+	Kind     int
+	// StartTime and EndTime are zero until the span is started and ended.
+	StartTime  time.Time
+	EndTime    time.Time
+	Attributes map[string]string
+	// Err is the message of the error of the operation. Empty if the operation succeeded.
+	Err string
+
+	trace *trace
+}
+
+// trace collects finished spans of the request.
+type trace struct {
+	mu    sync.Mutex
+	spans []*Span
+}
+
+// newSpan returns the span that is not started yet.
+func (s *Span) newSpan(name string, kind int) *Span {
+	child := &Span{TraceId: s.TraceId, ParentId: s.SpanId, Name: name, Kind: kind, trace: s.trace}
+	_, _ = rand.Read(child.SpanId[:])
+	return child
+}
+
+// Child starts the child span of the internal operation.
+func (s *Span) Child(name string) *Span {
+	if s == nil {
+		return nil
+	}
+	child := s.newSpan(name, SpanKindInternal)
+	child.StartTime = time.Now()
+	return child
+}
+
+// SetAttribute sets the attribute of the span, e.g. "http.route".
+func (s *Span) SetAttribute(key string, value string) {
+	if s == nil {
+		return
+	}
+	if s.Attributes == nil {
+		s.Attributes = make(map[string]string)
+	}
+	s.Attributes[key] = value
+}
+
+// SetError marks the span as failed with the error. Nil errors are ignored.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.Err = err.Error()
+}
+
+// End ends the span.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.endAt(time.Now())
+}
+
+func (s *Span) endAt(t time.Time) {
+	s.EndTime = t
+	s.trace.mu.Lock()
+	s.trace.spans = append(s.trace.spans, s)
+	s.trace.mu.Unlock()
+}
+
+// record adds the finished child span with the given times, e.g. for waiting in the queue.
+func (s *Span) record(name string, start time.Time, end time.Time) *Span {
+	if s == nil || start.IsZero() || end.IsZero() {
+		return nil
+	}
+	child := s.newSpan(name, SpanKindInternal)
+	child.StartTime = start
+	child.endAt(end)
+	return child
+}
+
+// TraceParent returns the value of traceparent header that propagates the span to the next
+// service, e.g. the origin. Empty if the span is nil.
+func (s *Span) TraceParent() string {
+	if s == nil {
+		return ""
+	}
+	return fmt.Sprintf("00-%s-%s-01", hex.EncodeToString(s.TraceId[:]), hex.EncodeToString(s.SpanId[:]))
+}
+
+type spanKey struct{}
+
+// ContextWithSpan returns the context with the current span.
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+// SpanFromContext returns the current span or nil if the request is not traced.
+func SpanFromContext(ctx context.Context) *Span {
+	if ctx == nil {
+		return nil
+	}
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// SpanExporter exports spans of finished requests, e.g. OtlpExporter.
+type SpanExporter interface {
+	Export(spans []*Span)
+}
+
+// Tracing traces requests: handling, loading of the source, waiting in the queue, transformation,
+// processor commands and writing of the response. Trace context of traceparent header is continued
+// and propagated to origins, so spans are linked with spans of other services.
+type Tracing struct {
+	Exporter SpanExporter
+	// SamplePercent is the percentage of requests without traceparent header that are traced.
+	// Requests with traceparent are traced if the parent is sampled.
+	SamplePercent float64
+}
+
+// start returns the started server span of the request or nil if the request is not sampled.
+func (t *Tracing) start(req *http.Request) *Span {
+	span := &Span{Kind: SpanKindServer, StartTime: time.Now(), trace: &trace{}}
+	if traceId, parentId, sampled, ok := parseTraceParent(req.Header.Get(TraceParentHeader)); ok {
+		if !sampled {
+			return nil
+		}
+		span.TraceId, span.ParentId = traceId, parentId
+	} else {
+		if t.SamplePercent <= 0 || mathrand.Float64()*100 >= t.SamplePercent {
+			return nil
+		}
+		_, _ = rand.Read(span.TraceId[:])
+	}
+	_, _ = rand.Read(span.SpanId[:])
+	return span
+}
+
+// parseTraceParent parses traceparent header, e.g. 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01.
+func parseTraceParent(header string) (traceId [16]byte, parentId [8]byte, sampled bool, ok bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return traceId, parentId, false, false
+	}
+	if _, err := hex.Decode(traceId[:], []byte(parts[1])); err != nil || traceId == [16]byte{} {
+		return traceId, parentId, false, false
+	}
+	if _, err := hex.Decode(parentId[:], []byte(parts[2])); err != nil || parentId == [8]byte{} {
+		return traceId, parentId, false, false
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return traceId, parentId, false, false
+	}
+	return traceId, parentId, flags&1 == 1, true
+}
+
+// statusWriter records the status code of the response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// traceHandler returns the handler that traces requests of the route if Service.Tracing is set.
+func (r *Service) traceHandler(route Route, next http.HandlerFunc) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		span := r.Tracing.start(req)
+		if span == nil {
+			next(resp, req)
+			return
+		}
+		span.Name = req.Method + " " + route.Name
+		span.SetAttribute("http.request.method", req.Method)
+		span.SetAttribute("http.route", route.Pattern)
+
+		w := &statusWriter{ResponseWriter: resp}
+		next(w, req.WithContext(ContextWithSpan(req.Context(), span)))
+
+		if w.status == 0 {
+			w.status = http.StatusOK
+		}
+		span.SetAttribute("http.response.status_code", strconv.Itoa(w.status))
+		if w.status >= http.StatusInternalServerError {
+			span.Err = http.StatusText(w.status)
+		}
+		span.End()
+
+		span.trace.mu.Lock()
+		spans := span.trace.spans
+		span.trace.mu.Unlock()
+		r.Tracing.Exporter.Export(spans)
+	}
+}
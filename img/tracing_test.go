@@ -0,0 +1,167 @@
+package img_test
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/Pixboost/transformimgs/v8/img"
+	"github.com/dooman87/kolibri/test"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type spansRecorder struct {
+	mu    sync.Mutex
+	spans []*img.Span
+}
+
+func (r *spansRecorder) Export(spans []*img.Span) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, spans...)
+}
+
+func (r *spansRecorder) byName() map[string]*img.Span {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	spans := make(map[string]*img.Span)
+	for _, s := range r.spans {
+		spans[s.Name] = s
+	}
+	return spans
+}
+
+// traceLoader records traceparent of the context of loads.
+type traceLoader struct {
+	loaderMock
+	traceParent string
+}
+
+func (l *traceLoader) Load(url string, ctx context.Context) (*img.Image, error) {
+	l.traceParent = img.SpanFromContext(ctx).TraceParent()
+	return l.loaderMock.Load(url, ctx)
+}
+
+func TestService_Tracing(t *testing.T) {
+	recorder := &spansRecorder{}
+	loader := &traceLoader{}
+	s, err := img.NewService(loader, &resizerMock{}, 1)
+	if err != nil {
+		t.Fatalf("could not create service: %s", err)
+	}
+	s.Tracing = &img.Tracing{Exporter: recorder, SamplePercent: 100}
+	test.Service = s.GetRouter().ServeHTTP
+	test.T = t
+
+	req := httptest.NewRequest("GET", "http://localhost/img/http%3A%2F%2Fsite.com/img.png/resize?size=300", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	test.RunRequests([]test.TestCase{
+		{
+			Request:     req,
+			Description: "Traced request",
+		},
+	})
+
+	spans := recorder.byName()
+	names := make([]string, 0, len(spans))
+	for name := range spans {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	root, load, queue, transform, write := spans["GET resize"], spans["load"], spans["queue"], spans["transform"], spans["write"]
+	if root == nil || load == nil || queue == nil || transform == nil || write == nil {
+		t.Fatalf("expected spans of the request, but got %v", names)
+	}
+
+	test.Error(t,
+		test.Equal("GET resize,load,queue,transform,write", strings.Join(names, ","), "names of spans"),
+		test.Equal("4bf92f3577b34da6a3ce929d0e0e4736", hex.EncodeToString(transform.TraceId[:]), "trace id"),
+		test.Equal("00f067aa0ba902b7", hex.EncodeToString(root.ParentId[:]), "parent of the request"),
+		test.Equal(root.SpanId, load.ParentId, "parent of load"),
+		test.Equal(root.SpanId, queue.ParentId, "parent of queue"),
+		test.Equal(root.SpanId, transform.ParentId, "parent of transform"),
+		test.Equal(root.SpanId, write.ParentId, "parent of write"),
+		test.Equal(img.SpanKindServer, root.Kind, "kind of the request span"),
+		test.Equal(img.SpanKindClient, load.Kind, "kind of load span"),
+		test.Equal("200", root.Attributes["http.response.status_code"], "status code"),
+		test.Equal("/img/{imgUrl:.*}/resize", root.Attributes["http.route"], "route"),
+		test.Equal("resize", transform.Attributes["transformimgs.op"], "operation"),
+		test.Equal(load.TraceParent(), loader.traceParent, "trace context of the loader"),
+		test.Equal(false, transform.StartTime.IsZero() || transform.EndTime.Before(transform.StartTime), "time of transform"),
+	)
+}
+
+func TestService_TracingSampling(t *testing.T) {
+	recorder := &spansRecorder{}
+	s := createService(t)
+	s.Tracing = &img.Tracing{Exporter: recorder}
+	test.Service = s.GetRouter().ServeHTTP
+	test.T = t
+
+	notSampled := httptest.NewRequest("GET", "http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise", nil)
+	notSampled.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	invalid := httptest.NewRequest("GET", "http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise", nil)
+	invalid.Header.Set("traceparent", "00-00000000000000000000000000000000-00f067aa0ba902b7-01")
+	test.RunRequests([]test.TestCase{
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise",
+			Description: "Request without trace context",
+		},
+		{
+			Request:     notSampled,
+			Description: "Parent is not sampled",
+		},
+		{
+			Request:     invalid,
+			Description: "Invalid trace context",
+		},
+	})
+
+	if len(recorder.spans) != 0 {
+		t.Errorf("expected no spans, but got %d", len(recorder.spans))
+	}
+}
+
+func TestOtlpExporter_Export(t *testing.T) {
+	requests := make(chan map[string]interface{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var request map[string]interface{}
+		_ = json.Unmarshal(body, &request)
+		requests <- request
+	}))
+	defer server.Close()
+
+	span := &img.Span{
+		Name:       "GET resize",
+		Kind:       img.SpanKindServer,
+		StartTime:  time.Unix(1, 0),
+		EndTime:    time.Unix(2, 0),
+		Attributes: map[string]string{"http.route": "/img/{imgUrl:.*}/resize"},
+		Err:        "Internal Server Error",
+	}
+	span.TraceId[0], span.SpanId[0] = 1, 2
+	img.NewOtlpExporter(server.URL, "images").Export([]*img.Span{span})
+
+	var request map[string]interface{}
+	select {
+	case request = <-requests:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected request to the collector")
+	}
+	encoded, _ := json.Marshal(request)
+
+	test.Error(t,
+		test.Equal(`{"resourceSpans":[{"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"images"}}]},`+
+			`"scopeSpans":[{"scope":{"name":"github.com/Pixboost/transformimgs"},"spans":[{"attributes":[{"key":"http.route","value":{"stringValue":"/img/{imgUrl:.*}/resize"}}],`+
+			`"endTimeUnixNano":"2000000000","kind":2,"name":"GET resize","spanId":"0200000000000000","startTimeUnixNano":"1000000000",`+
+			`"status":{"code":2,"message":"Internal Server Error"},"traceId":"01000000000000000000000000000000"}]}]}]}`,
+			string(encoded), "OTLP request"),
+	)
+}
@@ -0,0 +1,22 @@
+package img
+
+import (
+	"net/http"
+)
+
+// Transcoder is implemented by processors that could convert images to the format supported
+// by the client without other changes, e.g. for /asis?format=auto.
+type Transcoder interface {
+	// Transcode converts the image to one of input.SupportedFormats keeping its size and quality.
+	// The source is returned as is if it's already in the best format or the converted image is bigger.
+	Transcode(input *TransformationConfig) (*Image, error)
+}
+
+// transcode converts the image using the processor or returns 501 error if processor is not a Transcoder.
+func transcode(p Processor, config *TransformationConfig) (*Image, error) {
+	transcoder, ok := p.(Transcoder)
+	if !ok {
+		return nil, NewHttpError(http.StatusNotImplemented, "processor doesn't support transcode")
+	}
+	return transcoder.Transcode(config)
+}
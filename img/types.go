@@ -1,11 +1,39 @@
 package img
 
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
 type Image struct {
 	// Id of the image mainly used for debugging purposes.
 	// Could be a URL of the image or a filename.
 	Id       string
 	Data     []byte
 	MimeType string
+	// Width and Height are the dimensions of the image in pixels.
+	// Zero if dimensions are not known.
+	Width  int
+	Height int
+	// Frames is the number of frames, more than 1 for animated images.
+	// Zero if the number of frames is not known.
+	Frames int
+	// CacheControl and Expires are headers of the origin response of source images,
+	// see ServiceConfig.OriginCacheControl. Empty if not known.
+	CacheControl string
+	Expires      string
+	// RobotsTag is X-Robots-Tag header of the origin response, see ServiceConfig.OriginOptOut.
+	RobotsTag string
+	// NoStore is true if responses with the image must not be cached, e.g. the untransformed
+	// source that CircuitBreaker returns while the circuit is open or the source that is served
+	// before the verdict of async Moderation. Results of sources with NoStore are not cached either.
+	NoStore bool
+
+	// buf is the pooled buffer backing Data, see NewPooledImage
+	buf *bytes.Buffer
 }
 
 // Info holds basic information about an image.
@@ -23,6 +51,50 @@ type Info struct {
 	Illustration bool
 	// Size is the size of the image in bytes
 	Size int64
+	// ColorSpace is the color space of the image, e.g. sRGB, CMYK, Gray.
+	ColorSpace string
+	// Profiles is the list of embedded profiles, e.g. icc, exif.
+	Profiles []string
+	// ColorProfile is the description of embedded ICC profile, e.g. Display P3.
+	ColorProfile string
+	// Frames is the number of frames, more than 1 for animated images.
+	Frames int
+	// Orientation is EXIF orientation of the image, e.g. TopLeft or RightTop. Empty or Undefined if not set.
+	Orientation string
+	// Delay is the delay of the first frame of animated images in 1/100 of a second.
+	Delay int
+	// Grayscale is true if all pixels of the image are gray, e.g. black and white logos.
+	Grayscale bool
+	// BinaryAlpha is true if pixels of the image are either fully transparent or fully opaque, e.g. icons.
+	BinaryAlpha bool
+	// Colors is the number of unique colors of the image. Zero if not known.
+	Colors int
+}
+
+// HasProfile returns true if the image has embedded profile with the given name, e.g. icc.
+func (i *Info) HasProfile(name string) bool {
+	for _, p := range i.Profiles {
+		if strings.EqualFold(p, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Debug describes decisions made by a processor during the transformation.
+type Debug struct {
+	// Source is the information about the source image.
+	Source *Info
+	// Target is the information about the output image before encoding.
+	Target *Info
+	// MimeType is the MIME type of the output image. Empty if the format of the source is kept.
+	MimeType string
+	// Quality is the encoder quality of the output image. Zero if the default quality is used.
+	Quality int
+	// Args are the arguments of the ImageMagick command that produced the output image.
+	Args []string
+	// Original is true if the source image is returned, because it's smaller than the output.
+	Original bool
 }
 
 // HttpError is user defined error that could be used for
@@ -43,3 +115,49 @@ func (e *HttpError) Code() int {
 func (e *HttpError) Error() string {
 	return e.msg
 }
+
+// Categories of errors. Loaders and processors wrap them with details, e.g.
+// fmt.Errorf("%w: animation has too many frames", img.ErrTooLarge), so the service
+// responds with the status code of the category.
+var (
+	// ErrOriginNotFound is returned when the source image doesn't exist on the origin.
+	ErrOriginNotFound = NewHttpError(http.StatusNotFound, "source image is not found")
+	// ErrUnsupportedFormat is returned when the source image could not be read.
+	ErrUnsupportedFormat = NewHttpError(http.StatusUnsupportedMediaType, "source image is not supported or corrupted")
+	// ErrTooLarge is returned when the image exceeds limits.
+	ErrTooLarge = NewHttpError(http.StatusRequestEntityTooLarge, "image is too large")
+	// ErrEncodeFailed is returned when the processor fails to transform the image.
+	ErrEncodeFailed = NewHttpError(http.StatusInternalServerError, "image could not be encoded")
+)
+
+// ErrorCategory returns the name of the error category for logs and alerts: "origin_not_found",
+// "unsupported_format", "too_large", "encode_failed" or "other".
+func ErrorCategory(err error) string {
+	switch {
+	case errors.Is(err, ErrOriginNotFound):
+		return "origin_not_found"
+	case errors.Is(err, ErrUnsupportedFormat):
+		return "unsupported_format"
+	case errors.Is(err, ErrTooLarge):
+		return "too_large"
+	case errors.Is(err, ErrEncodeFailed):
+		return "encode_failed"
+	}
+	return "other"
+}
+
+// CommandError is the error of the external command, e.g. ImageMagick convert, with its standard error output.
+type CommandError struct {
+	// Command is the name of the command, e.g. "convert".
+	Command string
+	Err     error
+	Stderr  string
+}
+
+func (e *CommandError) Error() string {
+	return fmt.Sprintf("Error executing %s command: %s\nStderr: [%s]", e.Command, e.Err, e.Stderr)
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
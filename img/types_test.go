@@ -0,0 +1,100 @@
+package img_test
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Pixboost/transformimgs/v8/img"
+	"github.com/dooman87/kolibri/test"
+	"net/http"
+	"testing"
+)
+
+func TestInfo_HasProfile(t *testing.T) {
+	info := &img.Info{Profiles: []string{"exif", "ICC"}}
+
+	test.Error(t,
+		test.Equal(true, info.HasProfile("icc"), "icc profile"),
+		test.Equal(true, info.HasProfile("exif"), "exif profile"),
+		test.Equal(false, info.HasProfile("xmp"), "xmp profile"),
+		test.Equal(false, (&img.Info{}).HasProfile("icc"), "no profiles"),
+	)
+}
+
+func TestDevicePixels(t *testing.T) {
+	test.Error(t,
+		test.Equal(300, img.DevicePixels(300, 0), "unknown dppx"),
+		test.Equal(300, img.DevicePixels(300, 1), "dppx=1"),
+		test.Equal(600, img.DevicePixels(300, 2), "dppx=2"),
+		test.Equal(788, img.DevicePixels(300, 2.625), "dppx=2.625"),
+	)
+}
+
+func TestResizeConfig_ScaledSize(t *testing.T) {
+	scaled := func(size string, dppx float64) string {
+		result, err := (&img.ResizeConfig{Size: size}).ScaledSize(dppx)
+		if err != nil {
+			return err.Error()
+		}
+		return result
+	}
+
+	test.Error(t,
+		test.Equal("600x400", scaled("300x200", 2), "width and height"),
+		test.Equal("788", scaled("300", 2.625), "width"),
+		test.Equal("x400", scaled("x200", 2), "height"),
+		test.Equal("300x200", scaled("300x200", 0), "unknown dppx"),
+		test.Equal("invalid size [99999999999999999999]: strconv.Atoi: parsing \"99999999999999999999\": value out of range", scaled("99999999999999999999", 2), "too big"),
+	)
+}
+
+func TestTransformationConfig_LimitSize(t *testing.T) {
+	size := func(config *img.TransformationConfig, width int, height int) string {
+		w, h := config.LimitSize(width, height)
+		return fmt.Sprintf("%dx%d", w, h)
+	}
+
+	test.Error(t,
+		test.Equal("300x200", size(&img.TransformationConfig{}, 300, 200), "no limits"),
+		test.Equal("150x100", size(&img.TransformationConfig{Scale: 0.5}, 300, 200), "half resolution"),
+		test.Equal("100x67", size(&img.TransformationConfig{MaxSize: 100}, 300, 200), "max size"),
+		test.Equal("300x200", size(&img.TransformationConfig{MaxSize: 500}, 300, 200), "smaller than max size"),
+		test.Equal("100x67", size(&img.TransformationConfig{Scale: 0.5, MaxSize: 100}, 300, 200), "half resolution and max size"),
+		test.Equal("1x50", size(&img.TransformationConfig{Scale: 0.5}, 1, 100), "at least 1 pixel"),
+	)
+}
+
+func TestTransformationConfig_OutputFrames(t *testing.T) {
+	frames := func(config *img.TransformationConfig, frames int) string {
+		return fmt.Sprintf("%d/%d", config.OutputFrames(frames), config.FrameStep(frames))
+	}
+
+	test.Error(t,
+		test.Equal("10/1", frames(&img.TransformationConfig{}, 10), "no limits"),
+		test.Equal("1/1", frames(&img.TransformationConfig{Static: true}, 10), "static"),
+		test.Equal("10/1", frames(&img.TransformationConfig{MaxFrames: 10}, 10), "within limit"),
+		test.Equal("5/2", frames(&img.TransformationConfig{MaxFrames: 5}, 10), "every second frame"),
+		test.Equal("4/3", frames(&img.TransformationConfig{MaxFrames: 4}, 10), "every third frame"),
+		test.Equal("1/1", frames(&img.TransformationConfig{MaxFrames: 4}, 1), "still image"),
+	)
+}
+
+func TestErrorCategory(t *testing.T) {
+	code := func(err error) int {
+		var httpErr *img.HttpError
+		if errors.As(err, &httpErr) {
+			return httpErr.Code()
+		}
+		return 0
+	}
+	tooLarge := fmt.Errorf("%w, animation has [100] frames", img.ErrTooLarge)
+
+	test.Error(t,
+		test.Equal("origin_not_found", img.ErrorCategory(fmt.Errorf("%w: got 410", img.ErrOriginNotFound)), "origin not found"),
+		test.Equal("unsupported_format", img.ErrorCategory(img.ErrUnsupportedFormat), "unsupported format"),
+		test.Equal("too_large", img.ErrorCategory(tooLarge), "too large"),
+		test.Equal("encode_failed", img.ErrorCategory(fmt.Errorf("%w: exit status 1", img.ErrEncodeFailed)), "encode failed"),
+		test.Equal("other", img.ErrorCategory(errors.New("error")), "other"),
+		test.Equal(http.StatusRequestEntityTooLarge, code(tooLarge), "status code of wrapped error"),
+		test.Equal("image is too large, animation has [100] frames", tooLarge.Error(), "message"),
+	)
+}
@@ -0,0 +1,44 @@
+package img
+
+import (
+	"net/http"
+)
+
+// Upscaler is implemented by processors that could enlarge images using high-quality algorithms,
+// e.g. legacy small assets that must be displayed larger on retina screens.
+type Upscaler interface {
+	// Upscale resizes the image to the size from ResizeConfig passed in input.Config preserving
+	// aspect ratio. The format of the size is the same as for Resize.
+	Upscale(input *TransformationConfig) (*Image, error)
+}
+
+// upscale enlarges the image using the processor or returns 501 error if processor is not an Upscaler.
+func upscale(p Processor, config *TransformationConfig) (*Image, error) {
+	upscaler, ok := p.(Upscaler)
+	if !ok {
+		return nil, NewHttpError(http.StatusNotImplemented, "processor doesn't support upscale")
+	}
+	return upscaler.Upscale(config)
+}
+
+// UpscaleUrl enlarges the image to the size from size query param using high-quality algorithm
+// of the processor. Responds with 501 if the processor is not an Upscaler.
+func (r *Service) UpscaleUrl(resp http.ResponseWriter, req *http.Request) {
+	upscaler, ok := r.Processor.(Upscaler)
+	if !ok {
+		http.Error(resp, "processor doesn't support upscale", http.StatusNotImplemented)
+		return
+	}
+
+	size, _ := getQueryParam(req.URL, "size")
+	if len(size) == 0 {
+		http.Error(resp, "size param is required", http.StatusBadRequest)
+		return
+	}
+	if err := r.validateSize(size, false); err != nil {
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	r.transformUrl(resp, req, "upscale", upscaler.Upscale, &ResizeConfig{Size: size})
+}
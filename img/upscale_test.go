@@ -0,0 +1,81 @@
+package img_test
+
+import (
+	"github.com/Pixboost/transformimgs/v8/img"
+	"github.com/dooman87/kolibri/test"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestService_UpscaleUrl(t *testing.T) {
+	s := createService(t)
+	s.Savings = img.NewSavings()
+	test.Service = s.GetRouter().ServeHTTP
+	test.T = t
+
+	testCases := []test.TestCase{
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/upscale?size=1200",
+			Description: "Success",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal(ImgUpscaled, w.Body.String(), "Resulted image"),
+					test.Equal("image/png", w.Header().Get("Content-Type"), "Content-Type header"),
+				)
+			},
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/upscale",
+			Description:  "Size is required",
+			ExpectedCode: http.StatusBadRequest,
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/upscale?size=abc",
+			Description:  "Invalid size",
+			ExpectedCode: http.StatusBadRequest,
+		},
+	}
+	test.RunRequests(testCases)
+
+	stats := s.Savings.Stats()
+	if len(stats) != 1 || stats[0].Op != "upscale" {
+		t.Errorf("expected upscale to be counted, but got %+v", stats)
+	}
+}
+
+func TestService_UpscaleUrl_NotSupported(t *testing.T) {
+	s, err := img.NewService(&loaderMock{}, &processorOnly{&resizerMock{}}, 1)
+	if err != nil {
+		t.Fatalf("Error while creating service: %+v", err)
+	}
+	test.Service = s.GetRouter().ServeHTTP
+	test.T = t
+
+	test.RunRequests([]test.TestCase{
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/upscale?size=1200",
+			Description:  "Processor is not an upscaler",
+			ExpectedCode: http.StatusNotImplemented,
+		},
+	})
+}
+
+func TestCircuitBreaker_Upscale(t *testing.T) {
+	cb := img.NewCircuitBreaker(&resizerMock{}, 1, time.Second)
+	result, err := cb.Upscale(&img.TransformationConfig{
+		Src:    &img.Image{Data: []byte(ImgSrc)},
+		Config: &img.ResizeConfig{Size: "1200"},
+	})
+	if err != nil || string(result.Data) != ImgUpscaled {
+		t.Errorf("expected upscaled image, but got %v, %v", result, err)
+	}
+
+	_, err = img.NewCircuitBreaker(&processorOnly{&resizerMock{}}, 1, time.Second).Upscale(&img.TransformationConfig{
+		Src: &img.Image{Data: []byte(ImgSrc)},
+	})
+	test.Error(t,
+		test.NotNil(err, "error"),
+	)
+}
@@ -0,0 +1,152 @@
+package img
+
+import (
+	"container/list"
+	"net/http"
+	"sync"
+)
+
+// VariantCache keeps recent results of high density (dppx >= HighDensityDppx) resize and fit
+// transformations, so lower density variants of the same image are derived by downscaling the cached
+// result instead of loading and decoding the source image, which is usually much bigger.
+// It's used by Service when ScaleByDppx is set, because otherwise variants have the same size.
+// Derived variants are encoded twice, so their quality could be slightly lower.
+type VariantCache struct {
+	// MaxBytes is the maximum total size of cached results. The least recently used results are evicted.
+	MaxBytes int64
+
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List
+	entries map[string]*list.Element
+	hits    uint64
+	misses  uint64
+}
+
+type variantEntry struct {
+	key   string
+	image *Image
+}
+
+// VariantCacheStats are counters of VariantCache.
+type VariantCacheStats struct {
+	Entries int    `json:"entries"`
+	Bytes   int64  `json:"bytes"`
+	Hits    uint64 `json:"hits"`
+	Misses  uint64 `json:"misses"`
+}
+
+// NewVariantCache creates the cache limited by the total size of results in bytes.
+func NewVariantCache(maxBytes int64) *VariantCache {
+	return &VariantCache{
+		MaxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// Stats returns counters of the cache.
+func (c *VariantCache) Stats() VariantCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return VariantCacheStats{Entries: len(c.entries), Bytes: c.size, Hits: c.hits, Misses: c.misses}
+}
+
+// get returns the copy of the cached result or nil. Data of the copy must not be modified.
+func (c *VariantCache) get(key string) *Image {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		c.misses++
+		return nil
+	}
+	c.hits++
+	c.lru.MoveToFront(e)
+	cached := *e.Value.(*variantEntry).image
+	return &cached
+}
+
+// put caches the copy of the result. Results bigger than MaxBytes are not cached.
+func (c *VariantCache) put(key string, result *Image) {
+	size := int64(len(result.Data))
+	if size == 0 || size > c.MaxBytes {
+		return
+	}
+	image := &Image{
+		Id:           result.Id,
+		Data:         append([]byte(nil), result.Data...),
+		MimeType:     result.MimeType,
+		CacheControl: result.CacheControl,
+		Expires:      result.Expires,
+		RobotsTag:    result.RobotsTag,
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.size -= int64(len(e.Value.(*variantEntry).image.Data))
+		e.Value.(*variantEntry).image = image
+		c.lru.MoveToFront(e)
+	} else {
+		c.entries[key] = c.lru.PushFront(&variantEntry{key: key, image: image})
+	}
+	c.size += size
+
+	for c.size > c.MaxBytes {
+		oldest := c.lru.Back()
+		entry := oldest.Value.(*variantEntry)
+		c.lru.Remove(oldest)
+		delete(c.entries, entry.key)
+		c.size -= int64(len(entry.image.Data))
+	}
+}
+
+// variantKey returns the key of the variant in VariantCache: the operation, the source and
+// query params without dppx.
+func variantKey(req *http.Request, opName string, imgUrl string) string {
+	query := req.URL.Query()
+	query.Del("dppx")
+	return opName + " " + imgUrl + "?" + query.Encode()
+}
+
+// storeVariant returns the transformation that caches its successful results with the key.
+func (c *VariantCache) storeVariant(key string, transformation Cmd) Cmd {
+	return func(input *TransformationConfig) (*Image, error) {
+		result, err := transformation(input)
+		if err == nil && result != nil {
+			// Variants derived from the result are cached as the source
+			c.put(key, &Image{
+				Id:           result.Id,
+				Data:         result.Data,
+				MimeType:     result.MimeType,
+				CacheControl: input.Src.CacheControl,
+				Expires:      input.Src.Expires,
+				RobotsTag:    input.Src.RobotsTag,
+			})
+		}
+		return result, err
+	}
+}
+
+// loadVariant returns the cached variant as the source image for the request. Load hooks are
+// executed, so source policies are applied, but the source is not loaded. Returns nil if
+// the variant is not cached.
+func (r *Service) loadVariant(req *http.Request, imgUrl string, key string) (*Image, error) {
+	cached := r.Variants.get(key)
+	if cached == nil {
+		return nil, nil
+	}
+	cached.Id = imgUrl
+
+	if r.Status != nil {
+		r.Status.addSource(imgUrl)
+	}
+	if err := r.preLoad(req, imgUrl); err != nil {
+		return nil, err
+	}
+	if err := r.postLoad(req, cached); err != nil {
+		return nil, err
+	}
+	return cached, nil
+}
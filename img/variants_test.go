@@ -0,0 +1,100 @@
+package img_test
+
+import (
+	"github.com/Pixboost/transformimgs/v8/img"
+	"github.com/dooman87/kolibri/test"
+	"net/http/httptest"
+	"testing"
+)
+
+// variantsProcessor returns the size and the source of the transformation as the result.
+type variantsProcessor struct{}
+
+func (p *variantsProcessor) Resize(config *img.TransformationConfig) (*img.Image, error) {
+	return &img.Image{
+		Data:     []byte(config.Config.(*img.ResizeConfig).Size + " from " + string(config.Src.Data)),
+		MimeType: "image/png",
+	}, nil
+}
+
+func (p *variantsProcessor) FitToSize(config *img.TransformationConfig) (*img.Image, error) {
+	return p.Resize(config)
+}
+
+func (p *variantsProcessor) Optimise(config *img.TransformationConfig) (*img.Image, error) {
+	return config.Src, nil
+}
+
+func TestService_Variants(t *testing.T) {
+	s, err := img.NewService(&loaderMock{}, &variantsProcessor{}, 1)
+	if err != nil {
+		t.Fatalf("could not create service: %s", err)
+	}
+	s.ScaleByDppx = true
+	s.Variants = img.NewVariantCache(1024)
+	test.Service = s.GetRouter().ServeHTTP
+	test.T = t
+
+	expectImage := func(expected string) func(w *httptest.ResponseRecorder, t *testing.T) {
+		return func(w *httptest.ResponseRecorder, t *testing.T) {
+			test.Error(t,
+				test.Equal(expected, w.Body.String(), "Resulted image"),
+			)
+		}
+	}
+
+	test.RunRequests([]test.TestCase{
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/resize?size=150&dppx=1",
+			Description: "Not cached",
+			Handler:     expectImage("150 from " + ImgSrc),
+		},
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/resize?size=150&dppx=2",
+			Description: "High density variant",
+			Handler:     expectImage("300 from " + ImgSrc),
+		},
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/resize?size=150&dppx=1",
+			Description: "Derived from high density variant",
+			Handler:     expectImage("150 from 300 from " + ImgSrc),
+		},
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/fit?size=150x100&dppx=1",
+			Description: "Other operation",
+			Handler:     expectImage("150x100 from " + ImgSrc),
+		},
+		{
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/img.png/resize?size=200&dppx=1",
+			Description: "Other size",
+			Handler:     expectImage("200 from " + ImgSrc),
+		},
+	})
+
+	stats := s.Variants.Stats()
+	if stats.Entries != 1 || stats.Hits != 1 || stats.Misses != 3 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestVariantCache_Eviction(t *testing.T) {
+	s, err := img.NewService(&loaderMock{}, &variantsProcessor{}, 1)
+	if err != nil {
+		t.Fatalf("could not create service: %s", err)
+	}
+	s.ScaleByDppx = true
+	// Fits only one variant of "300 from 321"
+	s.Variants = img.NewVariantCache(20)
+	test.Service = s.GetRouter().ServeHTTP
+	test.T = t
+
+	test.RunRequests([]test.TestCase{
+		{Url: "http://localhost/img/http%3A%2F%2Fsite.com/img.png/resize?size=150&dppx=2"},
+		{Url: "http://localhost/img/http%3A%2F%2Fsite.com/img2.png/resize?size=150&dppx=2"},
+	})
+
+	stats := s.Variants.Stats()
+	if stats.Entries != 1 || stats.Bytes != int64(len("300 from "+NoContentTypeImgSrc)) {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
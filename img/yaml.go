@@ -0,0 +1,183 @@
+package img
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// yamlLine is a non-empty line of YAML document in the form "key: value".
+type yamlLine struct {
+	num    int
+	indent int
+	key    string
+	value  string
+}
+
+// parseYaml parses the subset of YAML that is used in configuration files: nested block
+// mappings with plain, single-quoted or double-quoted scalars and comments. Sequences, flow
+// collections, multiline scalars, anchors and tags are not supported.
+// Scalars are converted to bool, int64, float64 or string, empty values to nil.
+func parseYaml(data []byte) (map[string]interface{}, error) {
+	var lines []yamlLine
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(stripYamlComment(line), " \t\r")
+		trimmed := strings.TrimLeft(line, " ")
+		if len(trimmed) == 0 || trimmed == "---" {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "\t") {
+			return nil, fmt.Errorf("line %d: tabs are not allowed for indentation", i+1)
+		}
+
+		key, value, err := splitYamlLine(trimmed)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+		lines = append(lines, yamlLine{
+			num:    i + 1,
+			indent: len(line) - len(trimmed),
+			key:    key,
+			value:  value,
+		})
+	}
+
+	if len(lines) == 0 {
+		return map[string]interface{}{}, nil
+	}
+	result, _, err := parseYamlMapping(lines, 0, lines[0].indent)
+	return result, err
+}
+
+// parseYamlMapping parses lines with the given indent starting from pos.
+// Returns the mapping and the position of the first line that doesn't belong to it.
+func parseYamlMapping(lines []yamlLine, pos int, indent int) (map[string]interface{}, int, error) {
+	result := make(map[string]interface{})
+	for pos < len(lines) {
+		line := lines[pos]
+		if line.indent < indent {
+			break
+		}
+		if line.indent > indent {
+			return nil, pos, fmt.Errorf("line %d: unexpected indentation", line.num)
+		}
+		if _, ok := result[line.key]; ok {
+			return nil, pos, fmt.Errorf("line %d: duplicate key [%s]", line.num, line.key)
+		}
+
+		pos++
+		if len(line.value) > 0 {
+			value, err := parseYamlScalar(line.value)
+			if err != nil {
+				return nil, pos, fmt.Errorf("line %d: %w", line.num, err)
+			}
+			result[line.key] = value
+			continue
+		}
+		if pos < len(lines) && lines[pos].indent > indent {
+			var (
+				value map[string]interface{}
+				err   error
+			)
+			value, pos, err = parseYamlMapping(lines, pos, lines[pos].indent)
+			if err != nil {
+				return nil, pos, err
+			}
+			result[line.key] = value
+			continue
+		}
+		result[line.key] = nil
+	}
+
+	return result, pos, nil
+}
+
+// splitYamlLine splits the line without indentation into the key and the value.
+func splitYamlLine(line string) (string, string, error) {
+	quote := byte(0)
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case (c == '"' || c == '\'') && (i == 0 || line[i-1] == ' '):
+			quote = c
+		case c == ':' && (i == len(line)-1 || line[i+1] == ' '):
+			if i == 0 {
+				return "", "", fmt.Errorf("key is empty")
+			}
+			key, err := parseYamlScalar(strings.TrimSpace(line[:i]))
+			if err != nil {
+				return "", "", err
+			}
+			keyStr, ok := key.(string)
+			if !ok || len(keyStr) == 0 {
+				keyStr = strings.TrimSpace(line[:i])
+			}
+			return keyStr, strings.TrimSpace(line[i+1:]), nil
+		}
+	}
+	return "", "", fmt.Errorf("expected 'key: value', but got [%s]", line)
+}
+
+func parseYamlScalar(value string) (interface{}, error) {
+	switch value[0] {
+	case '"':
+		s, err := strconv.Unquote(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid double-quoted string [%s]", value)
+		}
+		return s, nil
+	case '\'':
+		if len(value) < 2 || value[len(value)-1] != '\'' {
+			return nil, fmt.Errorf("invalid single-quoted string [%s]", value)
+		}
+		return strings.ReplaceAll(value[1:len(value)-1], "''", "'"), nil
+	case '[', '{', '|', '>', '&', '*', '!', '-':
+		if value[0] != '-' || value == "-" || strings.HasPrefix(value, "- ") {
+			return nil, fmt.Errorf("unsupported value [%s]", value)
+		}
+	}
+
+	switch value {
+	case "~", "null":
+		return nil, nil
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	if i, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return i, nil
+	}
+	if f, err := strconv.ParseFloat(value, 64); err == nil {
+		return f, nil
+	}
+	return value, nil
+}
+
+// stripYamlComment removes the comment that starts with # outside of quotes
+// at the beginning of the line or after a whitespace.
+func stripYamlComment(line string) string {
+	quote := byte(0)
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case (c == '"' || c == '\'') && (i == 0 || line[i-1] == ' '):
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
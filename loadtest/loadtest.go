@@ -0,0 +1,300 @@
+// Package loadtest replays a manifest of transformation requests against
+// a running instance of the service and reports latency percentiles,
+// queue wait and bytes saved, so the impact of configuration changes could be benchmarked.
+package loadtest
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config is the configuration of the load test.
+type Config struct {
+	// Target is the base URL of the running instance, e.g. http://localhost:8080
+	Target string
+	// Manifest is the list of request paths, e.g. /img/https://site.com/img.png/resize?size=300.
+	// Requests are replayed in round-robin order.
+	Manifest []string
+	// Requests is the total number of requests to send. Defaults to the size of the manifest.
+	Requests int
+	// Concurrency is the number of requests in flight. Defaults to 1.
+	Concurrency int
+	// Headers will be sent with each request, e.g. Accept.
+	Headers http.Header
+	// CompareAsIs is the flag to load the original image using /asis endpoint,
+	// so the bytes saved could be reported.
+	CompareAsIs bool
+	// Client is the HTTP client to use. Defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+// Percentiles holds the latency distribution.
+type Percentiles struct {
+	P50 time.Duration
+	P90 time.Duration
+	P99 time.Duration
+	Max time.Duration
+}
+
+// Report is the result of the load test.
+type Report struct {
+	Requests int
+	Errors   int
+	Duration time.Duration
+	Latency  Percentiles
+	// QueueWait is the time requests spent in the queue of the service.
+	// It's only available when the service has Server-Timing enabled.
+	QueueWait Percentiles
+	// BytesOut is the total size of transformed images.
+	BytesOut int64
+	// BytesOriginal is the total size of original images. Only available when Config.CompareAsIs is set.
+	BytesOriginal int64
+	// BytesCompared is the total size of transformed images whose originals are counted in BytesOriginal.
+	BytesCompared int64
+}
+
+type sample struct {
+	latency   time.Duration
+	queueWait time.Duration
+	bytesOut  int64
+	bytesOrig int64
+	err       error
+}
+
+// ReadManifest reads request paths from the reader, one per line.
+// Empty lines and lines starting with # are skipped.
+func ReadManifest(r io.Reader) ([]string, error) {
+	var manifest []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		manifest = append(manifest, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+// Run executes the load test.
+func Run(ctx context.Context, config *Config) (*Report, error) {
+	if len(config.Manifest) == 0 {
+		return nil, fmt.Errorf("manifest is empty")
+	}
+	if _, err := url.Parse(config.Target); err != nil {
+		return nil, fmt.Errorf("invalid target [%s]: %w", config.Target, err)
+	}
+
+	requests := config.Requests
+	if requests <= 0 {
+		requests = len(config.Manifest)
+	}
+	concurrency := config.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	client := config.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	var (
+		samples = make([]*sample, requests)
+		next    = make(chan int)
+		wg      sync.WaitGroup
+	)
+	start := time.Now()
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				samples[i] = runOne(ctx, client, config, config.Manifest[i%len(config.Manifest)])
+			}
+		}()
+	}
+	for i := 0; i < requests; i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	return buildReport(samples, time.Since(start)), nil
+}
+
+func runOne(ctx context.Context, client *http.Client, config *Config, path string) *sample {
+	s := &sample{}
+
+	reqStart := time.Now()
+	resp, err := get(ctx, client, config.Target+path, config.Headers)
+	s.latency = time.Since(reqStart)
+	if err != nil {
+		s.err = err
+		return s
+	}
+	s.bytesOut = resp.size
+	s.queueWait = parseQueueWait(resp.serverTiming)
+
+	if config.CompareAsIs {
+		asIsPath, ok := AsIsPath(path)
+		if ok {
+			orig, err := get(ctx, client, config.Target+asIsPath, nil)
+			if err == nil {
+				s.bytesOrig = orig.size
+			}
+		}
+	}
+
+	return s
+}
+
+type response struct {
+	size         int64
+	serverTiming string
+}
+
+func get(ctx context.Context, client *http.Client, u string, headers http.Header) (*response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range headers {
+		for _, headerVal := range v {
+			req.Header.Add(k, headerVal)
+		}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(resp.Body)
+
+	size, err := io.Copy(io.Discard, resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("expected %d but got code %d for [%s]", http.StatusOK, resp.StatusCode, u)
+	}
+
+	return &response{
+		size:         size,
+		serverTiming: resp.Header.Get("Server-Timing"),
+	}, nil
+}
+
+// AsIsPath returns the path of /asis endpoint for the same source image.
+func AsIsPath(path string) (string, bool) {
+	if idx := strings.Index(path, "?"); idx >= 0 {
+		path = path[:idx]
+	}
+	idx := strings.LastIndex(path, "/")
+	if idx <= 0 || !strings.HasPrefix(path, "/img/") {
+		return "", false
+	}
+
+	return path[:idx] + "/asis", true
+}
+
+// parseQueueWait returns the duration of "queue" metric from Server-Timing header.
+func parseQueueWait(serverTiming string) time.Duration {
+	for _, metric := range strings.Split(serverTiming, ",") {
+		parts := strings.Split(strings.TrimSpace(metric), ";")
+		if parts[0] != "queue" {
+			continue
+		}
+		for _, p := range parts[1:] {
+			if strings.HasPrefix(p, "dur=") {
+				ms, err := strconv.ParseFloat(strings.TrimPrefix(p, "dur="), 64)
+				if err == nil {
+					return time.Duration(ms * float64(time.Millisecond))
+				}
+			}
+		}
+	}
+
+	return 0
+}
+
+func buildReport(samples []*sample, duration time.Duration) *Report {
+	report := &Report{
+		Requests: len(samples),
+		Duration: duration,
+	}
+
+	var latencies, queueWaits []time.Duration
+	for _, s := range samples {
+		if s.err != nil {
+			report.Errors++
+			continue
+		}
+		latencies = append(latencies, s.latency)
+		queueWaits = append(queueWaits, s.queueWait)
+		report.BytesOut += s.bytesOut
+		if s.bytesOrig > 0 {
+			report.BytesOriginal += s.bytesOrig
+			report.BytesCompared += s.bytesOut
+		}
+	}
+	report.Latency = percentiles(latencies)
+	report.QueueWait = percentiles(queueWaits)
+
+	return report
+}
+
+func percentiles(durations []time.Duration) Percentiles {
+	if len(durations) == 0 {
+		return Percentiles{}
+	}
+	sort.Slice(durations, func(i, j int) bool {
+		return durations[i] < durations[j]
+	})
+
+	at := func(p float64) time.Duration {
+		idx := int(float64(len(durations))*p+0.5) - 1
+		if idx < 0 {
+			idx = 0
+		}
+		if idx >= len(durations) {
+			idx = len(durations) - 1
+		}
+		return durations[idx]
+	}
+
+	return Percentiles{
+		P50: at(0.5),
+		P90: at(0.9),
+		P99: at(0.99),
+		Max: durations[len(durations)-1],
+	}
+}
+
+// Print writes human-readable report.
+func (r *Report) Print(w io.Writer) {
+	_, _ = fmt.Fprintf(w, "Requests:   %d (%d errors) in %s\n", r.Requests, r.Errors, r.Duration.Round(time.Millisecond))
+	if r.Duration > 0 {
+		_, _ = fmt.Fprintf(w, "Throughput: %.2f req/s\n", float64(r.Requests)/r.Duration.Seconds())
+	}
+	_, _ = fmt.Fprintf(w, "Latency:    p50=%s p90=%s p99=%s max=%s\n", r.Latency.P50, r.Latency.P90, r.Latency.P99, r.Latency.Max)
+	_, _ = fmt.Fprintf(w, "Queue wait: p50=%s p90=%s p99=%s max=%s\n", r.QueueWait.P50, r.QueueWait.P90, r.QueueWait.P99, r.QueueWait.Max)
+	_, _ = fmt.Fprintf(w, "Bytes out:  %d\n", r.BytesOut)
+	if r.BytesOriginal > 0 {
+		_, _ = fmt.Fprintf(w, "Bytes saved: %d (%.2f%%)\n", r.BytesOriginal-r.BytesCompared, 100*(1-float64(r.BytesCompared)/float64(r.BytesOriginal)))
+	}
+}
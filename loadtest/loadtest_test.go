@@ -0,0 +1,88 @@
+package loadtest_test
+
+import (
+	"context"
+	"github.com/Pixboost/transformimgs/v8/loadtest"
+	"github.com/dooman87/kolibri/test"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadManifest(t *testing.T) {
+	manifest, err := loadtest.ReadManifest(strings.NewReader("# comment\n/img/a.png/optimise\n\n  /img/b.png/resize?size=300  \n"))
+
+	test.Error(t,
+		test.Nil(err, "error"),
+		test.Equal(2, len(manifest), "number of paths"),
+		test.Equal("/img/a.png/optimise", manifest[0], "first path"),
+		test.Equal("/img/b.png/resize?size=300", manifest[1], "second path"),
+	)
+}
+
+func TestAsIsPath(t *testing.T) {
+	path, ok := loadtest.AsIsPath("/img/https://site.com/img.png/resize?size=300")
+	_, notOk := loadtest.AsIsPath("/health")
+
+	test.Error(t,
+		test.Equal(true, ok, "resize path"),
+		test.Equal("/img/https://site.com/img.png/asis", path, "asis path"),
+		test.Equal(false, notOk, "not an image path"),
+	)
+}
+
+func TestRun(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/broken.png/asis"):
+			w.WriteHeader(http.StatusInternalServerError)
+		case strings.HasSuffix(r.URL.Path, "/asis"):
+			_, _ = w.Write([]byte("1234567890"))
+		case strings.HasSuffix(r.URL.Path, "/optimise"):
+			if r.Header.Get("Accept") != "image/webp" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Server-Timing", "queue;dur=12.5, transform;dur=100.0")
+			_, _ = w.Write([]byte("1234"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	report, err := loadtest.Run(context.Background(), &loadtest.Config{
+		Target:      server.URL,
+		Manifest:    []string{"/img/site.com/img.png/optimise", "/img/site.com/nothing.png/fit", "/img/site.com/broken.png/optimise"},
+		Requests:    6,
+		Concurrency: 2,
+		Headers:     http.Header{"Accept": {"image/webp"}},
+		CompareAsIs: true,
+	})
+
+	test.Error(t,
+		test.Nil(err, "error"),
+		test.Equal(6, report.Requests, "requests"),
+		test.Equal(2, report.Errors, "errors"),
+		test.Equal(int64(16), report.BytesOut, "bytes out"),
+		test.Equal(int64(20), report.BytesOriginal, "bytes original"),
+		test.Equal(int64(8), report.BytesCompared, "bytes compared"),
+		test.Equal(12500*time.Microsecond, report.QueueWait.P50, "queue wait"),
+	)
+
+	var out strings.Builder
+	report.Print(&out)
+	if !strings.Contains(out.String(), "Bytes saved: 12 (60.00%)") {
+		t.Errorf("unexpected report: %s", out.String())
+	}
+}
+
+func TestRun_EmptyManifest(t *testing.T) {
+	_, err := loadtest.Run(context.Background(), &loadtest.Config{})
+
+	test.Error(t,
+		test.NotNil(err, "error"),
+	)
+}
@@ -9,4 +9,4 @@ set -e
 
 cd cmd/
 echo 'Running Application'
-go run main.go -imConvert=/usr/local/bin/convert -imIdentify=/usr/local/bin/identify $@
\ No newline at end of file
+go run . -imConvert=/usr/local/bin/convert -imIdentify=/usr/local/bin/identify $@
\ No newline at end of file